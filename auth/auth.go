@@ -21,8 +21,30 @@ type AuthSys interface {
 }
 
 type User struct {
-	Name string
-	Pass string
+	Name  string
+	Pass  string
+	Attrs Attributes
+}
+
+// optional per-user settings, a key may have multiple values
+// keys are case-insensitive
+type Attributes map[string][]string
+
+// the first value of key or empty
+func (a Attributes) Get(key string) string {
+	if v := a[strings.ToLower(key)]; len(v) > 0 {
+		return v[0]
+	}
+	return ""
+}
+
+func (a Attributes) Values(key string) []string {
+	return a[strings.ToLower(key)]
+}
+
+func (a Attributes) Add(key, value string) {
+	key = strings.ToLower(key)
+	a[key] = append(a[key], value)
 }
 
 func GetAuthSysImpl(proto string) (AuthSys, error) {
@@ -6,6 +6,8 @@ import (
 	"strings"
 )
 
+// each line is user:pass
+// then the indented key=value lines are attributes of the preceding user
 type FileAuthSys struct {
 	path string
 	db   map[string]*User
@@ -19,18 +21,34 @@ func NewFileAuthSys(path string) (AuthSys, error) {
 	f, e := os.Open(path)
 	if os.IsNotExist(e) {
 		return nil, INVALID_AUTH_CONF.Apply("NotFound: " + path)
+	} else if e != nil {
+		return nil, INVALID_AUTH_CONF.Apply(e)
 	}
 	defer f.Close()
+	var last *User
 	r := bufio.NewScanner(f)
 	for r.Scan() {
 		line := r.Text()
-		if len(line) > 0 {
-			arr := strings.SplitN(line, ":", 2)
-			if len(arr) < 2 {
+		if len(strings.TrimSpace(line)) == 0 {
+			continue
+		}
+		if line[0] == ' ' || line[0] == '\t' {
+			arr := strings.SplitN(line, "=", 2)
+			if last == nil || len(arr) < 2 {
 				return nil, INVALID_AUTH_CONF.Apply("at line: " + line)
 			}
-			sys.db[arr[0]] = &User{arr[0], arr[1]}
+			last.Attrs.Add(strings.TrimSpace(arr[0]), strings.TrimSpace(arr[1]))
+			continue
+		}
+		arr := strings.SplitN(line, ":", 2)
+		if len(arr) < 2 {
+			return nil, INVALID_AUTH_CONF.Apply("at line: " + line)
 		}
+		last = &User{arr[0], arr[1], make(Attributes)}
+		sys.db[arr[0]] = last
+	}
+	if e = r.Err(); e != nil {
+		return nil, INVALID_AUTH_CONF.Apply(e)
 	}
 	return sys, nil
 }
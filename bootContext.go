@@ -104,6 +104,26 @@ func (ctx *bootContext) keyInfoCommandHandler(c *cli.Context) error {
 	return nil
 }
 
+// ./deblocus admin [-socket PATH] COMMAND [TARGET]
+func (ctx *bootContext) adminCommandHandler(c *cli.Context) error {
+	args := c.Args()
+	if len(args) < 1 {
+		fatalAndCommandHelp(c)
+	}
+	socket := c.String("socket")
+	if socket == NULL {
+		// need server config
+		ctx.initConfig(SR_SERVER)
+		if socket = ctx.cman.AdminSocket(); socket == NULL {
+			fatalError(CONF_MISS.Apply("AdminSocket"))
+		}
+	}
+	reply, err := AdminRequest(socket, args)
+	fatalError(err)
+	fmt.Println(string(reply))
+	return nil
+}
+
 func (ctx *bootContext) startCommandHandler(c *cli.Context) error {
 	if len(c.Args()) > 0 {
 		fatalAndCommandHelp(c)
@@ -169,10 +189,11 @@ func (ctx *bootContext) startServer() {
 		err  error
 	)
 
-	server := NewServer(ctx.cman)
+	server, err := NewServer(ctx.cman)
+	fatalError(err)
 	addr := ctx.cman.ListenAddr(SR_SERVER)
 
-	ln, err = net.ListenTCP("tcp", addr)
+	ln, err = server.ListenTCP(addr)
 	fatalError(err)
 	defer ln.Close()
 
@@ -180,6 +201,63 @@ func (ctx *bootContext) startServer() {
 	log.Infoln(versionString())
 	log.Infoln("Server is listening on", addr)
 
+	wsLn, err := server.ListenWebSocket()
+	fatalError(err)
+	if wsLn != nil {
+		defer wsLn.Close()
+		ctx.closeable = append(ctx.closeable, wsLn)
+		log.Infoln("Server is listening on", wsLn.Addr(), "for WebSocket")
+	}
+	h2Ln, err := server.ListenHTTP2()
+	fatalError(err)
+	if h2Ln != nil {
+		defer h2Ln.Close()
+		ctx.closeable = append(ctx.closeable, h2Ln)
+		log.Infoln("Server is listening on", h2Ln.Addr(), "for HTTP/2")
+	}
+	dnsLn, err := server.ListenDNS()
+	fatalError(err)
+	if dnsLn != nil {
+		defer dnsLn.Close()
+		ctx.closeable = append(ctx.closeable, dnsLn)
+		log.Infoln("Server is listening on", dnsLn.LocalAddr(), "for DNS tunnel")
+	}
+	kcpLn, err := server.ListenKCP()
+	fatalError(err)
+	if kcpLn != nil {
+		defer kcpLn.Close()
+		ctx.closeable = append(ctx.closeable, kcpLn)
+		log.Infoln("Server is listening on", kcpLn.LocalAddr(), "for KCP")
+	}
+	knockLn, err := server.ListenKnock()
+	fatalError(err)
+	if knockLn != nil {
+		defer knockLn.Close()
+		ctx.closeable = append(ctx.closeable, knockLn)
+		log.Infoln("Server is listening on", knockLn.LocalAddr(), "for knocks")
+	}
+	metricsLn, err := server.ListenMetrics()
+	fatalError(err)
+	if metricsLn != nil {
+		defer metricsLn.Close()
+		ctx.closeable = append(ctx.closeable, metricsLn)
+		log.Infoln("Server is listening on", metricsLn.Addr(), "for metrics")
+	}
+	adminLn, err := server.ListenAdmin()
+	fatalError(err)
+	if adminLn != nil {
+		defer adminLn.Close()
+		ctx.closeable = append(ctx.closeable, adminLn)
+		log.Infoln("Server is listening on", adminLn.Addr(), "for admin")
+	}
+	adminSock, err := server.ListenAdminSocket()
+	fatalError(err)
+	if adminSock != nil {
+		defer adminSock.Close()
+		ctx.closeable = append(ctx.closeable, adminSock)
+		log.Infoln("Server is listening on", adminSock.Addr(), "for admin")
+	}
+
 	for {
 		conn, err = ln.AcceptTCP()
 		if err == nil {
@@ -0,0 +1,116 @@
+package crypto
+
+import (
+	"crypto/cipher"
+	"encoding/binary"
+	"errors"
+	"io"
+)
+
+const (
+	CHACHA20_POLY1305_NONCE_SIZE = CHACHA_IV_SIZE
+)
+
+var (
+	ErrOpen = errors.New("chacha20poly1305: message authentication failed")
+)
+
+// the original construction of chacha20-poly1305 with 64-bit nonce as the
+// libsodium crypto_aead_chacha20poly1305, the poly1305 key is the head of
+// block 0 and the plaintext is encrypted from block 1.
+type chacha20Poly1305 struct {
+	key [CHACHA_KEY_SIZE]byte
+}
+
+func NewChaCha20Poly1305(key []byte) (cipher.AEAD, error) {
+	if ks := len(key); ks != CHACHA_KEY_SIZE {
+		return nil, KeySizeError(ks)
+	}
+	c := new(chacha20Poly1305)
+	copy(c.key[:], key)
+	return c, nil
+}
+
+func (c *chacha20Poly1305) NonceSize() int {
+	return CHACHA20_POLY1305_NONCE_SIZE
+}
+
+func (c *chacha20Poly1305) Overhead() int {
+	return POLY1305_TAG_SIZE
+}
+
+func (c *chacha20Poly1305) Seal(dst, nonce, plaintext, additionalData []byte) []byte {
+	if len(nonce) != CHACHA20_POLY1305_NONCE_SIZE {
+		panic("chacha20poly1305: bad nonce length")
+	}
+	ret, out := sliceForAppend(dst, len(plaintext)+POLY1305_TAG_SIZE)
+	stream, polyKey := c.init(nonce)
+	stream.XORKeyStream(out, plaintext)
+	var tag [POLY1305_TAG_SIZE]byte
+	Poly1305(&tag, macData(additionalData, out[:len(plaintext)]), polyKey)
+	copy(out[len(plaintext):], tag[:])
+	closeStream(stream)
+	return ret
+}
+
+func (c *chacha20Poly1305) Open(dst, nonce, ciphertext, additionalData []byte) ([]byte, error) {
+	if len(nonce) != CHACHA20_POLY1305_NONCE_SIZE {
+		panic("chacha20poly1305: bad nonce length")
+	}
+	if len(ciphertext) < POLY1305_TAG_SIZE {
+		return nil, ErrOpen
+	}
+	var (
+		n   = len(ciphertext) - POLY1305_TAG_SIZE
+		tag = ciphertext[n:]
+	)
+	ciphertext = ciphertext[:n]
+	stream, polyKey := c.init(nonce)
+	defer closeStream(stream)
+	if !Poly1305Verify(tag, macData(additionalData, ciphertext), polyKey) {
+		return nil, ErrOpen
+	}
+	ret, out := sliceForAppend(dst, n)
+	stream.XORKeyStream(out, ciphertext)
+	return ret, nil
+}
+
+// the stream at block 1 and the poly1305 key from block 0
+func (c *chacha20Poly1305) init(nonce []byte) (cipher.Stream, *[POLY1305_KEY_SIZE]byte) {
+	stream, _ := NewChaCha(c.key[:], nonce, CHACHA20_ROUND)
+	var block [CHACHA_BLOCK_SIZE]byte
+	stream.XORKeyStream(block[:], block[:])
+	var polyKey [POLY1305_KEY_SIZE]byte
+	copy(polyKey[:], block[:])
+	return stream, &polyKey
+}
+
+// ad || len(ad) || ciphertext || len(ciphertext) in little endian
+func macData(ad, ciphertext []byte) []byte {
+	var buf = make([]byte, 0, len(ad)+len(ciphertext)+16)
+	var n [8]byte
+	buf = append(buf, ad...)
+	binary.LittleEndian.PutUint64(n[:], uint64(len(ad)))
+	buf = append(buf, n[:]...)
+	buf = append(buf, ciphertext...)
+	binary.LittleEndian.PutUint64(n[:], uint64(len(ciphertext)))
+	return append(buf, n[:]...)
+}
+
+func closeStream(stream cipher.Stream) {
+	if c, y := stream.(io.Closer); y {
+		c.Close()
+	}
+}
+
+// as the crypto/cipher of std
+func sliceForAppend(in []byte, n int) (head, tail []byte) {
+	if total := len(in) + n; cap(in) >= total {
+		head = in[:total]
+	} else {
+		head = make([]byte, total)
+		copy(head, in)
+	}
+	tail = head[len(in):]
+	return
+}
@@ -0,0 +1,61 @@
+package crypto
+
+import (
+	"bytes"
+	"encoding/hex"
+	"testing"
+)
+
+func unhex(s string) []byte {
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		panic(err)
+	}
+	return b
+}
+
+// rfc7539 2.5.2
+func TestPoly1305(t *testing.T) {
+	var key [POLY1305_KEY_SIZE]byte
+	var tag [POLY1305_TAG_SIZE]byte
+	copy(key[:], unhex("85d6be7857556d337f4452fe42d506a80103808afb0db2fd4abff6af4149f51b"))
+	Poly1305(&tag, []byte("Cryptographic Forum Research Group"), &key)
+	if expected := unhex("a8061dc1305136c6c22b8baf0c0127a9"); !bytes.Equal(tag[:], expected) {
+		t.Fatalf("tag=%x", tag)
+	}
+	if Poly1305Verify(tag[:], []byte("Cryptographic Forum Research Group."), &key) {
+		t.Errorf("verified the altered message")
+	}
+}
+
+// the vector of libsodium aead_chacha20poly1305
+func TestChaCha20Poly1305(t *testing.T) {
+	var (
+		key      = unhex("4290bcb154173531f314af57f3be3b5006da371ece272afa1b5dbdd1100a1007")
+		plain    = unhex("86d09974840bded2a5ca")
+		nonce    = unhex("cd7cf67be39c794a")
+		ad       = unhex("87e229d4500845a079c0")
+		expected = unhex("e3e446f7ede9a19b62a4677dabf4e3d24b876bb284753896e1d6")
+	)
+	aead, err := NewChaCha20Poly1305(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sealed := aead.Seal(nil, nonce, plain, ad)
+	if !bytes.Equal(sealed, expected) {
+		t.Fatalf("sealed=%x", sealed)
+	}
+	opened, err := aead.Open(sealed[:0], nonce, sealed, ad)
+	if err != nil || !bytes.Equal(opened, plain) {
+		t.Fatalf("opened=%x %v", opened, err)
+	}
+
+	sealed = aead.Seal(nil, nonce, plain, ad)
+	sealed[0] ^= 1
+	if _, err = aead.Open(nil, nonce, sealed, ad); err != ErrOpen {
+		t.Errorf("opened the forged")
+	}
+	if _, err = aead.Open(nil, nonce, expected, nil); err != ErrOpen {
+		t.Errorf("opened without ad")
+	}
+}
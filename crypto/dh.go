@@ -35,11 +35,16 @@ func SelectCurve(name string) (elliptic.Curve, error) {
 	return curve, nil
 }
 
-// enum: DHE, ECC-P224,256,384,521
+// enum: DHE, X25519, X25519-MLKEM768, ECC-P224,256,384,521
 func NewDHKey(name string) (DHKE, error) {
 	name = strings.ToUpper(name)
-	if name == "DHE" {
+	switch name {
+	case "DHE":
 		return GenerateDHEKey()
+	case "X25519":
+		return GenerateX25519Key()
+	case DH_HYBRID:
+		return GenerateHybridKey(false)
 	}
 	curve, err := SelectCurve(name)
 	if err != nil {
@@ -48,6 +53,15 @@ func NewDHKey(name string) (DHKE, error) {
 	return GenerateECKey(curve)
 }
 
+// the key of responder, which exports its public key after computing the
+// shared key as the hybrid KEM.
+func NewDHResponder(name string) (DHKE, error) {
+	if strings.ToUpper(name) == DH_HYBRID {
+		return GenerateHybridKey(true)
+	}
+	return NewDHKey(name)
+}
+
 type DHKE interface {
 	ExportPubKey() []byte
 	ComputeKey(bobPub []byte) ([]byte, error)
@@ -132,3 +146,59 @@ func (d *DHEKey) ComputeKey(pub []byte) ([]byte, error) {
 	}
 	return nil, e
 }
+
+const (
+	DH_HYBRID = "X25519-MLKEM768"
+)
+
+// hybrid key exchange of X25519 and ML-KEM-768, the shared key is secure as
+// long as either one is unbroken, eg. the recorded traffic against quantum
+// computers later.
+// initiator exports x25519Pub | ek, responder answers x25519Pub | ct
+type HybridKey struct {
+	x   *X25519Key
+	kem *MLKEM768Key // of initiator
+	ct  []byte       // of responder
+}
+
+func GenerateHybridKey(responder bool) (k *HybridKey, err error) {
+	k = new(HybridKey)
+	if k.x, err = GenerateX25519Key(); err != nil {
+		return nil, err
+	}
+	if !responder {
+		if k.kem, err = GenerateMLKEM768Key(); err != nil {
+			return nil, err
+		}
+	}
+	return k, nil
+}
+
+func (k *HybridKey) ExportPubKey() []byte {
+	pub := k.x.ExportPubKey()
+	if k.kem != nil {
+		return append(pub, k.kem.ek...)
+	}
+	return append(pub, k.ct...)
+}
+
+// x25519 shared | ML-KEM shared
+func (k *HybridKey) ComputeKey(bobPub []byte) ([]byte, error) {
+	if len(bobPub) <= X25519_SIZE {
+		return nil, InvalidKEMParam
+	}
+	xk, err := k.x.ComputeKey(bobPub[:X25519_SIZE])
+	if err != nil {
+		return nil, err
+	}
+	var sk []byte
+	if k.kem != nil {
+		sk, err = k.kem.Decapsulate(bobPub[X25519_SIZE:])
+	} else {
+		sk, k.ct, err = MLKEM768Encapsulate(bobPub[X25519_SIZE:])
+	}
+	if err != nil {
+		return nil, err
+	}
+	return append(xk, sk...), nil
+}
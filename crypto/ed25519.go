@@ -0,0 +1,322 @@
+package crypto
+
+import (
+	stdcrypto "crypto"
+	"crypto/rand"
+	"crypto/sha512"
+	"crypto/subtle"
+	"io"
+)
+
+const (
+	ED25519_SEED_SIZE      = 32
+	ED25519_PUBLIC_SIZE    = 32
+	ED25519_PRIVATE_SIZE   = 64
+	ED25519_SIGNATURE_SIZE = 64
+)
+
+// Ed25519 signature of rfc8032 ported from the tweetnacl as the X25519, the
+// points are in the extended coordinates (X:Y:Z:T) of the twisted Edwards
+// curve and the scalars are reduced by modL.
+type edPoint [4]fieldElement
+
+var (
+	fe0 fieldElement
+	fe1 = fieldElement{1}
+	// -121665/121666
+	edD = fieldElement{0x78a3, 0x1359, 0x4dca, 0x75eb, 0xd8ab, 0x4141, 0x0a4d, 0x0070,
+		0xe898, 0x7779, 0x4079, 0x8cc7, 0xfe73, 0x2b6f, 0x6cee, 0x5203}
+	edD2 = fieldElement{0xf159, 0x26b2, 0x9b94, 0xebd6, 0xb156, 0x8283, 0x149a, 0x00e0,
+		0xd130, 0xeef3, 0x80f2, 0x198e, 0xfce7, 0x56df, 0xd9dc, 0x2406}
+	// the base point
+	edX = fieldElement{0xd51a, 0x8f25, 0x2d60, 0xc956, 0xa7b2, 0x9525, 0xc760, 0x692c,
+		0xdc5c, 0xfdd6, 0xe231, 0xc0a4, 0x53fe, 0xcd6e, 0x36d3, 0x2169}
+	edY = fieldElement{0x6658, 0x6666, 0x6666, 0x6666, 0x6666, 0x6666, 0x6666, 0x6666,
+		0x6666, 0x6666, 0x6666, 0x6666, 0x6666, 0x6666, 0x6666, 0x6666}
+	// sqrt(-1)
+	edI = fieldElement{0xa0b0, 0x4a0e, 0x1b27, 0xc4ee, 0xe478, 0xad2f, 0x1806, 0x2f43,
+		0xd7a7, 0x3dfb, 0x0099, 0x2b4d, 0xdf0b, 0x4fc1, 0x2480, 0x2b83}
+	// the order of base point
+	edL = [32]int64{0xed, 0xd3, 0xf5, 0x5c, 0x1a, 0x63, 0x12, 0x58, 0xd6, 0x9c, 0xf7, 0xa2,
+		0xde, 0xf9, 0xde, 0x14, 31: 0x10}
+)
+
+// i^((p-5)/8)
+func fePow2523(o, i *fieldElement) {
+	var x, c = *i, *i
+	for a := 250; a >= 0; a-- {
+		feMul(&c, &c, &c)
+		if a != 1 {
+			feMul(&c, &c, &x)
+		}
+	}
+	*o = c
+}
+
+func feParity(a *fieldElement) byte {
+	var d [X25519_SIZE]byte
+	fePack(&d, a)
+	return d[0] & 1
+}
+
+func feEqual(a, b *fieldElement) bool {
+	var c, d [X25519_SIZE]byte
+	fePack(&c, a)
+	fePack(&d, b)
+	return subtle.ConstantTimeCompare(c[:], d[:]) == 1
+}
+
+// p += q
+func (p *edPoint) add(q *edPoint) {
+	var a, b, c, d, t, e, f, g, h fieldElement
+	feSub(&a, &p[1], &p[0])
+	feSub(&t, &q[1], &q[0])
+	feMul(&a, &a, &t)
+	feAdd(&b, &p[0], &p[1])
+	feAdd(&t, &q[0], &q[1])
+	feMul(&b, &b, &t)
+	feMul(&c, &p[3], &q[3])
+	feMul(&c, &c, &edD2)
+	feMul(&d, &p[2], &q[2])
+	feAdd(&d, &d, &d)
+	feSub(&e, &b, &a)
+	feSub(&f, &d, &c)
+	feAdd(&g, &d, &c)
+	feAdd(&h, &b, &a)
+	feMul(&p[0], &e, &f)
+	feMul(&p[1], &h, &g)
+	feMul(&p[2], &g, &f)
+	feMul(&p[3], &e, &h)
+}
+
+func edSwap(p, q *edPoint, b int64) {
+	for i := range p {
+		feSwap(&p[i], &q[i], b)
+	}
+}
+
+func (p *edPoint) pack(r *[32]byte) {
+	var tx, ty, zi fieldElement
+	feInvert(&zi, &p[2])
+	feMul(&tx, &p[0], &zi)
+	feMul(&ty, &p[1], &zi)
+	fePack(r, &ty)
+	r[31] ^= feParity(&tx) << 7
+}
+
+// the negative of the point of encoding s
+func (r *edPoint) unpackNeg(s *[32]byte) bool {
+	var t, chk, num, den, den2, den4, den6 fieldElement
+	r[2] = fe1
+	feUnpack(&r[1], s)
+	feMul(&num, &r[1], &r[1])
+	feMul(&den, &num, &edD)
+	feSub(&num, &num, &r[2])
+	feAdd(&den, &r[2], &den)
+
+	feMul(&den2, &den, &den)
+	feMul(&den4, &den2, &den2)
+	feMul(&den6, &den4, &den2)
+	feMul(&t, &den6, &num)
+	feMul(&t, &t, &den)
+
+	fePow2523(&t, &t)
+	feMul(&t, &t, &num)
+	feMul(&t, &t, &den)
+	feMul(&t, &t, &den)
+	feMul(&r[0], &t, &den)
+
+	feMul(&chk, &r[0], &r[0])
+	feMul(&chk, &chk, &den)
+	if !feEqual(&chk, &num) {
+		feMul(&r[0], &r[0], &edI)
+	}
+	feMul(&chk, &r[0], &r[0])
+	feMul(&chk, &chk, &den)
+	if !feEqual(&chk, &num) {
+		return false
+	}
+	if feParity(&r[0]) == s[31]>>7 {
+		feSub(&r[0], &fe0, &r[0])
+	}
+	feMul(&r[3], &r[0], &r[1])
+	return true
+}
+
+// p = s*q, q is consumed
+func (p *edPoint) scalarMult(q *edPoint, s []byte) {
+	*p = edPoint{fe0, fe1, fe1, fe0}
+	for i := 255; i >= 0; i-- {
+		b := int64(s[i/8]>>uint(i&7)) & 1
+		edSwap(p, q, b)
+		q.add(p)
+		p.add(p)
+		edSwap(p, q, b)
+	}
+}
+
+func (p *edPoint) scalarBase(s []byte) {
+	var q = edPoint{edX, edY, fe1}
+	feMul(&q[3], &edX, &edY)
+	p.scalarMult(&q, s)
+}
+
+// r = x mod L
+func modL(r []byte, x *[64]int64) {
+	var carry int64
+	for i := 63; i >= 32; i-- {
+		carry = 0
+		j := i - 32
+		for ; j < i-12; j++ {
+			x[j] += carry - 16*x[i]*edL[j-(i-32)]
+			carry = (x[j] + 128) >> 8
+			x[j] -= carry << 8
+		}
+		x[j] += carry
+		x[i] = 0
+	}
+	carry = 0
+	for j := 0; j < 32; j++ {
+		x[j] += carry - (x[31]>>4)*edL[j]
+		carry = x[j] >> 8
+		x[j] &= 255
+	}
+	for j := 0; j < 32; j++ {
+		x[j] -= carry * edL[j]
+	}
+	for i := 0; i < 32; i++ {
+		x[i+1] += x[i] >> 8
+		r[i] = byte(x[i])
+	}
+}
+
+// the 64 bytes of r reduced into the first 32
+func reduce(r []byte) {
+	var x [64]int64
+	for i := 0; i < 64; i++ {
+		x[i] = int64(r[i])
+		r[i] = 0
+	}
+	modL(r, &x)
+}
+
+// s < L
+func isCanonicalScalar(s []byte) bool {
+	for i := 31; i >= 0; i-- {
+		if l := byte(edL[i]); s[i] != l {
+			return s[i] < l
+		}
+	}
+	return false
+}
+
+// --------------------
+// Ed25519 keys
+// --------------------
+
+// the seed|public of 64 bytes, a signer for the identity of server
+type Ed25519PrivateKey []byte
+
+type Ed25519PublicKey []byte
+
+func GenerateEd25519Key() (Ed25519PrivateKey, error) {
+	var seed [ED25519_SEED_SIZE]byte
+	if _, e := io.ReadFull(rand.Reader, seed[:]); e != nil {
+		return nil, e
+	}
+	return NewEd25519Key(seed[:]), nil
+}
+
+func NewEd25519Key(seed []byte) Ed25519PrivateKey {
+	var (
+		d   = sha512.Sum512(seed[:ED25519_SEED_SIZE])
+		a   edPoint
+		pub [32]byte
+	)
+	d[0] &= 248
+	d[31] = d[31]&127 | 64
+	a.scalarBase(d[:32])
+	a.pack(&pub)
+	k := make(Ed25519PrivateKey, ED25519_PRIVATE_SIZE)
+	copy(k, seed)
+	copy(k[ED25519_SEED_SIZE:], pub[:])
+	return k
+}
+
+func (k Ed25519PrivateKey) Seed() []byte {
+	return append([]byte(nil), k[:ED25519_SEED_SIZE]...)
+}
+
+func (k Ed25519PrivateKey) Public() stdcrypto.PublicKey {
+	return Ed25519PublicKey(append([]byte(nil), k[ED25519_SEED_SIZE:]...))
+}
+
+// the message is signed directly, opts is ignored.
+func (k Ed25519PrivateKey) Sign(_ io.Reader, msg []byte, _ stdcrypto.SignerOpts) ([]byte, error) {
+	var (
+		d    = sha512.Sum512(k[:ED25519_SEED_SIZE])
+		r, h [64]byte
+		p    edPoint
+		sig  = make([]byte, ED25519_SIGNATURE_SIZE)
+		x    [64]int64
+		rb   [32]byte
+	)
+	d[0] &= 248
+	d[31] = d[31]&127 | 64
+
+	hs := sha512.New()
+	hs.Write(d[32:])
+	hs.Write(msg)
+	hs.Sum(r[:0])
+	reduce(r[:])
+	p.scalarBase(r[:32])
+	p.pack(&rb)
+	copy(sig, rb[:])
+
+	hs.Reset()
+	hs.Write(rb[:])
+	hs.Write(k[ED25519_SEED_SIZE:])
+	hs.Write(msg)
+	hs.Sum(h[:0])
+	reduce(h[:])
+
+	for i := 0; i < 32; i++ {
+		x[i] = int64(r[i])
+	}
+	for i := 0; i < 32; i++ {
+		for j := 0; j < 32; j++ {
+			x[i+j] += int64(h[i]) * int64(d[j])
+		}
+	}
+	modL(sig[32:], &x)
+	return sig, nil
+}
+
+func Ed25519Verify(pub Ed25519PublicKey, msg, sig []byte) bool {
+	if len(pub) != ED25519_PUBLIC_SIZE || len(sig) != ED25519_SIGNATURE_SIZE ||
+		!isCanonicalScalar(sig[32:]) {
+		return false
+	}
+	var (
+		a, p   edPoint
+		pk, rb [32]byte
+		h      [64]byte
+	)
+	copy(pk[:], pub)
+	if !a.unpackNeg(&pk) {
+		return false
+	}
+	hs := sha512.New()
+	hs.Write(sig[:32])
+	hs.Write(pub)
+	hs.Write(msg)
+	hs.Sum(h[:0])
+	reduce(h[:])
+
+	// R = S*B - h*A
+	p.scalarMult(&a, h[:32])
+	a.scalarBase(sig[32:])
+	p.add(&a)
+	p.pack(&rb)
+	return subtle.ConstantTimeCompare(sig[:32], rb[:]) == 1
+}
@@ -0,0 +1,76 @@
+package crypto
+
+import (
+	"bytes"
+	"testing"
+)
+
+// rfc8032 7.1 TEST 1 and 2
+func TestEd25519(t *testing.T) {
+	for _, v := range [][4]string{
+		{"9d61b19deffd5a60ba844af492ec2cc44449c5697b326919703bac031cae7f60",
+			"d75a980182b10ab7d54bfed3c964073a0ee172f3daa62325af021a68f707511a",
+			"",
+			"e5564300c360ac729086e2cc806e828a84877f1eb8e5d974d873e065224901555fb8821590a33bacc61e39701cf9b46bd25bf5f0595bbe24655141438e7a100b"},
+		{"4ccd089b28ff96da9db6c346ec114e0f5b8a319f35aba624da8cf6ed4fb8a6fb",
+			"3d4017c3e843895a92b70aa74d1b7ebc9c982ccf2ec4968cc0cd55f12af4660c",
+			"72",
+			"92a009a9f0d4cab8720e820b5f642540a2b27b5416503f8fb3762223ebdb69da085ac1e43e15996e458f3613d0f11d8c387b2eaeb4302aeeb00d291612bb0c00"},
+	} {
+		msg := unhex(v[2])
+		k := NewEd25519Key(unhex(v[0]))
+		pub := k.Public().(Ed25519PublicKey)
+		if !bytes.Equal(pub, unhex(v[1])) {
+			t.Fatalf("pub=%x", pub)
+		}
+		sig, _ := k.Sign(nil, msg, nil)
+		if !bytes.Equal(sig, unhex(v[3])) {
+			t.Fatalf("sig=%x", sig)
+		}
+		if !Ed25519Verify(pub, msg, sig) {
+			t.Fatalf("verify failed")
+		}
+	}
+}
+
+func TestEd25519Verify(t *testing.T) {
+	k, err := GenerateEd25519Key()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var (
+		pub = k.Public().(Ed25519PublicKey)
+		msg = []byte("deblocus")
+	)
+	sig, _ := k.Sign(nil, msg, nil)
+	if !Ed25519Verify(pub, msg, sig) {
+		t.Fatalf("verify failed")
+	}
+	if Ed25519Verify(pub, []byte("deblocuz"), sig) {
+		t.Errorf("verified the other message")
+	}
+	for _, i := range []int{0, 31, 32, 63} {
+		bad := append([]byte(nil), sig...)
+		bad[i] ^= 1
+		if Ed25519Verify(pub, msg, bad) {
+			t.Errorf("verified the signature tampered at %d", i)
+		}
+	}
+	// S+L is not canonical
+	bad := append([]byte(nil), sig...)
+	var c int
+	for i := 0; i < 32; i++ {
+		c += int(bad[32+i]) + int(edL[i])
+		bad[32+i], c = byte(c), c>>8
+	}
+	if Ed25519Verify(pub, msg, bad) {
+		t.Errorf("verified the non-canonical S")
+	}
+	if Ed25519Verify(pub[1:], msg, sig) || Ed25519Verify(pub, msg, sig[1:]) {
+		t.Errorf("verified the short key or signature")
+	}
+	other, _ := GenerateEd25519Key()
+	if Ed25519Verify(other.Public().(Ed25519PublicKey), msg, sig) {
+		t.Errorf("verified by the other key")
+	}
+}
@@ -0,0 +1,371 @@
+package crypto
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"io"
+
+	"github.com/Lafeng/deblocus/exception"
+)
+
+// ML-KEM-768 of FIPS 203, the polynomials are in Z_q[X]/(X^256+1) and the
+// coefficients are reduced to [0, q) after every operation.
+const (
+	MLKEM768_SEED_SIZE   = 64
+	MLKEM768_EK_SIZE     = 384*_MLKEM_K + 32
+	MLKEM768_CT_SIZE     = 32 * (_MLKEM_DU*_MLKEM_K + _MLKEM_DV)
+	MLKEM768_SHARED_SIZE = 32
+
+	_MLKEM_N   = 256
+	_MLKEM_Q   = 3329
+	_MLKEM_K   = 3
+	_MLKEM_ETA = 2 // eta1 = eta2
+	_MLKEM_DU  = 10
+	_MLKEM_DV  = 4
+)
+
+var (
+	InvalidKEMParam = exception.New("Invalid ML-KEM parameters")
+)
+
+type poly [_MLKEM_N]uint16
+
+// zetas[i] = 17^BitRev7(i) mod q
+var mlkemZetas, mlkemGammas [128]uint16
+
+func init() {
+	for i := 0; i < 128; i++ {
+		var rev uint
+		for b := uint(0); b < 7; b++ {
+			rev |= uint(i>>b&1) << (6 - b)
+		}
+		mlkemZetas[i] = uint16(powMod(17, rev))
+		mlkemGammas[i] = uint16(powMod(17, 2*rev+1))
+	}
+}
+
+func powMod(x uint32, e uint) uint32 {
+	var r uint32 = 1
+	for ; e > 0; e-- {
+		r = r * x % _MLKEM_Q
+	}
+	return r
+}
+
+func fqMul(a, b uint16) uint16 {
+	return uint16(uint32(a) * uint32(b) % _MLKEM_Q)
+}
+
+func fqAdd(a, b uint16) uint16 {
+	return uint16((uint32(a) + uint32(b)) % _MLKEM_Q)
+}
+
+func fqSub(a, b uint16) uint16 {
+	return uint16((uint32(a) + _MLKEM_Q - uint32(b)) % _MLKEM_Q)
+}
+
+func (f *poly) ntt() {
+	k := 1
+	for l := 128; l >= 2; l >>= 1 {
+		for start := 0; start < _MLKEM_N; start += 2 * l {
+			zeta := mlkemZetas[k]
+			k++
+			for j := start; j < start+l; j++ {
+				t := fqMul(zeta, f[j+l])
+				f[j+l] = fqSub(f[j], t)
+				f[j] = fqAdd(f[j], t)
+			}
+		}
+	}
+}
+
+func (f *poly) invNTT() {
+	k := 127
+	for l := 2; l <= 128; l <<= 1 {
+		for start := 0; start < _MLKEM_N; start += 2 * l {
+			zeta := mlkemZetas[k]
+			k--
+			for j := start; j < start+l; j++ {
+				t := f[j]
+				f[j] = fqAdd(t, f[j+l])
+				f[j+l] = fqMul(zeta, fqSub(f[j+l], t))
+			}
+		}
+	}
+	for i := range f {
+		f[i] = fqMul(f[i], 3303) // 128^-1
+	}
+}
+
+// h += f * g in NTT domain
+func (h *poly) mulAcc(f, g *poly) {
+	for i := 0; i < 128; i++ {
+		a0, a1, b0, b1 := f[2*i], f[2*i+1], g[2*i], g[2*i+1]
+		c0 := fqAdd(fqMul(a0, b0), fqMul(fqMul(a1, b1), mlkemGammas[i]))
+		c1 := fqAdd(fqMul(a0, b1), fqMul(a1, b0))
+		h[2*i] = fqAdd(h[2*i], c0)
+		h[2*i+1] = fqAdd(h[2*i+1], c1)
+	}
+}
+
+func (h *poly) add(f *poly) {
+	for i := range h {
+		h[i] = fqAdd(h[i], f[i])
+	}
+}
+
+// uniform sampling in NTT domain from SHAKE128(rho|j|i)
+func sampleNTT(rho []byte, j, i byte) (f poly) {
+	xof := newShake128()
+	xof.Write(rho)
+	xof.Write([]byte{j, i})
+	var c [3]byte
+	for n := 0; n < _MLKEM_N; {
+		xof.Read(c[:])
+		d1 := uint16(c[0]) | uint16(c[1]&0xf)<<8
+		d2 := uint16(c[1]>>4) | uint16(c[2])<<4
+		if d1 < _MLKEM_Q {
+			f[n] = d1
+			n++
+		}
+		if d2 < _MLKEM_Q && n < _MLKEM_N {
+			f[n] = d2
+			n++
+		}
+	}
+	return
+}
+
+// centered binomial distribution of eta=2 from SHAKE256(sigma|n)
+func sampleCBD(sigma []byte, n byte) (f poly) {
+	var buf [64 * _MLKEM_ETA]byte
+	prf := newShake256()
+	prf.Write(sigma)
+	prf.Write([]byte{n})
+	prf.Read(buf[:])
+	for i := 0; i < _MLKEM_N; i++ {
+		b := buf[i/2] >> (uint(i&1) << 2)
+		x := uint16(b&1) + uint16(b>>1&1)
+		y := uint16(b>>2&1) + uint16(b>>3&1)
+		f[i] = fqSub(x, y)
+	}
+	return
+}
+
+func compress(x uint16, d uint) uint16 {
+	return uint16(((uint32(x)<<d)+_MLKEM_Q/2)/_MLKEM_Q) & (1<<d - 1)
+}
+
+func decompress(y uint16, d uint) uint16 {
+	return uint16((uint32(y)*_MLKEM_Q + 1<<(d-1)) >> d)
+}
+
+// little endian bits of d per coefficient
+func (f *poly) encode(out []byte, d uint) {
+	var acc uint32
+	var bits uint
+	for _, c := range f {
+		acc |= uint32(c) << bits
+		for bits += d; bits >= 8; bits -= 8 {
+			out[0] = byte(acc)
+			out, acc = out[1:], acc>>8
+		}
+	}
+}
+
+func (f *poly) decode(in []byte, d uint) {
+	var acc uint32
+	var bits uint
+	for i := range f {
+		for bits < d {
+			acc |= uint32(in[0]) << bits
+			in, bits = in[1:], bits+8
+		}
+		f[i] = uint16(acc & (1<<d - 1))
+		acc, bits = acc>>d, bits-d
+	}
+}
+
+type polyVec [_MLKEM_K]poly
+
+// Â of rho, or the transposed
+func expandMatrix(rho []byte, transposed bool) (a [_MLKEM_K]polyVec) {
+	for i := 0; i < _MLKEM_K; i++ {
+		for j := 0; j < _MLKEM_K; j++ {
+			if transposed {
+				a[i][j] = sampleNTT(rho, byte(i), byte(j))
+			} else {
+				a[i][j] = sampleNTT(rho, byte(j), byte(i))
+			}
+		}
+	}
+	return
+}
+
+// ML-KEM-768 decapsulation key
+type MLKEM768Key struct {
+	s  polyVec // NTT domain
+	ek []byte
+	h  []byte // H(ek)
+	z  []byte
+}
+
+func GenerateMLKEM768Key() (*MLKEM768Key, error) {
+	var seed [MLKEM768_SEED_SIZE]byte
+	if _, e := io.ReadFull(rand.Reader, seed[:]); e != nil {
+		return nil, e
+	}
+	return NewMLKEM768Key(seed[:])
+}
+
+// the key of seed d|z
+func NewMLKEM768Key(seed []byte) (*MLKEM768Key, error) {
+	if len(seed) != MLKEM768_SEED_SIZE {
+		return nil, InvalidKEMParam
+	}
+	var (
+		g     = sha3_512(seed[:32], []byte{_MLKEM_K})
+		rho   = g[:32]
+		sigma = g[32:]
+		a     = expandMatrix(rho, false)
+		k     = &MLKEM768Key{z: append([]byte(nil), seed[32:]...)}
+		e     polyVec
+		n     byte
+	)
+	for i := range k.s {
+		k.s[i] = sampleCBD(sigma, n)
+		k.s[i].ntt()
+		n++
+	}
+	for i := range e {
+		e[i] = sampleCBD(sigma, n)
+		e[i].ntt()
+		n++
+	}
+	k.ek = make([]byte, MLKEM768_EK_SIZE)
+	for i := 0; i < _MLKEM_K; i++ {
+		t := e[i]
+		for j := 0; j < _MLKEM_K; j++ {
+			t.mulAcc(&a[i][j], &k.s[j])
+		}
+		t.encode(k.ek[384*i:], 12)
+	}
+	copy(k.ek[384*_MLKEM_K:], rho)
+	k.h = sha3_256(k.ek)
+	return k, nil
+}
+
+func (k *MLKEM768Key) EncapsulationKey() []byte {
+	return append([]byte(nil), k.ek...)
+}
+
+// the shared key of ct, or the pseudorandom of implicit rejection
+func (k *MLKEM768Key) Decapsulate(ct []byte) ([]byte, error) {
+	if len(ct) != MLKEM768_CT_SIZE {
+		return nil, InvalidKEMParam
+	}
+	var (
+		u polyVec
+		v poly
+		w poly
+		m [32]byte
+	)
+	for i := range u {
+		u[i].decode(ct[320*i:], _MLKEM_DU)
+		for j := range u[i] {
+			u[i][j] = decompress(u[i][j], _MLKEM_DU)
+		}
+		u[i].ntt()
+		w.mulAcc(&k.s[i], &u[i])
+	}
+	w.invNTT()
+	v.decode(ct[320*_MLKEM_K:], _MLKEM_DV)
+	for i := range v {
+		v[i] = fqSub(decompress(v[i], _MLKEM_DV), w[i])
+		m[i/8] |= byte(compress(v[i], 1) << uint(i&7))
+	}
+	g := sha3_512(m[:], k.h)
+	ct2, _ := mlkemEncrypt(k.ek, m[:], g[32:])
+
+	var rejected [MLKEM768_SHARED_SIZE]byte
+	j := newShake256()
+	j.Write(k.z)
+	j.Write(ct)
+	j.Read(rejected[:])
+	shared := g[:32]
+	subtle.ConstantTimeCopy(1-subtle.ConstantTimeCompare(ct, ct2), shared, rejected[:])
+	return shared, nil
+}
+
+// the shared key and ciphertext to ek
+func MLKEM768Encapsulate(ek []byte) (shared, ct []byte, err error) {
+	var m [32]byte
+	if _, err = io.ReadFull(rand.Reader, m[:]); err != nil {
+		return
+	}
+	return mlkem768Encapsulate(ek, m[:])
+}
+
+func mlkem768Encapsulate(ek, m []byte) (shared, ct []byte, err error) {
+	g := sha3_512(m, sha3_256(ek))
+	if ct, err = mlkemEncrypt(ek, m, g[32:]); err != nil {
+		return nil, nil, err
+	}
+	return g[:32], ct, nil
+}
+
+// K-PKE encryption of m with the randomness r
+func mlkemEncrypt(ek, m, r []byte) ([]byte, error) {
+	if len(ek) != MLKEM768_EK_SIZE {
+		return nil, InvalidKEMParam
+	}
+	var (
+		t   polyVec
+		y   polyVec
+		rho = ek[384*_MLKEM_K:]
+		ct  = make([]byte, MLKEM768_CT_SIZE)
+		n   byte
+	)
+	// the modulus check
+	for i := range t {
+		t[i].decode(ek[384*i:], 12)
+		for _, c := range t[i] {
+			if c >= _MLKEM_Q {
+				return nil, InvalidKEMParam
+			}
+		}
+	}
+	a := expandMatrix(rho, true)
+	for i := range y {
+		y[i] = sampleCBD(r, n)
+		y[i].ntt()
+		n++
+	}
+	for i := 0; i < _MLKEM_K; i++ {
+		var u poly
+		for j := 0; j < _MLKEM_K; j++ {
+			u.mulAcc(&a[i][j], &y[j])
+		}
+		u.invNTT()
+		e1 := sampleCBD(r, n)
+		n++
+		u.add(&e1)
+		for j := range u {
+			u[j] = compress(u[j], _MLKEM_DU)
+		}
+		u.encode(ct[320*i:], _MLKEM_DU)
+	}
+	var v poly
+	for i := range t {
+		v.mulAcc(&t[i], &y[i])
+	}
+	v.invNTT()
+	e2 := sampleCBD(r, n)
+	v.add(&e2)
+	for i := range v {
+		mu := decompress(uint16(m[i/8]>>uint(i&7))&1, 1)
+		v[i] = compress(fqAdd(v[i], mu), _MLKEM_DV)
+	}
+	v.encode(ct[320*_MLKEM_K:], _MLKEM_DV)
+	return ct, nil
+}
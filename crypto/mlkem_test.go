@@ -0,0 +1,79 @@
+package crypto
+
+import (
+	"bytes"
+	"testing"
+)
+
+// FIPS 202
+func TestSHA3(t *testing.T) {
+	if sum := sha3_256(nil); !bytes.Equal(sum, unhex("a7ffc6f8bf1ed76651c14756a061d662f580ff4de43b49fa82d80a4b80f8434a")) {
+		t.Errorf("sha3-256=%x", sum)
+	}
+	if sum := sha3_512([]byte("abc")); !bytes.Equal(sum, unhex("b751850b1a57168a5693cd924b6b096e08f621827444f70d884f5d0240d2712e10e116e9192af3c91a7ec57647e3934057340b4cf408d5a56592f8274eec53f0")) {
+		t.Errorf("sha3-512=%x", sum)
+	}
+	var out [32]byte
+	newShake128().Read(out[:])
+	if !bytes.Equal(out[:], unhex("7f9c2ba4e88f827d616045507605853ed73b8093f6efbc88eb1a6eacfa66ef26")) {
+		t.Errorf("shake128=%x", out)
+	}
+}
+
+// the vectors of ML-KEM-768 with seed 0..63 and message 0x80..0x9f
+func TestMLKEM768(t *testing.T) {
+	var seed, m = make([]byte, MLKEM768_SEED_SIZE), make([]byte, 32)
+	for i := range seed {
+		seed[i] = byte(i)
+	}
+	for i := range m {
+		m[i] = byte(0x80 + i)
+	}
+	k, err := NewMLKEM768Key(seed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ek := k.EncapsulationKey()
+	if sum := sha3_256(ek); len(ek) != MLKEM768_EK_SIZE || !bytes.Equal(sum, unhex("a24e16d8f8f9383a95b77050f4d9fd2f5733eec1d63ef3c23ebf9918173669a7")) {
+		t.Fatalf("H(ek)=%x", sum)
+	}
+	shared, ct, err := mlkem768Encapsulate(ek, m)
+	if err != nil || len(ct) != MLKEM768_CT_SIZE {
+		t.Fatal(len(ct), err)
+	}
+	if sum := sha3_256(ct); !bytes.Equal(sum, unhex("df7ac66499b94b59272371c2ebbace7fc7efa27c07d02959c7501c84644bbc40")) {
+		t.Fatalf("H(ct)=%x", sum)
+	}
+	if !bytes.Equal(shared, unhex("ef91db44b6cd5b2c50f483481a3d6e2a08cc149764fcb8dc568851332da45ed9")) {
+		t.Fatalf("shared=%x", shared)
+	}
+	if k2, _ := k.Decapsulate(ct); !bytes.Equal(k2, shared) {
+		t.Fatalf("decapsulated=%x", k2)
+	}
+	// implicit rejection
+	ct[0] ^= 1
+	if k2, err := k.Decapsulate(ct); err != nil || bytes.Equal(k2, shared) {
+		t.Errorf("decapsulated the tampered %v", err)
+	}
+	// the coefficient out of modulus
+	ek[0], ek[1] = 0xff, 0x0f
+	if _, _, err = MLKEM768Encapsulate(ek); err != InvalidKEMParam {
+		t.Errorf("encapsulated to the invalid key")
+	}
+}
+
+func TestHybridKey(t *testing.T) {
+	alice, _ := NewDHKey(DH_HYBRID)
+	bob, _ := NewDHResponder(DH_HYBRID)
+	k1, e1 := bob.ComputeKey(alice.ExportPubKey())
+	k2, e2 := alice.ComputeKey(bob.ExportPubKey())
+	if e1 != nil || e2 != nil || len(k1) != X25519_SIZE+MLKEM768_SHARED_SIZE || !bytes.Equal(k1, k2) {
+		t.Fatalf("k1=%x k2=%x %v %v", k1, k2, e1, e2)
+	}
+	if pub := bob.ExportPubKey(); len(pub) != X25519_SIZE+MLKEM768_CT_SIZE {
+		t.Errorf("responder pub.len=%d", len(pub))
+	}
+	if _, err := alice.ComputeKey(bob.ExportPubKey()[:X25519_SIZE]); err == nil {
+		t.Errorf("computed without ciphertext")
+	}
+}
@@ -0,0 +1,122 @@
+package crypto
+
+import (
+	"crypto/subtle"
+	"encoding/binary"
+)
+
+const (
+	POLY1305_KEY_SIZE = 32
+	POLY1305_TAG_SIZE = 16
+)
+
+// one-time authenticator of poly1305, ported from poly1305-donna-32
+// with 26-bit limbs. the key must not be reused.
+func Poly1305(out *[POLY1305_TAG_SIZE]byte, msg []byte, key *[POLY1305_KEY_SIZE]byte) {
+	var (
+		h0, h1, h2, h3, h4 uint32
+		// clamped r
+		r0 = binary.LittleEndian.Uint32(key[0:]) & 0x3ffffff
+		r1 = (binary.LittleEndian.Uint32(key[3:]) >> 2) & 0x3ffff03
+		r2 = (binary.LittleEndian.Uint32(key[6:]) >> 4) & 0x3ffc0ff
+		r3 = (binary.LittleEndian.Uint32(key[9:]) >> 6) & 0x3f03fff
+		r4 = (binary.LittleEndian.Uint32(key[12:]) >> 8) & 0x00fffff
+		s1 = uint64(r1 * 5)
+		s2 = uint64(r2 * 5)
+		s3 = uint64(r3 * 5)
+		s4 = uint64(r4 * 5)
+		c  uint32
+	)
+	var block [16]byte
+	for len(msg) > 0 {
+		var m []byte
+		var hibit uint32 = 1 << 24
+		if len(msg) >= 16 {
+			m, msg = msg[:16], msg[16:]
+		} else {
+			// the final partial block is padded with 1 then zeros
+			block = [16]byte{}
+			block[copy(block[:], msg)] = 1
+			m, msg, hibit = block[:], nil, 0
+		}
+		h0 += binary.LittleEndian.Uint32(m[0:]) & 0x3ffffff
+		h1 += (binary.LittleEndian.Uint32(m[3:]) >> 2) & 0x3ffffff
+		h2 += (binary.LittleEndian.Uint32(m[6:]) >> 4) & 0x3ffffff
+		h3 += (binary.LittleEndian.Uint32(m[9:]) >> 6) & 0x3ffffff
+		h4 += (binary.LittleEndian.Uint32(m[12:]) >> 8) | hibit
+
+		// h *= r
+		d0 := uint64(h0)*uint64(r0) + uint64(h1)*s4 + uint64(h2)*s3 + uint64(h3)*s2 + uint64(h4)*s1
+		d1 := uint64(h0)*uint64(r1) + uint64(h1)*uint64(r0) + uint64(h2)*s4 + uint64(h3)*s3 + uint64(h4)*s2
+		d2 := uint64(h0)*uint64(r2) + uint64(h1)*uint64(r1) + uint64(h2)*uint64(r0) + uint64(h3)*s4 + uint64(h4)*s3
+		d3 := uint64(h0)*uint64(r3) + uint64(h1)*uint64(r2) + uint64(h2)*uint64(r1) + uint64(h3)*uint64(r0) + uint64(h4)*s4
+		d4 := uint64(h0)*uint64(r4) + uint64(h1)*uint64(r3) + uint64(h2)*uint64(r2) + uint64(h3)*uint64(r1) + uint64(h4)*uint64(r0)
+
+		// partial reduction
+		c, h0 = uint32(d0>>26), uint32(d0)&0x3ffffff
+		d1 += uint64(c)
+		c, h1 = uint32(d1>>26), uint32(d1)&0x3ffffff
+		d2 += uint64(c)
+		c, h2 = uint32(d2>>26), uint32(d2)&0x3ffffff
+		d3 += uint64(c)
+		c, h3 = uint32(d3>>26), uint32(d3)&0x3ffffff
+		d4 += uint64(c)
+		c, h4 = uint32(d4>>26), uint32(d4)&0x3ffffff
+		h0 += c * 5
+		c, h0 = h0>>26, h0&0x3ffffff
+		h1 += c
+	}
+
+	// full carry
+	c, h1 = h1>>26, h1&0x3ffffff
+	h2 += c
+	c, h2 = h2>>26, h2&0x3ffffff
+	h3 += c
+	c, h3 = h3>>26, h3&0x3ffffff
+	h4 += c
+	c, h4 = h4>>26, h4&0x3ffffff
+	h0 += c * 5
+	c, h0 = h0>>26, h0&0x3ffffff
+	h1 += c
+
+	// g = h - p
+	g0 := h0 + 5
+	c, g0 = g0>>26, g0&0x3ffffff
+	g1 := h1 + c
+	c, g1 = g1>>26, g1&0x3ffffff
+	g2 := h2 + c
+	c, g2 = g2>>26, g2&0x3ffffff
+	g3 := h3 + c
+	c, g3 = g3>>26, g3&0x3ffffff
+	g4 := h4 + c - (1 << 26)
+
+	// select h if h < p, or g in constant time
+	mask := (g4 >> 31) - 1
+	h0 = (h0 &^ mask) | (g0 & mask)
+	h1 = (h1 &^ mask) | (g1 & mask)
+	h2 = (h2 &^ mask) | (g2 & mask)
+	h3 = (h3 &^ mask) | (g3 & mask)
+	h4 = (h4 &^ mask) | (g4 & mask)
+
+	// h %= 2^128
+	h0 = h0 | (h1 << 26)
+	h1 = (h1 >> 6) | (h2 << 20)
+	h2 = (h2 >> 12) | (h3 << 14)
+	h3 = (h3 >> 18) | (h4 << 8)
+
+	// tag = (h + s) % 2^128
+	f := uint64(h0) + uint64(binary.LittleEndian.Uint32(key[16:]))
+	binary.LittleEndian.PutUint32(out[0:], uint32(f))
+	f = uint64(h1) + uint64(binary.LittleEndian.Uint32(key[20:])) + f>>32
+	binary.LittleEndian.PutUint32(out[4:], uint32(f))
+	f = uint64(h2) + uint64(binary.LittleEndian.Uint32(key[24:])) + f>>32
+	binary.LittleEndian.PutUint32(out[8:], uint32(f))
+	f = uint64(h3) + uint64(binary.LittleEndian.Uint32(key[28:])) + f>>32
+	binary.LittleEndian.PutUint32(out[12:], uint32(f))
+}
+
+func Poly1305Verify(tag []byte, msg []byte, key *[POLY1305_KEY_SIZE]byte) bool {
+	var sum [POLY1305_TAG_SIZE]byte
+	Poly1305(&sum, msg, key)
+	return subtle.ConstantTimeCompare(tag, sum[:]) == 1
+}
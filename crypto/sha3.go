@@ -0,0 +1,130 @@
+package crypto
+
+// the Keccak sponge of FIPS 202 for ML-KEM: SHA3-256, SHA3-512,
+// SHAKE128 and SHAKE256.
+
+const (
+	_SHA3_DS  = 0x06
+	_SHAKE_DS = 0x1f
+)
+
+var keccakRC = [24]uint64{
+	0x0000000000000001, 0x0000000000008082, 0x800000000000808A, 0x8000000080008000,
+	0x000000000000808B, 0x0000000080000001, 0x8000000080008081, 0x8000000000008009,
+	0x000000000000008A, 0x0000000000000088, 0x0000000080008009, 0x000000008000000A,
+	0x000000008000808B, 0x800000000000008B, 0x8000000000008089, 0x8000000000008003,
+	0x8000000000008002, 0x8000000000000080, 0x000000000000800A, 0x800000008000000A,
+	0x8000000080008081, 0x8000000000008080, 0x0000000080000001, 0x8000000080008008,
+}
+
+var (
+	keccakRotc = [24]uint{1, 3, 6, 10, 15, 21, 28, 36, 45, 55, 2, 14, 27, 41, 56, 8, 25, 43, 62, 18, 39, 61, 20, 44}
+	keccakPiln = [24]int{10, 7, 11, 17, 18, 3, 5, 16, 8, 21, 24, 4, 15, 23, 19, 13, 12, 2, 20, 14, 22, 9, 6, 1}
+)
+
+func rotl64(x uint64, n uint) uint64 {
+	return x<<n | x>>(64-n)
+}
+
+func keccakF1600(a *[25]uint64) {
+	var bc [5]uint64
+	for r := 0; r < 24; r++ {
+		// theta
+		for i := 0; i < 5; i++ {
+			bc[i] = a[i] ^ a[i+5] ^ a[i+10] ^ a[i+15] ^ a[i+20]
+		}
+		for i := 0; i < 5; i++ {
+			t := bc[(i+4)%5] ^ rotl64(bc[(i+1)%5], 1)
+			for j := 0; j < 25; j += 5 {
+				a[j+i] ^= t
+			}
+		}
+		// rho and pi
+		t := a[1]
+		for i := 0; i < 24; i++ {
+			j := keccakPiln[i]
+			t, a[j] = a[j], rotl64(t, keccakRotc[i])
+		}
+		// chi
+		for j := 0; j < 25; j += 5 {
+			copy(bc[:], a[j:j+5])
+			for i := 0; i < 5; i++ {
+				a[j+i] ^= ^bc[(i+1)%5] & bc[(i+2)%5]
+			}
+		}
+		// iota
+		a[0] ^= keccakRC[r]
+	}
+}
+
+type sponge struct {
+	a         [25]uint64
+	rate      int
+	ds        byte
+	pos       int
+	squeezing bool
+}
+
+func newShake128() *sponge {
+	return &sponge{rate: 168, ds: _SHAKE_DS}
+}
+
+func newShake256() *sponge {
+	return &sponge{rate: 136, ds: _SHAKE_DS}
+}
+
+func (s *sponge) xorByte(i int, b byte) {
+	s.a[i>>3] ^= uint64(b) << (uint(i&7) << 3)
+}
+
+func (s *sponge) Write(p []byte) (int, error) {
+	if s.squeezing {
+		panic("sha3: write after read")
+	}
+	for _, b := range p {
+		s.xorByte(s.pos, b)
+		if s.pos++; s.pos == s.rate {
+			keccakF1600(&s.a)
+			s.pos = 0
+		}
+	}
+	return len(p), nil
+}
+
+func (s *sponge) Read(p []byte) (int, error) {
+	if !s.squeezing {
+		s.xorByte(s.pos, s.ds)
+		s.xorByte(s.rate-1, 0x80)
+		keccakF1600(&s.a)
+		s.pos, s.squeezing = 0, true
+	}
+	for i := range p {
+		if s.pos == s.rate {
+			keccakF1600(&s.a)
+			s.pos = 0
+		}
+		p[i] = byte(s.a[s.pos>>3] >> (uint(s.pos&7) << 3))
+		s.pos++
+	}
+	return len(p), nil
+}
+
+func sha3Sum(rate, size int, msg ...[]byte) []byte {
+	s := &sponge{rate: rate, ds: _SHA3_DS}
+	for _, m := range msg {
+		s.Write(m)
+	}
+	out := make([]byte, size)
+	s.Read(out)
+	return out
+}
+
+// H of ML-KEM
+func sha3_256(msg ...[]byte) []byte {
+	return sha3Sum(136, 32, msg...)
+}
+
+// G of ML-KEM
+func sha3_512(msg ...[]byte) []byte {
+	return sha3Sum(72, 64, msg...)
+}
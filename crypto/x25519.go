@@ -0,0 +1,191 @@
+package crypto
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"io"
+)
+
+const (
+	X25519_SIZE = 32
+)
+
+var x25519BasePoint = [X25519_SIZE]byte{9}
+
+// Curve25519 ECDH of rfc7748 ported from the tweetnacl, the element of
+// GF(2^255-19) is 16 limbs of 16 bits in int64 and all the operations are
+// in constant time.
+type fieldElement [16]int64
+
+var fe121665 = fieldElement{0xDB41, 1}
+
+// the shared point of scalar and point u
+func X25519(dst, scalar, point *[X25519_SIZE]byte) {
+	var (
+		z          [X25519_SIZE]byte
+		x          fieldElement
+		a, b, c, d fieldElement
+		e, f       fieldElement
+	)
+	copy(z[:], scalar[:])
+	z[31] = (z[31] & 127) | 64
+	z[0] &= 248
+	feUnpack(&x, point)
+	b = x
+	a[0], d[0] = 1, 1
+	for i := 254; i >= 0; i-- {
+		r := int64(z[i>>3]>>uint(i&7)) & 1
+		feSwap(&a, &b, r)
+		feSwap(&c, &d, r)
+		feAdd(&e, &a, &c)
+		feSub(&a, &a, &c)
+		feAdd(&c, &b, &d)
+		feSub(&b, &b, &d)
+		feMul(&d, &e, &e)
+		feMul(&f, &a, &a)
+		feMul(&a, &c, &a)
+		feMul(&c, &b, &e)
+		feAdd(&e, &a, &c)
+		feSub(&a, &a, &c)
+		feMul(&b, &a, &a)
+		feSub(&c, &d, &f)
+		feMul(&a, &c, &fe121665)
+		feAdd(&a, &a, &d)
+		feMul(&c, &c, &a)
+		feMul(&a, &d, &f)
+		feMul(&d, &b, &x)
+		feMul(&b, &e, &e)
+		feSwap(&a, &b, r)
+		feSwap(&c, &d, r)
+	}
+	feInvert(&c, &c)
+	feMul(&a, &a, &c)
+	fePack(dst, &a)
+}
+
+func feCarry(o *fieldElement) {
+	for i := 0; i < 16; i++ {
+		o[i] += 1 << 16
+		c := o[i] >> 16
+		if i < 15 {
+			o[i+1] += c - 1
+		} else {
+			o[0] += 38 * (c - 1)
+		}
+		o[i] -= c << 16
+	}
+}
+
+// swap p and q if b is 1
+func feSwap(p, q *fieldElement, b int64) {
+	c := ^(b - 1)
+	for i := 0; i < 16; i++ {
+		t := c & (p[i] ^ q[i])
+		p[i] ^= t
+		q[i] ^= t
+	}
+}
+
+func fePack(o *[X25519_SIZE]byte, n *fieldElement) {
+	var t, m fieldElement
+	t = *n
+	feCarry(&t)
+	feCarry(&t)
+	feCarry(&t)
+	for j := 0; j < 2; j++ {
+		m[0] = t[0] - 0xffed
+		for i := 1; i < 15; i++ {
+			m[i] = t[i] - 0xffff - ((m[i-1] >> 16) & 1)
+			m[i-1] &= 0xffff
+		}
+		m[15] = t[15] - 0x7fff - ((m[14] >> 16) & 1)
+		b := (m[15] >> 16) & 1
+		m[14] &= 0xffff
+		feSwap(&t, &m, 1-b)
+	}
+	for i := 0; i < 16; i++ {
+		o[2*i] = byte(t[i])
+		o[2*i+1] = byte(t[i] >> 8)
+	}
+}
+
+func feUnpack(o *fieldElement, n *[X25519_SIZE]byte) {
+	for i := 0; i < 16; i++ {
+		o[i] = int64(n[2*i]) + int64(n[2*i+1])<<8
+	}
+	o[15] &= 0x7fff
+}
+
+func feAdd(o, a, b *fieldElement) {
+	for i := 0; i < 16; i++ {
+		o[i] = a[i] + b[i]
+	}
+}
+
+func feSub(o, a, b *fieldElement) {
+	for i := 0; i < 16; i++ {
+		o[i] = a[i] - b[i]
+	}
+}
+
+func feMul(o, a, b *fieldElement) {
+	var t [31]int64
+	for i := 0; i < 16; i++ {
+		for j := 0; j < 16; j++ {
+			t[i+j] += a[i] * b[j]
+		}
+	}
+	// 2^256 = 38 mod p
+	for i := 0; i < 15; i++ {
+		t[i] += 38 * t[i+16]
+	}
+	copy(o[:], t[:16])
+	feCarry(o)
+	feCarry(o)
+}
+
+// i^(p-2)
+func feInvert(o, i *fieldElement) {
+	var x, c = *i, *i
+	for a := 253; a >= 0; a-- {
+		feMul(&c, &c, &c)
+		if a != 2 && a != 4 {
+			feMul(&c, &c, &x)
+		}
+	}
+	*o = c
+}
+
+// ECDH of Curve25519
+type X25519Key struct {
+	priv [X25519_SIZE]byte
+	pub  [X25519_SIZE]byte
+}
+
+func GenerateX25519Key() (*X25519Key, error) {
+	k := new(X25519Key)
+	if _, e := io.ReadFull(rand.Reader, k.priv[:]); e != nil {
+		return nil, e
+	}
+	X25519(&k.pub, &k.priv, &x25519BasePoint)
+	return k, nil
+}
+
+func (k *X25519Key) ExportPubKey() []byte {
+	return append([]byte(nil), k.pub[:]...)
+}
+
+func (k *X25519Key) ComputeKey(bobPub []byte) ([]byte, error) {
+	if len(bobPub) != X25519_SIZE {
+		return nil, InvalidECCParam
+	}
+	var point, shared [X25519_SIZE]byte
+	copy(point[:], bobPub)
+	X25519(&shared, &k.priv, &point)
+	// the points of small order yield zero
+	var zero [X25519_SIZE]byte
+	if subtle.ConstantTimeCompare(shared[:], zero[:]) == 1 {
+		return nil, InvalidECCParam
+	}
+	return shared[:], nil
+}
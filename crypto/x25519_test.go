@@ -0,0 +1,42 @@
+package crypto
+
+import (
+	"bytes"
+	"testing"
+)
+
+// rfc7748 5.2 and 6.1
+func TestX25519(t *testing.T) {
+	var scalar, point, out [X25519_SIZE]byte
+	copy(scalar[:], unhex("a546e36bf0527c9d3b16154b82465edd62144c0ac1fc5a18506a2244ba449ac4"))
+	copy(point[:], unhex("e6db6867583030db3594c1a424b15f7c726624ec26b3353b10a903a6d0ab1c4c"))
+	X25519(&out, &scalar, &point)
+	if expected := unhex("c3da55379de9c6908e94ea4df28d084f32eccf03491c71f754b4075577a28552"); !bytes.Equal(out[:], expected) {
+		t.Fatalf("out=%x", out)
+	}
+
+	var alice, bob X25519Key
+	copy(alice.priv[:], unhex("77076d0a7318a57d3c16c17251b26645df4c2f87ebc0992ab177fba51db92c2a"))
+	copy(bob.priv[:], unhex("5dab087e624a8a4b79e17f8b83800ee66f3bb1292618b6fd1c2f8b27ff88e0eb"))
+	X25519(&alice.pub, &alice.priv, &x25519BasePoint)
+	X25519(&bob.pub, &bob.priv, &x25519BasePoint)
+	if expected := unhex("8520f0098930a754748b7ddcb43ef75a0dbf3a0d26381af4eba4a98eaa9b4e6a"); !bytes.Equal(alice.pub[:], expected) {
+		t.Fatalf("alice.pub=%x", alice.pub)
+	}
+	if expected := unhex("de9edb7d7b7dc1b4d35b61c2ece435373f8343c85b78674dadfc7e146f882b4f"); !bytes.Equal(bob.pub[:], expected) {
+		t.Fatalf("bob.pub=%x", bob.pub)
+	}
+	k1, e1 := alice.ComputeKey(bob.ExportPubKey())
+	k2, e2 := bob.ComputeKey(alice.ExportPubKey())
+	if expected := unhex("4a5d9d5ba4ce2de1728e3bf480350f25e07e21c947d19e3376f09b3c1e161742"); e1 != nil || e2 != nil || !bytes.Equal(k1, expected) || !bytes.Equal(k2, expected) {
+		t.Fatalf("shared=%x %x %v %v", k1, k2, e1, e2)
+	}
+
+	// the point of small order
+	if _, e := alice.ComputeKey(make([]byte, X25519_SIZE)); e != InvalidECCParam {
+		t.Errorf("computed with zero point")
+	}
+	if _, e := alice.ComputeKey(alice.ExportPubKey()[1:]); e != InvalidECCParam {
+		t.Errorf("computed with short point")
+	}
+}
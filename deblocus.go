@@ -79,6 +79,20 @@ func setupCommands() *cli.App {
 			Action:      context.keyInfoCommandHandler,
 			Flags:       []cli.Flag{globalOptions[0]},
 		},
+		{
+			Name:        "admin",
+			Usage:       "Manage the running server by the admin socket",
+			ArgsUsage:   "deblocus admin [options] <command> [target]",
+			Description: _admin_examples,
+			Action:      context.adminCommandHandler,
+			Flags: []cli.Flag{
+				globalOptions[0],
+				cli.StringFlag{
+					Name:  "socket, s",
+					Usage: "Path of the admin socket, or AdminSocket of config",
+				},
+			},
+		},
 	}
 	app.Flags = globalOptions
 	app.Before = context.initialize
@@ -111,7 +125,7 @@ OPTIONS:
 const _csc_examples = `
    ./deblocus csc > deblocus.ini
    ./deblocus csc -o deblocus.ini
-   ./deblocus csc -t [ECC-P224,256,384,521 | RSA-1024,2048,4096]`
+   ./deblocus csc -t [ECC-P224,256,384,521 | RSA-1024,2048,4096 | ED25519]`
 
 const _ccc_examples = `
    ./deblocus ccc --addr=example.com:9008  user
@@ -120,3 +134,11 @@ const _ccc_examples = `
 const _keyinfo_examples = `
    ./deblocus keyinfo
    ./deblocus keyinfo -c someconfig.ini`
+
+const _admin_examples = `
+   ./deblocus admin sessions [uid|cid]
+   ./deblocus admin kick <uid|cid>
+   ./deblocus admin stats
+   ./deblocus admin reload
+   ./deblocus admin -s /var/run/deblocus.sock verbosity 3
+   commands: users, streams, tokens, pause, resume also`
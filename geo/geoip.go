@@ -131,6 +131,45 @@ func (f *GeoIPFilter) Filter(host string) bool {
 	return false
 }
 
+// the reverse of GeoIPFilter, filters the hosts located out of the countries
+type GeoIPAllowFilter struct {
+	tab      *routingTable
+	keywords map[uint16]bool
+}
+
+// keywords are the country codes separated by comma
+func NewGeoIPAllowFilter(keywords string) (f *GeoIPAllowFilter, e error) {
+	f = &GeoIPAllowFilter{keywords: make(map[uint16]bool)}
+	for _, k := range strings.Split(keywords, ",") {
+		if k = strings.TrimSpace(k); len(k) != 2 {
+			return nil, fmt.Errorf("filter keyword must be 2-byte country_iso_code")
+		}
+		f.keywords[StoU16(strings.ToUpper(k))] = true
+	}
+	f.tab = deserialize(buildGeoDB())
+	log.Infoln("Init DestIPAllowFilter with target keywords", keywords)
+	return
+}
+
+// the unlocated, eg. ipv6, are filtered
+func (f *GeoIPAllowFilter) Filter(host string) bool {
+	ipAddr, e := net.ResolveTCPAddr("tcp", host)
+	// assume no target no filter
+	if e != nil || ipAddr == nil {
+		return false
+	}
+
+	ipv4 := ipAddr.IP.To4()
+	if ipv4 == nil {
+		return true
+	}
+
+	if nexthop, y := f.tab.Find(binary.BigEndian.Uint32(ipv4)); y {
+		return !f.keywords[nexthop]
+	}
+	return true
+}
+
 // Serialize routingTable{trie,base,pre} to 3-[]byte directly without copying
 // then could make persistent data
 func Serialize(r *routingTable) (t, b, p []byte) {
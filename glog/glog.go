@@ -1236,3 +1236,7 @@ func DirectPrintln(data string) {
 func SetLogVerbose(verbosity int) {
 	atomic.StoreInt32((*int32)(&logging.verbosity), int32(verbosity))
 }
+
+func GetLogVerbose() int {
+	return int(atomic.LoadInt32((*int32)(&logging.verbosity)))
+}
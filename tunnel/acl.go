@@ -0,0 +1,175 @@
+package tunnel
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/Lafeng/deblocus/exception"
+	log "github.com/Lafeng/deblocus/glog"
+)
+
+const (
+	ACL_REFRESH     = time.Minute * 5
+	ACL_REFRESH_MIN = time.Second * 10
+	ACL_FETCH_MAX   = 1 << 20
+	ACL_TIMEOUT     = time.Second * 10
+)
+
+var (
+	ACL_ERROR = exception.New("Invalid ACL")
+)
+
+// --------------------
+// aclSource
+// --------------------
+// refresh the deny networks of destGuard from an url or a file periodically,
+// the file is reloaded only if modified. the fetched rules are validated
+// entirely before applying, and the last good rules are kept on any failure.
+type aclSource struct {
+	failures  int64
+	source    string
+	interval  time.Duration
+	guard     *destGuard
+	client    *http.Client
+	lock      sync.Mutex
+	modTime   time.Time // of the file attempted last
+	refreshed time.Time
+	rules     int
+	ticker    *time.Ticker
+	done      chan struct{}
+}
+
+func newACLSource(source string, interval time.Duration, guard *destGuard) *aclSource {
+	return &aclSource{
+		source:   source,
+		interval: interval,
+		guard:    guard,
+		client:   &http.Client{Timeout: ACL_TIMEOUT},
+	}
+}
+
+func isURLSource(source string) bool {
+	return strings.HasPrefix(source, "http://") || strings.HasPrefix(source, "https://")
+}
+
+// the CIDRs separated by comma or line, and "#" for comments
+func parseACLRules(data []byte) ([]*net.IPNet, error) {
+	var items []string
+	for _, line := range strings.Split(string(data), "\n") {
+		if i := strings.IndexByte(line, '#'); i >= 0 {
+			line = line[:i]
+		}
+		items = append(items, strings.Split(line, ",")...)
+	}
+	networks, err := parseNetworks(items)
+	if err != nil {
+		return nil, ACL_ERROR.Apply(err)
+	}
+	// maybe truncated, use OFF to disable instead
+	if len(networks) == 0 {
+		return nil, ACL_ERROR.Apply("no rules")
+	}
+	return networks, nil
+}
+
+// return nil data if the file was not modified
+func (a *aclSource) fetch() ([]byte, error) {
+	if isURLSource(a.source) {
+		resp, err := a.client.Get(a.source)
+		if err != nil {
+			return nil, err
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return nil, ACL_ERROR.Apply(resp.Status)
+		}
+		// the truncated may be parsed as the partial rules
+		data, err := ioutil.ReadAll(io.LimitReader(resp.Body, ACL_FETCH_MAX+1))
+		if err == nil && len(data) > ACL_FETCH_MAX {
+			return nil, ACL_ERROR.Apply("truncated, larger than " + strconv.Itoa(ACL_FETCH_MAX) + " bytes")
+		}
+		return data, err
+	}
+	fi, err := os.Stat(a.source)
+	if err != nil {
+		return nil, err
+	}
+	a.lock.Lock()
+	modified := !fi.ModTime().Equal(a.modTime)
+	a.modTime = fi.ModTime()
+	a.lock.Unlock()
+	if !modified {
+		return nil, nil
+	}
+	if fi.Size() > ACL_FETCH_MAX {
+		return nil, ACL_ERROR.Apply("truncated, larger than " + strconv.Itoa(ACL_FETCH_MAX) + " bytes")
+	}
+	return ioutil.ReadFile(a.source)
+}
+
+func (a *aclSource) refresh() error {
+	data, err := a.fetch()
+	if err == nil && data == nil {
+		return nil
+	}
+	var networks []*net.IPNet
+	if err == nil {
+		networks, err = parseACLRules(data)
+	}
+	if err != nil {
+		atomic.AddInt64(&a.failures, 1)
+		log.Warningf("Kept the last good ACL, failed to refresh from %s: %v\n", a.source, err)
+		return err
+	}
+	a.guard.setNetworks(networks)
+	a.lock.Lock()
+	a.refreshed, a.rules = time.Now(), len(networks)
+	a.lock.Unlock()
+	if log.V(log.LV_SVR_CONNECT) {
+		log.Infof("Refreshed ACL from %s rules=%d", a.source, len(networks))
+	}
+	return nil
+}
+
+func (a *aclSource) start() {
+	a.ticker = time.NewTicker(a.interval)
+	a.done = make(chan struct{})
+	go func(ticker *time.Ticker, done chan struct{}) {
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				a.refresh()
+			}
+		}
+	}(a.ticker, a.done)
+}
+
+func (a *aclSource) stop() {
+	if a.ticker != nil {
+		a.ticker.Stop()
+		close(a.done)
+		a.ticker = nil
+	}
+}
+
+func (a *aclSource) String() string {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	var last = "never"
+	if !a.refreshed.IsZero() {
+		last = a.refreshed.Format(time.RFC3339)
+	}
+	return fmt.Sprintf("ACL-refreshed=%s ACL-rules=%d ACL-refresh-failed=%d",
+		last, a.rules, atomic.LoadInt64(&a.failures))
+}
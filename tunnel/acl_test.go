@@ -0,0 +1,127 @@
+package tunnel
+
+import (
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+var (
+	aclDest  = net.ParseIP("10.1.2.3")
+	aclRules = "# internal\n10.0.0.0/8\n172.16.0.0/12, 192.168.0.0/16\n"
+)
+
+func newACLGuard() *destGuard {
+	networks, _ := parseNetworks([]string{"127.0.0.0/8"})
+	return newDestGuard(&net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 9008}, networks)
+}
+
+func TestACLRefreshFromURL(t *testing.T) {
+	var body atomic.Value
+	body.Store(aclRules)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if b := body.Load().(string); b == "500" {
+			w.WriteHeader(http.StatusInternalServerError)
+		} else {
+			w.Write([]byte(b))
+		}
+	}))
+	guard := newACLGuard()
+	acl := newACLSource(ts.URL, time.Minute, guard)
+	if !strings.Contains(acl.String(), "ACL-refreshed=never ACL-rules=0") {
+		t.Errorf("unexpected stats %s", acl)
+	}
+	if guard.denied(aclDest, 80) {
+		t.Fatalf("denied before refresh")
+	}
+	if err := acl.refresh(); err != nil || !guard.denied(aclDest, 80) {
+		t.Fatalf("not applied err=%v", err)
+	}
+	// keep the last good
+	var oversized = strings.Repeat("10.0.0.0/8\n", ACL_FETCH_MAX/11+1)
+	for i, b := range []string{"10.0.0.0/33\n", "# nothing\n", "500", oversized} {
+		body.Store(b)
+		if err := acl.refresh(); err == nil {
+			t.Errorf("%.20q was applied", b)
+		}
+		if !guard.denied(aclDest, 80) || !strings.Contains(acl.String(), "ACL-rules=3") {
+			t.Errorf("%.20q cleared the rules %s", b, acl)
+		}
+		if n := atomic.LoadInt64(&acl.failures); n != int64(i+1) {
+			t.Errorf("failures=%d", n)
+		}
+	}
+	ts.Close()
+	if err := acl.refresh(); err == nil || !guard.denied(aclDest, 80) {
+		t.Errorf("fetch failure cleared the rules err=%v", err)
+	}
+	if s := acl.String(); strings.Contains(s, "never") || !strings.Contains(s, "ACL-refresh-failed=5") {
+		t.Errorf("unexpected stats %s", s)
+	}
+}
+
+func TestACLRefreshFromFile(t *testing.T) {
+	f, err := ioutil.TempFile(NULL, "acl")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	f.WriteString("10.0.0.0/8")
+	f.Close()
+
+	var (
+		guard = newACLGuard()
+		acl   = newACLSource(f.Name(), time.Minute, guard)
+		mtime = time.Now()
+	)
+	if err = acl.refresh(); err != nil || !guard.denied(aclDest, 80) {
+		t.Fatalf("not applied err=%v", err)
+	}
+	// not modified, no failure
+	if err = acl.refresh(); err != nil {
+		t.Errorf("refresh unmodified %v", err)
+	}
+	write := func(rules string) {
+		ioutil.WriteFile(f.Name(), []byte(rules), 0644)
+		mtime = mtime.Add(time.Minute)
+		os.Chtimes(f.Name(), mtime, mtime)
+	}
+	write("10.0.0.0/8\nbad")
+	if err = acl.refresh(); err == nil || !guard.denied(aclDest, 80) {
+		t.Errorf("malformed file was applied err=%v", err)
+	}
+	write("192.168.0.0/16")
+	if err = acl.refresh(); err != nil || guard.denied(aclDest, 80) {
+		t.Errorf("modified file was not applied err=%v", err)
+	}
+	if !guard.denied(net.ParseIP("192.168.1.1"), 80) || !strings.Contains(acl.String(), "ACL-rules=1 ACL-refresh-failed=1") {
+		t.Errorf("unexpected stats %s", acl)
+	}
+	os.Remove(f.Name())
+	if err = acl.refresh(); err == nil || !guard.denied(net.ParseIP("192.168.1.1"), 80) {
+		t.Errorf("missing file cleared the rules err=%v", err)
+	}
+}
+
+func TestACLStop(t *testing.T) {
+	acl := newACLSource("file-not-found", time.Millisecond, newACLGuard())
+	acl.start()
+	done := acl.done
+	acl.stop()
+	select {
+	case <-done:
+	default:
+		t.Fatalf("refresh loop was not signaled")
+	}
+	if acl.ticker != nil {
+		t.Errorf("ticker was not released")
+	}
+	// stop again
+	acl.stop()
+}
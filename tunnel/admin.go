@@ -0,0 +1,421 @@
+package tunnel
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/Lafeng/deblocus/auth"
+	"github.com/Lafeng/deblocus/exception"
+	log "github.com/Lafeng/deblocus/glog"
+)
+
+const (
+	ADMIN_TOKEN_MIN       = 16
+	ADMIN_REQUEST_TIMEOUT = time.Minute
+)
+
+var (
+	ADMIN_SOCKET_IN_USE  = exception.New("Admin socket is in use by the running server")
+	ADMIN_BAD_COMMAND    = exception.New("Invalid admin command")
+	ADMIN_REQUEST_FAILED = exception.New("Admin request failed")
+)
+
+// --------------------
+// reloadableAuth
+// --------------------
+// the user database of server swapped by reloading, the handshakes in
+// progress see either the old or the new one.
+type reloadableAuth struct {
+	lock sync.RWMutex
+	sys  auth.AuthSys
+}
+
+func newReloadableAuth(sys auth.AuthSys) *reloadableAuth {
+	return &reloadableAuth{sys: sys}
+}
+
+func (a *reloadableAuth) current() auth.AuthSys {
+	a.lock.RLock()
+	defer a.lock.RUnlock()
+	return a.sys
+}
+
+func (a *reloadableAuth) swap(sys auth.AuthSys) {
+	a.lock.Lock()
+	a.sys = sys
+	a.lock.Unlock()
+}
+
+func (a *reloadableAuth) Authenticate(user, passwd string) (bool, error) {
+	return a.current().Authenticate(user, passwd)
+}
+
+func (a *reloadableAuth) AddUser(user *auth.User) error {
+	return a.current().AddUser(user)
+}
+
+func (a *reloadableAuth) UserInfo(user string) (*auth.User, error) {
+	return a.current().UserInfo(user)
+}
+
+// admin: reload the users from the config file, the sessions of the removed
+// users are kicked. the other settings take effect after restarting.
+// return the number of kicked sessions
+func (t *Server) Reload() (int, error) {
+	cman, err := DetectConfig(t.configFile)
+	if err != nil {
+		return 0, err
+	}
+	conf, err := cman.ParseServConf()
+	if err != nil {
+		return 0, err
+	}
+	kicked := t.reloadUsers(conf.AuthSys)
+	log.Infof("Reloaded the users from %s, kicked sessions=%d", conf.Auth, kicked)
+	return kicked, nil
+}
+
+func (t *Server) reloadUsers(sys auth.AuthSys) int {
+	t.users.swap(sys)
+	var removed = make(map[string]bool)
+	for _, s := range t.sessionMgr.lookup(NULL) {
+		if s.uid == NULL || removed[s.uid] {
+			continue
+		}
+		if u, _ := sys.UserInfo(s.uid); u == nil {
+			removed[s.uid] = true
+		}
+	}
+	var kicked int
+	for uid := range removed {
+		kicked += t.KickSession(uid)
+	}
+	return kicked
+}
+
+// the admin listens on loopback only
+func validateAdminAddr(str string) error {
+	return validateLoopbackAddr("Admin", str)
+}
+
+// the listen address of option must be loopback
+func validateLoopbackAddr(option, str string) error {
+	addr, _, err := parseListenPath(str)
+	if err != nil {
+		return CONF_ERROR.Apply(option)
+	}
+	host, _, _ := net.SplitHostPort(addr)
+	if ip := net.ParseIP(host); host != "localhost" && (ip == nil || !ip.IsLoopback()) {
+		return CONF_ERROR.Apply(option + " " + host + " is not loopback")
+	}
+	return nil
+}
+
+// --------------------
+// admin API
+// --------------------
+// the json API of the admin methods on the local listener. GET of stats,
+// users, sessions, streams, tokens and verbosity, POST of kick, pause, resume,
+// reload and verbosity. the sessions are matched by the query target of uid
+// or cid. the requests of the unix socket are not authenticated by token, the
+// socket is guarded by the file permission.
+
+type SessionInfo struct {
+	User          string `json:"user"`
+	Client        string `json:"client"`
+	Label         string `json:"label,omitempty"`
+	Correlation   string `json:"correlation,omitempty"`
+	Tunnels       int    `json:"tunnels"`
+	Tokens        int    `json:"tokens"`
+	RxBytes       int64  `json:"rx_bytes"`
+	TxBytes       int64  `json:"tx_bytes"`
+	ActiveStreams int64  `json:"active_streams"`
+	Age           int64  `json:"age"` // seconds
+}
+
+func (t *Server) sessionInfos(target string) []*SessionInfo {
+	var (
+		now  = time.Now()
+		list []*SessionInfo
+	)
+	for _, s := range t.sessionMgr.lookup(target) {
+		rx, tx, _ := s.mux.traffic()
+		list = append(list, &SessionInfo{
+			User:          s.uid,
+			Client:        s.cid,
+			Label:         s.label,
+			Correlation:   s.correlation,
+			Tunnels:       int(atomic.LoadInt32(&s.activeCnt)),
+			Tokens:        t.sessionMgr.tokenCount(s),
+			RxBytes:       rx,
+			TxBytes:       tx,
+			ActiveStreams: atomic.LoadInt64(&s.mux.active),
+			Age:           int64(now.Sub(s.start) / time.Second),
+		})
+	}
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].User != list[j].User {
+			return list[i].User < list[j].User
+		}
+		return list[i].Client < list[j].Client
+	})
+	return list
+}
+
+type adminFunc func(r *http.Request) (interface{}, error)
+
+// the error of request with the status
+type adminError struct {
+	status int
+	msg    string
+}
+
+func (e *adminError) Error() string {
+	return e.msg
+}
+
+// the requests must carry the token as Bearer if not empty
+func (t *Server) adminHandler(path, token string) http.Handler {
+	var (
+		mux    = http.NewServeMux()
+		prefix = strings.TrimSuffix(path, "/") + "/"
+		bearer = []byte("Bearer " + token)
+	)
+	var route = func(name string, methods map[string]adminFunc) {
+		mux.HandleFunc(prefix+name, func(w http.ResponseWriter, r *http.Request) {
+			if token != NULL && subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), bearer) != 1 {
+				if log.V(log.LV_WARN) {
+					log.Warningf("Rejected admin request from=%s %s", r.RemoteAddr, r.URL.Path)
+				}
+				writeAdminReply(w, nil, &adminError{http.StatusUnauthorized, "unauthorized"})
+				return
+			}
+			fn := methods[r.Method]
+			if fn == nil {
+				writeAdminReply(w, nil, &adminError{http.StatusMethodNotAllowed, "method not allowed"})
+				return
+			}
+			result, err := fn(r)
+			writeAdminReply(w, result, err)
+		})
+	}
+	var targeted = func(action func(target string) int) adminFunc {
+		return func(r *http.Request) (interface{}, error) {
+			target := r.URL.Query().Get("target")
+			if target == NULL {
+				return nil, &adminError{http.StatusBadRequest, "target is required"}
+			}
+			return map[string]int{"sessions": action(target)}, nil
+		}
+	}
+	var raw = func(data []byte, err error) (interface{}, error) {
+		return json.RawMessage(data), err
+	}
+
+	route("stats", map[string]adminFunc{
+		"GET": func(r *http.Request) (interface{}, error) {
+			return t.collectStats(), nil
+		},
+	})
+	route("users", map[string]adminFunc{
+		"GET": func(r *http.Request) (interface{}, error) {
+			return t.collectStats().Users, nil
+		},
+	})
+	route("sessions", map[string]adminFunc{
+		"GET": func(r *http.Request) (interface{}, error) {
+			return t.sessionInfos(r.URL.Query().Get("target")), nil
+		},
+	})
+	route("streams", map[string]adminFunc{
+		"GET": func(r *http.Request) (interface{}, error) {
+			return raw(t.DumpStreams(r.URL.Query().Get("target"), true))
+		},
+	})
+	route("tokens", map[string]adminFunc{
+		"GET": func(r *http.Request) (interface{}, error) {
+			return raw(t.DumpTokens())
+		},
+	})
+	route("kick", map[string]adminFunc{"POST": targeted(t.KickSession)})
+	route("pause", map[string]adminFunc{"POST": targeted(t.PauseSession)})
+	route("resume", map[string]adminFunc{"POST": targeted(t.ResumeSession)})
+	route("reload", map[string]adminFunc{
+		"POST": func(r *http.Request) (interface{}, error) {
+			kicked, err := t.Reload()
+			if err != nil {
+				return nil, &adminError{http.StatusInternalServerError, err.Error()}
+			}
+			return map[string]int{"kicked": kicked}, nil
+		},
+	})
+	route("verbosity", map[string]adminFunc{
+		"GET": func(r *http.Request) (interface{}, error) {
+			return map[string]int{"verbosity": log.GetLogVerbose()}, nil
+		},
+		"POST": func(r *http.Request) (interface{}, error) {
+			v, err := strconv.Atoi(r.URL.Query().Get("level"))
+			if err != nil || v < 0 {
+				return nil, &adminError{http.StatusBadRequest, "invalid level"}
+			}
+			log.SetLogVerbose(v)
+			log.Infof("Log verbosity was set to %d by admin", v)
+			return map[string]int{"verbosity": v}, nil
+		},
+	})
+	return mux
+}
+
+func writeAdminReply(w http.ResponseWriter, result interface{}, err error) {
+	w.Header().Set("Content-Type", "application/json")
+	if err != nil {
+		var status = http.StatusInternalServerError
+		if e, y := err.(*adminError); y {
+			status = e.status
+		}
+		w.WriteHeader(status)
+		result = map[string]string{"error": err.Error()}
+	}
+	data, _ := json.MarshalIndent(result, NULL, "  ")
+	w.Write(data)
+}
+
+// the listener of admin API, or nil if not configured
+func (t *Server) ListenAdmin() (net.Listener, error) {
+	if t.Admin == NULL {
+		return nil, nil
+	}
+	if err := validateAdminAddr(t.Admin); err != nil {
+		return nil, err
+	}
+	addr, path, _ := parseListenPath(t.Admin)
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	go newHTTPServer(t.adminHandler(path, t.AdminToken)).Serve(ln)
+	return ln, nil
+}
+
+// the unix socket of admin API, or nil if not configured. the stale socket
+// left by the crashed server is replaced.
+func (t *Server) ListenAdminSocket() (net.Listener, error) {
+	if t.AdminSocket == NULL {
+		return nil, nil
+	}
+	if fi, err := os.Lstat(t.AdminSocket); err == nil {
+		if fi.Mode()&os.ModeSocket == 0 {
+			return nil, CONF_ERROR.Apply("AdminSocket " + t.AdminSocket + " is not socket")
+		}
+		if conn, err := net.Dial("unix", t.AdminSocket); err == nil {
+			conn.Close()
+			return nil, ADMIN_SOCKET_IN_USE.Apply(t.AdminSocket)
+		}
+		os.Remove(t.AdminSocket)
+	}
+	ln, err := net.Listen("unix", t.AdminSocket)
+	if err != nil {
+		return nil, err
+	}
+	if err = os.Chmod(t.AdminSocket, 0600); err != nil {
+		ln.Close()
+		return nil, err
+	}
+	go newHTTPServer(t.adminHandler("/", NULL)).Serve(ln)
+	return ln, nil
+}
+
+// --------------------
+// admin command
+// --------------------
+// the commands of admin API, the arguments after the command name are the
+// target of sessions or the level of verbosity.
+type adminCommand struct {
+	method   string
+	path     string
+	param    string // the query of argument
+	required bool   // the argument
+}
+
+var adminCommands = map[string]*adminCommand{
+	"stats":     {"GET", "stats", NULL, false},
+	"users":     {"GET", "users", NULL, false},
+	"sessions":  {"GET", "sessions", "target", false},
+	"streams":   {"GET", "streams", "target", false},
+	"tokens":    {"GET", "tokens", NULL, false},
+	"kick":      {"POST", "kick", "target", true},
+	"pause":     {"POST", "pause", "target", true},
+	"resume":    {"POST", "resume", "target", true},
+	"reload":    {"POST", "reload", NULL, false},
+	"verbosity": {"GET", "verbosity", "level", false},
+}
+
+// the names of admin commands
+func AdminCommands() []string {
+	var names = make([]string, 0, len(adminCommands))
+	for name := range adminCommands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// request the running server by the admin socket, return the json reply
+func AdminRequest(socket string, args []string) ([]byte, error) {
+	if len(args) < 1 || adminCommands[args[0]] == nil {
+		return nil, ADMIN_BAD_COMMAND.Apply(strings.Join(args, " "))
+	}
+	var (
+		cmd   = adminCommands[args[0]]
+		query = make(url.Values)
+	)
+	if len(args) > 1 && cmd.param != NULL {
+		query.Set(cmd.param, args[1])
+	} else if len(args) > 1 || cmd.required {
+		return nil, ADMIN_BAD_COMMAND.Apply(strings.Join(args, " "))
+	}
+	var method = cmd.method
+	if args[0] == "verbosity" && len(args) > 1 {
+		method = "POST"
+	}
+	var client = &http.Client{
+		Transport: &http.Transport{
+			Dial: func(_, _ string) (net.Conn, error) {
+				return net.DialTimeout("unix", socket, GENERAL_SO_TIMEOUT)
+			},
+		},
+		Timeout: ADMIN_REQUEST_TIMEOUT,
+	}
+	// the host is ignored by the dialer
+	var u = &url.URL{Scheme: "http", Host: "admin", Path: "/" + cmd.path, RawQuery: query.Encode()}
+	req, err := http.NewRequest(method, u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		var reply map[string]string
+		json.Unmarshal(body, &reply)
+		return nil, ADMIN_REQUEST_FAILED.Apply(reply["error"])
+	}
+	return body, nil
+}
@@ -0,0 +1,202 @@
+package tunnel
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/Lafeng/deblocus/auth"
+	log "github.com/Lafeng/deblocus/glog"
+)
+
+func newTestAuthSys(t *testing.T, users string) auth.AuthSys {
+	f, err := ioutil.TempFile(NULL, "auth")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	f.WriteString(users)
+	f.Close()
+	sys, err := auth.NewFileAuthSys(f.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return sys
+}
+
+func TestAdminAPI(t *testing.T) {
+	var (
+		serv  = newTestServer()
+		alice = newTestSession(serv, "alice")
+		bob   = newTestSession(serv, "bob")
+	)
+	serv.AdminToken = "0123456789abcdef"
+	for _, s := range []*Session{alice, bob} {
+		serv.sessionMgr.register(s)
+		defer s.destroy(SESSION_CLOSE_SHUTDOWN)
+	}
+	alice.mux.rxBytes = 100
+	ts := httptest.NewServer(serv.adminHandler("/admin", serv.AdminToken))
+	defer ts.Close()
+
+	var call = func(method, path, token string, expected int, result interface{}) {
+		req, _ := http.NewRequest(method, ts.URL+path, nil)
+		if token != NULL {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		body, _ := ioutil.ReadAll(resp.Body)
+		if resp.StatusCode != expected {
+			t.Fatalf("%s %s status=%d body=%s", method, path, resp.StatusCode, body)
+		}
+		if result != nil {
+			if err = json.Unmarshal(body, result); err != nil {
+				t.Fatalf("%s %s body=%s err=%v", method, path, body, err)
+			}
+		}
+	}
+	var token = serv.AdminToken
+	call("GET", "/admin/sessions", NULL, http.StatusUnauthorized, nil)
+	call("GET", "/admin/sessions", "0123456789abcdeF", http.StatusUnauthorized, nil)
+	call("POST", "/admin/sessions", token, http.StatusMethodNotAllowed, nil)
+
+	var sessions []*SessionInfo
+	call("GET", "/admin/sessions", token, http.StatusOK, &sessions)
+	if len(sessions) != 2 || sessions[0].User != "alice" || sessions[0].RxBytes != 100 {
+		t.Errorf("unexpected sessions %+v", sessions)
+	}
+	var users map[string]*UserStats
+	call("GET", "/admin/users", token, http.StatusOK, &users)
+	if len(users) != 2 || users["alice"] == nil || users["alice"].RxBytes != 100 {
+		t.Errorf("unexpected users %+v", users)
+	}
+
+	// kick
+	var reply map[string]int
+	call("POST", "/admin/kick", token, http.StatusBadRequest, nil)
+	call("POST", "/admin/kick?target=bob", token, http.StatusOK, &reply)
+	if reply["sessions"] != 1 {
+		t.Errorf("kicked %v", reply)
+	}
+	sessions = nil
+	call("GET", "/admin/sessions?target=bob", token, http.StatusOK, &sessions)
+	if len(sessions) != 0 {
+		t.Errorf("bob was not kicked %+v", sessions)
+	}
+
+	// verbosity
+	defer log.SetLogVerbose(log.GetLogVerbose())
+	call("POST", "/admin/verbosity?level=x", token, http.StatusBadRequest, nil)
+	call("POST", "/admin/verbosity?level=3", token, http.StatusOK, nil)
+	call("GET", "/admin/verbosity", token, http.StatusOK, &reply)
+	if reply["verbosity"] != 3 {
+		t.Errorf("verbosity %v", reply)
+	}
+}
+
+func TestReloadUsers(t *testing.T) {
+	var (
+		serv  = newTestServer()
+		alice = newTestSession(serv, "alice")
+		bob   = newTestSession(serv, "bob")
+	)
+	serv.users = newReloadableAuth(newTestAuthSys(t, "alice:a\nbob:b\n"))
+	serv.AuthSys = serv.users
+	for _, s := range []*Session{alice, bob} {
+		serv.sessionMgr.register(s)
+		defer s.destroy(SESSION_CLOSE_SHUTDOWN)
+	}
+	if kicked := serv.reloadUsers(newTestAuthSys(t, "alice:a2\n")); kicked != 1 {
+		t.Errorf("kicked %d sessions", kicked)
+	}
+	if y, _ := serv.AuthSys.Authenticate("alice", "a2"); !y {
+		t.Errorf("the users were not reloaded")
+	}
+	if u, _ := serv.AuthSys.UserInfo("bob"); u != nil {
+		t.Errorf("bob was not removed")
+	}
+	if len(serv.sessionMgr.lookup("bob")) != 0 || len(serv.sessionMgr.lookup("alice")) != 1 {
+		t.Errorf("unexpected sessions after reloading")
+	}
+}
+
+func TestAdminAddr(t *testing.T) {
+	for addr, valid := range map[string]bool{
+		"127.0.0.1:9300":       true,
+		"localhost:9300/admin": true,
+		"[::1]:9300":           true,
+		":9300":                false,
+		"0.0.0.0:9300":         false,
+		"10.0.0.1:9300":        false,
+	} {
+		if err := validateAdminAddr(addr); (err == nil) != valid {
+			t.Errorf("addr=%s err=%v", addr, err)
+		}
+	}
+}
+
+func TestAdminSocket(t *testing.T) {
+	var (
+		serv  = newTestServer()
+		alice = newTestSession(serv, "alice")
+	)
+	dir, err := ioutil.TempDir(NULL, "admin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	serv.AdminSocket = filepath.Join(dir, "admin.sock")
+	serv.sessionMgr.register(alice)
+	defer alice.destroy(SESSION_CLOSE_SHUTDOWN)
+
+	// the stale socket is replaced
+	stale, err := net.Listen("unix", serv.AdminSocket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stale.(*net.UnixListener).SetUnlinkOnClose(false)
+	stale.Close()
+	ln, err := serv.ListenAdminSocket()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	if fi, _ := os.Stat(serv.AdminSocket); fi == nil || fi.Mode().Perm() != 0600 {
+		t.Errorf("socket mode %v", fi)
+	}
+	if _, err = serv.ListenAdminSocket(); err == nil {
+		t.Errorf("listened on the socket in use")
+	}
+
+	var sessions []*SessionInfo
+	reply, err := AdminRequest(serv.AdminSocket, []string{"sessions"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = json.Unmarshal(reply, &sessions); err != nil || len(sessions) != 1 || sessions[0].User != "alice" {
+		t.Errorf("sessions=%s err=%v", reply, err)
+	}
+	for _, args := range [][]string{nil, {"unknown"}, {"kick"}, {"stats", "alice"}} {
+		if _, err = AdminRequest(serv.AdminSocket, args); err == nil {
+			t.Errorf("requested the invalid %v", args)
+		}
+	}
+	if reply, err = AdminRequest(serv.AdminSocket, []string{"kick", "alice"}); err != nil {
+		t.Fatal(err)
+	}
+	if len(serv.sessionMgr.lookup(NULL)) != 0 {
+		t.Errorf("not kicked reply=%s", reply)
+	}
+	if _, err = AdminRequest(filepath.Join(dir, "none.sock"), []string{"stats"}); err == nil {
+		t.Errorf("requested the absent socket")
+	}
+}
@@ -0,0 +1,163 @@
+package tunnel
+
+import (
+	"crypto/cipher"
+	"encoding/binary"
+	"io"
+
+	"github.com/Lafeng/deblocus/crypto"
+	"github.com/Lafeng/deblocus/exception"
+)
+
+const (
+	AEAD_SALT_LEN    = 16
+	AEAD_PAYLOAD_MAX = 0x3fff
+)
+
+var (
+	AUTHENTICATION_FAILED = exception.New("Authentication failed")
+)
+
+// --------------------
+// aeadCipherKit
+// --------------------
+// the authenticated ciphers (chacha20-poly1305, aes-gcm) seal the stream
+// into records:
+//   salt | sealed length(2) | sealed payload | sealed length | ...
+// each direction derives its subkey from the key of session and its random
+// salt sent ahead of the first record, so the both sides never reuse the
+// nonces which are the counter of sealing.
+// the record is read across the timeouts of the tunnel reader.
+
+type aeadCipherKit struct {
+	wkey    []byte // of directions, rotated by rekey
+	rkey    []byte
+	newAEAD func(key []byte) (cipher.AEAD, error)
+	// sealing
+	sealer cipher.AEAD
+	wnonce []byte
+	// opening
+	opener cipher.AEAD
+	rnonce []byte
+	rbuf   []byte
+	filled int
+	plen   int    // length of the pending payload, -1 if reading length
+	plain  []byte // opened but unread
+}
+
+func new_ChaCha20Poly1305(key, iv []byte) cipherKit {
+	return newAEADCipherKit(key, iv, crypto.NewChaCha20Poly1305)
+}
+
+func newAEADCipherKit(key, iv []byte, newAEAD func([]byte) (cipher.AEAD, error)) *aeadCipherKit {
+	key = normalizeKey(len(key), key, iv)
+	return &aeadCipherKit{
+		wkey:    key,
+		rkey:    append([]byte(nil), key...),
+		newAEAD: newAEAD,
+		rbuf:    make([]byte, AEAD_SALT_LEN),
+		plen:    -1,
+	}
+}
+
+// the stream ciphers only
+func (c *aeadCipherKit) encrypt(dst, src []byte) {
+	panic(ILLEGAL_STATE.Apply("AEAD"))
+}
+
+func (c *aeadCipherKit) decrypt(dst, src []byte) {
+	panic(ILLEGAL_STATE.Apply("AEAD"))
+}
+
+func (c *aeadCipherKit) Cleanup() {
+	crypto.Memset(c.wkey, 0)
+	crypto.Memset(c.rkey, 0)
+}
+
+// the records of b
+func (c *aeadCipherKit) seal(b []byte) []byte {
+	var salt []byte
+	if c.sealer == nil {
+		salt = randArray(AEAD_SALT_LEN)
+		c.sealer = c.subkey(c.wkey, salt)
+		c.wnonce = make([]byte, c.sealer.NonceSize())
+	}
+	var (
+		records = (len(b) + AEAD_PAYLOAD_MAX - 1) / AEAD_PAYLOAD_MAX
+		out     = bytePool.Get(len(salt) + len(b) + records*(2+2*c.sealer.Overhead()))[:0]
+		length  [2]byte
+	)
+	out = append(out, salt...)
+	for len(b) > 0 {
+		n := minInt(len(b), AEAD_PAYLOAD_MAX)
+		binary.BigEndian.PutUint16(length[:], uint16(n))
+		out = c.sealer.Seal(out, c.wnonce, length[:], nil)
+		increaseNonce(c.wnonce)
+		out = c.sealer.Seal(out, c.wnonce, b[:n], nil)
+		increaseNonce(c.wnonce)
+		b = b[n:]
+	}
+	return out
+}
+
+// read the plaintext of records from r
+func (c *aeadCipherKit) open(r io.Reader, b []byte) (int, error) {
+	for len(c.plain) == 0 {
+		var need int
+		switch {
+		case c.opener == nil:
+			need = AEAD_SALT_LEN
+		case c.plen < 0:
+			need = 2 + c.opener.Overhead()
+		default:
+			need = c.plen + c.opener.Overhead()
+		}
+		// keep the partial record if timeout
+		for c.filled < need {
+			n, err := r.Read(c.rbuf[c.filled:need])
+			c.filled += n
+			if err != nil && c.filled < need {
+				return 0, err
+			}
+		}
+		c.filled = 0
+		if c.opener == nil {
+			c.opener = c.subkey(c.rkey, c.rbuf[:AEAD_SALT_LEN])
+			c.rnonce = make([]byte, c.opener.NonceSize())
+			c.rbuf = make([]byte, AEAD_PAYLOAD_MAX+c.opener.Overhead())
+			continue
+		}
+		opened, err := c.opener.Open(c.rbuf[:0], c.rnonce, c.rbuf[:need], nil)
+		if err != nil {
+			return 0, AUTHENTICATION_FAILED
+		}
+		increaseNonce(c.rnonce)
+		if c.plen < 0 {
+			c.plen = int(binary.BigEndian.Uint16(opened))
+			if c.plen == 0 || c.plen > AEAD_PAYLOAD_MAX {
+				return 0, AUTHENTICATION_FAILED
+			}
+		} else {
+			c.plen, c.plain = -1, opened
+		}
+	}
+	n := copy(b, c.plain)
+	c.plain = c.plain[n:]
+	return n, nil
+}
+
+func (c *aeadCipherKit) subkey(key, salt []byte) cipher.AEAD {
+	aead, err := c.newAEAD(normalizeKey(len(key), key, salt))
+	ThrowErr(err)
+	return aead
+}
+
+// little endian counter
+func increaseNonce(nonce []byte) {
+	for i := range nonce {
+		nonce[i]++
+		if nonce[i] != 0 {
+			return
+		}
+	}
+}
@@ -0,0 +1,112 @@
+package tunnel
+
+import (
+	"bytes"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/Lafeng/deblocus/crypto"
+)
+
+// yields a byte with a timeout before each
+type tricklingReader struct {
+	data    []byte
+	timeout bool
+}
+
+func (r *tricklingReader) Read(b []byte) (int, error) {
+	if r.timeout = !r.timeout; r.timeout {
+		return 0, timeoutError{}
+	}
+	if len(r.data) == 0 {
+		return 0, io.EOF
+	}
+	b[0], r.data = r.data[0], r.data[1:]
+	return 1, nil
+}
+
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+func TestAEADConn(t *testing.T) {
+	for _, name := range []string{"chacha20-poly1305", "AES128GCM", "AES256GCM"} {
+		testAEADConn(t, name)
+	}
+}
+
+func testAEADConn(t *testing.T, name string) {
+	var (
+		iv = []byte("0123456789abcdef")
+		cf = NewCipherFactory(name, []byte("secret"))
+	)
+	c, s := tcpPair(t)
+	defer c.Close()
+	defer s.Close()
+	client, server := NewConn(c, cf.InitCipher(iv)), NewConn(s, cf.InitCipher(iv))
+	var echo = func(w, r *Conn, size int) {
+		data := randArray(size)
+		go w.Write(append([]byte(nil), data...))
+		buf := make([]byte, size)
+		r.SetReadDeadline(time.Now().Add(GENERAL_SO_TIMEOUT))
+		if _, err := io.ReadFull(r, buf); err != nil {
+			t.Fatal(name, size, err)
+		}
+		if !bytes.Equal(data, buf) {
+			t.Fatalf("%s size=%d mismatched", name, size)
+		}
+	}
+	for _, size := range []int{1, AEAD_PAYLOAD_MAX + 1, FRAME_MAX_LEN} {
+		echo(client, server, size)
+		echo(server, client, size)
+	}
+	// salted subkeys of directions
+	if client.cipher.(*aeadCipherKit).sealer == server.cipher.(*aeadCipherKit).sealer {
+		t.Errorf("%s: directions shared the subkey", name)
+	}
+}
+
+func TestAEADRecord(t *testing.T) {
+	var (
+		iv     = []byte("0123456789abcdef")
+		cf     = NewCipherFactory("CHACHA20-POLY1305", []byte("secret"))
+		sealer = cf.InitCipher(iv).(recordCipherKit)
+		data   = randArray(AEAD_PAYLOAD_MAX + 100)
+		sealed = sealer.seal(data)
+	)
+	if len(sealed) != AEAD_SALT_LEN+2*(2+2*crypto.POLY1305_TAG_SIZE)+len(data) {
+		t.Fatalf("sealed %d bytes", len(sealed))
+	}
+	// the partial record is kept across the timeouts
+	var (
+		opener = cf.InitCipher(iv).(recordCipherKit)
+		r      = &tricklingReader{data: sealed}
+		buf    = make([]byte, len(data))
+		n      int
+	)
+	for n < len(buf) {
+		m, err := opener.open(r, buf[n:])
+		if err != nil && !IsTimeout(err) {
+			t.Fatal(err)
+		}
+		n += m
+	}
+	if !bytes.Equal(buf, data) {
+		t.Fatalf("opened mismatched")
+	}
+
+	// tampered
+	sealed = sealer.seal(data[:100])
+	sealed[len(sealed)-1] ^= 1
+	if _, err := opener.open(bytes.NewReader(sealed), buf); err != AUTHENTICATION_FAILED {
+		t.Errorf("opened the tampered %v", err)
+	}
+	// the other key
+	opener = NewCipherFactory("CHACHA20-POLY1305", []byte("other")).InitCipher(iv).(recordCipherKit)
+	if _, err := opener.open(bytes.NewReader(cf.InitCipher(iv).(recordCipherKit).seal(data[:100])), buf); err != AUTHENTICATION_FAILED {
+		t.Errorf("opened by the other key %v", err)
+	}
+}
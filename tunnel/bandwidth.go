@@ -0,0 +1,175 @@
+package tunnel
+
+import (
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Lafeng/deblocus/exception"
+)
+
+const (
+	// user attribute, value: [HH:MM-HH:MM] rate
+	// eg. 08:00-23:00 256K, or 1M for the rest of day
+	UA_BANDWIDTH = "bandwidth"
+	// user attribute, value: IANA name of timezone for the schedules
+	// eg. Asia/Shanghai, the server local time by default
+	UA_TIMEZONE  = "timezone"
+	BW_UNLIMITED = "unlimited"
+	BW_BURST     = time.Millisecond * 100
+)
+
+var (
+	INVALID_BANDWIDTH = exception.New("Invalid bandwidth schedule")
+)
+
+// --------------------
+// bwSchedule
+// --------------------
+// the time-of-day windows are evaluated with the wall clock of timezone,
+// so they follow the DST changes of that zone.
+type bwWindow struct {
+	from, to int   // minutes of day, from == to is whole day
+	rate     int64 // bytes per second, 0 is unlimited
+}
+
+type bwSchedule struct {
+	windows []bwWindow // the first matched wins
+	loc     *time.Location
+}
+
+func (w *bwWindow) contains(minute int) bool {
+	switch {
+	case w.from < w.to:
+		return minute >= w.from && minute < w.to
+	case w.from > w.to: // across midnight
+		return minute >= w.from || minute < w.to
+	}
+	return true
+}
+
+func parseClock(str string) (int, error) {
+	t, err := time.Parse("15:04", strings.TrimSpace(str))
+	if err != nil {
+		return 0, err
+	}
+	return t.Hour()*60 + t.Minute(), nil
+}
+
+func parseBandwidthSchedule(values []string, tz string) (*bwSchedule, error) {
+	var (
+		s        = &bwSchedule{loc: time.Local}
+		wholeDay []bwWindow
+		err      error
+	)
+	if tz != NULL {
+		if s.loc, err = time.LoadLocation(tz); err != nil {
+			return nil, INVALID_BANDWIDTH.Apply(err)
+		}
+	}
+	for _, v := range values {
+		var (
+			w      bwWindow
+			fields = strings.Fields(v)
+		)
+		if len(fields) < 1 || len(fields) > 2 {
+			return nil, INVALID_BANDWIDTH.Apply(v)
+		}
+		var rate = fields[len(fields)-1]
+		if len(fields) == 2 {
+			from, to := SubstringBefore(fields[0], "-")
+			if w.from, err = parseClock(from); err == nil {
+				w.to, err = parseClock(to)
+			}
+			if err != nil {
+				return nil, INVALID_BANDWIDTH.Apply(v)
+			}
+		}
+		if rate != BW_UNLIMITED {
+			if w.rate, err = parseHumanSize(rate); err != nil || w.rate <= 0 {
+				return nil, INVALID_BANDWIDTH.Apply(v)
+			}
+		}
+		if len(fields) == 2 && w.from != w.to {
+			s.windows = append(s.windows, w)
+		} else {
+			wholeDay = append(wholeDay, w)
+		}
+	}
+	// the rest of day
+	s.windows = append(s.windows, wholeDay...)
+	return s, nil
+}
+
+// the rate at now, 0 is unlimited
+func (s *bwSchedule) rateAt(now time.Time) int64 {
+	var (
+		t      = now.In(s.loc)
+		minute = t.Hour()*60 + t.Minute()
+	)
+	for _, w := range s.windows {
+		if w.contains(minute) {
+			return w.rate
+		}
+	}
+	return 0
+}
+
+// --------------------
+// bwLimiter
+// --------------------
+// token bucket following the schedule, the rate is re-evaluated on the
+// minute boundaries then the sessions switch the limits without dropping.
+type bwLimiter struct {
+	lock     sync.Mutex
+	schedule *bwSchedule
+	rate     int64
+	tokens   float64
+	last     time.Time
+	recheck  time.Time
+}
+
+func newBwLimiter(schedule *bwSchedule) *bwLimiter {
+	return &bwLimiter{schedule: schedule}
+}
+
+// take n bytes and return the time to wait for
+func (l *bwLimiter) reserve(n int, now time.Time) time.Duration {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if !now.Before(l.recheck) {
+		l.rate = l.schedule.rateAt(now)
+		l.recheck = now.Truncate(time.Minute).Add(time.Minute)
+	}
+	if l.rate <= 0 {
+		// the debt is forgiven
+		l.tokens, l.last = 0, now
+		return 0
+	}
+	var rate = float64(l.rate)
+	if !l.last.IsZero() {
+		l.tokens += rate * now.Sub(l.last).Seconds()
+		if max := rate * BW_BURST.Seconds(); l.tokens > max {
+			l.tokens = max
+		}
+	}
+	l.last = now
+	l.tokens -= float64(n)
+	if l.tokens < 0 {
+		return time.Duration(-l.tokens / rate * float64(time.Second))
+	}
+	return 0
+}
+
+func (l *bwLimiter) acquire(n int) {
+	if wait := l.reserve(n, time.Now()); wait > 0 {
+		time.Sleep(wait)
+	}
+}
+
+// current limit, 0 is unlimited
+func (l *bwLimiter) limit() int64 {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	return l.rate
+}
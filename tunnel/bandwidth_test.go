@@ -0,0 +1,118 @@
+package tunnel
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Lafeng/deblocus/auth"
+)
+
+func TestParseBandwidthSchedule(t *testing.T) {
+	for _, values := range [][]string{
+		{"09:00-17:00"},
+		{"09:00 1K"},
+		{"25:00-26:00 1K"},
+		{"09:00-17:00 1K 2K"},
+		{"09:00-17:00 -1K"},
+		{""},
+	} {
+		if _, err := parseBandwidthSchedule(values, NULL); err == nil {
+			t.Errorf("expected error of %q", values)
+		}
+	}
+	if _, err := parseBandwidthSchedule([]string{"1M"}, "Mars/Olympus"); err == nil {
+		t.Errorf("expected error of timezone")
+	}
+	s, err := parseBandwidthSchedule([]string{"2M", "22:00-06:00 unlimited", "08:00-23:00 256K"}, "UTC")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for clock, expected := range map[string]int64{
+		"07:30": 2 << 20,
+		"08:00": 256 << 10,
+		"21:59": 256 << 10,
+		"22:00": 0, // the first matched wins
+		"05:59": 0,
+		"06:00": 2 << 20,
+	} {
+		now, _ := time.Parse("2006-01-02 15:04", "2021-06-01 "+clock)
+		if r := s.rateAt(now); r != expected {
+			t.Errorf("rate at %s is %d, expected %d", clock, r, expected)
+		}
+	}
+}
+
+func TestBandwidthAcrossBoundary(t *testing.T) {
+	s, _ := parseBandwidthSchedule([]string{"09:00-17:00 1K", "17:00-18:00 4K"}, "UTC")
+	var (
+		l      = newBwLimiter(s)
+		now, _ = time.Parse(time.RFC3339, "2021-06-01T16:59:58Z")
+	)
+	// peak hours
+	if wait := l.reserve(2048, now); wait != 2*time.Second {
+		t.Errorf("wait=%s in peak", wait)
+	}
+	now = now.Add(time.Second)
+	if wait := l.reserve(0, now); wait != time.Second {
+		t.Errorf("wait=%s before boundary", wait)
+	}
+	// the debt of peak is repaid with the new rate
+	now = now.Add(time.Second)
+	if wait := l.reserve(4096, now); wait < time.Second*3/4 || wait > time.Second {
+		t.Errorf("wait=%s after boundary", wait)
+	}
+	if l.limit() != 4<<10 {
+		t.Errorf("limit=%d", l.limit())
+	}
+	// unlimited
+	now = now.Add(time.Hour)
+	if wait := l.reserve(1<<20, now); wait != 0 || l.limit() != 0 {
+		t.Errorf("wait=%s limit=%d off-peak", wait, l.limit())
+	}
+}
+
+func TestBandwidthTimezone(t *testing.T) {
+	s, err := parseBandwidthSchedule([]string{"09:00-10:00 1K"}, "America/New_York")
+	if err != nil {
+		t.Skip(err)
+	}
+	for utc, limited := range map[string]bool{
+		"2021-07-01T13:30:00Z": true,  // 09:30 EDT
+		"2021-01-04T13:30:00Z": false, // 08:30 EST
+		"2021-01-04T14:30:00Z": true,  // 09:30 EST
+		// the day of DST starting
+		"2021-03-14T13:30:00Z": true,
+		"2021-03-14T14:30:00Z": false,
+	} {
+		now, _ := time.Parse(time.RFC3339, utc)
+		if r := s.rateAt(now); (r > 0) != limited {
+			t.Errorf("rate at %s is %d", utc, r)
+		}
+	}
+}
+
+func TestBandwidthOfUser(t *testing.T) {
+	var (
+		serv = newTestServer()
+		u    = &auth.User{Name: "peak", Attrs: make(auth.Attributes)}
+	)
+	u.Attrs.Add(UA_BANDWIDTH, "512K")
+	s := newTestSession(serv, u.Name)
+	s.applyUserPolicy(u)
+	if s.mux.bandwidth == nil {
+		t.Fatal("bandwidth was not applied")
+	}
+	s.mux.bandwidth.reserve(0, time.Now())
+	serv.sessionMgr.register(s)
+	if !strings.Contains(serv.Stats(), "Bandwidth=512.0KB/s") {
+		t.Errorf("unexpected stats %s", serv.Stats())
+	}
+
+	u.Attrs.Add(UA_TIMEZONE, "Nowhere")
+	s = newTestSession(serv, u.Name)
+	s.applyUserPolicy(u)
+	if s.mux.bandwidth != nil {
+		t.Errorf("invalid schedule was applied")
+	}
+}
@@ -0,0 +1,91 @@
+package tunnel
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+)
+
+const (
+	// the tiers of buffers in power of 2, 64B to 64K
+	BUF_TIER_MIN = 6
+	BUF_TIER_MAX = 16
+)
+
+// --------------------
+// bufferPool
+// --------------------
+// the buffers of frames are taken from the smallest tier fitting the size,
+// and returned to the tier of its capacity. the tiers are sync.Pool, so the
+// idle buffers are released by GC without draining. the larger than the top
+// tier are allocated as is.
+// the tiers hold *[]byte, since a slice boxed in interface is allocated.
+// the emptied pointers are recycled by holders for the next Put.
+type bufferPool struct {
+	gets    int64
+	misses  int64 // allocated by the empty tiers
+	tiers   [BUF_TIER_MAX - BUF_TIER_MIN + 1]sync.Pool
+	holders sync.Pool
+}
+
+func newBufferPool() *bufferPool {
+	p := new(bufferPool)
+	for i := range p.tiers {
+		var size = 1 << uint(i+BUF_TIER_MIN)
+		p.tiers[i].New = func() interface{} {
+			atomic.AddInt64(&p.misses, 1)
+			buf := make([]byte, size)
+			return &buf
+		}
+	}
+	p.holders.New = func() interface{} {
+		return new([]byte)
+	}
+	return p
+}
+
+// tier of the smallest capacity not less than size
+func tierOf(size int) int {
+	var t = BUF_TIER_MIN
+	for 1<<uint(t) < size {
+		t++
+	}
+	return t - BUF_TIER_MIN
+}
+
+func (p *bufferPool) Get(size int) []byte {
+	if size < 1 || size > 1<<BUF_TIER_MAX {
+		return make([]byte, size)
+	}
+	atomic.AddInt64(&p.gets, 1)
+	holder := p.tiers[tierOf(size)].Get().(*[]byte)
+	buf := *holder
+	*holder = nil
+	p.holders.Put(holder)
+	return buf[:size]
+}
+
+// the buffer must not be used after returned
+func (p *bufferPool) Put(buf []byte) {
+	var c = cap(buf)
+	if c < 1<<BUF_TIER_MIN || c > 1<<BUF_TIER_MAX {
+		return
+	}
+	// the tier of capacity not greater than it
+	var t = tierOf(c)
+	if 1<<uint(t+BUF_TIER_MIN) > c {
+		t--
+	}
+	holder := p.holders.Get().(*[]byte)
+	*holder = buf[:c]
+	p.tiers[t].Put(holder)
+}
+
+func (p *bufferPool) String() string {
+	var gets, misses = atomic.LoadInt64(&p.gets), atomic.LoadInt64(&p.misses)
+	var hits float64
+	if gets > 0 && gets > misses {
+		hits = float64(gets-misses) * 100 / float64(gets)
+	}
+	return fmt.Sprintf("Buffer-gets=%d Buffer-hits=%.1f%%", gets, hits)
+}
@@ -0,0 +1,43 @@
+package tunnel
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestBufferPool(t *testing.T) {
+	var p = newBufferPool()
+	for size, expected := range map[int]int{1: 64, 64: 64, 65: 128, FRAME_HEADER_LEN: 64, FRAME_MAX_LEN: 1 << 16} {
+		if buf := p.Get(size); len(buf) != size || cap(buf) != expected {
+			t.Errorf("size=%d len=%d cap=%d", size, len(buf), cap(buf))
+		}
+	}
+	// beyond the tiers
+	if buf := p.Get(1<<16 + 1); cap(buf) != 1<<16+1 {
+		t.Errorf("cap=%d", cap(buf))
+	}
+	if buf := p.Get(0); buf == nil || len(buf) != 0 {
+		t.Errorf("empty buf=%v", buf)
+	}
+
+	// returned to the tier of capacity, may be dropped by sync.Pool
+	buf := p.Get(1000)
+	p.Put(buf[:10])
+	if reused := p.Get(600); len(reused) != 600 || cap(reused) != 1024 {
+		t.Errorf("len=%d cap=%d", len(reused), cap(reused))
+	}
+	// the irregular capacity goes to the lower tier
+	p.Put(make([]byte, 100))
+	if buf = *p.tiers[tierOf(64)].Get().(*[]byte); cap(buf) != 100 && cap(buf) != 64 {
+		t.Errorf("irregular cap=%d", cap(buf))
+	}
+	p.Put(make([]byte, 10))
+	p.Put(make([]byte, 1<<17))
+	if s := p.String(); !strings.HasPrefix(s, "Buffer-gets=") {
+		t.Errorf("unexpected %s", s)
+	}
+	// recycled without allocating
+	if n := testing.AllocsPerRun(100, func() { p.Put(p.Get(1000)) }); n > 0 {
+		t.Errorf("allocated %.1f times per recycling", n)
+	}
+}
@@ -0,0 +1,126 @@
+package tunnel
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"io/ioutil"
+	"strings"
+)
+
+const (
+	// listeners could be wrapped in TLS
+	TLS_LISTENER_TUNNEL    = "tunnel"
+	TLS_LISTENER_WEBSOCKET = "websocket"
+)
+
+// --------------------
+// tlsCamouflage
+// --------------------
+// the handshake and frames of tunnel are carried by a real TLS session with
+// the configured certificate, so the traffic looks like ordinary HTTPS to
+// middleboxes. the negotiation inside is unchanged, the cost is the second
+// encryption layer.
+type tlsCamouflage struct {
+	config    *tls.Config
+	tunnel    bool
+	websocket bool
+}
+
+// listeners: comma-separated
+func newTLSCamouflage(listeners, certFile, keyFile string) (*tlsCamouflage, error) {
+	var c = new(tlsCamouflage)
+	for _, l := range strings.Split(listeners, ",") {
+		switch strings.TrimSpace(l) {
+		case TLS_LISTENER_TUNNEL:
+			c.tunnel = true
+		case TLS_LISTENER_WEBSOCKET:
+			c.websocket = true
+		case NULL:
+		default:
+			return nil, CONF_ERROR.Apply("TLS " + l)
+		}
+	}
+	var err error
+	// look like a web server
+	if c.config, err = loadServerTLSConfig(certFile, keyFile, "http/1.1"); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+func loadServerTLSConfig(certFile, keyFile string, protos ...string) (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, CONF_ERROR.Apply("TLSCert: " + err.Error())
+	}
+	return &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+		NextProtos:   protos,
+	}, nil
+}
+
+// the ClientHello of camouflage mimics the current browsers by the profile,
+// the floor of version and the suites offered. the stale versions are not
+// accepted since the naive censors detect them.
+var tlsVersions = map[string]uint16{
+	"1.2": tls.VersionTLS12,
+	"1.3": 0x0304, // requires the runtime supports it
+}
+
+// the suites of TLS 1.2, the ones of 1.3 are offered by the runtime
+var tlsCipherSuites = map[string]uint16{
+	"TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256":       tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
+	"TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256":         tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
+	"TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384":       tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384,
+	"TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384":         tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384,
+	"TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305_SHA256": tls.TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305,
+	"TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305_SHA256":   tls.TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305,
+	"TLS_ECDHE_ECDSA_WITH_AES_128_CBC_SHA":          tls.TLS_ECDHE_ECDSA_WITH_AES_128_CBC_SHA,
+	"TLS_ECDHE_RSA_WITH_AES_128_CBC_SHA":            tls.TLS_ECDHE_RSA_WITH_AES_128_CBC_SHA,
+	"TLS_ECDHE_ECDSA_WITH_AES_256_CBC_SHA":          tls.TLS_ECDHE_ECDSA_WITH_AES_256_CBC_SHA,
+	"TLS_ECDHE_RSA_WITH_AES_256_CBC_SHA":            tls.TLS_ECDHE_RSA_WITH_AES_256_CBC_SHA,
+}
+
+// version eg. 1.3, suites separated by comma, the defaults if empty
+func applyTLSProfile(config *tls.Config, version, suites string) error {
+	if version != NULL {
+		v, y := tlsVersions[strings.TrimSpace(version)]
+		if !y {
+			return CONF_ERROR.Apply("TLSVersion")
+		}
+		config.MinVersion = v
+	}
+	if suites != NULL {
+		config.CipherSuites = nil
+		for _, name := range strings.Split(suites, ",") {
+			s, y := tlsCipherSuites[strings.ToUpper(strings.TrimSpace(name))]
+			if !y {
+				return CONF_ERROR.Apply("TLSCipherSuites " + name)
+			}
+			config.CipherSuites = append(config.CipherSuites, s)
+		}
+	}
+	return nil
+}
+
+// the server name is verified, and the root CA in PEM file is trusted
+// instead of the system pool if specified, eg. self-signed.
+func newClientTLSConfig(serverName, rootCA string) (*tls.Config, error) {
+	var config = &tls.Config{
+		ServerName: serverName,
+		MinVersion: tls.VersionTLS12,
+		NextProtos: []string{"http/1.1"},
+	}
+	if rootCA != NULL {
+		pem, err := ioutil.ReadFile(rootCA)
+		if err != nil {
+			return nil, CONF_ERROR.Apply("TLSRootCA: " + err.Error())
+		}
+		config.RootCAs = x509.NewCertPool()
+		if !config.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, CONF_ERROR.Apply("TLSRootCA")
+		}
+	}
+	return config, nil
+}
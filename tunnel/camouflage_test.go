@@ -0,0 +1,159 @@
+package tunnel
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// write self-signed cert and key of host to dir
+func writeTestCert(t *testing.T, dir, host string) (certFile, keyFile string) {
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: host},
+		DNSNames:              []string{host},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDer, _ := x509.MarshalECPrivateKey(key)
+	certFile, keyFile = filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600)
+	ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600)
+	return
+}
+
+func TestTLSCamouflage(t *testing.T) {
+	dir, err := ioutil.TempDir(NULL, "tls")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	certFile, keyFile := writeTestCert(t, dir, "example.com")
+
+	if _, err = newTLSCamouflage("tunnel,http", certFile, keyFile); err == nil {
+		t.Errorf("accepted unknown listener")
+	}
+	cam, err := newTLSCamouflage("tunnel", certFile, keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !cam.tunnel || cam.websocket {
+		t.Errorf("listeners tunnel=%t websocket=%t", cam.tunnel, cam.websocket)
+	}
+	config, err := newClientTLSConfig("example.com", certFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c, s := tcpPair(t)
+	var (
+		server = tls.Server(s, cam.config)
+		client = tls.Client(c, config)
+		msg    = randArray(FRAME_MAX_LEN)
+	)
+	defer server.Close()
+	defer client.Close()
+	go io.Copy(server, server)
+	go client.Write(msg)
+	echo := make([]byte, len(msg))
+	if _, err = io.ReadFull(client, echo); err != nil {
+		t.Fatal(err)
+	}
+	if string(echo) != string(msg) {
+		t.Errorf("echo mismatched")
+	}
+
+	// verify server name
+	c, s = tcpPair(t)
+	defer c.Close()
+	go tls.Server(s, cam.config).Handshake()
+	config.ServerName = "example.org"
+	if err = tls.Client(c, config).Handshake(); err == nil {
+		t.Errorf("accepted mismatched server name")
+	}
+	s.Close()
+}
+
+func TestTLSProfile(t *testing.T) {
+	dir, err := ioutil.TempDir(NULL, "tls")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	certFile, keyFile := writeTestCert(t, dir, "example.com")
+	cam, err := newTLSCamouflage("tunnel", certFile, keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config, err := newClientTLSConfig("example.com", certFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, bad := range [][2]string{{"1.1", NULL}, {"ssl3", NULL}, {NULL, "TLS_RSA_WITH_RC4_128_SHA"}} {
+		if applyTLSProfile(config, bad[0], bad[1]) == nil {
+			t.Errorf("accepted profile %q", bad)
+		}
+	}
+
+	suites := " tls_ecdhe_ecdsa_with_chacha20_poly1305_sha256,TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384"
+	if err = applyTLSProfile(config, "1.2", suites); err != nil {
+		t.Fatal(err)
+	}
+	offered := make(chan []uint16, 1)
+	serverConfig := cam.config.Clone()
+	serverConfig.GetConfigForClient = func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+		offered <- hello.CipherSuites
+		return nil, nil
+	}
+	c, s := tcpPair(t)
+	go tls.Server(s, serverConfig).Handshake()
+	if err = tls.Client(c, config).Handshake(); err != nil {
+		t.Fatal(err)
+	}
+	c.Close()
+	s.Close()
+	var hello, got = <-offered, make(map[uint16]bool)
+	for _, s := range hello {
+		if s>>8 != 0x13 { // of 1.3 by the runtime
+			got[s] = true
+		}
+	}
+	if len(got) != 2 || !got[tls.TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305] ||
+		!got[tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384] {
+		t.Errorf("offered suites %x", hello)
+	}
+
+	// the floor is above the server
+	if err = applyTLSProfile(config, "1.3", NULL); err != nil {
+		t.Fatal(err)
+	}
+	serverConfig = cam.config.Clone()
+	serverConfig.MaxVersion = tls.VersionTLS12
+	c, s = tcpPair(t)
+	defer c.Close()
+	go tls.Server(s, serverConfig).Handshake()
+	if err = tls.Client(c, config).Handshake(); err == nil {
+		t.Errorf("negotiated below the floor")
+	}
+	s.Close()
+}
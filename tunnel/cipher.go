@@ -3,6 +3,7 @@ package tunnel
 import (
 	"bytes"
 	stdcrypto "crypto"
+	"crypto/aes"
 	"crypto/cipher"
 	"crypto/ecdsa"
 	"crypto/rand"
@@ -14,18 +15,27 @@ import (
 	"io"
 	"math/big"
 	"strings"
+	"sync"
 
 	"github.com/Lafeng/deblocus/crypto"
 	"github.com/Lafeng/deblocus/exception"
 )
 
+const (
+	// no encryption, only for the trusted links and must be allowed by both sides
+	CIPHER_NULL = "NULL"
+)
+
 var (
-	UNSUPPORTED_CIPHER = exception.New("Unsupported cipher")
+	UNSUPPORTED_CIPHER    = exception.New("Unsupported cipher")
+	PLAINTEXT_NOT_ALLOWED = exception.New("Plaintext is not allowed")
+	CIPHER_NOT_READY      = exception.New("Cipher is not initialized")
 )
 
-type cipherBuilder func(k, iv []byte) *XORCipherKit
+type cipherBuilder func(k, iv []byte) cipherKit
 
 type cipherDesc struct {
+	suite   byte // id in negotiation
 	keyLen  int
 	ivLen   int
 	builder cipherBuilder
@@ -37,6 +47,14 @@ type cipherKit interface {
 	Cleanup()
 }
 
+// the authenticated cipher seals the stream into records instead of
+// encrypting in place
+type recordCipherKit interface {
+	cipherKit
+	seal(b []byte) []byte
+	open(r io.Reader, b []byte) (int, error)
+}
+
 type XORCipherKit struct {
 	enc cipher.Stream
 	dec cipher.Stream
@@ -67,22 +85,82 @@ func (c *NullCipherKit) Cleanup()                {}
 
 var nullCipherKit = new(NullCipherKit)
 
-// Uppercase Name
+// Uppercase Name, the strongest first in negotiation
 var availableCiphers = []interface{}{
-	"CHACHA12", &cipherDesc{32, 8, new_ChaCha12},
-	"CHACHA20", &cipherDesc{32, 8, new_ChaCha20},
-	"AES128OFB", &cipherDesc{16, 16, new_AES_OFB},
-	"AES256OFB", &cipherDesc{32, 16, new_AES_OFB},
-	"AES128CTR", &cipherDesc{16, 16, new_AES_CTR},
-	"AES192CTR", &cipherDesc{24, 16, new_AES_CTR},
-	"AES256CTR", &cipherDesc{32, 16, new_AES_CTR},
+	"AES256GCM", &cipherDesc{10, 32, 8, new_AES_GCM},
+	"CHACHA20-POLY1305", &cipherDesc{8, 32, 8, new_ChaCha20Poly1305},
+	"AES128GCM", &cipherDesc{9, 16, 8, new_AES_GCM},
+	"AES256CTR", &cipherDesc{7, 32, 16, new_AES_CTR},
+	"CHACHA20", &cipherDesc{2, 32, 8, new_ChaCha20},
+	"AES192CTR", &cipherDesc{6, 24, 16, new_AES_CTR},
+	"AES128CTR", &cipherDesc{5, 16, 16, new_AES_CTR},
+	"AES256OFB", &cipherDesc{4, 32, 16, new_AES_OFB},
+	"AES128OFB", &cipherDesc{3, 16, 16, new_AES_OFB},
+	"CHACHA12", &cipherDesc{1, 32, 8, new_ChaCha12},
+}
+
+// the registry is replaced on registering, the readers take a snapshot
+var ciphersLock sync.RWMutex
+
+func registeredCiphers() []interface{} {
+	ciphersLock.RLock()
+	defer ciphersLock.RUnlock()
+	return availableCiphers
+}
+
+// the custom cipher built by either Stream or AEAD
+type CipherSuite struct {
+	Suite  byte // unique id in negotiation, 128-255 are reserved for custom
+	KeyLen int  // at most 32 bytes as IVLen
+	IVLen  int
+	// the streams of encrypting and decrypting
+	Stream func(key, iv []byte) (enc, dec cipher.Stream, err error)
+	// sealing the records with the subkey of KeyLen
+	AEAD func(key []byte) (cipher.AEAD, error)
+}
+
+// register the custom cipher before loading configs, it's preferred to the
+// builtin ones in negotiation if both sides accept it.
+func RegisterCipher(name string, factory *CipherSuite) error {
+	name = strings.ToUpper(strings.TrimSpace(name))
+	if name == NULL || name == CIPHER_NULL || strings.ContainsAny(name, ",/ ") {
+		return UNSUPPORTED_CIPHER.Apply("invalid name " + name)
+	}
+	if factory == nil || factory.Suite == nullCipherDesc.suite || isSignalSuite(factory.Suite) ||
+		factory.KeyLen <= 0 || factory.KeyLen > sha256.Size || factory.IVLen <= 0 || factory.IVLen > sha256.Size ||
+		(factory.Stream == nil) == (factory.AEAD == nil) {
+		return UNSUPPORTED_CIPHER.Apply("invalid factory of " + name)
+	}
+	var desc = &cipherDesc{suite: factory.Suite, keyLen: factory.KeyLen, ivLen: factory.IVLen}
+	if factory.AEAD != nil {
+		desc.builder = func(key, iv []byte) cipherKit {
+			return newAEADCipherKit(key, iv, factory.AEAD)
+		}
+	} else {
+		desc.builder = func(key, iv []byte) cipherKit {
+			enc, dec, err := factory.Stream(key, iv)
+			ThrowErr(err)
+			return &XORCipherKit{enc, dec}
+		}
+	}
+
+	ciphersLock.Lock()
+	defer ciphersLock.Unlock()
+	for i := 0; i < len(availableCiphers); i += 2 {
+		if availableCiphers[i].(string) == name || availableCiphers[i+1].(*cipherDesc).suite == desc.suite {
+			return UNSUPPORTED_CIPHER.Apply("duplicate " + name)
+		}
+	}
+	availableCiphers = append([]interface{}{name, desc}, availableCiphers...)
+	return nil
 }
 
 func GetAvailableCipher(wants string) (*cipherDesc, error) {
 	wants = strings.ToUpper(wants)
-	for i := 0; i < len(availableCiphers); i += 2 {
-		name := availableCiphers[i].(string)
-		decr := availableCiphers[i+1].(*cipherDesc)
+	var ciphers = registeredCiphers()
+	for i := 0; i < len(ciphers); i += 2 {
+		name := ciphers[i].(string)
+		decr := ciphers[i+1].(*cipherDesc)
 		if name == wants {
 			return decr, nil
 		}
@@ -90,21 +168,120 @@ func GetAvailableCipher(wants string) (*cipherDesc, error) {
 	return nil, UNSUPPORTED_CIPHER.Apply(wants)
 }
 
-func new_AES_CTR(key, iv []byte) *XORCipherKit {
+var nullCipherDesc = &cipherDesc{}
+
+// the NULL cipher is available only if plaintext was allowed explicitly
+func GetCipher(wants string, allowPlaintext bool) (*cipherDesc, error) {
+	if strings.ToUpper(wants) == CIPHER_NULL {
+		if allowPlaintext {
+			return nullCipherDesc, nil
+		}
+		return nil, PLAINTEXT_NOT_ALLOWED.Apply("Cipher " + CIPHER_NULL)
+	}
+	return GetAvailableCipher(wants)
+}
+
+// the suites offered by client are of the configured list only, so the
+// others, eg. the weaker or NULL, must be opted in by listing them.
+func offerCipherSuites(list string, allowPlaintext bool) []byte {
+	var offer []byte
+	// the list was validated by the config
+	names, _ := parseCipherSuites(list, allowPlaintext)
+	for _, name := range names {
+		desc, _ := GetCipher(name, allowPlaintext)
+		if bytes.IndexByte(offer, desc.suite) < 0 {
+			offer = append(offer, desc.suite)
+		}
+	}
+	return offer
+}
+
+// the peers of the legacy format agree on the first of list without the
+// offer, which was the only one in the credentials of old servers.
+func legacyCipherSuite(list string) string {
+	name, _ := SubstringBefore(list, ",")
+	return strings.ToUpper(strings.TrimSpace(name))
+}
+
+// the list of cipher names, eg. AES256GCM,AES128CTR
+func parseCipherSuites(list string, allowPlaintext bool) ([]string, error) {
+	var names []string
+	for _, name := range strings.Split(list, ",") {
+		name = strings.ToUpper(strings.TrimSpace(name))
+		if _, err := GetCipher(name, allowPlaintext); err != nil {
+			return nil, err
+		}
+		names = append(names, name)
+	}
+	return names, nil
+}
+
+// the strongest of the offer in the accepted list of server
+func selectCipherSuite(offer []byte, accepted string, allowPlaintext bool) (string, error) {
+	list, err := parseCipherSuites(accepted, allowPlaintext)
+	if err != nil {
+		return NULL, err
+	}
+	var names = make(map[string]bool)
+	for _, name := range list {
+		names[name] = true
+	}
+	var ciphers = registeredCiphers()
+	for i := 0; i < len(ciphers); i += 2 {
+		name := ciphers[i].(string)
+		if names[name] && bytes.IndexByte(offer, ciphers[i+1].(*cipherDesc).suite) >= 0 {
+			return name, nil
+		}
+	}
+	if names[CIPHER_NULL] && bytes.IndexByte(offer, nullCipherDesc.suite) >= 0 {
+		return CIPHER_NULL, nil
+	}
+	return NULL, UNSUPPORTED_CIPHER.Apply("no common suite")
+}
+
+// the name of suite selected by server, which must be offered
+func cipherOfSuite(suite byte, offer []byte) (string, error) {
+	if bytes.IndexByte(offer, suite) >= 0 {
+		if suite == nullCipherDesc.suite {
+			return CIPHER_NULL, nil
+		}
+		var ciphers = registeredCiphers()
+		for i := 1; i < len(ciphers); i += 2 {
+			if ciphers[i].(*cipherDesc).suite == suite {
+				return ciphers[i-1].(string), nil
+			}
+		}
+	}
+	return NULL, UNSUPPORTED_CIPHER.Apply(suite)
+}
+
+func new_AES_CTR(key, iv []byte) cipherKit {
 	block, _ := crypto.NewAESCipher(key, crypto.MODE_CTR)
 	ec, _ := crypto.NewAESEncrypter(block, iv)
 	dc, _ := crypto.NewAESDecrypter(block, iv)
 	return &XORCipherKit{ec, dc}
 }
 
-func new_AES_OFB(key, iv []byte) *XORCipherKit {
+func new_AES_OFB(key, iv []byte) cipherKit {
 	block, _ := crypto.NewAESCipher(key, crypto.MODE_OFB)
 	ec, _ := crypto.NewAESEncrypter(block, iv)
 	dc, _ := crypto.NewAESDecrypter(block, iv)
 	return &XORCipherKit{ec, dc}
 }
 
-func new_ChaCha20(key, iv []byte) *XORCipherKit {
+func new_AES_GCM(key, iv []byte) cipherKit {
+	return newAEADCipherKit(key, iv, newGCM)
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func new_ChaCha20(key, iv []byte) cipherKit {
 	ec, e := crypto.NewChaCha(key, iv, crypto.CHACHA20_ROUND)
 	ThrowErr(e)
 	dc, e := crypto.NewChaCha(key, iv, crypto.CHACHA20_ROUND)
@@ -112,7 +289,7 @@ func new_ChaCha20(key, iv []byte) *XORCipherKit {
 	return &XORCipherKit{ec, dc}
 }
 
-func new_ChaCha12(key, iv []byte) *XORCipherKit {
+func new_ChaCha12(key, iv []byte) cipherKit {
 	ec, e := crypto.NewChaCha(key, iv, crypto.CHACHA12_ROUND)
 	ThrowErr(e)
 	dc, e := crypto.NewChaCha(key, iv, crypto.CHACHA12_ROUND)
@@ -123,12 +300,16 @@ func new_ChaCha12(key, iv []byte) *XORCipherKit {
 type CipherFactory struct {
 	key  []byte
 	decr *cipherDesc
+	name string
 }
 
-func (c *CipherFactory) InitCipher(iv []byte) *XORCipherKit {
+func (c *CipherFactory) InitCipher(iv []byte) cipherKit {
 	if iv == nil {
 		panic("iv nil") // TODO test
 	}
+	if c.decr == nullCipherDesc {
+		return nullCipherKit
+	}
 	if len(iv) < c.decr.ivLen {
 		iv = normalizeKey(c.decr.ivLen, iv)
 	} else {
@@ -141,10 +322,11 @@ func (f *CipherFactory) Cleanup() {
 	crypto.Memset(f.key, 0)
 }
 
+// the name must be validated, and NULL was allowed
 func NewCipherFactory(name string, secrets ...[]byte) *CipherFactory {
-	desc, _ := GetAvailableCipher(name)
+	desc, _ := GetCipher(name, true)
 	key := normalizeKey(desc.keyLen, secrets...)
-	return &CipherFactory{key, desc}
+	return &CipherFactory{key, desc, strings.ToUpper(name)}
 }
 
 func normalizeKey(size int, msg ...[]byte) []byte {
@@ -162,6 +344,8 @@ func NameOfKey(v interface{}) string {
 		return fmt.Sprintf("ECC-P%d", k.Params().BitSize)
 	case *rsa.PublicKey:
 		return fmt.Sprintf("RSA-%d", k.N.BitLen())
+	case crypto.Ed25519PublicKey:
+		return "ED25519"
 	}
 	return NULL
 }
@@ -176,6 +360,9 @@ func FingerprintOfKey(v interface{}) string {
 	case *rsa.PublicKey:
 		buf.Write(k.N.Bytes())
 		buf.WriteRune(rune(k.E))
+	case crypto.Ed25519PublicKey:
+		buf.WriteString("Ed25519")
+		buf.Write(k)
 	}
 	hs := hash128(buf.Bytes())
 	return strings.Replace(fmt.Sprintf("% x", hs), " ", ":", -1)
@@ -202,21 +389,35 @@ func GenerateDSAKey(name string) (stdcrypto.PrivateKey, error) {
 			return nil, UNSUPPORTED_CIPHER.Apply(name)
 		}
 		return ecdsa.GenerateKey(curve, rand.Reader)
+	case "ED25519":
+		return crypto.GenerateEd25519Key()
 	}
 	return nil, UNSUPPORTED_CIPHER.Apply(name)
 }
 
+// the Ed25519 keys in the DER of rfc8410 which is not supported by x509 of
+// the old go, the encodings of a key are the fixed prefix and the raw bytes.
+var (
+	ed25519PKCS8Prefix = []byte{0x30, 0x2e, 0x02, 0x01, 0x00, 0x30, 0x05, 0x06, 0x03, 0x2b, 0x65, 0x70, 0x04, 0x22, 0x04, 0x20}
+	ed25519PKIXPrefix  = []byte{0x30, 0x2a, 0x30, 0x05, 0x06, 0x03, 0x2b, 0x65, 0x70, 0x03, 0x21, 0x00}
+)
+
 func MarshalPrivateKey(priv stdcrypto.PrivateKey) (b []byte) {
 	switch k := priv.(type) {
 	case *rsa.PrivateKey:
 		b = x509.MarshalPKCS1PrivateKey(k)
 	case *ecdsa.PrivateKey:
 		b, _ = x509.MarshalECPrivateKey(k)
+	case crypto.Ed25519PrivateKey:
+		b = append(append([]byte(nil), ed25519PKCS8Prefix...), k.Seed()...)
 	}
 	return
 }
 
 func UnmarshalPrivateKey(b []byte) (stdcrypto.PrivateKey, error) {
+	if len(b) == len(ed25519PKCS8Prefix)+crypto.ED25519_SEED_SIZE && bytes.HasPrefix(b, ed25519PKCS8Prefix) {
+		return crypto.NewEd25519Key(b[len(ed25519PKCS8Prefix):]), nil
+	}
 	if k, err := x509.ParseECPrivateKey(b); err == nil {
 		return k, nil
 	}
@@ -232,15 +433,23 @@ func preSharedKey(v interface{}) []byte {
 		return k.N.Bytes()
 	case *ecdsa.PublicKey:
 		return k.X.Bytes()
+	case crypto.Ed25519PublicKey:
+		return k
 	}
 	panic(UNSUPPORTED_CIPHER)
 }
 
 func MarshalPublicKey(v interface{}) ([]byte, error) {
+	if k, y := v.(crypto.Ed25519PublicKey); y {
+		return append(append([]byte(nil), ed25519PKIXPrefix...), k...), nil
+	}
 	return x509.MarshalPKIXPublicKey(v)
 }
 
 func UnmarshalPublicKey(b []byte) (stdcrypto.PublicKey, error) {
+	if len(b) == len(ed25519PKIXPrefix)+crypto.ED25519_PUBLIC_SIZE && bytes.HasPrefix(b, ed25519PKIXPrefix) {
+		return crypto.Ed25519PublicKey(b[len(ed25519PKIXPrefix):]), nil
+	}
 	pub, err := x509.ParsePKIXPublicKey(b)
 	if pub == nil { //maybe pub==err==nil
 		return nil, nvl(err, UNRECOGNIZED_SYMBOLS).(error)
@@ -264,6 +473,8 @@ func DSAVerify(pub stdcrypto.PublicKey, sig, msg []byte) bool {
 			return false
 		}
 		return ecdsa.Verify(k, msg, es.R, es.S)
+	case crypto.Ed25519PublicKey:
+		return crypto.Ed25519Verify(k, msg, sig)
 	}
 	panic(UNSUPPORTED_CIPHER)
 }
@@ -0,0 +1,184 @@
+package tunnel
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdsa"
+	"io"
+	"testing"
+)
+
+func TestNullCipherOptIn(t *testing.T) {
+	for _, name := range []string{"NULL", "null"} {
+		if _, err := GetCipher(name, false); err == nil {
+			t.Errorf("%s was accepted without opt-in", name)
+		}
+		if _, err := GetCipher(name, true); err != nil {
+			t.Errorf("%s was rejected with opt-in: %v", name, err)
+		}
+	}
+	if _, err := GetCipher("AES128CTR", false); err != nil {
+		t.Errorf("regular cipher was rejected: %v", err)
+	}
+
+	priv, err := GenerateDSAKey("ECC-P256")
+	if err != nil {
+		t.Fatal(err)
+	}
+	pub := &priv.(*ecdsa.PrivateKey).PublicKey
+	conf := &clientConf{
+		Listen:   ":9009",
+		connInfo: &connectionInfo{cipher: "NULL", pkType: NameOfKey(pub), sPubKey: pub},
+	}
+	if err = conf.validate(); err == nil {
+		t.Errorf("client accepted NULL cipher without AllowPlaintext")
+	}
+	conf.AllowPlaintext = "true"
+	if err = conf.validate(); err != nil {
+		t.Errorf("client rejected NULL cipher with AllowPlaintext: %v", err)
+	}
+}
+
+func TestNullCipherKit(t *testing.T) {
+	var (
+		iv    = []byte("0123456789abcdef")
+		plain = []byte("plaintext passthrough")
+		buf   = make([]byte, len(plain))
+	)
+	kit := NewCipherFactory("NULL", []byte("secret")).InitCipher(iv)
+	if kit != nullCipherKit {
+		t.Fatalf("unexpected kit %T", kit)
+	}
+	copy(buf, plain)
+	kit.encrypt(buf, buf)
+	if !bytes.Equal(buf, plain) {
+		t.Errorf("data was changed %q", buf)
+	}
+	// no negotiation, the peer of a regular cipher can't read it
+	aes := NewCipherFactory("AES128CTR", []byte("secret")).InitCipher(iv)
+	aes.decrypt(buf, buf)
+	if bytes.Equal(buf, plain) {
+		t.Errorf("mismatched ciphers interoperated")
+	}
+}
+
+// the suites of builtin ciphers, the strongest first
+const allSuites = "AES256GCM,CHACHA20-POLY1305,AES128GCM,AES256CTR,CHACHA20,AES192CTR,AES128CTR,AES256OFB,AES128OFB,CHACHA12"
+
+func TestCipherSuiteOffer(t *testing.T) {
+	if offer := offerCipherSuites("AES256GCM", false); !bytes.Equal(offer, []byte{10}) {
+		t.Errorf("offered %v beyond the configured", offer)
+	}
+	// the weaker and NULL by opt-in only
+	if offer := offerCipherSuites("aes128gcm, CHACHA12,aes128gcm", false); !bytes.Equal(offer, []byte{9, 1}) {
+		t.Errorf("unexpected offer %v", offer)
+	}
+	if offer := offerCipherSuites("AES128CTR", true); bytes.IndexByte(offer, nullCipherDesc.suite) >= 0 {
+		t.Errorf("offered NULL without listing it")
+	}
+	if offer := offerCipherSuites("NULL", false); len(offer) != 0 {
+		t.Errorf("offered NULL without allowing plaintext")
+	}
+}
+
+func TestCipherSuiteNegotiation(t *testing.T) {
+	var offer = offerCipherSuites(allSuites, false)
+	for _, c := range []struct {
+		accepted, selected string
+	}{
+		{"AES128CTR", "AES128CTR"},
+		{"aes128ctr, AES256GCM ,CHACHA20-POLY1305", "AES256GCM"},
+		{"CHACHA12,CHACHA20-POLY1305,AES128GCM", "CHACHA20-POLY1305"},
+	} {
+		name, err := selectCipherSuite(offer, c.accepted, false)
+		if err != nil || name != c.selected {
+			t.Errorf("%s: selected %s %v", c.accepted, name, err)
+		}
+		desc, _ := GetCipher(name, false)
+		if s, err := cipherOfSuite(desc.suite, offer); s != name {
+			t.Errorf("%s: suite of %s %v", c.accepted, s, err)
+		}
+	}
+	// NULL only if both allowed it
+	if _, err := selectCipherSuite(offer, "NULL", true); err == nil {
+		t.Errorf("selected NULL which was not offered")
+	}
+	if name, _ := selectCipherSuite(offerCipherSuites("NULL,AES128CTR", true), "NULL,AES128CTR", true); name != "AES128CTR" {
+		t.Errorf("selected %s instead of the stronger", name)
+	}
+	if _, err := selectCipherSuite(offer, "AES128CTR,RC4", false); err == nil {
+		t.Errorf("accepted the unknown cipher")
+	}
+	if _, err := selectCipherSuite(offer[:1], "AES128CTR", false); err == nil {
+		t.Errorf("selected the suite not in common")
+	}
+	// the suite not offered by client
+	if _, err := cipherOfSuite(offer[0], offer[1:]); err == nil {
+		t.Errorf("accepted the suite not offered")
+	}
+}
+
+func TestRegisterCipher(t *testing.T) {
+	var saved = registeredCiphers()
+	defer func() {
+		ciphersLock.Lock()
+		availableCiphers = saved
+		ciphersLock.Unlock()
+	}()
+	var cfb = &CipherSuite{Suite: 200, KeyLen: 16, IVLen: 16,
+		Stream: func(key, iv []byte) (cipher.Stream, cipher.Stream, error) {
+			block, err := aes.NewCipher(key)
+			if err != nil {
+				return nil, nil, err
+			}
+			return cipher.NewCFBEncrypter(block, iv), cipher.NewCFBDecrypter(block, iv), nil
+		},
+	}
+	if err := RegisterCipher("test-cfb", cfb); err != nil {
+		t.Fatal(err)
+	}
+	if err := RegisterCipher("test-gcm", &CipherSuite{Suite: 201, KeyLen: 16, IVLen: 8, AEAD: newGCM}); err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range []struct {
+		name  string
+		suite *CipherSuite
+	}{
+		{"TEST-CFB", &CipherSuite{Suite: 202, KeyLen: 16, IVLen: 16, AEAD: newGCM}}, // duplicate name
+		{"other", &CipherSuite{Suite: 200, KeyLen: 16, IVLen: 16, AEAD: newGCM}},    // duplicate suite
+		{"NULL", &CipherSuite{Suite: 203, KeyLen: 16, IVLen: 16, AEAD: newGCM}},
+		{"a,b", &CipherSuite{Suite: 203, KeyLen: 16, IVLen: 16, AEAD: newGCM}},
+		{"other", &CipherSuite{Suite: 203, KeyLen: 64, IVLen: 16, AEAD: newGCM}},
+		{"other", &CipherSuite{Suite: 203, KeyLen: 16, IVLen: 16}},
+	} {
+		if err := RegisterCipher(c.name, c.suite); err == nil {
+			t.Errorf("registered %s %+v", c.name, c.suite)
+		}
+	}
+
+	// preferred in negotiation
+	var offer = offerCipherSuites(allSuites+",TEST-CFB,TEST-GCM", false)
+	if name, err := selectCipherSuite(offer, "AES256GCM,TEST-CFB", false); name != "TEST-CFB" {
+		t.Errorf("selected %s %v", name, err)
+	}
+	if name, _ := cipherOfSuite(201, offer); name != "TEST-GCM" {
+		t.Errorf("suite of %s", name)
+	}
+	for _, name := range []string{"TEST-CFB", "TEST-GCM"} {
+		var (
+			cf    = NewCipherFactory(name, []byte("secret"))
+			iv    = []byte("0123456789abcdef")
+			plain = randArray(1000)
+		)
+		c, s := tcpPair(t)
+		client, server := NewConn(c, cf.InitCipher(iv)), NewConn(s, cf.InitCipher(iv))
+		go client.Write(append([]byte(nil), plain...))
+		buf := make([]byte, len(plain))
+		if _, err := io.ReadFull(server, buf); err != nil || !bytes.Equal(buf, plain) {
+			t.Errorf("%s: read %v", name, err)
+		}
+		c.Close()
+		s.Close()
+	}
+}
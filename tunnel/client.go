@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"io"
 	"net"
+	"strings"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -16,6 +17,12 @@ const (
 	DT_PING_INTERVAL = 110
 	RETRY_INTERVAL   = time.Second * 5
 	REST_INTERVAL    = RETRY_INTERVAL
+	// bounds of ping interval in seconds
+	PING_INTERVAL_MIN = 60
+	PING_INTERVAL_MAX = 600
+	PING_BACKOFF_MAX  = 3600
+	// the old session is destroyed after migration at most
+	MIGRATE_DRAIN_TIMEOUT = time.Minute * 5
 )
 
 const (
@@ -32,14 +39,18 @@ var (
 type Client struct {
 	mux       *multiplexer
 	token     []byte
+	tokenAt   []time.Time // received time of each token
 	params    *tunParams
 	connInfo  *connectionInfo
+	cor       string // correlation id of current session
 	lock      sync.Locker
 	dtCnt     int32
 	reqCnt    int32
 	state     int32
 	round     int32
+	migrating int32
 	pendingTK *timedWait
+	health    *tunHealth // replaces the degraded tunnels
 }
 
 func NewClient(cman *ConfigMan) *Client {
@@ -48,24 +59,32 @@ func NewClient(cman *ConfigMan) *Client {
 		connInfo:  cman.cConf.connInfo,
 		state:     CLT_WORKING,
 		pendingTK: NewTimedWait(false), // waiting tokens
+		health:    newTunHealth(),
+	}
+	clt.health.start(clt)
+	if strings.ToUpper(clt.connInfo.cipher) == CIPHER_NULL {
+		log.Warningln("*** Encryption is OFF, the tunnels are in PLAINTEXT ***")
 	}
 	return clt
 }
 
-func (c *Client) initialConnect() (tun *Conn) {
+func (c *Client) initialConnect() (tun *Conn, err error) {
 	var theParam = new(tunParams)
-	var man = &d5cman{connectionInfo: c.connInfo}
-	var err error
+	var man = &d5cman{connectionInfo: c.connInfo, correlation: newCorrelationId()}
+	var tag = correlationTag(man.correlation)
 	tun, err = man.Connect(theParam)
 	if err != nil {
-		log.Errorf("Failed to connect to %s %s Retry after %s",
-			c.connInfo.RemoteName(), ex.Detail(err), RETRY_INTERVAL)
-		return nil
+		log.Errorf("Failed to connect to %s %s Retry after %s%s",
+			c.connInfo.RemoteName(), ex.Detail(err), RETRY_INTERVAL, tag)
+		return nil, err
 	} else {
-		log.Infof("Login to server %s with %s successfully",
-			c.connInfo.RemoteName(), c.connInfo.user)
+		log.Infof("Login to server %s with %s successfully%s",
+			c.connInfo.RemoteName(), c.connInfo.user, tag)
+		c.cor = man.correlation
 		c.params = theParam
-		c.token = theParam.token
+		c.lock.Lock()
+		c.setTokens(theParam.token)
+		c.lock.Unlock()
 		return
 	}
 }
@@ -79,16 +98,30 @@ func (c *Client) restart() (tun *Conn, rn int32) {
 		for atomic.LoadInt32(&c.dtCnt) > 0 {
 			time.Sleep(time.Second)
 		}
-		c.mux.destroy()
+		// keep the mux with orphaned streams if re-attached
+		if tun = c.roam(); tun == nil {
+			c.mux.destroy()
+		}
+	}
+	if tun == nil {
+		c.mux = c.newConfiguredMux(c.connInfo, nil)
+		// the server may have restored the session after restart
+		if tun = c.resumeSession(); tun == nil {
+			tun = c.resumeTicket()
+		}
 	}
-	c.mux = newClientMultiplexer()
 	// try negotiating connection infinitely until success
-	for i := 0; tun == nil; i++ {
-		if i > 0 {
-			time.Sleep(RETRY_INTERVAL)
+	for retry := time.Duration(0); tun == nil; {
+		time.Sleep(retry)
+		var err error
+		tun, err = c.initialConnect()
+		retry = RETRY_INTERVAL
+		if e, y := err.(*ex.Exception); y && e.Origin == ERR_SERVER_BUSY {
+			// spread out the reconnections in storm
+			retry += time.Duration(myRand.Int63n(int64(BUSY_RETRY_JITTER)))
 		}
-		tun = c.initialConnect()
 	}
+	c.applyNegotiated(c.mux, c.connInfo, c.params)
 	atomic.StoreInt32(&c.state, CLT_WORKING)
 	rn = atomic.AddInt32(&c.round, 1)
 	// start n-1 data tun
@@ -98,9 +131,99 @@ func (c *Client) restart() (tun *Conn, rn int32) {
 	return
 }
 
+// resume the last session with a remained token without negotiation,
+// the token will be cleared as dirty if the server rejected it.
+func (c *Client) resumeSession() *Conn {
+	if c.params == nil {
+		return nil
+	}
+	c.lock.Lock()
+	var token = c.shiftToken()
+	c.lock.Unlock()
+	if token == nil {
+		return nil
+	}
+
+	man := &d5cman{connectionInfo: c.connInfo}
+	tun, err := man.ResumeSession(c.params, token)
+	if err != nil {
+		if log.V(log.LV_CLT_CONNECT) {
+			log.Warningf("Failed to resume the session %s, renegotiate", ex.Detail(err))
+		}
+		c.clearTokens()
+		return nil
+	}
+	log.Infof("Resuming the session with %s%s", c.connInfo.RemoteName(), correlationTag(c.cor))
+	return tun
+}
+
+// revive the session destroyed by server with the ticket in a single round
+// trip. the ticket is single-use, and replaced by the one issued again.
+func (c *Client) resumeTicket() *Conn {
+	var p = c.params
+	if p == nil || len(p.ticket) == 0 {
+		return nil
+	}
+	var (
+		params = &tunParams{cipherFactory: p.cipherFactory, protocol: p.protocol}
+		man    = &d5cman{connectionInfo: c.connInfo, correlation: c.cor}
+	)
+	tun, err := man.ResumeTicket(params, p.ticket)
+	p.ticket = nil
+	if err != nil {
+		if log.V(log.LV_CLT_CONNECT) {
+			log.Warningf("Failed to resume the session by ticket %s, renegotiate", ex.Detail(err))
+		}
+		return nil
+	}
+	c.params = params
+	c.lock.Lock()
+	c.setTokens(params.token)
+	c.lock.Unlock()
+	log.Infof("Resumed the session by ticket with %s%s", c.connInfo.RemoteName(), correlationTag(c.cor))
+	return tun
+}
+
+// re-attach the session with a token after all tunnels were lost, eg. the
+// address was changed, then the orphaned streams of mux will be rebound to
+// the resumed tun. retry until the orphans were expired.
+func (c *Client) roam() *Conn {
+	var since = c.mux.router.orphanedSince()
+	if c.mux.roam <= 0 || since == 0 || c.params == nil {
+		return nil
+	}
+	var deadline = time.Unix(0, since).Add(c.mux.roam)
+	for time.Now().Before(deadline) {
+		c.lock.Lock()
+		// the token is kept for retrying if failed to connect
+		var token = c.peekToken()
+		c.lock.Unlock()
+		if token == nil {
+			return nil
+		}
+
+		man := &d5cman{connectionInfo: c.connInfo}
+		tun, err := man.ResumeSession(c.params, token)
+		if err == nil {
+			c.lock.Lock()
+			c.shiftToken()
+			c.lock.Unlock()
+			log.Infof("Re-attached the session with %s%s", c.connInfo.RemoteName(), correlationTag(c.cor))
+			return tun
+		}
+		log.Warningf("Failed to re-attach the session %s Retry after %s", ex.Detail(err), RETRY_INTERVAL)
+		time.Sleep(RETRY_INTERVAL)
+	}
+	return nil
+}
+
 func (c *Client) StartTun(mustRestart bool) {
+	c.startTun(nil, mustRestart)
+}
+
+// serve the tun of current round, or create one if nil
+func (c *Client) startTun(tun *Conn, mustRestart bool) {
 	var (
-		tun  *Conn
 		wait bool
 		rn   = atomic.LoadInt32(&c.round)
 	)
@@ -135,10 +258,15 @@ func (c *Client) StartTun(mustRestart bool) {
 				log.Infof("Tun %s is established", tun.identifier)
 			}
 
+			mux := c.mux
 			dtcnt = atomic.AddInt32(&c.dtCnt, 1)
-			err = c.mux.Listen(tun, c.eventHandler, c.params.pingInterval+int(dtcnt))
+			err = mux.Listen(tun, c.eventHandler, c.params.pingInterval+int(dtcnt))
 			dtcnt = atomic.AddInt32(&c.dtCnt, -1)
 
+			// the new tun was serving in place
+			if atomic.LoadInt32(&tun.retired) == TUN_REPLACED {
+				return
+			}
 			if log.V(log.LV_CLT_CONNECT) {
 				log.Errorf("Tun %s was disconnected %s Reconnect after %s",
 					tun.identifier, ex.Detail(err), RETRY_INTERVAL)
@@ -147,7 +275,7 @@ func (c *Client) StartTun(mustRestart bool) {
 			tun, wait = nil, true
 
 			// received ping count
-			if atomic.LoadInt32(&c.mux.pingCnt) <= 0 {
+			if atomic.LoadInt32(&mux.pingCnt) <= 0 {
 				// dirty tokens: used abandoned tokens
 				c.clearTokens()
 			}
@@ -191,10 +319,14 @@ func (c *Client) ClientServe(conn net.Conn) {
 
 	switch proto {
 	case PROT_SOCKS5:
-		s5 := socks5Handler{pbConn}
+		s5 := socks5Handler{pbConn, c.connInfo.udpAssociate && c.capable(CAP_UDP_RELAY), c.mux.streamsFull}
 		if s5.handshake() {
-			if literalTarget, ok := s5.readRequest(); ok {
-				c.mux.HandleRequest("SOCKS5", conn, literalTarget)
+			if literalTarget, cmd, ok := s5.readRequest(); ok {
+				if cmd == SOCKS5_CMD_ASSOCIATE {
+					c.udpAssociate(s5, conn)
+				} else {
+					c.mux.HandleRequest("SOCKS5", conn, literalTarget)
+				}
 				done = true
 			}
 		}
@@ -226,6 +358,27 @@ func (c *Client) ClientServe(conn net.Conn) {
 	}
 }
 
+// bind the UDP relay on the address that the app connected to
+func (c *Client) udpAssociate(s5 socks5Handler, conn net.Conn) {
+	var ip net.IP
+	if a, y := conn.LocalAddr().(*net.TCPAddr); y {
+		ip = a.IP
+	}
+	local, err := net.ListenUDP("udp", &net.UDPAddr{IP: ip})
+	if err != nil {
+		log.Warningln("socks: bind UDP", err)
+		s5.replyBound(nil)
+		SafeClose(conn)
+		return
+	}
+	if err = s5.replyBound(local.LocalAddr().(*net.UDPAddr)); err != nil {
+		SafeClose(local)
+		SafeClose(conn)
+		return
+	}
+	c.mux.HandleAssociate(conn, local)
+}
+
 func (t *Client) IsReady() bool {
 	return atomic.LoadInt32(&t.dtCnt) > 0
 }
@@ -243,18 +396,94 @@ func (t *Client) createDataTun() (c *Conn, err error) {
 func (c *Client) eventHandler(e event, msg ...interface{}) {
 	switch e {
 	case evt_tokens:
-		go c.saveTokens(msg[0].([]byte))
+		if data := msg[0].([]byte); len(data) > 0 && data[0] == FRAME_ACTION_MIGRATE {
+			go c.migrate(string(data[1:]))
+		} else {
+			go c.saveTokens(data)
+		}
+	case evt_rotate:
+		go c.replaceTun(msg[0].(*multiplexer), msg[1].(*Conn), "rotated")
+	}
+}
+
+// migrate to the endpoint advertised by server: negotiate a new session
+// there first, then serve the new requests by it and drain the old one.
+// stay on the current server if the negotiation failed.
+func (c *Client) migrate(endpoint string) {
+	c.lock.Lock()
+	var current = c.connInfo
+	c.lock.Unlock()
+	if _, _, err := net.SplitHostPort(endpoint); err != nil || endpoint == current.sAddr {
+		log.Warningf("Ignored the migration to %q", endpoint)
+		return
+	}
+	if atomic.LoadInt32(&c.state) != CLT_WORKING || !atomic.CompareAndSwapInt32(&c.migrating, 0, 1) {
+		return
 	}
+	defer atomic.StoreInt32(&c.migrating, 0)
+	log.Infof("Server %s asked to migrate to %s", current.RemoteName(), endpoint)
+
+	var (
+		info   = *current
+		params = new(tunParams)
+	)
+	info.sAddr, info.wsURL, info.h2URL = endpoint, NULL, NULL
+	man := &d5cman{connectionInfo: &info, correlation: newCorrelationId(), tentative: true}
+	tun, err := man.Connect(params)
+	if err != nil {
+		log.Errorf("Failed to migrate to %s %s Stay on %s",
+			endpoint, ex.Detail(err), current.RemoteName())
+		return
+	}
+	var old, mux = c.mux, c.newConfiguredMux(&info, params)
+	c.lock.Lock()
+	c.connInfo, c.params, c.cor = &info, params, man.correlation
+	c.setTokens(params.token)
+	c.mux = mux
+	c.lock.Unlock()
+	// the tuns of old round will not reconnect
+	atomic.AddInt32(&c.round, 1)
+	log.Infof("Migrated to server %s with %s successfully%s",
+		endpoint, info.user, correlationTag(man.correlation))
+	go c.startTun(tun, false)
+	for j := params.parallels; j > 1; j-- {
+		go c.StartTun(false)
+	}
+	go drainMux(old, MIGRATE_DRAIN_TIMEOUT)
+}
+
+// destroy the mux once the streams were finished or in timeout
+func drainMux(mux *multiplexer, timeout time.Duration) {
+	mux.drain(timeout)
+	mux.destroy()
 }
 
 func (t *Client) Stats() string {
-	return fmt.Sprintf("Client -> %s Conn=%d TK=%d",
-		t.connInfo.sAddr, atomic.LoadInt32(&t.dtCnt), len(t.token)/TKSZ)
+	var stats = fmt.Sprintf("Client -> %s Conn=%d TK=%d",
+		t.connInfo.sAddr, atomic.LoadInt32(&t.dtCnt), len(t.token)/t.tokenSize())
+	if t.cor != NULL {
+		stats += " Cor=" + t.cor
+	}
+	if t.mux != nil {
+		stats += t.mux.pingStats()
+		stats += t.mux.rttStats()
+		stats += t.mux.stallStats()
+	}
+	if h := t.health; h != nil && atomic.LoadInt64(&h.replaced) > 0 {
+		stats += " " + h.String()
+	}
+	if f := t.connInfo.frames; f != nil {
+		stats += " " + f.String()
+	}
+	return stats
 }
 
 func (t *Client) Close() {
+	if t.health != nil {
+		t.health.stop()
+	}
 	if t.mux != nil {
-		t.mux.destroy()
+		drainMux(t.mux, TUN_DRAIN_TIMEOUT)
 	}
 	if t.params != nil {
 		f := t.params.cipherFactory
@@ -264,15 +493,74 @@ func (t *Client) Close() {
 	}
 }
 
+// the servers of V1 are assumed capable by the configuration
+func (c *Client) capable(cap uint32) bool {
+	p := c.params
+	return p == nil || p.protocol < PROTOCOL_V2 || p.caps&cap != 0
+}
+
+// the subsystems not shared with server are disabled
+// the multiplexer of a new session configured by the options of info, and
+// by the negotiated params unless nil, then applyNegotiated after.
+func (c *Client) newConfiguredMux(info *connectionInfo, params *tunParams) *multiplexer {
+	mux := newClientMultiplexer()
+	mux.pingMax = info.pingMax
+	mux.frames = info.frames
+	mux.coalesce = info.coalesce
+	mux.multipath = len(info.bindAddrs) > 1
+	mux.roam = info.roaming
+	mux.rekey = info.rekey
+	mux.prioPorts = info.prioPorts
+	if params != nil {
+		c.applyNegotiated(mux, info, params)
+	}
+	return mux
+}
+
+// the wire profile derived from the key of session and the capabilities
+func (c *Client) applyNegotiated(mux *multiplexer, info *connectionInfo, params *tunParams) {
+	mux.profile = newWireProfile(info.fingerprint, params.cipherFactory.key)
+	c.applyCapabilities(mux, params)
+}
+
+func (c *Client) applyCapabilities(mux *multiplexer, p *tunParams) {
+	if p.protocol < PROTOCOL_V2 {
+		return
+	}
+	if p.caps&CAP_MULTIPATH == 0 {
+		mux.multipath = false
+	}
+	if p.caps&CAP_ROAMING == 0 {
+		mux.roam = 0
+	}
+	// the tunnels are rotated instead
+	if p.caps&CAP_REKEY == 0 {
+		mux.rotate, mux.rekey = mux.rekey, nil
+	}
+	mux.flowCtl = p.caps&CAP_FLOW_CONTROL != 0
+	mux.frameMAC = p.caps&CAP_FRAME_MAC != 0
+	mux.goaway = p.caps&CAP_GOAWAY != 0
+	mux.streamCap = p.maxStreams
+}
+
+// the size negotiated with server
+func (c *Client) tokenSize() int {
+	if p := c.params; p != nil && p.tokenSize > 0 {
+		return p.tokenSize
+	}
+	return TKSZ
+}
+
 func (c *Client) getToken() ([]byte, error) {
 	c.lock.Lock()
 
-	var tlen = len(c.token) / TKSZ
-	if tlen <= TOKENS_FLOOR {
+	c.dropExpiredTokens(time.Now())
+	if len(c.tokenAt) <= c.connInfo.tokenFloor {
 		// TODO may request many times
 		c.asyncRequestTokens()
 	}
-	for len(c.token) < TKSZ {
+	var token = c.shiftToken()
+	for token == nil {
 		// release lock for waiting of pendingTK()
 		c.lock.Unlock()
 		log.Warningln("Waiting for token. Maybe the requests are coming too fast.")
@@ -285,9 +573,8 @@ func (c *Client) getToken() ([]byte, error) {
 		}
 		// recover lock status
 		c.lock.Lock()
+		token = c.shiftToken()
 	}
-	var token = c.token[:TKSZ]
-	c.token = c.token[TKSZ:]
 	// finally release
 	c.lock.Unlock()
 	return token, nil
@@ -299,7 +586,7 @@ func (c *Client) asyncRequestTokens() {
 	if atomic.LoadInt32(&c.state) >= CLT_WORKING {
 		go c.mux.bestSend([]byte{FRAME_ACTION_TOKEN_REQUEST}, "asyncRequestTokens")
 		if log.V(log.LV_TOKEN) {
-			log.Infof("Request new tokens, current pool=%d\n", len(c.token)/TKSZ)
+			log.Infof("Request new tokens, current pool=%d\n", len(c.token)/c.tokenSize())
 		}
 	}
 }
@@ -315,16 +602,101 @@ func (c *Client) saveTokens(data []byte) {
 	}
 	c.lock.Lock()
 	c.token = append(c.token, tokens...)
+	c.tokenAt = append(c.tokenAt, c.stampTokens(len(tokens))...)
 	c.lock.Unlock()
 	// wakeup waiting
 	c.pendingTK.notifyAll()
 	if log.V(log.LV_TOKEN) {
-		log.Infof("Received tokens=%d pool=%d\n", len(tokens)/TKSZ, len(c.token)/TKSZ)
+		log.Infof("Received tokens=%d pool=%d\n", len(tokens)/c.tokenSize(), len(c.token)/c.tokenSize())
 	}
 }
 
 func (c *Client) clearTokens() {
 	c.lock.Lock()
 	defer c.lock.Unlock()
-	c.token = nil
+	c.token, c.tokenAt = nil, nil
+}
+
+// must hold the lock
+func (c *Client) setTokens(tokens []byte) {
+	c.token, c.tokenAt = tokens, c.stampTokens(len(tokens))
+}
+
+// the received time of tokens, and schedule the renewal at the half of ttl
+// if the server told the ttl.
+func (c *Client) stampTokens(n int) []time.Time {
+	var (
+		p     = c.params
+		now   = time.Now()
+		stamp = make([]time.Time, n/c.tokenSize())
+	)
+	for i := range stamp {
+		stamp[i] = now
+	}
+	if p != nil && p.tokenTTL > 0 && len(stamp) > 0 {
+		time.AfterFunc(p.tokenTTL/2, func() { c.renewTokens(p) })
+	}
+	return stamp
+}
+
+// the tokens are used before the ttl with a margin of the latency, and in
+// the order of receiving, so the expired are at the head.
+// must hold the lock
+func (c *Client) dropExpiredTokens(now time.Time) {
+	var p, i = c.params, 0
+	if p == nil || p.tokenTTL <= 0 {
+		return
+	}
+	var life = p.tokenTTL - p.tokenTTL/8
+	for i < len(c.tokenAt) && now.Sub(c.tokenAt[i]) >= life {
+		i++
+	}
+	if i > 0 {
+		c.token, c.tokenAt = c.token[i*c.tokenSize():], c.tokenAt[i:]
+		if log.V(log.LV_TOKEN) {
+			log.Infof("Dropped expired tokens=%d pool=%d\n", i, len(c.tokenAt))
+		}
+	}
+}
+
+// the first unexpired token, or nil
+// must hold the lock
+func (c *Client) peekToken() []byte {
+	c.dropExpiredTokens(time.Now())
+	var size = c.tokenSize()
+	if len(c.token) < size {
+		return nil
+	}
+	return c.token[:size]
+}
+
+// must hold the lock
+func (c *Client) shiftToken() []byte {
+	var token = c.peekToken()
+	if token != nil {
+		c.token, c.tokenAt = c.token[len(token):], c.tokenAt[1:]
+	}
+	return token
+}
+
+// request the fresh tokens proactively if the tokens received in the latest
+// half of ttl are few, so the new tunnels do not wait for them.
+// return true if requested
+func (c *Client) renewTokens(p *tunParams) bool {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.params != p {
+		return false
+	}
+	var fresh, since = 0, time.Now().Add(-p.tokenTTL / 2)
+	for _, at := range c.tokenAt {
+		if at.After(since) {
+			fresh++
+		}
+	}
+	if fresh > c.connInfo.tokenFloor {
+		return false
+	}
+	c.asyncRequestTokens()
+	return true
 }
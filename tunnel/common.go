@@ -130,6 +130,18 @@ func i64HumanSize(size int64) string {
 	return strconv.FormatInt(size, 10) + string(SIZE_UNIT[i])
 }
 
+// reverse of i64HumanSize, eg. 64M
+func parseHumanSize(str string) (int64, error) {
+	var unit int64 = 1
+	if n := len(str); n > 0 {
+		if i := strings.IndexByte(SIZE_UNIT, str[n-1]&^0x20); i >= 0 {
+			unit, str = 1<<uint(i*10), str[:n-1]
+		}
+	}
+	size, err := strconv.ParseInt(str, 10, 64)
+	return size * unit, err
+}
+
 func maxInt(a, b int) int {
 	if a > b {
 		return a
@@ -138,6 +150,14 @@ func maxInt(a, b int) int {
 	}
 }
 
+func minInt(a, b int) int {
+	if a < b {
+		return a
+	} else {
+		return b
+	}
+}
+
 func randomRange(min, max int64) (n int64) {
 	for ; n < min; n %= max {
 		n = myRand.Int63n(max)
@@ -190,9 +210,31 @@ func SafeClose(conn net.Conn) {
 	}
 }
 
+// sec < 0: graceful close in background by OS (default)
+// sec = 0: discard unsent data and reset
+// sec > 0: flush unsent data in sec seconds then reset
+// only for tcp, and the behavior of sec>0 varies by platform.
+func setLinger(conn net.Conn, sec int) {
+	if sec < 0 {
+		return
+	}
+	if o, y := conn.(*outboundConn); y {
+		conn = o.Conn
+	}
+	if t, y := conn.(*net.TCPConn); y {
+		t.SetLinger(sec)
+	}
+}
+
+// implemented by TCPConn and outboundConn
+type halfCloser interface {
+	CloseRead() error
+	CloseWrite() error
+}
+
 func closeR(conn net.Conn) {
 	defer func() { _ = recover() }()
-	if t, y := conn.(*net.TCPConn); y {
+	if t, y := conn.(halfCloser); y {
 		t.CloseRead()
 	} else {
 		conn.Close()
@@ -201,7 +243,7 @@ func closeR(conn net.Conn) {
 
 func closeW(conn net.Conn) {
 	defer func() { _ = recover() }()
-	if t, y := conn.(*net.TCPConn); y {
+	if t, y := conn.(halfCloser); y {
 		t.CloseWrite()
 	} else {
 		conn.Close()
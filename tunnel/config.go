@@ -3,10 +3,13 @@ package tunnel
 import (
 	"bytes"
 	stdcrypto "crypto"
+	"crypto/tls"
 	"encoding/base64"
 	"errors"
 	"fmt"
+	"math"
 	"net"
+	"net/http"
 	"net/url"
 	"os"
 	"os/user"
@@ -16,6 +19,7 @@ import (
 	"runtime"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/Lafeng/deblocus/auth"
 	"github.com/Lafeng/deblocus/crypto"
@@ -33,10 +37,15 @@ const (
 	CF_PRIVKEY    = "PrivateKey"
 	CF_CREDENTIAL = "Credential"
 	CF_PAC        = "PAC.Server"
+	CF_LABELS     = "Labels.Server"
 	CF_FILE       = "File"
 
 	CONFIG_NAME = "deblocus.ini"
 	SIZE_UNIT   = "BKMG"
+
+	// modes of StartupMode and IdentityMode
+	STARTUP_STRICT  = "strict"
+	STARTUP_LENIENT = "lenient"
 )
 
 var (
@@ -44,6 +53,7 @@ var (
 	LOCAL_BIND_ERROR     = exception.New("Local bind error")
 	CONF_MISS            = exception.New("Missed field in config:")
 	CONF_ERROR           = exception.New("Error field in config:")
+	RESOURCE_ERROR       = exception.New("Failed to load resource")
 )
 
 type ServerRole uint32
@@ -160,6 +170,10 @@ func (cman *ConfigMan) ListenAddr(expectedRole ServerRole) *net.TCPAddr {
 	return nil
 }
 
+func (cman *ConfigMan) AdminSocket() string {
+	return cman.sConf.AdminSocket
+}
+
 func (cman *ConfigMan) KeyInfo(expectedRole ServerRole) string {
 	var buf = new(bytes.Buffer)
 	if expectedRole&SR_SERVER != 0 {
@@ -183,6 +197,83 @@ type clientConf struct {
 	Verbose    int          `importable:"1"`
 	ListenAddr *net.TCPAddr `ini:"-"`
 	connInfo   *connectionInfo
+	// optional settings
+	Label string `ini:",omitempty"` // eg. mobile, the treatment is defined by server
+	// accept the NULL cipher of credential, only for trusted links
+	AllowPlaintext string `ini:",omitempty"`
+	// send the correlation id of session to server, requires the server
+	// supports it, otherwise the login will be rejected.
+	Correlate string `ini:",omitempty"`
+	// ping interval backs off up to it on busy tunnel, fixed if empty
+	PingIntervalMax int `ini:",omitempty"`
+	// randomize the wire profile of sessions: off (default), low or high,
+	// that costs throughput, see wireProfile
+	Fingerprint string `ini:",omitempty"`
+	// bounds of frame payload min-max, eg. 255-255 for uniform size, or the
+	// max only, eg. 4096 for interactive use
+	FramePayload string `ini:",omitempty"`
+	// delay of coalescing the small writes of tunnels into one, eg. 2ms,
+	// that costs latency for less syscalls
+	WriteCoalesce string `ini:",omitempty"`
+	// connect the server by ws:// or wss:// url, eg. fronted by CDN
+	WebSocket string `ini:",omitempty"`
+	// wrap the tunnel in TLS with the server name, also used by wss
+	TLS       string `ini:",omitempty"`
+	TLSRootCA string `ini:",omitempty"` // PEM file, eg. of self-signed cert
+	// the profile of ClientHello mimicked: the floor of version, 1.2 or
+	// 1.3, and the suites of 1.2 separated by comma, eg.
+	// TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256. updated as the browsers evolve.
+	TLSVersion      string `ini:",omitempty"`
+	TLSCipherSuites string `ini:",omitempty"`
+	// connect the server by HTTP/2 stream to https:// url, the certificate
+	// is verified by the system pool
+	HTTP2 string `ini:",omitempty"`
+	// relay UDP ASSOCIATE of socks5, requires the server supports it,
+	// otherwise the tunnel will be broken.
+	UDPAssociate string `ini:",omitempty"`
+	// local interfaces of tunnels, eg. 192.168.1.10, 10.0.0.5, the frames
+	// of streams are striped across them if more than one. requires the
+	// server supports it.
+	Multipath string `ini:",omitempty"`
+	// re-attach the session and streams in grace after the address was
+	// changed, eg. 30s, requires the server supports it.
+	Roaming string `ini:",omitempty"`
+	// fallback to the tunnel by DNS queries of the domain delegated to the
+	// server through the resolver host:port, if the server was unreachable.
+	DNSTunnel   string `ini:",omitempty"`
+	DNSResolver string `ini:",omitempty"`
+	// carry the tunnels by reliable UDP to the port of server instead of
+	// TCP, for the lossy and long-distance links. the window of segments is
+	// 128 by default, and a parity is sent per KCPFEC datagrams if set, eg.
+	// 10. requires the server enables it.
+	KCP       string `ini:",omitempty"`
+	KCPWindow string `ini:",omitempty"`
+	KCPFEC    string `ini:",omitempty"`
+	// dial the tunnels with TCP Fast Open on linux, requires the server
+	// enables it.
+	FastOpen string `ini:",omitempty"`
+	// send the knock to the udp port of server before dialing the tunnels,
+	// from the local address of the tunnel, eg. by Multipath. requires the
+	// server enables it.
+	Knock string `ini:",omitempty"`
+	// negotiate in the format of old version for the servers of it: the key
+	// exchanged by ECC-P256 instead of X25519, and the first cipher of the
+	// credential used without the offer of suites.
+	LegacyDH string `ini:",omitempty"`
+	// hybrid key exchange of X25519 and ML-KEM-768, against decrypting the
+	// recorded traffic by quantum computers later. requires the server
+	// supports it.
+	PostQuantum string `ini:",omitempty"`
+	// rotate the keys of tunnels after the traffic or the period of each,
+	// eg. 1G,30m. requires the server supports it.
+	Rekey string `ini:",omitempty"`
+	// request the tokens when the pool is at or below it, 1 to 16, 2 by
+	// default. the higher floor requests earlier, against the new tunnels
+	// waiting for tokens in bursts.
+	TokenFloor int `ini:",omitempty"`
+	// destination ports of the interactive streams written to tunnels before
+	// the others, eg. 22,3389
+	InteractivePorts string `ini:",omitempty"`
 }
 
 func (c *clientConf) validate() error {
@@ -203,10 +294,174 @@ func (c *clientConf) validate() error {
 	if c.connInfo.pacFile != NULL && IsNotExist(c.connInfo.pacFile) {
 		return CONF_ERROR.Apply("File Not Found " + c.connInfo.pacFile)
 	}
+	if c.Label != NULL && !labelPattern.MatchString(c.Label) {
+		return CONF_ERROR.Apply("Label")
+	}
+	var allowPlaintext bool
+	if len(c.AllowPlaintext) > 0 {
+		if allowPlaintext, e = strconv.ParseBool(c.AllowPlaintext); e != nil {
+			return CONF_ERROR.Apply("AllowPlaintext")
+		}
+	}
+	if _, e = parseCipherSuites(c.connInfo.cipher, allowPlaintext); e != nil {
+		return e
+	}
+	c.connInfo.allowPlaintext = allowPlaintext
+	if len(c.Correlate) > 0 {
+		if c.connInfo.correlate, e = strconv.ParseBool(c.Correlate); e != nil {
+			return CONF_ERROR.Apply("Correlate")
+		}
+	}
+	// the initial interval is told by server
+	if e = validatePingBackoff(PING_INTERVAL_MIN, c.PingIntervalMax); e != nil {
+		return e
+	}
+	c.connInfo.pingMax = c.PingIntervalMax
+	if c.TokenFloor == 0 {
+		c.TokenFloor = TOKENS_FLOOR
+	} else if c.TokenFloor < 1 || c.TokenFloor > TOKEN_FLOOR_MAX {
+		return CONF_ERROR.Apply("TokenFloor")
+	}
+	c.connInfo.tokenFloor = c.TokenFloor
+	if c.connInfo.fingerprint, e = parseFingerprint(c.Fingerprint); e != nil {
+		return e
+	}
+	if len(c.FramePayload) > 0 {
+		if c.connInfo.frames, e = parseFrameBounds(c.FramePayload); e != nil {
+			return e
+		}
+	}
+	if len(c.WriteCoalesce) > 0 {
+		if c.connInfo.coalesce, e = parseCoalesceDelay(c.WriteCoalesce); e != nil {
+			return e
+		}
+	}
+	if len(c.WebSocket) > 0 {
+		u, e := url.Parse(c.WebSocket)
+		if e != nil || (u.Scheme != "ws" && u.Scheme != "wss") || u.Host == NULL {
+			return CONF_ERROR.Apply("WebSocket")
+		}
+		c.connInfo.wsURL = c.WebSocket
+	}
+	if len(c.UDPAssociate) > 0 {
+		if c.connInfo.udpAssociate, e = strconv.ParseBool(c.UDPAssociate); e != nil {
+			return CONF_ERROR.Apply("UDPAssociate")
+		}
+	}
+	if len(c.Multipath) > 0 {
+		if c.connInfo.bindAddrs, e = parseBindAddrs(c.Multipath); e != nil {
+			return e
+		}
+	}
+	if len(c.Roaming) > 0 {
+		// the striped streams could not be rebound
+		c.connInfo.roaming, e = time.ParseDuration(c.Roaming)
+		if e != nil || c.connInfo.roaming < 0 || len(c.connInfo.bindAddrs) > 1 {
+			return CONF_ERROR.Apply("Roaming")
+		}
+	}
+	if len(c.DNSTunnel) > 0 {
+		if e = validateDnsDomain(c.DNSTunnel); e != nil {
+			return e
+		}
+		if _, _, e = net.SplitHostPort(c.DNSResolver); e != nil {
+			return CONF_ERROR.Apply("DNSResolver")
+		}
+		c.connInfo.dnsTun = &dnsFallback{domain: strings.ToLower(c.DNSTunnel), resolver: c.DNSResolver}
+	}
+	if len(c.KCP) > 0 {
+		host, _, _ := net.SplitHostPort(c.connInfo.sAddr)
+		port, e := strconv.Atoi(c.KCP)
+		// carries the raw tunnel only
+		if e != nil || port <= 0 || port > 0xffff || len(c.WebSocket) > 0 || len(c.HTTP2) > 0 || len(c.TLS) > 0 {
+			return CONF_ERROR.Apply("KCP")
+		}
+		c.connInfo.kcpAddr = net.JoinHostPort(host, c.KCP)
+		c.connInfo.kcpWindow = KCP_WINDOW
+		if len(c.KCPWindow) > 0 {
+			if c.connInfo.kcpWindow, e = parseKcpWindow(c.KCPWindow, "KCPWindow"); e != nil {
+				return e
+			}
+		}
+		if len(c.KCPFEC) > 0 {
+			c.connInfo.kcpFEC, e = strconv.Atoi(c.KCPFEC)
+			if e != nil || c.connInfo.kcpFEC < 0 || c.connInfo.kcpFEC > KCP_FEC_MAX {
+				return CONF_ERROR.Apply("KCPFEC")
+			}
+		}
+	}
+	if len(c.FastOpen) > 0 {
+		if c.connInfo.fastOpen, e = strconv.ParseBool(c.FastOpen); e != nil {
+			return CONF_ERROR.Apply("FastOpen")
+		}
+	}
+	if len(c.Knock) > 0 {
+		host, _, _ := net.SplitHostPort(c.connInfo.sAddr)
+		if port, e := strconv.Atoi(c.Knock); e != nil || port <= 0 || port > 0xffff {
+			return CONF_ERROR.Apply("Knock")
+		}
+		c.connInfo.knockAddr = net.JoinHostPort(host, c.Knock)
+		c.connInfo.knockKey = newKnockKey(preSharedKey(c.connInfo.sPubKey))
+	}
+	if len(c.LegacyDH) > 0 {
+		if c.connInfo.legacyDH, e = strconv.ParseBool(c.LegacyDH); e != nil {
+			return CONF_ERROR.Apply("LegacyDH")
+		}
+	}
+	if len(c.PostQuantum) > 0 {
+		c.connInfo.postQuantum, e = strconv.ParseBool(c.PostQuantum)
+		if e != nil || c.connInfo.postQuantum && c.connInfo.legacyDH {
+			return CONF_ERROR.Apply("PostQuantum")
+		}
+	}
+	if len(c.Rekey) > 0 {
+		if c.connInfo.rekey, e = parseRekeyPolicy(c.Rekey); e != nil {
+			return e
+		}
+	}
+	if len(c.InteractivePorts) > 0 {
+		if c.connInfo.prioPorts, e = parsePriorityPorts(c.InteractivePorts); e != nil {
+			return e
+		}
+	}
+	if len(c.HTTP2) > 0 {
+		if e = validateHTTP2URL(c.HTTP2); e != nil {
+			return e
+		}
+		// negotiate h2 by default without custom TLS config
+		c.connInfo.h2URL, c.connInfo.h2Transport = c.HTTP2, new(http.Transport)
+	}
+	if len(c.TLS) > 0 || len(c.TLSRootCA) > 0 {
+		if c.connInfo.tlsConfig, e = newClientTLSConfig(c.TLS, c.TLSRootCA); e != nil {
+			return e
+		}
+		if e = applyTLSProfile(c.connInfo.tlsConfig, c.TLSVersion, c.TLSCipherSuites); e != nil {
+			return e
+		}
+	} else if len(c.TLSVersion) > 0 || len(c.TLSCipherSuites) > 0 {
+		return CONF_ERROR.Apply("TLSVersion without TLS")
+	}
 	c.ListenAddr = a
 	return nil
 }
 
+// eg. 2ms, up to COALESCE_DELAY_MAX
+func parseCoalesceDelay(str string) (time.Duration, error) {
+	d, e := time.ParseDuration(str)
+	if e != nil || d <= 0 || d > COALESCE_DELAY_MAX {
+		return 0, CONF_ERROR.Apply("WriteCoalesce")
+	}
+	return d, nil
+}
+
+// zero to disable backoff, or greater than the initial interval
+func validatePingBackoff(interval, max int) error {
+	if max != 0 && (max <= interval || max > PING_BACKOFF_MAX) {
+		return CONF_ERROR.Apply("PingIntervalMax")
+	}
+	return nil
+}
+
 type connectionInfo struct {
 	sAddr    string
 	provider string
@@ -215,8 +470,85 @@ type connectionInfo struct {
 	pass     string
 	pkType   string
 	pacFile  string
+	label    string
 	sPubKey  stdcrypto.PublicKey
 	rawURL   string
+
+	correlate   bool // send correlation id in identity
+	pingMax     int  // seconds, backoff ceiling of ping interval
+	fingerprint int  // degree of randomizing wire profile
+	frames      *frameBounds
+	wsURL       string // dial the server by WebSocket if set
+	tlsConfig   *tls.Config
+	h2URL       string // dial the server by HTTP/2 if set
+	h2Transport http.RoundTripper
+	// accept UDP ASSOCIATE of socks5
+	udpAssociate bool
+	// local interfaces of tunnels in turn
+	bindAddrs []net.IP
+	bindSeq   uint32
+	// grace of re-attaching in roaming
+	roaming  time.Duration
+	dnsTun   *dnsFallback
+	fastOpen bool
+	legacyDH bool
+	// udp address of server, the window and data datagrams per parity of KCP
+	kcpAddr   string
+	kcpWindow int
+	kcpFEC    int
+	// udp address of server for the knock
+	knockAddr string
+	knockKey  []byte
+	// hybrid key exchange with ML-KEM
+	postQuantum bool
+	rekey       *rekeyPolicy
+	// delay of coalescing writes of tunnels
+	coalesce time.Duration
+	// offer the NULL cipher in negotiation
+	allowPlaintext bool
+	// pool size to request tokens
+	tokenFloor int
+	// destination ports of interactive streams
+	prioPorts priorityPorts
+}
+
+// dial the server, fallback to the DNS tunnel if enabled
+func (d *connectionInfo) dial() (net.Conn, error) {
+	if d.dnsTun != nil {
+		return d.dnsTun.dial(d.dialDirect)
+	}
+	return d.dialDirect()
+}
+
+// dial the server directly or by WebSocket
+func (d *connectionInfo) dialDirect() (net.Conn, error) {
+	if d.h2URL != NULL {
+		return dialHTTP2(d.h2URL, d.h2Transport, GENERAL_SO_TIMEOUT)
+	}
+	if d.wsURL != NULL {
+		return dialWebSocket(d.wsURL, d.tlsConfig, GENERAL_SO_TIMEOUT)
+	}
+	if d.kcpAddr != NULL {
+		return dialKCP(d.kcpAddr, d.kcpWindow, d.kcpFEC)
+	}
+	var dialer = d.nextDialer()
+	if d.knockAddr != NULL {
+		if err := sendKnock(d.knockKey, d.knockAddr, dialer); err != nil {
+			return nil, err
+		}
+		time.Sleep(KNOCK_LEAD)
+	}
+	if d.fastOpen {
+		conn, err := dialFastOpen(dialer, d.sAddr)
+		if err != nil || d.tlsConfig == nil {
+			return conn, err
+		}
+		return fastOpenTLS(conn, d.tlsConfig, d.sAddr)
+	}
+	if d.tlsConfig != nil {
+		return tls.DialWithDialer(dialer, "tcp", d.sAddr, d.tlsConfig)
+	}
+	return dialer.Dial("tcp", d.sAddr)
 }
 
 func (d *connectionInfo) RemoteName() string {
@@ -250,7 +582,8 @@ func newConnectionInfo(uri string) (*connectionInfo, error) {
 	}
 
 	info.pkType, info.cipher = SubstringBefore(tmp, "/")
-	_, err = GetAvailableCipher(info.cipher)
+	// NULL will be checked with the client settings
+	_, err = parseCipherSuites(info.cipher, true)
 	if err != nil {
 		return nil, err
 	}
@@ -361,6 +694,7 @@ func (cman *ConfigMan) ParseClientConf() (conf *clientConf, err error) {
 		connInfo.pacFile = pacFile.String()
 	}
 	connInfo.sPubKey = pubkey
+	connInfo.label = conf.Label
 	conf.connInfo = connInfo
 	err = conf.validate()
 	return
@@ -372,7 +706,7 @@ type serverConf struct {
 	Auth          string       `importable:"file://_USER_PASS_FILE_PATH_"`
 	Cipher        string       `importable:"AES128CTR"`
 	ServerName    string       `importable:"_MY_SERVER"`
-	Parallels     int          `importable:"2"`
+	Parallels     int          `importable:"2"` // tunnels of client, 2 to 16
 	Verbose       int          `importable:"1"`
 	DenyDest      string       `importable:"OFF"`
 	ErrorFeedback string       `importable:"true"`
@@ -381,6 +715,250 @@ type serverConf struct {
 	errFeedback   bool
 	privateKey    stdcrypto.PrivateKey
 	publicKey     stdcrypto.PublicKey
+
+	// optional settings
+	StormThreshold int `ini:",omitempty"` // negotiations per second to detect storm
+	StormAdmitRate int `ini:",omitempty"`
+	// concurrent negotiations, the resumptions will be admitted first at capacity
+	MaxNegotiations int `ini:",omitempty"`
+	// connections in negotiation including the slow ones before hello, and
+	// the deadline of negotiation, eg. 30s
+	MaxHalfOpen      int    `ini:",omitempty"`
+	HandshakeTimeout string `ini:",omitempty"`
+	handshakeTimeout time.Duration
+	// negotiations per source subnet
+	SubnetConcurrency int `ini:",omitempty"`
+	SubnetRate        int `ini:",omitempty"` // per minute
+	// concurrent connections per source ip including the tunnels
+	MaxTunnelsPerIP int `ini:",omitempty"`
+	// ban the source ip for the cooldown (10m by default) after the failed
+	// negotiations reached the threshold in 10 minutes
+	BanThreshold int    `ini:",omitempty"`
+	BanCooldown  string `ini:",omitempty"`
+	banCooldown  time.Duration
+	// tolerance of client clock, eg. 2m
+	MaxClockSkew string `ini:",omitempty"`
+	skewSteps    int
+	// respond to probes with slow, tls or http style instead of instant close
+	Tarpit      string `ini:",omitempty"`
+	TarpitDelay string `ini:",omitempty"` // holding time, eg. 10s
+	TarpitMax   int    `ini:",omitempty"` // concurrent trapped connections
+	tarpitStyle string
+	tarpitDelay time.Duration
+	// proxy the probes to the web server host:port instead, prior to tarpit
+	Decoy    string `ini:",omitempty"`
+	DecoyMax int    `ini:",omitempty"` // concurrent proxied probes
+	// streams opened per second of session
+	StreamOpenRate  int `ini:",omitempty"`
+	StreamOpenBurst int `ini:",omitempty"`
+	// concurrent open streams per session, unlimited if 0. the clients refuse
+	// the requests over it by SOCKS failure instead of queueing them.
+	MaxStreams int `ini:",omitempty"`
+	// consecutive failures of connecting destinations in window per session,
+	// then the openings are delayed with backoff
+	DialFailBudget int    `ini:",omitempty"`
+	DialFailWindow string `ini:",omitempty"` // eg. 1m
+	dialFailWindow time.Duration
+	// the same client could reuse the consumed token in window, eg. 10s
+	TokenGrace string `ini:",omitempty"`
+	tokenGrace time.Duration
+	// unconsumed tokens held by a session
+	MaxTokens int `ini:",omitempty"`
+	// tokens issued per request of client, 2 to 32, 4 by default, and at
+	// least Parallels+2 in the first batch. the larger batch costs less
+	// requests but more tokens in flight, and MaxTokens is raised to hold
+	// the batches if unset.
+	TokenBatch int `ini:",omitempty"`
+	// bytes of token, 20 (default) or 32 for the clients support it
+	TokenSize int `ini:",omitempty"`
+	// refuse the clients of older protocol version, 1 (default) to retire none
+	MinProtocol int `ini:",omitempty"`
+	// issue the tokens of sha1 construction as the old servers, only for
+	// the rollout
+	LegacyTokens string `ini:",omitempty"`
+	legacyTokens bool
+	// issue the tokens signed by the key of server and valid in the period
+	// instead of storing them, so the processes of the same key could
+	// validate them, eg. 24h. the sessions are shared by TokenStore if set,
+	// otherwise a token could be spent once on each process.
+	StatelessTokens string `ini:",omitempty"`
+	statelessTokens time.Duration
+	// the unused tokens expire after issued, and the clients request the
+	// fresh ones before, eg. 1h. the stateless tokens expire by their period.
+	TokenTTL string `ini:",omitempty"`
+	tokenTTL time.Duration
+	// take the tokens and tickets only from the ip, or the subnet (/24 of
+	// ipv4, /64 of ipv6), of the client which created the session, so the
+	// leaked tokens are useless elsewhere. the token presented by others is
+	// refused as the incorrect one but not consumed, and the clients of any
+	// version renegotiate then, so no upgrade of clients is required. but
+	// the roaming clients across networks have to authenticate again.
+	BindTokens string `ini:",omitempty"`
+	// share the tokens with the servers of the same key behind a load
+	// balancer, redis://[:password@]host[:port][/db]
+	TokenStore string `ini:",omitempty"`
+	// file to save the sessions of users opted in, restored after restart
+	SessionStore string `ini:",omitempty"`
+	// issue the tickets to revive the sessions in the period, eg. 12h
+	SessionTickets string `ini:",omitempty"`
+	sessionTickets time.Duration
+	// save the store also in interval, eg. 1m, so the sessions survive the
+	// crash or kill of server rather than renegotiated by all clients at
+	// once. but the tokens spent after the last checkpoint are valid again
+	// once restored, the interval bounds that window. nothing changes on
+	// the wire.
+	SessionCheckpoint string `ini:",omitempty"`
+	sessionCheckpoint time.Duration
+	// concurrent destination connections of server
+	MaxOutbound int `ini:",omitempty"`
+	// CIDRs separated by comma instead of the defaults, or OFF
+	DenyNetworks string `ini:",omitempty"`
+	denyNetworks []*net.IPNet
+	// url or file path, replaces the DenyNetworks by the fetched rules
+	DenyNetworksSource string `ini:",omitempty"`
+	// refresh interval of DenyNetworksSource, eg. 5m
+	DenyNetworksRefresh string `ini:",omitempty"`
+	aclRefresh          time.Duration
+	// country codes separated by comma, eg. US,JP, the destinations located
+	// out of them are denied
+	AllowDest string `ini:",omitempty"`
+	// url to authorize opening streams, replies 2xx to allow and 403 to deny
+	AuthWebhook string `ini:",omitempty"`
+	// eg. 2s
+	AuthWebhookTimeout string `ini:",omitempty"`
+	webhookTimeout     time.Duration
+	// decisions are cached in such duration, eg. 30s or 0 to disable
+	AuthWebhookCache string `ini:",omitempty"`
+	webhookCache     time.Duration
+	// policy on webhook errors: open or closed (default)
+	AuthWebhookFail string `ini:",omitempty"`
+	webhookFailOpen bool
+	// url of DNS-over-HTTPS endpoint for resolving destinations
+	DoH         string `ini:",omitempty"`
+	DoHFallback string `ini:",omitempty"` // to system resolver if DoH failed
+	dohFallback bool
+	// strict (default) or lenient when required resources failed to load
+	StartupMode string `ini:",omitempty"`
+	lenient     bool
+	// strict (default) or lenient parsing of client identity
+	IdentityMode    string `ini:",omitempty"`
+	lenientIdentity bool
+	// the streams of zero bytes closed within threshold are probes, eg. 500ms
+	ProbeThreshold string `ini:",omitempty"`
+	ProbePenalty   string `ini:",omitempty"` // delay the next opening of session
+	probeThreshold time.Duration
+	probePenalty   time.Duration
+	// ceiling of memory held in receive buffers, eg. 64M. the heavy streams
+	// are paused or dropped at it
+	MaxBufferMemory string `ini:",omitempty"`
+	maxBufferMemory int64
+	// credit granted to the clients of each stream with flow control, eg. 1M.
+	// the streams sent beyond it are dropped
+	StreamWindow string `ini:",omitempty"`
+	streamWindow int
+	// SO_LINGER seconds of tunnel and destination sockets, or graceful if empty
+	Linger string `ini:",omitempty"`
+	linger int
+	// seconds of idle tunnel before ping, also told to the clients
+	PingInterval int `ini:",omitempty"`
+	// ping interval backs off up to it on busy tunnel, fixed if empty
+	PingIntervalMax int `ini:",omitempty"`
+	// randomize the wire profile of sessions: off (default), low or high,
+	// that costs throughput, see wireProfile
+	Fingerprint string `ini:",omitempty"`
+	fingerprint int
+	// bounds of frame payload min-max, eg. 255-255 for uniform size, or the
+	// max only, eg. 4096 for interactive use
+	FramePayload string `ini:",omitempty"`
+	frames       *frameBounds
+	// delay of coalescing the small writes of tunnels into one, eg. 2ms,
+	// that costs latency for less syscalls
+	WriteCoalesce string `ini:",omitempty"`
+	coalesce      time.Duration
+	// listen address and path of WebSocket transport besides the raw
+	// listener, eg. :8080/tunnel
+	WebSocket string `ini:",omitempty"`
+	// CIDRs of the reverse proxies in front of WebSocket, the address of
+	// client is taken from the X-Forwarded-For of them for the guards.
+	WebSocketProxies string `ini:",omitempty"`
+	wsProxies        []*net.IPNet
+	// listeners wrapped in TLS with the certificate: tunnel, websocket
+	TLS     string `ini:",omitempty"`
+	TLSCert string `ini:",omitempty"` // PEM files
+	TLSKey  string `ini:",omitempty"`
+	// listen address and path of HTTP/2 transport with the certificate,
+	// eg. :8443/tunnel behind the reverse proxy
+	HTTP2 string `ini:",omitempty"`
+	// the alternate endpoint host:port noticed to clients for migration
+	MigrateTo string `ini:",omitempty"`
+	// keep the session and streams of disconnected client for re-attaching
+	// from another address in grace, eg. 30s
+	Roaming string `ini:",omitempty"`
+	roaming time.Duration
+	// relay UDP ASSOCIATE of socks5 clients, disabled by default. the
+	// associations are counted as streams and outbound connections
+	UDPRelay string `ini:",omitempty"`
+	udpRelay bool
+	// accept the striped frames of multipath clients, disabled by default
+	Multipath string `ini:",omitempty"`
+	multipath bool
+	// answer the DNS queries of the domain delegated to this server on the
+	// udp address (:53 by default) as the fallback tunnels of clients
+	DNSTunnel string `ini:",omitempty"`
+	DNSListen string `ini:",omitempty"`
+	// serve the tunnels carried by reliable UDP on the address, eg. :9009,
+	// with the window of segments, 128 by default
+	KCP       string `ini:",omitempty"`
+	KCPWindow string `ini:",omitempty"`
+	kcpWindow int
+	// accept TCP Fast Open of clients on linux
+	FastOpen string `ini:",omitempty"`
+	fastOpen bool
+	// reset the tcp connections from the sources without a valid knock sent
+	// to the udp address, eg. :9010, in window (30s by default)
+	Knock       string `ini:",omitempty"`
+	KnockWindow string `ini:",omitempty"`
+	knockWindow time.Duration
+	// rotate the keys of tunnels after the traffic or the period of each,
+	// eg. 1G,30m. requires the clients support it.
+	Rekey string `ini:",omitempty"`
+	rekey *rekeyPolicy
+	// destroy the session without progress of tunnels in timeout, eg. 30m
+	ZombieTimeout string `ini:",omitempty"`
+	zombieTimeout time.Duration
+	// evict the session without data relayed in timeout, eg. 2h, the pings
+	// are not counted and the paused sessions are kept. the tunnels are
+	// closed and the tokens dropped, then the clients of any version
+	// renegotiate at the next connection. disabled by default.
+	IdleTimeout string `ini:",omitempty"`
+	idleTimeout time.Duration
+	// accept the NULL cipher, only for trusted links
+	AllowPlaintext string `ini:",omitempty"`
+	allowPlaintext bool
+	// detect protocol of streams with behaviors: http-xff, tls-sni, ssh-log
+	Sniff string `ini:",omitempty"`
+	// total egress bytes per second shared by classes, eg. 10M
+	EgressRate      string `ini:",omitempty"`
+	PriorityClasses string `ini:",omitempty"` // name:weight,... eg. premium:8,default:2
+	egressRate      int64
+	labels          map[string]*labelRule // allowed labels
+	// destination ports of the interactive streams written to tunnels before
+	// the others, eg. 22,3389. the streams are demoted to bulk after 1M sent
+	// if not listed.
+	InteractivePorts string `ini:",omitempty"`
+	prioPorts        priorityPorts
+	// listen address and path of the metrics in the text format of
+	// Prometheus, eg. 127.0.0.1:9100 for /metrics by default. it listens on
+	// loopback only, unless the scrapes must carry MetricsToken as Bearer
+	Metrics      string `ini:",omitempty"`
+	MetricsToken string `ini:",omitempty"`
+	// listen address and path of the admin API on loopback, eg.
+	// 127.0.0.1:9300/admin, the requests must carry AdminToken as Bearer
+	Admin      string `ini:",omitempty"`
+	AdminToken string `ini:",omitempty"`
+	// path of the unix socket of the admin API for the admin command,
+	// eg. /var/run/deblocus.sock, only accessible to the owner
+	AdminSocket string `ini:",omitempty"`
 }
 
 func (d *serverConf) validate() error {
@@ -402,14 +980,23 @@ func (d *serverConf) validate() error {
 	if len(d.Cipher) < 1 {
 		return CONF_MISS.Apply("Cipher")
 	}
-	_, e = GetAvailableCipher(d.Cipher)
+	if len(d.AllowPlaintext) > 0 {
+		d.allowPlaintext, e = strconv.ParseBool(d.AllowPlaintext)
+		if e != nil {
+			return CONF_ERROR.Apply("AllowPlaintext")
+		}
+	}
+	// the accepted suites in negotiation
+	_, e = parseCipherSuites(d.Cipher, d.allowPlaintext)
 	if e != nil {
 		return e
 	}
 	if d.ServerName == NULL {
 		return CONF_MISS.Apply("ServerName")
 	}
-	if d.Parallels < 2 || d.Parallels > 16 {
+	if d.Parallels == 0 {
+		d.Parallels = PARALLEL_TUN_QTY
+	} else if d.Parallels < 2 || d.Parallels > PARALLEL_MAX {
 		return CONF_ERROR.Apply("Parallels")
 	}
 	if d.privateKey == nil {
@@ -428,6 +1015,424 @@ func (d *serverConf) validate() error {
 			return CONF_ERROR.Apply("ErrorFeedback")
 		}
 	}
+	if d.StormThreshold < 0 || d.StormAdmitRate < 0 {
+		return CONF_ERROR.Apply("StormThreshold/StormAdmitRate")
+	}
+	if d.StormThreshold > 0 && d.StormAdmitRate == 0 {
+		d.StormAdmitRate = STORM_ADMIT_RATE
+	}
+	if d.SubnetConcurrency < 0 || d.SubnetRate < 0 {
+		return CONF_ERROR.Apply("SubnetConcurrency/SubnetRate")
+	}
+	if d.MaxTunnelsPerIP < 0 {
+		return CONF_ERROR.Apply("MaxTunnelsPerIP")
+	}
+	if d.BanThreshold < 0 {
+		return CONF_ERROR.Apply("BanThreshold")
+	}
+	d.banCooldown = BAN_COOLDOWN
+	if len(d.BanCooldown) > 0 {
+		d.banCooldown, e = time.ParseDuration(d.BanCooldown)
+		if e != nil || d.banCooldown <= 0 {
+			return CONF_ERROR.Apply("BanCooldown")
+		}
+	}
+	if d.StreamOpenRate < 0 || d.StreamOpenBurst < 0 {
+		return CONF_ERROR.Apply("StreamOpenRate/StreamOpenBurst")
+	}
+	if d.MaxStreams < 0 || d.MaxStreams > math.MaxUint16 {
+		return CONF_ERROR.Apply("MaxStreams")
+	}
+	if d.DialFailBudget < 0 {
+		return CONF_ERROR.Apply("DialFailBudget")
+	}
+	d.dialFailWindow = DIAL_FAIL_WINDOW
+	if len(d.DialFailWindow) > 0 {
+		d.dialFailWindow, e = time.ParseDuration(d.DialFailWindow)
+		if e != nil || d.dialFailWindow <= 0 {
+			return CONF_ERROR.Apply("DialFailWindow")
+		}
+	}
+	if d.MaxNegotiations < 0 {
+		return CONF_ERROR.Apply("MaxNegotiations")
+	}
+	if d.MaxHalfOpen == 0 {
+		d.MaxHalfOpen = HALF_OPEN_MAX
+	} else if d.MaxHalfOpen < 0 {
+		return CONF_ERROR.Apply("MaxHalfOpen")
+	}
+	d.handshakeTimeout = HANDSHAKE_TIMEOUT
+	if len(d.HandshakeTimeout) > 0 {
+		d.handshakeTimeout, e = time.ParseDuration(d.HandshakeTimeout)
+		if e != nil || d.handshakeTimeout < time.Second {
+			return CONF_ERROR.Apply("HandshakeTimeout")
+		}
+	}
+	if d.MaxOutbound < 0 {
+		return CONF_ERROR.Apply("MaxOutbound")
+	}
+	d.skewSteps = TIME_ERROR
+	if len(d.MaxClockSkew) > 0 {
+		skew, e := time.ParseDuration(d.MaxClockSkew)
+		if e != nil || skew < 0 || skew > SKEW_MAX {
+			return CONF_ERROR.Apply("MaxClockSkew")
+		}
+		// round up to steps
+		var step = time.Second * TIME_STEP
+		d.skewSteps = int((skew + step - 1) / step)
+	}
+	switch d.tarpitStyle = strings.ToLower(d.Tarpit); d.tarpitStyle {
+	case NULL, TARPIT_OFF:
+		d.tarpitStyle = NULL
+	case TARPIT_SLOW, TARPIT_TLS, TARPIT_HTTP:
+	default:
+		return CONF_ERROR.Apply("Tarpit")
+	}
+	d.tarpitDelay = TARPIT_DELAY
+	if len(d.TarpitDelay) > 0 {
+		d.tarpitDelay, e = time.ParseDuration(d.TarpitDelay)
+		if e != nil || d.tarpitDelay < 0 || d.tarpitDelay > TARPIT_DELAY_MAX {
+			return CONF_ERROR.Apply("TarpitDelay")
+		}
+	}
+	if d.TarpitMax < 0 {
+		return CONF_ERROR.Apply("TarpitMax")
+	} else if d.TarpitMax == 0 {
+		d.TarpitMax = TARPIT_MAX
+	}
+	if d.Decoy != NULL && IsValidHost(d.Decoy) != nil {
+		return CONF_ERROR.Apply("Decoy")
+	}
+	if d.DecoyMax < 0 {
+		return CONF_ERROR.Apply("DecoyMax")
+	} else if d.DecoyMax == 0 {
+		d.DecoyMax = DECOY_MAX
+	}
+	switch d.DenyNetworks {
+	case NULL:
+		d.denyNetworks, e = parseNetworks(DEFAULT_DENY_NETWORKS)
+	case "OFF", "off":
+		d.denyNetworks = nil
+	default:
+		d.denyNetworks, e = parseNetworks(strings.Split(d.DenyNetworks, ","))
+	}
+	if e != nil {
+		return CONF_ERROR.Apply("DenyNetworks")
+	}
+	if d.DenyNetworksSource != NULL && isURLSource(d.DenyNetworksSource) {
+		if _, e = url.Parse(d.DenyNetworksSource); e != nil {
+			return CONF_ERROR.Apply("DenyNetworksSource")
+		}
+	}
+	if len(d.AllowDest) > 0 && !regexp.MustCompile("^[A-Za-z]{2}(,[A-Za-z]{2})*$").MatchString(d.AllowDest) {
+		return CONF_ERROR.Apply("AllowDest must be ISO3166-1 2-letter Country Codes")
+	}
+	d.aclRefresh = ACL_REFRESH
+	if d.DenyNetworksRefresh != NULL {
+		d.aclRefresh, e = time.ParseDuration(d.DenyNetworksRefresh)
+		if e != nil || d.aclRefresh < ACL_REFRESH_MIN {
+			return CONF_ERROR.Apply("DenyNetworksRefresh")
+		}
+	}
+	if d.AuthWebhook != NULL {
+		if u, e := url.Parse(d.AuthWebhook); e != nil || !isURLSource(d.AuthWebhook) || u.Host == NULL {
+			return CONF_ERROR.Apply("AuthWebhook must be http(s) url")
+		}
+	}
+	d.webhookTimeout = WEBHOOK_TIMEOUT
+	if d.AuthWebhookTimeout != NULL {
+		d.webhookTimeout, e = time.ParseDuration(d.AuthWebhookTimeout)
+		if e != nil || d.webhookTimeout <= 0 || d.webhookTimeout > WEBHOOK_TIMEOUT_MAX {
+			return CONF_ERROR.Apply("AuthWebhookTimeout")
+		}
+	}
+	d.webhookCache = WEBHOOK_CACHE_TTL
+	if d.AuthWebhookCache != NULL {
+		d.webhookCache, e = time.ParseDuration(d.AuthWebhookCache)
+		if e != nil || d.webhookCache < 0 {
+			return CONF_ERROR.Apply("AuthWebhookCache")
+		}
+	}
+	switch d.AuthWebhookFail {
+	case NULL, WEBHOOK_FAIL_CLOSED:
+		d.webhookFailOpen = false
+	case WEBHOOK_FAIL_OPEN:
+		d.webhookFailOpen = true
+	default:
+		return CONF_ERROR.Apply("AuthWebhookFail")
+	}
+	if d.DoH != NULL {
+		if u, e := url.Parse(d.DoH); e != nil || u.Scheme != "https" || u.Host == NULL {
+			return CONF_ERROR.Apply("DoH must be https url")
+		}
+	}
+	if len(d.DoHFallback) > 0 {
+		d.dohFallback, e = strconv.ParseBool(d.DoHFallback)
+		if e != nil {
+			return CONF_ERROR.Apply("DoHFallback")
+		}
+	}
+	if len(d.UDPRelay) > 0 {
+		d.udpRelay, e = strconv.ParseBool(d.UDPRelay)
+		if e != nil {
+			return CONF_ERROR.Apply("UDPRelay")
+		}
+	}
+	if len(d.Multipath) > 0 {
+		d.multipath, e = strconv.ParseBool(d.Multipath)
+		if e != nil {
+			return CONF_ERROR.Apply("Multipath")
+		}
+	}
+	if len(d.ProbeThreshold) > 0 {
+		d.probeThreshold, e = time.ParseDuration(d.ProbeThreshold)
+		if e != nil || d.probeThreshold < 0 {
+			return CONF_ERROR.Apply("ProbeThreshold")
+		}
+	}
+	if len(d.ProbePenalty) > 0 {
+		d.probePenalty, e = time.ParseDuration(d.ProbePenalty)
+		if e != nil || d.probePenalty < 0 {
+			return CONF_ERROR.Apply("ProbePenalty")
+		}
+	}
+	if len(d.MaxBufferMemory) > 0 {
+		d.maxBufferMemory, e = parseHumanSize(d.MaxBufferMemory)
+		if e != nil || d.maxBufferMemory < 0 {
+			return CONF_ERROR.Apply("MaxBufferMemory")
+		}
+	}
+	if len(d.StreamWindow) > 0 {
+		window, e := parseHumanSize(d.StreamWindow)
+		if e != nil || window < STREAM_WINDOW || window > STREAM_QUEUE_MAX/2 {
+			return CONF_ERROR.Apply("StreamWindow")
+		}
+		d.streamWindow = int(window)
+	}
+	if len(d.TokenGrace) > 0 {
+		d.tokenGrace, e = time.ParseDuration(d.TokenGrace)
+		if e != nil || d.tokenGrace < 0 {
+			return CONF_ERROR.Apply("TokenGrace")
+		}
+	}
+	if d.TokenBatch == 0 {
+		d.TokenBatch = GENERATE_TOKEN_NUM
+	} else if d.TokenBatch < 2 || d.TokenBatch > TOKEN_BATCH_MAX {
+		return CONF_ERROR.Apply("TokenBatch")
+	}
+	// room for the initial tokens and refills
+	if d.MaxTokens == 0 {
+		d.MaxTokens = maxInt(TOKENS_MAX, maxInt(d.TokenBatch, d.Parallels+2)+d.TokenBatch*2)
+	} else if d.MaxTokens < maxInt(d.TokenBatch, d.Parallels+2)+d.TokenBatch*2 {
+		return CONF_ERROR.Apply("MaxTokens")
+	}
+	if d.TokenSize == 0 {
+		d.TokenSize = TKSZ
+	} else if d.TokenSize != TKSZ && d.TokenSize != TKSZ_LONG {
+		return CONF_ERROR.Apply("TokenSize")
+	}
+	if d.MinProtocol == 0 {
+		d.MinProtocol = PROTOCOL_V1
+	} else if d.MinProtocol < PROTOCOL_V1 || d.MinProtocol > PROTOCOL_MAX {
+		return CONF_ERROR.Apply("MinProtocol")
+	}
+	if len(d.LegacyTokens) > 0 {
+		d.legacyTokens, e = strconv.ParseBool(d.LegacyTokens)
+		if e != nil {
+			return CONF_ERROR.Apply("LegacyTokens")
+		}
+	}
+	if len(d.StatelessTokens) > 0 {
+		d.statelessTokens, e = time.ParseDuration(d.StatelessTokens)
+		if e != nil || d.statelessTokens < time.Minute || d.legacyTokens {
+			return CONF_ERROR.Apply("StatelessTokens")
+		}
+	}
+	if len(d.TokenTTL) > 0 {
+		d.tokenTTL, e = time.ParseDuration(d.TokenTTL)
+		if e != nil || d.tokenTTL < time.Minute || d.statelessTokens > 0 {
+			return CONF_ERROR.Apply("TokenTTL")
+		}
+	}
+	if len(d.SessionTickets) > 0 {
+		d.sessionTickets, e = time.ParseDuration(d.SessionTickets)
+		if e != nil || d.sessionTickets < time.Minute {
+			return CONF_ERROR.Apply("SessionTickets")
+		}
+	}
+	if len(d.SessionCheckpoint) > 0 {
+		d.sessionCheckpoint, e = time.ParseDuration(d.SessionCheckpoint)
+		if e != nil || d.sessionCheckpoint < SESSION_CHECKPOINT_MIN || d.SessionStore == NULL {
+			return CONF_ERROR.Apply("SessionCheckpoint")
+		}
+	}
+	switch d.BindTokens = strings.ToLower(d.BindTokens); d.BindTokens {
+	case NULL, BIND_TOKENS_IP, BIND_TOKENS_SUBNET:
+	default:
+		return CONF_ERROR.Apply("BindTokens")
+	}
+	if len(d.TokenStore) > 0 {
+		if _, e = newRedisTokenStore(d.TokenStore); e != nil {
+			return CONF_ERROR.Apply("TokenStore")
+		}
+	}
+	if len(d.ZombieTimeout) > 0 {
+		d.zombieTimeout, e = time.ParseDuration(d.ZombieTimeout)
+		if e != nil || d.zombieTimeout < 0 {
+			return CONF_ERROR.Apply("ZombieTimeout")
+		}
+	}
+	if len(d.IdleTimeout) > 0 {
+		d.idleTimeout, e = time.ParseDuration(d.IdleTimeout)
+		if e != nil || d.idleTimeout < 0 {
+			return CONF_ERROR.Apply("IdleTimeout")
+		}
+	}
+	if d.PingInterval == 0 {
+		d.PingInterval = DT_PING_INTERVAL
+	} else if d.PingInterval < PING_INTERVAL_MIN || d.PingInterval > PING_INTERVAL_MAX {
+		return CONF_ERROR.Apply("PingInterval")
+	}
+	if e = validatePingBackoff(d.PingInterval, d.PingIntervalMax); e != nil {
+		return e
+	}
+	if d.fingerprint, e = parseFingerprint(d.Fingerprint); e != nil {
+		return e
+	}
+	if len(d.FramePayload) > 0 {
+		if d.frames, e = parseFrameBounds(d.FramePayload); e != nil {
+			return e
+		}
+	}
+	if len(d.WriteCoalesce) > 0 {
+		if d.coalesce, e = parseCoalesceDelay(d.WriteCoalesce); e != nil {
+			return e
+		}
+	}
+	if len(d.WebSocket) > 0 {
+		if _, _, e = parseListenPath(d.WebSocket); e != nil {
+			return CONF_ERROR.Apply("WebSocket")
+		}
+	}
+	if len(d.WebSocketProxies) > 0 {
+		d.wsProxies, e = parseNetworks(strings.Split(d.WebSocketProxies, ","))
+		if e != nil || len(d.wsProxies) == 0 || d.WebSocket == NULL {
+			return CONF_ERROR.Apply("WebSocketProxies")
+		}
+	}
+	if len(d.HTTP2) > 0 {
+		if _, _, e = parseListenPath(d.HTTP2); e != nil {
+			return CONF_ERROR.Apply("HTTP2")
+		}
+	}
+	if len(d.Metrics) > 0 {
+		if len(d.MetricsToken) == 0 {
+			if e = validateLoopbackAddr("Metrics", d.Metrics); e != nil {
+				return e
+			}
+		} else if len(d.MetricsToken) < ADMIN_TOKEN_MIN {
+			return CONF_ERROR.Apply("MetricsToken")
+		}
+		if _, _, e = parseListenPath(d.Metrics); e != nil {
+			return CONF_ERROR.Apply("Metrics")
+		}
+	}
+	if len(d.Admin) > 0 {
+		if e = validateAdminAddr(d.Admin); e != nil {
+			return e
+		}
+		if len(d.AdminToken) < ADMIN_TOKEN_MIN {
+			return CONF_ERROR.Apply("AdminToken")
+		}
+	}
+	if (len(d.TLS) > 0 || len(d.HTTP2) > 0) && (IsNotExist(d.TLSCert) || IsNotExist(d.TLSKey)) {
+		return CONF_ERROR.Apply("TLSCert")
+	}
+	if len(d.MigrateTo) > 0 {
+		if _, _, e = net.SplitHostPort(d.MigrateTo); e != nil {
+			return CONF_ERROR.Apply("MigrateTo")
+		}
+	}
+	if len(d.Roaming) > 0 {
+		d.roaming, e = time.ParseDuration(d.Roaming)
+		if e != nil || d.roaming < 0 {
+			return CONF_ERROR.Apply("Roaming")
+		}
+	}
+	if len(d.DNSTunnel) > 0 {
+		if e = validateDnsDomain(d.DNSTunnel); e != nil {
+			return e
+		}
+		if d.DNSListen == NULL {
+			d.DNSListen = ":53"
+		}
+	}
+	if len(d.KCP) > 0 {
+		if _, e = net.ResolveUDPAddr("udp", d.KCP); e != nil {
+			return CONF_ERROR.Apply("KCP")
+		}
+	}
+	d.kcpWindow = KCP_WINDOW
+	if len(d.KCPWindow) > 0 {
+		if d.kcpWindow, e = parseKcpWindow(d.KCPWindow, "KCPWindow"); e != nil {
+			return e
+		}
+	}
+	if len(d.FastOpen) > 0 {
+		d.fastOpen, e = strconv.ParseBool(d.FastOpen)
+		if e != nil {
+			return CONF_ERROR.Apply("FastOpen")
+		}
+	}
+	if len(d.Knock) > 0 {
+		if _, e = net.ResolveUDPAddr("udp", d.Knock); e != nil {
+			return CONF_ERROR.Apply("Knock")
+		}
+	}
+	d.knockWindow = KNOCK_WINDOW
+	if len(d.KnockWindow) > 0 {
+		d.knockWindow, e = time.ParseDuration(d.KnockWindow)
+		if e != nil || d.knockWindow < time.Second {
+			return CONF_ERROR.Apply("KnockWindow")
+		}
+	}
+	if len(d.Rekey) > 0 {
+		if d.rekey, e = parseRekeyPolicy(d.Rekey); e != nil {
+			return e
+		}
+	}
+	d.linger = -1
+	if len(d.Linger) > 0 {
+		d.linger, e = strconv.Atoi(d.Linger)
+		if e != nil || d.linger < 0 {
+			return CONF_ERROR.Apply("Linger")
+		}
+	}
+	if len(d.EgressRate) > 0 {
+		d.egressRate, e = parseHumanSize(d.EgressRate)
+		if e != nil || d.egressRate < 0 {
+			return CONF_ERROR.Apply("EgressRate")
+		}
+	}
+	if len(d.InteractivePorts) > 0 {
+		if d.prioPorts, e = parsePriorityPorts(d.InteractivePorts); e != nil {
+			return e
+		}
+	}
+	switch strings.ToLower(d.StartupMode) {
+	case NULL, STARTUP_STRICT:
+	case STARTUP_LENIENT:
+		d.lenient = true
+	default:
+		return CONF_ERROR.Apply("StartupMode")
+	}
+	switch strings.ToLower(d.IdentityMode) {
+	case NULL, STARTUP_STRICT:
+	case STARTUP_LENIENT:
+		d.lenientIdentity = true
+	default:
+		return CONF_ERROR.Apply("IdentityMode")
+	}
 	return nil
 }
 
@@ -460,6 +1465,14 @@ func (cman *ConfigMan) ParseServConf() (d5s *serverConf, err error) {
 	}
 	d5s.privateKey = priv
 	d5s.publicKey = priv.(stdcrypto.Signer).Public()
+	if secLabels, _ := ii.GetSection(CF_LABELS); secLabels != nil {
+		d5s.labels = make(map[string]*labelRule)
+		for _, k := range secLabels.Keys() {
+			if d5s.labels[k.Name()], err = parseLabelRule(k.Name(), k.String()); err != nil {
+				return
+			}
+		}
+	}
 	err = d5s.validate()
 	return
 }
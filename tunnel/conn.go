@@ -2,19 +2,47 @@ package tunnel
 
 import (
 	"fmt"
+	"io"
 	"net"
 	"sync"
 	"sync/atomic"
 	"time"
 )
 
+const (
+	// the ceiling of delay in coalescing writes
+	COALESCE_DELAY_MAX = time.Millisecond * 50
+	// flush the coalesced writes at the size without delay
+	COALESCE_FLUSH_SIZE = 1 << 14
+)
+
 type Conn struct {
+	wrote int64 // writes, the activity of egress
+	ping  int64 // effective ping interval
+	wcost int64 // average time of writing frames in striping
+	wlast int64 // unixnano of last striped writing
+	srtt  int64 // smoothed RTT of pings, zero if not sampled
+	rvar  int64 // mean deviation of RTT, the jitter
+	stall int64 // writes timed out but tolerated
 	net.Conn
 	cipher     cipherKit
 	closed     int32
+	retired    int32 // going away, streams are drained but not opened
+	rotate     int32 // the key is due but couldn't be renewed in place
 	identifier string
+	keyed      bool // the cipher of session was set up
 	wlock      *sync.Mutex
 	priority   *TSPriority
+	profile    *wireProfile // randomized wire profile of session
+	frames     *frameBounds
+	cf         *CipherFactory // of session, for rekeying
+	iv         []byte         // of tunnel, keys the MAC of records
+	rekey      *rekeyState    // of writing, nil if disabled
+	gate       *priorityGate  // of writing data frames by stream priority
+	coalesce   time.Duration  // delay of coalescing writes, zero to disable
+	pending    []byte         // coalesced writes, flushed by the timer or size
+	flusher    *time.Timer
+	werr       error // failed to flush, returned by the later writes
 }
 
 func NewConn(conn net.Conn, cipher cipherKit) *Conn {
@@ -38,13 +66,32 @@ func (c *Conn) SetId(name string, isServ bool) {
 	}
 }
 
-func (c *Conn) SetupCipher(cf *CipherFactory, iv []byte) {
+// switch from the plaintext of negotiation to the cipher of session,
+// by the new factory of DHE or the factory of resumed session.
+func (c *Conn) SetupCipher(cf *CipherFactory, iv []byte) error {
+	if cf == nil {
+		return CIPHER_NOT_READY.Apply("no cipher factory")
+	}
 	c.wlock.Lock()
 	defer c.wlock.Unlock()
 	c.cipher = cf.InitCipher(iv)
+	c.cf = cf
+	c.iv = append([]byte(nil), iv...)
+	c.keyed = true
+	return nil
+}
+
+// the conn could be handed over to mux only after SetupCipher
+func (c *Conn) cipherReady() bool {
+	c.wlock.Lock()
+	defer c.wlock.Unlock()
+	return c.keyed && c.cipher != nil
 }
 
 func (c *Conn) Read(b []byte) (int, error) {
+	if rc, y := c.cipher.(recordCipherKit); y {
+		return rc.open(c.Conn, b)
+	}
 	n, err := c.Conn.Read(b)
 	if n > 0 {
 		c.cipher.decrypt(b[:n], b[:n])
@@ -55,17 +102,109 @@ func (c *Conn) Read(b []byte) (int, error) {
 func (c *Conn) Write(b []byte) (int, error) {
 	c.wlock.Lock()
 	defer c.wlock.Unlock()
+	n, err := c.write(b)
+	if err == nil && c.rekey != nil && c.rekey.due(n) {
+		err = c.rekeyWrite()
+	}
+	return n, err
+}
+
+func (c *Conn) write(b []byte) (int, error) {
+	atomic.AddInt64(&c.wrote, 1)
+	if rc, y := c.cipher.(recordCipherKit); y {
+		sealed := rc.seal(b)
+		_, err := c.emit(sealed)
+		bytePool.Put(sealed)
+		if err != nil {
+			return 0, err
+		}
+		return len(b), nil
+	}
 	c.cipher.encrypt(b, b)
-	return c.Conn.Write(b)
+	return c.emit(b)
+}
+
+// write through, or append to the pending in coalescing. must hold wlock
+func (c *Conn) emit(b []byte) (int, error) {
+	if c.coalesce <= 0 {
+		return c.Conn.Write(b)
+	}
+	if c.werr != nil {
+		return 0, c.werr
+	}
+	c.pending = append(c.pending, b...)
+	if len(c.pending) >= COALESCE_FLUSH_SIZE {
+		return len(b), c.flushPending()
+	}
+	if c.flusher == nil {
+		c.flusher = time.AfterFunc(c.coalesce, c.flush)
+	} else if len(c.pending) == len(b) {
+		// the first of batch
+		c.flusher.Reset(c.coalesce)
+	}
+	return len(b), nil
+}
+
+func (c *Conn) flush() {
+	c.wlock.Lock()
+	defer c.wlock.Unlock()
+	c.flushPending()
+}
+
+// must hold wlock
+func (c *Conn) flushPending() error {
+	if len(c.pending) == 0 || c.werr != nil {
+		return c.werr
+	}
+	c.Conn.SetWriteDeadline(time.Now().Add(WRITE_TUN_TIMEOUT))
+	n, err := c.Conn.Write(c.pending)
+	if err != nil && IsTimeout(err) && c.priority != nil &&
+		time.Now().UnixNano()-c.priority.last < int64(WRITE_TUN_TIMEOUT) {
+		// tolerated as the writing of frames, the rest is flushed later
+		atomic.AddInt64(&c.stall, 1)
+		c.pending = c.pending[:copy(c.pending, c.pending[n:])]
+		if c.flusher == nil {
+			c.flusher = time.AfterFunc(c.coalesce, c.flush)
+		} else {
+			c.flusher.Reset(c.coalesce)
+		}
+		return nil
+	}
+	c.pending = c.pending[:0]
+	if err != nil {
+		c.werr = err
+		// then the reading exits
+		go SafeClose(c)
+	}
+	return err
 }
 
 func (c *Conn) isClosed() bool {
 	return atomic.LoadInt32(&c.closed) > 0
 }
 
+// flush the coalesced writes before closing, and return the error of flushing
+// which was not reported to the writers yet.
 func (c *Conn) Close() error {
 	atomic.AddInt32(&c.closed, 1)
-	return c.Conn.Close()
+	var err error
+	// the writing under wlock is bounded by the deadline in coalescing
+	if c.coalesce > 0 {
+		c.wlock.Lock()
+		if c.flusher != nil {
+			c.flusher.Stop()
+		}
+		err = c.flushPending()
+		if c.werr == nil {
+			// the later writes fail rather than pending
+			c.werr = io.ErrClosedPipe
+		}
+		c.wlock.Unlock()
+	}
+	if e := c.Conn.Close(); err == nil {
+		err = e
+	}
+	return err
 }
 
 func (c *Conn) CloseRead() {
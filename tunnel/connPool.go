@@ -77,12 +77,18 @@ func (h *ConnPool) Select() *Conn {
 		return nil
 	}
 	sort.Sort(h.pool)
-	if log.V(log.LV_TUN_SELECT) {
-		log.Infoln("Selected tun", h.pool[0].LocalAddr())
+	for _, selected := range h.pool {
+		// no more new streams on the retired
+		if atomic.LoadInt32(&selected.retired) != 0 {
+			continue
+		}
+		if log.V(log.LV_TUN_SELECT) {
+			log.Infoln("Selected tun", selected.LocalAddr())
+		}
+		atomic.AddInt64(&selected.priority.rank, SELECT_DECREASE)
+		return selected
 	}
-	selected := h.pool[0]
-	atomic.AddInt64(&selected.priority.rank, SELECT_DECREASE)
-	return selected
+	return nil
 }
 
 func (h *ConnPool) destroy() {
@@ -0,0 +1,39 @@
+package tunnel
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+)
+
+const (
+	// random bytes of correlation id, 12 chars in base64url
+	CORRELATION_ID_BYTES = 9
+)
+
+// --------------------
+// correlation id
+// --------------------
+// generated by client per session and carried in the identity of handshake,
+// then both sides log it to grep the same session in client and server logs.
+// it's sent only if enabled on client, since the old servers reject the
+// identity with an extra field.
+func newCorrelationId() string {
+	var b = make([]byte, CORRELATION_ID_BYTES)
+	if _, err := rand.Read(b); err != nil {
+		copy(b, randArray(CORRELATION_ID_BYTES))
+	}
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// the id from client must be safe to log, same charset as label
+func validCorrelationId(id string) bool {
+	return labelPattern.MatchString(id)
+}
+
+// the suffix of log lines
+func correlationTag(id string) string {
+	if id == NULL {
+		return NULL
+	}
+	return " cor=" + id
+}
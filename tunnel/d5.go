@@ -20,10 +20,72 @@ import (
 
 const (
 	AUTH_PASS byte = 0xff
-	TYPE_NEW  byte = 0xfb
+	TYPE_NEW  byte = 0xfb // new session by the legacy DH
+	TYPE_NEWX byte = 0xfc // new session by X25519
+	TYPE_NEWQ byte = 0xfd // new session by X25519 + ML-KEM-768
 	TYPE_RES  byte = 0xf1
+	TYPE_RESL byte = 0xf2 // resume by the long token
+	TYPE_TKT  byte = 0xf3 // revive the session by the ticket
 )
 
+// the hello of TYPE_TKT, in a single round trip:
+// dbcHello | ticketLen~2 | ticket~? | randLen~1 | rand~16
+// the ticket is nonce~12 | AES-GCM(json state padded to 512n) issued by the
+// server after the tokens of settings, only to the peers of PROTOCOL_V2
+// sharing CAP_TICKET, so the settings of old peers are unchanged. the server
+// answers the auth result and the settings as the negotiation. the servers
+// without tickets take TYPE_TKT as unrecognized, then the client negotiates
+// in full.
+
+// the signaling value in the offer of cipher suites instead of a cipher, the
+// client accepts the tokens of TKSZ_LONG. the old servers ignore it.
+const SCSV_LONG_TOKENS byte = 0x7f
+
+// the versions of protocol, the client signals the highest one it speaks in
+// the offer by SCSV_PROTOCOL+version, and the server answers the selected one
+// after the suite. so the server serves the clients of any version in
+// [MinProtocol, PROTOCOL_MAX] at the same time, and the changes of frames or
+// ciphers could be gated by the version of session.
+const (
+	PROTOCOL_V1  = 1 // the old clients without the signal
+	PROTOCOL_V2  = 2 // the version negotiated
+	PROTOCOL_MAX = PROTOCOL_V2
+	// the signals of versions up to 14 are reserved below SCSV_LONG_TOKENS
+	SCSV_PROTOCOL byte = 0x70
+)
+
+// the optional subsystems, exchanged by the peers of PROTOCOL_V2 after the
+// identity, then both enable the shared ones only. the peers of V1 are
+// assumed capable by the configuration as before.
+const (
+	CAP_UDP_RELAY uint32 = 1 << iota
+	CAP_MULTIPATH
+	CAP_ROAMING
+	CAP_REKEY
+	CAP_TICKET // the ticket follows the tokens
+	// windows and pausing of streams
+	CAP_FLOW_CONTROL
+	// the records of stream ciphers are authenticated
+	CAP_FRAME_MAC
+	// the tunnels are drained in closing
+	CAP_GOAWAY
+)
+
+func isSignalSuite(suite byte) bool {
+	return suite >= SCSV_PROTOCOL && suite <= SCSV_LONG_TOKENS
+}
+
+// the version signaled in the offer, or V1 of the old clients
+func protocolOfOffer(offer []byte) int {
+	var version = PROTOCOL_V1
+	for _, b := range offer {
+		if b > SCSV_PROTOCOL && b < SCSV_LONG_TOKENS && int(b-SCSV_PROTOCOL) > version {
+			version = int(b - SCSV_PROTOCOL)
+		}
+	}
+	return version
+}
+
 const (
 	GENERAL_SO_TIMEOUT = 10 * time.Second
 
@@ -39,6 +101,7 @@ const (
 
 const (
 	EFB_CODE_PRE_AUTH byte = 1
+	EFB_CODE_BUSY     byte = 2
 )
 
 const (
@@ -63,6 +126,7 @@ var (
 	ERR_PRE_AUTH_UNKNOWN = exception.New("Pre-auth failed")
 	ERR_PRE_AUTH         = exception.New(EMSG_PRE_AUTH)
 	ERR_HIDDEN_EFB       = exception.New(EMSG_HIDDEN_EFB)
+	ERR_SERVER_BUSY      = exception.New("Server is busy")
 	ABORTED_ERROR        = exception.New("")
 )
 
@@ -92,22 +156,50 @@ type tunParams struct {
 	token         []byte
 	pingInterval  int
 	parallels     int
+	tokenSize     int
+	protocol      int           // of the session
+	caps          uint32        // shared by both
+	tokenTTL      time.Duration // the unused tokens expire, never if 0
+	maxStreams    int           // open streams of session, unlimited if 0
+	ticket        []byte        // of the session, if issued
 }
 
 // write to buf
 // for server
+// pingInterval~2 | parallels~2 | tokenSize~1 | caps~4 | tokenTTL~4 | maxStreams~2
+// the ttl is in seconds and 0 for never. the fields were appended by the
+// versions in turn and sent in the message of length, the old clients read
+// the leading ones they know and ignore the rest.
 func (p *tunParams) serialize() []byte {
-	var buf = make([]byte, 4)
+	var buf = make([]byte, 15)
 	binary.BigEndian.PutUint16(buf, uint16(p.pingInterval))
 	binary.BigEndian.PutUint16(buf[2:], uint16(p.parallels))
+	buf[4] = byte(p.tokenSize)
+	binary.BigEndian.PutUint32(buf[5:], p.caps)
+	binary.BigEndian.PutUint32(buf[9:], uint32(p.tokenTTL/time.Second))
+	binary.BigEndian.PutUint16(buf[13:], uint16(p.maxStreams))
 	return buf
 }
 
 // read from raw buf
-// for client
+// for client, the old servers send no token size, capabilities, ttl or
+// the cap of streams
 func (p *tunParams) deserialize(buf []byte) {
 	p.pingInterval = int(binary.BigEndian.Uint16(buf))
 	p.parallels = int(binary.BigEndian.Uint16(buf[2:]))
+	p.tokenSize = TKSZ
+	if len(buf) > 4 {
+		p.tokenSize = int(buf[4])
+	}
+	if len(buf) > 8 {
+		p.caps = binary.BigEndian.Uint32(buf[5:])
+	}
+	if len(buf) > 12 {
+		p.tokenTTL = time.Duration(binary.BigEndian.Uint32(buf[9:])) * time.Second
+	}
+	if len(buf) > 14 {
+		p.maxStreams = int(binary.BigEndian.Uint16(buf[13:]))
+	}
 }
 
 func compareVersion(buf []byte) error {
@@ -128,23 +220,41 @@ func compareVersion(buf []byte) error {
 }
 
 const (
-	DH_METHOD = "ECC-P256"
+	DH_METHOD        = "X25519"
+	DH_LEGACY_METHOD = "ECC-P256"
+	DH_HYBRID_METHOD = crypto.DH_HYBRID
 )
 
+// the type of dbcHello flags the version of key exchange, the server accepts
+// both in the migration window of clients.
+func dhMethodOf(stype byte) string {
+	switch stype {
+	case TYPE_NEWX:
+		return DH_METHOD
+	case TYPE_NEWQ:
+		return DH_HYBRID_METHOD
+	}
+	return DH_LEGACY_METHOD
+}
+
 //
 // d5 client handshake protocol
 //
 type d5cman struct {
 	*connectionInfo
-	dhKey    crypto.DHKE
-	dbcHello []byte
-	sRand    []byte
+	dhKey       crypto.DHKE
+	dbcHello    []byte
+	sRand       []byte
+	offer       []byte // cipher suites
+	protocol    int    // selected by server
+	correlation string // id of the session
+	tentative   bool   // not terminate on the fatal errors, eg. migration
 }
 
 func (n *d5cman) Connect(p *tunParams) (conn *Conn, err error) {
 	var rawConn net.Conn
 	defer func() {
-		n.dbcHello, n.sRand = nil, nil
+		n.dbcHello, n.sRand, n.offer = nil, nil, nil
 		if exception.Catch(recover(), &err) {
 			SafeClose(rawConn)
 			if t, y := err.(*exception.Exception); y {
@@ -159,7 +269,7 @@ func (n *d5cman) Connect(p *tunParams) (conn *Conn, err error) {
 				case INCOMPATIBLE_VERSION:
 					exitCode = 3
 				}
-				if exitCode > 0 {
+				if exitCode > 0 && !n.tentative {
 					line := string(bytes.Repeat([]byte{'+'}, 30))
 					log.Warningln(line)
 					log.Warningln(err)
@@ -169,8 +279,8 @@ func (n *d5cman) Connect(p *tunParams) (conn *Conn, err error) {
 			}
 		}
 	}()
-	rawConn, err = net.DialTimeout("tcp", n.sAddr, GENERAL_SO_TIMEOUT)
-	n.dhKey, _ = crypto.NewDHKey(DH_METHOD)
+	rawConn, err = n.dial()
+	n.dhKey, _ = crypto.NewDHKey(dhMethodOf(n.helloType()))
 	if err != nil {
 		return
 	}
@@ -197,13 +307,17 @@ func (n *d5cman) Connect(p *tunParams) (conn *Conn, err error) {
 
 func (n *d5cman) ResumeSession(p *tunParams, token []byte) (conn *Conn, err error) {
 	var rawConn net.Conn
-	rawConn, err = net.DialTimeout("tcp", n.sAddr, GENERAL_SO_TIMEOUT)
+	rawConn, err = n.dial()
 	if err != nil {
 		exception.Spawn(&err, "resume: connnecting")
 		return
 	}
 	conn = NewConn(rawConn, nullCipherKit)
-	obf := makeDbcHello(TYPE_RES, preSharedKey(n.sPubKey))
+	var stype = TYPE_RES
+	if len(token) == TKSZ_LONG {
+		stype = TYPE_RESL
+	}
+	obf := makeDbcHello(stype, preSharedKey(n.sPubKey))
 	w := newMsgWriter()
 	w.WriteMsg(obf)
 	w.WriteMsg(token)
@@ -214,16 +328,53 @@ func (n *d5cman) ResumeSession(p *tunParams, token []byte) (conn *Conn, err erro
 		return
 	}
 
-	conn.SetupCipher(p.cipherFactory, token)
+	if err = conn.SetupCipher(p.cipherFactory, token); err != nil {
+		SafeClose(rawConn)
+		return nil, err
+	}
+	conn.SetId(n.provider, false)
+	return conn, nil
+}
+
+// revive the session destroyed by server in a single round trip
+// dbcHello | ticketLen~2 | ticket~? | randLen~1 | rand~?
+// then the settings are read from the resumed tun, as the negotiation.
+func (n *d5cman) ResumeTicket(p *tunParams, ticket []byte) (conn *Conn, err error) {
+	var rawConn net.Conn
+	rawConn, err = n.dial()
+	if err != nil {
+		exception.Spawn(&err, "ticket: connecting")
+		return
+	}
+	conn = NewConn(rawConn, nullCipherKit)
+	var random = randArray(TICKET_RAND_LEN)
+	w := newMsgWriter()
+	w.WriteMsg(makeDbcHello(TYPE_TKT, preSharedKey(n.sPubKey)))
+	w.WriteL2Msg(ticket)
+	w.WriteL1Msg(random)
+
+	setWTimeout(conn)
+	if err = w.WriteTo(conn); err == nil {
+		err = conn.SetupCipher(p.cipherFactory, random)
+	}
+	if err == nil {
+		n.protocol = p.protocol
+		err = n.readSettings(conn, p)
+	}
+	if err != nil {
+		SafeClose(rawConn)
+		return nil, exception.Spawn(&err, "ticket: resume")
+	}
 	conn.SetId(n.provider, false)
 	return conn, nil
 }
 
-// 1-send dbcHello,dhPub
-// dbcHello~256 | dhPubLen~2 | dhPub~?
+// 1-send dbcHello,dhPub,suites
+// dbcHello~256 | dhPubLen~2 | dhPub~? | suitesLen~1 | suites~?
+// the suites are omitted in the legacy format of LegacyDH
 func (n *d5cman) requestDHExchange(conn *Conn) (err error) {
 	// obfuscated header
-	obf := makeDbcHello(TYPE_NEW, preSharedKey(n.sPubKey))
+	obf := makeDbcHello(n.helloType(), preSharedKey(n.sPubKey))
 	w := newMsgWriter().WriteMsg(obf)
 	if len(obf) > DPH_P2 {
 		n.dbcHello = obf[DPH_P2:]
@@ -235,17 +386,33 @@ func (n *d5cman) requestDHExchange(conn *Conn) (err error) {
 	pub := n.dhKey.ExportPubKey()
 	w.WriteL2Msg(pub)
 
+	if !n.legacyDH {
+		n.offer = append(offerCipherSuites(n.cipher, n.allowPlaintext), SCSV_LONG_TOKENS, SCSV_PROTOCOL+PROTOCOL_MAX)
+		w.WriteL1Msg(n.offer)
+	}
+
 	setWTimeout(conn)
 	err = w.WriteTo(conn)
 	exception.Spawn(&err, "dh: write connection")
 	return
 }
 
+// the servers of old version know the legacy DH only
+func (n *d5cman) helloType() byte {
+	switch {
+	case n.legacyDH:
+		return TYPE_NEW
+	case n.postQuantum:
+		return TYPE_NEWQ
+	}
+	return TYPE_NEWX
+}
+
 // read dhPub from server and verify sign
-// dhPubLen~1 | dhPub~? | signLen~1 | sign~? | rand
+// dhPubLen~1 | dhPub~? | [kemCtLen~2 | kemCt~?] | signLen~1 | sign~? | rand | suite
 func (n *d5cman) finishDHExchange(conn *Conn) (cf *CipherFactory, err error) {
 	var dhk, dhkSign []byte
-	// recv: rhPub~2+256 or ecdhPub~2+32
+	// recv: ecdhPub~1+65 or x25519Pub~1+32
 	setRTimeout(conn)
 	dhk, err = ReadFullByLen(1, conn)
 	if err != nil {
@@ -255,6 +422,8 @@ func (n *d5cman) finishDHExchange(conn *Conn) (cf *CipherFactory, err error) {
 			switch code {
 			case EFB_CODE_PRE_AUTH:
 				err = ERR_PRE_AUTH.Apply("Remote Time " + rTime)
+			case EFB_CODE_BUSY:
+				err = ERR_SERVER_BUSY
 			default:
 				err = ERR_PRE_AUTH_UNKNOWN.Apply("Remote Time " + rTime)
 			}
@@ -268,6 +437,17 @@ func (n *d5cman) finishDHExchange(conn *Conn) (cf *CipherFactory, err error) {
 		}
 		return
 	}
+	// the ciphertext of hybrid KEM is out of the error feedback
+	if n.helloType() == TYPE_NEWQ {
+		var ct []byte
+		setRTimeout(conn)
+		ct, err = ReadFullByLen(2, conn)
+		if err != nil {
+			exception.Spawn(&err, "dh: read kem")
+			return
+		}
+		dhk = append(dhk, ct...)
+	}
 
 	setRTimeout(conn)
 	dhkSign, err = ReadFullByLen(1, conn)
@@ -293,12 +473,47 @@ func (n *d5cman) finishDHExchange(conn *Conn) (cf *CipherFactory, err error) {
 		return
 	}
 
-	// setup cipher
-	cf = NewCipherFactory(n.cipher, key, n.dbcHello)
-	conn.SetupCipher(cf, n.sRand)
+	var name, suite = legacyCipherSuite(n.cipher), []byte(nil)
+	n.protocol = PROTOCOL_V1
+	// the servers of old version select no suite
+	if !n.legacyDH {
+		suite, err = ReadFullByLen(1, conn)
+		if err != nil {
+			exception.Spawn(&err, "suite: read connection")
+			return
+		}
+		// suite~1 | [version~1] of the servers know the protocol versions
+		switch {
+		case len(suite) == 2 && suite[1] >= PROTOCOL_V2 && suite[1] <= PROTOCOL_MAX:
+			n.protocol = int(suite[1])
+		case len(suite) != 1:
+			return nil, VALIDATION_FAILED
+		}
+		name, err = cipherOfSuite(suite[0], n.offer)
+		if err != nil {
+			return
+		}
+	}
+	if name == CIPHER_NULL {
+		log.Warningln("*** The server selected NULL cipher, the tunnels are in PLAINTEXT ***")
+	}
+
+	cf = NewCipherFactory(name, transcriptOf(key, n.dbcHello, n.offer, suite, n.protocol)...)
+	err = conn.SetupCipher(cf, n.sRand)
 	return
 }
 
+// the secrets of keys. the offer of client was bound against stripping the
+// suites, and since v2 the selection of server (suite | version) is bound
+// too, so neither side could be downgraded without failing the handshake.
+func transcriptOf(key, hello, offer, selection []byte, protocol int) [][]byte {
+	var secrets = [][]byte{key, hello, offer}
+	if protocol >= PROTOCOL_V2 {
+		secrets = append(secrets, selection)
+	}
+	return secrets
+}
+
 // verify encrypted message
 // hashHello, version
 func (n *d5cman) validate(conn *Conn) error {
@@ -333,16 +548,23 @@ func (n *d5cman) authThenFinishSetting(conn *Conn, t *tunParams) error {
 	w.WriteL1Msg(hash256(n.sRand))
 	// identity
 	w.WriteL1Msg(n.serializeIdentity())
+	if n.protocol >= PROTOCOL_V2 {
+		w.WriteL1Msg(ito4b(n.capabilities()))
+	}
 
 	setWTimeout(conn)
 	err = w.WriteTo(conn)
 	if err != nil {
 		return exception.Spawn(&err, "auth: write connection")
 	}
+	return n.readSettings(conn, t)
+}
 
+// auth result, params, tokens and the ticket if capable
+func (n *d5cman) readSettings(conn *Conn, t *tunParams) error {
 	setRTimeout(conn)
 	var buf, params []byte
-	buf, err = ReadFullByLen(1, conn)
+	buf, err := ReadFullByLen(1, conn)
 	if err != nil {
 		return exception.Spawn(&err, "auth: read connection")
 	}
@@ -359,16 +581,26 @@ func (n *d5cman) authThenFinishSetting(conn *Conn, t *tunParams) error {
 		return exception.Spawn(&err, "param: read connection")
 	}
 	t.deserialize(params)
+	t.protocol = n.protocol
 
 	t.token, err = ReadFullByLen(2, conn)
 	if err != nil {
 		return exception.Spawn(&err, "token: read connection")
 	}
-	if len(t.token) < TKSZ || len(t.token)%TKSZ != 0 {
+	if t.tokenSize != TKSZ && t.tokenSize != TKSZ_LONG {
+		return ILLEGAL_STATE.Apply("incorrect token size")
+	}
+	if len(t.token) < t.tokenSize || len(t.token)%t.tokenSize != 0 {
 		return ILLEGAL_STATE.Apply("incorrect token")
 	}
+	if t.protocol >= PROTOCOL_V2 && t.caps&CAP_TICKET != 0 {
+		t.ticket, err = ReadFullByLen(2, conn)
+		if err != nil {
+			return exception.Spawn(&err, "ticket: read connection")
+		}
+	}
 	if log.V(log.LV_TOKEN) {
-		log.Infof("Received tokens size=%d\n", len(t.token)/TKSZ)
+		log.Infof("Received tokens=%d size=%d\n", len(t.token)/t.tokenSize, t.tokenSize)
 	}
 
 	return nil
@@ -381,12 +613,28 @@ type d5sman struct {
 	*Server
 	dbcHello     []byte
 	sRand        []byte
+	offer        []byte // cipher suites of client
+	cipher       string // the selected suite
+	protocol     int    // the selected version
+	dhMethod     string // by the version of client
 	clientAddr   net.Addr
 	isNewSession bool
+	stage        int         // of negotiation
+	unwatch      func() bool // stop the half-open deadline
 }
 
 // external conn lifecycle
 func (n *d5sman) Connect(conn *Conn, tcPool []uint64) (session *Session, err error) {
+	session, err = n.negotiate(conn, tcPool)
+	// the busy rejections were counted by guards
+	if err != nil && err != ERR_SERVER_BUSY {
+		n.handshakes.fail(n.stage)
+	}
+	return
+}
+
+func (n *d5sman) negotiate(conn *Conn, tcPool []uint64) (session *Session, err error) {
+	n.stage = STAGE_PRE_AUTH
 	var (
 		nr  int
 		buf = make([]byte, DPH_P2)
@@ -394,11 +642,15 @@ func (n *d5sman) Connect(conn *Conn, tcPool []uint64) (session *Session, err err
 
 	setRTimeout(conn)
 	nr, err = conn.Read(buf)
+	consumed := buf[:nr]
 
 	if nr == len(buf) {
 
 		nr = 0 // reset nr
-		ok, stype, len2 := verifyDbcHello(buf, n.sharedKey, tcPool)
+		index, stype, len2 := matchDbcHello(buf, n.sharedKey, tcPool)
+		ok := index >= 0 && n.skew.check(index, n.clientAddr)
+		replayed := ok && n.replays.seen(buf[DPH_LEN1:DPH_P2], n.clientAddr)
+		ok = ok && !replayed
 
 		if ok {
 			if len2 > 0 {
@@ -410,15 +662,44 @@ func (n *d5sman) Connect(conn *Conn, tcPool []uint64) (session *Session, err err
 			}
 
 			if nr == int(len2) && err == nil {
+				if n.admits != nil {
+					var priority = PRIORITY_NEW
+					if stype == TYPE_RES || stype == TYPE_RESL || stype == TYPE_TKT {
+						priority = PRIORITY_RESUME
+					}
+					if !n.admits.acquire(priority, ADMIT_QUEUE_WAIT) {
+						sendErrorFeedback(conn, EFB_CODE_BUSY)
+						if log.V(log.LV_WARN) {
+							log.Warningf("Rejected negotiation at capacity from=%s", n.clientAddr)
+						}
+						return nil, ERR_SERVER_BUSY
+					}
+					defer n.admits.release()
+				}
 				switch stype {
-				case TYPE_NEW:
+				case TYPE_NEW, TYPE_NEWX, TYPE_NEWQ:
+					n.dhMethod = dhMethodOf(stype)
+					if n.storm != nil && !n.storm.admit(time.Now()) {
+						// retryable, client will come back later
+						sendErrorFeedback(conn, EFB_CODE_BUSY)
+						if log.V(log.LV_WARN) {
+							log.Warningf("Deferred negotiation in storm from=%s", n.clientAddr)
+						}
+						return nil, ERR_SERVER_BUSY
+					}
 					return n.fullHandshake(conn)
 				case TYPE_RES:
-					return n.resumeSession(conn)
+					return n.resumeSession(conn, TKSZ)
+				case TYPE_RESL:
+					return n.resumeSession(conn, TKSZ_LONG)
+				case TYPE_TKT:
+					if n.tickets != nil {
+						return n.resumeTicket(conn)
+					}
 				}
 			}
 
-		} else if n.errFeedback { // can give error feedback
+		} else if n.errFeedback && !replayed { // can give error feedback
 			sendErrorFeedback(conn, EFB_CODE_PRE_AUTH)
 			log.Warningf("Failed to pre-auth client from=%s", n.clientAddr)
 			return nil, UNRECOGNIZED_REQ
@@ -429,6 +710,15 @@ func (n *d5sman) Connect(conn *Conn, tcPool []uint64) (session *Session, err err
 	// threats OR overlarge time error
 	// We could use this log to block threats origin by external tools such as fail2ban.
 	log.Warningf("Unrecognized Request from=%s len=%d\n", n.clientAddr, nr)
+	// the decoy and tarpit are bounded by themselves, not by the deadline
+	if n.unwatch != nil && (n.decoy != nil || n.tarpit != nil) {
+		n.unwatch()
+	}
+	// the buf was reused by the recognized hello, which is not a prober
+	decoyed := n.decoy != nil && n.dbcHello == nil && n.decoy.serve(conn.Conn, consumed)
+	if !decoyed && n.tarpit != nil {
+		n.tarpit.trap(conn.Conn)
+	}
 	return nil, nvl(err, UNRECOGNIZED_REQ).(error)
 }
 
@@ -439,47 +729,126 @@ func (n *d5sman) fullHandshake(conn *Conn) (session *Session, err error) {
 			if t, y := err.(*exception.Exception); y && t.Origin == ABORTED_ERROR {
 				log.Warningf("Handshake aborted by client from=%s", n.clientAddr)
 			} else {
-				log.Warningf("Handshake error=%v from=%s", err, n.clientAddr)
+				log.Warningf("Handshake error=%v stage=%s from=%s", err, stageNames[n.stage], n.clientAddr)
 			}
 		}
 	}()
 	var cf *CipherFactory
 	n.isNewSession = true
+	n.stage = STAGE_DH
 	cf, err = n.finishDHExchange(conn)
 	if err != nil {
 		return
 	}
 	session = n.NewSession(cf)
+	session.tokenSize, session.protocol = n.tokenSize(), n.protocol
 	err = n.authenticate(conn, session)
 	return
 }
 
+// the long tokens for the clients signaled in offer only
+func (n *d5sman) tokenSize() int {
+	if n.TokenSize == TKSZ_LONG && bytes.IndexByte(n.offer, SCSV_LONG_TOKENS) >= 0 {
+		return TKSZ_LONG
+	}
+	return TKSZ
+}
+
 // quick resume session
-func (n *d5sman) resumeSession(conn *Conn) (session *Session, err error) {
-	token := make([]byte, TKSZ)
+func (n *d5sman) resumeSession(conn *Conn, size int) (session *Session, err error) {
+	n.stage = STAGE_RESUME
+	token := make([]byte, size)
 	setRTimeout(conn)
 	// just read once
 	nr, err := conn.Read(token)
 	if nr == len(token) && err == nil {
 		// check token ok
-		if session := n.sessionMgr.take(token); session != nil {
+		client, _, _ := net.SplitHostPort(n.clientAddr.String())
+		session, err = n.sessionMgr.take(token, client)
+		if session != nil {
 			// reuse cipherFactory to init cipher
-			conn.SetupCipher(session.cipherFactory, token)
+			if err = conn.SetupCipher(session.cipherFactory, token); err != nil {
+				log.Warningf("Failed to resume session of %s from=%s %v", session.cid, n.clientAddr, err)
+				return nil, err
+			}
 			// identify connection
 			conn.SetId(session.uid, true)
 			return session, nil
 		}
+		if t, y := err.(*exception.Exception); y && t.Origin == TOKEN_REPLAYED {
+			// security signal: the token was leaked or the traffic was replayed
+			log.Warningf("Double-spend of token from=%s %v", n.clientAddr, err)
+			return nil, err
+		}
+		if t, y := err.(*exception.Exception); y && t.Origin == TOKEN_MISBOUND {
+			log.Warningf("Token of other client from=%s %v", n.clientAddr, err)
+			return nil, err
+		}
 	}
 	log.Warningln("Incorrect token from", n.clientAddr, nvl(err, NULL))
 	return nil, VALIDATION_FAILED
 }
 
+// revive the session of ticket
+func (n *d5sman) resumeTicket(conn *Conn) (session *Session, err error) {
+	n.stage = STAGE_RESUME
+	var sealed, random []byte
+	setRTimeout(conn)
+	if sealed, err = ReadFullByLen(2, conn); err == nil {
+		random, err = ReadFullByLen(1, conn)
+	}
+	if err != nil {
+		return nil, exception.Spawn(&err, "ticket: read connection")
+	}
+	ticket, err := n.tickets.open(sealed)
+	if err == nil && len(random) != TICKET_RAND_LEN {
+		err = TICKET_INVALID.Apply("incorrect random")
+	}
+	if err != nil {
+		log.Warningf("Incorrect ticket from=%s %v", n.clientAddr, err)
+		return nil, VALIDATION_FAILED
+	}
+	var tag = ticket.User + "@" + ticket.Client
+	client, _, _ := net.SplitHostPort(n.clientAddr.String())
+	if n.BindTokens != NULL && !sameOrigin(ticket.origin(), client, n.BindTokens) {
+		log.Warningf("Ticket of other client from=%s %s", n.clientAddr, tag)
+		return nil, TOKEN_MISBOUND.Apply(tag)
+	}
+	u, _ := n.AuthSys.UserInfo(ticket.User)
+	if u == nil {
+		log.Warningf("Ticket of unknown user from=%s %s", n.clientAddr, tag)
+		return nil, VALIDATION_FAILED
+	}
+	if session, err = n.reviveSession(&ticket.persistedSession, u); err != nil {
+		log.Warningf("Failed to revive session of %s from=%s %v", tag, n.clientAddr, err)
+		return nil, err
+	}
+	if err = conn.SetupCipher(session.cipherFactory, random); err != nil {
+		return
+	}
+	session.indentifySession(ticket.User, conn)
+	n.isNewSession = true
+	n.stage = STAGE_TOKEN
+	n.sessionMgr.register(session)
+	if log.V(log.LV_LOGIN) {
+		log.Infof("Resumed the session of %s by ticket%s", tag, correlationTag(session.correlation))
+	}
+	w := newMsgWriter()
+	w.WriteL1Msg([]byte{AUTH_PASS})
+	n.writeSettings(w, session)
+	setWTimeout(conn)
+	err = w.WriteTo(conn)
+	return session, exception.Spawn(&err, "setting: write connection")
+}
+
 // finish DHE
-// 1, dhPub, dhSign, rand
+// 1, dhPub, dhSign, rand, suite
 // 2, hashHello, version
+// the clients of legacy DH speak the format of old version, which offer no
+// suites and expect the first accepted one without the selection.
 func (n *d5sman) finishDHExchange(conn *Conn) (cf *CipherFactory, err error) {
 	var dhPub, key []byte
-	dhKey, _ := crypto.NewDHKey(DH_METHOD)
+	dhKey, _ := crypto.NewDHResponder(n.dhMethod)
 
 	setRTimeout(conn)
 	dhPub, err = ReadFullByLen(2, conn)
@@ -487,16 +856,56 @@ func (n *d5sman) finishDHExchange(conn *Conn) (cf *CipherFactory, err error) {
 		exception.Spawn(&err, "dh: read connection")
 		return
 	}
+	var legacy = n.dhMethod == DH_LEGACY_METHOD
+	if !legacy {
+		n.offer, err = ReadFullByLen(1, conn)
+		if err != nil {
+			exception.Spawn(&err, "suite: read connection")
+			return
+		}
+	}
+	if n.protocol = minInt(protocolOfOffer(n.offer), PROTOCOL_MAX); n.protocol < n.MinProtocol {
+		log.Warningf("Refused the client of protocol v%d from=%s", n.protocol, n.clientAddr)
+		return nil, INCOMPATIBLE_VERSION.Apply(n.protocol)
+	}
+	if legacy {
+		n.cipher = legacyCipherSuite(n.Cipher)
+	} else if n.cipher, err = selectCipherSuite(n.offer, n.Cipher, n.allowPlaintext); err != nil {
+		// the strongest one of both
+		return nil, CIPHER_NOT_READY.Apply(err)
+	}
+
+	// the responder of KEM answers after computing
+	key, err = dhKey.ComputeKey(dhPub)
+	if err != nil {
+		exception.Spawn(&err, "dh: compute")
+		return
+	}
 
 	w := newMsgWriter()
 	myDhPub := dhKey.ExportPubKey()
-	w.WriteL1Msg(myDhPub)
+	if n.dhMethod == DH_HYBRID_METHOD {
+		w.WriteL1Msg(myDhPub[:crypto.X25519_SIZE])
+		w.WriteL2Msg(myDhPub[crypto.X25519_SIZE:])
+	} else {
+		w.WriteL1Msg(myDhPub)
+	}
 
 	myDhSign := DSASign(n.privateKey, myDhPub)
 	w.WriteL1Msg(myDhSign)
 
 	n.sRand = randMinArray()
 	w.WriteL1Msg(n.sRand)
+	// the old clients read the suite only
+	var selection []byte
+	if !legacy {
+		desc, _ := GetCipher(n.cipher, true)
+		selection = []byte{desc.suite}
+		if n.protocol >= PROTOCOL_V2 {
+			selection = append(selection, byte(n.protocol))
+		}
+		w.WriteL1Msg(selection)
+	}
 
 	setWTimeout(conn)
 	err = w.WriteTo(conn)
@@ -505,16 +914,11 @@ func (n *d5sman) finishDHExchange(conn *Conn) (cf *CipherFactory, err error) {
 		return
 	}
 
-	key, err = dhKey.ComputeKey(dhPub)
+	cf, err = n.setupCipher(conn, key, selection)
 	if err != nil {
-		exception.Spawn(&err, "dh: compute")
 		return
 	}
 
-	// setup cipher
-	cf = NewCipherFactory(n.Cipher, key, n.dbcHello)
-	conn.SetupCipher(cf, n.sRand)
-
 	// encrypted
 	w.WriteL1Msg(hash256(n.dbcHello))
 	w.WriteL1Msg(ito4b(VERSION))
@@ -528,6 +932,17 @@ func (n *d5sman) finishDHExchange(conn *Conn) (cf *CipherFactory, err error) {
 	return
 }
 
+// the cipher of new session derived from the shared key of DHE,
+// while the resumed session reuses its factory with the token as iv.
+func (n *d5sman) setupCipher(conn *Conn, key, selection []byte) (*CipherFactory, error) {
+	n.stage = STAGE_CIPHER
+	if _, err := GetCipher(n.cipher, n.allowPlaintext); err != nil {
+		return nil, CIPHER_NOT_READY.Apply(err)
+	}
+	cf := NewCipherFactory(n.cipher, transcriptOf(key, n.dbcHello, n.offer, selection, n.protocol)...)
+	return cf, conn.SetupCipher(cf, n.sRand)
+}
+
 func (n *d5sman) authenticate(conn *Conn, session *Session) error {
 	var err error
 	setRTimeout(conn)
@@ -548,59 +963,177 @@ func (n *d5sman) authenticate(conn *Conn, session *Session) error {
 	}
 
 	// client identity
+	n.stage = STAGE_IDENTITY
 	setRTimeout(conn)
 	idBuf, err := ReadFullByLen(1, conn)
 	if err != nil {
 		return exception.Spawn(&err, "auth: read connection")
 	}
 
-	user, passwd, err := n.deserializeIdentity(idBuf)
+	user, passwd, label, cor, err := n.deserializeIdentity(idBuf)
 	if err != nil {
 		return err
 	}
+	if session.protocol >= PROTOCOL_V2 {
+		setRTimeout(conn)
+		caps, err := ReadFullByLen(1, conn)
+		if err != nil {
+			return exception.Spawn(&err, "caps: read connection")
+		}
+		if len(caps) != 4 {
+			return ILLEGAL_STATE.Apply("incorrect capabilities")
+		}
+		session.applyCapabilities(binary.BigEndian.Uint32(caps) & n.capabilities())
+	}
+	if cor != NULL && !validCorrelationId(cor) {
+		log.Warningf("Ignored invalid correlation id of user %s from=%s\n", user, n.clientAddr)
+		cor = NULL
+	}
+	session.correlation = cor
 
 	if log.V(log.LV_LOGIN) {
-		log.Infoln("Login request:", user)
+		log.Infof("Login request: %s %s%s", user, label, correlationTag(cor))
 	}
 
+	n.stage = STAGE_AUTH
 	pass, err := n.AuthSys.Authenticate(user, passwd)
 	if !pass {
 		// authSys denied
-		log.Warningf("Auth %s:%s failed: %v\n", user, passwd, err)
+		log.Warningf("Auth %s:%s failed: %v%s\n", user, passwd, err, correlationTag(cor))
 		// reply failed msg
 		conn.Write([]byte{1, 0})
 		return VALIDATION_FAILED
 	}
 
 	session.indentifySession(user, conn)
+	if u, _ := n.AuthSys.UserInfo(user); u != nil {
+		session.applyUserPolicy(u)
+	}
+	if label != NULL {
+		if rule := n.labels[label]; rule != nil {
+			session.applyLabelRule(label, rule)
+		} else {
+			log.Warningf("Ignored unknown label %q of user %s\n", label, user)
+		}
+	}
+	if n.webhook != nil {
+		session.applyWebhook(n.webhook)
+	}
+	n.stage = STAGE_TOKEN
+	n.sessionMgr.register(session)
 	w := newMsgWriter()
 	w.WriteL1Msg([]byte{AUTH_PASS})
-	w.WriteL2Msg(n.tunParams.serialize())
-	// send tokens
-	num := maxInt(GENERATE_TOKEN_NUM, n.Parallels+2)
-	tokens := n.sessionMgr.createTokens(session, num)
-	w.WriteL2Msg(tokens[1:]) // skip index=0
+	n.writeSettings(w, session)
 
 	setWTimeout(conn)
 	err = w.WriteTo(conn)
 	return exception.Spawn(&err, "setting: write connection")
 }
 
+// params, tokens and the ticket if capable
+func (n *d5sman) writeSettings(w *msgWriter, session *Session) {
+	params := *n.tunParams
+	params.tokenSize, params.caps = session.tokenSize, session.caps
+	w.WriteL2Msg(params.serialize())
+	// send tokens
+	num := maxInt(n.TokenBatch, n.Parallels+2)
+	tokens := n.sessionMgr.createTokens(session, num)
+	w.WriteL2Msg(tokens[1:]) // skip index=0
+	if session.protocol >= PROTOCOL_V2 && session.caps&CAP_TICKET != 0 {
+		// empty if failed or disabled after restored
+		var ticket []byte
+		if n.tickets != nil {
+			var err error
+			if ticket, err = n.tickets.issue(session); err != nil {
+				log.Warningf("Failed to issue ticket to %s@%s %v", session.uid, session.cid, err)
+			}
+		}
+		w.WriteL2Msg(ticket)
+	}
+}
+
+// the subsystems of client enabled, the rekey frames, tickets, windows, MAC
+// and GOAWAY are always understood
+func (n *d5cman) capabilities() uint32 {
+	var caps = CAP_REKEY | CAP_TICKET | CAP_FLOW_CONTROL | CAP_FRAME_MAC | CAP_GOAWAY
+	if n.udpAssociate {
+		caps |= CAP_UDP_RELAY
+	}
+	if len(n.bindAddrs) > 1 {
+		caps |= CAP_MULTIPATH
+	}
+	if n.roaming > 0 {
+		caps |= CAP_ROAMING
+	}
+	return caps
+}
+
+// the subsystems of server, the roaming, UDP relay and multipath must be
+// enabled
+func (n *d5sman) capabilities() uint32 {
+	var caps = CAP_REKEY | CAP_FLOW_CONTROL | CAP_FRAME_MAC | CAP_GOAWAY
+	if n.udpRelay {
+		caps |= CAP_UDP_RELAY
+	}
+	if n.multipath {
+		caps |= CAP_MULTIPATH
+	}
+	if n.roaming > 0 {
+		caps |= CAP_ROAMING
+	}
+	if n.tickets != nil {
+		caps |= CAP_TICKET
+	}
+	return caps
+}
+
 func (n *d5cman) serializeIdentity() []byte {
 	identity := n.user + IDENTITY_SEP + n.pass
+	if n.label != NULL || n.correlate {
+		identity += IDENTITY_SEP + n.label
+	}
+	if n.correlate {
+		identity += IDENTITY_SEP + n.correlation
+	}
 	if len(identity) > 255 {
 		panic("identity too long")
 	}
 	return []byte(identity)
 }
 
-func (n *d5sman) deserializeIdentity(block []byte) (user, pass string, e error) {
-	fields := strings.Split(string(block), IDENTITY_SEP)
-	if len(fields) != 2 {
+// user, pass[, label[, correlation]]
+// strict: the fields must be separated exactly
+// lenient: the whole block is user if the separator is absent
+func (n *d5sman) deserializeIdentity(block []byte) (user, pass, label, cor string, e error) {
+	identity := string(block)
+	if n.lenientIdentity {
+		fields := strings.SplitN(identity, IDENTITY_SEP, 4)
+		user = fields[0]
+		if len(fields) > 1 {
+			pass = fields[1]
+		}
+		if len(fields) > 2 {
+			label = fields[2]
+		}
+		if len(fields) > 3 {
+			cor = fields[3]
+		}
+		return
+	}
+	fields := strings.Split(identity, IDENTITY_SEP)
+	if len(fields) < 2 || len(fields) > 4 {
+		log.Warningf("Malformed identity=%s len=%d separators=%d from=%s\n",
+			redactToken(identity), len(block), len(fields)-1, n.clientAddr)
 		e = ILLEGAL_STATE.Apply("incorrect identity format")
 		return
 	}
 	user, pass = fields[0], fields[1]
+	if len(fields) > 2 {
+		label = fields[2]
+	}
+	if len(fields) > 3 {
+		cor = fields[3]
+	}
 	return
 }
 
@@ -639,25 +1172,9 @@ func extractKeys(b []byte) (pos, sKey int, hKey uint64) {
 
 func calculateTimeCounter(withTimeError bool) (tc []uint64) {
 	if withTimeError {
-		// cur, prev1, next1, prev2, next2...
-		tc = make([]uint64, TIME_ERROR<<1+1)
-	} else {
-		tc = make([]uint64, 1)
-	}
-	var cur, last uint64 = 0, uint64(time.Now().Unix() / TIME_STEP)
-	for i := 0; i < len(tc); i++ {
-		cur += last
-		if i > 0 {
-			if i&1 == 1 {
-				cur -= uint64(i)
-			} else {
-				cur += uint64(i)
-			}
-		}
-		tc[i] = cur
-		last, cur = cur, 0
+		return timeCounters(time.Now(), TIME_ERROR)
 	}
-	return tc
+	return timeCounters(time.Now(), 0)
 }
 
 func makeDbcHello(data byte, secret []byte) []byte {
@@ -676,19 +1193,26 @@ func makeDbcHello(data byte, secret []byte) []byte {
 }
 
 func verifyDbcHello(buf []byte, secret []byte, tc []uint64) (trusted bool, data, len2 byte) {
+	index, data, len2 := matchDbcHello(buf, secret, tc)
+	return index >= 0, data, len2
+}
+
+// return the index of matched time counter, or -1 if untrusted
+func matchDbcHello(buf []byte, secret []byte, tc []uint64) (index int, data, len2 byte) {
 	pos, sKey, hKey := extractKeys(secret)
 	p1 := buf[:DPH_LEN1]
 
 	var sum, cltSum uint64
 	cltSum = binary.BigEndian.Uint64(buf[DPH_LEN1:DPH_P2])
 
-	for i := 0; !trusted && i < len(tc); i++ {
-		sum = siphash.Hash(hKey, tc[i], p1)
-		trusted = cltSum == sum
+	for index = 0; index < len(tc); index++ {
+		if sum = siphash.Hash(hKey, tc[index], p1); cltSum == sum {
+			break
+		}
 	}
 
-	if !trusted {
-		return
+	if index >= len(tc) {
+		return -1, 0, 0
 	}
 
 	z := int(binary.BigEndian.Uint16(buf[pos : pos+2]))
@@ -1,11 +1,17 @@
 package tunnel
 
 import (
+	"bytes"
 	"encoding/binary"
+	"io"
 	"math/rand"
+	"net"
+	"strings"
+	"sync/atomic"
 	"testing"
 	"time"
 
+	"github.com/Lafeng/deblocus/exception"
 	"github.com/dchest/siphash"
 )
 
@@ -116,3 +122,218 @@ func (t *test) Skip(args ...interface{})                  {}
 func (t *test) SkipNow()                                  {}
 func (t *test) Skipf(format string, args ...interface{})  {}
 func (t *test) Skipped() bool                             { return t.TB.Skipped() }
+
+func TestDeserializeIdentity(tt *testing.T) {
+	var (
+		strict  = &d5sman{Server: newTestServer()}
+		lenient = &d5sman{Server: newTestServer()}
+	)
+	lenient.lenientIdentity = true
+	var cases = []struct {
+		identity               string
+		strictOK               bool
+		user, pass, label, cor string // of strict
+		laxUser, laxPass, lax  string // of lenient
+		laxCor                 string
+	}{
+		{"alice\x00secret", true, "alice", "secret", NULL, NULL, "alice", "secret", NULL, NULL},
+		{"alice", false, NULL, NULL, NULL, NULL, "alice", NULL, NULL, NULL},
+		{"alice\x00secret\x00mobile", true, "alice", "secret", "mobile", NULL, "alice", "secret", "mobile", NULL},
+		{"alice\x00secret\x00\x00c0rre1", true, "alice", "secret", NULL, "c0rre1", "alice", "secret", NULL, "c0rre1"},
+		{"alice\x00se\x00cr\x00e\x00t", false, NULL, NULL, NULL, NULL, "alice", "se", "cr", "e\x00t"},
+	}
+	for _, c := range cases {
+		user, pass, label, cor, err := strict.deserializeIdentity([]byte(c.identity))
+		if (err == nil) != c.strictOK || user != c.user || pass != c.pass || label != c.label || cor != c.cor {
+			tt.Errorf("strict %q => %q %q %q %q %v", c.identity, user, pass, label, cor, err)
+		}
+		user, pass, label, cor, err = lenient.deserializeIdentity([]byte(c.identity))
+		if err != nil || user != c.laxUser || pass != c.laxPass || label != c.lax || cor != c.laxCor {
+			tt.Errorf("lenient %q => %q %q %q %q %v", c.identity, user, pass, label, cor, err)
+		}
+	}
+}
+
+func TestCorrelationId(t *testing.T) {
+	var ids = make(map[string]bool)
+	for i := 0; i < 1000; i++ {
+		id := newCorrelationId()
+		if len(id) != 12 || !validCorrelationId(id) || ids[id] {
+			t.Fatalf("bad id %q", id)
+		}
+		ids[id] = true
+	}
+	var (
+		serv = newTestServer()
+		sman = &d5sman{Server: serv}
+		info = &connectionInfo{user: "alice", pass: "secret"}
+		cman = &d5cman{connectionInfo: info, correlation: newCorrelationId()}
+	)
+	// not sent by default
+	if _, _, _, cor, err := sman.deserializeIdentity(cman.serializeIdentity()); cor != NULL || err != nil {
+		t.Errorf("sent cor=%q err=%v", cor, err)
+	}
+	info.correlate = true
+	user, _, label, cor, err := sman.deserializeIdentity(cman.serializeIdentity())
+	if user != "alice" || label != NULL || cor != cman.correlation || err != nil {
+		t.Fatalf("received %q %q %q %v", user, label, cor, err)
+	}
+	// both sides log the same tag
+	clt := &Client{connInfo: info, cor: cman.correlation}
+	ses := newTestSession(serv, "alice")
+	ses.correlation = cor
+	serv.sessionMgr.register(ses)
+	tag := correlationTag(cman.correlation)
+	if tag != " cor="+cman.correlation || correlationTag(ses.correlation) != tag {
+		t.Errorf("unexpected tag %q", tag)
+	}
+	for _, stats := range []string{clt.Stats(), serv.Stats()} {
+		if !strings.Contains(stats, " Cor="+cman.correlation) {
+			t.Errorf("unexpected stats %s", stats)
+		}
+	}
+	if info := ses.disconnectInfo(SESSION_CLOSE_OFFLINE); info.Correlation != cor {
+		t.Errorf("unexpected disconnect info %+v", info)
+	}
+	if validCorrelationId("x\ninjected") {
+		t.Errorf("accepted unsafe id")
+	}
+}
+
+// a pair of loopback tcp connections, the server side is second
+func tcpPair(t *testing.T) (net.Conn, net.Conn) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	c, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := ln.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c, s
+}
+
+func TestCipherSetupOfNegotiation(t *testing.T) {
+	var (
+		key   = randArray(32)
+		msg   = []byte("negotiated")
+		cconn = NewConn(nil, nullCipherKit)
+		sman  = &d5sman{
+			Server:   &Server{serverConf: &serverConf{Cipher: "AES128CTR"}},
+			dbcHello: randArray(64),
+			sRand:    randArray(32),
+			offer:    offerCipherSuites(allSuites, false),
+			cipher:   "AES128CTR",
+		}
+	)
+	c1, c2 := net.Pipe()
+	defer c1.Close()
+	defer c2.Close()
+	sconn := NewConn(c2, nullCipherKit)
+	if sconn.cipherReady() {
+		t.Fatalf("cipher was ready before negotiation")
+	}
+	cf, err := sman.setupCipher(sconn, key, []byte{5})
+	if err != nil || !sconn.cipherReady() {
+		t.Fatalf("cipher was not ready after negotiation err=%v", err)
+	}
+	// the same derivation of client
+	cconn.Conn = c1
+	cconn.SetupCipher(NewCipherFactory("AES128CTR", key, sman.dbcHello, sman.offer), sman.sRand)
+	go cconn.Write(append([]byte(nil), msg...))
+	buf := make([]byte, len(msg))
+	if _, err = io.ReadFull(sconn, buf); err != nil || !bytes.Equal(buf, msg) {
+		t.Errorf("read %q err=%v", buf, err)
+	}
+	cf.Cleanup()
+
+	// invalid cipher is refused instead of panic later
+	for _, name := range []string{"RC4", CIPHER_NULL} {
+		sman.cipher = name
+		sconn = NewConn(c2, nullCipherKit)
+		cf, err = sman.setupCipher(sconn, key, []byte{5})
+		if e, y := err.(*exception.Exception); cf != nil || !y || e.Origin != CIPHER_NOT_READY {
+			t.Errorf("%s: cf=%v err=%v", name, cf, err)
+		}
+		if sconn.cipherReady() {
+			t.Errorf("%s: cipher was ready", name)
+		}
+	}
+}
+
+func TestCipherSetupOfResumption(t *testing.T) {
+	var (
+		serv   = newTestServer()
+		alice  = newTestSession(serv, "alice")
+		orphan = serv.NewSession(nil)
+		tokens = serv.sessionMgr.createTokens(alice, 1)
+		token  = tokens[1 : 1+TKSZ]
+		msg    = []byte("resumed")
+	)
+	orphan.uid, orphan.cid = "orphan", "127.0.0.1"
+	c, s := tcpPair(t)
+	defer c.Close()
+	defer s.Close()
+	sman := &d5sman{Server: serv, clientAddr: c.LocalAddr()}
+	sconn := NewConn(s, nullCipherKit)
+	c.Write(token)
+	if ses, err := sman.resumeSession(sconn, TKSZ); ses != alice || err != nil {
+		t.Fatalf("resume ses=%v err=%v", ses, err)
+	}
+	if !sconn.cipherReady() {
+		t.Fatalf("cipher was not ready after resumption")
+	}
+	cconn := NewConn(c, nullCipherKit)
+	cconn.SetupCipher(alice.cipherFactory, token)
+	cconn.Write(append([]byte(nil), msg...))
+	buf := make([]byte, len(msg))
+	if _, err := io.ReadFull(sconn, buf); err != nil || !bytes.Equal(buf, msg) {
+		t.Errorf("read %q err=%v", buf, err)
+	}
+
+	// the session without cipher is refused cleanly
+	tokens = serv.sessionMgr.createTokens(orphan, 1)
+	c, s = tcpPair(t)
+	defer c.Close()
+	defer s.Close()
+	sconn = NewConn(s, nullCipherKit)
+	c.Write(tokens[1 : 1+TKSZ])
+	ses, err := sman.resumeSession(sconn, TKSZ)
+	if e, y := err.(*exception.Exception); ses != nil || !y || e.Origin != CIPHER_NOT_READY {
+		t.Errorf("resume ses=%v err=%v", ses, err)
+	}
+	if sconn.cipherReady() {
+		t.Errorf("cipher was ready without factory")
+	}
+}
+
+func TestDataTunWithoutCipher(t *testing.T) {
+	var (
+		serv   = newTestServer()
+		ses    = newTestSession(serv, "alice")
+		c1, c2 = net.Pipe()
+		done   = make(chan bool)
+	)
+	defer c2.Close()
+	serv.sessionMgr.register(ses)
+	go func() {
+		ses.DataTunServe(NewConn(c1, nullCipherKit), true)
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("plaintext tun was handed over to mux")
+	}
+	if _, err := c2.Read(make([]byte, 1)); err == nil {
+		t.Errorf("tun was not closed")
+	}
+	if atomic.LoadInt32(&ses.closed) != 1 || ses.activeCnt != 0 {
+		t.Errorf("session was not torn down closed=%d active=%d", ses.closed, ses.activeCnt)
+	}
+}
@@ -0,0 +1,87 @@
+package tunnel
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"sync/atomic"
+	"time"
+
+	log "github.com/Lafeng/deblocus/glog"
+)
+
+const (
+	// concurrent proxied probes
+	DECOY_MAX = 64
+	// lifetime of the proxied probe, exempt from the handshake timeout of
+	// half-open guard.
+	DECOY_TIMEOUT = time.Minute * 2
+)
+
+// --------------------
+// decoy
+// --------------------
+// proxy the connections failed at the first stage of negotiation to an
+// ordinary web server, with the bytes consumed by negotiation replayed first.
+// so the active probers see the pages of that host rather than anything
+// distinctive of deblocus. at capacity or when the decoy is unreachable, the
+// probes are left to the tarpit or closed as before.
+type decoy struct {
+	proxied  int64
+	bypassed int64 // at capacity or unreachable
+	addr     string
+	slots    chan bool
+}
+
+func newDecoy(addr string, capacity int) *decoy {
+	return &decoy{
+		addr:  addr,
+		slots: make(chan bool, capacity),
+	}
+}
+
+// return false if the probe was not proxied
+func (d *decoy) serve(conn net.Conn, consumed []byte) bool {
+	select {
+	case d.slots <- true:
+		defer func() { <-d.slots }()
+	default:
+		atomic.AddInt64(&d.bypassed, 1)
+		return false
+	}
+	target, err := net.DialTimeout("tcp", d.addr, GENERAL_SO_TIMEOUT)
+	if err != nil {
+		atomic.AddInt64(&d.bypassed, 1)
+		if log.V(log.LV_WARN) {
+			log.Warningf("Decoy %s unreachable: %v", d.addr, err)
+		}
+		return false
+	}
+	defer target.Close()
+	atomic.AddInt64(&d.proxied, 1)
+
+	var deadline = time.Now().Add(DECOY_TIMEOUT)
+	conn.SetDeadline(deadline)
+	target.SetDeadline(deadline)
+	if len(consumed) > 0 {
+		if _, err = target.Write(consumed); err != nil {
+			return true
+		}
+	}
+	var done = make(chan bool, 1)
+	go func() {
+		io.Copy(conn, target)
+		// the web server has closed, so does the probe
+		conn.Close()
+		done <- true
+	}()
+	io.Copy(target, conn)
+	closeW(target)
+	<-done
+	return true
+}
+
+func (d *decoy) String() string {
+	return fmt.Sprintf("Decoyed=%d Decoy-bypassed=%d",
+		atomic.LoadInt64(&d.proxied), atomic.LoadInt64(&d.bypassed))
+}
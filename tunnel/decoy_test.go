@@ -0,0 +1,91 @@
+package tunnel
+
+import (
+	"bufio"
+	"io/ioutil"
+	"net"
+	"strings"
+	"testing"
+)
+
+// the web server replies with the request line it received after the header
+func newDecoyServer(t *testing.T) net.Listener {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			r := bufio.NewReader(conn)
+			line, _ := r.ReadString('\n')
+			for l := line; len(l) > 2; {
+				l, _ = r.ReadString('\n')
+			}
+			conn.Write([]byte("HTTP/1.1 200 OK\r\nContent-Length: 0\r\n\r\n" + line))
+			conn.Close()
+		}
+	}()
+	return ln
+}
+
+func TestDecoy(t *testing.T) {
+	ln := newDecoyServer(t)
+	defer ln.Close()
+	var (
+		d              = newDecoy(ln.Addr().String(), 1)
+		client, server = net.Pipe()
+	)
+	go func() {
+		defer server.Close()
+		d.serve(server, []byte("GET /index"))
+	}()
+	client.Write([]byte(".html HTTP/1.1\r\n\r\n"))
+	reply, _ := ioutil.ReadAll(client)
+	if !strings.HasSuffix(string(reply), "GET /index.html HTTP/1.1\r\n") {
+		t.Errorf("unexpected reply %q", reply)
+	}
+
+	// unreachable
+	d = newDecoy(ln.Addr().String(), 1)
+	ln.Close()
+	if d.serve(server, nil) {
+		t.Errorf("proxied to the unreachable")
+	}
+	if s := d.String(); !strings.Contains(s, "Decoyed=0 Decoy-bypassed=1") {
+		t.Errorf("unexpected stats %s", s)
+	}
+}
+
+// the prober sees the pages of web server rather than the closed connection
+func TestDecoyedHandshake(t *testing.T) {
+	ln := newDecoyServer(t)
+	defer ln.Close()
+	var (
+		serv = newHandshakeServer(t)
+		c, s = tcpPair(t)
+		sman = &d5sman{Server: serv, clientAddr: c.LocalAddr()}
+		done = make(chan error, 1)
+	)
+	serv.decoy = newDecoy(ln.Addr().String(), 1)
+	go func() {
+		_, err := sman.Connect(NewConn(s, nullCipherKit), calculateTimeCounter(true))
+		s.Close()
+		done <- err
+	}()
+	// longer than the first read of negotiation
+	c.Write([]byte("GET / HTTP/1.1\r\nHost: example.com\r\nCookie: " +
+		strings.Repeat("x", DPH_P2) + "\r\n\r\n"))
+	reply, _ := ioutil.ReadAll(c)
+	c.Close()
+	if err := <-done; err != UNRECOGNIZED_REQ {
+		t.Errorf("err=%v", err)
+	}
+	if !strings.HasPrefix(string(reply), "HTTP/1.1 200 OK") ||
+		!strings.HasSuffix(string(reply), "GET / HTTP/1.1\r\n") {
+		t.Errorf("unexpected reply %q", reply)
+	}
+}
@@ -0,0 +1,299 @@
+package tunnel
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"math"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// length of hex prefix of the hashed token
+	TOKEN_HASH_PREFIX = 8
+	// time constant of ewma rate
+	STREAM_RATE_TAU = 5 * time.Second
+	// the fastest streams will be reported
+	STREAM_STATS_MAX = 200
+)
+
+// --------------------
+// token map dump
+// --------------------
+// the redacted view of token map for debugging the orphan tokens.
+// the raw tokens will never be exposed, only the prefix of sha1(token).
+type TokenMapDump struct {
+	Total    int                 `json:"total"`
+	Orphans  int                 `json:"orphans"` // tokens owned by unregistered sessions
+	Users    map[string]int      `json:"users"`   // uid -> tokens
+	Sessions []*TokenSessionDump `json:"sessions"`
+}
+
+type TokenSessionDump struct {
+	User       string   `json:"user"`
+	Client     string   `json:"client"`
+	Registered bool     `json:"registered"`
+	Tokens     int      `json:"tokens"`
+	OldestAge  int64    `json:"oldest_age"` // seconds
+	Hashes     []string `json:"hashes"`
+}
+
+func redactToken(key string) string {
+	sum := sha1.Sum([]byte(key))
+	return hex.EncodeToString(sum[:])[:TOKEN_HASH_PREFIX]
+}
+
+// copy the token map under the read lock, and format it outside.
+func (s *SessionMgr) dumpTokens(now time.Time) *TokenMapDump {
+	type record struct {
+		ses    *Session
+		keys   []tokenKey
+		oldest time.Time
+	}
+	var (
+		records = make(map[*Session]*record)
+		orphans = make(map[*Session]bool)
+		dump    = &TokenMapDump{Users: make(map[string]int)}
+	)
+	for i := range s.shards {
+		shard := &s.shards[i]
+		shard.lock.Lock()
+		dump.Total += len(shard.container)
+		for key, ses := range shard.container {
+			r := records[ses]
+			if r == nil {
+				r = &record{ses: ses}
+				records[ses] = r
+			}
+			r.keys = append(r.keys, key)
+			if t := ses.issuedOf(key); !t.IsZero() && (r.oldest.IsZero() || t.Before(r.oldest)) {
+				r.oldest = t
+			}
+		}
+		shard.lock.Unlock()
+	}
+	s.lock.RLock()
+	for ses := range records {
+		orphans[ses] = !s.sessions[ses]
+	}
+	s.lock.RUnlock()
+
+	for ses, r := range records {
+		d := &TokenSessionDump{
+			User:       ses.uid,
+			Client:     ses.cid,
+			Registered: !orphans[ses],
+			Tokens:     len(r.keys),
+			Hashes:     make([]string, len(r.keys)),
+		}
+		if !r.oldest.IsZero() {
+			d.OldestAge = int64(now.Sub(r.oldest) / time.Second)
+		}
+		for i, key := range r.keys {
+			d.Hashes[i] = redactToken(hex.EncodeToString(key[:ses.tokenSize]))
+		}
+		sort.Strings(d.Hashes)
+		if orphans[ses] {
+			dump.Orphans += d.Tokens
+		}
+		dump.Users[ses.uid] += d.Tokens
+		dump.Sessions = append(dump.Sessions, d)
+	}
+	// the hoarders first
+	sort.Slice(dump.Sessions, func(i, j int) bool {
+		a, b := dump.Sessions[i], dump.Sessions[j]
+		if a.Tokens != b.Tokens {
+			return a.Tokens > b.Tokens
+		}
+		return a.OldestAge > b.OldestAge
+	})
+	return dump
+}
+
+// admin: export the redacted token map as json
+func (t *Server) DumpTokens() ([]byte, error) {
+	return json.MarshalIndent(t.sessionMgr.dumpTokens(time.Now()), NULL, "  ")
+}
+
+// --------------------
+// server stats
+// --------------------
+// the metrics of Stats for the monitoring, the counters are accumulated
+// since the server started except of the sessions left.
+type ServerStats struct {
+	Sessions      int                   `json:"sessions"`
+	Tunnels       int                   `json:"tunnels"`
+	Tokens        int                   `json:"tokens"`   // the pool of unconsumed
+	RxBytes       int64                 `json:"rx_bytes"` // from clients
+	TxBytes       int64                 `json:"tx_bytes"` // to clients
+	Streams       int64                 `json:"streams"`  // opened
+	ActiveStreams int64                 `json:"active_streams"`
+	QueuedFrames  int                   `json:"queued_frames"` // to the destinations
+	Users         map[string]*UserStats `json:"users"`
+	Failures      map[string]int64      `json:"handshake_failures"` // by stage
+}
+
+type UserStats struct {
+	Sessions      int   `json:"sessions"`
+	Tunnels       int   `json:"tunnels"`
+	Tokens        int   `json:"tokens"`
+	RxBytes       int64 `json:"rx_bytes"`
+	TxBytes       int64 `json:"tx_bytes"`
+	Streams       int64 `json:"streams"`
+	ActiveStreams int64 `json:"active_streams"`
+	QueuedFrames  int   `json:"queued_frames"`
+}
+
+func (t *Server) collectStats() *ServerStats {
+	var st = &ServerStats{
+		Tokens:   t.sessionMgr.length(),
+		Users:    make(map[string]*UserStats),
+		Failures: make(map[string]int64),
+	}
+	for _, s := range t.sessionMgr.lookup(NULL) {
+		var (
+			rx, tx, streams = s.mux.traffic()
+			tuns            = int(atomic.LoadInt32(&s.activeCnt))
+			active          = atomic.LoadInt64(&s.mux.active)
+			queued          = s.mux.queuedFrames()
+			user            = st.Users[s.uid]
+		)
+		if user == nil {
+			user = new(UserStats)
+			st.Users[s.uid] = user
+		}
+		st.Sessions++
+		st.Tunnels += tuns
+		st.RxBytes += rx
+		st.TxBytes += tx
+		st.Streams += streams
+		st.ActiveStreams += active
+		st.QueuedFrames += queued
+		user.Sessions++
+		user.Tunnels += tuns
+		user.Tokens += t.sessionMgr.tokenCount(s)
+		user.RxBytes += rx
+		user.TxBytes += tx
+		user.Streams += streams
+		user.ActiveStreams += active
+		user.QueuedFrames += queued
+	}
+	if t.handshakes != nil {
+		for i, name := range stageNames {
+			st.Failures[name] = t.handshakes.failures(i)
+		}
+	}
+	return st
+}
+
+// the summary line then the line of each user in text
+func (st *ServerStats) String() string {
+	buf := new(bytes.Buffer)
+	fmt.Fprintf(buf, "Sessions=%d Tunnels=%d Tokens=%d Rx=%d Tx=%d Streams=%d Active-streams=%d\n",
+		st.Sessions, st.Tunnels, st.Tokens, st.RxBytes, st.TxBytes, st.Streams, st.ActiveStreams)
+	var users = make([]string, 0, len(st.Users))
+	for uid := range st.Users {
+		users = append(users, uid)
+	}
+	sort.Strings(users)
+	for _, uid := range users {
+		u := st.Users[uid]
+		fmt.Fprintf(buf, "User=%s Sessions=%d Conn=%d TK=%d Active-streams=%d\n",
+			uid, u.Sessions, u.Tunnels, u.Tokens, u.ActiveStreams)
+	}
+	return buf.String()
+}
+
+// admin: export the metrics of Stats as json
+func (t *Server) DumpStats() ([]byte, error) {
+	return json.MarshalIndent(t.collectStats(), NULL, "  ")
+}
+
+// --------------------
+// stream stats
+// --------------------
+// the ewma rate is updated on sampling (querying) without any ticker,
+// and weighted by the elapsed time since last sampling.
+type streamMeter struct {
+	lock      sync.Mutex
+	start     time.Time
+	last      time.Time
+	lastBytes int64
+	rate      float64 // bytes per second
+}
+
+func (m *streamMeter) sample(now time.Time, total int64) float64 {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if m.last.IsZero() {
+		m.last = m.start
+	}
+	dt := now.Sub(m.last).Seconds()
+	if dt <= 0 {
+		return m.rate
+	}
+	instant := float64(total-m.lastBytes) / dt
+	alpha := 1 - math.Exp(-dt/STREAM_RATE_TAU.Seconds())
+	m.rate += alpha * (instant - m.rate)
+	m.last, m.lastBytes = now, total
+	return m.rate
+}
+
+type StreamStat struct {
+	User      string  `json:"user"`
+	Client    string  `json:"client"`
+	Dest      string  `json:"dest"`
+	BytesUp   int64   `json:"bytes_up"`   // from client to destination
+	BytesDown int64   `json:"bytes_down"` // from destination to client
+	Rate      float64 `json:"rate"`       // bytes per second of both directions
+	Age       int64   `json:"age"`        // seconds
+}
+
+func (s *Session) streamStats(now time.Time) []*StreamStat {
+	var list []*StreamStat
+	for _, e := range s.mux.edges() {
+		up, down := atomic.LoadInt64(&e.rxBytes), atomic.LoadInt64(&e.txBytes)
+		list = append(list, &StreamStat{
+			User:      s.uid,
+			Client:    s.cid,
+			Dest:      e.dest[2:],
+			BytesUp:   up,
+			BytesDown: down,
+			Rate:      e.meter.sample(now, up+down),
+			Age:       int64(now.Sub(e.meter.start) / time.Second),
+		})
+	}
+	return list
+}
+
+// admin: the fastest streams of sessions matched with uid or cid,
+// output json or text.
+func (t *Server) DumpStreams(target string, asJSON bool) ([]byte, error) {
+	var (
+		now  = time.Now()
+		list []*StreamStat
+	)
+	for _, s := range t.sessionMgr.lookup(target) {
+		list = append(list, s.streamStats(now)...)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].Rate > list[j].Rate
+	})
+	if len(list) > STREAM_STATS_MAX {
+		list = list[:STREAM_STATS_MAX]
+	}
+	if asJSON {
+		return json.MarshalIndent(list, NULL, "  ")
+	}
+	buf := new(bytes.Buffer)
+	for _, st := range list {
+		fmt.Fprintf(buf, "Clt=%s User=%s Dest=%s Up=%d Down=%d Rate=%.1fKB/s Age=%ds\n",
+			st.Client, st.User, st.Dest, st.BytesUp, st.BytesDown, st.Rate/1024, st.Age)
+	}
+	return buf.Bytes(), nil
+}
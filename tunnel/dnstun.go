@@ -0,0 +1,654 @@
+package tunnel
+
+import (
+	"bytes"
+	"encoding/base32"
+	"encoding/binary"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Lafeng/deblocus/exception"
+	log "github.com/Lafeng/deblocus/glog"
+)
+
+const (
+	DNS_TYPE_TXT      = 16
+	DNS_RCODE_REFUSED = 5
+	DNS_NAME_MAX      = 253
+	DNS_LABEL_MAX     = 63
+	// id(4) + seq(2) + flags(1) + nonce(1) in the labels of query
+	DNSTUN_HEADER_LEN = 8
+	// data in the TXT of response, fits the 512 bytes of classic UDP
+	DNSTUN_DOWN_MAX = 180
+	// unsent bytes of the conn, writing is blocked beyond it
+	DNSTUN_BUF_MAX = 64 << 10
+	// the query is retried in timeout, the conn is broken after the retries
+	DNSTUN_RETRY_TIMEOUT = time.Second * 2
+	DNSTUN_RETRIES       = 5
+	// polling interval for the downstream, backs off in idle
+	DNSTUN_POLL_MIN = time.Millisecond * 20
+	DNSTUN_POLL_MAX = time.Second
+	// the server closes the conn without queries in timeout
+	DNSTUN_IDLE_TIMEOUT = time.Minute * 2
+	DNSTUN_CONNS_MAX    = 64
+	// the conns never answered any data are pending, they are cheap to
+	// spoof and limited per resolver, then dropped soon
+	DNSTUN_PENDING_MAX     = 8
+	DNSTUN_PENDING_TIMEOUT = GENERAL_SO_TIMEOUT
+	// the client stays on the fallback before retrying the direct dialing
+	DNSTUN_HOLD = time.Minute * 5
+	// flags
+	DNSTUN_FIN = 1
+)
+
+var (
+	DNSTUN_ERROR   = exception.New("DNS tunnel error")
+	DNSTUN_TIMEOUT = &dnsTimeout{}
+	dnsEncoding    = base32.StdEncoding.WithPadding(base32.NoPadding)
+)
+
+type dnsTimeout struct{}
+
+func (dnsTimeout) Error() string   { return "DNS tunnel read timeout" }
+func (dnsTimeout) Timeout() bool   { return true }
+func (dnsTimeout) Temporary() bool { return true }
+
+// --------------------
+// dnsConn
+// --------------------
+// the extreme fallback of tunnel carried by DNS queries through the
+// recursive resolvers, when the TCP to server was blocked. it keeps the
+// tokens and control traffic alive in low throughput.
+// the client encodes the upstream in the labels of TXT query under the
+// domain delegated to the server:
+//   base32(id seq flags nonce data).domain
+// and the server answers the downstream in TXT: flags data.
+// it's stop-and-wait, the query of seq is retried with another nonce to
+// bypass the caches, and the server answers the retry with the last answer.
+
+// the stream of DNS tunnel as net.Conn
+type dnsConn struct {
+	laddr    net.Addr
+	raddr    net.Addr
+	lock     sync.Mutex
+	cond     *sync.Cond
+	in       []byte // received
+	out      []byte // to send
+	deadline time.Time
+	closed   bool // locally
+	eof      bool // closed by peer
+	kick     chan struct{}
+}
+
+func newDnsConn(laddr, raddr net.Addr) *dnsConn {
+	c := &dnsConn{laddr: laddr, raddr: raddr, kick: make(chan struct{}, 1)}
+	c.cond = sync.NewCond(&c.lock)
+	return c
+}
+
+func (c *dnsConn) Read(b []byte) (int, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	for len(c.in) == 0 {
+		switch {
+		case c.closed:
+			return 0, io.ErrClosedPipe
+		case c.eof:
+			return 0, io.EOF
+		case !c.deadline.IsZero() && !time.Now().Before(c.deadline):
+			return 0, DNSTUN_TIMEOUT
+		}
+		c.cond.Wait()
+	}
+	n := copy(b, c.in)
+	c.in = c.in[n:]
+	return n, nil
+}
+
+func (c *dnsConn) Write(b []byte) (int, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	for len(c.out) >= DNSTUN_BUF_MAX && !c.closed && !c.eof {
+		c.cond.Wait()
+	}
+	if c.closed || c.eof {
+		return 0, io.ErrClosedPipe
+	}
+	c.out = append(c.out, b...)
+	select {
+	case c.kick <- struct{}{}:
+	default:
+	}
+	return len(b), nil
+}
+
+// the chunk to send, and whether it's the last
+func (c *dnsConn) take(n int) ([]byte, bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	n = minInt(n, len(c.out))
+	chunk := append([]byte(nil), c.out[:n]...)
+	c.out = c.out[n:]
+	c.cond.Broadcast()
+	return chunk, c.closed && len(c.out) == 0
+}
+
+func (c *dnsConn) feed(b []byte, fin bool) {
+	c.lock.Lock()
+	c.in = append(c.in, b...)
+	c.eof = c.eof || fin
+	c.cond.Broadcast()
+	c.lock.Unlock()
+}
+
+func (c *dnsConn) Close() error {
+	c.lock.Lock()
+	c.closed = true
+	c.cond.Broadcast()
+	c.lock.Unlock()
+	select {
+	case c.kick <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+func (c *dnsConn) LocalAddr() net.Addr  { return c.laddr }
+func (c *dnsConn) RemoteAddr() net.Addr { return c.raddr }
+
+func (c *dnsConn) SetDeadline(t time.Time) error {
+	return c.SetReadDeadline(t)
+}
+
+func (c *dnsConn) SetReadDeadline(t time.Time) error {
+	c.lock.Lock()
+	c.deadline = t
+	c.lock.Unlock()
+	if !t.IsZero() {
+		time.AfterFunc(t.Sub(time.Now()), func() {
+			c.lock.Lock()
+			c.cond.Broadcast()
+			c.lock.Unlock()
+		})
+	}
+	return nil
+}
+
+// the writing is blocked by the buffer, and broken by closing
+func (c *dnsConn) SetWriteDeadline(t time.Time) error {
+	return nil
+}
+
+// the Conn.SetId requires the addresses of TCP
+func tcpAddrOf(addr net.Addr) *net.TCPAddr {
+	if a, y := addr.(*net.UDPAddr); y {
+		return &net.TCPAddr{IP: a.IP, Port: a.Port}
+	}
+	return new(net.TCPAddr)
+}
+
+// payload bytes of query carried in the labels before the domain
+func dnsUpCapacity(domain string) int {
+	room := DNS_NAME_MAX - len(domain) - 1
+	// a dot for each label
+	chars := room - (room+DNS_LABEL_MAX)/(DNS_LABEL_MAX+1)
+	return chars*5/8 - DNSTUN_HEADER_LEN
+}
+
+func packDnsTunName(payload []byte, domain string) string {
+	var (
+		encoded = strings.ToLower(dnsEncoding.EncodeToString(payload))
+		labels  []string
+	)
+	for len(encoded) > DNS_LABEL_MAX {
+		labels = append(labels, encoded[:DNS_LABEL_MAX])
+		encoded = encoded[DNS_LABEL_MAX:]
+	}
+	if len(encoded) > 0 {
+		labels = append(labels, encoded)
+	}
+	return strings.Join(append(labels, domain), ".")
+}
+
+// the payload of name under domain, the case may be randomized by resolvers
+func parseDnsTunName(name, domain string) ([]byte, bool) {
+	name = strings.TrimSuffix(name, ".")
+	if !strings.HasSuffix(strings.ToLower(name), "."+domain) {
+		return nil, false
+	}
+	encoded := strings.Replace(name[:len(name)-len(domain)-1], ".", NULL, -1)
+	payload, err := dnsEncoding.DecodeString(strings.ToUpper(encoded))
+	return payload, err == nil && len(payload) >= DNSTUN_HEADER_LEN
+}
+
+// name and type of the only question, and the end of question
+func parseDNSQuestion(msg []byte) (string, uint16, int, error) {
+	if len(msg) < 12 || binary.BigEndian.Uint16(msg[4:]) != 1 {
+		return NULL, 0, 0, DNSTUN_ERROR.Apply("malformed query")
+	}
+	var labels []string
+	var off = 12
+	for off < len(msg) && msg[off] != 0 {
+		n := int(msg[off])
+		if n > DNS_LABEL_MAX || off+1+n > len(msg) {
+			return NULL, 0, 0, DNSTUN_ERROR.Apply("malformed query")
+		}
+		labels = append(labels, string(msg[off+1:off+1+n]))
+		off += n + 1
+	}
+	if off+5 > len(msg) {
+		return NULL, 0, 0, DNSTUN_ERROR.Apply("malformed query")
+	}
+	qtype := binary.BigEndian.Uint16(msg[off+1:])
+	return strings.Join(labels, "."), qtype, off + 5, nil
+}
+
+// --------------------
+// client
+// --------------------
+type dnsClient struct {
+	conn     *dnsConn
+	udp      *net.UDPConn
+	domain   string
+	id       []byte
+	seq      uint16
+	nonce    byte
+	capacity int
+}
+
+// open the conn by the initial query through the resolver
+func dialDNS(domain, resolver string, timeout time.Duration) (net.Conn, error) {
+	raddr, err := net.ResolveUDPAddr("udp", resolver)
+	if err != nil {
+		return nil, err
+	}
+	udp, err := net.DialUDP("udp", nil, raddr)
+	if err != nil {
+		return nil, err
+	}
+	c := &dnsClient{
+		conn:     newDnsConn(tcpAddrOf(udp.LocalAddr()), tcpAddrOf(raddr)),
+		udp:      udp,
+		domain:   domain,
+		id:       randArray(4),
+		capacity: dnsUpCapacity(domain),
+	}
+	var deadline = time.Now().Add(timeout)
+	for {
+		_, _, err = c.exchange(nil, 0)
+		if err == nil || !IsTimeout(err) || time.Now().After(deadline) {
+			break
+		}
+	}
+	if err != nil {
+		udp.Close()
+		return nil, DNSTUN_ERROR.Apply(err)
+	}
+	c.seq++
+	go c.run()
+	return c.conn, nil
+}
+
+func (c *dnsClient) run() {
+	defer c.udp.Close()
+	var interval = DNSTUN_POLL_MIN
+	for {
+		up, fin := c.conn.take(c.capacity)
+		var flags byte
+		if fin {
+			flags = DNSTUN_FIN
+		}
+		var (
+			down    []byte
+			peerFin bool
+			err     error
+		)
+		for i := 0; i < DNSTUN_RETRIES; i++ {
+			if down, peerFin, err = c.exchange(up, flags); !IsTimeout(err) {
+				break
+			}
+		}
+		if err != nil {
+			if log.V(log.LV_WARN) {
+				log.Warningln("DNS tunnel was broken", err)
+			}
+			c.conn.feed(nil, true)
+			return
+		}
+		c.seq++
+		c.conn.feed(down, peerFin)
+		if fin || peerFin {
+			return
+		}
+		if len(up) > 0 || len(down) > 0 {
+			interval = DNSTUN_POLL_MIN
+			continue
+		}
+		select {
+		case <-c.conn.kick:
+			interval = DNSTUN_POLL_MIN
+		case <-time.After(interval):
+			if interval *= 2; interval > DNSTUN_POLL_MAX {
+				interval = DNSTUN_POLL_MAX
+			}
+		}
+	}
+}
+
+// query with the upstream, return the downstream and fin of server
+func (c *dnsClient) exchange(up []byte, flags byte) ([]byte, bool, error) {
+	c.nonce++
+	var payload = make([]byte, DNSTUN_HEADER_LEN, DNSTUN_HEADER_LEN+len(up))
+	copy(payload, c.id)
+	binary.BigEndian.PutUint16(payload[4:], c.seq)
+	payload[6], payload[7] = flags, c.nonce
+	query, err := packDNSQuery(packDnsTunName(append(payload, up...), c.domain), DNS_TYPE_TXT)
+	if err != nil {
+		return nil, false, err
+	}
+	var qid = uint16(myRand.Int63n(1 << 16))
+	binary.BigEndian.PutUint16(query, qid)
+	if _, err = c.udp.Write(query); err != nil {
+		return nil, false, err
+	}
+	var buf = make([]byte, 1500)
+	c.udp.SetReadDeadline(time.Now().Add(DNSTUN_RETRY_TIMEOUT))
+	for {
+		n, err := c.udp.Read(buf)
+		if err != nil {
+			return nil, false, err
+		}
+		// the late answers of retried queries
+		if n < 12 || binary.BigEndian.Uint16(buf) != qid {
+			continue
+		}
+		txt, err := parseTXTAnswer(buf[:n])
+		if err != nil || len(txt) < 1 {
+			return nil, false, DNSTUN_ERROR.Apply("invalid answer")
+		}
+		return txt[1:], txt[0]&DNSTUN_FIN != 0, nil
+	}
+}
+
+// the strings of TXT answers joined
+func parseTXTAnswer(msg []byte) ([]byte, error) {
+	if len(msg) < 12 {
+		return nil, DNSTUN_ERROR.Apply("malformed answer")
+	}
+	var (
+		rcode   = msg[3] & 0xf
+		ancount = int(binary.BigEndian.Uint16(msg[6:]))
+		txt     []byte
+	)
+	if rcode != 0 {
+		return nil, DNSTUN_ERROR.Apply("rcode=" + strconv.Itoa(int(rcode)))
+	}
+	_, _, off, err := parseDNSQuestion(msg)
+	if err != nil {
+		return nil, err
+	}
+	for i := 0; i < ancount; i++ {
+		if off, err = skipDNSName(msg, off); err != nil {
+			return nil, err
+		}
+		if off+10 > len(msg) {
+			return nil, DNSTUN_ERROR.Apply("malformed answer")
+		}
+		rtype := binary.BigEndian.Uint16(msg[off:])
+		rdlen := int(binary.BigEndian.Uint16(msg[off+8:]))
+		off += 10
+		if off+rdlen > len(msg) {
+			return nil, DNSTUN_ERROR.Apply("malformed answer")
+		}
+		for p := off; rtype == DNS_TYPE_TXT && p < off+rdlen; {
+			n := int(msg[p])
+			if p+1+n > off+rdlen {
+				return nil, DNSTUN_ERROR.Apply("malformed answer")
+			}
+			txt = append(txt, msg[p+1:p+1+n]...)
+			p += n + 1
+		}
+		off += rdlen
+	}
+	return txt, nil
+}
+
+// --------------------
+// fallback of client
+// --------------------
+type dnsFallback struct {
+	domain   string
+	resolver string
+	lock     sync.Mutex
+	until    time.Time // holding the fallback
+}
+
+// dial directly, or by the DNS tunnel if failed
+func (f *dnsFallback) dial(direct func() (net.Conn, error)) (net.Conn, error) {
+	f.lock.Lock()
+	holding := time.Now().Before(f.until)
+	f.lock.Unlock()
+	if !holding {
+		conn, err := direct()
+		if err == nil {
+			return conn, nil
+		}
+		log.Warningf("Failed to connect the server %s Fallback to the DNS tunnel via %s",
+			err, f.resolver)
+	}
+	conn, err := dialDNS(f.domain, f.resolver, GENERAL_SO_TIMEOUT)
+	if err == nil && !holding {
+		f.lock.Lock()
+		f.until = time.Now().Add(DNSTUN_HOLD)
+		f.lock.Unlock()
+	}
+	return conn, err
+}
+
+// --------------------
+// server
+// --------------------
+type dnsTunState struct {
+	conn *dnsConn
+	next uint16 // expected seq
+	last []byte // answer of the last seq for retries
+	seen time.Time
+	born time.Time
+	// the resolver of the first query
+	source string
+	// answered any data, no longer pending
+	proven bool
+}
+
+// answers the queries under domain, the conns are served as tunnels
+type dnsTunnel struct {
+	udp    *net.UDPConn
+	domain string
+	serve  func(net.Conn)
+	lock   sync.Mutex
+	conns  map[string]*dnsTunState
+}
+
+func newDnsTunnel(udp *net.UDPConn, domain string, serve func(net.Conn)) *dnsTunnel {
+	return &dnsTunnel{
+		udp:    udp,
+		domain: strings.ToLower(strings.TrimSuffix(domain, ".")),
+		serve:  serve,
+		conns:  make(map[string]*dnsTunState),
+	}
+}
+
+func (t *dnsTunnel) run() {
+	var buf = make([]byte, 1500)
+	go t.cleanTask()
+	for {
+		n, from, err := t.udp.ReadFromUDP(buf)
+		if err != nil {
+			t.destroy()
+			return
+		}
+		if answer := t.answer(buf[:n], from); answer != nil {
+			t.udp.WriteToUDP(answer, from)
+		}
+	}
+}
+
+func (t *dnsTunnel) answer(query []byte, from *net.UDPAddr) []byte {
+	name, qtype, end, err := parseDNSQuestion(query)
+	if err != nil {
+		return nil
+	}
+	payload, y := parseDnsTunName(name, t.domain)
+	if !y || qtype != DNS_TYPE_TXT {
+		return packDnsAnswer(query[:end], DNS_RCODE_REFUSED, nil)
+	}
+	var (
+		id    = string(payload[:4])
+		seq   = binary.BigEndian.Uint16(payload[4:])
+		flags = payload[6]
+	)
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	st := t.conns[id]
+	if st == nil && seq == 0 && t.admit(from.IP.String()) {
+		st = &dnsTunState{
+			conn:   newDnsConn(tcpAddrOf(t.udp.LocalAddr()), tcpAddrOf(from)),
+			born:   time.Now(),
+			source: from.IP.String(),
+		}
+		t.conns[id] = st
+		go t.serve(st.conn)
+	}
+	if st == nil {
+		return packDnsAnswer(query[:end], DNS_RCODE_NAME, nil)
+	}
+	st.seen = time.Now()
+	switch seq {
+	case st.next:
+		st.conn.feed(payload[DNSTUN_HEADER_LEN:], flags&DNSTUN_FIN != 0)
+		down, fin := st.conn.take(DNSTUN_DOWN_MAX)
+		st.last = append([]byte{0}, down...)
+		st.proven = st.proven || len(down) > 0
+		if fin {
+			st.last[0] = DNSTUN_FIN
+		}
+		st.next++
+	case st.next - 1: // retried
+	default:
+		return packDnsAnswer(query[:end], DNS_RCODE_NAME, nil)
+	}
+	return packDnsAnswer(query[:end], 0, st.last)
+}
+
+// the id of query is spoofable and all clients behind a resolver share
+// its address, so the pending conns are limited per resolver.
+// must be called in lock
+func (t *dnsTunnel) admit(source string) bool {
+	if len(t.conns) >= DNSTUN_CONNS_MAX {
+		t.sweep(time.Now())
+	}
+	if len(t.conns) >= DNSTUN_CONNS_MAX {
+		return false
+	}
+	var pending int
+	for _, st := range t.conns {
+		if !st.proven && st.source == source {
+			pending++
+		}
+	}
+	return pending < DNSTUN_PENDING_MAX
+}
+
+// close the conns without queries in timeout, or pending too long.
+// must be called in lock
+func (t *dnsTunnel) sweep(now time.Time) {
+	for id, st := range t.conns {
+		if now.Sub(st.seen) > DNSTUN_IDLE_TIMEOUT ||
+			!st.proven && now.Sub(st.born) > DNSTUN_PENDING_TIMEOUT {
+			delete(t.conns, id)
+			st.conn.feed(nil, true)
+		}
+	}
+}
+
+func (t *dnsTunnel) cleanTask() {
+	var ticker = time.NewTicker(DNSTUN_PENDING_TIMEOUT / 2)
+	defer ticker.Stop()
+	for range ticker.C {
+		t.lock.Lock()
+		if t.conns == nil {
+			t.lock.Unlock()
+			return
+		}
+		t.sweep(time.Now())
+		t.lock.Unlock()
+	}
+}
+
+func (t *dnsTunnel) destroy() {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	for _, st := range t.conns {
+		st.conn.feed(nil, true)
+	}
+	t.conns = nil
+}
+
+// the answer with the question and a TXT of data if rcode is 0
+func packDnsAnswer(question []byte, rcode byte, data []byte) []byte {
+	var buf = bytes.NewBuffer(make([]byte, 0, len(question)+len(data)+16))
+	buf.Write(question[:2])
+	// QR AA RD, RA rcode
+	buf.WriteByte(0x84 | question[2]&1)
+	buf.WriteByte(0x80 | rcode)
+	buf.Write([]byte{0, 1, 0, 0, 0, 0, 0, 0})
+	buf.Write(question[12:])
+	if rcode != 0 {
+		return buf.Bytes()
+	}
+	b := buf.Bytes()
+	b[7] = 1 // ancount
+	// pointer to the question name, TXT IN ttl=0
+	buf.Write([]byte{0xc0, 12, 0, DNS_TYPE_TXT, 0, 1, 0, 0, 0, 0})
+	binary.Write(buf, binary.BigEndian, uint16(len(data)+(len(data)+254)/255))
+	for len(data) > 0 {
+		n := minInt(len(data), 255)
+		buf.WriteByte(byte(n))
+		buf.Write(data[:n])
+		data = data[n:]
+	}
+	return buf.Bytes()
+}
+
+func validateDnsDomain(domain string) error {
+	for _, label := range strings.Split(domain, ".") {
+		if len(label) == 0 || len(label) > DNS_LABEL_MAX {
+			return CONF_ERROR.Apply("DNSTunnel")
+		}
+	}
+	if dnsUpCapacity(domain) < DNSTUN_HEADER_LEN {
+		return CONF_ERROR.Apply("DNSTunnel")
+	}
+	return nil
+}
+
+// return nil if the DNS tunnel is not enabled
+func (t *Server) ListenDNS() (*net.UDPConn, error) {
+	if t.DNSTunnel == NULL {
+		return nil, nil
+	}
+	addr, err := net.ResolveUDPAddr("udp", t.DNSListen)
+	if err != nil {
+		return nil, CONF_ERROR.Apply("DNSListen")
+	}
+	udp, err := net.ListenUDP("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	go newDnsTunnel(udp, t.DNSTunnel, t.TunnelServe).run()
+	return udp, nil
+}
@@ -0,0 +1,166 @@
+package tunnel
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDnsTunName(t *testing.T) {
+	var domain = "t.example.com"
+	payload := randArray(DNSTUN_HEADER_LEN + dnsUpCapacity(domain))
+	name := packDnsTunName(payload, domain)
+	if len(name) > DNS_NAME_MAX {
+		t.Fatalf("name of %d chars", len(name))
+	}
+	if _, err := packDNSQuery(name, DNS_TYPE_TXT); err != nil {
+		t.Fatal(err)
+	}
+	// the case was randomized by resolver
+	decoded, y := parseDnsTunName(strings.ToUpper(name)+".", domain)
+	if !y || !bytes.Equal(decoded, payload) {
+		t.Errorf("decoded % x", decoded)
+	}
+	if _, y = parseDnsTunName("0x!.t.example.com", domain); y {
+		t.Errorf("parsed invalid payload")
+	}
+	if _, y = parseDnsTunName("www.example.com", domain); y {
+		t.Errorf("parsed other domain")
+	}
+	if validateDnsDomain(strings.Repeat("a.", 120)+"com") == nil {
+		t.Errorf("accepted long domain")
+	}
+}
+
+func TestDNSTunnel(t *testing.T) {
+	udp, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer udp.Close()
+	var served, done = make(chan net.Conn, 1), make(chan bool)
+	tunnel := newDnsTunnel(udp, "T.Example.com.", func(conn net.Conn) {
+		served <- conn
+		io.Copy(conn, conn)
+		conn.Close()
+		close(done)
+	})
+	go tunnel.run()
+
+	conn, err := dialDNS("t.example.com", udp.LocalAddr().String(), time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, y := (<-served).RemoteAddr().(*net.TCPAddr); !y {
+		t.Errorf("remote addr is not TCPAddr")
+	}
+	for _, size := range []int{1, DNSTUN_DOWN_MAX + 1, FRAME_MAX_LEN} {
+		data := randArray(size)
+		go conn.Write(data)
+		buf := make([]byte, size)
+		conn.SetReadDeadline(time.Now().Add(GENERAL_SO_TIMEOUT))
+		if _, err = io.ReadFull(conn, buf); err != nil {
+			t.Fatal(size, err)
+		}
+		if !bytes.Equal(data, buf) {
+			t.Fatalf("size=%d echo mismatched", size)
+		}
+	}
+	conn.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	if _, err = conn.Read(make([]byte, 1)); !IsTimeout(err) {
+		t.Errorf("read without timeout %v", err)
+	}
+
+	// the other names are refused
+	query, _ := packDNSQuery("www.example.com", DNS_TYPE_TXT)
+	if answer := tunnel.answer(query, nil); answer[3]&0xf != DNS_RCODE_REFUSED {
+		t.Errorf("answered % x", answer)
+	}
+	// closed by client
+	conn.Close()
+	select {
+	case <-done:
+	case <-time.After(GENERAL_SO_TIMEOUT):
+		t.Errorf("server was not aware of closing")
+	}
+}
+
+func TestDnsTunnelPending(t *testing.T) {
+	udp, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer udp.Close()
+	tunnel := newDnsTunnel(udp, "t.example.com", func(net.Conn) {})
+	open := func(from *net.UDPAddr) bool {
+		payload := randArray(DNSTUN_HEADER_LEN)
+		payload[4], payload[5], payload[6] = 0, 0, 0
+		query, _ := packDNSQuery(packDnsTunName(payload, "t.example.com"), DNS_TYPE_TXT)
+		return tunnel.answer(query, from)[3]&0xf == 0
+	}
+	spoofer := &net.UDPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 53}
+	for i := 0; i < DNSTUN_PENDING_MAX; i++ {
+		if !open(spoofer) {
+			t.Fatalf("refused pending conn %d", i)
+		}
+	}
+	if open(spoofer) {
+		t.Errorf("accepted pending conns over the limit")
+	}
+	// the other resolver is not affected
+	if !open(&net.UDPAddr{IP: net.IPv4(10, 0, 0, 2), Port: 53}) {
+		t.Errorf("refused conn of other resolver")
+	}
+	// the proven one is kept
+	tunnel.lock.Lock()
+	for _, st := range tunnel.conns {
+		if st.source == "10.0.0.2" {
+			st.proven = true
+		}
+	}
+	tunnel.sweep(time.Now().Add(DNSTUN_PENDING_TIMEOUT + time.Second))
+	remained := len(tunnel.conns)
+	tunnel.lock.Unlock()
+	if remained != 1 {
+		t.Errorf("remained %d conns after sweeping", remained)
+	}
+	if !open(spoofer) {
+		t.Errorf("refused pending conn after sweeping")
+	}
+}
+
+func TestDnsFallback(t *testing.T) {
+	udp, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer udp.Close()
+	go newDnsTunnel(udp, "t.example.com", func(conn net.Conn) {}).run()
+
+	var (
+		directs  int
+		fallback = &dnsFallback{domain: "t.example.com", resolver: udp.LocalAddr().String()}
+		blocked  = func() (net.Conn, error) {
+			directs++
+			return nil, errors.New("blocked")
+		}
+	)
+	for i := 0; i < 2; i++ {
+		conn, err := fallback.dial(blocked)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, y := conn.(*dnsConn); !y {
+			t.Fatalf("dialed %T", conn)
+		}
+		conn.Close()
+	}
+	// held on the fallback
+	if directs != 1 {
+		t.Errorf("dialed directly %d times", directs)
+	}
+}
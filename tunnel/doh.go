@@ -0,0 +1,214 @@
+package tunnel
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/Lafeng/deblocus/exception"
+)
+
+const (
+	DOH_TIMEOUT      = 5 * time.Second
+	DOH_MAX_RESPONSE = 4096
+	DOH_MIME         = "application/dns-message"
+	DNS_TYPE_A       = 1
+	DNS_TYPE_AAAA    = 28
+	DNS_RCODE_NAME   = 3 // NXDOMAIN
+)
+
+var (
+	DOH_ERROR     = exception.New("DoH error")
+	HOST_NOTFOUND = exception.New("No such host")
+)
+
+// resolve hostname of destinations on server
+type hostResolver interface {
+	LookupIP(host string) ([]net.IP, error)
+}
+
+type systemResolver struct{}
+
+func (systemResolver) LookupIP(host string) ([]net.IP, error) {
+	return net.LookupIP(host)
+}
+
+// --------------------
+// dohResolver
+// --------------------
+// DNS-over-HTTPS (rfc8484) client, queries A then AAAA if no A records.
+// the failures (not negative answers) could fallback to the system resolver.
+type dohResolver struct {
+	succeeded int64
+	failed    int64
+	endpoint  string
+	fallback  bool
+	client    *http.Client
+}
+
+func newDoHResolver(endpoint string, fallback bool) *dohResolver {
+	return &dohResolver{
+		endpoint: endpoint,
+		fallback: fallback,
+		// reuse connections to the endpoint
+		client: &http.Client{
+			Timeout: DOH_TIMEOUT,
+			Transport: &http.Transport{
+				MaxIdleConnsPerHost: 4,
+				IdleConnTimeout:     time.Minute,
+			},
+		},
+	}
+}
+
+func (r *dohResolver) LookupIP(host string) ([]net.IP, error) {
+	ips, err := r.query(host, DNS_TYPE_A)
+	if err == nil && len(ips) == 0 {
+		ips, err = r.query(host, DNS_TYPE_AAAA)
+	}
+	if err == nil {
+		atomic.AddInt64(&r.succeeded, 1)
+		if len(ips) == 0 {
+			err = HOST_NOTFOUND.Apply(host)
+		}
+		return ips, err
+	}
+	atomic.AddInt64(&r.failed, 1)
+	if r.fallback {
+		return net.LookupIP(host)
+	}
+	return nil, err
+}
+
+func (r *dohResolver) query(host string, qtype uint16) ([]net.IP, error) {
+	msg, err := packDNSQuery(host, qtype)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequest("POST", r.endpoint, bytes.NewReader(msg))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", DOH_MIME)
+	req.Header.Set("Accept", DOH_MIME)
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, DOH_MAX_RESPONSE))
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, DOH_ERROR.Apply(resp.Status)
+	}
+	return parseDNSAnswers(body, qtype)
+}
+
+func (r *dohResolver) String() string {
+	return fmt.Sprintf("DoH=%d DoH-failed=%d",
+		atomic.LoadInt64(&r.succeeded), atomic.LoadInt64(&r.failed))
+}
+
+// --------------------
+// dns message
+// --------------------
+// header: id=0 (rfc8484 4.1), flags=RD, qdcount=1
+func packDNSQuery(host string, qtype uint16) ([]byte, error) {
+	var buf = bytes.NewBuffer([]byte{0, 0, 1, 0, 0, 1, 0, 0, 0, 0, 0, 0})
+	for _, label := range strings.Split(strings.TrimSuffix(host, "."), ".") {
+		if len(label) == 0 || len(label) > 63 {
+			return nil, DOH_ERROR.Apply("invalid host " + host)
+		}
+		buf.WriteByte(byte(len(label)))
+		buf.WriteString(label)
+	}
+	buf.WriteByte(0)
+	binary.Write(buf, binary.BigEndian, []uint16{qtype, 1}) // class IN
+	return buf.Bytes(), nil
+}
+
+// skip the name (labels or compression pointer) at offset
+func skipDNSName(msg []byte, off int) (int, error) {
+	for off < len(msg) {
+		n := int(msg[off])
+		switch {
+		case n == 0:
+			return off + 1, nil
+		case n&0xc0 == 0xc0:
+			return off + 2, nil
+		default:
+			off += n + 1
+		}
+	}
+	return 0, DOH_ERROR.Apply("malformed message")
+}
+
+func parseDNSAnswers(msg []byte, qtype uint16) ([]net.IP, error) {
+	if len(msg) < 12 {
+		return nil, DOH_ERROR.Apply("malformed message")
+	}
+	var (
+		rcode   = msg[3] & 0xf
+		qdcount = int(binary.BigEndian.Uint16(msg[4:]))
+		ancount = int(binary.BigEndian.Uint16(msg[6:]))
+		off     = 12
+		err     error
+		ips     []net.IP
+	)
+	if rcode == DNS_RCODE_NAME {
+		return nil, nil
+	} else if rcode != 0 {
+		return nil, DOH_ERROR.Apply(fmt.Sprintf("rcode=%d", rcode))
+	}
+	for i := 0; i < qdcount; i++ {
+		if off, err = skipDNSName(msg, off); err != nil {
+			return nil, err
+		}
+		off += 4
+	}
+	for i := 0; i < ancount; i++ {
+		if off, err = skipDNSName(msg, off); err != nil {
+			return nil, err
+		}
+		if off+10 > len(msg) {
+			return nil, DOH_ERROR.Apply("malformed message")
+		}
+		rtype := binary.BigEndian.Uint16(msg[off:])
+		rdlen := int(binary.BigEndian.Uint16(msg[off+8:]))
+		off += 10
+		if off+rdlen > len(msg) {
+			return nil, DOH_ERROR.Apply("malformed message")
+		}
+		// skip CNAME and others
+		if rtype == qtype && (rdlen == net.IPv4len || rdlen == net.IPv6len) {
+			ips = append(ips, net.IP(append([]byte(nil), msg[off:off+rdlen]...)))
+		}
+		off += rdlen
+	}
+	return ips, nil
+}
+
+// resolve the host of target with resolver, return ip:port
+func resolveTarget(r hostResolver, target string) (string, error) {
+	host, port, err := net.SplitHostPort(target)
+	if err != nil || net.ParseIP(host) != nil {
+		return target, err
+	}
+	ips, err := r.LookupIP(host)
+	if err == nil && len(ips) == 0 {
+		err = &net.DNSError{Err: "no such host", Name: host}
+	}
+	if err != nil {
+		return target, err
+	}
+	return net.JoinHostPort(ips[0].String(), port), nil
+}
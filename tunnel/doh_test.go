@@ -0,0 +1,80 @@
+package tunnel
+
+import (
+	"encoding/binary"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// answer A records of example.test, others are NXDOMAIN
+func mockDoHHandler(w http.ResponseWriter, r *http.Request) {
+	query, _ := ioutil.ReadAll(r.Body)
+	if r.Method != "POST" || r.Header.Get("Content-Type") != DOH_MIME || len(query) < 12 {
+		http.Error(w, "bad request", http.StatusBadRequest)
+		return
+	}
+	var (
+		qend, _ = skipDNSName(query, 12)
+		qtype   = binary.BigEndian.Uint16(query[qend:])
+		resp    = append([]byte(nil), query[:qend+4]...)
+	)
+	resp[2], resp[3] = 0x81, 0x80 // response, RD, RA
+	if string(query[12:qend]) != "\x07example\x04test\x00" {
+		resp[3] |= DNS_RCODE_NAME
+	} else if qtype == DNS_TYPE_A {
+		resp[7] = 2 // ancount
+		for _, ip := range []byte{1, 2} {
+			// name pointer to question, type, class, ttl, rdlen, rdata
+			resp = append(resp, 0xc0, 12, 0, DNS_TYPE_A, 0, 1, 0, 0, 0, 60, 0, 4, 192, 0, 2, ip)
+		}
+	}
+	w.Header().Set("Content-Type", DOH_MIME)
+	w.Write(resp)
+}
+
+func TestDoHResolver(t *testing.T) {
+	ts := httptest.NewTLSServer(http.HandlerFunc(mockDoHHandler))
+	defer ts.Close()
+	r := newDoHResolver(ts.URL, false)
+	r.client = ts.Client()
+
+	ips, err := r.LookupIP("example.test")
+	if err != nil || len(ips) != 2 || !ips[0].Equal(net.ParseIP("192.0.2.1")) {
+		t.Fatalf("ips=%v err=%v", ips, err)
+	}
+	target, err := resolveTarget(r, "example.test:443")
+	if err != nil || target != "192.0.2.1:443" {
+		t.Errorf("target=%s err=%v", target, err)
+	}
+	// negative answer is not failure
+	if _, err = r.LookupIP("nx.example.test"); err == nil {
+		t.Errorf("expected no such host")
+	}
+	if !strings.Contains(r.String(), "DoH=3 DoH-failed=0") {
+		t.Errorf("unexpected stats %s", r)
+	}
+}
+
+func TestDoHFallback(t *testing.T) {
+	ts := httptest.NewTLSServer(http.NotFoundHandler())
+	defer ts.Close()
+
+	strict := newDoHResolver(ts.URL, false)
+	strict.client = ts.Client()
+	if _, err := strict.LookupIP("localhost"); err == nil {
+		t.Errorf("expected DoH error")
+	}
+
+	lenient := newDoHResolver(ts.URL, true)
+	lenient.client = ts.Client()
+	if ips, err := lenient.LookupIP("localhost"); err != nil || len(ips) == 0 {
+		t.Errorf("fallback failed ips=%v err=%v", ips, err)
+	}
+	if strict.failed != 1 || lenient.failed != 1 {
+		t.Errorf("failed=%d,%d", strict.failed, lenient.failed)
+	}
+}
@@ -0,0 +1,57 @@
+package tunnel
+
+import (
+	"crypto/tls"
+	"net"
+	"time"
+
+	"github.com/Lafeng/deblocus/exception"
+	log "github.com/Lafeng/deblocus/glog"
+)
+
+const (
+	// pending fast open requests of listener
+	TFO_QUEUE_LEN = 256
+)
+
+var (
+	TFO_UNSUPPORTED = exception.New("TCP Fast Open is unsupported")
+)
+
+// --------------------
+// TCP Fast Open
+// --------------------
+// the client sends the first flight (the handshake of tunnel or the TLS
+// ClientHello) in SYN with the cookie got from the previous connection,
+// that saves a round trip on every re-dialing of the parallel tunnels.
+// the first connection without cookie is established as usual.
+// it requires the net.ipv4.tcp_fastopen sysctl of both sides enables it,
+// currently only linux is supported and the others dial as usual.
+
+// listen the tunnel address, with fast open if enabled
+func (t *Server) ListenTCP(addr *net.TCPAddr) (*net.TCPListener, error) {
+	if t.fastOpen {
+		ln, err := listenFastOpen(addr)
+		if err == nil {
+			return ln, nil
+		}
+		log.Warningln("Listen without fast open,", err)
+	}
+	return net.ListenTCP("tcp", addr)
+}
+
+// the TLS handshake over the fast open conn, as tls.DialWithDialer
+func fastOpenTLS(conn net.Conn, config *tls.Config, addr string) (net.Conn, error) {
+	if config.ServerName == NULL {
+		config = config.Clone()
+		config.ServerName, _, _ = net.SplitHostPort(addr)
+	}
+	tlsConn := tls.Client(conn, config)
+	tlsConn.SetDeadline(time.Now().Add(GENERAL_SO_TIMEOUT))
+	if err := tlsConn.Handshake(); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	tlsConn.SetDeadline(ZERO_TIME)
+	return tlsConn, nil
+}
@@ -0,0 +1,101 @@
+package tunnel
+
+import (
+	"net"
+	"os"
+	"syscall"
+)
+
+const (
+	TCP_FASTOPEN         = 0x17
+	TCP_FASTOPEN_CONNECT = 0x1e // linux 4.11+
+)
+
+// the socket is created by syscall as the dialer and listener have no
+// control of options before connect and listen.
+func listenFastOpen(addr *net.TCPAddr) (*net.TCPListener, error) {
+	family, sa := tcpSockaddr(addr)
+	fd, err := syscall.Socket(family, syscall.SOCK_STREAM|syscall.SOCK_CLOEXEC, syscall.IPPROTO_TCP)
+	if err != nil && addr.IP == nil {
+		// ipv6 was disabled
+		family, sa = syscall.AF_INET, &syscall.SockaddrInet4{Port: addr.Port}
+		fd, err = syscall.Socket(family, syscall.SOCK_STREAM|syscall.SOCK_CLOEXEC, syscall.IPPROTO_TCP)
+	}
+	if err != nil {
+		return nil, os.NewSyscallError("socket", err)
+	}
+	var file = os.NewFile(uintptr(fd), "tfo")
+	defer file.Close()
+	if err = syscall.SetsockoptInt(fd, syscall.SOL_SOCKET, syscall.SO_REUSEADDR, 1); err != nil {
+		return nil, os.NewSyscallError("setsockopt", err)
+	}
+	if family == syscall.AF_INET6 && addr.IP == nil {
+		// dual stack as net.ListenTCP
+		syscall.SetsockoptInt(fd, syscall.IPPROTO_IPV6, syscall.IPV6_V6ONLY, 0)
+	}
+	if err = syscall.SetsockoptInt(fd, syscall.IPPROTO_TCP, TCP_FASTOPEN, TFO_QUEUE_LEN); err != nil {
+		return nil, TFO_UNSUPPORTED.Apply(err)
+	}
+	if err = syscall.Bind(fd, sa); err != nil {
+		return nil, os.NewSyscallError("bind", err)
+	}
+	if err = syscall.Listen(fd, syscall.SOMAXCONN); err != nil {
+		return nil, os.NewSyscallError("listen", err)
+	}
+	// the fd is duplicated
+	ln, err := net.FileListener(file)
+	if err != nil {
+		return nil, err
+	}
+	return ln.(*net.TCPListener), nil
+}
+
+// connect returns at once if the cookie was cached, and the SYN is deferred
+// to carry the first writing. otherwise it's blocked in dialer timeout.
+func dialFastOpen(d *net.Dialer, addr string) (net.Conn, error) {
+	raddr, err := net.ResolveTCPAddr("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	family, sa := tcpSockaddr(raddr)
+	fd, err := syscall.Socket(family, syscall.SOCK_STREAM|syscall.SOCK_CLOEXEC, syscall.IPPROTO_TCP)
+	if err != nil {
+		return nil, os.NewSyscallError("socket", err)
+	}
+	var file = os.NewFile(uintptr(fd), "tfo")
+	defer file.Close()
+	if laddr, y := d.LocalAddr.(*net.TCPAddr); y && laddr != nil {
+		_, lsa := tcpSockaddr(laddr)
+		if err = syscall.Bind(fd, lsa); err != nil {
+			return nil, os.NewSyscallError("bind", err)
+		}
+	}
+	if err = syscall.SetsockoptInt(fd, syscall.IPPROTO_TCP, TCP_FASTOPEN_CONNECT, 1); err != nil {
+		return nil, TFO_UNSUPPORTED.Apply(err)
+	}
+	if d.Timeout > 0 {
+		tv := syscall.NsecToTimeval(d.Timeout.Nanoseconds())
+		syscall.SetsockoptTimeval(fd, syscall.SOL_SOCKET, syscall.SO_SNDTIMEO, &tv)
+	}
+	if err = syscall.Connect(fd, sa); err != nil {
+		if err == syscall.EINPROGRESS {
+			err = syscall.ETIMEDOUT
+		}
+		return nil, &net.OpError{Op: "dial", Net: "tcp", Addr: raddr, Err: os.NewSyscallError("connect", err)}
+	}
+	syscall.SetsockoptTimeval(fd, syscall.SOL_SOCKET, syscall.SO_SNDTIMEO, new(syscall.Timeval))
+	// the fd is duplicated
+	return net.FileConn(file)
+}
+
+func tcpSockaddr(addr *net.TCPAddr) (int, syscall.Sockaddr) {
+	if ip := addr.IP.To4(); ip != nil {
+		sa := &syscall.SockaddrInet4{Port: addr.Port}
+		copy(sa.Addr[:], ip)
+		return syscall.AF_INET, sa
+	}
+	// unspecified if nil
+	sa := &syscall.SockaddrInet6{Port: addr.Port}
+	copy(sa.Addr[:], addr.IP.To16())
+	return syscall.AF_INET6, sa
+}
@@ -0,0 +1,57 @@
+package tunnel
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestFastOpen(t *testing.T) {
+	ln, err := listenFastOpen(&net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Skip(err)
+	}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				io.Copy(conn, conn)
+				conn.Close()
+			}()
+		}
+	}()
+	var dialer = &net.Dialer{Timeout: time.Second}
+	// the second one is with the cookie if enabled by sysctl
+	for i := 0; i < 2; i++ {
+		conn, err := dialFastOpen(dialer, ln.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, y := conn.(*net.TCPConn); !y {
+			t.Fatalf("dialed %T", conn)
+		}
+		data := randArray(FRAME_MAX_LEN)
+		go conn.Write(data)
+		buf := make([]byte, len(data))
+		conn.SetReadDeadline(time.Now().Add(GENERAL_SO_TIMEOUT))
+		if _, err = io.ReadFull(conn, buf); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(data, buf) {
+			t.Fatalf("echo mismatched")
+		}
+		conn.Close()
+	}
+
+	// refused after closed
+	addr := ln.Addr().String()
+	ln.Close()
+	if _, err = dialFastOpen(dialer, addr); err == nil {
+		t.Errorf("dialed the closed listener")
+	}
+}
@@ -0,0 +1,15 @@
+// +build !linux
+
+package tunnel
+
+import (
+	"net"
+)
+
+func listenFastOpen(addr *net.TCPAddr) (*net.TCPListener, error) {
+	return nil, TFO_UNSUPPORTED
+}
+
+func dialFastOpen(d *net.Dialer, addr string) (net.Conn, error) {
+	return d.Dial("tcp", addr)
+}
@@ -0,0 +1,90 @@
+package tunnel
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"math/rand"
+	"net"
+	"strings"
+	"time"
+)
+
+const (
+	// degree of randomizing the wire profile
+	FINGERPRINT_OFF  = "off"
+	FINGERPRINT_LOW  = "low"
+	FINGERPRINT_HIGH = "high"
+)
+
+// --------------------
+// wireProfile
+// --------------------
+// the observable characteristics of tunnels are randomized per session to
+// resist fingerprinting by traffic analysis. the profile is derived from
+// the key of session, so it varies across sessions but is consistent in
+// one session, and both sides derive the same profile.
+//
+// the cost of throughput:
+// low: data frames are read in 16k-64k chunks with padding up to 64 bytes,
+// less than 1% of bandwidth and the cpu of more frames in smaller chunks.
+// high: chunks of 2k-64k with padding up to 255 bytes and the randomized
+// socket buffers, that costs up to 12% of bandwidth in the smallest chunks
+// and may limit the throughput of high latency links by smaller windows.
+type wireProfile struct {
+	chunk   int           // max payload of data frames
+	padding int           // max padding of frames
+	jitter  time.Duration // offset of ping interval
+	sockBuf int           // size of socket buffers, or system default if 0
+}
+
+func parseFingerprint(degree string) (int, error) {
+	switch strings.ToLower(degree) {
+	case NULL, FINGERPRINT_OFF:
+		return 0, nil
+	case FINGERPRINT_LOW:
+		return 1, nil
+	case FINGERPRINT_HIGH:
+		return 2, nil
+	}
+	return 0, CONF_ERROR.Apply("Fingerprint")
+}
+
+// return nil if the degree is off
+func newWireProfile(degree int, key []byte) *wireProfile {
+	if degree <= 0 || len(key) == 0 {
+		return nil
+	}
+	var (
+		sum = sha256.Sum256(append([]byte("wire-profile:"), key...))
+		rnd = rand.New(rand.NewSource(int64(binary.BigEndian.Uint64(sum[:]))))
+		p   = new(wireProfile)
+	)
+	if degree == 1 {
+		p.chunk = 16<<10 + rnd.Intn(FRAME_PAYLOAD_MAX-16<<10)
+		p.padding = 16 + rnd.Intn(48)
+		p.jitter = time.Duration(rnd.Int63n(int64(GENERAL_SO_TIMEOUT)))
+	} else {
+		p.chunk = 2<<10 + rnd.Intn(FRAME_PAYLOAD_MAX-2<<10)
+		p.padding = 64 + rnd.Intn(192)
+		p.jitter = time.Duration(rnd.Int63n(int64(GENERAL_SO_TIMEOUT) * 3))
+		p.sockBuf = 32<<10 + rnd.Intn(224<<10)
+	}
+	return p
+}
+
+// random length of padding in profile
+func (p *wireProfile) pad() int {
+	return int(myRand.Int63n(int64(p.padding) + 1))
+}
+
+func (p *wireProfile) applySocket(tun *Conn) {
+	if t, y := tun.Conn.(*net.TCPConn); y && p.sockBuf > 0 {
+		t.SetReadBuffer(p.sockBuf)
+		t.SetWriteBuffer(p.sockBuf)
+	}
+}
+
+func (p *wireProfile) String() string {
+	return fmt.Sprintf("chunk=%d padding=%d jitter=%s sockbuf=%d", p.chunk, p.padding, p.jitter, p.sockBuf)
+}
@@ -0,0 +1,62 @@
+package tunnel
+
+import (
+	"testing"
+)
+
+func TestWireProfilePerSession(t *testing.T) {
+	serv := newTestServer()
+	if newTestSession(serv, "alice").mux.profile != nil {
+		t.Fatalf("randomized by default")
+	}
+	serv.fingerprint = 2
+	var (
+		alice = newTestSession(serv, "alice")
+		bob   = newTestSession(serv, "bob")
+	)
+	if alice.mux.profile == nil || bob.mux.profile == nil {
+		t.Fatalf("no profile")
+	}
+	if *alice.mux.profile == *bob.mux.profile {
+		t.Errorf("same profile of sessions %s", alice.mux.profile)
+	}
+	// consistent in session, also derived by the client
+	if p := newWireProfile(2, alice.cipherFactory.key); *p != *alice.mux.profile {
+		t.Errorf("inconsistent profile %s != %s", p, alice.mux.profile)
+	}
+	for _, p := range []*wireProfile{alice.mux.profile, newWireProfile(1, alice.cipherFactory.key)} {
+		if p.chunk < 2<<10 || p.chunk > FRAME_PAYLOAD_MAX || p.padding > FRAME_PADDING_MAX {
+			t.Errorf("out of range %s", p)
+		}
+	}
+}
+
+func TestFramePadding(t *testing.T) {
+	var (
+		profile = newWireProfile(2, randArray(32))
+		body    = randArray(1000)
+		padded  int
+	)
+	for i := 0; i < 20; i++ {
+		buf := make([]byte, FRAME_MAX_LEN)
+		n := pack(buf, FRAME_ACTION_DATA, 1, body)
+		out := frameTransform(buf[:n], profile)
+		frm, err := parse_frame(out[:FRAME_HEADER_LEN])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if int(frm.length) != len(body) || int(frm.vary) > profile.padding || len(out) != n+int(frm.vary) {
+			t.Fatalf("length=%d vary=%d out=%d", frm.length, frm.vary, len(out))
+		}
+		padded += int(frm.vary)
+	}
+	if padded == 0 {
+		t.Errorf("no padding")
+	}
+	// no spare capacity
+	buf := make([]byte, FRAME_HEADER_LEN+len(body))
+	pack(buf, FRAME_ACTION_DATA, 1, body)
+	if out := frameTransform(buf, profile); len(out) != len(buf) || out[1] != 0 {
+		t.Errorf("padded beyond the buffer")
+	}
+}
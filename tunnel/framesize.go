@@ -0,0 +1,93 @@
+package tunnel
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync/atomic"
+
+	"github.com/Lafeng/deblocus/crypto"
+)
+
+const (
+	// carried by the vary of frame header
+	FRAME_PADDING_MAX = 0xff
+	// leave space for padding in the buffer of frame
+	FRAME_PAYLOAD_MAX = FRAME_MAX_LEN - FRAME_HEADER_LEN - FRAME_PADDING_MAX
+)
+
+// --------------------
+// frameBounds
+// --------------------
+// the bounds of frame payload (body and padding). the data is split into
+// frames not greater than max and the frames less than min are padded, so
+// all frames are the uniform size if min=max, which is maximal against
+// fingerprinting at the cost of 8 bytes header per frame. the receiver
+// reassembles the data of stream naturally.
+// the padding is at most 255 bytes, so min is bounded by it, and the
+// control frames greater than max are sent as is. the ciphers are stream
+// ciphers without overhead.
+type frameBounds struct {
+	frames int64
+	bytes  int64
+	min    int
+	max    int
+}
+
+// eg. 255-255 for uniform size, or 64-16384, or 4096 of max without padding
+func parseFrameBounds(str string) (*frameBounds, error) {
+	var b = new(frameBounds)
+	parts := strings.SplitN(str, "-", 2)
+	if len(parts) == 1 {
+		parts = []string{"0", parts[0]}
+	}
+	var e1, e2 error
+	b.min, e1 = strconv.Atoi(strings.TrimSpace(parts[0]))
+	b.max, e2 = strconv.Atoi(strings.TrimSpace(parts[1]))
+	if e1 != nil || e2 != nil || b.min < 0 || b.min > FRAME_PADDING_MAX ||
+		b.max < 1 || b.max < b.min || b.max > FRAME_PAYLOAD_MAX {
+		return nil, CONF_ERROR.Apply("FramePayload")
+	}
+	return b, nil
+}
+
+// pad the body of frame up to min, then randomly by profile within max
+func (b *frameBounds) transform(buf []byte, profile *wireProfile) []byte {
+	var (
+		theLen = len(buf)
+		body   = theLen - FRAME_HEADER_LEN
+		n      int
+	)
+	if body < b.min {
+		n = b.min - body
+	}
+	if profile != nil && body+n < b.max {
+		n += minInt(profile.pad(), b.max-body-n)
+		n = minInt(n, FRAME_PADDING_MAX)
+	}
+	if n > 0 {
+		if cap(buf)-theLen >= n {
+			buf = buf[:theLen+n]
+			for i := theLen; i < len(buf); i++ {
+				buf[i] = 0
+			}
+		} else {
+			box := make([]byte, theLen+n)
+			copy(box, buf)
+			buf = box
+		}
+	}
+	buf[1] = byte(n)
+	crypto.SetHash16At6(buf)
+	atomic.AddInt64(&b.frames, 1)
+	atomic.AddInt64(&b.bytes, int64(len(buf)))
+	return buf
+}
+
+func (b *frameBounds) String() string {
+	var avg int64
+	if n := atomic.LoadInt64(&b.frames); n > 0 {
+		avg = atomic.LoadInt64(&b.bytes) / n
+	}
+	return fmt.Sprintf("Frame-payload=%d-%d Frame-avg=%d", b.min, b.max, avg)
+}
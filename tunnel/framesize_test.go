@@ -0,0 +1,201 @@
+package tunnel
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestParseFrameBounds(t *testing.T) {
+	for str, valid := range map[string]bool{
+		"255-255":   true,
+		"0-65272":   true,
+		"64-16384":  true,
+		"256-1024":  false, // beyond padding
+		"100-50":    false,
+		"0-0":       false,
+		"0-65273":   false,
+		"64":        true, // the max only
+		"65273":     false,
+		"0":         false,
+		"a-b":       false,
+		" 16 - 32 ": true,
+	} {
+		if _, err := parseFrameBounds(str); (err == nil) != valid {
+			t.Errorf("%q: valid=%t err=%v", str, valid, err)
+		}
+	}
+}
+
+// relay the data through tun, return the wire size of frames and the
+// reassembled data of stream
+func relayWithBounds(t *testing.T, bounds *frameBounds, profile *wireProfile, data []byte) ([]int, []byte) {
+	c, s := tcpPair(t)
+	defer c.Close()
+	var (
+		mux       = newServerMultiplexer()
+		tun       = NewConn(s, nullCipherKit)
+		src, feed = net.Pipe()
+		sizes     []int
+		out       []byte
+	)
+	defer mux.destroy()
+	mux.frames = bounds
+	tun.frames, tun.profile = bounds, profile
+	go func() {
+		feed.Write(data)
+		feed.Close()
+	}()
+	go mux.relay(newEdgeConn(mux, "key", "example.com:80", tun, src), tun, 1)
+	for {
+		header := make([]byte, FRAME_HEADER_LEN)
+		if _, err := io.ReadFull(c, header); err != nil {
+			t.Fatal(err)
+		}
+		frm, err := parse_frame(header)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err = io.ReadFull(c, frm.data); err != nil {
+			t.Fatal(err)
+		}
+		sizes = append(sizes, FRAME_HEADER_LEN+len(frm.data))
+		if frm.action == FRAME_ACTION_CLOSE_W {
+			break
+		}
+		out = append(out, frm.data[:frm.length]...)
+	}
+	return sizes, out
+}
+
+func TestUniformFrameSize(t *testing.T) {
+	bounds, _ := parseFrameBounds("200-200")
+	data := randArray(5000)
+	sizes, out := relayWithBounds(t, bounds, nil, data)
+	if !bytes.Equal(data, out) {
+		t.Fatalf("reassembled len=%d of sent=%d", len(out), len(data))
+	}
+	if len(sizes) != 26 {
+		t.Errorf("frames=%d", len(sizes))
+	}
+	for i, n := range sizes {
+		if n != FRAME_HEADER_LEN+200 {
+			t.Errorf("frame %d size=%d", i, n)
+		}
+	}
+	if s := bounds.String(); s != "Frame-payload=200-200 Frame-avg=208" {
+		t.Errorf("unexpected stats %s", s)
+	}
+}
+
+func TestVariableFrameSize(t *testing.T) {
+	var (
+		bounds, _ = parseFrameBounds("16-1000")
+		profile   = newWireProfile(2, randArray(32))
+		data      = randArray(20000)
+		varied    bool
+	)
+	sizes, out := relayWithBounds(t, bounds, profile, data)
+	if !bytes.Equal(data, out) {
+		t.Fatalf("reassembled len=%d of sent=%d", len(out), len(data))
+	}
+	for i, n := range sizes {
+		if n < FRAME_HEADER_LEN+16 || n > FRAME_HEADER_LEN+1000 {
+			t.Errorf("frame %d size=%d", i, n)
+		}
+		varied = varied || n != sizes[0]
+	}
+	if !varied {
+		t.Errorf("uniform frames in variable mode")
+	}
+}
+
+func TestFramePadByProfile(t *testing.T) {
+	var (
+		bounds, _ = parseFrameBounds("16-1000")
+		profile   = newWireProfile(2, randArray(32))
+		varied    bool
+	)
+	// the frames less than min are padded by profile too
+	for i := 0; i < 64; i++ {
+		buf := make([]byte, FRAME_HEADER_LEN+1, 64)
+		out := bounds.transform(buf, profile)
+		pad := int(out[1])
+		if len(out) != FRAME_HEADER_LEN+1+pad || pad < 15 || pad > 15+profile.padding {
+			t.Fatalf("frame size=%d padding=%d", len(out), pad)
+		}
+		varied = varied || pad != 15
+	}
+	if !varied {
+		t.Errorf("padded up to min only")
+	}
+	// uniform
+	bounds, _ = parseFrameBounds("200-200")
+	for i := 0; i < 16; i++ {
+		if out := bounds.transform(make([]byte, FRAME_HEADER_LEN+1), profile); len(out) != FRAME_HEADER_LEN+200 {
+			t.Fatalf("uniform frame size=%d", len(out))
+		}
+	}
+}
+
+func TestWriteCoalesce(t *testing.T) {
+	for str, valid := range map[string]bool{"2ms": true, "50ms": true, "0": false, "1s": false, "x": false} {
+		if _, err := parseCoalesceDelay(str); (err == nil) != valid {
+			t.Errorf("%q: valid=%t err=%v", str, valid, err)
+		}
+	}
+	c, s := tcpPair(t)
+	defer c.Close()
+	defer s.Close()
+	var (
+		tun = NewConn(c, nullCipherKit)
+		buf = make([]byte, COALESCE_FLUSH_SIZE*2)
+	)
+	tun.coalesce = time.Millisecond * 50
+	for i := 0; i < 3; i++ {
+		if n, err := tun.Write([]byte("frame")); n != 5 || err != nil {
+			t.Fatalf("write n=%d err=%v", n, err)
+		}
+	}
+	// held in delay
+	s.SetReadDeadline(time.Now().Add(time.Millisecond * 10))
+	if n, err := s.Read(buf); n > 0 || !IsTimeout(err) {
+		t.Fatalf("written without delay n=%d err=%v", n, err)
+	}
+	s.SetReadDeadline(time.Now().Add(time.Second))
+	if n, err := io.ReadFull(s, buf[:15]); err != nil || string(buf[:n]) != "frameframeframe" {
+		t.Errorf("coalesced %q err=%v", buf[:n], err)
+	}
+	// flushed at the size without delay
+	tun.Write(make([]byte, COALESCE_FLUSH_SIZE))
+	s.SetReadDeadline(time.Now().Add(time.Millisecond * 20))
+	if n, err := io.ReadFull(s, buf[:COALESCE_FLUSH_SIZE]); err != nil {
+		t.Errorf("not flushed n=%d err=%v", n, err)
+	}
+	// the later writes fail after the flushing failed
+	c.Close()
+	tun.Write([]byte("frame"))
+	time.Sleep(time.Millisecond * 100)
+	if _, err := tun.Write([]byte("frame")); err == nil {
+		t.Errorf("no error after failed")
+	}
+
+	// the pending are flushed on closing
+	c, s = tcpPair(t)
+	defer s.Close()
+	tun = NewConn(c, nullCipherKit)
+	tun.coalesce = time.Second
+	tun.Write([]byte("frame"))
+	if err := tun.Close(); err != nil {
+		t.Errorf("close err=%v", err)
+	}
+	s.SetReadDeadline(time.Now().Add(time.Millisecond * 100))
+	if n, err := io.ReadFull(s, buf[:5]); err != nil || string(buf[:n]) != "frame" {
+		t.Errorf("not flushed on closing %q err=%v", buf[:n], err)
+	}
+	if _, err := tun.Write([]byte("frame")); err == nil {
+		t.Errorf("written after closed")
+	}
+}
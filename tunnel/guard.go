@@ -0,0 +1,788 @@
+package tunnel
+
+import (
+	"container/list"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	log "github.com/Lafeng/deblocus/glog"
+	"github.com/cloudflare/golibs/lrucache"
+)
+
+const (
+	// storm lasts at least such seconds after arrivals exceeded threshold
+	STORM_COOLDOWN    = 10
+	STORM_ADMIT_RATE  = 10
+	BUSY_RETRY_JITTER = time.Second * 10
+	// the capacity of tracked subnets
+	SUBNET_TRACK_MAX = 4096
+	SUBNET_IDLE_TTL  = time.Minute * 10
+	// admission queue
+	PRIORITY_RESUME  = 0
+	PRIORITY_NEW     = 1
+	ADMIT_QUEUE_MAX  = 256 // waiters per priority
+	ADMIT_QUEUE_WAIT = GENERAL_SO_TIMEOUT / 2
+	// connections in negotiation and the deadline of each
+	HALF_OPEN_MAX     = 1024
+	HANDSHAKE_TIMEOUT = time.Second * 30
+	// failed negotiations of source are counted in window
+	BAN_TRACK_MAX   = 4096
+	BAN_FAIL_WINDOW = time.Minute * 10
+	BAN_COOLDOWN    = time.Minute * 10
+	// opening destination waits for a free slot at capacity
+	OUTBOUND_QUEUE_WAIT = time.Second * 2
+
+	DIAL_FAIL_WINDOW = time.Minute
+	DIAL_BACKOFF     = time.Second
+	DIAL_BACKOFF_MAX = time.Minute
+)
+
+// loopback, private, link-local (cloud metadata) and other special-purpose ranges
+var DEFAULT_DENY_NETWORKS = []string{
+	"0.0.0.0/8", "10.0.0.0/8", "100.64.0.0/10", "127.0.0.0/8", "169.254.0.0/16",
+	"172.16.0.0/12", "192.168.0.0/16", "::/128", "::1/128", "fc00::/7", "fe80::/10",
+}
+
+// --------------------
+// stormGuard
+// --------------------
+// Smooth the reconnection storm (eg. all clients reconnect after server restarted).
+// When the new negotiations exceed the threshold per second, the storm is detected,
+// then only admit negotiations at the rate, and the excess will be deferred.
+type stormGuard struct {
+	lock       sync.Mutex
+	threshold  int
+	rate       int
+	window     int64 // current second
+	arrivals   int
+	admits     int
+	stormUntil int64
+	admitted   int64
+	deferred   int64
+}
+
+func newStormGuard(threshold, rate int) *stormGuard {
+	return &stormGuard{
+		threshold: threshold,
+		rate:      rate,
+	}
+}
+
+func (g *stormGuard) admit(now time.Time) bool {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	sec := now.Unix()
+	if sec != g.window {
+		g.window, g.arrivals, g.admits = sec, 0, 0
+	}
+	g.arrivals++
+	if g.arrivals > g.threshold {
+		g.stormUntil = sec + STORM_COOLDOWN
+	}
+	if sec < g.stormUntil && g.admits >= g.rate {
+		atomic.AddInt64(&g.deferred, 1)
+		return false
+	}
+	g.admits++
+	atomic.AddInt64(&g.admitted, 1)
+	return true
+}
+
+func (g *stormGuard) inStorm() bool {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	return time.Now().Unix() < g.stormUntil
+}
+
+func (g *stormGuard) String() string {
+	var state = "off"
+	if g.inStorm() {
+		state = "on"
+	}
+	return fmt.Sprintf("Storm=%s Admitted=%d Deferred=%d",
+		state, atomic.LoadInt64(&g.admitted), atomic.LoadInt64(&g.deferred))
+}
+
+// --------------------
+// subnetGuard
+// --------------------
+// limit the concurrent negotiations and the rate (per minute) of negotiations
+// per source subnet (/24 of v4 and /64 of v6).
+// only the recent subnets will be tracked in a bounded lru.
+type subnetGuard struct {
+	throttled     int64
+	lock          sync.Mutex
+	maxConcurrent int32
+	maxRate       int32
+	subnets       *lrucache.LRUCache
+}
+
+type subnetState struct {
+	active int32
+	window int64 // current minute
+	count  int32
+}
+
+func newSubnetGuard(maxConcurrent, maxRate int) *subnetGuard {
+	return &subnetGuard{
+		maxConcurrent: int32(maxConcurrent),
+		maxRate:       int32(maxRate),
+		subnets:       lrucache.NewLRUCache(SUBNET_TRACK_MAX),
+	}
+}
+
+func subnetOf(addr net.Addr) string {
+	ip := net.ParseIP(ipAddr(addr))
+	if ip == nil {
+		return addr.String()
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		return ip4.Mask(net.CIDRMask(24, 32)).String() + "/24"
+	}
+	return ip.Mask(net.CIDRMask(64, 128)).String() + "/64"
+}
+
+// must call release(subnet) after negotiation if acquired
+func (g *subnetGuard) acquire(subnet string, now time.Time) bool {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	var state *subnetState
+	if v, y := g.subnets.GetNotStaleNow(subnet, now); y {
+		state = v.(*subnetState)
+	} else {
+		state = new(subnetState)
+	}
+	g.subnets.SetNow(subnet, state, now.Add(SUBNET_IDLE_TTL), now)
+
+	if min := now.Unix() / 60; min != state.window {
+		state.window, state.count = min, 0
+	}
+	if (g.maxConcurrent > 0 && state.active >= g.maxConcurrent) ||
+		(g.maxRate > 0 && state.count >= g.maxRate) {
+		atomic.AddInt64(&g.throttled, 1)
+		return false
+	}
+	state.active++
+	state.count++
+	return true
+}
+
+func (g *subnetGuard) release(subnet string) {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	// may be evicted then ignore
+	if v, y := g.subnets.Get(subnet); y {
+		if state := v.(*subnetState); state.active > 0 {
+			state.active--
+		}
+	}
+}
+
+func (g *subnetGuard) String() string {
+	return fmt.Sprintf("Throttled-by-subnet=%d", atomic.LoadInt64(&g.throttled))
+}
+
+// --------------------
+// admitQueue
+// --------------------
+// limit the concurrent negotiations, and when at capacity the waiters will be
+// admitted by priority, the resumptions (known token) before the new handshakes.
+// the waiter will be rejected if queue is full or waited too long.
+type admitQueue struct {
+	lock     sync.Mutex
+	capacity int
+	active   int
+	waiters  [2]*list.List // of chan bool
+	rejected int64
+}
+
+func newAdmitQueue(capacity int) *admitQueue {
+	return &admitQueue{
+		capacity: capacity,
+		waiters:  [2]*list.List{list.New(), list.New()},
+	}
+}
+
+// must call release() after negotiation if acquired
+func (q *admitQueue) acquire(priority int, wait time.Duration) bool {
+	q.lock.Lock()
+	if q.active < q.capacity {
+		q.active++
+		q.lock.Unlock()
+		return true
+	}
+	var queue = q.waiters[priority]
+	if queue.Len() >= ADMIT_QUEUE_MAX {
+		q.rejected++
+		q.lock.Unlock()
+		return false
+	}
+	var ch = make(chan bool, 1)
+	var elem = queue.PushBack(ch)
+	q.lock.Unlock()
+
+	var timer = time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case <-ch:
+		return true
+	case <-timer.C:
+	}
+
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	// may be admitted concurrently
+	select {
+	case <-ch:
+		return true
+	default:
+	}
+	queue.Remove(elem)
+	q.rejected++
+	return false
+}
+
+// hand over the slot to the first waiter of the highest priority
+func (q *admitQueue) release() {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	for _, queue := range q.waiters {
+		if elem := queue.Front(); elem != nil {
+			queue.Remove(elem)
+			elem.Value.(chan bool) <- true
+			return
+		}
+	}
+	q.active--
+}
+
+func (q *admitQueue) String() string {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	return fmt.Sprintf("Negotiating=%d Queued-resume=%d Queued-new=%d Rejected=%d",
+		q.active, q.waiters[PRIORITY_RESUME].Len(), q.waiters[PRIORITY_NEW].Len(), q.rejected)
+}
+
+// --------------------
+// halfOpenGuard
+// --------------------
+// against the slowloris: the connections from accepted to negotiated are
+// capped and the excess are closed without reading, and each one must finish
+// the negotiation in the deadline regardless of the timeouts of reading.
+type halfOpenGuard struct {
+	refused  int64
+	expired  int64
+	active   int32
+	capacity int32
+	timeout  time.Duration
+}
+
+func newHalfOpenGuard(capacity int, timeout time.Duration) *halfOpenGuard {
+	return &halfOpenGuard{capacity: int32(capacity), timeout: timeout}
+}
+
+// must call release() after negotiation if acquired
+func (g *halfOpenGuard) acquire() bool {
+	if atomic.AddInt32(&g.active, 1) > g.capacity {
+		atomic.AddInt32(&g.active, -1)
+		atomic.AddInt64(&g.refused, 1)
+		return false
+	}
+	return true
+}
+
+func (g *halfOpenGuard) release() {
+	atomic.AddInt32(&g.active, -1)
+}
+
+// close the conn at the deadline, the returned func stops watching and
+// reports whether the deadline was exceeded, the same if called again.
+func (g *halfOpenGuard) watch(conn net.Conn) func() bool {
+	var (
+		once    sync.Once
+		expired bool
+		timer   = time.AfterFunc(g.timeout, func() {
+			SafeClose(conn)
+		})
+	)
+	return func() bool {
+		once.Do(func() {
+			if !timer.Stop() {
+				expired = true
+				atomic.AddInt64(&g.expired, 1)
+			}
+		})
+		return expired
+	}
+}
+
+func (g *halfOpenGuard) String() string {
+	return fmt.Sprintf("Half-open=%d/%d Half-open-refused=%d Handshake-timeouts=%d",
+		atomic.LoadInt32(&g.active), g.capacity, atomic.LoadInt64(&g.refused), atomic.LoadInt64(&g.expired))
+}
+
+// --------------------
+// banGuard
+// --------------------
+// against the brute-force: the source ip is banned for the cooldown when its
+// failed negotiations reached the threshold in window, the connections from
+// the banned are closed without reading.
+// only the recent sources will be tracked in a bounded lru.
+type banGuard struct {
+	bans      int64
+	refused   int64
+	lock      sync.Mutex
+	threshold int32
+	cooldown  time.Duration
+	sources   *lrucache.LRUCache
+}
+
+type banState struct {
+	since    time.Time // the first failure in window
+	failures int32
+	until    time.Time
+}
+
+func newBanGuard(threshold int, cooldown time.Duration) *banGuard {
+	return &banGuard{
+		threshold: int32(threshold),
+		cooldown:  cooldown,
+		sources:   lrucache.NewLRUCache(BAN_TRACK_MAX),
+	}
+}
+
+// return false if the source is banned
+func (g *banGuard) admit(ip string, now time.Time) bool {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	if v, y := g.sources.GetNotStaleNow(ip, now); y && now.Before(v.(*banState).until) {
+		atomic.AddInt64(&g.refused, 1)
+		return false
+	}
+	return true
+}
+
+// return true if the source was banned by this failure
+func (g *banGuard) fail(ip string, now time.Time) bool {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	var state *banState
+	if v, y := g.sources.GetNotStaleNow(ip, now); y {
+		state = v.(*banState)
+	} else {
+		state = new(banState)
+	}
+	if now.Sub(state.since) > BAN_FAIL_WINDOW {
+		state.since, state.failures = now, 0
+	}
+	state.failures++
+	var banned = state.failures >= g.threshold
+	if banned {
+		state.until, state.failures = now.Add(g.cooldown), 0
+		atomic.AddInt64(&g.bans, 1)
+	}
+	var expire = state.since.Add(BAN_FAIL_WINDOW)
+	if state.until.After(expire) {
+		expire = state.until
+	}
+	g.sources.SetNow(ip, state, expire, now)
+	return banned
+}
+
+// only the failures before authentication are counted toward bans, the
+// later were of the peers knowing the key, eg. stale tokens after restart,
+// and the timeouts were counted by the halfOpenWatch.
+func banworthy(stage int, err error) bool {
+	return err != nil && err != ERR_SERVER_BUSY && err != ERR_HANDSHAKE_TIMEOUT && stage < STAGE_AUTH
+}
+
+func (g *banGuard) String() string {
+	return fmt.Sprintf("Bans=%d Refused-by-ban=%d", atomic.LoadInt64(&g.bans), atomic.LoadInt64(&g.refused))
+}
+
+// --------------------
+// sourceLimit
+// --------------------
+// the cap of concurrent connections per source ip, from accepted to the
+// tunnel was closed. the excess are closed without reading, so a client
+// cannot consume the whole server, and the established are unaffected.
+type sourceLimit struct {
+	refused  int64
+	lock     sync.Mutex
+	capacity int
+	active   map[string]int
+}
+
+func newSourceLimit(capacity int) *sourceLimit {
+	return &sourceLimit{capacity: capacity, active: make(map[string]int)}
+}
+
+// must call release(ip) after the connection was closed if acquired
+func (l *sourceLimit) acquire(ip string) bool {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if l.active[ip] >= l.capacity {
+		atomic.AddInt64(&l.refused, 1)
+		return false
+	}
+	l.active[ip]++
+	return true
+}
+
+func (l *sourceLimit) release(ip string) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if n := l.active[ip]; n > 1 {
+		l.active[ip] = n - 1
+	} else {
+		delete(l.active, ip)
+	}
+}
+
+func (l *sourceLimit) String() string {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	return fmt.Sprintf("Sources=%d Refused-by-source=%d", len(l.active), atomic.LoadInt64(&l.refused))
+}
+
+// --------------------
+// outboundLimit
+// --------------------
+// the global cap of concurrent destination connections of server,
+// the slot is held by outboundConn until it was closed or shutdown.
+type outboundLimit struct {
+	*admitQueue
+}
+
+func newOutboundLimit(capacity int) *outboundLimit {
+	return &outboundLimit{newAdmitQueue(capacity)}
+}
+
+func (l *outboundLimit) acquire() bool {
+	return l.admitQueue.acquire(PRIORITY_NEW, OUTBOUND_QUEUE_WAIT)
+}
+
+func (l *outboundLimit) String() string {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	return fmt.Sprintf("Outbound=%d/%d Queued-outbound=%d Refused-outbound=%d",
+		l.active, l.capacity, l.waiters[PRIORITY_NEW].Len(), l.rejected)
+}
+
+type outboundConn struct {
+	net.Conn
+	limit *outboundLimit
+	shut  uint32 // TCP_CLOSE_R | TCP_CLOSE_W
+}
+
+func (c *outboundConn) CloseRead() error {
+	closeR(c.Conn)
+	c.shutdown(TCP_CLOSE_R)
+	return nil
+}
+
+func (c *outboundConn) CloseWrite() error {
+	closeW(c.Conn)
+	c.shutdown(TCP_CLOSE_W)
+	return nil
+}
+
+func (c *outboundConn) Close() error {
+	err := c.Conn.Close()
+	c.shutdown(TCP_CLOSED)
+	return err
+}
+
+// release the slot once both directions were shutdown
+func (c *outboundConn) shutdown(mask uint32) {
+	for {
+		old := atomic.LoadUint32(&c.shut)
+		if old|mask == old {
+			return
+		}
+		if atomic.CompareAndSwapUint32(&c.shut, old, old|mask) {
+			if old|mask == TCP_CLOSED {
+				c.limit.release()
+			}
+			return
+		}
+	}
+}
+
+// --------------------
+// probePolicy
+// --------------------
+// the streams transferred nothing and closed quickly are regarded as probes
+// (eg. port scanning through the proxy). they are not counted as streams,
+// and the following opening of the session would be delayed by the penalty.
+// the destinations of probes are logged in LV_ACT_FRM only.
+type probePolicy struct {
+	count     int64
+	threshold time.Duration
+	penalty   time.Duration
+}
+
+func newProbePolicy(threshold, penalty time.Duration) *probePolicy {
+	return &probePolicy{
+		threshold: threshold,
+		penalty:   penalty,
+	}
+}
+
+func (g *probePolicy) isProbe(e *edgeConn, now time.Time) bool {
+	return atomic.LoadInt64(&e.rxBytes) == 0 && atomic.LoadInt64(&e.txBytes) == 0 &&
+		now.Sub(e.meter.start) < g.threshold
+}
+
+// inspect the closed stream
+func (g *probePolicy) inspect(mux *multiplexer, e *edgeConn, now time.Time) {
+	if !g.isProbe(e, now) {
+		return
+	}
+	atomic.StoreUint32(&e.probed, 1)
+	atomic.AddInt64(&g.count, 1)
+	atomic.AddInt64(&mux.streams, -1)
+	if g.penalty > 0 {
+		atomic.StoreInt64(&mux.penalty, now.Add(g.penalty).UnixNano())
+	}
+	if log.V(log.LV_ACT_FRM) {
+		log.Infoln("PROBE", e.dest, "for", e.key)
+	}
+}
+
+// the opening is logged after the threshold unless it was a probe
+func (g *probePolicy) logOpen(e *edgeConn) {
+	time.AfterFunc(g.threshold, func() {
+		if atomic.LoadUint32(&e.probed) == 0 {
+			log.Infoln("OPEN", e.dest, "for", e.key)
+		}
+	})
+}
+
+func (g *probePolicy) String() string {
+	return fmt.Sprintf("Probe-streams=%d", atomic.LoadInt64(&g.count))
+}
+
+// --------------------
+// tokenBucket
+// --------------------
+type tokenBucket struct {
+	lock   sync.Mutex
+	rate   float64 // per second
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(rate, burst int) *tokenBucket {
+	if burst < rate {
+		burst = rate
+	}
+	return &tokenBucket{
+		rate:   float64(rate),
+		burst:  float64(burst),
+		tokens: float64(burst),
+	}
+}
+
+func (b *tokenBucket) allow(now time.Time) bool {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if !b.last.IsZero() {
+		b.tokens += b.rate * now.Sub(b.last).Seconds()
+		if b.tokens > b.burst {
+			b.tokens = b.burst
+		}
+	}
+	b.last = now
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// --------------------
+// dialBudget
+// --------------------
+// the budget of consecutive failures of dialing destinations in the window,
+// to prevent the session from using the server as an amplifier. once it was
+// exhausted, the following openings are delayed with the backoff doubling
+// on every failure, and a success replenishes the budget.
+type dialBudget struct {
+	failures int64
+	lock     sync.Mutex
+	budget   int
+	window   time.Duration
+	streak   int       // consecutive failures
+	first    time.Time // of the streak
+	backoff  time.Duration
+}
+
+func newDialBudget(budget int, window time.Duration) *dialBudget {
+	return &dialBudget{budget: budget, window: window}
+}
+
+// return the backoff if the budget was exhausted
+func (b *dialBudget) record(err error, now time.Time) time.Duration {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if err == nil {
+		b.streak, b.backoff = 0, 0
+		return 0
+	}
+	atomic.AddInt64(&b.failures, 1)
+	if b.streak > 0 && now.Sub(b.first) > b.window {
+		b.streak, b.backoff = 0, 0
+	}
+	if b.streak == 0 {
+		b.first = now
+	}
+	if b.streak++; b.streak < b.budget {
+		return 0
+	}
+	if b.backoff *= 2; b.backoff == 0 {
+		b.backoff = DIAL_BACKOFF
+	} else if b.backoff > DIAL_BACKOFF_MAX {
+		b.backoff = DIAL_BACKOFF_MAX
+	}
+	return b.backoff
+}
+
+func (b *dialBudget) String() string {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	var str = fmt.Sprintf(" Dial-failed=%d", atomic.LoadInt64(&b.failures))
+	if b.backoff > 0 {
+		str += " Dial-backoff=" + b.backoff.String()
+	}
+	return str
+}
+
+// --------------------
+// destGuard
+// --------------------
+// prevent the server from connecting to itself (loop) or internal services (SSRF).
+// the self-connection is always denied, and the deny networks are configurable.
+// the hostname which couldn't be resolved is denied, and the multiplexer
+// dials the checked address rather than resolving again, see filterDest.
+type destGuard struct {
+	port     int
+	selfIPs  []net.IP
+	lock     sync.RWMutex
+	networks []*net.IPNet // could be refreshed by aclSource
+	resolver hostResolver // or system resolver if nil
+}
+
+func newDestGuard(listen *net.TCPAddr, networks []*net.IPNet) *destGuard {
+	var g = &destGuard{
+		port:     listen.Port,
+		networks: networks,
+	}
+	if listen.IP != nil && !listen.IP.IsUnspecified() {
+		g.selfIPs = []net.IP{listen.IP}
+	} else if addrs, err := net.InterfaceAddrs(); err == nil {
+		for _, a := range addrs {
+			if n, y := a.(*net.IPNet); y {
+				g.selfIPs = append(g.selfIPs, n.IP)
+			}
+		}
+	}
+	return g
+}
+
+func parseNetworks(list []string) ([]*net.IPNet, error) {
+	var networks []*net.IPNet
+	for _, item := range list {
+		if item = strings.TrimSpace(item); item == NULL {
+			continue
+		}
+		_, n, err := net.ParseCIDR(item)
+		if err != nil {
+			return nil, err
+		}
+		networks = append(networks, n)
+	}
+	return networks, nil
+}
+
+func (g *destGuard) isSelf(ip net.IP, port int) bool {
+	if port != g.port {
+		return false
+	}
+	if ip.IsLoopback() || ip.IsUnspecified() {
+		return true
+	}
+	for _, self := range g.selfIPs {
+		if self.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// hot-apply to the future stream opens
+func (g *destGuard) setNetworks(networks []*net.IPNet) {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	g.networks = networks
+}
+
+func (g *destGuard) denied(ip net.IP, port int) bool {
+	if g.isSelf(ip, port) {
+		return true
+	}
+	g.lock.RLock()
+	defer g.lock.RUnlock()
+	return inNetworks(ip, g.networks)
+}
+
+// implement Filterable
+// deny if any of resolved addresses was denied
+func (g *destGuard) Filter(host string) bool {
+	h, p, err := net.SplitHostPort(host)
+	if err != nil {
+		return true
+	}
+	port, err := strconv.Atoi(p)
+	if err != nil {
+		return true
+	}
+	var ips []net.IP
+	if ip := net.ParseIP(h); ip != nil {
+		ips = []net.IP{ip}
+	} else {
+		if g.resolver != nil {
+			ips, err = g.resolver.LookupIP(h)
+		} else {
+			ips, err = net.LookupIP(h)
+		}
+		if err != nil {
+			// fail closed
+			return true
+		}
+	}
+	for _, ip := range ips {
+		if g.denied(ip, port) {
+			return true
+		}
+	}
+	return false
+}
+
+// combination of filters, denied by any one
+type filterChain []Filterable
+
+func (c filterChain) Filter(host string) bool {
+	for _, f := range c {
+		if f.Filter(host) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,720 @@
+package tunnel
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestStormGuardPacing(t *testing.T) {
+	var (
+		threshold = 50
+		rate      = 5
+		g         = newStormGuard(threshold, rate)
+		now       = time.Unix(1e9, 0)
+	)
+	// normal arrivals are all admitted
+	for i := 0; i < threshold; i++ {
+		if !g.admit(now) {
+			t.Fatalf("arrival=%d was deferred before storm", i)
+		}
+	}
+	// flooding in the following seconds
+	for sec := 1; sec <= 3; sec++ {
+		now = now.Add(time.Second)
+		var admitted, expected = 0, rate
+		if sec == 1 { // storm was detected after arrivals exceeded threshold
+			expected = threshold
+		}
+		for i := 0; i < threshold*4; i++ {
+			if g.admit(now) {
+				admitted++
+			}
+		}
+		if admitted != expected {
+			t.Errorf("sec=%d admitted=%d expected=%d", sec, admitted, expected)
+		}
+	}
+	// storm calms down after cooldown
+	now = now.Add(time.Second * (STORM_COOLDOWN + 1))
+	for i := 0; i < threshold; i++ {
+		if !g.admit(now) {
+			t.Fatalf("arrival=%d was deferred after storm", i)
+		}
+	}
+	if g.deferred != int64(threshold*3+2*(threshold*4-rate)) {
+		t.Errorf("deferred=%d", g.deferred)
+	}
+}
+
+func TestSubnetGuard(t *testing.T) {
+	var (
+		g   = newSubnetGuard(3, 5)
+		now = time.Unix(1e9, 0)
+		net = func(ip string) string {
+			return subnetOf(&net.TCPAddr{IP: net.ParseIP(ip), Port: 1000})
+		}
+	)
+	if s := net("10.1.2.3"); s != "10.1.2.0/24" {
+		t.Fatalf("subnet=%s", s)
+	}
+	if s := net("2001:db8:1:2:3::4"); s != "2001:db8:1:2::/64" {
+		t.Fatalf("subnet=%s", s)
+	}
+	// concurrency spread across IPs within one subnet
+	for i := 1; i <= 3; i++ {
+		if !g.acquire(net(fmt.Sprintf("10.1.2.%d", i)), now) {
+			t.Fatalf("ip=%d was throttled", i)
+		}
+	}
+	if g.acquire(net("10.1.2.200"), now) {
+		t.Fatalf("concurrency exceeded")
+	}
+	// other subnet is unaffected
+	if !g.acquire(net("10.1.3.1"), now) {
+		t.Fatalf("other subnet was throttled")
+	}
+	g.release(net("10.1.2.1"))
+	if !g.acquire(net("10.1.2.4"), now) {
+		t.Fatalf("throttled after released")
+	}
+	// rate: 4 negotiations were made in this minute
+	g.release(net("10.1.2.2"))
+	g.release(net("10.1.2.3"))
+	if !g.acquire(net("10.1.2.5"), now) || g.acquire(net("10.1.2.6"), now) {
+		t.Fatalf("rate limit failed")
+	}
+	// next minute
+	g.release(net("10.1.2.5"))
+	if !g.acquire(net("10.1.2.6"), now.Add(time.Minute)) {
+		t.Fatalf("throttled in next minute")
+	}
+	if g.throttled != 2 {
+		t.Errorf("throttled=%d", g.throttled)
+	}
+}
+
+// resolve the names to the public address for the first lookups, then to
+// the loopback, and fail the invalid
+type rebindResolver struct {
+	public  int
+	lookups int
+}
+
+func (r *rebindResolver) LookupIP(host string) ([]net.IP, error) {
+	if strings.HasSuffix(host, ".invalid") {
+		return nil, &net.DNSError{Err: "no such host", Name: host}
+	}
+	if r.lookups++; r.lookups > r.public {
+		return []net.IP{net.IPv4(127, 0, 0, 1)}, nil
+	}
+	return []net.IP{net.IPv4(8, 8, 8, 8)}, nil
+}
+
+func TestDestGuard(t *testing.T) {
+	networks, err := parseNetworks(DEFAULT_DENY_NETWORKS)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var (
+		listen   = &net.TCPAddr{IP: net.ParseIP("203.0.113.5"), Port: 9008}
+		defaults = newDestGuard(listen, networks)
+		off      = newDestGuard(listen, nil)
+	)
+	var cases = []struct {
+		host         string
+		denied, self bool
+	}{
+		{"203.0.113.5:9008", true, true}, // self
+		{"127.0.0.1:9008", true, true},
+		{"[::1]:9008", true, true},
+		{"localhost:9008", true, true},
+		{"203.0.113.5:80", false, false},
+		{"127.0.0.1:80", true, false}, // loopback
+		{"[::ffff:127.0.0.1]:80", true, false},
+		{"localhost:80", true, false},
+		{"169.254.169.254:80", true, false}, // metadata service
+		{"192.168.1.1:80", true, false},
+		{"[fd00::1]:80", true, false},
+		{"8.8.8.8:53", false, false},
+	}
+	for _, c := range cases {
+		if defaults.Filter(c.host) != c.denied {
+			t.Errorf("host=%s expected denied=%v", c.host, c.denied)
+		}
+		// overridden for trusted setups but self-connection
+		if off.Filter(c.host) != c.self {
+			t.Errorf("host=%s expected denied=%v when off", c.host, c.self)
+		}
+	}
+	// the unresolved fails closed
+	off.resolver = &rebindResolver{}
+	if !off.Filter("host.invalid:80") {
+		t.Errorf("the unresolved was not denied")
+	}
+
+	// the checked address is dialed, though the name was rebound later
+	var (
+		mux      = newServerMultiplexer()
+		resolver = &rebindResolver{public: 2}
+	)
+	defer mux.destroy()
+	defaults.resolver, mux.resolver, mux.filter = resolver, resolver, defaults
+	addr, denied, err := mux.filterDest("rebind.example:80")
+	if addr != "8.8.8.8:80" || denied || err != nil {
+		t.Errorf("addr=%s denied=%v err=%v", addr, denied, err)
+	}
+	if addr, _, _ = mux.filterDest("rebind.example:80"); addr != "127.0.0.1:80" {
+		t.Errorf("addr=%s after rebound", addr)
+	}
+	if _, denied, _ = mux.filterDest("rebind.example:80"); !denied {
+		t.Errorf("the rebound was not denied")
+	}
+	if _, _, err = mux.filterDest("host.invalid:80"); err == nil {
+		t.Errorf("the unresolved was not failed")
+	}
+	if _, err = parseNetworks([]string{"10.0.0.0/8", "10.0.0.1"}); err == nil {
+		t.Errorf("expected error for invalid cidr")
+	}
+}
+
+func TestAdmitQueuePriority(t *testing.T) {
+	var (
+		q     = newAdmitQueue(1)
+		order = make(chan int, 4)
+	)
+	if !q.acquire(PRIORITY_NEW, time.Second) {
+		t.Fatal("not admitted under capacity")
+	}
+	var waitFor = func(n int) {
+		for i := 0; i < 100; i++ {
+			q.lock.Lock()
+			l := q.waiters[0].Len() + q.waiters[1].Len()
+			q.lock.Unlock()
+			if l == n {
+				return
+			}
+			time.Sleep(time.Millisecond * 10)
+		}
+		t.Fatalf("waiters != %d", n)
+	}
+	// queued new handshake before resumption
+	for i, priority := range []int{PRIORITY_NEW, PRIORITY_RESUME} {
+		go func(priority int) {
+			if q.acquire(priority, time.Second*5) {
+				order <- priority
+				q.release()
+			}
+		}(priority)
+		waitFor(i + 1)
+	}
+	q.release()
+	if first, second := <-order, <-order; first != PRIORITY_RESUME || second != PRIORITY_NEW {
+		t.Errorf("admitted order %d, %d", first, second)
+	}
+	// rejected after waited
+	q.acquire(PRIORITY_NEW, time.Second)
+	if q.acquire(PRIORITY_NEW, time.Millisecond*50) || q.rejected != 1 {
+		t.Errorf("expected to be rejected")
+	}
+	q.release()
+	if q.active != 0 || !strings.Contains(q.String(), "Rejected=1") {
+		t.Errorf("unexpected state %s", q)
+	}
+}
+
+func TestHalfOpenGuard(t *testing.T) {
+	serv := newHandshakeServer(t)
+	serv.skew = newSkewMeter(TIME_ERROR)
+	serv.updateNow()
+	serv.halfOpen = newHalfOpenGuard(1, time.Millisecond*200)
+	var (
+		c1, s1 = tcpPair(t)
+		done   = make(chan bool)
+		start  = time.Now()
+	)
+	defer c1.Close()
+	// the slow client sends nothing
+	go func() {
+		serv.TunnelServe(s1)
+		close(done)
+	}()
+	for i := 0; atomic.LoadInt32(&serv.halfOpen.active) == 0 && i < 100; i++ {
+		time.Sleep(time.Millisecond * 10)
+	}
+	// the excess is closed at once
+	c2, s2 := tcpPair(t)
+	defer c2.Close()
+	serv.TunnelServe(s2)
+	c2.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := c2.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("the excess was not closed %v", err)
+	}
+	select {
+	case <-done:
+	case <-time.After(GENERAL_SO_TIMEOUT / 2):
+		t.Fatalf("the slow one was not closed at deadline")
+	}
+	if d := time.Since(start); d < time.Millisecond*200 {
+		t.Errorf("closed before deadline %s", d)
+	}
+	if stats := serv.halfOpen.String(); stats != "Half-open=0/1 Half-open-refused=1 Handshake-timeouts=1" {
+		t.Errorf("unexpected stats %s", stats)
+	}
+}
+
+// the probe is held by tarpit beyond the deadline of half-open
+func TestHalfOpenTarpit(t *testing.T) {
+	serv := newHandshakeServer(t)
+	serv.skew = newSkewMeter(TIME_ERROR)
+	serv.updateNow()
+	serv.halfOpen = newHalfOpenGuard(1, time.Millisecond*100)
+	serv.tarpit = newTarpit(TARPIT_TLS, time.Millisecond*400, 1)
+	var (
+		c, s  = tcpPair(t)
+		start = time.Now()
+	)
+	defer c.Close()
+	go serv.TunnelServe(s)
+	c.Write([]byte("GET / HTTP/1.1\r\nHost: example.com\r\nCookie: " +
+		strings.Repeat("x", DPH_P2) + "\r\n\r\n"))
+	c.SetReadDeadline(time.Now().Add(GENERAL_SO_TIMEOUT))
+	reply, _ := ioutil.ReadAll(c)
+	if !bytes.Equal(reply, tarpitTLSAlert) {
+		t.Errorf("cut by the deadline reply=%q", reply)
+	}
+	if d := time.Since(start); d < time.Millisecond*400 {
+		t.Errorf("released in %s", d)
+	}
+	if stats := serv.halfOpen.String(); !strings.Contains(stats, "Handshake-timeouts=0") {
+		t.Errorf("unexpected stats %s", stats)
+	}
+}
+
+// closed by the watch without breaking the reading
+type watchedConn struct {
+	net.Conn
+	closed chan bool
+}
+
+func (c *watchedConn) Close() error {
+	close(c.closed)
+	return nil
+}
+
+// the session resumed at the deadline is not destroyed with the tunnel
+func TestHalfOpenResume(t *testing.T) {
+	serv := newHandshakeServer(t)
+	serv.skew = newSkewMeter(TIME_ERROR)
+	serv.updateNow()
+	serv.halfOpen = newHalfOpenGuard(1, time.Nanosecond)
+	var (
+		alice = newTestSession(serv, "alice")
+		c, s  = tcpPair(t)
+		raw   = &watchedConn{s, make(chan bool)}
+		done  = make(chan bool)
+	)
+	defer c.Close()
+	defer s.Close()
+	serv.sessionMgr.register(alice)
+	tokens := serv.sessionMgr.createTokens(alice, 1)
+	go func() {
+		serv.TunnelServe(raw)
+		close(done)
+	}()
+	<-raw.closed
+	w := newMsgWriter().WriteMsg(makeDbcHello(TYPE_RES, serv.sharedKey))
+	w.WriteMsg(tokens[1 : 1+TKSZ]).WriteTo(c)
+	<-done
+	if atomic.LoadInt32(&alice.closed) != 0 {
+		t.Errorf("the resumed session was destroyed")
+	}
+	if stats := serv.halfOpen.String(); !strings.Contains(stats, "Handshake-timeouts=1") {
+		t.Errorf("unexpected stats %s", stats)
+	}
+}
+
+func TestBanGuard(t *testing.T) {
+	var (
+		g   = newBanGuard(3, time.Minute)
+		now = time.Unix(1e9, 0)
+	)
+	// the failures out of window are forgotten
+	g.fail("10.0.0.1", now)
+	g.fail("10.0.0.1", now)
+	now = now.Add(BAN_FAIL_WINDOW + time.Second)
+	if g.fail("10.0.0.1", now) || g.fail("10.0.0.1", now) || !g.admit("10.0.0.1", now) {
+		t.Fatalf("banned by the failures out of window")
+	}
+	if !g.fail("10.0.0.1", now) {
+		t.Fatalf("not banned at threshold")
+	}
+	if g.admit("10.0.0.1", now.Add(time.Second)) || !g.admit("10.0.0.2", now) {
+		t.Errorf("unexpected admission")
+	}
+	if !g.admit("10.0.0.1", now.Add(time.Minute)) {
+		t.Errorf("banned after cooldown")
+	}
+	if stats := g.String(); stats != "Bans=1 Refused-by-ban=1" {
+		t.Errorf("unexpected stats %s", stats)
+	}
+}
+
+func TestBanworthy(t *testing.T) {
+	for _, c := range []struct {
+		stage int
+		err   error
+		want  bool
+	}{
+		{STAGE_PRE_AUTH, VALIDATION_FAILED, true},
+		{STAGE_DH, io.EOF, true},
+		{STAGE_IDENTITY, VALIDATION_FAILED, true},
+		{STAGE_PRE_AUTH, nil, false},
+		{STAGE_PRE_AUTH, ERR_SERVER_BUSY, false},
+		{STAGE_CIPHER, ERR_HANDSHAKE_TIMEOUT, false},
+		{STAGE_AUTH, VALIDATION_FAILED, false},
+		{STAGE_RESUME, VALIDATION_FAILED, false},
+		{STAGE_RESUME, TOKEN_MISBOUND.Apply("u@c"), false},
+		{STAGE_RESUME, TOKEN_REPLAYED.Apply("u@c"), false},
+	} {
+		if banworthy(c.stage, c.err) != c.want {
+			t.Errorf("banworthy(%s, %v) != %v", stageNames[c.stage], c.err, c.want)
+		}
+	}
+}
+
+// the source is banned after the unrecognized request
+func TestBannedConnection(t *testing.T) {
+	serv := newHandshakeServer(t)
+	serv.skew = newSkewMeter(TIME_ERROR)
+	serv.updateNow()
+	serv.bans = newBanGuard(1, time.Minute)
+	c1, s1 := tcpPair(t)
+	defer c1.Close()
+	c1.Write(make([]byte, DPH_P2))
+	serv.TunnelServe(s1)
+
+	c2, s2 := tcpPair(t)
+	defer c2.Close()
+	serv.TunnelServe(s2)
+	c2.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := c2.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("the banned was not closed %v", err)
+	}
+	if stats := serv.bans.String(); stats != "Bans=1 Refused-by-ban=1" {
+		t.Errorf("unexpected stats %s", stats)
+	}
+}
+
+func TestSourceLimit(t *testing.T) {
+	l := newSourceLimit(2)
+	if !l.acquire("10.0.0.1") || !l.acquire("10.0.0.1") {
+		t.Fatalf("refused under the limit")
+	}
+	if l.acquire("10.0.0.1") || !l.acquire("10.0.0.2") {
+		t.Errorf("unexpected admission")
+	}
+	l.release("10.0.0.1")
+	if !l.acquire("10.0.0.1") {
+		t.Errorf("refused after released")
+	}
+	l.release("10.0.0.2")
+	if stats := l.String(); stats != "Sources=1 Refused-by-source=1" {
+		t.Errorf("unexpected stats %s", stats)
+	}
+}
+
+// the failed negotiation releases the slot, and the excess is closed at once
+func TestSourceLimitOfConnections(t *testing.T) {
+	serv := newHandshakeServer(t)
+	serv.skew = newSkewMeter(TIME_ERROR)
+	serv.updateNow()
+	serv.perSource = newSourceLimit(1)
+	c1, s1 := tcpPair(t)
+	defer c1.Close()
+	c1.Write(make([]byte, DPH_P2))
+	serv.TunnelServe(s1)
+	if stats := serv.perSource.String(); stats != "Sources=0 Refused-by-source=0" {
+		t.Fatalf("the slot was not released %s", stats)
+	}
+
+	c2, s2 := tcpPair(t)
+	defer c2.Close()
+	go serv.TunnelServe(s2)
+	for i := 0; serv.perSource.String() == "Sources=0 Refused-by-source=0" && i < 100; i++ {
+		time.Sleep(time.Millisecond * 10)
+	}
+	c3, s3 := tcpPair(t)
+	defer c3.Close()
+	serv.TunnelServe(s3)
+	c3.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := c3.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("the excess was not closed %v", err)
+	}
+	if stats := serv.perSource.String(); stats != "Sources=1 Refused-by-source=1" {
+		t.Errorf("unexpected stats %s", stats)
+	}
+}
+
+func TestProbePolicy(t *testing.T) {
+	var (
+		g   = newProbePolicy(time.Second, time.Millisecond*100)
+		mux = newServerMultiplexer()
+		now = time.Now()
+	)
+	defer mux.destroy()
+	var newEdge = func(rx, tx int64, age time.Duration) *edgeConn {
+		mux.streams++
+		e := newEdgeConn(mux, "key", "dest:80", nil, nil)
+		e.rxBytes, e.txBytes, e.meter.start = rx, tx, now.Add(-age)
+		return e
+	}
+	// near-zero bytes and long-lived
+	g.inspect(mux, newEdge(1, 0, 0), now)
+	g.inspect(mux, newEdge(0, 1, 0), now)
+	g.inspect(mux, newEdge(0, 0, time.Second*2), now)
+	if g.count != 0 || mux.streams != 3 || mux.penalty != 0 {
+		t.Fatalf("not probes but count=%d streams=%d", g.count, mux.streams)
+	}
+	// zero bytes
+	probe := newEdge(0, 0, time.Millisecond*10)
+	g.inspect(mux, probe, now)
+	if g.count != 1 || mux.streams != 3 {
+		t.Errorf("probe count=%d streams=%d", g.count, mux.streams)
+	}
+	// not logged as the opening
+	if probe.probed == 0 {
+		t.Errorf("probe was not marked")
+	}
+	if mux.penalty != now.Add(g.penalty).UnixNano() {
+		t.Errorf("not penalized")
+	}
+}
+
+func TestStreamOpenRate(t *testing.T) {
+	var (
+		mux = newServerMultiplexer()
+		now = time.Unix(1e9, 0)
+		n   int
+	)
+	defer mux.destroy()
+	mux.opens = newTokenBucket(10, 20)
+	// opening 100 streams within 1s
+	for i := 0; i < 100; i++ {
+		if mux.admitOpen(now.Add(time.Duration(i) * time.Millisecond * 10)) {
+			n++
+		}
+	}
+	// burst + rate*0.99s
+	if n < 29 || n > 30 || mux.throttled != int64(100-n) {
+		t.Errorf("admitted=%d throttled=%d", n, mux.throttled)
+	}
+	// refilled later
+	if !mux.admitOpen(now.Add(time.Second * 2)) {
+		t.Errorf("not refilled")
+	}
+}
+
+func TestMaxStreams(t *testing.T) {
+	c, s := tcpPair(t)
+	defer c.Close()
+	var (
+		mux = newServerMultiplexer()
+		tun = NewConn(s, nullCipherKit)
+		key = sessionKey(tun, 1)
+	)
+	defer mux.destroy()
+	mux.streamCap = 2
+	if !mux.acquireStream() || !mux.acquireStream() || !mux.streamsFull() {
+		t.Fatalf("active=%d", mux.active)
+	}
+	// refused rather than queued
+	mux.router.preRegister(key)
+	mux.connectToDest(&frame{data: []byte("127.0.0.1:1"), sid: 1}, key, tun)
+	header := make([]byte, FRAME_HEADER_LEN)
+	c.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := io.ReadFull(c, header); err != nil {
+		t.Fatal(err)
+	}
+	if frm, _ := parse_frame(header); frm == nil || frm.action != FRAME_ACTION_OPEN_N {
+		t.Errorf("unexpected reply %s", frm)
+	}
+	if mux.active != 2 || mux.overflows != 1 {
+		t.Errorf("active=%d overflows=%d", mux.active, mux.overflows)
+	}
+	mux.releaseStream()
+	if mux.streamsFull() || !mux.acquireStream() {
+		t.Errorf("not released")
+	}
+
+	// advertised to clients, none by the old servers
+	var p = new(tunParams)
+	p.deserialize((&tunParams{tokenSize: TKSZ, maxStreams: 300}).serialize())
+	if p.maxStreams != 300 {
+		t.Errorf("maxStreams=%d", p.maxStreams)
+	}
+	p = new(tunParams)
+	p.deserialize((&tunParams{tokenSize: TKSZ, maxStreams: 300}).serialize()[:13])
+	if p.maxStreams != 0 {
+		t.Errorf("maxStreams=%d", p.maxStreams)
+	}
+}
+
+func TestOutboundLimit(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			if _, err := ln.Accept(); err != nil {
+				return
+			}
+		}
+	}()
+	var (
+		mux    = newServerMultiplexer()
+		target = ln.Addr().String()
+		conns  []net.Conn
+	)
+	defer mux.destroy()
+	mux.outbound = newOutboundLimit(2)
+	for i := 0; i < 2; i++ {
+		conn, err := mux.dialOutbound(target)
+		if err != nil {
+			t.Fatal(err)
+		}
+		conns = append(conns, conn)
+	}
+	// queued then admitted after a connection was shutdown
+	var queued = make(chan error, 1)
+	go func() {
+		conn, err := mux.dialOutbound(target)
+		if err == nil {
+			conns = append(conns, conn)
+		}
+		queued <- err
+	}()
+	time.Sleep(time.Millisecond * 100)
+	closeR(conns[0])
+	closeW(conns[0])
+	if err = <-queued; err != nil {
+		t.Fatalf("queued dialing failed %v", err)
+	}
+	// refused at cap
+	start := time.Now()
+	if _, err = mux.dialOutbound(target); err != ERR_OUTBOUND_FULL {
+		t.Errorf("expected refusal but %v", err)
+	}
+	if d := time.Since(start); d < OUTBOUND_QUEUE_WAIT {
+		t.Errorf("refused without waiting %s", d)
+	}
+	if s := mux.outbound.String(); !strings.Contains(s, "Outbound=2/2") || !strings.Contains(s, "Refused-outbound=1") {
+		t.Errorf("unexpected stats %s", s)
+	}
+	for _, c := range conns {
+		c.Close()
+	}
+	if s := mux.outbound.String(); !strings.Contains(s, "Outbound=0/2") {
+		t.Errorf("slots were not released %s", s)
+	}
+}
+
+func TestDialBudget(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+	// a closed port
+	closed, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	closed.Close()
+
+	c, s := tcpPair(t)
+	defer c.Close()
+	go io.Copy(ioutil.Discard, c)
+	var (
+		mux = newServerMultiplexer()
+		tun = NewConn(s, nullCipherKit)
+	)
+	defer mux.destroy()
+	mux.dials = newDialBudget(3, time.Minute)
+	open := func(target string) time.Duration {
+		var (
+			key   = sessionKey(tun, 1)
+			start = time.Now()
+		)
+		mux.router.preRegister(key)
+		mux.connectToDest(&frame{data: []byte(target), sid: 1}, key, tun)
+		return time.Since(start)
+	}
+	for i := 1; i <= 3; i++ {
+		open(closed.Addr().String())
+		if throttled := atomic.LoadInt64(&mux.penalty) > time.Now().UnixNano(); throttled != (i == 3) {
+			t.Errorf("failures=%d throttled=%t", i, throttled)
+		}
+	}
+	if s := mux.dials.String(); s != " Dial-failed=3 Dial-backoff=1s" {
+		t.Errorf("unexpected stats %q", s)
+	}
+	// delayed and backoff
+	if d := open(closed.Addr().String()); d < time.Millisecond*900 {
+		t.Errorf("not delayed %s", d)
+	}
+	if s := mux.dials.String(); s != " Dial-failed=4 Dial-backoff=2s" {
+		t.Errorf("unexpected stats %q", s)
+	}
+	// skip the delay, then replenished by success
+	atomic.StoreInt64(&mux.penalty, 0)
+	open(ln.Addr().String())
+	open(closed.Addr().String())
+	if atomic.LoadInt64(&mux.penalty) > time.Now().UnixNano() {
+		t.Errorf("throttled after replenished")
+	}
+	if s := mux.dials.String(); s != " Dial-failed=5" {
+		t.Errorf("unexpected stats %q", s)
+	}
+}
+
+func TestDialBudgetWindow(t *testing.T) {
+	var (
+		b   = newDialBudget(2, time.Minute)
+		now = time.Now()
+		err = fmt.Errorf("refused")
+	)
+	if b.record(err, now) != 0 || b.record(err, now) != DIAL_BACKOFF {
+		t.Fatalf("not exhausted")
+	}
+	if d := b.record(err, now); d != DIAL_BACKOFF*2 {
+		t.Errorf("backoff=%s", d)
+	}
+	// out of window
+	if d := b.record(err, now.Add(time.Minute*2)); d != 0 {
+		t.Errorf("backoff=%s out of window", d)
+	}
+	for i := 0; i < 10; i++ {
+		b.record(err, now.Add(time.Minute*2))
+	}
+	if b.backoff != DIAL_BACKOFF_MAX {
+		t.Errorf("backoff=%s exceeds max", b.backoff)
+	}
+}
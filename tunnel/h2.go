@@ -0,0 +1,271 @@
+package tunnel
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Lafeng/deblocus/exception"
+	log "github.com/Lafeng/deblocus/glog"
+)
+
+var (
+	H2_HANDSHAKE_FAILED = exception.New("HTTP/2 handshake failed")
+	H2_TIMEOUT          = &h2Timeout{}
+)
+
+type h2Timeout struct{}
+
+func (h2Timeout) Error() string   { return "HTTP/2 stream read timeout" }
+func (h2Timeout) Timeout() bool   { return true }
+func (h2Timeout) Temporary() bool { return true }
+
+// --------------------
+// h2Conn
+// --------------------
+// the tunnel carried by a full duplex HTTP/2 stream, the client posts the
+// request body and the server answers the response body, so it could sit
+// behind the reverse proxies forwarding HTTP/2 only.
+// the stream could not be interrupted, so the read deadline is emulated by
+// the reader in background, and the write deadline is ignored that the
+// blocked writing is broken by closing.
+type h2Conn struct {
+	body      io.ReadCloser // incoming
+	writer    io.Writer     // outgoing
+	flusher   http.Flusher
+	cancel    func()
+	laddr     net.Addr
+	raddr     net.Addr
+	chunks    chan []byte
+	chunk     []byte // of pending, recycled after consumed
+	pending   []byte
+	readErr   error
+	lock      sync.Mutex
+	deadline  time.Time
+	closeOnce sync.Once
+	closed    chan struct{}
+}
+
+func newH2Conn(body io.ReadCloser, writer io.Writer, laddr, raddr net.Addr) *h2Conn {
+	c := &h2Conn{
+		body:   body,
+		writer: writer,
+		laddr:  laddr,
+		raddr:  raddr,
+		chunks: make(chan []byte, 4),
+		closed: make(chan struct{}),
+	}
+	c.flusher, _ = writer.(http.Flusher)
+	go c.readLoop()
+	return c
+}
+
+func (c *h2Conn) readLoop() {
+	defer close(c.chunks)
+	for {
+		buf := bytePool.Get(FRAME_MAX_LEN)
+		n, err := c.body.Read(buf)
+		if n > 0 {
+			select {
+			case c.chunks <- buf[:n]:
+			case <-c.closed:
+				bytePool.Put(buf)
+				return
+			}
+		} else {
+			bytePool.Put(buf)
+		}
+		if err != nil {
+			c.readErr = err
+			return
+		}
+	}
+}
+
+func (c *h2Conn) Read(b []byte) (int, error) {
+	if len(c.pending) == 0 {
+		var timeout <-chan time.Time
+		c.lock.Lock()
+		deadline := c.deadline
+		c.lock.Unlock()
+		if !deadline.IsZero() {
+			timer := time.NewTimer(deadline.Sub(time.Now()))
+			defer timer.Stop()
+			timeout = timer.C
+		}
+		select {
+		case chunk, ok := <-c.chunks:
+			if !ok {
+				return 0, c.readErr
+			}
+			c.chunk, c.pending = chunk, chunk
+		case <-timeout:
+			return 0, H2_TIMEOUT
+		}
+	}
+	n := copy(b, c.pending)
+	c.pending = c.pending[n:]
+	if len(c.pending) == 0 {
+		// consumed then recycled
+		bytePool.Put(c.chunk)
+		c.chunk = nil
+	}
+	return n, nil
+}
+
+func (c *h2Conn) Write(b []byte) (int, error) {
+	select {
+	case <-c.closed:
+		return 0, io.ErrClosedPipe
+	default:
+	}
+	n, err := c.writer.Write(b)
+	if err == nil && c.flusher != nil {
+		c.flusher.Flush()
+	}
+	return n, err
+}
+
+func (c *h2Conn) Close() error {
+	c.closeOnce.Do(func() {
+		close(c.closed)
+		if w, y := c.writer.(io.Closer); y {
+			w.Close()
+		}
+		c.body.Close()
+		if c.cancel != nil {
+			c.cancel()
+		}
+	})
+	return nil
+}
+
+func (c *h2Conn) LocalAddr() net.Addr  { return c.laddr }
+func (c *h2Conn) RemoteAddr() net.Addr { return c.raddr }
+
+func (c *h2Conn) SetDeadline(t time.Time) error {
+	return c.SetReadDeadline(t)
+}
+
+func (c *h2Conn) SetReadDeadline(t time.Time) error {
+	c.lock.Lock()
+	c.deadline = t
+	c.lock.Unlock()
+	return nil
+}
+
+func (c *h2Conn) SetWriteDeadline(t time.Time) error {
+	return nil
+}
+
+// post the stream to https:// url, the transport must be capable of HTTP/2
+func dialHTTP2(rawURL string, transport http.RoundTripper, timeout time.Duration) (net.Conn, error) {
+	var (
+		laddr, raddr net.Addr
+		reader, pw   = io.Pipe()
+		ctx, cancel  = context.WithCancel(context.Background())
+	)
+	trace := &httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) {
+			laddr, raddr = info.Conn.LocalAddr(), info.Conn.RemoteAddr()
+		},
+	}
+	req, err := http.NewRequest("POST", rawURL, reader)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	req = req.WithContext(httptrace.WithClientTrace(ctx, trace))
+	req.Header.Set("Content-Type", "application/octet-stream")
+	// the transport waits for the body writing on error
+	timer := time.AfterFunc(timeout, func() {
+		cancel()
+		reader.Close()
+	})
+	resp, err := transport.RoundTrip(req)
+	if !timer.Stop() && err == nil {
+		resp.Body.Close()
+		err = H2_HANDSHAKE_FAILED.Apply("timeout")
+	}
+	if err == nil && (resp.StatusCode != http.StatusOK || resp.ProtoMajor != 2) {
+		resp.Body.Close()
+		err = H2_HANDSHAKE_FAILED.Apply(resp.Proto + " " + resp.Status)
+	}
+	if err != nil {
+		cancel()
+		pw.Close()
+		return nil, err
+	}
+	conn := newH2Conn(resp.Body, pw, laddr, raddr)
+	conn.cancel = cancel
+	return conn, nil
+}
+
+// --------------------
+// HTTP/2 listener
+// --------------------
+// the streams posted to path are served as connections
+func http2Handler(path string, serve func(net.Conn)) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc(path, func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" || r.ProtoMajor != 2 {
+			http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+			if log.V(log.LV_WARN) {
+				log.Warningf("Rejected %s %s from=%s", r.Proto, r.Method, r.RemoteAddr)
+			}
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+		w.(http.Flusher).Flush()
+		laddr, y := r.Context().Value(http.LocalAddrContextKey).(*net.TCPAddr)
+		if !y {
+			laddr = new(net.TCPAddr)
+		}
+		raddr, _ := net.ResolveTCPAddr("tcp", r.RemoteAddr)
+		conn := newH2Conn(r.Body, w, laddr, raddr)
+		serve(conn)
+		// the stream is ended by returning
+		select {
+		case <-conn.closed:
+		case <-r.Context().Done():
+			conn.Close()
+		}
+	})
+	return mux
+}
+
+// return nil if the HTTP/2 transport is not enabled
+func (t *Server) ListenHTTP2() (net.Listener, error) {
+	if t.HTTP2 == NULL {
+		return nil, nil
+	}
+	addr, path, err := parseListenPath(t.HTTP2)
+	if err != nil {
+		return nil, CONF_ERROR.Apply("HTTP2")
+	}
+	config, err := loadServerTLSConfig(t.TLSCert, t.TLSKey, "h2")
+	if err != nil {
+		return nil, err
+	}
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	srv := &http.Server{Handler: http2Handler(path, t.TunnelServe), TLSConfig: config}
+	go srv.ServeTLS(ln, NULL, NULL)
+	return ln, nil
+}
+
+func validateHTTP2URL(rawURL string) error {
+	u, err := url.Parse(rawURL)
+	if err != nil || !strings.EqualFold(u.Scheme, "https") || u.Host == NULL {
+		return CONF_ERROR.Apply("HTTP2")
+	}
+	return nil
+}
@@ -0,0 +1,87 @@
+package tunnel
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestHTTP2Relay(t *testing.T) {
+	dir, err := ioutil.TempDir(NULL, "h2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	certFile, keyFile := writeTestCert(t, dir, "example.com")
+	config, err := loadServerTLSConfig(certFile, keyFile, "h2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var echo = func(conn net.Conn) {
+		go func() {
+			io.Copy(conn, conn)
+			conn.Close()
+		}()
+	}
+	srv := &http.Server{Handler: http2Handler("/tunnel", echo), TLSConfig: config}
+	go srv.ServeTLS(ln, NULL, NULL)
+	defer srv.Close()
+
+	clientConfig, _ := newClientTLSConfig("example.com", certFile)
+	clientConfig.NextProtos = nil
+	var (
+		transport = &http.Transport{TLSClientConfig: clientConfig, ForceAttemptHTTP2: true}
+		url       = "https://" + ln.Addr().String() + "/tunnel"
+	)
+	defer transport.CloseIdleConnections()
+
+	conn, err := dialHTTP2(url, transport, GENERAL_SO_TIMEOUT)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if _, y := conn.LocalAddr().(*net.TCPAddr); !y {
+		t.Errorf("local addr %v", conn.LocalAddr())
+	}
+	for _, size := range []int{1, FRAME_MAX_LEN, FRAME_MAX_LEN * 3} {
+		data := randArray(size)
+		go conn.Write(data)
+		buf := make([]byte, size)
+		if _, err = io.ReadFull(conn, buf); err != nil {
+			t.Fatal(size, err)
+		}
+		if !bytes.Equal(data, buf) {
+			t.Fatalf("size=%d echo mismatched", size)
+		}
+	}
+	// the stream survives the read timeout
+	conn.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	if _, err = conn.Read(make([]byte, 1)); !IsTimeout(err) {
+		t.Fatalf("read without timeout %v", err)
+	}
+	conn.SetReadDeadline(ZERO_TIME)
+	conn.Write([]byte("ping"))
+	buf := make([]byte, 4)
+	if _, err = io.ReadFull(conn, buf); err != nil || string(buf) != "ping" {
+		t.Errorf("read %q %v", buf, err)
+	}
+
+	// not HTTP/2
+	h1 := &http.Transport{TLSClientConfig: clientConfig}
+	if _, err = dialHTTP2(url, h1, time.Second); err == nil {
+		t.Errorf("accepted HTTP/1.1")
+	}
+	h1.CloseIdleConnections()
+	if err = validateHTTP2URL("http://example.com/tunnel"); err == nil {
+		t.Errorf("accepted http url")
+	}
+}
@@ -0,0 +1,52 @@
+package tunnel
+
+import (
+	"bytes"
+	"fmt"
+	"sync/atomic"
+)
+
+const (
+	// stages of server negotiation
+	STAGE_PRE_AUTH = iota // dbcHello, mostly probers or clock skew
+	STAGE_DH              // DH exchange, eg. version mismatch
+	STAGE_CIPHER          // cipher setup and key confirmation by hashed sRand
+	STAGE_IDENTITY        // identity parse
+	STAGE_AUTH            // credentials
+	STAGE_TOKEN           // session register and token issuance
+	STAGE_RESUME          // token of resumption
+)
+
+var stageNames = []string{"pre-auth", "dh", "cipher", "identity", "auth", "token", "resume"}
+
+// --------------------
+// handshakeMeter
+// --------------------
+// the failures of negotiation counted by the stage they died,
+// to turn the abnormal connections into actionable telemetry.
+type handshakeMeter struct {
+	failed [7]int64
+}
+
+func newHandshakeMeter() *handshakeMeter {
+	return new(handshakeMeter)
+}
+
+func (m *handshakeMeter) fail(stage int) {
+	if m != nil {
+		atomic.AddInt64(&m.failed[stage], 1)
+	}
+}
+
+func (m *handshakeMeter) failures(stage int) int64 {
+	return atomic.LoadInt64(&m.failed[stage])
+}
+
+func (m *handshakeMeter) String() string {
+	var buf = new(bytes.Buffer)
+	buf.WriteString("Handshake-failed")
+	for i, name := range stageNames {
+		fmt.Fprintf(buf, " %s=%d", name, m.failures(i))
+	}
+	return buf.String()
+}
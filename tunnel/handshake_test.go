@@ -0,0 +1,528 @@
+package tunnel
+
+import (
+	stdcrypto "crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/asn1"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Lafeng/deblocus/auth"
+	"github.com/Lafeng/deblocus/crypto"
+)
+
+// the signature is not verified by the test client
+type testSigner struct{}
+
+func (testSigner) Public() stdcrypto.PublicKey { return nil }
+func (testSigner) Sign(io.Reader, []byte, stdcrypto.SignerOpts) ([]byte, error) {
+	return []byte("signature"), nil
+}
+
+// fail the nth write of server
+type flakyConn struct {
+	net.Conn
+	writes, failAt int
+}
+
+func (c *flakyConn) Write(b []byte) (int, error) {
+	if c.writes++; c.writes == c.failAt {
+		return 0, errors.New("broken pipe")
+	}
+	return c.Conn.Write(b)
+}
+
+func newHandshakeServer(t *testing.T) *Server {
+	f, err := ioutil.TempFile(NULL, "auth")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	f.WriteString("alice:secret\n")
+	f.Close()
+	serv := newTestServer()
+	if serv.AuthSys, err = auth.NewFileAuthSys(f.Name()); err != nil {
+		t.Fatal(err)
+	}
+	serv.Cipher = "AES128CTR"
+	serv.privateKey = testSigner{}
+	serv.sharedKey = randArray(32)
+	serv.tunParams = &tunParams{pingInterval: DT_PING_INTERVAL, parallels: 1}
+	serv.handshakes = newHandshakeMeter()
+	return serv
+}
+
+// pass the negotiation by the other versions of key exchange
+const (
+	passLegacyDH = -2
+	passHybridDH = -3
+)
+
+// negotiate as a client which misbehaves at the stage, or -1 to pass
+func handshakeAt(t *testing.T, serv *Server, stage int) error {
+	c, s := tcpPair(t)
+	defer s.Close()
+	var raw net.Conn = s
+	if stage == STAGE_TOKEN {
+		// dh reply, encrypted hello, then the settings with tokens
+		raw = &flakyConn{Conn: s, failAt: 3}
+	}
+	var (
+		man  = &d5sman{Server: serv, clientAddr: s.RemoteAddr()}
+		done = make(chan error, 1)
+	)
+	go func() {
+		_, err := man.Connect(NewConn(raw, nullCipherKit), calculateTimeCounter(true))
+		done <- err
+	}()
+	handshakeClient(t, NewConn(c, nullCipherKit), serv, stage)
+	c.Close()
+	return <-done
+}
+
+func handshakeClient(t *testing.T, conn *Conn, serv *Server, stage int) {
+	if stage == STAGE_PRE_AUTH {
+		conn.Write(randArray(DPH_P2))
+		return
+	}
+	var typ byte = TYPE_NEWX
+	switch stage {
+	case STAGE_RESUME:
+		typ = TYPE_RES
+	case passLegacyDH:
+		typ = TYPE_NEW
+	case passHybridDH:
+		typ = TYPE_NEWQ
+	}
+	hello := makeDbcHello(typ, serv.sharedKey)
+	w := newMsgWriter().WriteMsg(hello)
+	switch stage {
+	case STAGE_RESUME:
+		w.WriteMsg(randArray(TKSZ)).WriteTo(conn)
+		return
+	case STAGE_DH:
+		w.WriteTo(conn)
+		return
+	}
+	dhKey, _ := crypto.NewDHKey(dhMethodOf(typ))
+	w.WriteL2Msg(dhKey.ExportPubKey())
+	// the old clients of legacy DH offer no suites
+	var offer []byte
+	if typ != TYPE_NEW {
+		offer = offerCipherSuites(allSuites, false)
+		w.WriteL1Msg(offer)
+	}
+	w.WriteTo(conn)
+	var dhPub, sRand, suite []byte
+	dhPub, err := ReadFullByLen(1, conn)
+	if err == nil && typ == TYPE_NEWQ {
+		var ct []byte
+		ct, err = ReadFullByLen(2, conn)
+		dhPub = append(dhPub, ct...)
+	}
+	if err == nil {
+		_, err = ReadFullByLen(1, conn) // sign
+	}
+	if err == nil {
+		sRand, err = ReadFullByLen(1, conn)
+	}
+	var cipher = legacyCipherSuite(serv.Cipher)
+	if err == nil && typ != TYPE_NEW {
+		if suite, err = ReadFullByLen(1, conn); err == nil {
+			cipher, _ = cipherOfSuite(suite[0], offer)
+		}
+	}
+	if err != nil {
+		t.Fatalf("dh: %v", err)
+	}
+	key, _ := dhKey.ComputeKey(dhPub)
+	var dbcHello = hello
+	if len(hello) > DPH_P2 {
+		dbcHello = hello[DPH_P2:]
+	}
+	if stage == STAGE_CIPHER {
+		cipher = "CHACHA20"
+	}
+	conn.SetupCipher(NewCipherFactory(cipher, key, dbcHello, offer), sRand)
+
+	var identity = "alice\x00secret"
+	switch stage {
+	case STAGE_IDENTITY:
+		identity = "alice"
+	case STAGE_AUTH:
+		identity = "alice\x00wrong"
+	}
+	w.WriteL1Msg(hash256(sRand)).WriteL1Msg([]byte(identity)).WriteTo(conn)
+	if stage < 0 {
+		// hashHello, version, auth result
+		for i := 0; i < 3; i++ {
+			if buf, err := ReadFullByLen(1, conn); err != nil || i == 2 && buf[0] != AUTH_PASS {
+				t.Fatalf("auth: %v %v", buf, err)
+			}
+		}
+	}
+}
+
+func TestHandshakeFailureStages(t *testing.T) {
+	serv := newHandshakeServer(t)
+	for _, stage := range []int{-1, passLegacyDH, passHybridDH} {
+		if err := handshakeAt(t, serv, stage); err != nil {
+			t.Fatalf("handshake failed %v", err)
+		}
+	}
+	for stage, name := range stageNames {
+		if err := handshakeAt(t, serv, stage); err == nil {
+			t.Errorf("%s: passed", name)
+		}
+		for i := range stageNames {
+			var expected int64
+			if i <= stage {
+				expected = 1
+			}
+			if n := serv.handshakes.failures(i); n != expected {
+				t.Errorf("%s: %s failures=%d", name, stageNames[i], n)
+			}
+		}
+	}
+	stats := serv.Stats()
+	if !strings.Contains(stats, "Handshake-failed pre-auth=1 dh=1 cipher=1 identity=1 auth=1 token=1 resume=1") {
+		t.Errorf("unexpected stats %s", stats)
+	}
+}
+
+// signs the raw message as DSAVerify of client
+type ecdsaTestSigner struct {
+	*ecdsa.PrivateKey
+}
+
+func (k ecdsaTestSigner) Sign(r io.Reader, msg []byte, _ stdcrypto.SignerOpts) ([]byte, error) {
+	var es ecdsaSignature
+	var err error
+	if es.R, es.S, err = ecdsa.Sign(r, k.PrivateKey, msg); err != nil {
+		return nil, err
+	}
+	return asn1.Marshal(es)
+}
+
+// the key exchange and validation of client to serv, then login with the
+// params if not nil
+func exchangeKeys(t *testing.T, serv *Server, info *connectionInfo, params ...*tunParams) (*d5sman, error) {
+	var (
+		cman = &d5cman{connectionInfo: info}
+		sman = &d5sman{Server: serv}
+		done = make(chan error, 1)
+	)
+	// the credential carries the suites of server
+	if info.cipher == NULL {
+		info.cipher = serv.Cipher
+	}
+	c, s := tcpPair(t)
+	defer s.Close()
+	go func() {
+		_, err := sman.Connect(NewConn(s, nullCipherKit), calculateTimeCounter(true))
+		done <- err
+	}()
+	conn := NewConn(c, nullCipherKit)
+	cman.dhKey, _ = crypto.NewDHKey(dhMethodOf(cman.helloType()))
+	var cf *CipherFactory
+	err := cman.requestDHExchange(conn)
+	if err == nil {
+		cf, err = cman.finishDHExchange(conn)
+	}
+	if err == nil {
+		err = cman.validate(conn)
+	}
+	if err == nil && len(params) > 0 {
+		err = cman.authThenFinishSetting(conn, params[0])
+		params[0].cipherFactory = cf
+	}
+	c.Close()
+	<-done
+	return sman, err
+}
+
+// the client negotiates by each version of key exchange
+func TestKeyExchangeVersions(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	serv := newHandshakeServer(t)
+	serv.privateKey = ecdsaTestSigner{key}
+	serv.sharedKey = preSharedKey(&key.PublicKey)
+	serv.Cipher = "AES128CTR,AES256GCM"
+	for _, info := range []*connectionInfo{
+		{sPubKey: &key.PublicKey},
+		{sPubKey: &key.PublicKey, legacyDH: true},
+		{sPubKey: &key.PublicKey, postQuantum: true},
+	} {
+		sman, err := exchangeKeys(t, serv, info)
+		if err != nil || sman.dhMethod != dhMethodOf((&d5cman{connectionInfo: info}).helloType()) {
+			t.Errorf("%s: %v", sman.dhMethod, err)
+		}
+		// the format of old version, without the offer and selection
+		if info.legacyDH && (sman.offer != nil || sman.protocol != PROTOCOL_V1 || sman.cipher != legacyCipherSuite(serv.Cipher)) {
+			t.Errorf("legacy: offer=%v v%d %s", sman.offer, sman.protocol, sman.cipher)
+		}
+	}
+}
+
+func TestEd25519Identity(t *testing.T) {
+	priv, err := GenerateDSAKey("ED25519")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// as the config and credential
+	priv, err = UnmarshalPrivateKey(MarshalPrivateKey(priv))
+	if err != nil {
+		t.Fatal(err)
+	}
+	pubBytes, err := MarshalPublicKey(priv.(stdcrypto.Signer).Public())
+	if err != nil {
+		t.Fatal(err)
+	}
+	pub, err := UnmarshalPublicKey(pubBytes)
+	if err != nil || NameOfKey(pub) != "ED25519" {
+		t.Fatal(NameOfKey(pub), err)
+	}
+	serv := newHandshakeServer(t)
+	serv.privateKey = priv
+	serv.sharedKey = preSharedKey(pub)
+	for _, info := range []*connectionInfo{
+		{sPubKey: pub},
+		{sPubKey: pub, postQuantum: true},
+	} {
+		if _, err = exchangeKeys(t, serv, info); err != nil {
+			t.Errorf("postQuantum=%v: %v", info.postQuantum, err)
+		}
+	}
+
+	// the server impersonated by another key
+	fake, _ := GenerateDSAKey("ED25519")
+	serv.privateKey = fake
+	if _, err = exchangeKeys(t, serv, &connectionInfo{sPubKey: pub}); err != VALIDATION_FAILED {
+		t.Errorf("impersonated server: %v", err)
+	}
+}
+
+func TestTokenSizeNegotiation(t *testing.T) {
+	priv, _ := GenerateDSAKey("ED25519")
+	pub := priv.(stdcrypto.Signer).Public()
+	serv := newHandshakeServer(t)
+	serv.privateKey = priv
+	serv.sharedKey = preSharedKey(pub)
+	info := &connectionInfo{sPubKey: pub, user: "alice", pass: "secret"}
+	for _, size := range []int{TKSZ, TKSZ_LONG} {
+		serv.TokenSize = size
+		p := new(tunParams)
+		if _, err := exchangeKeys(t, serv, info, p); err != nil {
+			t.Fatalf("size=%d: %v", size, err)
+		}
+		if p.tokenSize != size || len(p.token)%size != 0 {
+			t.Errorf("size=%d: negotiated=%d tokens=%d", size, p.tokenSize, len(p.token))
+		}
+	}
+
+	// the old client did not signal
+	sman := &d5sman{Server: serv, offer: offerCipherSuites(allSuites, false)}
+	if n := sman.tokenSize(); n != TKSZ {
+		t.Errorf("issued %d bytes tokens to old client", n)
+	}
+	// the old server sent no size
+	p := new(tunParams)
+	p.deserialize((&tunParams{pingInterval: 1, parallels: 1}).serialize()[:4])
+	if p.tokenSize != TKSZ {
+		t.Errorf("token size of old server %d", p.tokenSize)
+	}
+}
+
+func TestProtocolNegotiation(t *testing.T) {
+	priv, _ := GenerateDSAKey("ED25519")
+	pub := priv.(stdcrypto.Signer).Public()
+	serv := newHandshakeServer(t)
+	serv.privateKey = priv
+	serv.sharedKey = preSharedKey(pub)
+	info := &connectionInfo{sPubKey: pub, user: "alice", pass: "secret"}
+	p := new(tunParams)
+	sman, err := exchangeKeys(t, serv, info, p)
+	if err != nil || sman.protocol != PROTOCOL_MAX || p.protocol != PROTOCOL_MAX {
+		t.Fatalf("server=v%d client=v%d %v", sman.protocol, p.protocol, err)
+	}
+
+	// the old clients did not signal, and the newer one signals the version
+	// higher than the server, which is lowered in negotiation
+	for offer, expected := range map[string]int{
+		string(offerCipherSuites(allSuites, false)):              PROTOCOL_V1,
+		string([]byte{10, SCSV_LONG_TOKENS}):                     PROTOCOL_V1,
+		string([]byte{10, SCSV_PROTOCOL + PROTOCOL_V2}):          PROTOCOL_V2,
+		string([]byte{10, SCSV_PROTOCOL + 1, SCSV_PROTOCOL + 9}): 9,
+	} {
+		if v := protocolOfOffer([]byte(offer)); v != expected {
+			t.Errorf("offer=%x version=%d", offer, v)
+		}
+	}
+
+	// the version of client was retired
+	serv.MinProtocol = PROTOCOL_MAX + 1
+	if _, err = exchangeKeys(t, serv, info, new(tunParams)); err == nil {
+		t.Errorf("the retired version was served")
+	}
+}
+
+func TestCapabilityNegotiation(t *testing.T) {
+	priv, _ := GenerateDSAKey("ED25519")
+	pub := priv.(stdcrypto.Signer).Public()
+	serv := newHandshakeServer(t)
+	serv.privateKey = priv
+	serv.sharedKey = preSharedKey(pub)
+	info := &connectionInfo{sPubKey: pub, user: "alice", pass: "secret",
+		udpAssociate: true, roaming: time.Minute,
+		bindAddrs: []net.IP{net.IPv4(10, 0, 0, 1), net.IPv4(10, 0, 0, 2)}}
+	for _, roaming := range []time.Duration{0, time.Minute} {
+		// the UDP relay and multipath are advertised only if enabled
+		serv.roaming, serv.udpRelay, serv.multipath = roaming, roaming > 0, roaming > 0
+		p := new(tunParams)
+		if _, err := exchangeKeys(t, serv, info, p); err != nil {
+			t.Fatal(err)
+		}
+		var expected = CAP_REKEY | CAP_FLOW_CONTROL | CAP_FRAME_MAC | CAP_GOAWAY
+		if roaming > 0 {
+			expected |= CAP_ROAMING | CAP_UDP_RELAY | CAP_MULTIPATH
+		}
+		if p.caps != expected {
+			t.Errorf("roaming=%s caps=%b", roaming, p.caps)
+		}
+	}
+
+	// the client disables the subsystems not shared, except of the old servers
+	var (
+		c   = &Client{connInfo: info}
+		mux = newClientMultiplexer()
+	)
+	for _, p := range []*tunParams{{protocol: PROTOCOL_V1}, {protocol: PROTOCOL_V2, caps: CAP_REKEY}} {
+		mux.multipath, mux.roam = true, time.Minute
+		c.params = p
+		c.applyCapabilities(mux, p)
+		if old := p.protocol == PROTOCOL_V1; mux.multipath != old || (mux.roam > 0) != old || c.capable(CAP_UDP_RELAY) != old || mux.flowCtl || mux.frameMAC || mux.goaway {
+			t.Errorf("v%d: multipath=%v roam=%s", p.protocol, mux.multipath, mux.roam)
+		}
+	}
+	// and the server
+	ses := newTestSession(serv, "alice")
+	ses.mux.rekey = &rekeyPolicy{interval: time.Hour}
+	ses.applyCapabilities(CAP_UDP_RELAY)
+	if ses.mux.roam != 0 || ses.mux.rekey != nil || ses.mux.flowCtl || ses.mux.frameMAC || ses.mux.goaway || !ses.mux.datagrams {
+		t.Errorf("roam=%s rekey=%v", ses.mux.roam, ses.mux.rekey)
+	}
+}
+
+// the mux of restarting and migrating are configured alike
+func TestConfiguredMux(t *testing.T) {
+	var (
+		c    = new(Client)
+		info = &connectionInfo{pingMax: 90, roaming: time.Minute, fingerprint: 2,
+			coalesce: time.Millisecond, rekey: &rekeyPolicy{interval: time.Hour},
+			bindAddrs: []net.IP{net.IPv4(10, 0, 0, 1), net.IPv4(10, 0, 0, 2)}}
+		params = &tunParams{protocol: PROTOCOL_V2, caps: CAP_REKEY | CAP_GOAWAY, maxStreams: 8,
+			cipherFactory: NewCipherFactory("AES128CTR", randArray(32))}
+	)
+	mux := c.newConfiguredMux(info, nil)
+	defer mux.destroy()
+	if mux.pingMax != 90 || mux.coalesce != time.Millisecond || !mux.multipath || mux.roam != time.Minute || mux.rekey == nil {
+		t.Errorf("options were not applied")
+	}
+	if mux.profile != nil || mux.goaway {
+		t.Errorf("negotiated before the session")
+	}
+	mux = c.newConfiguredMux(info, params)
+	defer mux.destroy()
+	if mux.profile == nil || !mux.goaway || mux.streamCap != 8 || mux.multipath || mux.roam != 0 || mux.rekey == nil {
+		t.Errorf("params were not applied profile=%v multipath=%v roam=%s", mux.profile, mux.multipath, mux.roam)
+	}
+}
+
+// the version of selection stripped by the attacker fails the handshake
+// instead of the client falling back to v1 silently
+func TestDowngradeOfSelection(t *testing.T) {
+	priv, _ := GenerateDSAKey("ED25519")
+	pub := priv.(stdcrypto.Signer).Public()
+	serv := newHandshakeServer(t)
+	serv.privateKey = priv
+	serv.sharedKey = preSharedKey(pub)
+	var (
+		c, p1 = tcpPair(t)
+		p2, s = tcpPair(t)
+		sman  = &d5sman{Server: serv}
+		cman  = &d5cman{connectionInfo: &connectionInfo{sPubKey: pub, cipher: serv.Cipher}}
+	)
+	defer c.Close()
+	defer p1.Close()
+	defer p2.Close()
+	go func() {
+		sman.Connect(NewConn(s, nullCipherKit), calculateTimeCounter(true))
+		s.Close()
+	}()
+	go io.Copy(p2, p1)
+	go func() {
+		// dhPub, sign and rand, then the selection as the old server
+		for i := 0; i < 3; i++ {
+			msg, _ := ReadFullByLen(1, p2)
+			p1.Write(append([]byte{byte(len(msg))}, msg...))
+		}
+		selection, _ := ReadFullByLen(1, p2)
+		if len(selection) > 0 {
+			p1.Write([]byte{1, selection[0]})
+		}
+		// hashHello and version of the stream cipher
+		io.CopyN(p1, p2, 1+32+1+4)
+		p1.Close()
+	}()
+	conn := NewConn(c, nullCipherKit)
+	cman.dhKey, _ = crypto.NewDHKey(dhMethodOf(cman.helloType()))
+	err := cman.requestDHExchange(conn)
+	if err == nil {
+		_, err = cman.finishDHExchange(conn)
+	}
+	if cman.protocol != PROTOCOL_V1 {
+		t.Fatalf("the selection was not stripped v%d", cman.protocol)
+	}
+	if err == nil {
+		err = cman.validate(conn)
+	}
+	// the garbage decrypted by the different keys
+	if err == nil {
+		t.Errorf("the downgraded handshake was validated")
+	}
+}
+
+func TestResumeLongToken(t *testing.T) {
+	var (
+		serv   = newHandshakeServer(t)
+		alice  = newTestSession(serv, "alice")
+		tokens []byte
+	)
+	alice.tokenSize = TKSZ_LONG
+	serv.sessionMgr.register(alice)
+	tokens = serv.sessionMgr.createTokens(alice, 2)
+	for i, typ := range []byte{TYPE_RESL, TYPE_RES} {
+		c, s := tcpPair(t)
+		w := newMsgWriter().WriteMsg(makeDbcHello(typ, serv.sharedKey))
+		w.WriteMsg(tokens[1+i*TKSZ_LONG : 1+(i+1)*TKSZ_LONG]).WriteTo(c)
+		sman := &d5sman{Server: serv, clientAddr: c.LocalAddr()}
+		ses, err := sman.Connect(NewConn(s, nullCipherKit), calculateTimeCounter(true))
+		// the long token was truncated by TYPE_RES
+		if expected := typ == TYPE_RESL; (ses == alice && err == nil) != expected {
+			t.Errorf("type=%x ses=%v err=%v", typ, ses, err)
+		}
+		c.Close()
+		s.Close()
+	}
+}
@@ -0,0 +1,169 @@
+package tunnel
+
+import (
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	ex "github.com/Lafeng/deblocus/exception"
+	log "github.com/Lafeng/deblocus/glog"
+)
+
+const (
+	HEALTH_SCAN_INTERVAL = time.Second * 30
+	HEALTH_STRIKES       = 2 // degraded in the scans in a row
+	HEALTH_RTT_FACTOR    = 3 // the RTT over the times of baseline
+	HEALTH_RTT_SLACK     = time.Millisecond * 50
+	HEALTH_REPLACE_MIN   = time.Minute
+)
+
+// --------------------
+// tunHealth
+// --------------------
+// the tunnels of client are scored by the path quality in each scan: the RTT
+// far over the baseline of the best tunnels, the jitter over the RTT and the
+// writes stalled since last scan. the unanswered ping closes the tun already.
+// the tun degraded in the scans in a row is replaced: a new tun is dialed,
+// then the bad one is drained and closed. one replacement in the interval at
+// most, so the tunnels don't churn if the whole path was degraded.
+type tunHealth struct {
+	replaced int64
+	baseline int64                 // the best RTT, follows the path slowly
+	marks    map[*Conn]*healthMark // owned by the scanning goroutine
+	last     time.Time             // of the last replacement
+	ticker   *time.Ticker
+	done     chan struct{}
+}
+
+type healthMark struct {
+	strikes int
+	stall   int64 // the stalls of writing at last scan
+}
+
+func newTunHealth() *tunHealth {
+	return &tunHealth{marks: make(map[*Conn]*healthMark)}
+}
+
+// the degraded signals of tun
+func (h *tunHealth) score(tun *Conn, mark *healthMark) int {
+	var score int
+	if srtt := atomic.LoadInt64(&tun.srtt); srtt > 0 && h.baseline > 0 {
+		if srtt > h.baseline*HEALTH_RTT_FACTOR && srtt-h.baseline > int64(HEALTH_RTT_SLACK) {
+			score++
+		}
+		if atomic.LoadInt64(&tun.rvar) > srtt {
+			score++
+		}
+	}
+	if stall := atomic.LoadInt64(&tun.stall); stall > mark.stall {
+		mark.stall = stall
+		score++
+	}
+	return score
+}
+
+// return the worst tun of the degraded in a row at now, or nil
+func (h *tunHealth) scan(tuns []*Conn, now time.Time) *Conn {
+	var best int64
+	for _, tun := range tuns {
+		if srtt := atomic.LoadInt64(&tun.srtt); srtt > 0 && (best == 0 || srtt < best) {
+			best = srtt
+		}
+	}
+	if h.baseline == 0 || best > 0 && best < h.baseline {
+		h.baseline = best
+	} else if best > 0 {
+		h.baseline += (best - h.baseline) >> 3
+	}
+
+	var (
+		worst *Conn
+		most  int
+		alive = make(map[*Conn]*healthMark, len(tuns))
+	)
+	for _, tun := range tuns {
+		var mark = h.marks[tun]
+		if mark == nil {
+			mark = &healthMark{stall: atomic.LoadInt64(&tun.stall)}
+		}
+		alive[tun] = mark
+		if score := h.score(tun, mark); score > 0 {
+			mark.strikes++
+			if mark.strikes >= HEALTH_STRIKES && score > most {
+				worst, most = tun, score
+			}
+		} else {
+			mark.strikes = 0
+		}
+	}
+	h.marks = alive
+	if worst != nil && now.Sub(h.last) >= HEALTH_REPLACE_MIN {
+		h.last = now
+		delete(h.marks, worst)
+		return worst
+	}
+	return nil
+}
+
+func (h *tunHealth) start(c *Client) {
+	h.ticker = time.NewTicker(HEALTH_SCAN_INTERVAL)
+	h.done = make(chan struct{})
+	go func(ticker *time.Ticker, done chan struct{}) {
+		for {
+			var now time.Time
+			select {
+			case <-done:
+				return
+			case now = <-ticker.C:
+			}
+			mux := c.mux
+			if mux == nil || atomic.LoadInt32(&c.state) != CLT_WORKING {
+				continue
+			}
+			if bad := h.scan(mux.activeTuns(), now); bad != nil {
+				c.replaceTun(mux, bad, "degraded")
+			}
+		}
+	}(h.ticker, h.done)
+}
+
+func (h *tunHealth) stop() {
+	if h.ticker != nil {
+		h.ticker.Stop()
+		close(h.done)
+		h.ticker = nil
+	}
+}
+
+func (h *tunHealth) String() string {
+	return fmt.Sprintf("Replaced-tuns=%d", atomic.LoadInt64(&h.replaced))
+}
+
+// the tunnels not retired
+func (p *multiplexer) activeTuns() []*Conn {
+	var tuns []*Conn
+	if pool := p.pool; pool != nil {
+		pool.lock.Lock()
+		for _, tun := range pool.pool {
+			if atomic.LoadInt32(&tun.retired) == 0 {
+				tuns = append(tuns, tun)
+			}
+		}
+		pool.lock.Unlock()
+	}
+	return tuns
+}
+
+// dial the new tun for the degraded or rotated, then drain and close the bad
+// one. keep it if failed to dial.
+func (c *Client) replaceTun(mux *multiplexer, bad *Conn, reason string) {
+	tun, err := c.createDataTun()
+	if err != nil {
+		log.Warningf("Failed to replace the %s tun %s %s", reason, bad.identifier, ex.Detail(err))
+		return
+	}
+	atomic.AddInt64(&c.health.replaced, 1)
+	log.Infof("Tun %s was %s, replaced by %s", bad.identifier, reason, tun.identifier)
+	go c.startTun(tun, false)
+	go mux.retire(bad, TUN_REPLACED, TUN_DRAIN_TIMEOUT)
+}
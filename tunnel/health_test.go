@@ -0,0 +1,140 @@
+package tunnel
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestTunHealth(t *testing.T) {
+	var (
+		h    = newTunHealth()
+		now  = time.Now()
+		tuns = []*Conn{new(Conn), new(Conn), new(Conn)}
+		scan = func(expected *Conn, step string) {
+			now = now.Add(HEALTH_SCAN_INTERVAL)
+			if bad := h.scan(tuns, now); bad != expected {
+				t.Errorf("%s: replaced %p expected %p", step, bad, expected)
+			}
+		}
+	)
+	for i, rtt := range []time.Duration{40, 50, 300} {
+		tuns[i].srtt = int64(rtt * time.Millisecond)
+		tuns[i].rvar = int64(time.Millisecond * 5)
+	}
+	// the slow one in a row
+	scan(nil, "rtt strike 1")
+	if h.baseline != int64(time.Millisecond*40) {
+		t.Errorf("baseline=%s", time.Duration(h.baseline))
+	}
+	scan(tuns[2], "rtt strike 2")
+	tuns[2].srtt = int64(time.Millisecond * 45)
+
+	// the stalled writes, not in a row
+	tuns[1].stall++
+	scan(nil, "stall strike 1")
+	scan(nil, "stall recovered")
+
+	// the jitter
+	tuns[0].rvar = int64(time.Millisecond * 80)
+	scan(nil, "jitter strike 1")
+	scan(tuns[0], "jitter strike 2")
+	tuns[0].rvar = 0
+
+	// replaced once in the interval
+	tuns[1].rvar = int64(time.Millisecond * 80)
+	scan(nil, "jitter strike 1")
+	h.last = now
+	scan(nil, "jitter in the interval")
+	now = now.Add(HEALTH_REPLACE_MIN)
+	scan(tuns[1], "jitter after the interval")
+
+	// the baseline follows the path slowly
+	for _, tun := range tuns {
+		tun.srtt, tun.rvar = int64(time.Millisecond*200), 0
+	}
+	h = newTunHealth()
+	h.baseline = int64(time.Millisecond * 40)
+	scan(nil, "path degraded")
+	if h.baseline != int64(time.Millisecond*60) {
+		t.Errorf("baseline=%s", time.Duration(h.baseline))
+	}
+}
+
+// the writes timed out once, then accepted
+type stallConn struct {
+	net.Conn
+	stalled bool
+	wrote   []byte
+}
+
+func (c *stallConn) Write(b []byte) (int, error) {
+	if !c.stalled {
+		c.stalled = true
+		c.wrote = append(c.wrote, b[:1]...)
+		return 1, timeoutError{}
+	}
+	c.wrote = append(c.wrote, b...)
+	return len(b), nil
+}
+
+func (c *stallConn) SetWriteDeadline(time.Time) error { return nil }
+
+// the stalled flushing of the coalesced writes is counted and tolerated
+func TestCoalescedStall(t *testing.T) {
+	var (
+		conn = new(stallConn)
+		tun  = NewConn(conn, nullCipherKit)
+	)
+	tun.coalesce = time.Millisecond * 10
+	tun.priority = &TSPriority{last: time.Now().UnixNano()}
+	if _, err := tun.Write(make([]byte, COALESCE_FLUSH_SIZE)); err != nil {
+		t.Fatalf("the stall was not tolerated err=%v", err)
+	}
+	time.Sleep(time.Millisecond * 50)
+	tun.wlock.Lock()
+	defer tun.wlock.Unlock()
+	if tun.stall != 1 || len(conn.wrote) != COALESCE_FLUSH_SIZE || len(tun.pending) != 0 {
+		t.Errorf("stall=%d wrote=%d pending=%d", tun.stall, len(conn.wrote), len(tun.pending))
+	}
+
+	// and the scanning stops
+	var h = newTunHealth()
+	h.start(new(Client))
+	h.stop()
+	h.stop()
+}
+
+func TestRetireTun(t *testing.T) {
+	var (
+		mux     = newClientMultiplexer()
+		dst, rd = net.Pipe()
+		closed  = make(chan bool)
+	)
+	c, s := tcpPair(t)
+	defer c.Close()
+	defer rd.Close()
+	defer mux.destroy()
+	mux.goaway = true
+	tun := NewConn(s.(*net.TCPConn), nullCipherKit)
+	tun.priority = &TSPriority{0, 1e9}
+	mux.pool.Push(tun)
+	edge := mux.router.register("key", "dest:80", tun, dst, false)
+	go func() {
+		mux.retire(tun, TUN_REPLACED, time.Second*3)
+		closed <- true
+	}()
+	readFrameOf(t, c, FRAME_ACTION_GOAWAY)
+	if len(mux.activeTuns()) != 0 || mux.pool.Select() != nil {
+		t.Errorf("selected the replaced tun")
+	}
+	edge.bitwiseCompareAndSet(TCP_CLOSED)
+	select {
+	case <-closed:
+		if !tun.isClosed() {
+			t.Errorf("the retired tun was not closed")
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("not closed after the stream finished")
+	}
+}
@@ -0,0 +1,73 @@
+package tunnel
+
+import (
+	"time"
+
+	ex "github.com/Lafeng/deblocus/exception"
+)
+
+const (
+	// reason category of session closing
+	SESSION_CLOSE_OFFLINE  = "offline"  // all tunnels were disconnected
+	SESSION_CLOSE_SHUTDOWN = "shutdown" // server was closing
+	SESSION_CLOSE_ABORTED  = "aborted"  // negotiation was not completed
+	SESSION_CLOSE_PLAN     = "plan"     // reached max session duration of user
+	SESSION_CLOSE_ZOMBIE   = "zombie"   // tunnels had no progress
+	SESSION_CLOSE_IDLE     = "idle"     // no data flowed in timeout
+	SESSION_CLOSE_KICKED   = "kicked"   // terminated by admin
+	// saved at shutdown and will be restored, the traffic is cumulative
+	SESSION_CLOSE_PERSISTED = "persisted"
+)
+
+// DisconnectInfo is the stable contract passed to DisconnectHook,
+// fields may be appended but never be removed or changed.
+type DisconnectInfo struct {
+	User      string
+	Client    string // client address without port
+	Start     time.Time
+	Duration  time.Duration
+	BytesUp   int64 // from client to destinations
+	BytesDown int64 // from destinations to client
+	Streams   int64 // opened streams
+	Reason    string
+	Cipher    string
+	Label     string
+	// correlation id generated by client, empty if not sent
+	Correlation string
+}
+
+// DisconnectHook will be invoked in a new goroutine when a session was closed.
+type DisconnectHook func(info *DisconnectInfo)
+
+// register a hook, eg. for accounting
+// must be called before serving
+func (t *Server) OnDisconnect(hook DisconnectHook) {
+	t.disconnectHook = hook
+}
+
+func (s *Session) disconnectInfo(reason string) *DisconnectInfo {
+	var info = &DisconnectInfo{
+		User:   s.uid,
+		Client: s.cid,
+		Start:  s.start,
+		Reason: reason,
+		Label:  s.label,
+	}
+	info.Correlation = s.correlation
+	info.Duration = time.Since(s.start)
+	info.BytesUp, info.BytesDown, info.Streams = s.mux.traffic()
+	if s.cipherFactory != nil {
+		info.Cipher = s.cipherFactory.name
+	}
+	return info
+}
+
+// non-blocking and panic-safe
+func invokeDisconnectHook(hook DisconnectHook, info *DisconnectInfo) {
+	go func() {
+		defer func() {
+			ex.Catch(recover(), nil)
+		}()
+		hook(info)
+	}()
+}
@@ -0,0 +1,631 @@
+package tunnel
+
+import (
+	"encoding/binary"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	log "github.com/Lafeng/deblocus/glog"
+)
+
+const (
+	// the datagrams fit the path MTU of PPPoE and the common tunnels
+	KCP_MTU = 1350
+	// conv(4) + fec seq(4) + fec shards(1)
+	KCP_FEC_HEADER_LEN = 9
+	// cmd(1) + wnd(2) + sn(4) + una(4)
+	KCP_HEADER_LEN = 11
+	// data of a segment, leaves the room of length in the parity
+	KCP_MSS = KCP_MTU - KCP_FEC_HEADER_LEN - KCP_HEADER_LEN - 2
+	// commands of segment
+	KCP_CMD_PUSH = 1
+	KCP_CMD_ACK  = 2
+	KCP_CMD_FIN  = 3
+	// segments in flight and reordered
+	KCP_WINDOW     = 128
+	KCP_WINDOW_MIN = 16
+	KCP_WINDOW_MAX = 4096
+	// data datagrams per parity
+	KCP_FEC_MAX = 64
+	// groups of datagrams waiting for the recovery
+	KCP_FEC_GROUPS = 32
+	KCP_INTERVAL   = time.Millisecond * 20
+	KCP_RTO_INIT   = time.Millisecond * 200
+	KCP_RTO_MIN    = time.Millisecond * 50
+	KCP_RTO_MAX    = time.Second * 8
+	// retransmitted after skipped by the acks of later segments
+	KCP_FAST_RESEND = 2
+	// the link is broken after the retransmissions of a segment
+	KCP_DEAD_LINK = 16
+	// answer the retransmitted fin after both sides finished
+	KCP_LINGER = time.Second * 2
+	// the server closes the conn without datagrams in timeout
+	KCP_IDLE_TIMEOUT = time.Minute * 2
+	KCP_CONNS_MAX    = 1024
+	KCP_SOURCE_MAX   = 16
+)
+
+// --------------------
+// kcpConn
+// --------------------
+// the tunnel carried by reliable UDP for the lossy and long-distance links,
+// where TCP collapses by its congestion control. it's an ARQ in the way of
+// KCP: selective and cumulative acks, fast retransmission on the skipped
+// acks, and the retransmission timeout backs off by half instead of double.
+// there is no congestion window, the throughput is bounded by the window of
+// peers. the datagrams could be protected by FEC of a XOR parity per group,
+// which recovers one lost datagram of the group without waiting for rto.
+//   datagram: conv(4) fec_seq(4) fec_shards(1) body
+//   body of data: cmd(1) wnd(2) sn(4) una(4) data
+// the server follows the shards of client for the datagrams to it.
+
+// the buffered stream is shared with the DNS tunnel
+type kcpConn struct {
+	*dnsConn
+}
+
+type kcpSegment struct {
+	cmd     byte
+	sn      uint32
+	data    []byte
+	sentAt  time.Time
+	resend  time.Time
+	rto     time.Duration
+	xmit    int
+	skipped int
+}
+
+type kcpSession struct {
+	conn   *kcpConn
+	conv   uint32
+	window int
+	output func([]byte) error
+	enc    *fecEncoder
+	dec    *fecDecoder
+	lock   sync.Mutex
+	// sender
+	sndNxt  uint32
+	sndBuf  []*kcpSegment // in flight, ordered by sn
+	rmtWnd  int
+	finSent bool
+	// receiver
+	rcvNxt  uint32
+	rcvBuf  map[uint32]*kcpSegment
+	acks    []uint32
+	finRecv bool
+	srtt    time.Duration
+	rttvar  time.Duration
+	rto     time.Duration
+	seen    time.Time
+	finAt   time.Time
+	aborted bool
+	done    chan struct{}
+}
+
+func newKcpSession(conv uint32, window, shards int, laddr, raddr net.Addr, output func([]byte) error) *kcpSession {
+	return &kcpSession{
+		conn:   &kcpConn{newDnsConn(tcpAddrOf(laddr), tcpAddrOf(raddr))},
+		conv:   conv,
+		window: window,
+		output: output,
+		enc:    &fecEncoder{conv: conv, shards: shards},
+		dec:    &fecDecoder{groups: make(map[uint32]*fecGroup)},
+		rmtWnd: window,
+		rcvBuf: make(map[uint32]*kcpSegment),
+		rto:    KCP_RTO_INIT,
+		seen:   time.Now(),
+		done:   make(chan struct{}),
+	}
+}
+
+func seqBefore(a, b uint32) bool {
+	return int32(a-b) < 0
+}
+
+// conv, fec seq, fec shards and body of the datagram
+func parseKcpDatagram(d []byte) (uint32, uint32, int, []byte, bool) {
+	if len(d) < KCP_FEC_HEADER_LEN || d[8] > KCP_FEC_MAX {
+		return 0, 0, 0, nil, false
+	}
+	return binary.BigEndian.Uint32(d), binary.BigEndian.Uint32(d[4:]), int(d[8]), d[KCP_FEC_HEADER_LEN:], true
+}
+
+// flush until finished or broken
+func (s *kcpSession) run() {
+	var ticker = time.NewTicker(KCP_INTERVAL)
+	defer ticker.Stop()
+	defer close(s.done)
+	for s.flush(time.Now()) {
+		select {
+		case <-ticker.C:
+		case <-s.conn.kick:
+		}
+	}
+}
+
+// the datagram received
+func (s *kcpSession) receive(seq uint32, shards int, body []byte) {
+	s.lock.Lock()
+	var now = time.Now()
+	for _, pkt := range s.dec.decode(seq, shards, body) {
+		s.input(pkt, now)
+	}
+	var acking = len(s.acks) > 0
+	s.lock.Unlock()
+	if acking {
+		select {
+		case s.conn.kick <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// must be called in lock
+func (s *kcpSession) input(pkt []byte, now time.Time) {
+	if len(pkt) < KCP_HEADER_LEN {
+		return
+	}
+	var (
+		cmd  = pkt[0]
+		sn   = binary.BigEndian.Uint32(pkt[3:])
+		una  = binary.BigEndian.Uint32(pkt[7:])
+		data = pkt[KCP_HEADER_LEN:]
+	)
+	s.seen = now
+	s.rmtWnd = int(binary.BigEndian.Uint16(pkt[1:]))
+	// acked cumulatively
+	for len(s.sndBuf) > 0 && seqBefore(s.sndBuf[0].sn, una) {
+		s.sndBuf = s.sndBuf[1:]
+	}
+	switch cmd {
+	case KCP_CMD_ACK:
+		for ; len(data) >= 4; data = data[4:] {
+			s.ack(binary.BigEndian.Uint32(data), now)
+		}
+	case KCP_CMD_PUSH, KCP_CMD_FIN:
+		if !seqBefore(sn, s.rcvNxt+uint32(s.window)) {
+			return
+		}
+		s.acks = append(s.acks, sn)
+		if !seqBefore(sn, s.rcvNxt) && s.rcvBuf[sn] == nil {
+			s.rcvBuf[sn] = &kcpSegment{cmd: cmd, sn: sn, data: append([]byte(nil), data...)}
+		}
+		for seg := s.rcvBuf[s.rcvNxt]; seg != nil && !s.finRecv; seg = s.rcvBuf[s.rcvNxt] {
+			delete(s.rcvBuf, s.rcvNxt)
+			s.rcvNxt++
+			s.finRecv = seg.cmd == KCP_CMD_FIN
+			s.conn.feed(seg.data, s.finRecv)
+		}
+	}
+}
+
+// must be called in lock
+func (s *kcpSession) ack(sn uint32, now time.Time) {
+	for i, seg := range s.sndBuf {
+		if seg.sn == sn {
+			// karn's algorithm, the retransmitted are ambiguous
+			if seg.xmit == 1 {
+				s.updateRTT(now.Sub(seg.sentAt))
+			}
+			s.sndBuf = append(s.sndBuf[:i:i], s.sndBuf[i+1:]...)
+			return
+		}
+		if seqBefore(seg.sn, sn) {
+			seg.skipped++
+		}
+	}
+}
+
+// rfc6298
+func (s *kcpSession) updateRTT(rtt time.Duration) {
+	if s.srtt == 0 {
+		s.srtt, s.rttvar = rtt, rtt/2
+	} else {
+		var delta = rtt - s.srtt
+		if delta < 0 {
+			delta = -delta
+		}
+		s.rttvar = (3*s.rttvar + delta) / 4
+		s.srtt = (7*s.srtt + rtt) / 8
+	}
+	var variance = 4 * s.rttvar
+	if variance < KCP_INTERVAL {
+		variance = KCP_INTERVAL
+	}
+	switch s.rto = s.srtt + variance; {
+	case s.rto < KCP_RTO_MIN:
+		s.rto = KCP_RTO_MIN
+	case s.rto > KCP_RTO_MAX:
+		s.rto = KCP_RTO_MAX
+	}
+}
+
+// the free slots of receiving, the unread data are counted
+func (s *kcpSession) rcvWindow() int {
+	s.conn.lock.Lock()
+	var unread = len(s.conn.in)
+	s.conn.lock.Unlock()
+	return maxInt(s.window-len(s.rcvBuf)-unread/KCP_MSS, 0)
+}
+
+// the lost are retransmitted, must be called in lock
+func (s *kcpSession) send(cmd byte, sn uint32, data []byte, wnd int) {
+	var pkt = make([]byte, KCP_HEADER_LEN+len(data))
+	pkt[0] = cmd
+	binary.BigEndian.PutUint16(pkt[1:], uint16(wnd))
+	binary.BigEndian.PutUint32(pkt[3:], sn)
+	binary.BigEndian.PutUint32(pkt[7:], s.rcvNxt)
+	copy(pkt[KCP_HEADER_LEN:], data)
+	for _, d := range s.enc.encode(pkt) {
+		s.output(d)
+	}
+}
+
+// send the acks, new and expired segments. return false if the session
+// was finished, broken or idle.
+func (s *kcpSession) flush(now time.Time) bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.aborted {
+		return false
+	}
+	var wnd = s.rcvWindow()
+	for len(s.acks) > 0 {
+		var n = minInt(len(s.acks), KCP_MSS/4)
+		var data = make([]byte, n*4)
+		for i, sn := range s.acks[:n] {
+			binary.BigEndian.PutUint32(data[i*4:], sn)
+		}
+		s.acks = s.acks[n:]
+		s.send(KCP_CMD_ACK, 0, data, wnd)
+	}
+	// one segment probes the closed window of peer
+	for limit := minInt(s.window, maxInt(s.rmtWnd, 1)); len(s.sndBuf) < limit && !s.finSent; {
+		chunk, fin := s.conn.take(KCP_MSS)
+		var seg = &kcpSegment{cmd: KCP_CMD_PUSH, sn: s.sndNxt, data: chunk, rto: s.rto}
+		if len(chunk) == 0 {
+			if !fin {
+				break
+			}
+			seg.cmd, s.finSent = KCP_CMD_FIN, true
+		}
+		s.sndNxt++
+		s.sndBuf = append(s.sndBuf, seg)
+	}
+	for _, seg := range s.sndBuf {
+		switch {
+		case seg.xmit == 0:
+		case seg.skipped >= KCP_FAST_RESEND:
+		case !now.Before(seg.resend):
+			if seg.rto += seg.rto / 2; seg.rto > KCP_RTO_MAX {
+				seg.rto = KCP_RTO_MAX
+			}
+		default:
+			continue
+		}
+		if seg.xmit++; seg.xmit > KCP_DEAD_LINK {
+			if log.V(log.LV_WARN) {
+				log.Warningln("KCP link was broken", s.conn.RemoteAddr())
+			}
+			s.conn.feed(nil, true)
+			return false
+		}
+		seg.sentAt, seg.resend, seg.skipped = now, now.Add(seg.rto), 0
+		s.send(seg.cmd, seg.sn, seg.data, wnd)
+	}
+	if now.Sub(s.seen) > KCP_IDLE_TIMEOUT {
+		s.conn.feed(nil, true)
+		return false
+	}
+	if s.finSent && s.finRecv && len(s.sndBuf) == 0 {
+		if s.finAt.IsZero() {
+			s.finAt = now
+		}
+		return now.Sub(s.finAt) < KCP_LINGER
+	}
+	return true
+}
+
+// stop without the fin, eg. the listener was closed
+func (s *kcpSession) abort() {
+	s.lock.Lock()
+	s.aborted = true
+	s.lock.Unlock()
+	s.conn.feed(nil, true)
+	select {
+	case s.conn.kick <- struct{}{}:
+	default:
+	}
+}
+
+// --------------------
+// fec
+// --------------------
+// the datagrams are grouped in shards and a parity, the parity is the XOR
+// of the length-prefixed bodies padded to the longest.
+type fecEncoder struct {
+	conv   uint32
+	shards int // data datagrams per group, 0 for none
+	seq    uint32
+	parity []byte
+	count  int
+}
+
+func (f *fecEncoder) encode(body []byte) [][]byte {
+	var out = [][]byte{f.datagram(body)}
+	if f.shards == 0 {
+		return out
+	}
+	if need := len(body) + 2; len(f.parity) < need {
+		f.parity = append(f.parity, make([]byte, need-len(f.parity))...)
+	}
+	f.parity[0] ^= byte(len(body) >> 8)
+	f.parity[1] ^= byte(len(body))
+	for i, b := range body {
+		f.parity[i+2] ^= b
+	}
+	if f.count++; f.count == f.shards {
+		out = append(out, f.datagram(f.parity))
+		f.parity, f.count = nil, 0
+		// wraps at the boundary of group
+		if f.seq >= 1<<31 {
+			f.seq = 0
+		}
+	}
+	return out
+}
+
+func (f *fecEncoder) datagram(body []byte) []byte {
+	var d = make([]byte, KCP_FEC_HEADER_LEN+len(body))
+	binary.BigEndian.PutUint32(d, f.conv)
+	binary.BigEndian.PutUint32(d[4:], f.seq)
+	d[8] = byte(f.shards)
+	copy(d[KCP_FEC_HEADER_LEN:], body)
+	f.seq++
+	return d
+}
+
+type fecGroup struct {
+	shards [][]byte // bodies by index, the last is parity
+	count  int
+	done   bool
+}
+
+type fecDecoder struct {
+	groups map[uint32]*fecGroup
+	order  []uint32 // evicted first in first
+}
+
+// the bodies of data in the datagram, or recovered by it
+func (f *fecDecoder) decode(seq uint32, shards int, body []byte) [][]byte {
+	if shards == 0 {
+		return [][]byte{body}
+	}
+	var (
+		id  = seq / uint32(shards+1)
+		idx = int(seq % uint32(shards+1))
+		out [][]byte
+	)
+	if idx < shards {
+		out = append(out, body)
+	}
+	g := f.groups[id]
+	if g == nil {
+		g = &fecGroup{shards: make([][]byte, shards+1)}
+		f.groups[id] = g
+		if f.order = append(f.order, id); len(f.order) > KCP_FEC_GROUPS {
+			delete(f.groups, f.order[0])
+			f.order = f.order[1:]
+		}
+	}
+	if g.done || len(g.shards) != shards+1 || g.shards[idx] != nil {
+		return out
+	}
+	g.shards[idx] = append([]byte(nil), body...)
+	if g.count++; g.count < shards {
+		return out
+	}
+	g.done = true
+	var lost = -1
+	for i, b := range g.shards[:shards] {
+		if b == nil {
+			lost = i
+		}
+	}
+	if lost < 0 {
+		return out
+	}
+	var rec = append([]byte(nil), g.shards[shards]...)
+	for i, b := range g.shards[:shards] {
+		if i == lost {
+			continue
+		}
+		if len(b)+2 > len(rec) {
+			return out
+		}
+		rec[0] ^= byte(len(b) >> 8)
+		rec[1] ^= byte(len(b))
+		for j, c := range b {
+			rec[j+2] ^= c
+		}
+	}
+	if len(rec) < 2 {
+		return out
+	}
+	if n := int(binary.BigEndian.Uint16(rec)); n <= len(rec)-2 {
+		out = append(out, rec[2:2+n])
+	}
+	return out
+}
+
+// --------------------
+// client
+// --------------------
+// the tunnel to the KCP listener of server, the shards of FEC are 0 for none
+func dialKCP(addr string, window, shards int) (net.Conn, error) {
+	raddr, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	udp, err := net.DialUDP("udp", nil, raddr)
+	if err != nil {
+		return nil, err
+	}
+	var conv = binary.BigEndian.Uint32(randArray(4))
+	s := newKcpSession(conv, window, shards, udp.LocalAddr(), raddr, func(d []byte) error {
+		_, err := udp.Write(d)
+		return err
+	})
+	go func() {
+		var buf = make([]byte, KCP_MTU*2)
+		for {
+			n, err := udp.Read(buf)
+			if err != nil {
+				select {
+				case <-s.done:
+					return
+				default: // refused by icmp, until the link is dead
+					time.Sleep(KCP_INTERVAL)
+					continue
+				}
+			}
+			c, seq, shards, body, y := parseKcpDatagram(buf[:n])
+			if y && c == conv {
+				s.receive(seq, shards, body)
+			}
+		}
+	}()
+	go func() {
+		s.run()
+		udp.Close()
+	}()
+	return s.conn, nil
+}
+
+// 16-4096
+func parseKcpWindow(str, option string) (int, error) {
+	n, e := strconv.Atoi(str)
+	if e != nil || n < KCP_WINDOW_MIN || n > KCP_WINDOW_MAX {
+		return 0, CONF_ERROR.Apply(option)
+	}
+	return n, nil
+}
+
+// --------------------
+// server
+// --------------------
+type kcpKey struct {
+	addr string
+	conv uint32
+}
+
+type kcpServer struct {
+	udp      *net.UDPConn
+	window   int
+	serve    func(net.Conn)
+	lock     sync.Mutex
+	sessions map[kcpKey]*kcpSession
+	closed   bool
+}
+
+func newKcpServer(udp *net.UDPConn, window int, serve func(net.Conn)) *kcpServer {
+	return &kcpServer{
+		udp:      udp,
+		window:   window,
+		serve:    serve,
+		sessions: make(map[kcpKey]*kcpSession),
+	}
+}
+
+func (t *kcpServer) run() {
+	var buf = make([]byte, KCP_MTU*2)
+	for {
+		n, from, err := t.udp.ReadFromUDP(buf)
+		if err != nil {
+			t.destroy()
+			return
+		}
+		t.input(buf[:n], from)
+	}
+}
+
+func (t *kcpServer) input(d []byte, from *net.UDPAddr) {
+	conv, seq, shards, body, y := parseKcpDatagram(d)
+	if !y {
+		return
+	}
+	var key = kcpKey{from.String(), conv}
+	t.lock.Lock()
+	s := t.sessions[key]
+	if s == nil {
+		// opened by the first segment of client
+		if t.closed || !isKcpOpening(seq, shards, body) || !t.admit(from.IP.String()) {
+			t.lock.Unlock()
+			return
+		}
+		s = newKcpSession(conv, t.window, shards, t.udp.LocalAddr(), from, func(d []byte) error {
+			_, err := t.udp.WriteToUDP(d, from)
+			return err
+		})
+		t.sessions[key] = s
+		go t.serve(s.conn)
+		go func() {
+			s.run()
+			t.lock.Lock()
+			delete(t.sessions, key)
+			t.lock.Unlock()
+		}()
+	}
+	t.lock.Unlock()
+	s.receive(seq, shards, body)
+}
+
+func isKcpOpening(seq uint32, shards int, body []byte) bool {
+	if shards > 0 && int(seq%uint32(shards+1)) == shards {
+		return false
+	}
+	return len(body) >= KCP_HEADER_LEN && body[0] == KCP_CMD_PUSH && binary.BigEndian.Uint32(body[3:]) == 0
+}
+
+// the source address of UDP could be spoofed, but the answers are lost.
+// must be called in lock
+func (t *kcpServer) admit(source string) bool {
+	if len(t.sessions) >= KCP_CONNS_MAX {
+		return false
+	}
+	var n int
+	for key := range t.sessions {
+		if host, _, _ := net.SplitHostPort(key.addr); host == source {
+			n++
+		}
+	}
+	return n < KCP_SOURCE_MAX
+}
+
+func (t *kcpServer) destroy() {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.closed = true
+	for _, s := range t.sessions {
+		s.abort()
+	}
+}
+
+// return nil if the KCP transport is not enabled
+func (t *Server) ListenKCP() (*net.UDPConn, error) {
+	if t.KCP == NULL {
+		return nil, nil
+	}
+	addr, err := net.ResolveUDPAddr("udp", t.KCP)
+	if err != nil {
+		return nil, CONF_ERROR.Apply("KCP")
+	}
+	udp, err := net.ListenUDP("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	go newKcpServer(udp, t.kcpWindow, t.TunnelServe).run()
+	return udp, nil
+}
@@ -0,0 +1,171 @@
+package tunnel
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestKCP(t *testing.T) {
+	udp, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer udp.Close()
+	var served, done = make(chan net.Conn, 1), make(chan bool)
+	go newKcpServer(udp, KCP_WINDOW, func(conn net.Conn) {
+		served <- conn
+		io.Copy(conn, conn)
+		conn.Close()
+		close(done)
+	}).run()
+
+	conn, err := dialKCP(udp.LocalAddr().String(), KCP_WINDOW, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, size := range []int{1, KCP_MSS + 1, 256 << 10} {
+		data := randArray(size)
+		go conn.Write(data)
+		buf := make([]byte, size)
+		conn.SetReadDeadline(time.Now().Add(GENERAL_SO_TIMEOUT))
+		if _, err = io.ReadFull(conn, buf); err != nil {
+			t.Fatal(size, err)
+		}
+		if !bytes.Equal(data, buf) {
+			t.Fatalf("size=%d echo mismatched", size)
+		}
+	}
+	if _, y := (<-served).(*kcpConn); !y {
+		t.Errorf("served conn is not kcpConn")
+	}
+	// closed by client
+	conn.Close()
+	select {
+	case <-done:
+	case <-time.After(GENERAL_SO_TIMEOUT):
+		t.Errorf("server was not aware of closing")
+	}
+}
+
+// the datagrams are dropped in turn and reordered between the pair
+func newLossyKcpPair(window, shards, drop int) (*kcpSession, *kcpSession) {
+	var a, b *kcpSession
+	var wire = func(peer **kcpSession) func([]byte) error {
+		var n int
+		return func(d []byte) error {
+			if n++; n%drop == 0 {
+				return nil
+			}
+			_, seq, shards, body, _ := parseKcpDatagram(d)
+			go (*peer).receive(seq, shards, append([]byte(nil), body...))
+			return nil
+		}
+	}
+	var addr = &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 1}
+	a = newKcpSession(1, window, shards, addr, addr, wire(&b))
+	b = newKcpSession(1, window, shards, addr, addr, wire(&a))
+	return a, b
+}
+
+func TestKCPLossy(t *testing.T) {
+	for _, shards := range []int{0, 4} {
+		a, b := newLossyKcpPair(KCP_WINDOW_MIN, shards, 5)
+		go a.run()
+		go b.run()
+		data := randArray(128 << 10)
+		go func() {
+			a.conn.Write(data)
+			a.conn.Close()
+		}()
+		b.conn.SetReadDeadline(time.Now().Add(GENERAL_SO_TIMEOUT))
+		var buf bytes.Buffer
+		if _, err := io.Copy(&buf, b.conn); err != nil {
+			t.Fatal(shards, err)
+		}
+		if !bytes.Equal(data, buf.Bytes()) {
+			t.Fatalf("shards=%d received %d bytes mismatched", shards, buf.Len())
+		}
+		b.conn.Close()
+		select {
+		case <-a.done:
+		case <-time.After(GENERAL_SO_TIMEOUT):
+			t.Errorf("shards=%d session was not finished", shards)
+		}
+	}
+}
+
+func TestFecRecovery(t *testing.T) {
+	var (
+		enc    = &fecEncoder{conv: 1, shards: 3}
+		dec    = &fecDecoder{groups: make(map[uint32]*fecGroup)}
+		bodies = [][]byte{randArray(10), randArray(100), randArray(1)}
+		out    [][]byte
+	)
+	for i, body := range bodies {
+		for _, d := range enc.encode(body) {
+			// the second is lost
+			if i == 1 && len(d) == KCP_FEC_HEADER_LEN+len(body) {
+				continue
+			}
+			_, seq, shards, b, y := parseKcpDatagram(d)
+			if !y {
+				t.Fatalf("invalid datagram % x", d)
+			}
+			out = append(out, dec.decode(seq, shards, b)...)
+		}
+	}
+	if len(out) != 3 || !bytes.Equal(out[2], bodies[1]) {
+		t.Errorf("recovered %d bodies % x", len(out), out)
+	}
+	// the groups are bounded
+	for i := 0; i < KCP_FEC_GROUPS*2; i++ {
+		for _, d := range enc.encode(randArray(8)) {
+			_, seq, shards, b, _ := parseKcpDatagram(d)
+			dec.decode(seq, shards, b)
+		}
+	}
+	if len(dec.groups) > KCP_FEC_GROUPS {
+		t.Errorf("kept %d groups", len(dec.groups))
+	}
+}
+
+func TestKcpServerAdmit(t *testing.T) {
+	udp, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer udp.Close()
+	server := newKcpServer(udp, KCP_WINDOW, func(net.Conn) {})
+	defer server.destroy()
+	var open = func(conv uint32, sn uint32, from *net.UDPAddr) {
+		enc := &fecEncoder{conv: conv}
+		pkt := make([]byte, KCP_HEADER_LEN)
+		pkt[0] = KCP_CMD_PUSH
+		pkt[6] = byte(sn)
+		server.input(enc.encode(pkt)[0], from)
+	}
+	var count = func() int {
+		server.lock.Lock()
+		defer server.lock.Unlock()
+		return len(server.sessions)
+	}
+	var from = &net.UDPAddr{IP: net.IPv4(127, 0, 0, 2), Port: 1000}
+	// not the first segment
+	open(1, 1, from)
+	if count() != 0 {
+		t.Errorf("opened by the later segment")
+	}
+	for i := 0; i < KCP_SOURCE_MAX+1; i++ {
+		open(uint32(i), 0, from)
+	}
+	if count() != KCP_SOURCE_MAX {
+		t.Errorf("opened %d sessions of a source", count())
+	}
+	open(1, 0, &net.UDPAddr{IP: net.IPv4(127, 0, 0, 3), Port: 1000})
+	if count() != KCP_SOURCE_MAX+1 {
+		t.Errorf("refused the other source")
+	}
+}
@@ -0,0 +1,169 @@
+package tunnel
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	log "github.com/Lafeng/deblocus/glog"
+	"github.com/cloudflare/golibs/lrucache"
+)
+
+const (
+	// time~8 | nonce~8 | hmac~16 | padding
+	KNOCK_LEN     = 32
+	KNOCK_PAD_MAX = 32
+	KNOCK_SKEW    = time.Second * 90
+	// the source is admitted in window after the knock
+	KNOCK_WINDOW  = time.Second * 30
+	KNOCK_SRC_MAX = 1 << 16
+	// the knock goes first for the race to the SYN
+	KNOCK_LEAD = time.Millisecond * 50
+)
+
+func newKnockKey(sharedKey []byte) []byte {
+	var key = sha256.Sum256(append([]byte("knock:"), sharedKey...))
+	return key[:]
+}
+
+func signKnock(key, packet []byte) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write(packet[:16])
+	return mac.Sum(nil)[:KNOCK_LEN-16]
+}
+
+// the packet of single packet authorization, stamped and signed by the key
+// derived from the public key of server.
+func makeKnock(key []byte) []byte {
+	packet := randArray(KNOCK_LEN + int(myRand.Int63n(KNOCK_PAD_MAX+1)))
+	binary.BigEndian.PutUint64(packet, uint64(time.Now().Unix()))
+	copy(packet[16:], signKnock(key, packet))
+	return packet
+}
+
+// send the knock to server udp address from the local address of dialer,
+// so the source is the same as of the tunnel dialed by it.
+func sendKnock(key []byte, addr string, dialer *net.Dialer) error {
+	var udpDialer = &net.Dialer{Timeout: GENERAL_SO_TIMEOUT}
+	if local, y := dialer.LocalAddr.(*net.TCPAddr); y {
+		udpDialer.LocalAddr = &net.UDPAddr{IP: local.IP}
+	}
+	conn, err := udpDialer.Dial("udp", addr)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	_, err = conn.Write(makeKnock(key))
+	return err
+}
+
+// --------------------
+// knockGate
+// --------------------
+// the tcp connections are reset without reading anything unless the source
+// sent a valid knock to the udp port in window, so the listener looks closed
+// to the mass scanners. the knocks are stamped in tolerance of clock skew and
+// spent once.
+type knockGate struct {
+	knocked int64
+	invalid int64
+	refused int64
+	key     []byte
+	window  time.Duration
+	sources *lrucache.LRUCache // admitted ip
+	spent   *lrucache.LRUCache
+	lock    sync.Mutex
+}
+
+func newKnockGate(sharedKey []byte, window time.Duration) *knockGate {
+	return &knockGate{
+		key:     newKnockKey(sharedKey),
+		window:  window,
+		sources: lrucache.NewLRUCache(KNOCK_SRC_MAX),
+		spent:   lrucache.NewLRUCache(KNOCK_SRC_MAX),
+	}
+}
+
+// return true if the source was admitted by the packet
+func (g *knockGate) knock(packet []byte, src net.Addr) bool {
+	var now = time.Now()
+	if len(packet) < KNOCK_LEN || !hmac.Equal(packet[16:KNOCK_LEN], signKnock(g.key, packet)) {
+		atomic.AddInt64(&g.invalid, 1)
+		return false
+	}
+	stamp := time.Unix(int64(binary.BigEndian.Uint64(packet)), 0)
+	if stamp.Before(now.Add(-KNOCK_SKEW)) || stamp.After(now.Add(KNOCK_SKEW)) {
+		atomic.AddInt64(&g.invalid, 1)
+		return false
+	}
+	var nonce = string(packet[:16])
+	g.lock.Lock()
+	_, replayed := g.spent.GetNotStale(nonce)
+	if !replayed {
+		g.spent.Set(nonce, true, stamp.Add(KNOCK_SKEW))
+		g.sources.Set(ipAddr(src), true, now.Add(g.window))
+	}
+	g.lock.Unlock()
+	if replayed {
+		atomic.AddInt64(&g.invalid, 1)
+		return false
+	}
+	atomic.AddInt64(&g.knocked, 1)
+	return true
+}
+
+func (g *knockGate) admit(src net.Addr) bool {
+	g.lock.Lock()
+	_, y := g.sources.GetNotStale(ipAddr(src))
+	g.lock.Unlock()
+	if !y {
+		atomic.AddInt64(&g.refused, 1)
+	}
+	return y
+}
+
+// serve the knocks until the conn was closed
+func (g *knockGate) serve(conn *net.UDPConn) {
+	var buf = make([]byte, KNOCK_LEN+KNOCK_PAD_MAX+1)
+	for {
+		nr, src, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			if IsClosedError(err) {
+				return
+			}
+			continue
+		}
+		if !g.knock(buf[:nr], src) {
+			if log.V(log.LV_WARN) {
+				log.Warningf("Invalid knock from=%s", src)
+			}
+		}
+	}
+}
+
+func (g *knockGate) String() string {
+	return fmt.Sprintf("Knocked=%d Knock-invalid=%d Knock-refused=%d",
+		atomic.LoadInt64(&g.knocked), atomic.LoadInt64(&g.invalid), atomic.LoadInt64(&g.refused))
+}
+
+// return nil if the knock is not enabled
+func (t *Server) ListenKnock() (*net.UDPConn, error) {
+	if t.knocks == nil {
+		return nil, nil
+	}
+	addr, err := net.ResolveUDPAddr("udp", t.Knock)
+	if err != nil {
+		return nil, CONF_ERROR.Apply("Knock")
+	}
+	udp, err := net.ListenUDP("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	go t.knocks.serve(udp)
+	return udp, nil
+}
@@ -0,0 +1,79 @@
+package tunnel
+
+import (
+	"encoding/binary"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestKnockGate(t *testing.T) {
+	var (
+		g     = newKnockGate([]byte("shared"), time.Minute)
+		key   = newKnockKey([]byte("shared"))
+		alice = &net.UDPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 1}
+		bob   = &net.UDPAddr{IP: net.IPv4(10, 0, 0, 2), Port: 1}
+	)
+	if g.admit(alice) {
+		t.Fatalf("admitted without knock")
+	}
+	packet := makeKnock(key)
+	if !g.knock(packet, alice) {
+		t.Fatalf("valid knock was refused")
+	}
+	// the tcp source port differs
+	if !g.admit(&net.TCPAddr{IP: alice.IP, Port: 2}) || g.admit(bob) {
+		t.Errorf("unexpected admission")
+	}
+
+	// replayed, tampered, signed by other key, or stale
+	if g.knock(packet, bob) {
+		t.Errorf("replayed knock was accepted")
+	}
+	packet = makeKnock(key)
+	packet[8] ^= 1
+	if g.knock(packet, bob) {
+		t.Errorf("tampered knock was accepted")
+	}
+	if g.knock(makeKnock(newKnockKey([]byte("other"))), bob) {
+		t.Errorf("knock of other key was accepted")
+	}
+	packet = makeKnock(key)
+	binary.BigEndian.PutUint64(packet, uint64(time.Now().Add(-KNOCK_SKEW*2).Unix()))
+	copy(packet[16:], signKnock(key, packet))
+	if g.knock(packet, bob) || g.admit(bob) {
+		t.Errorf("stale knock was accepted")
+	}
+	if s := g.String(); !strings.Contains(s, "Knocked=1 Knock-invalid=4 Knock-refused=3") {
+		t.Errorf("unexpected stats %s", s)
+	}
+}
+
+func TestKnockOverUDP(t *testing.T) {
+	var serv = newTestServer()
+	serv.Knock, serv.sharedKey = "127.0.0.1:0", []byte("shared")
+	serv.knocks = newKnockGate(serv.sharedKey, time.Minute)
+	udp, err := serv.ListenKnock()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer udp.Close()
+	// from the bound address of tunnel
+	var (
+		local  = &net.TCPAddr{IP: net.IPv4(127, 0, 0, 2)}
+		dialer = &net.Dialer{LocalAddr: local}
+	)
+	if err = sendKnock(newKnockKey(serv.sharedKey), udp.LocalAddr().String(), dialer); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 100 && !serv.knocks.admit(local); i++ {
+		time.Sleep(time.Millisecond * 10)
+	}
+	if !serv.knocks.admit(local) {
+		t.Errorf("knock was not received")
+	}
+	if serv.knocks.admit(&net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)}) {
+		t.Errorf("admitted the other source")
+	}
+}
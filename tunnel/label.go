@@ -0,0 +1,93 @@
+package tunnel
+
+import (
+	"net"
+	"regexp"
+	"strings"
+
+	"github.com/Lafeng/deblocus/exception"
+)
+
+const (
+	// keys of label rule
+	LR_CLASS = "class"
+	LR_ROUTE = "route"
+	LR_DENY  = "deny"
+)
+
+var (
+	INVALID_LABEL = exception.New("Invalid label")
+	labelPattern  = regexp.MustCompile("^[A-Za-z0-9_-]{1,32}$")
+)
+
+// --------------------
+// labelRule
+// --------------------
+// the treatment of sessions carrying the label supplied by client.
+// defined in the config section, a key is an allowed label and the value is
+// the rules separated by "|" (";" is comment in ini), eg. mobile = class=free |
+// route=default eth1 | deny=10.0.0.0/8,192.168.0.0/16
+type labelRule struct {
+	class  string
+	egress *egressTable
+	deny   []*net.IPNet
+}
+
+func parseLabelRule(label, value string) (*labelRule, error) {
+	if !labelPattern.MatchString(label) {
+		return nil, INVALID_LABEL.Apply(label)
+	}
+	var (
+		rule   = new(labelRule)
+		routes []string
+		err    error
+	)
+	for _, item := range strings.Split(value, "|") {
+		if item = strings.TrimSpace(item); item == NULL {
+			continue
+		}
+		k, v := SubstringBefore(item, "=")
+		switch strings.TrimSpace(k) {
+		case LR_CLASS:
+			rule.class = strings.TrimSpace(v)
+		case LR_ROUTE:
+			routes = append(routes, v)
+		case LR_DENY:
+			if rule.deny, err = parseNetworks(strings.Split(v, ",")); err != nil {
+				return nil, INVALID_LABEL.Apply(label + ": " + item)
+			}
+		default:
+			return nil, INVALID_LABEL.Apply(label + ": " + item)
+		}
+	}
+	if len(routes) > 0 {
+		if rule.egress, err = newEgressTable(routes); err != nil {
+			return nil, INVALID_LABEL.Apply(label + ": " + err.Error())
+		}
+	}
+	return rule, nil
+}
+
+// the rule of label takes precedence over the policies of user
+func (s *Session) applyLabelRule(label string, rule *labelRule) {
+	s.label = label
+	if sched := s.server.sched; sched != nil && rule.class != NULL {
+		if c, known := sched.class(rule.class); known {
+			s.mux.class = c
+		}
+	}
+	if rule.egress != nil {
+		s.mux.egress = rule.egress
+	}
+	if len(rule.deny) > 0 {
+		var guard = &destGuard{networks: rule.deny}
+		if s.server.resolver != nil {
+			guard.resolver = s.server.resolver
+		}
+		if s.mux.filter != nil {
+			s.mux.filter = filterChain{s.mux.filter, guard}
+		} else {
+			s.mux.filter = guard
+		}
+	}
+}
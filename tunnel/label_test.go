@@ -0,0 +1,48 @@
+package tunnel
+
+import (
+	"net"
+	"testing"
+)
+
+func TestLabelRules(t *testing.T) {
+	mobile, err := parseLabelRule("mobile", "class=free | route=default 192.0.2.7 | deny=10.0.0.0/8, 192.168.0.0/16")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ci, err := parseLabelRule("ci", NULL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, bad := range [][2]string{{"mo bile", NULL}, {"mobile", "speed=1"}, {"mobile", "deny=10.0.0.0"}, {"mobile", "route=10.0.0.0/8"}} {
+		if _, err = parseLabelRule(bad[0], bad[1]); err == nil {
+			t.Errorf("expected error for %q", bad)
+		}
+	}
+
+	serv := newTestServer()
+	serv.sched, _ = newEgressScheduler(1<<20, "free:1,default:4")
+	var newSession = func(label string, rule *labelRule) *Session {
+		s := newTestSession(serv, "alice")
+		s.mux.class, _ = serv.sched.class(NULL)
+		s.applyLabelRule(label, rule)
+		return s
+	}
+
+	s := newSession("mobile", mobile)
+	if s.label != "mobile" || s.mux.class.name != "free" {
+		t.Errorf("label=%s class=%s", s.label, s.mux.class.name)
+	}
+	if r := s.mux.egress.lookup(net.ParseIP("8.8.8.8")); r == nil || !r.source.Equal(net.ParseIP("192.0.2.7")) {
+		t.Errorf("unexpected egress %+v", r)
+	}
+	if !s.mux.filter.Filter("10.1.1.1:80") || !s.mux.filter.Filter("192.168.1.1:80") || s.mux.filter.Filter("8.8.8.8:53") {
+		t.Errorf("unexpected acl")
+	}
+
+	// label without rules
+	s = newSession("ci", ci)
+	if s.label != "ci" || s.mux.class.name != CLASS_DEFAULT || s.mux.egress != nil || s.mux.filter != nil {
+		t.Errorf("unexpected treatment of ci")
+	}
+}
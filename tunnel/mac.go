@@ -0,0 +1,156 @@
+package tunnel
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"hash"
+	"io"
+)
+
+const (
+	MAC_TAG_LEN     = 16
+	MAC_PAYLOAD_MAX = 0x3fff
+)
+
+// --------------------
+// macCipherKit
+// --------------------
+// the stream ciphers don't detect the flipped bits, so the frames of tunnel
+// are sealed into the records of encrypt-then-MAC if both sides are capable:
+//   encrypted length(2) | encrypted payload | tag
+// the tag is the truncated HMAC-SHA256 of the sequence and the ciphertext,
+// then the reordered, replayed or tampered records fail the tunnel.
+// each direction of each tunnel has its own key derived from the key of
+// session and the iv of tunnel, so the records couldn't be reflected to the
+// sender or spliced into the other tunnels of session.
+
+type macCipherKit struct {
+	stream *XORCipherKit
+	// sealing
+	wmac hash.Hash
+	wseq uint64
+	// opening
+	rmac   hash.Hash
+	rseq   uint64
+	rbuf   []byte
+	filled int
+	plen   int    // length of the pending payload, -1 if reading length
+	plain  []byte // opened but unread
+}
+
+// the kit of stream cipher in the key of session, the iv of tunnel and the role
+func newMACCipherKit(stream *XORCipherKit, key, iv []byte, isClient bool) *macCipherKit {
+	var wdir, rdir = []byte("mac-c2s"), []byte("mac-s2c")
+	if !isClient {
+		wdir, rdir = rdir, wdir
+	}
+	return &macCipherKit{
+		stream: stream,
+		wmac:   hmac.New(sha256.New, normalizeKey(sha256.Size, key, iv, wdir)),
+		rmac:   hmac.New(sha256.New, normalizeKey(sha256.Size, key, iv, rdir)),
+		rbuf:   make([]byte, 2+MAC_PAYLOAD_MAX+MAC_TAG_LEN),
+		plen:   -1,
+	}
+}
+
+// the records only
+func (c *macCipherKit) encrypt(dst, src []byte) {
+	panic(ILLEGAL_STATE.Apply("MAC"))
+}
+
+func (c *macCipherKit) decrypt(dst, src []byte) {
+	panic(ILLEGAL_STATE.Apply("MAC"))
+}
+
+func (c *macCipherKit) Cleanup() {
+	c.stream.Cleanup()
+}
+
+// the keys of MAC are kept, the sequences go on
+func (c *macCipherKit) rekey(fresh cipherKit, write bool) {
+	c.stream.rekey(fresh, write)
+}
+
+// the records of b
+func (c *macCipherKit) seal(b []byte) []byte {
+	var (
+		records = (len(b) + MAC_PAYLOAD_MAX - 1) / MAC_PAYLOAD_MAX
+		out     = bytePool.Get(len(b) + records*(2+MAC_TAG_LEN))[:0]
+	)
+	for len(b) > 0 {
+		n := minInt(len(b), MAC_PAYLOAD_MAX)
+		pos := len(out)
+		out = out[:pos+2+n]
+		binary.BigEndian.PutUint16(out[pos:], uint16(n))
+		copy(out[pos+2:], b[:n])
+		c.stream.encrypt(out[pos:], out[pos:])
+		out = c.tag(c.wmac, c.wseq, out, out[pos:])
+		c.wseq++
+		b = b[n:]
+	}
+	return out
+}
+
+// read the plaintext of records from r
+func (c *macCipherKit) open(r io.Reader, b []byte) (int, error) {
+	for len(c.plain) == 0 {
+		var need = 2
+		if c.plen >= 0 {
+			need += c.plen + MAC_TAG_LEN
+		}
+		// keep the partial record if timeout
+		for c.filled < need {
+			n, err := r.Read(c.rbuf[c.filled:need])
+			c.filled += n
+			if err != nil && c.filled < need {
+				return 0, err
+			}
+		}
+		if c.plen < 0 {
+			// the length is decrypted in the copy, verified with the record
+			var length [2]byte
+			c.stream.decrypt(length[:], c.rbuf[:2])
+			c.plen = int(binary.BigEndian.Uint16(length[:]))
+			if c.plen == 0 || c.plen > MAC_PAYLOAD_MAX {
+				return 0, AUTHENTICATION_FAILED
+			}
+			continue
+		}
+		var (
+			sealed = c.rbuf[:2+c.plen]
+			tag    = c.tag(c.rmac, c.rseq, nil, sealed)
+		)
+		if !hmac.Equal(tag, c.rbuf[len(sealed):need]) {
+			return 0, AUTHENTICATION_FAILED
+		}
+		c.rseq++
+		c.stream.decrypt(sealed[2:], sealed[2:])
+		c.plain = sealed[2:]
+		c.filled, c.plen = 0, -1
+	}
+	n := copy(b, c.plain)
+	c.plain = c.plain[n:]
+	return n, nil
+}
+
+// append the tag of the sequence and the ciphertext to out
+func (c *macCipherKit) tag(mac hash.Hash, seq uint64, out, sealed []byte) []byte {
+	var seqBuf [8]byte
+	binary.BigEndian.PutUint64(seqBuf[:], seq)
+	mac.Reset()
+	mac.Write(seqBuf[:])
+	mac.Write(sealed)
+	var sum [sha256.Size]byte
+	return append(out, mac.Sum(sum[:0])[:MAC_TAG_LEN]...)
+}
+
+// seal the frames of the stream cipher since the next writing and reading,
+// in the key of session and the iv of tunnel.
+func (c *Conn) authenticateFrames(isClient bool) {
+	c.wlock.Lock()
+	defer c.wlock.Unlock()
+	if stream, y := c.cipher.(*XORCipherKit); y && c.cf != nil {
+		c.cipher = newMACCipherKit(stream, c.cf.key, c.iv, isClient)
+	}
+}
@@ -0,0 +1,115 @@
+package tunnel
+
+import (
+	"bytes"
+	"io"
+	"testing"
+	"time"
+)
+
+func TestMACRecord(t *testing.T) {
+	var (
+		iv     = []byte("0123456789abcdef")
+		cf     = NewCipherFactory("AES128CTR", []byte("secret"))
+		newKit = func(isClient bool) *macCipherKit {
+			return newMACCipherKit(cf.InitCipher(iv).(*XORCipherKit), cf.key, iv, isClient)
+		}
+		sealer = newKit(true)
+		opener = newKit(false)
+		data   = randArray(MAC_PAYLOAD_MAX + 100)
+		sealed = sealer.seal(data)
+	)
+	if len(sealed) != len(data)+2*(2+MAC_TAG_LEN) {
+		t.Fatalf("sealed %d bytes", len(sealed))
+	}
+	// the partial record is kept across the timeouts
+	var (
+		r   = &tricklingReader{data: sealed}
+		buf = make([]byte, len(data))
+		n   int
+	)
+	for n < len(buf) {
+		m, err := opener.open(r, buf[n:])
+		if err != nil && !IsTimeout(err) {
+			t.Fatal(err)
+		}
+		n += m
+	}
+	if !bytes.Equal(buf, data) {
+		t.Fatalf("opened mismatched")
+	}
+
+	// the garbled length may be beyond the record
+	var tampered = func(name string, opener *macCipherKit, sealed []byte) {
+		if n, err := opener.open(bytes.NewReader(sealed), buf); n > 0 || err == nil {
+			t.Errorf("opened the %s err=%v", name, err)
+		}
+	}
+	// flipped bit of payload
+	sealed = sealer.seal(data[:100])
+	sealed[10] ^= 1
+	tampered("flipped", newKit(false), sealed)
+	// replayed, the sequence goes on
+	sealer, opener = newKit(true), newKit(false)
+	sealed = sealer.seal(data[:100])
+	if _, err := opener.open(bytes.NewReader(sealed), buf); err != nil {
+		t.Fatal(err)
+	}
+	tampered("replayed", opener, sealed)
+	// reflected to the sender
+	tampered("reflected", newKit(true), newKit(true).seal(data[:100]))
+	// spliced into the other tunnel of session at the same sequence, even if
+	// the keystream was the same, the MAC key of tunnel differs
+	var other = newMACCipherKit(cf.InitCipher(iv).(*XORCipherKit), cf.key, []byte("fedcba9876543210"), false)
+	if _, err := other.open(bytes.NewReader(newKit(true).seal(data[:100])), buf); err != AUTHENTICATION_FAILED {
+		t.Errorf("opened the spliced err=%v", err)
+	}
+}
+
+func TestMACConn(t *testing.T) {
+	var (
+		iv = []byte("0123456789abcdef")
+		cf = NewCipherFactory("CHACHA20", []byte("secret"))
+	)
+	c, s := tcpPair(t)
+	defer c.Close()
+	defer s.Close()
+	client, server := NewConn(c, nil), NewConn(s, nil)
+	client.SetupCipher(cf, iv)
+	server.SetupCipher(cf, iv)
+	client.authenticateFrames(true)
+	server.authenticateFrames(false)
+	if _, y := client.cipher.(*macCipherKit); !y {
+		t.Fatalf("not authenticated %T", client.cipher)
+	}
+	var echo = func(w, r *Conn, size int) {
+		data := randArray(size)
+		go w.Write(append([]byte(nil), data...))
+		buf := make([]byte, size)
+		r.SetReadDeadline(time.Now().Add(GENERAL_SO_TIMEOUT))
+		if _, err := io.ReadFull(r, buf); err != nil {
+			t.Fatal(size, err)
+		}
+		if !bytes.Equal(data, buf) {
+			t.Fatalf("size=%d mismatched", size)
+		}
+	}
+	for _, size := range []int{1, MAC_PAYLOAD_MAX + 1, FRAME_MAX_LEN} {
+		echo(client, server, size)
+		echo(server, client, size)
+	}
+
+	// the tampered bytes on the wire fail the reader
+	data := randArray(64)
+	go func() {
+		client.wlock.Lock()
+		sealed := client.cipher.(recordCipherKit).seal(data)
+		sealed[len(sealed)-1] ^= 1
+		c.Write(sealed)
+		client.wlock.Unlock()
+	}()
+	server.SetReadDeadline(time.Now().Add(GENERAL_SO_TIMEOUT))
+	if _, err := io.ReadFull(server, make([]byte, len(data))); err != AUTHENTICATION_FAILED {
+		t.Errorf("read the tampered err=%v", err)
+	}
+}
@@ -0,0 +1,213 @@
+package tunnel
+
+import (
+	"bytes"
+	"crypto/subtle"
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+const (
+	METRICS_PATH   = "/metrics"
+	METRICS_PREFIX = "deblocus_"
+)
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// --------------------
+// trafficLedger
+// --------------------
+// the traffic of destroyed sessions by user, so the counters of user exported
+// to the metrics never go backwards while the sessions come and go.
+type trafficLedger struct {
+	lock  sync.Mutex
+	users map[string]*trafficEntry
+}
+
+type trafficEntry struct {
+	rx, tx, streams int64
+}
+
+func newTrafficLedger() *trafficLedger {
+	return &trafficLedger{users: make(map[string]*trafficEntry)}
+}
+
+func (l *trafficLedger) retire(s *Session) {
+	if l == nil || s.uid == NULL {
+		return
+	}
+	rx, tx, streams := s.mux.traffic()
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	var e = l.users[s.uid]
+	if e == nil {
+		e = new(trafficEntry)
+		l.users[s.uid] = e
+	}
+	e.rx += rx
+	e.tx += tx
+	e.streams += streams
+}
+
+// add the retired traffic into the stats of the living sessions
+func (l *trafficLedger) merge(st *ServerStats) {
+	if l == nil {
+		return
+	}
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	for uid, e := range l.users {
+		var user = st.Users[uid]
+		if user == nil {
+			user = new(UserStats)
+			st.Users[uid] = user
+		}
+		user.RxBytes += e.rx
+		user.TxBytes += e.tx
+		user.Streams += e.streams
+		st.RxBytes += e.rx
+		st.TxBytes += e.tx
+		st.Streams += e.streams
+	}
+}
+
+// --------------------
+// metrics
+// --------------------
+// the stats of server in the text exposition format of Prometheus.
+// the gauges are sampled on scraping, and the counters are accumulated since
+// the server started.
+type metricsWriter struct {
+	buf *bytes.Buffer
+}
+
+// the header of metric family
+func (w *metricsWriter) family(name, kind, help string) {
+	fmt.Fprintf(w.buf, "# HELP %s%s %s\n", METRICS_PREFIX, name, help)
+	fmt.Fprintf(w.buf, "# TYPE %s%s %s\n", METRICS_PREFIX, name, kind)
+}
+
+// the sample with the label pairs of name and value
+func (w *metricsWriter) sample(name string, value int64, labels ...string) {
+	w.buf.WriteString(METRICS_PREFIX + name)
+	if len(labels) > 1 {
+		w.buf.WriteByte('{')
+		for i := 0; i+1 < len(labels); i += 2 {
+			if i > 0 {
+				w.buf.WriteByte(',')
+			}
+			w.buf.WriteString(labels[i] + `="` + labelEscaper.Replace(labels[i+1]) + `"`)
+		}
+		w.buf.WriteByte('}')
+	}
+	w.buf.WriteString(" " + strconv.FormatInt(value, 10) + "\n")
+}
+
+func (w *metricsWriter) single(name, kind, help string, value int64) {
+	w.family(name, kind, help)
+	w.sample(name, value)
+}
+
+func (t *Server) writeMetrics(w *metricsWriter) {
+	var st = t.collectStats()
+	t.traffic.merge(st)
+	w.single("sessions", "gauge", "Sessions of clients.", int64(st.Sessions))
+	w.single("tunnels", "gauge", "Tunnels of sessions.", int64(st.Tunnels))
+	w.single("tokens", "gauge", "Unconsumed tokens in the pool.", int64(st.Tokens))
+	w.single("active_streams", "gauge", "Streams in relaying.", st.ActiveStreams)
+	w.single("queued_frames", "gauge", "Frames queued to the destinations.", int64(st.QueuedFrames))
+	if t.buffers != nil {
+		t.buffers.lock.Lock()
+		var used = t.buffers.used
+		t.buffers.lock.Unlock()
+		w.single("buffered_bytes", "gauge", "Bytes of the queued frames.", used)
+	}
+	w.single("streams_total", "counter", "Streams opened.", st.Streams)
+	w.single("rx_bytes_total", "counter", "Bytes received from clients.", st.RxBytes)
+	w.single("tx_bytes_total", "counter", "Bytes sent to clients.", st.TxBytes)
+	w.single("plan_drops_total", "counter", "Sessions dropped by the plan limit.", atomic.LoadInt64(&t.planDrops))
+
+	w.family("handshake_failures_total", "counter", "Failed handshakes by stage.")
+	var stages = make([]string, 0, len(st.Failures))
+	for name := range st.Failures {
+		stages = append(stages, name)
+	}
+	sort.Strings(stages)
+	for _, name := range stages {
+		w.sample("handshake_failures_total", st.Failures[name], "stage", name)
+	}
+
+	var users = make([]string, 0, len(st.Users))
+	for uid := range st.Users {
+		users = append(users, uid)
+	}
+	sort.Strings(users)
+	var perUser = []struct {
+		name, kind, help string
+		value            func(u *UserStats) int64
+	}{
+		{"user_sessions", "gauge", "Sessions of user.", func(u *UserStats) int64 { return int64(u.Sessions) }},
+		{"user_tunnels", "gauge", "Tunnels of user.", func(u *UserStats) int64 { return int64(u.Tunnels) }},
+		{"user_active_streams", "gauge", "Streams of user in relaying.", func(u *UserStats) int64 { return u.ActiveStreams }},
+		{"user_queued_frames", "gauge", "Frames of user queued to the destinations.", func(u *UserStats) int64 { return int64(u.QueuedFrames) }},
+		{"user_streams_total", "counter", "Streams opened by user.", func(u *UserStats) int64 { return u.Streams }},
+		{"user_rx_bytes_total", "counter", "Bytes received from user.", func(u *UserStats) int64 { return u.RxBytes }},
+		{"user_tx_bytes_total", "counter", "Bytes sent to user.", func(u *UserStats) int64 { return u.TxBytes }},
+	}
+	for _, m := range perUser {
+		w.family(m.name, m.kind, m.help)
+		for _, uid := range users {
+			w.sample(m.name, m.value(st.Users[uid]), "user", uid)
+		}
+	}
+}
+
+// the scrapes must carry the token as Bearer if not empty
+func (t *Server) metricsHandler(path, token string) http.Handler {
+	var (
+		mux    = http.NewServeMux()
+		bearer = []byte("Bearer " + token)
+	)
+	mux.HandleFunc(path, func(w http.ResponseWriter, r *http.Request) {
+		if token != NULL && subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), bearer) != 1 {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		var mw = &metricsWriter{buf: new(bytes.Buffer)}
+		t.writeMetrics(mw)
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		w.Write(mw.buf.Bytes())
+	})
+	return mux
+}
+
+// the listener of metrics, or nil if not configured
+func (t *Server) ListenMetrics() (net.Listener, error) {
+	if t.Metrics == NULL {
+		return nil, nil
+	}
+	addr, path, err := parseListenPath(t.Metrics)
+	if err != nil {
+		return nil, CONF_ERROR.Apply("Metrics")
+	}
+	if t.MetricsToken == NULL {
+		if err = validateLoopbackAddr("Metrics", t.Metrics); err != nil {
+			return nil, err
+		}
+	}
+	if !strings.Contains(t.Metrics, "/") {
+		path = METRICS_PATH
+	}
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	go newHTTPServer(t.metricsHandler(path, t.MetricsToken)).Serve(ln)
+	return ln, nil
+}
@@ -0,0 +1,106 @@
+package tunnel
+
+import (
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestMetrics(t *testing.T) {
+	var (
+		serv  = newTestServer()
+		alice = newTestSession(serv, "alice")
+		bob   = newTestSession(serv, "bob")
+		gone  = newTestSession(serv, `al"ice`)
+	)
+	serv.traffic = newTrafficLedger()
+	serv.handshakes = newHandshakeMeter()
+	for _, s := range []*Session{alice, bob, gone} {
+		serv.sessionMgr.register(s)
+		defer s.destroy(SESSION_CLOSE_SHUTDOWN)
+	}
+	serv.sessionMgr.createTokens(alice, 3)
+	alice.activeCnt = 2
+	alice.mux.rxBytes, alice.mux.txBytes = 100, 1000
+	gone.mux.rxBytes, gone.mux.txBytes = 5, 50
+	// the stream is counted by registering
+	if !alice.mux.acquireStream() {
+		t.Fatal("stream was refused")
+	}
+	defer alice.mux.releaseStream()
+	dst, rd := net.Pipe()
+	defer rd.Close()
+	alice.mux.router.register("key", "dest:80", nil, dst, false)
+	serv.handshakes.fail(STAGE_AUTH)
+	// the traffic is kept after destroyed
+	gone.destroy(SESSION_CLOSE_SHUTDOWN)
+
+	ts := httptest.NewServer(serv.metricsHandler(METRICS_PATH, NULL))
+	defer ts.Close()
+	resp, err := http.Get(ts.URL + METRICS_PATH)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var text = string(body)
+	for _, line := range []string{
+		"# TYPE deblocus_sessions gauge\ndeblocus_sessions 2\n",
+		"deblocus_tunnels 2\n",
+		"deblocus_tokens 3\n",
+		"deblocus_active_streams 1\n",
+		"deblocus_queued_frames 0\n",
+		"# TYPE deblocus_rx_bytes_total counter\ndeblocus_rx_bytes_total 105\n",
+		"deblocus_tx_bytes_total 1050\n",
+		"deblocus_handshake_failures_total{stage=\"auth\"} 1\n",
+		"deblocus_user_sessions{user=\"alice\"} 1\ndeblocus_user_sessions{user=\"bob\"} 1\n",
+		"deblocus_user_rx_bytes_total{user=\"al\\\"ice\"} 5\n",
+		"deblocus_user_tx_bytes_total{user=\"alice\"} 1000\n",
+		"deblocus_user_streams_total{user=\"alice\"} 1\n",
+	} {
+		if !strings.Contains(text, line) {
+			t.Errorf("%q not in metrics %s", line, text)
+		}
+	}
+	if resp.Header.Get("Content-Type") != "text/plain; version=0.0.4; charset=utf-8" {
+		t.Errorf("content-type=%s", resp.Header.Get("Content-Type"))
+	}
+}
+
+func TestMetricsAuth(t *testing.T) {
+	var serv = newTestServer()
+	serv.traffic = newTrafficLedger()
+	serv.handshakes = newHandshakeMeter()
+	ts := httptest.NewServer(serv.metricsHandler(METRICS_PATH, "0123456789abcdef"))
+	defer ts.Close()
+	for auth, code := range map[string]int{
+		"":                        http.StatusUnauthorized,
+		"Bearer wrong":            http.StatusUnauthorized,
+		"Bearer 0123456789abcdef": http.StatusOK,
+	} {
+		req, _ := http.NewRequest("GET", ts.URL+METRICS_PATH, nil)
+		if auth != "" {
+			req.Header.Set("Authorization", auth)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != code {
+			t.Errorf("auth=%q status=%d", auth, resp.StatusCode)
+		}
+	}
+	// only loopback without token
+	serv.Metrics = ":9100"
+	if ln, err := serv.ListenMetrics(); err == nil {
+		ln.Close()
+		t.Errorf("listened on all interfaces without token")
+	}
+}
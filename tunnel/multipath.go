@@ -0,0 +1,267 @@
+package tunnel
+
+import (
+	"encoding/binary"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	log "github.com/Lafeng/deblocus/glog"
+)
+
+const (
+	// the sequence in the body of DATA_SEQ and CLOSE_SEQ
+	SEQ_LEN = 4
+	// out-of-order frames held for the missing one, the stream will be
+	// aborted beyond it.
+	REORDER_WINDOW = 1024
+	// the tunnel without striped writing in the interval is probed again
+	STRIPE_PROBE_INTERVAL = time.Second
+)
+
+// --------------------
+// multipath
+// --------------------
+// the tunnels of client could be established over several local interfaces,
+// eg. WiFi + LTE, and the data frames of streams from client are striped
+// across the tunnels, so the uplink bandwidth is bonded.
+// the frames of striped stream are sequenced, the OPEN and the frames in
+// fast-open are sent by the tunnel of stream, and the others are sent by the
+// tunnel of least writing time. the server reorders the frames then delivers
+// them to the stream as usual. the frames to client are not striped.
+
+// the local interfaces to dial, eg. 192.168.1.10, 10.0.0.5
+func parseBindAddrs(str string) ([]net.IP, error) {
+	var ips []net.IP
+	for _, s := range strings.Split(str, ",") {
+		if s = strings.TrimSpace(s); s == NULL {
+			continue
+		}
+		ip := net.ParseIP(s)
+		if ip == nil {
+			return nil, CONF_ERROR.Apply("Multipath " + s)
+		}
+		ips = append(ips, ip)
+	}
+	if len(ips) == 0 {
+		return nil, CONF_ERROR.Apply("Multipath")
+	}
+	return ips, nil
+}
+
+// the dialer of next local interface in turn
+func (d *connectionInfo) nextDialer() *net.Dialer {
+	var dialer = &net.Dialer{Timeout: GENERAL_SO_TIMEOUT}
+	if n := len(d.bindAddrs); n > 0 {
+		i := atomic.AddUint32(&d.bindSeq, 1)
+		dialer.LocalAddr = &net.TCPAddr{IP: d.bindAddrs[int(i)%n]}
+	}
+	return dialer
+}
+
+// select the tunnel of least writing time, or the tunnel of stream
+func (p *multiplexer) stripe(tun *Conn) *Conn {
+	var (
+		selected = tun
+		least    = atomic.LoadInt64(&tun.wcost)
+		now      = time.Now().UnixNano()
+	)
+	p.pool.lock.Lock()
+	defer p.pool.lock.Unlock()
+	for _, t := range p.pool.pool {
+		cost := atomic.LoadInt64(&t.wcost)
+		if now-atomic.LoadInt64(&t.wlast) > int64(STRIPE_PROBE_INTERVAL) {
+			cost = 0
+		}
+		if cost < least {
+			selected, least = t, cost
+		}
+	}
+	return selected
+}
+
+// write and update the average writing time of tunnel
+func stripeWrite(tun *Conn, buf []byte, prio int) error {
+	var start = time.Now().UnixNano()
+	err := frameWritePriority(tun, buf, prio)
+	var now = time.Now().UnixNano()
+	cost := atomic.LoadInt64(&tun.wcost)
+	atomic.StoreInt64(&tun.wcost, cost+(now-start-cost)/8)
+	atomic.StoreInt64(&tun.wlast, now)
+	return err
+}
+
+// --------------------
+// reorderBuffer
+// --------------------
+type reorderBuffer struct {
+	lock    sync.Mutex
+	next    uint32
+	pending map[uint32]*frame
+}
+
+// free the pending frames with lock held
+func (rb *reorderBuffer) discard(meter *bufferMeter) {
+	for seq, f := range rb.pending {
+		delete(rb.pending, seq)
+		meter.add(-int64(len(f.data)))
+		f.free()
+	}
+}
+
+// --------------------
+// bondTable
+// --------------------
+// the reorder buffers of striped streams
+type bondTable struct {
+	lock    sync.Mutex
+	streams map[string]*reorderBuffer
+}
+
+func newBondTable() *bondTable {
+	return &bondTable{streams: make(map[string]*reorderBuffer)}
+}
+
+func (b *bondTable) get(key string) *reorderBuffer {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	rb := b.streams[key]
+	if rb == nil {
+		rb = &reorderBuffer{pending: make(map[uint32]*frame)}
+		b.streams[key] = rb
+	}
+	return rb
+}
+
+func (b *bondTable) remove(key string) {
+	b.lock.Lock()
+	delete(b.streams, key)
+	b.lock.Unlock()
+}
+
+func (b *bondTable) size() int {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return len(b.streams)
+}
+
+func (b *bondTable) cleanOfTun(tun *Conn, meter *bufferMeter) {
+	var removed []*reorderBuffer
+	b.lock.Lock()
+	for k, rb := range b.streams {
+		if strings.HasPrefix(k, tun.identifier) {
+			delete(b.streams, k)
+			removed = append(removed, rb)
+		}
+	}
+	b.lock.Unlock()
+	for _, rb := range removed {
+		rb.lock.Lock()
+		rb.discard(meter)
+		rb.lock.Unlock()
+	}
+}
+
+// the key of stream which the striped frame belongs to, the stream was
+// opened by one of the tunnels of session.
+func (p *multiplexer) streamKeyOf(tun *Conn, sid uint16) (string, bool) {
+	var key = sessionKey(tun, sid)
+	if edge, pre := p.router.getRegistered(key); edge != nil || pre {
+		return key, true
+	}
+	p.pool.lock.Lock()
+	var tuns = append([]*Conn(nil), p.pool.pool...)
+	p.pool.lock.Unlock()
+	for _, t := range tuns {
+		if t != tun {
+			key = sessionKey(t, sid)
+			if edge, pre := p.router.getRegistered(key); edge != nil || pre {
+				return key, true
+			}
+		}
+	}
+	return NULL, false
+}
+
+// reorder the sequenced frame then deliver the frames in order, the pending
+// are charged to the buffers. return false if the stream was not found
+func (p *multiplexer) onSequenced(frm *frame, tun *Conn) bool {
+	key, found := p.streamKeyOf(tun, frm.sid)
+	seq, valid := stripSeq(frm)
+	if !found || !valid {
+		frm.free()
+		return found
+	}
+	rb := p.bonds.get(key)
+	rb.lock.Lock()
+	defer rb.lock.Unlock()
+	if seq < rb.next { // duplicated
+		frm.free()
+		return true
+	}
+	if len(rb.pending) >= REORDER_WINDOW || seq != rb.next && p.buffers.over() {
+		if log.V(log.LV_WARN) {
+			log.Warningln("Striped stream was aborted beyond the reorder window", key)
+		}
+		frm.free()
+		rb.discard(p.buffers)
+		p.bonds.remove(key)
+		if edge, _ := p.router.getRegistered(key); edge != nil {
+			edge.bitwiseCompareAndSet(TCP_CLOSE_W)
+			edge.closeReason = CLOSE_REASON_ERROR
+			edge.deliver(&frame{action: FRAME_ACTION_CLOSE_W, sid: frm.sid})
+		}
+		return true
+	}
+	rb.pending[seq] = frm
+	p.buffers.add(int64(len(frm.data)))
+	for f := rb.pending[rb.next]; f != nil; f = rb.pending[rb.next] {
+		delete(rb.pending, rb.next)
+		p.buffers.add(-int64(len(f.data)))
+		rb.next++
+		if f.action == FRAME_ACTION_CLOSE_SEQ {
+			rb.discard(p.buffers)
+			p.bonds.remove(key)
+		}
+		p.deliverSequenced(key, f)
+	}
+	return true
+}
+
+// deliver the frame in order as DATA or CLOSE_W
+func (p *multiplexer) deliverSequenced(key string, frm *frame) {
+	var router = p.router
+	if frm.action == FRAME_ACTION_CLOSE_SEQ {
+		frm.action = FRAME_ACTION_CLOSE_W
+		if edge, _ := router.getRegistered(key); edge != nil {
+			edge.bitwiseCompareAndSet(TCP_CLOSE_W)
+			edge.closeReason = parseCloseReason(frm.data)
+			edge.deliver(frm)
+		} else {
+			frm.free()
+		}
+		return
+	}
+	frm.action = FRAME_ACTION_DATA
+	if edge, pre := router.getRegistered(key); edge != nil {
+		edge.deliver(frm)
+	} else if pre {
+		router.preDeliver(key, frm)
+	} else {
+		frm.free()
+	}
+}
+
+// strip the sequence from the body in place to keep the buffer of pool
+func stripSeq(frm *frame) (uint32, bool) {
+	if len(frm.data) < SEQ_LEN {
+		return 0, false
+	}
+	seq := binary.BigEndian.Uint32(frm.data)
+	copy(frm.data, frm.data[SEQ_LEN:])
+	frm.data = frm.data[:len(frm.data)-SEQ_LEN]
+	frm.length -= SEQ_LEN
+	return seq, true
+}
@@ -0,0 +1,133 @@
+package tunnel
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestParseBindAddrs(t *testing.T) {
+	ips, err := parseBindAddrs(" 192.168.1.10, ,2001:db8::1")
+	if err != nil || len(ips) != 2 || ips[1].String() != "2001:db8::1" {
+		t.Fatalf("%v %v", ips, err)
+	}
+	for _, s := range []string{"", " , ", "192.168.1.10, wlan0"} {
+		if _, err = parseBindAddrs(s); err == nil {
+			t.Errorf("parsed invalid %q", s)
+		}
+	}
+	var d = &connectionInfo{bindAddrs: ips}
+	first, second := d.nextDialer(), d.nextDialer()
+	if first.LocalAddr.String() == second.LocalAddr.String() {
+		t.Errorf("dialers were not rotated %s", first.LocalAddr)
+	}
+}
+
+func TestMultipathRelay(t *testing.T) {
+	var (
+		client = newClientMultiplexer()
+		server = newServerMultiplexer()
+		tuns   []*Conn
+	)
+	client.multipath, server.multipath = true, true
+	defer client.destroy()
+	defer server.destroy()
+	for i := 0; i < 2; i++ {
+		c, s := tcpPair(t)
+		tun := NewConn(c, nullCipherKit)
+		tuns = append(tuns, tun)
+		go server.Listen(NewConn(s, nullCipherKit), nil, 0)
+		go client.Listen(tun, nil, 0)
+	}
+	for client.pool.Len() < 2 {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	dest, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dest.Close()
+	go func() {
+		for {
+			conn, err := dest.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				io.Copy(conn, conn)
+				conn.Close()
+			}()
+		}
+	}()
+
+	app, req := tcpPair(t)
+	defer app.Close()
+	go client.HandleRequest("T", req, dest.Addr().String())
+	var data = randArray(FRAME_MAX_LEN * 64)
+	go app.Write(data)
+	buf := make([]byte, len(data))
+	app.SetReadDeadline(time.Now().Add(GENERAL_SO_TIMEOUT))
+	if _, err = io.ReadFull(app, buf); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(data, buf) {
+		t.Fatalf("echo mismatched")
+	}
+	for _, tun := range tuns {
+		if tun.wlast == 0 {
+			t.Errorf("tunnel %s was not striped", tun.identifier)
+		}
+	}
+
+	// the reorder buffer is removed with the stream
+	app.Close()
+	for i := 0; i < 50 && server.bonds.size() > 0; i++ {
+		time.Sleep(20 * time.Millisecond)
+	}
+	if n := server.bonds.size(); n != 0 {
+		t.Errorf("bonds=%d", n)
+	}
+}
+
+func TestReorderBuffer(t *testing.T) {
+	var (
+		server  = newServerMultiplexer()
+		dst, rd = net.Pipe()
+		seqOf   = func(seq byte, n int) *frame {
+			body := make([]byte, SEQ_LEN+n)
+			body[SEQ_LEN-1] = seq
+			return &frame{action: FRAME_ACTION_DATA_SEQ, sid: 5, length: uint16(len(body)), data: body}
+		}
+	)
+	c, s := tcpPair(t)
+	defer c.Close()
+	defer rd.Close()
+	defer server.destroy()
+	server.multipath = true
+	server.buffers = newBufferMeter(1 << 20)
+	tun := NewConn(s.(*net.TCPConn), nullCipherKit)
+	server.router.register(sessionKey(tun, 5), "dest:80", tun, dst, false)
+
+	// the pending are charged to the buffers
+	if !server.onSequenced(seqOf(1, 100), tun) || server.buffers.used != 100 {
+		t.Errorf("the pending were not charged used=%d", server.buffers.used)
+	}
+	server.bonds.cleanOfTun(tun, server.buffers)
+	if server.buffers.used != 0 {
+		t.Errorf("the discarded were not released used=%d", server.buffers.used)
+	}
+
+	// the striping not negotiated is refused
+	server.multipath = false
+	go server.Listen(tun, nil, 0)
+	var peer = NewConn(c.(*net.TCPConn), nullCipherKit)
+	if err := frameWriteBuffer(peer, packFrame(FRAME_ACTION_DATA_SEQ, 5, make([]byte, SEQ_LEN+1))); err != nil {
+		t.Fatal(err)
+	}
+	if frm := readFrameOf(t, c, FRAME_ACTION_CLOSE_R); frm.sid != 5 {
+		t.Errorf("unexpected refusing %v", frm)
+	}
+}
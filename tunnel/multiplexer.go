@@ -7,6 +7,7 @@ import (
 	"net"
 	"runtime"
 	"strconv"
+	"strings"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -14,7 +15,6 @@ import (
 	"github.com/Lafeng/deblocus/crypto"
 	ex "github.com/Lafeng/deblocus/exception"
 	log "github.com/Lafeng/deblocus/glog"
-	"github.com/cloudflare/golibs/bytepool"
 	"github.com/cloudflare/golibs/lrucache"
 )
 
@@ -29,15 +29,36 @@ const (
 	FRAME_ACTION_OPEN_DENIED         = 0x13
 	FRAME_ACTION_SLOWDOWN            = 0x20
 	FRAME_ACTION_DATA                = 0x21
+	FRAME_ACTION_DATA_SEQ            = 0x22 // sequenced data of striped stream
+	FRAME_ACTION_CLOSE_SEQ           = 0x23 // sequenced CLOSE_W of striped stream
+	FRAME_ACTION_REBIND              = 0x24 // rebind the orphaned stream in roaming
+	FRAME_ACTION_REBIND_N            = 0x25
+	FRAME_ACTION_WINDOW              = 0x26 // credit granted to the stream window
+	FRAME_ACTION_GOAWAY              = 0x27 // no more new streams on the tun
 	FRAME_ACTION_PING                = 0x30
 	FRAME_ACTION_PONG                = 0x31
 	FRAME_ACTION_TOKENS              = 0x40
 	FRAME_ACTION_TOKEN_REQUEST       = 0x41
 	FRAME_ACTION_TOKEN_REPLY         = 0x42
+	FRAME_ACTION_MIGRATE             = 0x43 // notice to migrate to the endpoint
+	FRAME_ACTION_REKEY               = 0x44 // switch the reading key
 	FRAME_ACTION_DNS_REQUEST         = 0x51
 	FRAME_ACTION_DNS_REPLY           = 0x52
+	FRAME_ACTION_UDP                 = 0x60 // datagram of association
+	FRAME_ACTION_UDP_CLOSE           = 0x61
 )
 
+const (
+	// close reason carried in the body of CLOSE_W
+	// absent in the frames sent by old version
+	CLOSE_REASON_UNKNOWN byte = 0x0
+	CLOSE_REASON_EOF     byte = 0x1 // end of stream
+	CLOSE_REASON_CANCEL  byte = 0x2 // canceled by the app or the destination
+	CLOSE_REASON_ERROR   byte = 0x3
+)
+
+var closeReasonNames = []string{"unknown", "eof", "cancel", "error"}
+
 const (
 	FRAME_HEADER_LEN = 8
 	FRAME_MAX_LEN    = 0xffff
@@ -48,6 +69,13 @@ const (
 	MUX_CLOSED        int32 = -2
 )
 
+const (
+	// the tun opens no more new streams
+	TUN_RETIRED int32 = 1
+	// and the new one was dialed for it
+	TUN_REPLACED int32 = 2
+)
+
 const (
 	FAST_OPEN              = true
 	FAST_OPEN_BUF_MAX_SIZE = 1 << 16 // 64k
@@ -57,6 +85,8 @@ const (
 	WAITING_OPEN_TIMEOUT = time.Second * 30
 	WRITE_TUN_TIMEOUT    = time.Second * 15
 	READ_TMO_IN_FASTOPEN = time.Millisecond * 1500
+	// the streams are waited to finish in closing the mux at most
+	TUN_DRAIN_TIMEOUT = time.Second * 10
 )
 
 const (
@@ -70,15 +100,18 @@ const sid_max uint32 = 0xffff
 
 var (
 	// [1, 0xfffe]
-	sid_seq      uint32
-	dialer       net.Dialer
-	bytePoolOnce sync.Once
-	bytePool     *bytepool.BytePool
+	sid_seq    uint32
+	dialer     net.Dialer
+	dialerOnce sync.Once
+	bytePool   = newBufferPool()
 )
 
 var (
-	ERR_TUN_NA        = ex.New("No tunnels are available")
-	ERR_DATA_TAMPERED = ex.New("data tampered")
+	ERR_TUN_NA         = ex.New("No tunnels are available")
+	ERR_DATA_TAMPERED  = ex.New("data tampered")
+	ERR_OPEN_THROTTLED = ex.New("Opening was throttled")
+	ERR_OUTBOUND_FULL  = ex.New("Outbound connections were full")
+	ERR_STREAMS_FULL   = ex.New("Streams of session were full")
 )
 
 // --------------------
@@ -88,6 +121,7 @@ type event byte
 
 const (
 	evt_tokens = event(1)
+	evt_rotate = event(2) // the tun of mux is due to be rotated
 )
 
 type event_handler func(e event, msg ...interface{})
@@ -99,12 +133,15 @@ type idler struct {
 	enabled      bool
 	waiting      bool
 	interval     time.Duration
+	min, max     time.Duration // bounds of adaptive interval, or fixed if max=0
+	wrote        int64         // writes of tun at last round
+	tun          *Conn
 	lastPing     int64
 	sRtt, devRtt int64
 }
 
 func NewIdler(interval int, isClient bool) *idler {
-	if interval > 0 && (interval > 600 || interval < 60) {
+	if interval > 0 && (interval > PING_INTERVAL_MAX || interval < PING_INTERVAL_MIN) {
 		interval = DT_PING_INTERVAL
 	}
 	i := &idler{
@@ -120,6 +157,44 @@ func NewIdler(interval int, isClient bool) *idler {
 	return i
 }
 
+// the interval backs off up to max seconds while the tunnel is busy,
+// or fixed if max is not greater than the initial interval.
+func (i *idler) attach(tun *Conn, max int) {
+	var d = time.Second * time.Duration(max)
+	if i.enabled && d > i.interval {
+		i.min, i.max = i.interval, d
+	}
+	i.tun, i.wrote = tun, atomic.LoadInt64(&tun.wrote)
+	atomic.StoreInt64(&tun.ping, int64(i.interval))
+}
+
+// adapt the interval as nothing was read in it, return true to ping.
+// the tunnel is busy if it was writing, then the ping is deferred with
+// the doubled interval until max, otherwise it is idle and the interval
+// returns to the initial one to detect a dead peer promptly.
+func (i *idler) adapt() bool {
+	var wrote = atomic.LoadInt64(&i.tun.wrote)
+	busy := wrote != i.wrote
+	i.wrote = wrote
+	if i.max <= 0 {
+		return true
+	}
+	defer func() {
+		atomic.StoreInt64(&i.tun.ping, int64(i.interval))
+	}()
+	if !busy {
+		i.interval = i.min
+		return true
+	}
+	if i.interval < i.max {
+		if i.interval *= 2; i.interval > i.max {
+			i.interval = i.max
+		}
+		return false
+	}
+	return true
+}
+
 func (i *idler) newRound(tun *Conn) {
 	if i.enabled {
 		if i.waiting { // ping sent, waiting response
@@ -151,6 +226,7 @@ func (i *idler) ping(tun *Conn) error {
 		defer i.updateLast()
 		buf := make([]byte, FRAME_HEADER_LEN)
 		pack(buf, FRAME_ACTION_PING, 0, nil)
+		defer i.ownWrite()
 		return frameWriteBuffer(tun, buf)
 	}
 	return nil
@@ -160,6 +236,7 @@ func (i *idler) pong(tun *Conn) error {
 	if i.enabled {
 		buf := make([]byte, FRAME_HEADER_LEN)
 		pack(buf, FRAME_ACTION_PONG, 0, nil)
+		defer i.ownWrite()
 		return frameWriteBuffer(tun, buf)
 	}
 	return nil
@@ -173,31 +250,81 @@ func (i *idler) verify() (r bool) {
 	return
 }
 
+// the pings and pongs are not the activity of tunnel
+func (i *idler) ownWrite() {
+	if i.tun != nil {
+		i.wrote = atomic.LoadInt64(&i.tun.wrote)
+	}
+}
+
 func (i *idler) updateLast() {
 	i.lastPing = time.Now().UnixNano()
 }
 
 // ref: http://tools.ietf.org/html/rfc6298
-// return srtt, devrtt in millisecond
+// return srtt, devrtt in millisecond, which are kept in the tun also.
 func (i *idler) updateRtt() (int32, int32) {
 	rtt := time.Now().UnixNano() - i.lastPing
-	if i.devRtt != 0 {
-		// DevRTT = (1-beta)*DevRTT + beta*(|R'-SRTT|)
-		// simplify: devRtt with sign bit and β=0.5
-		i.devRtt = i.devRtt>>1 + (rtt-i.sRtt)>>1
-	} else {
-		i.devRtt = rtt >> 3
-	}
 	if i.sRtt > 0 {
+		// DevRTT = (1-beta)*DevRTT + beta*(|R'-SRTT|)
+		// Let β=0.5 because of the low sampling rate
+		dev := rtt - i.sRtt
+		if dev < 0 {
+			dev = -dev
+		}
+		i.devRtt += (dev - i.devRtt) >> 1
 		// SRTT = (1-alpha)*SRTT + alpha*R'
 		// Let α=0.25 because of the low sampling rate
 		i.sRtt += (rtt - i.sRtt) >> 2
 	} else {
-		i.sRtt = rtt
+		i.sRtt, i.devRtt = rtt, rtt>>1
+	}
+	if i.tun != nil {
+		atomic.StoreInt64(&i.tun.srtt, i.sRtt)
+		atomic.StoreInt64(&i.tun.rvar, i.devRtt)
 	}
 	return int32(i.sRtt / 1e6), int32(i.devRtt / 1e6)
 }
 
+// --------------------
+// pauser
+// --------------------
+type pauser struct {
+	lock   sync.Mutex
+	cond   *sync.Cond
+	paused bool
+}
+
+func newPauser() *pauser {
+	p := new(pauser)
+	p.cond = sync.NewCond(&p.lock)
+	return p
+}
+
+// blocking while paused
+func (p *pauser) wait() {
+	p.lock.Lock()
+	for p.paused {
+		p.cond.Wait()
+	}
+	p.lock.Unlock()
+}
+
+func (p *pauser) set(paused bool) {
+	p.lock.Lock()
+	p.paused = paused
+	p.lock.Unlock()
+	if !paused {
+		p.cond.Broadcast()
+	}
+}
+
+func (p *pauser) isPaused() bool {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	return p.paused
+}
+
 // --------------------
 // frame
 // --------------------
@@ -221,9 +348,7 @@ func (f *frame) free() {
 	}
 }
 
-func initBytePool() {
-	bytePool = new(bytepool.BytePool)
-	bytePool.Init(time.Minute, 1<<20)
+func initDialer() {
 	dialer.Timeout = time.Second * 3
 	dialer.DualStack = false
 	//dialer.DualStack = determineDualStack()
@@ -233,6 +358,18 @@ func initBytePool() {
 // multiplexer
 // --------------------
 type multiplexer struct {
+	// traffic counters, keep 64-bit aligned
+	rxBytes   int64 // from tunnels to edges
+	txBytes   int64 // from edges to tunnels
+	streams   int64
+	penalty   int64 // deadline (unixnano) of delaying opening
+	throttled int64 // opening was throttled
+	active    int64 // open streams
+	overflows int64 // openings over streamCap
+	received  int64 // frames from tunnels
+	stalls    int64 // pausing sent to peer for the slow consumers
+	drops     int64 // streams dropped by the queue over the max
+	lostPings int64 // pings not answered, the tunnels were closed
 	isClient  bool
 	pool      *ConnPool
 	router    *egressRouter
@@ -241,28 +378,68 @@ type multiplexer struct {
 	pingCnt   int32 // received ping count
 	sRtt      int32
 	filter    Filterable
+	egress    *egressTable
+	resolver  hostResolver
+	probe     *probePolicy
+	buffers   *bufferMeter
+	sched     *egressScheduler
+	class     *egressClass
+	bandwidth *bwLimiter   // schedule of user
+	opens     *tokenBucket // rate of opening streams
+	streamCap int          // concurrent open streams, unlimited if 0
+	dials     *dialBudget  // failures of connecting destinations
+	outbound  *outboundLimit
+	sniffer   *protocolSniffer
+	prioPorts priorityPorts // destination ports of interactive streams
+	coalesce  time.Duration // delay of coalescing writes of tunnels
+	linger    int
+	pingMax   int // seconds, backoff ceiling of ping interval
+	profile   *wireProfile
+	frames    *frameBounds
+	udp       *udpRelay  // associations of UDP
+	datagrams bool       // server: the UDP relay negotiated
+	multipath bool       // stripe the frames of streams across tunnels, or reorder them in server
+	flowCtl   bool       // credit-based windows of streams
+	window    int        // credit granted to peer of each stream
+	frameMAC  bool       // authenticate the records of stream ciphers
+	goaway    bool       // notice the peer in draining
+	bonds     *bondTable // reorder the striped frames
+	pauser    *pauser
 	sLock     sync.Mutex
+	roam      time.Duration // grace of orphaned streams in roaming
+	rekey     *rekeyPolicy  // of writing tunnels
+	rotate    *rekeyPolicy  // client: of rotating tunnels if the peer couldn't rekey
 	blacklist *lrucache.LRUCache
 }
 
 func newServerMultiplexer() *multiplexer {
-	bytePoolOnce.Do(initBytePool)
+	dialerOnce.Do(initDialer)
 	m := &multiplexer{
 		isClient: false,
 		pool:     NewConnPool(),
 		role:     "SVR",
+		udp:      newUdpRelay(),
+		bonds:    newBondTable(),
+		pauser:   newPauser(),
+		linger:   -1,
+		window:   STREAM_WINDOW,
 	}
 	m.router = newEgressRouter(m)
 	return m
 }
 
 func newClientMultiplexer() *multiplexer {
-	bytePoolOnce.Do(initBytePool)
+	dialerOnce.Do(initDialer)
 	m := &multiplexer{
 		isClient:  true,
 		pool:      NewConnPool(),
 		role:      "CLT",
 		blacklist: lrucache.NewLRUCache(256),
+		udp:       newUdpRelay(),
+		bonds:     newBondTable(),
+		pauser:    newPauser(),
+		linger:    -1,
+		window:    STREAM_WINDOW,
 	}
 	m.router = newEgressRouter(m)
 	return m
@@ -281,20 +458,96 @@ func (p *multiplexer) destroy() {
 		}
 	}()
 	atomic.StoreInt32(&p.status, MUX_PENDING_CLOSE)
+	// release the paused
+	p.pauser.set(false)
 	p.sLock.Lock()
 	defer p.sLock.Unlock()
 	p.router.destroy() // destroy queue
+	p.udp.destroy()
 	p.pool.destroy()
 	p.router = nil
 	p.pool = nil
 }
 
+// retire the tunnels then wait for the streams to finish in timeout, the peer
+// is noticed to open no more streams on them. the tunnels are still alive
+// until destroyed.
+func (p *multiplexer) drain(timeout time.Duration) {
+	var pool, router = p.pool, p.router
+	if atomic.LoadInt32(&p.status) < 0 || pool == nil || router == nil {
+		return
+	}
+	pool.lock.Lock()
+	var tuns = append([]*Conn(nil), pool.pool...)
+	pool.lock.Unlock()
+	for _, tun := range tuns {
+		if atomic.CompareAndSwapInt32(&tun.retired, 0, TUN_RETIRED) && p.goaway {
+			frameWriteHead(tun, &frame{action: FRAME_ACTION_GOAWAY})
+		}
+	}
+	if n := p.waitStreams(nil, timeout); n > 0 && log.V(log.LV_WARN) {
+		log.Warningf("%s was closed with %d streams in draining", p.role, n)
+	}
+}
+
+// retire the tun in the state, then close it after its streams were finished
+// or in timeout. the streams left are orphaned if roaming.
+func (p *multiplexer) retire(tun *Conn, state int32, timeout time.Duration) {
+	if atomic.SwapInt32(&tun.retired, state) == 0 && p.goaway {
+		frameWriteHead(tun, &frame{action: FRAME_ACTION_GOAWAY})
+	}
+	if n := p.waitStreams(tun, timeout); n > 0 && log.V(log.LV_WARN) {
+		log.Warningf("Tun (%s) was closed with %d streams in draining", tun.identifier, n)
+	}
+	SafeClose(tun)
+}
+
+// wait for the streams of tun, or all if nil, to finish in timeout, return
+// the count of left.
+func (p *multiplexer) waitStreams(tun *Conn, timeout time.Duration) int {
+	for deadline := time.Now().Add(timeout); ; time.Sleep(time.Millisecond * 100) {
+		var n int
+		if router := p.router; router != nil {
+			for _, e := range router.snapshot() {
+				if tun == nil || e.tun == tun {
+					n++
+				}
+			}
+		}
+		if n == 0 || time.Now().After(deadline) {
+			return n
+		}
+	}
+}
+
+func (p *multiplexer) setPaused(paused bool) {
+	p.pauser.set(paused)
+}
+
+func (p *multiplexer) isPaused() bool {
+	return p.pauser.isPaused()
+}
+
+func (p *multiplexer) traffic() (rx, tx, streams int64) {
+	rx = atomic.LoadInt64(&p.rxBytes)
+	tx = atomic.LoadInt64(&p.txBytes)
+	streams = atomic.LoadInt64(&p.streams)
+	return
+}
+
 // serve client request
 func (p *multiplexer) HandleRequest(protocol string, req net.Conn, target string) {
 	// select a tunnel to serve client request
 	if tun := p.pool.Select(); tun != nil {
 		sid := next_sid()
 		key := sessionKey(tun, sid)
+		// raced with others after the check of socks
+		if !p.acquireStream() {
+			log.Warningln(ERR_STREAMS_FULL.Apply(target))
+			SafeClose(req)
+			return
+		}
+		defer p.releaseStream()
 		// ingress: register in router table
 		// asynchronously transmit data from the tunnel to the edge connection
 		edge := p.router.register(key, target, tun, req, true)
@@ -321,19 +574,93 @@ func (p *multiplexer) onTunDisconnected(tun *Conn, handler event_handler) {
 	if p.router != nil {
 		p.router.cleanOfTun(tun)
 	}
+	p.udp.cleanOfTun(tun)
+	p.bonds.cleanOfTun(tun, p.buffers)
 	// use finalizer to cleanup
 	runtime.SetFinalizer(tun, cleanupConn)
 }
 
+// the effective ping intervals of tunnels, eg. " Ping=110s/220s"
+func (p *multiplexer) pingStats() string {
+	var list []string
+	if p.pool == nil {
+		return NULL
+	}
+	p.pool.lock.Lock()
+	for _, tun := range p.pool.pool {
+		d := time.Duration(atomic.LoadInt64(&tun.ping))
+		list = append(list, strconv.Itoa(int(d/time.Second))+"s")
+	}
+	p.pool.lock.Unlock()
+	if len(list) == 0 {
+		return NULL
+	}
+	return " Ping=" + strings.Join(list, "/")
+}
+
+// the smoothed RTT and jitter of the sampled tunnels, and the count of pings
+// which the peer didn't answer, eg. " RTT=45ms/52ms Jitter=3ms/6ms Lost-pings=1"
+func (p *multiplexer) rttStats() string {
+	var rtts, jitters []string
+	if pool := p.pool; pool != nil {
+		pool.lock.Lock()
+		for _, tun := range pool.pool {
+			if srtt := atomic.LoadInt64(&tun.srtt); srtt > 0 {
+				rtts = append(rtts, strconv.FormatInt(srtt/1e6, 10)+"ms")
+				jitters = append(jitters, strconv.FormatInt(atomic.LoadInt64(&tun.rvar)/1e6, 10)+"ms")
+			}
+		}
+		pool.lock.Unlock()
+	}
+	var stats string
+	if len(rtts) > 0 {
+		stats = " RTT=" + strings.Join(rtts, "/") + " Jitter=" + strings.Join(jitters, "/")
+	}
+	if n := atomic.LoadInt64(&p.lostPings); n > 0 {
+		stats += fmt.Sprintf(" Lost-pings=%d", n)
+	}
+	return stats
+}
+
+// the pausing and dropping of slow streams, eg. " Stalls=3 Dropped-streams=1"
+func (p *multiplexer) stallStats() string {
+	var stats string
+	if n := atomic.LoadInt64(&p.stalls); n > 0 {
+		stats += fmt.Sprintf(" Stalls=%d", n)
+	}
+	if n := atomic.LoadInt64(&p.drops); n > 0 {
+		stats += fmt.Sprintf(" Dropped-streams=%d", n)
+	}
+	return stats
+}
+
 // This thread will listen on the tunnel, and process ingress data packets,
 // and route them to correct session.
-// TODO notify peer to slow down when queue increased too fast
 func (p *multiplexer) Listen(tun *Conn, handler event_handler, interval int) error {
 	// set priority for selecting tunnel
 	tun.priority = &TSPriority{0, 1e9}
+	if p.profile != nil {
+		tun.profile = p.profile
+		p.profile.applySocket(tun)
+	}
+	tun.frames = p.frames
+	tun.coalesce = p.coalesce
+	tun.gate = newPriorityGate()
+	if p.frameMAC {
+		tun.authenticateFrames(p.isClient)
+	}
+	if p.rekey != nil {
+		tun.rekey = newRekeyState(p.rekey)
+	} else if p.rotate != nil {
+		tun.rekey = newRekeyState(p.rotate)
+		tun.rekey.rotate = true
+	}
 	p.pool.Push(tun)
 	defer p.onTunDisconnected(tun, handler)
 	tun.SetSockOpt(1, 0, 1)
+	if p.isClient && p.roam > 0 {
+		p.rebindOrphans(tun)
+	}
 
 	var (
 		header = make([]byte, FRAME_HEADER_LEN)
@@ -344,12 +671,19 @@ func (p *multiplexer) Listen(tun *Conn, handler event_handler, interval int) err
 		frm    *frame
 		key    string
 	)
+	if p.profile != nil {
+		idle.interval += p.profile.jitter
+	}
+	idle.attach(tun, p.pingMax)
 	if !p.isClient {
 		// the server needs to ping client at first
 		// make client aware of using a valid token.
 		idle.ping(tun)
 	}
 	for {
+		if atomic.CompareAndSwapInt32(&tun.rotate, 1, 2) && handler != nil {
+			handler(evt_rotate, p, tun)
+		}
 		idle.newRound(tun)
 		// read frame header
 		nr, er = io.ReadFull(tun, header)
@@ -370,15 +704,20 @@ func (p *multiplexer) Listen(tun *Conn, handler event_handler, interval int) err
 			}
 			switch idle.consumeError(er) {
 			case ERR_NEW_PING:
+				if !idle.adapt() {
+					continue
+				}
 				if er = idle.ping(tun); er == nil {
 					continue
 				}
 			case ERR_PING_TIMEOUT:
+				atomic.AddInt64(&p.lostPings, 1)
 				er = ex.New("Peer was unresponsive then close")
 			}
 			// Exit: abandon this connection
 			return er
 		}
+		atomic.AddInt64(&p.received, 1)
 		// prepare the session key of the frame
 		key = sessionKey(tun, frm.sid)
 
@@ -387,18 +726,58 @@ func (p *multiplexer) Listen(tun *Conn, handler event_handler, interval int) err
 		case FRAME_ACTION_CLOSE_W:
 			if edge, _ := router.getRegistered(key); edge != nil {
 				edge.bitwiseCompareAndSet(TCP_CLOSE_W)
+				edge.closeReason = parseCloseReason(frm.data)
 				edge.deliver(frm)
+			} else {
+				frm.free()
 			}
 		// stop ingress
 		case FRAME_ACTION_CLOSE_R:
 			if edge, _ := router.getRegistered(key); edge != nil {
 				edge.bitwiseCompareAndSet(TCP_CLOSE_R)
+				edge.window.close()
+				edge.stall.set(false)
 				closeR(edge.conn)
 			}
 
+		// the frames of subsystems not negotiated are ignored
+		case FRAME_ACTION_SLOWDOWN:
+			if edge, _ := router.getRegistered(key); edge != nil && p.flowCtl && frm.length > 0 {
+				edge.stall.set(frm.data[0] != 0)
+			}
+			frm.free()
+
+		case FRAME_ACTION_WINDOW:
+			if edge, _ := router.getRegistered(key); edge != nil && frm.length >= 4 {
+				edge.window.grant(int(binary.BigEndian.Uint32(frm.data)))
+			}
+			frm.free()
+
+		// the peer is closing the tun, its streams go on
+		case FRAME_ACTION_GOAWAY:
+			if !p.goaway {
+				break
+			}
+			atomic.CompareAndSwapInt32(&tun.retired, 0, TUN_RETIRED)
+			if log.V(log.LV_ACT_FRM) {
+				log.Infof("Tun (%s) was retired by peer", tun.identifier)
+			}
+
 		case FRAME_ACTION_DATA:
 			edge, pre := router.getRegistered(key)
-			if edge != nil {
+			if edge != nil && !edge.charge(int(frm.length)) {
+				// sent beyond the window, then refuse the stream
+				frm.free()
+				if edge.queue.drop() {
+					if log.V(log.LV_WARN) {
+						log.Warningln("Peer sent data beyond the window.", key)
+					}
+					pack(header, FRAME_ACTION_CLOSE_R, frm.sid, nil)
+					if er = frameWriteBuffer(tun, header); er != nil {
+						return er
+					}
+				}
+			} else if edge != nil {
 				// normally
 				edge.deliver(frm)
 			} else if pre {
@@ -444,7 +823,7 @@ func (p *multiplexer) Listen(tun *Conn, handler event_handler, interval int) err
 
 		case FRAME_ACTION_PONG:
 			if idle.verify() {
-				if p.isClient && idle.lastPing > 0 {
+				if idle.lastPing > 0 {
 					sRtt, devRtt := idle.updateRtt()
 					atomic.StoreInt32(&p.sRtt, sRtt)
 					if DEBUG {
@@ -462,6 +841,41 @@ func (p *multiplexer) Listen(tun *Conn, handler event_handler, interval int) err
 		case FRAME_ACTION_TOKENS:
 			handler(evt_tokens, frm.data)
 
+		case FRAME_ACTION_DATA_SEQ, FRAME_ACTION_CLOSE_SEQ:
+			var found bool
+			// only the striping negotiated with client is accepted
+			if p.multipath && !p.isClient {
+				found = p.onSequenced(frm, tun)
+			} else {
+				if log.V(log.LV_WARN) {
+					log.Warningln("Peer sent the striped frame not negotiated", frm)
+				}
+				frm.free()
+			}
+			if !found && frm.action == FRAME_ACTION_DATA_SEQ {
+				// notice peer to stop sending
+				pack(header, FRAME_ACTION_CLOSE_R, frm.sid, nil)
+				if er = frameWriteBuffer(tun, header); er != nil {
+					return er
+				}
+			}
+
+		case FRAME_ACTION_REBIND, FRAME_ACTION_REBIND_N:
+			p.onRebind(frm, tun)
+
+		case FRAME_ACTION_UDP:
+			p.onDatagram(frm, key, tun)
+
+		case FRAME_ACTION_UDP_CLOSE:
+			if a := p.udp.get(key); a != nil {
+				p.closeAssoc(a, false)
+			}
+
+		case FRAME_ACTION_REKEY:
+			if er = tun.rekeyRead(frm.data); er != nil {
+				return er
+			}
+
 		default: // impossible
 			return fmt.Errorf("Unrecognized %s", frm)
 		}
@@ -484,20 +898,36 @@ func (p *multiplexer) connectToDest(frm *frame, key string, tun *Conn) {
 		dstConn net.Conn
 		err     error
 		target  = string(frm.data)
-		denied  = false
+		addr    string
+		denied  bool
 	)
-	if p.filter != nil {
-		// denyDest filter
-		denied = p.filter.Filter(target)
+	if wait := atomic.LoadInt64(&p.penalty) - time.Now().UnixNano(); wait > 0 {
+		time.Sleep(time.Duration(wait))
 	}
-	if !denied {
-		dstConn, err = dialer.Dial("tcp", target)
+	// denyDest filter, and fail closed if not resolved
+	addr, denied, err = p.filterDest(target)
+	if err == nil && !denied && p.acquireStream() {
+		defer p.releaseStream()
+		if p.admitOpen(time.Now()) {
+			dstConn, err = p.dialOutbound(addr)
+			if p.dials != nil && err != ERR_OUTBOUND_FULL {
+				p.recordDial(key, err)
+			}
+		} else {
+			// retryable
+			err = ERR_OPEN_THROTTLED
+		}
+	} else if err == nil && !denied {
+		err = ERR_STREAMS_FULL
 	}
 
 	p.sLock.Lock()
 	// check mux status to prevent mux.fields were cleaned
 	if atomic.LoadInt32(&p.status) < 0 {
 		p.sLock.Unlock()
+		if dstConn != nil {
+			SafeClose(dstConn)
+		}
 		return
 	}
 
@@ -517,16 +947,22 @@ func (p *multiplexer) connectToDest(frm *frame, key string, tun *Conn) {
 
 	} else { // accept and register really
 		dstConn.SetReadDeadline(ZERO_TIME)
+		setLinger(dstConn, p.linger)
 		var edge = p.router.register(key, target, tun, dstConn, false) // write edge
 		p.sLock.Unlock()
 
 		if log.V(log.LV_SVR_OPEN) {
-			log.Infoln("OPEN", target, "for", key)
+			if p.probe != nil {
+				p.probe.logOpen(edge)
+			} else {
+				log.Infoln("OPEN", target, "for", key)
+			}
 		}
 
 		// notify peer
 		frm.action = FRAME_ACTION_OPEN_Y
 		if frameWriteHead(tun, frm) == nil {
+			edge.openWindow(frm.sid)
 			// ingress: transmit edge data to tunnel
 			p.relay(edge, tun, frm.sid)
 		} else {
@@ -536,20 +972,148 @@ func (p *multiplexer) connectToDest(frm *frame, key string, tun *Conn) {
 	}
 }
 
+// delay the openings if the budget of failures was exhausted
+func (p *multiplexer) recordDial(key string, err error) {
+	var now = time.Now()
+	if backoff := p.dials.record(err, now); backoff > 0 {
+		atomic.StoreInt64(&p.penalty, now.Add(backoff).UnixNano())
+		log.Warningf("Suspicious failures of connecting for %s, delay opening %s\n", key, backoff)
+	}
+}
+
+func (p *multiplexer) admitOpen(now time.Time) bool {
+	if p.opens == nil || p.opens.allow(now) {
+		return true
+	}
+	atomic.AddInt64(&p.throttled, 1)
+	return false
+}
+
+// reserve the slot of stream until released
+func (p *multiplexer) acquireStream() bool {
+	if n := atomic.AddInt64(&p.active, 1); p.streamCap > 0 && n > int64(p.streamCap) {
+		atomic.AddInt64(&p.active, -1)
+		atomic.AddInt64(&p.overflows, 1)
+		return false
+	}
+	return true
+}
+
+func (p *multiplexer) releaseStream() {
+	atomic.AddInt64(&p.active, -1)
+}
+
+func (p *multiplexer) streamsFull() bool {
+	return p.streamCap > 0 && atomic.LoadInt64(&p.active) >= int64(p.streamCap)
+}
+
+// snapshot of alive streams
+func (p *multiplexer) edges() []*edgeConn {
+	p.sLock.Lock()
+	var router = p.router
+	p.sLock.Unlock()
+	if router == nil {
+		return nil
+	}
+	return router.snapshot()
+}
+
+// frames queued to the destinations of all streams
+func (p *multiplexer) queuedFrames() int {
+	var n int
+	for _, e := range p.edges() {
+		if q := e.queue; q != nil {
+			n += q.length()
+		}
+	}
+	return n
+}
+
+// dial within the global cap of outbound connections
+func (p *multiplexer) dialOutbound(target string) (net.Conn, error) {
+	if p.outbound == nil {
+		return p.dial(target)
+	}
+	if !p.outbound.acquire() {
+		// retryable
+		return nil, ERR_OUTBOUND_FULL
+	}
+	conn, err := p.dial(target)
+	if err != nil {
+		p.outbound.release()
+		return nil, err
+	}
+	return &outboundConn{Conn: conn, limit: p.outbound}, nil
+}
+
+// resolve the destination once, then the filtered address is dialed, so the
+// names couldn't be rebound to the denied after checked. the failure of
+// lookup fails closed.
+func (p *multiplexer) filterDest(target string) (string, bool, error) {
+	if p.filter == nil {
+		return target, false, nil
+	}
+	var resolver = p.resolver
+	if resolver == nil {
+		resolver = systemResolver{}
+	}
+	addr, err := resolveTarget(resolver, target)
+	if err != nil {
+		return target, false, err
+	}
+	return addr, p.deniedDest(addr, target), nil
+}
+
+// the resolved address, and the name for the filters of names, eg. webhook
+func (p *multiplexer) deniedDest(addr, target string) bool {
+	return p.filter.Filter(addr) || addr != target && p.filter.Filter(target)
+}
+
+func (p *multiplexer) dial(target string) (net.Conn, error) {
+	if p.resolver != nil {
+		addr, err := resolveTarget(p.resolver, target)
+		if err != nil {
+			return nil, err
+		}
+		target = addr
+	}
+	if p.egress != nil {
+		return p.egress.Dial(target)
+	}
+	return dialer.Dial("tcp", target)
+}
+
 func (p *multiplexer) relay(edge *edgeConn, tun *Conn, sid uint16) {
 	var (
 		buf      = bytePool.Get(FRAME_MAX_LEN)
 		destHost = edge.dest[2:] // dest with a leading mark
 		src      = edge.conn
 		code     byte
+		er       error
+		// the frames from client are sequenced in multipath
+		striped = p.isClient && p.multipath
+		seq     uint32
+		prio    = p.prioPorts.of(destHost)
 	)
 	defer func() {
 		// actively close then notify peer
-		if edge.bitwiseCompareAndSet(TCP_CLOSE_R) && code != FRAME_ACTION_OPEN_DENIED {
-			pack(buf, FRAME_ACTION_CLOSE_W, sid, nil)
+		var notify = edge.bitwiseCompareAndSet(TCP_CLOSE_R) && code != FRAME_ACTION_OPEN_DENIED
+		if notify && edge.replay != nil {
+			// resent after rebinding if lost
+			go p.roamClose(edge, sid, closeReasonOf(er))
+			bytePool.Put(buf)
+		} else if notify {
+			var _len int
+			if striped {
+				body := []byte{0, 0, 0, 0, closeReasonOf(er)}
+				binary.BigEndian.PutUint32(body, seq)
+				_len = pack(buf, FRAME_ACTION_CLOSE_SEQ, sid, body)
+			} else {
+				_len = pack(buf, FRAME_ACTION_CLOSE_W, sid, []byte{closeReasonOf(er)})
+			}
 			go func() {
 				// tell peer to closeW
-				frameWriteBuffer(tun, buf[:FRAME_HEADER_LEN])
+				frameWriteBuffer(tun, buf[:_len])
 				bytePool.Put(buf)
 			}()
 		} else {
@@ -560,6 +1124,9 @@ func (p *multiplexer) relay(edge *edgeConn, tun *Conn, sid uint16) {
 		} else { // remote open failed
 			SafeClose(src)
 		}
+		if p.probe != nil {
+			p.probe.inspect(p, edge, time.Now())
+		}
 	}()
 
 	// for client
@@ -586,6 +1153,7 @@ func (p *multiplexer) relay(edge *edgeConn, tun *Conn, sid uint16) {
 		case FRAME_ACTION_OPEN_Y:
 			// fastopen finished
 			*p_fastOpen = false
+			edge.openWindow(sid)
 			return false
 
 		case FRAME_ACTION_OPEN_DENIED:
@@ -606,10 +1174,19 @@ func (p *multiplexer) relay(edge *edgeConn, tun *Conn, sid uint16) {
 	var (
 		tn         int // total
 		nr         int
-		er         error
 		_fast_open = p.isClient
 		dataBuf    = buf[FRAME_HEADER_LEN:]
 	)
+	if p.profile != nil {
+		dataBuf = dataBuf[:p.profile.chunk]
+	}
+	if p.frames != nil {
+		dataBuf = dataBuf[:minInt(len(dataBuf), p.frames.max)]
+	}
+	if striped {
+		// leave space for the sequence in body
+		dataBuf = buf[FRAME_HEADER_LEN+SEQ_LEN : FRAME_HEADER_LEN+len(dataBuf)]
+	}
 	for {
 		if _fast_open {
 			select {
@@ -643,14 +1220,54 @@ func (p *multiplexer) relay(edge *edgeConn, tun *Conn, sid uint16) {
 			}
 		}
 
-		nr, er = src.Read(dataBuf)
+		// read no more than the credit granted by peer
+		var avail = edge.window.acquire(len(dataBuf))
+		if avail <= 0 {
+			return
+		}
+		// stop reading the edge to make backpressure in pausing
+		edge.stall.wait()
+		p.pauser.wait()
+		nr, er = src.Read(dataBuf[:avail])
 		if nr > 0 {
+			edge.window.consume(nr)
+			if p.bandwidth != nil {
+				p.bandwidth.acquire(nr)
+			}
+			if p.sched != nil {
+				p.sched.acquire(p.class, nr)
+			}
 			tn += nr
-			pack(buf, FRAME_ACTION_DATA, sid, uint16(nr))
-			if frameWriteBuffer(tun, buf[:nr+FRAME_HEADER_LEN]) != nil {
-				SafeClose(tun)
-				return
+			// the long-running unmarked is bulk
+			if prio == STREAM_PRIO_NORMAL && tn > STREAM_BULK_BYTES {
+				prio = STREAM_PRIO_BULK
+			}
+			if striped {
+				binary.BigEndian.PutUint32(buf[FRAME_HEADER_LEN:], seq)
+				seq++
+				pack(buf, FRAME_ACTION_DATA_SEQ, sid, uint16(nr+SEQ_LEN))
+				var t = tun
+				if !_fast_open {
+					t = p.stripe(tun)
+				}
+				if stripeWrite(t, buf[:nr+SEQ_LEN+FRAME_HEADER_LEN], prio) != nil {
+					SafeClose(t)
+					return
+				}
+			} else if edge.replay != nil {
+				pack(buf, FRAME_ACTION_DATA, sid, uint16(nr))
+				if !p.roamWrite(edge, buf[:nr+FRAME_HEADER_LEN], prio) {
+					return
+				}
+			} else {
+				pack(buf, FRAME_ACTION_DATA, sid, uint16(nr))
+				if frameWritePriority(tun, buf[:nr+FRAME_HEADER_LEN], prio) != nil {
+					SafeClose(tun)
+					return
+				}
 			}
+			atomic.AddInt64(&p.txBytes, int64(nr))
+			atomic.AddInt64(&edge.txBytes, int64(nr))
 		}
 		// timeout cause of rechecking then open-signal in fastOpen
 		if er != nil && !(_fast_open && IsTimeout(er)) {
@@ -662,6 +1279,24 @@ func (p *multiplexer) relay(edge *edgeConn, tun *Conn, sid uint16) {
 	}
 }
 
+func closeReasonOf(err error) byte {
+	switch {
+	case err == nil, err == io.EOF:
+		return CLOSE_REASON_EOF
+	case IsClosedError(err):
+		return CLOSE_REASON_CANCEL
+	}
+	return CLOSE_REASON_ERROR
+}
+
+// tolerate the peer without sending reason
+func parseCloseReason(body []byte) byte {
+	if len(body) > 0 && int(body[0]) < len(closeReasonNames) {
+		return body[0]
+	}
+	return CLOSE_REASON_UNKNOWN
+}
+
 // best to send message to peer in some critical cases
 func (p *multiplexer) bestSend(data []byte, action_desc string) bool {
 	var buf = make([]byte, FRAME_HEADER_LEN+len(data))
@@ -691,11 +1326,12 @@ func frameWriteBuffer(tun *Conn, origin []byte) (err error) {
 	err = tun.SetWriteDeadline(time.Now().Add(WRITE_TUN_TIMEOUT))
 	if err == nil {
 		var nw int
-		buf := frameTransform(origin)
+		var buf = tun.transformFrame(origin)
 		nw, err = tun.Write(buf)
 		if nw != len(buf) || err != nil {
 			idleLastR := time.Now().UnixNano() - tun.priority.last
 			if IsTimeout(err) && idleLastR < int64(WRITE_TUN_TIMEOUT) {
+				atomic.AddInt64(&tun.stall, 1)
 				err = nil
 			} else {
 				log.Warningf("Write tun (%s) error (%v) buf.len=%d\n", tun.identifier, err, len(buf))
@@ -716,10 +1352,28 @@ func frameWriteHead(tun *Conn, frm *frame) (err error) {
 	return frameWriteBuffer(tun, b)
 }
 
-func frameTransform(buf []byte) []byte {
+// pad and sign the frame of tun
+func (c *Conn) transformFrame(origin []byte) []byte {
+	if c.frames != nil {
+		return c.frames.transform(origin, c.profile)
+	}
+	return frameTransform(origin, c.profile)
+}
+
+func frameTransform(buf []byte, profile *wireProfile) []byte {
 	theLen := len(buf)
 	if theLen > 32 {
 		buf[1] = 0
+		// random padding in the spare capacity
+		if profile != nil {
+			if n := profile.pad(); n > 0 && cap(buf)-theLen >= n {
+				buf = buf[:theLen+n]
+				for i := theLen; i < len(buf); i++ {
+					buf[i] = 0
+				}
+				buf[1] = byte(n)
+			}
+		}
 		crypto.SetHash16At6(buf)
 		return buf
 	} else {
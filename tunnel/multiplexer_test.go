@@ -7,11 +7,13 @@ import (
 	"flag"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"net"
 	"reflect"
 	"runtime"
 	"strconv"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -236,3 +238,440 @@ func TestConcurrency(t *testing.T) {
 	rest(3)
 	checkFinishedLength(t)
 }
+
+func TestCloseReason(t *testing.T) {
+	var cases = []struct {
+		err    error
+		reason byte
+	}{
+		{nil, CLOSE_REASON_EOF},
+		{io.EOF, CLOSE_REASON_EOF},
+		{fmt.Errorf("read: connection reset by peer"), CLOSE_REASON_CANCEL},
+		{fmt.Errorf("i/o timeout"), CLOSE_REASON_ERROR},
+	}
+	for _, c := range cases {
+		r := closeReasonOf(c.err)
+		if r != c.reason {
+			t.Errorf("closeReasonOf(%v)=%d expected %d", c.err, r, c.reason)
+		}
+		if p := parseCloseReason([]byte{r}); p != r {
+			t.Errorf("parseCloseReason=%d expected %d", p, r)
+		}
+	}
+	// old peer sends no reason
+	if r := parseCloseReason(nil); r != CLOSE_REASON_UNKNOWN {
+		t.Errorf("parseCloseReason(nil)=%d", r)
+	}
+	if r := parseCloseReason([]byte{0xff}); r != CLOSE_REASON_UNKNOWN {
+		t.Errorf("parseCloseReason(0xff)=%d", r)
+	}
+}
+
+func TestPauseResume(t *testing.T) {
+	startEmulation()
+	conn, e := net.Dial("tcp", cltAddr)
+	ThrowErr(e)
+	defer conn.Close()
+	buf0 := make([]byte, 0xffff)
+	buf1 := make([]byte, 0xffff)
+
+	server.setPaused(true)
+	n := randomBuffer(buf0)
+	_, e = conn.Write(buf0[:n])
+	ThrowErr(e)
+	conn.SetReadDeadline(time.Now().Add(time.Millisecond * 500))
+	if nr, e := conn.Read(buf1); nr > 0 || !IsTimeout(e) {
+		t.Fatalf("data flowed in pausing nr=%d err=%v", nr, e)
+	}
+
+	server.setPaused(false)
+	conn.SetReadDeadline(time.Now().Add(time.Second * 4))
+	nr, e := io.ReadFull(conn, buf1[:n-2])
+	if e != nil || !bytes.Equal(buf0[2:n], buf1[:nr]) {
+		t.Errorf("data lost after resuming nr=%d err=%v", nr, e)
+	}
+}
+
+// the queue of paused session is bounded without flow control
+func TestPausedQueueBound(t *testing.T) {
+	var (
+		mux     = newServerMultiplexer()
+		dst, rd = net.Pipe()
+	)
+	c, s := tcpPair(t)
+	defer c.Close()
+	defer rd.Close()
+	defer mux.destroy()
+	go io.Copy(ioutil.Discard, rd)
+	mux.setPaused(true)
+	tun := NewConn(s.(*net.TCPConn), nullCipherKit)
+	edge := mux.router.register("key", "dest:80", tun, dst, false)
+	for i := 0; i <= STREAM_QUEUE_MAX/0x8000; i++ {
+		edge.deliver(&frame{action: FRAME_ACTION_DATA, sid: 9, length: 0x8000, data: make([]byte, 0x8000)})
+	}
+	mux.setPaused(false)
+	readFrameOf(t, c, FRAME_ACTION_CLOSE_R)
+	time.Sleep(time.Millisecond * 50)
+	if !edge.closed_gte(TCP_CLOSED) || mux.drops != 1 {
+		t.Errorf("the queue over the max was not dropped drops=%d", mux.drops)
+	}
+}
+
+func TestBufferBackpressure(t *testing.T) {
+	if n, err := parseHumanSize("64k"); err != nil || n != 64<<10 {
+		t.Fatalf("parseHumanSize=%d err=%v", n, err)
+	}
+	var (
+		mux     = newServerMultiplexer()
+		dst, rd = net.Pipe()
+		data    = func(sid uint16) *frame {
+			return &frame{action: FRAME_ACTION_DATA, sid: sid, length: 0x8000, data: make([]byte, 0x8000)}
+		}
+	)
+	c, s := tcpPair(t)
+	defer c.Close()
+	defer rd.Close()
+	defer mux.destroy()
+	mux.flowCtl = true
+	mux.buffers = newBufferMeter(STREAM_QUEUE_LOW * 2)
+	tun := NewConn(s.(*net.TCPConn), nullCipherKit)
+	// the destination doesn't read, then the slow stream is paused at the
+	// ceiling under its high
+	slow := mux.router.register("key", "dest:80", tun, dst, false)
+	for i := 0; i < 5; i++ {
+		slow.deliver(data(9))
+	}
+	if frm := readFrameOf(t, c, FRAME_ACTION_SLOWDOWN); frm.sid != 9 || frm.data[0] != 1 {
+		t.Errorf("unexpected pausing %v", frm)
+	}
+	// the others are not stalled
+	dst2, rd2 := net.Pipe()
+	defer rd2.Close()
+	other := mux.router.register("key2", "dest:80", tun, dst2, false)
+	other.deliver(data(10))
+	rd2.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := io.ReadFull(rd2, make([]byte, 0x8000)); err != nil {
+		t.Fatalf("the other stream stalled %v", err)
+	}
+	// the stream of peer couldn't be paused is dropped
+	mux.flowCtl = false
+	dst3, rd3 := net.Pipe()
+	defer rd3.Close()
+	heavy := mux.router.register("key3", "dest:80", tun, dst3, false)
+	for i := 0; i < 3; i++ {
+		heavy.deliver(data(11))
+	}
+	readFrameOf(t, c, FRAME_ACTION_CLOSE_R)
+	time.Sleep(time.Millisecond * 50)
+	if !heavy.closed_gte(TCP_CLOSED) || slow.closed_gte(TCP_CLOSED) {
+		t.Errorf("dropped the wrong streams")
+	}
+	// drain the destination
+	go io.Copy(ioutil.Discard, rd)
+	slow.deliver(&frame{action: FRAME_ACTION_CLOSE})
+	time.Sleep(time.Millisecond * 100)
+	if s := mux.buffers.String(); s != "Buffer=0B/128K" {
+		t.Errorf("unexpected %s", s)
+	}
+}
+
+func TestAdaptivePing(t *testing.T) {
+	c, s := net.Pipe()
+	defer c.Close()
+	defer s.Close()
+	var (
+		tun  = NewConn(c, nullCipherKit)
+		idle = NewIdler(DT_PING_INTERVAL, false)
+		base = idle.interval
+		busy = func() { atomic.AddInt64(&tun.wrote, 1) }
+	)
+	idle.attach(tun, 4*DT_PING_INTERVAL)
+	for i, step := range []struct {
+		busy     bool
+		ping     bool
+		interval time.Duration
+	}{
+		{false, true, base},
+		{true, false, base * 2},
+		{true, false, time.Second * 4 * DT_PING_INTERVAL},
+		// at the ceiling
+		{true, true, time.Second * 4 * DT_PING_INTERVAL},
+		{false, true, base},
+	} {
+		if step.busy {
+			busy()
+		}
+		if ping := idle.adapt(); ping != step.ping || idle.interval != step.interval {
+			t.Errorf("step %d: ping=%t interval=%s", i, ping, idle.interval)
+		}
+		if n := atomic.LoadInt64(&tun.ping); n != int64(step.interval) {
+			t.Errorf("step %d: effective interval %s", i, time.Duration(n))
+		}
+	}
+	// the pings are not activity
+	go io.Copy(ioutil.Discard, s)
+	if idle.ping(tun); !idle.adapt() || idle.interval != base {
+		t.Errorf("ping was taken as activity")
+	}
+	// fixed
+	idle = NewIdler(DT_PING_INTERVAL, false)
+	idle.attach(tun, 0)
+	busy()
+	if !idle.adapt() || idle.interval != base {
+		t.Errorf("fixed interval was adapted")
+	}
+}
+
+func TestPingRtt(t *testing.T) {
+	c, s := net.Pipe()
+	defer c.Close()
+	defer s.Close()
+	var (
+		tun  = NewConn(c, nullCipherKit)
+		idle = NewIdler(DT_PING_INTERVAL, true)
+		near = func(v int64, expected time.Duration) bool {
+			return v >= int64(expected) && v < int64(expected+time.Millisecond*5)
+		}
+	)
+	idle.attach(tun, 0)
+	for _, sample := range []struct {
+		rtt, srtt, rvar time.Duration
+	}{
+		{time.Millisecond * 100, time.Millisecond * 100, time.Millisecond * 50},
+		{time.Millisecond * 60, time.Millisecond * 90, time.Millisecond * 45},
+	} {
+		idle.lastPing = time.Now().Add(-sample.rtt).UnixNano()
+		idle.updateRtt()
+		if srtt, rvar := atomic.LoadInt64(&tun.srtt), atomic.LoadInt64(&tun.rvar); !near(srtt, sample.srtt) || !near(rvar, sample.rvar) {
+			t.Errorf("rtt=%s srtt=%s rvar=%s", sample.rtt, time.Duration(srtt), time.Duration(rvar))
+		}
+	}
+
+	var mux = newServerMultiplexer()
+	defer mux.destroy()
+	if stats := mux.rttStats(); stats != NULL {
+		t.Errorf("unexpected stats %q", stats)
+	}
+	var unsampled = NewConn(s, nullCipherKit)
+	tun.srtt, tun.rvar = int64(time.Millisecond*45), int64(time.Millisecond*3)
+	mux.pool.Push(tun)
+	mux.pool.Push(unsampled)
+	mux.lostPings = 1
+	if stats := mux.rttStats(); stats != " RTT=45ms Jitter=3ms Lost-pings=1" {
+		t.Errorf("unexpected stats %q", stats)
+	}
+}
+
+func TestStreamWindow(t *testing.T) {
+	var w = newFlowWindow(100)
+	if n := w.acquire(FRAME_MAX_LEN); n != 100 {
+		t.Fatalf("acquire=%d", n)
+	}
+	w.consume(100)
+	var acquired = make(chan int)
+	go func() {
+		acquired <- w.acquire(FRAME_MAX_LEN)
+	}()
+	select {
+	case n := <-acquired:
+		t.Fatalf("not blocked without credit n=%d", n)
+	case <-time.After(time.Millisecond * 100):
+	}
+	w.grant(50)
+	if n := <-acquired; n != 50 {
+		t.Errorf("acquire=%d after granted", n)
+	}
+	w.consume(50)
+	go func() {
+		acquired <- w.acquire(FRAME_MAX_LEN)
+	}()
+	w.close()
+	if n := <-acquired; n != 0 {
+		t.Errorf("acquire=%d after closed", n)
+	}
+
+	// the receiver grants the credit back after the data was written to edge
+	var (
+		mux     = newServerMultiplexer()
+		dst, rd = net.Pipe()
+	)
+	c, s := tcpPair(t)
+	defer c.Close()
+	defer rd.Close()
+	defer mux.destroy()
+	go io.Copy(ioutil.Discard, rd)
+	mux.flowCtl = true
+	edge := mux.router.register("key", "dest:80", NewConn(s.(*net.TCPConn), nullCipherKit), dst, false)
+	if edge.window == nil {
+		t.Fatalf("stream window was not created")
+	}
+	for i := 0; i < STREAM_WINDOW/2/0x8000; i++ {
+		edge.deliver(&frame{action: FRAME_ACTION_DATA, sid: 7, length: 0x8000, data: make([]byte, 0x8000)})
+	}
+	c.SetReadDeadline(time.Now().Add(time.Second * 2))
+	header := make([]byte, FRAME_HEADER_LEN)
+	if _, e := io.ReadFull(c, header); e != nil {
+		t.Fatalf("credit was not granted err=%v", e)
+	}
+	frm, e := parse_frame(header)
+	if e == nil {
+		_, e = io.ReadFull(c, frm.data)
+	}
+	if e != nil || frm.action != FRAME_ACTION_WINDOW || frm.sid != 7 ||
+		binary.BigEndian.Uint32(frm.data) != STREAM_WINDOW/2 {
+		t.Errorf("unexpected grant %v err=%v", frm, e)
+	}
+
+	// the larger window is granted on opening, and the peer sent beyond it
+	// is refused
+	mux.window = STREAM_WINDOW * 4
+	edge = mux.router.register("key2", "dest:80", edge.tun, dst, false)
+	edge.openWindow(8)
+	if frm = readFrameOf(t, c, FRAME_ACTION_WINDOW); frm.sid != 8 ||
+		binary.BigEndian.Uint32(frm.data) != STREAM_WINDOW*3 {
+		t.Errorf("unexpected grant on opening %v", frm)
+	}
+	if !edge.charge(STREAM_WINDOW*4) || edge.charge(1) {
+		t.Errorf("the credit was not enforced %d", edge.credit)
+	}
+	if !edge.queue.drop() || edge.queue.drop() || mux.drops != 1 {
+		t.Errorf("the stream was not dropped once")
+	}
+}
+
+// read the frames until the action
+func readFrameOf(t *testing.T, conn net.Conn, action byte) *frame {
+	conn.SetReadDeadline(time.Now().Add(time.Second * 3))
+	header := make([]byte, FRAME_HEADER_LEN)
+	for {
+		if _, e := io.ReadFull(conn, header); e != nil {
+			t.Fatalf("not received action=%x err=%v", action, e)
+		}
+		frm, e := parse_frame(header)
+		if e == nil && len(frm.data) > 0 {
+			_, e = io.ReadFull(conn, frm.data)
+			frm.data = frm.data[:frm.length]
+		}
+		if e != nil {
+			t.Fatal(e)
+		}
+		if frm.action == action {
+			return frm
+		}
+	}
+}
+
+func TestStreamBackpressure(t *testing.T) {
+	var (
+		mux     = newServerMultiplexer()
+		dst, rd = net.Pipe()
+		data    = func() *frame {
+			return &frame{action: FRAME_ACTION_DATA, sid: 9, length: 0x8000, data: make([]byte, 0x8000)}
+		}
+	)
+	c, s := tcpPair(t)
+	defer c.Close()
+	defer rd.Close()
+	defer mux.destroy()
+	mux.flowCtl = true
+	tun := NewConn(s.(*net.TCPConn), nullCipherKit)
+	// the destination doesn't read, then peer is paused at the high
+	edge := mux.router.register("key", "dest:80", tun, dst, false)
+	for i := 0; i <= STREAM_QUEUE_HIGH/0x8000; i++ {
+		edge.deliver(data())
+	}
+	if frm := readFrameOf(t, c, FRAME_ACTION_SLOWDOWN); frm.sid != 9 || frm.data[0] != 1 {
+		t.Errorf("unexpected pausing %v", frm)
+	}
+	// and resumed after drained
+	go io.Copy(ioutil.Discard, rd)
+	if frm := readFrameOf(t, c, FRAME_ACTION_SLOWDOWN); frm.data[0] != 0 {
+		t.Errorf("unexpected resuming %v", frm)
+	}
+
+	// the stream is dropped if peer ignored the pausing
+	dst, rd = net.Pipe()
+	defer rd.Close()
+	edge = mux.router.register("key2", "dest:80", tun, dst, false)
+	for i := 0; i <= STREAM_QUEUE_MAX/0x8000; i++ {
+		edge.deliver(data())
+	}
+	readFrameOf(t, c, FRAME_ACTION_CLOSE_R)
+	time.Sleep(time.Millisecond * 50)
+	if !edge.closed_gte(TCP_CLOSED) {
+		t.Errorf("stream was not dropped")
+	}
+	if stats := mux.stallStats(); stats != " Stalls=2 Dropped-streams=1" {
+		t.Errorf("unexpected stats %q", stats)
+	}
+
+	// the sender waits until resumed or expired
+	var stall streamStall
+	if stall.wait() {
+		t.Errorf("waited without pausing")
+	}
+	stall.set(true)
+	time.AfterFunc(time.Millisecond*50, func() { stall.set(false) })
+	if start := time.Now(); !stall.wait() || time.Since(start) > time.Second {
+		t.Errorf("not resumed")
+	}
+	stall.set(true)
+	stall.until = time.Now().Add(time.Millisecond * 50)
+	if start := time.Now(); !stall.wait() || time.Since(start) > time.Second || stall.resumed != nil {
+		t.Errorf("pausing not expired")
+	}
+}
+
+func TestGoAway(t *testing.T) {
+	var (
+		mux     = newServerMultiplexer()
+		dst, rd = net.Pipe()
+		drained = make(chan bool)
+	)
+	c, s := tcpPair(t)
+	defer c.Close()
+	defer rd.Close()
+	defer mux.destroy()
+	mux.goaway = true
+	tun := NewConn(s.(*net.TCPConn), nullCipherKit)
+	mux.pool.Push(tun)
+	tun.priority = &TSPriority{0, 1e9}
+	edge := mux.router.register("key", "dest:80", tun, dst, false)
+	go func() {
+		mux.drain(time.Second * 3)
+		drained <- true
+	}()
+	readFrameOf(t, c, FRAME_ACTION_GOAWAY)
+	if mux.pool.Select() != nil {
+		t.Errorf("selected the retired tun")
+	}
+	select {
+	case <-drained:
+		t.Fatalf("drained with the stream alive")
+	case <-time.After(time.Millisecond * 200):
+	}
+	edge.bitwiseCompareAndSet(TCP_CLOSED)
+	select {
+	case <-drained:
+	case <-time.After(time.Second):
+		t.Fatalf("not drained after the stream finished")
+	}
+
+	// the peer opens no more streams on the tun
+	var peer = newClientMultiplexer()
+	defer peer.destroy()
+	// negotiated by the capability
+	peer.goaway = true
+	c2, s2 := tcpPair(t)
+	defer c2.Close()
+	go peer.Listen(NewConn(c2.(*net.TCPConn), nullCipherKit), nil, 0)
+	rest(1)
+	if peer.pool.Select() == nil {
+		t.Fatalf("no tun selected")
+	}
+	frameWriteHead(NewConn(s2.(*net.TCPConn), nullCipherKit), &frame{action: FRAME_ACTION_GOAWAY})
+	rest(1)
+	if peer.pool.Select() != nil || peer.pool.Len() != 1 {
+		t.Errorf("selected the tun retired by peer")
+	}
+}
@@ -0,0 +1,312 @@
+package tunnel
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/Lafeng/deblocus/auth"
+	"github.com/Lafeng/deblocus/exception"
+	log "github.com/Lafeng/deblocus/glog"
+)
+
+const (
+	// user attribute, value: true to persist sessions across restarts
+	UA_PERSIST = "persist"
+	// the restored sessions must be resumed in time
+	SESSION_RESTORE_TTL = time.Minute * 5
+	// interval of checkpoints at least
+	SESSION_CHECKPOINT_MIN = time.Second
+)
+
+var (
+	SESSION_STORE_ERROR = exception.New("Invalid session store")
+)
+
+// the state of session to be restored
+type persistedSession struct {
+	User        string
+	Client      string
+	Addr        string // bare ip of client, derived from Client if empty
+	Label       string
+	Correlation string
+	Cipher      string
+	Key         []byte
+	Tokens      map[string]time.Time
+	TokenSize   int
+	Protocol    int
+	Caps        uint32
+	Id          uint32 // of the stateless tokens
+	Start       time.Time
+	BytesUp     int64
+	BytesDown   int64
+	Streams     int64
+}
+
+// the ip of client, the older states carry the cid only
+func (p *persistedSession) origin() string {
+	if p.Addr != NULL {
+		return p.Addr
+	}
+	return originOf(p.Client)
+}
+
+// --------------------
+// sessionStore
+// --------------------
+// the sessions of the users opted in are saved at shutdown, and restored at
+// startup then resumed by the tokens without negotiation. the whole file is
+// sealed by AES-GCM with the key derived from the private key of server, and
+// removed once loaded.
+// the store could be checkpointed periodically also, so the sessions survive
+// the crash or kill of server rather than renegotiated by all clients at once.
+// but the tokens spent after the last checkpoint are valid again once
+// restored, the interval bounds that window.
+type sessionStore struct {
+	path   string
+	aead   cipher.AEAD
+	lock   sync.Mutex // of the snapshots and writers
+	closed bool       // the final state was saved
+}
+
+func newSessionStore(path string, secret []byte) *sessionStore {
+	var key = sha256.Sum256(append([]byte("session-store:"), secret...))
+	block, _ := aes.NewCipher(key[:])
+	aead, _ := cipher.NewGCM(block)
+	return &sessionStore{path: path, aead: aead}
+}
+
+func persistable(attrs auth.Attributes) bool {
+	y, _ := strconv.ParseBool(attrs.Get(UA_PERSIST))
+	return y
+}
+
+// snapshot and save in lock, so the older state never overwrites the newer.
+// no more saving after the final.
+func (st *sessionStore) update(snapshot func() []*persistedSession, final bool) (int, error) {
+	st.lock.Lock()
+	defer st.lock.Unlock()
+	if st.closed {
+		return 0, SESSION_STORE_ERROR.Apply("closed")
+	}
+	st.closed = final
+	list := snapshot()
+	return len(list), st.save(list)
+}
+
+// must be called in lock
+func (st *sessionStore) save(list []*persistedSession) error {
+	plain, err := json.Marshal(list)
+	if err != nil {
+		return err
+	}
+	var nonce = make([]byte, st.aead.NonceSize())
+	if _, err = io.ReadFull(rand.Reader, nonce); err != nil {
+		return err
+	}
+	sealed := st.aead.Seal(nonce, nonce, plain, nil)
+	var tmp = st.path + ".tmp"
+	if err = ioutil.WriteFile(tmp, sealed, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, st.path)
+}
+
+// the store is single-use, removed after loaded successfully. the invalid
+// is kept for inspecting.
+func (st *sessionStore) load() ([]*persistedSession, error) {
+	sealed, err := ioutil.ReadFile(st.path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var n = st.aead.NonceSize()
+	if len(sealed) < n {
+		return nil, SESSION_STORE_ERROR.Apply("truncated")
+	}
+	plain, err := st.aead.Open(nil, sealed[:n], sealed[n:], nil)
+	if err != nil {
+		return nil, SESSION_STORE_ERROR.Apply(err)
+	}
+	var list []*persistedSession
+	if err = json.Unmarshal(plain, &list); err != nil {
+		return nil, SESSION_STORE_ERROR.Apply(err)
+	}
+	os.Remove(st.path)
+	return list, nil
+}
+
+// save the sessions opted in before shutdown, and return them
+func (t *Server) persistSessions() map[*Session]bool {
+	var saved map[*Session]bool
+	n, err := t.store.update(func() (list []*persistedSession) {
+		list, saved = t.snapshotSessions()
+		return
+	}, true)
+	if err != nil {
+		log.Warningf("Failed to persist sessions: %v\n", err)
+		return nil
+	}
+	log.Infof("Persisted sessions=%d to %s", n, t.SessionStore)
+	return saved
+}
+
+// save the sessions opted in without closing them
+func (t *Server) checkpointSessions() error {
+	n, err := t.store.update(func() []*persistedSession {
+		list, _ := t.snapshotSessions()
+		return list
+	}, false)
+	if err != nil {
+		log.Warningf("Failed to checkpoint sessions: %v\n", err)
+		return err
+	}
+	if log.V(log.LV_SESSION) {
+		log.Infof("Checkpointed sessions=%d to %s", n, t.SessionStore)
+	}
+	return nil
+}
+
+func (t *Server) startCheckpoint(interval time.Duration) {
+	t.checkpoint = time.NewTicker(interval)
+	t.checkpointDone = make(chan struct{})
+	go func(ticker *time.Ticker, done chan struct{}) {
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				t.checkpointSessions()
+			}
+		}
+	}(t.checkpoint, t.checkpointDone)
+}
+
+// before the final persisting
+func (t *Server) stopCheckpoint() {
+	if t.checkpoint != nil {
+		t.checkpoint.Stop()
+		close(t.checkpointDone)
+		t.checkpoint = nil
+	}
+}
+
+// the state of sessions opted in
+func (t *Server) snapshotSessions() ([]*persistedSession, map[*Session]bool) {
+	var (
+		saved = make(map[*Session]bool)
+		list  []*persistedSession
+	)
+	for _, s := range t.sessionMgr.lookup(NULL) {
+		if !s.persist || s.cipherFactory == nil || atomic.LoadInt32(&s.closed) != 0 {
+			continue
+		}
+		p := persistedOf(s)
+		p.Tokens = t.sessionMgr.tokensOf(s)
+		list = append(list, p)
+		saved[s] = true
+	}
+	return list, saved
+}
+
+// the state of session without tokens
+func persistedOf(s *Session) *persistedSession {
+	p := &persistedSession{
+		User:        s.uid,
+		Client:      s.cid,
+		Addr:        s.addr,
+		Label:       s.label,
+		Correlation: s.correlation,
+		Cipher:      s.cipherFactory.name,
+		Key:         s.cipherFactory.key,
+		TokenSize:   s.tokenSize,
+		Protocol:    s.protocol,
+		Caps:        s.caps,
+		Id:          s.sid,
+		Start:       s.start,
+	}
+	p.BytesUp, p.BytesDown, p.Streams = s.mux.traffic()
+	return p
+}
+
+// reconcile against the user store, then restore the sessions
+func (t *Server) restoreSessions() error {
+	list, err := t.store.load()
+	if err != nil {
+		return err
+	}
+	var restored int
+	for _, p := range list {
+		u, _ := t.AuthSys.UserInfo(p.User)
+		if u == nil || !persistable(u.Attrs) {
+			log.Warningf("Dropped the persisted session of %s@%s", p.User, p.Client)
+			continue
+		}
+		s, err := t.reviveSession(p, u)
+		if err != nil {
+			log.Warningf("Dropped the persisted session of %s@%s: %v", p.User, p.Client, err)
+			continue
+		}
+		t.sessionMgr.register(s)
+		t.sessionMgr.restoreTokens(s, p.Tokens)
+		time.AfterFunc(SESSION_RESTORE_TTL, s.restoreExpired)
+		restored++
+	}
+	if len(list) > 0 {
+		log.Infof("Restored sessions=%d of persisted=%d", restored, len(list))
+	}
+	return nil
+}
+
+// the session of the state and the current policies of user, not registered
+func (t *Server) reviveSession(p *persistedSession, u *auth.User) (*Session, error) {
+	desc, err := GetCipher(p.Cipher, t.allowPlaintext)
+	if err != nil {
+		return nil, err
+	}
+	s := t.NewSession(&CipherFactory{p.Key, desc, p.Cipher})
+	s.uid, s.cid, s.start = p.User, p.Client, p.Start
+	s.addr = p.origin()
+	s.correlation = p.Correlation
+	if p.TokenSize > 0 {
+		s.tokenSize = p.TokenSize
+	}
+	if p.Protocol > 0 {
+		s.protocol = p.Protocol
+	}
+	if s.protocol >= PROTOCOL_V2 {
+		s.applyCapabilities(p.Caps)
+	}
+	s.sid = p.Id
+	s.applyUserPolicy(u)
+	if p.Label != NULL {
+		if rule := t.labels[p.Label]; rule != nil {
+			s.applyLabelRule(p.Label, rule)
+		}
+	}
+	if t.webhook != nil {
+		s.applyWebhook(t.webhook)
+	}
+	atomic.StoreInt64(&s.mux.rxBytes, p.BytesUp)
+	atomic.StoreInt64(&s.mux.txBytes, p.BytesDown)
+	atomic.StoreInt64(&s.mux.streams, p.Streams)
+	return s, nil
+}
+
+// not resumed in time after restored
+func (s *Session) restoreExpired() {
+	if atomic.LoadInt32(&s.activeCnt) <= 0 && atomic.LoadInt32(&s.closed) == 0 {
+		log.Infof("Restored session %s@%s was not resumed", s.uid, s.cid)
+		s.destroy(SESSION_CLOSE_OFFLINE)
+	}
+}
@@ -0,0 +1,186 @@
+package tunnel
+
+import (
+	"bytes"
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/Lafeng/deblocus/auth"
+)
+
+func newPersistServer(t *testing.T, store, users string) *Server {
+	f, err := ioutil.TempFile(NULL, "auth")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	f.WriteString(users)
+	f.Close()
+	serv := newTestServer()
+	if serv.AuthSys, err = auth.NewFileAuthSys(f.Name()); err != nil {
+		t.Fatal(err)
+	}
+	serv.SessionStore = store
+	serv.store = newSessionStore(store, []byte("private key"))
+	return serv
+}
+
+func newPersistSession(t *testing.T, serv *Server, user string) (*Session, []byte) {
+	s := newTestSession(serv, user)
+	u, _ := serv.AuthSys.UserInfo(user)
+	s.applyUserPolicy(u)
+	serv.sessionMgr.register(s)
+	tokens := serv.sessionMgr.createTokens(s, 2)
+	atomic.StoreInt64(&s.mux.rxBytes, 100)
+	atomic.StoreInt64(&s.mux.txBytes, 200)
+	return s, tokens
+}
+
+func TestSessionPersistence(t *testing.T) {
+	dir, err := ioutil.TempDir(NULL, "store")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	var (
+		store = dir + "/sessions"
+		users = "alice:secret\n  persist=true\nbob:secret\ncarol:secret\n  persist=true\n"
+		serv  = newPersistServer(t, store, users)
+	)
+	alice, aliceTokens := newPersistSession(t, serv, "alice")
+	_, bobTokens := newPersistSession(t, serv, "bob")
+	_, carolTokens := newPersistSession(t, serv, "carol")
+	// cleared at destroy
+	aliceKey := append([]byte(nil), alice.cipherFactory.key...)
+	serv.Close()
+	if atomic.LoadInt32(&alice.closed) == 0 {
+		t.Fatalf("persisted session was not closed")
+	}
+	data, err := ioutil.ReadFile(store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(data, []byte("alice")) {
+		t.Errorf("store was not sealed")
+	}
+
+	// carol was removed
+	serv = newPersistServer(t, store, "alice:secret\n  persist=true\nbob:secret\n")
+	if err = serv.restoreSessions(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = os.Stat(store); !os.IsNotExist(err) {
+		t.Errorf("store was not removed after loading")
+	}
+	if n := serv.sessionMgr.length(); n != 2 {
+		t.Fatalf("restored tokens=%d", n)
+	}
+	ses, err := serv.sessionMgr.take(aliceTokens[1:1+TKSZ], "127.0.0.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ses.uid != "alice" || !ses.persist || !bytes.Equal(ses.cipherFactory.key, aliceKey) {
+		t.Errorf("unexpected restored session %s key=%s", ses.uid, hex.EncodeToString(ses.cipherFactory.key))
+	}
+	if up, down, _ := ses.mux.traffic(); up != 100 || down != 200 {
+		t.Errorf("restored traffic up=%d down=%d", up, down)
+	}
+	for user, tokens := range map[string][]byte{"bob": bobTokens, "carol": carolTokens} {
+		if _, err = serv.sessionMgr.take(tokens[1:1+TKSZ], "127.0.0.1"); err == nil {
+			t.Errorf("session of %s was restored", user)
+		}
+	}
+
+	// single-use
+	serv = newPersistServer(t, store, users)
+	if err = serv.restoreSessions(); err != nil || serv.sessionMgr.length() != 0 {
+		t.Errorf("restored again err=%v", err)
+	}
+}
+
+// the server crashed after checkpoints
+func TestSessionCheckpoint(t *testing.T) {
+	dir, err := ioutil.TempDir(NULL, "store")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	var (
+		store = dir + "/sessions"
+		users = "alice:secret\n  persist=true\n"
+		serv  = newPersistServer(t, store, users)
+	)
+	alice, tokens := newPersistSession(t, serv, "alice")
+	serv.startCheckpoint(time.Millisecond * 10)
+	for i := 0; i < 100; i++ {
+		if _, err = os.Stat(store); err == nil {
+			break
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+	serv.stopCheckpoint()
+	if err != nil {
+		t.Fatalf("not checkpointed %v", err)
+	}
+	if atomic.LoadInt32(&alice.closed) != 0 {
+		t.Errorf("checkpointed session was closed")
+	}
+
+	serv = newPersistServer(t, store, users)
+	if err = serv.restoreSessions(); err != nil {
+		t.Fatal(err)
+	}
+	if ses, err := serv.sessionMgr.take(tokens[1:1+TKSZ], "127.0.0.1"); err != nil || ses.uid != "alice" {
+		t.Errorf("checkpointed session was not restored %v", err)
+	}
+}
+
+func TestSessionStoreTampered(t *testing.T) {
+	f, err := ioutil.TempFile(NULL, "store")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	defer os.Remove(f.Name())
+	st := newSessionStore(f.Name(), []byte("private key"))
+	if err = st.save([]*persistedSession{{User: "alice"}}); err != nil {
+		t.Fatal(err)
+	}
+	other := newSessionStore(f.Name(), []byte("other key"))
+	if _, err = other.load(); err == nil {
+		t.Errorf("loaded with other key")
+	}
+	// kept for the right key
+	if list, err := st.load(); err != nil || len(list) != 1 {
+		t.Errorf("store was removed by the failed loading err=%v", err)
+	}
+}
+
+// the checkpoint racing with shutdown
+func TestSessionStoreFinal(t *testing.T) {
+	f, err := ioutil.TempFile(NULL, "store")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	defer os.Remove(f.Name())
+	st := newSessionStore(f.Name(), []byte("private key"))
+	var snapshot = func(user string) func() []*persistedSession {
+		return func() []*persistedSession {
+			return []*persistedSession{{User: user}}
+		}
+	}
+	if _, err = st.update(snapshot("final"), true); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = st.update(snapshot("older"), false); err == nil {
+		t.Errorf("saved after the final")
+	}
+	if list, err := st.load(); err != nil || len(list) != 1 || list[0].User != "final" {
+		t.Errorf("loaded %v err=%v", list, err)
+	}
+}
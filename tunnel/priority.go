@@ -0,0 +1,140 @@
+package tunnel
+
+import (
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const (
+	// priority of streams in writing tunnels, the lower goes first
+	STREAM_PRIO_INTERACTIVE = iota
+	STREAM_PRIO_NORMAL
+	STREAM_PRIO_BULK
+	STREAM_PRIO_LEVELS
+)
+
+const (
+	// the unmarked stream is demoted to bulk after sent such bytes
+	STREAM_BULK_BYTES = 1 << 20
+	// bytes credited to the waiting stream in each round
+	DRR_QUANTUM = 1 << 13
+)
+
+// destination ports of the interactive streams, eg. ssh
+type priorityPorts map[string]bool
+
+// ports: 22,3389,...
+func parsePriorityPorts(ports string) (priorityPorts, error) {
+	var set = make(priorityPorts)
+	for _, item := range strings.Split(ports, ",") {
+		if item = strings.TrimSpace(item); item == NULL {
+			continue
+		}
+		if port, err := strconv.Atoi(item); err != nil || port <= 0 || port > 0xffff {
+			return nil, CONF_ERROR.Apply("InteractivePorts " + item)
+		}
+		set[item] = true
+	}
+	return set, nil
+}
+
+// the initial priority of stream to the destination
+func (s priorityPorts) of(dest string) int {
+	if len(s) > 0 {
+		if _, port, err := net.SplitHostPort(dest); err == nil && s[port] {
+			return STREAM_PRIO_INTERACTIVE
+		}
+	}
+	return STREAM_PRIO_NORMAL
+}
+
+// --------------------
+// priorityGate
+// --------------------
+// the data frames of streams are written to the tunnel one by one, and the
+// waiting of higher priority go first. so the interactive and the short ones
+// don't queue behind megabytes of bulk. the waiting of the same priority take
+// turns by deficit round-robin, then a stream of large frames can't take more
+// bytes than the others. the control frames bypass the gate.
+// nil gate means unordered.
+type priorityGate struct {
+	lock   sync.Mutex
+	cond   *sync.Cond
+	busy   bool
+	turn   *gateWaiter // granted but not entered yet
+	rings  [STREAM_PRIO_LEVELS][]*gateWaiter
+	cursor [STREAM_PRIO_LEVELS]int
+}
+
+// the frame of a stream waiting for the turn
+type gateWaiter struct {
+	size    int
+	deficit int
+}
+
+func newPriorityGate() *priorityGate {
+	g := new(priorityGate)
+	g.cond = sync.NewCond(&g.lock)
+	return g
+}
+
+// wait for the turn to write the frame of size
+func (g *priorityGate) enter(prio int, size int) {
+	if g == nil {
+		return
+	}
+	var w = &gateWaiter{size: size}
+	g.lock.Lock()
+	g.rings[prio] = append(g.rings[prio], w)
+	if !g.busy {
+		g.schedule()
+	}
+	for g.turn != w {
+		g.cond.Wait()
+	}
+	g.turn = nil
+	g.lock.Unlock()
+}
+
+func (g *priorityGate) leave() {
+	if g == nil {
+		return
+	}
+	g.lock.Lock()
+	g.busy = false
+	g.schedule()
+	g.lock.Unlock()
+}
+
+// grant the turn to the next waiting, must hold the lock
+func (g *priorityGate) schedule() {
+	for prio, ring := range g.rings {
+		if len(ring) == 0 {
+			continue
+		}
+		for i := g.cursor[prio]; ; i++ {
+			if i >= len(ring) {
+				i = 0
+			}
+			w := ring[i]
+			w.deficit += DRR_QUANTUM
+			if w.deficit >= w.size {
+				// the next one takes the place
+				g.rings[prio] = append(ring[:i], ring[i+1:]...)
+				g.cursor[prio] = i
+				g.turn, g.busy = w, true
+				g.cond.Broadcast()
+				return
+			}
+		}
+	}
+}
+
+// write the data frame in the turn of priority
+func frameWritePriority(tun *Conn, buf []byte, prio int) error {
+	tun.gate.enter(prio, len(buf))
+	defer tun.gate.leave()
+	return frameWriteBuffer(tun, buf)
+}
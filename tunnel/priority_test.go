@@ -0,0 +1,104 @@
+package tunnel
+
+import (
+	"testing"
+	"time"
+)
+
+func TestPriorityPorts(t *testing.T) {
+	ports, err := parsePriorityPorts("22, 3389")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for dest, expected := range map[string]int{
+		"example.com:22":  STREAM_PRIO_INTERACTIVE,
+		"10.0.0.1:3389":   STREAM_PRIO_INTERACTIVE,
+		"example.com:443": STREAM_PRIO_NORMAL,
+		"example.com":     STREAM_PRIO_NORMAL,
+	} {
+		if prio := ports.of(dest); prio != expected {
+			t.Errorf("%s prio=%d", dest, prio)
+		}
+	}
+	if prio := priorityPorts(nil).of("example.com:22"); prio != STREAM_PRIO_NORMAL {
+		t.Errorf("unmarked prio=%d", prio)
+	}
+	for _, ports := range []string{"ssh", "0", "65536", "22,x"} {
+		if _, err = parsePriorityPorts(ports); err == nil {
+			t.Errorf("accepted ports %s", ports)
+		}
+	}
+}
+
+func TestPriorityGate(t *testing.T) {
+	var (
+		g     = newPriorityGate()
+		order = make(chan int, 3)
+	)
+	g.enter(STREAM_PRIO_BULK, 1)
+	var waitFor = func(prio int) {
+		go func() {
+			g.enter(prio, 1)
+			order <- prio
+			g.leave()
+		}()
+		// queued in turn
+		time.Sleep(time.Millisecond * 50)
+	}
+	waitFor(STREAM_PRIO_BULK)
+	waitFor(STREAM_PRIO_NORMAL)
+	waitFor(STREAM_PRIO_INTERACTIVE)
+	select {
+	case prio := <-order:
+		t.Fatalf("prio=%d entered the busy gate", prio)
+	default:
+	}
+	g.leave()
+	for _, expected := range []int{STREAM_PRIO_INTERACTIVE, STREAM_PRIO_NORMAL, STREAM_PRIO_BULK} {
+		select {
+		case prio := <-order:
+			if prio != expected {
+				t.Errorf("prio=%d entered before %d", prio, expected)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("prio=%d was starved", expected)
+		}
+	}
+	// nil gate is unordered
+	var none *priorityGate
+	none.enter(STREAM_PRIO_BULK, 1)
+	none.leave()
+}
+
+func TestFairQueuing(t *testing.T) {
+	var (
+		g     = newPriorityGate()
+		order = make(chan int, 4)
+	)
+	g.enter(STREAM_PRIO_NORMAL, 1)
+	// the large frame queued first goes after the small ones
+	for i, size := range []int{FRAME_MAX_LEN, 1024, 1024, 1024} {
+		go func(i, size int) {
+			g.enter(STREAM_PRIO_NORMAL, size)
+			order <- i
+			g.leave()
+		}(i, size)
+		time.Sleep(time.Millisecond * 50)
+	}
+	g.leave()
+	for _, expected := range []int{1, 2, 3, 0} {
+		select {
+		case i := <-order:
+			if i != expected {
+				t.Errorf("stream %d entered before %d", i, expected)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("stream %d was starved", expected)
+		}
+	}
+	for _, ring := range g.rings {
+		if len(ring) > 0 || g.busy {
+			t.Errorf("waiting=%d busy=%v after all left", len(ring), g.busy)
+		}
+	}
+}
@@ -51,7 +51,9 @@ var (
 // socks5 protocol handler in client side
 // Ref: https://www.ietf.org/rfc/rfc1928.txt
 type socks5Handler struct {
-	conn net.Conn
+	conn      net.Conn
+	associate bool        // accept UDP ASSOCIATE
+	full      func() bool // refuse CONNECT if the streams were full
 }
 
 // step1-2
@@ -105,7 +107,8 @@ errLogging:
 }
 
 // step3-4
-func (s socks5Handler) readRequest() (string, bool) {
+// the request of UDP ASSOCIATE is replied by replyBound
+func (s socks5Handler) readRequest() (string, byte, bool) {
 	var (
 		buf            = make([]byte, 262) // 4+(1+255)+2
 		host           string
@@ -120,10 +123,17 @@ func (s socks5Handler) readRequest() (string, bool) {
 		goto errLogging
 	}
 	ver, cmd, atyp = buf[0], buf[1], buf[3]
-	if ver != S5_VER || cmd != 1 {
+	if ver != S5_VER || (cmd != SOCKS5_CMD_CONNECT && cmd != SOCKS5_CMD_ASSOCIATE) {
 		exception.Spawn(&err, "socks: invalid request")
 		goto errHandler
 	}
+	if cmd == SOCKS5_CMD_ASSOCIATE && !s.associate {
+		err = UNSUPPORTED_SOCKS5_CMD
+		msg[1] = 0x7 // command not supported
+		setWTimeout(s.conn)
+		s.conn.Write(msg)
+		goto errLogging
+	}
 
 	buf = buf[4:]
 	switch atyp {
@@ -146,15 +156,22 @@ func (s socks5Handler) readRequest() (string, bool) {
 		goto errHandler
 	}
 
+	host += ":" + strconv.Itoa(int(binary.BigEndian.Uint16(buf[ofs:])))
+	if cmd == SOCKS5_CMD_ASSOCIATE {
+		return host, cmd, true
+	}
+	if s.full != nil && s.full() {
+		err = ERR_STREAMS_FULL.Apply(host)
+		goto errHandler
+	}
+
 	// accept
 	_, err = s.conn.Write(msg)
 	if err != nil {
 		exception.Spawn(&err, "socks: write response")
 		goto errLogging
 	}
-
-	host += ":" + strconv.Itoa(int(binary.BigEndian.Uint16(buf[ofs:])))
-	return host, true
+	return host, cmd, true
 
 errHandler:
 	msg[1] = 0x1 // general SOCKS server failure
@@ -163,7 +180,20 @@ errHandler:
 errLogging:
 	log.Warningln(err)
 
-	return NULL, false
+	return NULL, 0, false
+}
+
+// reply the address of UDP relay, or failure if nil
+func (s socks5Handler) replyBound(addr *net.UDPAddr) error {
+	var msg = []byte{5, 0, 0, 1, 0, 0, 0, 0, 0, 0}
+	if addr != nil {
+		msg = append([]byte{5, 0, 0}, packSocksAddr(addr)...)
+	} else {
+		msg[1] = 0x1 // general SOCKS server failure
+	}
+	setWTimeout(s.conn)
+	_, err := s.conn.Write(msg)
+	return err
 }
 
 // determines protocol of client req
@@ -2,6 +2,8 @@ package tunnel
 
 import (
 	"container/list"
+	"encoding/binary"
+	"fmt"
 	"net"
 	"strings"
 	"sync"
@@ -26,9 +28,26 @@ const (
 
 const (
 	TICKER_INTERVAL = time.Second * 15
+	// the initial credit of the stream window, granted again by the half. the
+	// receiver configured a larger window grants the rest on opening
+	STREAM_WINDOW = 1 << 18
+	// the peer is paused if the queued bytes of stream reach the high, and
+	// resumed at the low. the stream is dropped at the max if peer ignored.
+	STREAM_QUEUE_HIGH = 1 << 18
+	STREAM_QUEUE_LOW  = 1 << 16
+	STREAM_QUEUE_MAX  = 1 << 22
+	// the pausing expires in case the resuming was lost
+	STREAM_PAUSE_MAX = time.Second * 10
 )
 
 type edgeConn struct {
+	// traffic counters, rx: tun -> edge, tx: edge -> tun
+	rxBytes int64
+	txBytes int64
+	recv    int64 // data accepted from tunnel, reported in rebinding
+	meter   streamMeter
+	stall   streamStall // the sending paused by peer
+
 	mux    *multiplexer
 	tun    *Conn
 	conn   net.Conn
@@ -36,16 +55,30 @@ type edgeConn struct {
 	key    string
 	dest   string
 	queue  *equeue
-	active bool // actively open
+	window *flowWindow // credit of sending, nil if not controlled
+	active bool        // actively open
 	closed uint32
+	// reason of peer closeW
+	closeReason byte
+	// the first frame was inspected, only used in sendLoop
+	sniffed bool
+	// sent data kept for rebinding in roaming
+	replay *replayBuffer
+	// written to the edge but not granted to peer yet, only used in sendLoop
+	ungranted int
+	// the credit of peer sending, atomically charged by the received data
+	credit int64
+	// regarded as a probe at closing
+	probed uint32
 }
 
 func newEdgeConn(mux *multiplexer, key, dest string, tun *Conn, conn net.Conn) *edgeConn {
 	var edge = &edgeConn{
-		mux:  mux,
-		tun:  tun,
-		conn: conn,
-		key:  key,
+		mux:   mux,
+		tun:   tun,
+		conn:  conn,
+		key:   key,
+		meter: streamMeter{start: time.Now()},
 	}
 	if mux.isClient {
 		edge.ready = make(chan byte, 1)
@@ -63,6 +96,65 @@ func (e *edgeConn) deliver(frm *frame) {
 	}
 }
 
+// return the credit to peer after the data was written to the edge
+func (e *edgeConn) grantPeer(sid uint16, n int) {
+	e.ungranted += n
+	if e.ungranted < e.mux.window/2 {
+		return
+	}
+	if e.sendCredit(sid, e.ungranted) {
+		e.ungranted = 0
+	}
+}
+
+// grant the window beyond the initial to peer on opening
+func (e *edgeConn) openWindow(sid uint16) {
+	if e.mux.flowCtl && e.mux.window > STREAM_WINDOW {
+		e.sendCredit(sid, e.mux.window-STREAM_WINDOW)
+	}
+}
+
+func (e *edgeConn) sendCredit(sid uint16, n int) bool {
+	var body = make([]byte, 4)
+	binary.BigEndian.PutUint32(body, uint32(n))
+	// credited before sending, the peer may send as soon as granted
+	atomic.AddInt64(&e.credit, int64(n))
+	if e.signal(FRAME_ACTION_WINDOW, sid, body) {
+		return true
+	}
+	atomic.AddInt64(&e.credit, -int64(n))
+	return false
+}
+
+// charge the data from peer, return false if sent beyond the granted credit.
+// the replayed are not controlled.
+func (e *edgeConn) charge(n int) bool {
+	if !e.mux.flowCtl || e.replay != nil {
+		return true
+	}
+	return atomic.AddInt64(&e.credit, -int64(n)) >= 0
+}
+
+// pause or resume the sending of peer
+func (e *edgeConn) pausePeer(sid uint16, paused bool) {
+	var body = []byte{0}
+	if paused {
+		body[0] = 1
+		atomic.AddInt64(&e.mux.stalls, 1)
+	}
+	e.signal(FRAME_ACTION_SLOWDOWN, sid, body)
+}
+
+// send the control frame of stream to peer
+func (e *edgeConn) signal(action byte, sid uint16, body []byte) bool {
+	tun := e.tun
+	// may be a broken tun
+	if tun == nil || tun.LocalAddr() == nil {
+		tun = e.mux.pool.Select()
+	}
+	return tun != nil && frameWriteBuffer(tun, packFrame(action, sid, body)) == nil
+}
+
 // greater than or equals b
 func (e *edgeConn) closed_gte(b uint32) bool {
 	return atomic.LoadUint32(&e.closed) >= b
@@ -85,6 +177,7 @@ type egressRouter struct {
 	mux             *multiplexer
 	registry        map[string]*edgeConn
 	preRegistry     map[string]*list.List
+	orphans         map[uint16]*edgeConn // edges of broken tunnels in roaming
 	cleanerTicker   *time.Ticker
 	stopCleanerChan chan bool
 }
@@ -94,6 +187,7 @@ func newEgressRouter(mux *multiplexer) *egressRouter {
 		lock:            new(sync.RWMutex),
 		mux:             mux,
 		registry:        make(map[string]*edgeConn),
+		orphans:         make(map[uint16]*edgeConn),
 		cleanerTicker:   time.NewTicker(TICKER_INTERVAL),
 		stopCleanerChan: make(chan bool, 1),
 	}
@@ -160,16 +254,39 @@ func (r *egressRouter) register(key, destination string, tun *Conn, conn net.Con
 	if edge == nil {
 		edge = newEdgeConn(r.mux, key, destination, tun, conn)
 		edge.active = active
+		if r.mux.roam > 0 {
+			edge.replay = new(replayBuffer)
+		}
+		// the replayed and striped are not controlled
+		if r.mux.flowCtl && edge.replay == nil && !(r.mux.isClient && r.mux.multipath) {
+			edge.window = newFlowWindow(STREAM_WINDOW)
+		}
+		edge.credit = STREAM_WINDOW
 		edge.initEqueue()
 		r.registry[key] = edge
+		atomic.AddInt64(&r.mux.streams, 1)
 	}
 	if buffer := r.preRegistry[key]; buffer != nil {
 		delete(r.preRegistry, key)
+		edge.charge(int(queuedBytes(buffer)))
 		edge.queue._push_all(buffer)
 	}
 	return edge
 }
 
+// the alive edges
+func (r *egressRouter) snapshot() []*edgeConn {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+	var edges = make([]*edgeConn, 0, len(r.registry))
+	for _, e := range r.registry {
+		if !e.closed_gte(TCP_CLOSED) {
+			edges = append(edges, e)
+		}
+	}
+	return edges
+}
+
 // destroy whole router
 func (r *egressRouter) destroy() {
 	r.lock.Lock()
@@ -180,11 +297,18 @@ func (r *egressRouter) destroy() {
 			e.queue._push(frm) // wakeup and self-exiting
 		}
 	}
+	for _, e := range r.orphans {
+		e.replay.abort()
+		if e.queue != nil {
+			e.queue._push(frm)
+		}
+	}
 	r.stopCleanTask()
 	r.registry = nil
 }
 
-// remove edges (with queues) were related to the tun
+// remove edges (with queues) were related to the tun,
+// or keep them as orphans for rebinding in roaming.
 func (r *egressRouter) cleanOfTun(tun *Conn) {
 	r.lock.Lock()
 	defer r.lock.Unlock()
@@ -192,6 +316,10 @@ func (r *egressRouter) cleanOfTun(tun *Conn) {
 	var frm = &frame{action: FRAME_ACTION_CLOSE}
 	for k, e := range r.registry {
 		if strings.HasPrefix(k, prefix) {
+			if r.mux.roam > 0 && r.orphan(k, e) {
+				delete(r.registry, k)
+				continue
+			}
 			if e.queue != nil {
 				e.queue._push(frm)
 			} else {
@@ -215,6 +343,9 @@ func (r *egressRouter) cleanTask() {
 			}
 		case <-runCh:
 			r.clean()
+			if grace := r.mux.roam; grace > 0 {
+				r.expireOrphans(grace)
+			}
 		}
 	}
 }
@@ -233,6 +364,10 @@ type equeue struct {
 	lock   sync.Locker
 	cond   *sync.Cond
 	buffer *list.List
+	// bytes of data queued and in sending
+	held    int
+	paused  time.Time // peer was paused at, zero if resumed
+	dropped bool      // over the max or the ceiling then closing
 }
 
 func (edge *edgeConn) initEqueue() *equeue {
@@ -249,16 +384,102 @@ func (edge *edgeConn) initEqueue() *equeue {
 }
 
 func (q *equeue) _push(frm *frame) {
+	var sid, pause = frm.sid, false
+	defer func() {
+		if pause {
+			q.edge.pausePeer(sid, true)
+		}
+	}()
 	q.lock.Lock()
 	defer q.cond.Signal()
 	defer q.lock.Unlock()
 	// push
 	if q.buffer != nil {
+		if q.dropped && len(frm.data) > 0 {
+			frm.free()
+			return
+		}
 		q.buffer.PushBack(frm)
+		q.edge.mux.buffers.add(int64(len(frm.data)))
+		if frm.action == FRAME_ACTION_DATA {
+			atomic.AddInt64(&q.edge.recv, int64(len(frm.data)))
+		}
+		pause = q.hold(len(frm.data))
 	} // else the queue was exited
 }
 
+// account the queued, and return true if peer should be paused. when the
+// buffers of all reach the ceiling, only the streams queued over the low are
+// paused, or dropped if the peer couldn't be paused.
+// must hold the lock
+func (q *equeue) hold(n int) bool {
+	if n == 0 {
+		return false
+	}
+	q.held += n
+	var (
+		flowCtl = q.edge.mux.flowCtl
+		over    = q.held > STREAM_QUEUE_LOW && q.edge.mux.buffers.over()
+	)
+	// the queue is bounded even if the peer couldn't be paused, eg. the
+	// session was paused by admin
+	if !q.dropped && (q.held > STREAM_QUEUE_MAX || !flowCtl && over) {
+		// peer ignored the pausing, then drop the stream
+		q._drop()
+		return false
+	}
+	// refresh the pausing before expired
+	if flowCtl && (q.held >= STREAM_QUEUE_HIGH || over) && time.Since(q.paused) > STREAM_PAUSE_MAX/2 {
+		q.paused = time.Now()
+		return true
+	}
+	return false
+}
+
+// drop the stream of misbehaving peer once, return false if dropped already
+func (q *equeue) drop() bool {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	if q.dropped || q.buffer == nil {
+		return false
+	}
+	q._drop()
+	return true
+}
+
+// drop the stream of misbehaving peer, the later data are discarded.
+// must hold the lock
+func (q *equeue) _drop() {
+	q.dropped = true
+	atomic.AddInt64(&q.edge.mux.drops, 1)
+	if log.V(log.LV_WARN_EDGE) {
+		log.Warningf("Drop %s of queued %s\n", q.edge.dest, i64HumanSize(int64(q.held)))
+	}
+	// the sending fails then notifies peer
+	SafeClose(q.edge.conn)
+}
+
+// the sent was released, then resume peer at the low
+func (q *equeue) release(sid uint16, n int) {
+	q.lock.Lock()
+	q.held -= n
+	var resume = q.edge.mux.flowCtl && !q.paused.IsZero() && q.held <= STREAM_QUEUE_LOW
+	if resume {
+		q.paused = time.Time{}
+	}
+	q.lock.Unlock()
+	if resume {
+		q.edge.pausePeer(sid, false)
+	}
+}
+
 func (q *equeue) _push_all(buffer *list.List) {
+	var sid, pause = uint16(0), false
+	defer func() {
+		if pause {
+			q.edge.pausePeer(sid, true)
+		}
+	}()
 	q.lock.Lock()
 	defer q.cond.Signal()
 	defer q.lock.Unlock()
@@ -269,6 +490,12 @@ func (q *equeue) _push_all(buffer *list.List) {
 			f.conn = q.edge
 			_list.PushBack(f)
 		}
+		q.edge.mux.buffers.add(queuedBytes(buffer))
+		atomic.AddInt64(&q.edge.recv, queuedBytes(buffer))
+		if f := buffer.Front(); f != nil {
+			sid = f.Value.(*frame).sid
+			pause = q.hold(int(queuedBytes(buffer)))
+		}
 	} // else the queue was exited
 }
 
@@ -282,18 +509,25 @@ func (q *equeue) sendLoop() {
 		buffer = q.buffer
 		q.buffer = list.New()
 		q.lock.Unlock()
+		// released after the batch was sent
+		var held = queuedBytes(buffer)
 
 		for item := buffer.Front(); item != nil; item = item.Next() {
 			// send
 			var frm *frame = item.Value.(*frame)
 			switch frm.action {
 			case FRAME_ACTION_CLOSE:
+				q.edge.mux.buffers.add(-held)
 				q._close(true, CLOSED_FORCE)
 				return
 			case FRAME_ACTION_CLOSE_W:
+				q.edge.mux.buffers.add(-held)
+				frm.free()
 				q._close(false, CLOSED_WRITE)
 				return
 			default:
+				// hold frames in pausing
+				q.edge.mux.pauser.wait()
 				werr := sendFrame(frm)
 				if werr {
 					edge := q.edge
@@ -308,14 +542,22 @@ func (q *equeue) sendLoop() {
 							frameWriteHead(tun, frm)
 						}
 					}
+					q.edge.mux.buffers.add(-held)
 					q._close(true, CLOSED_BY_ERR)
 					frm.free()
 					return
 				} else {
+					atomic.AddInt64(&q.edge.mux.rxBytes, int64(frm.length))
+					atomic.AddInt64(&q.edge.rxBytes, int64(frm.length))
+					if frm.action == FRAME_ACTION_DATA && q.edge.mux.flowCtl {
+						q.edge.grantPeer(frm.sid, int(frm.length))
+					}
+					q.release(frm.sid, len(frm.data))
 					frm.free()
 				}
 			}
 		}
+		q.edge.mux.buffers.add(-held)
 	}
 }
 
@@ -331,10 +573,11 @@ func (q *equeue) _close(force bool, close_code uint) {
 		case CLOSED_FORCE:
 			log.Infoln("Close", e.dest)
 		case CLOSED_WRITE:
-			log.Infof("CloseWrite %s by peer\n", e.dest)
+			log.Infof("CloseWrite %s by peer reason=%s\n", e.dest, closeReasonNames[e.closeReason])
 		}
 	}
 
+	e.mux.buffers.add(-queuedBytes(q.buffer))
 	for i, e := q.buffer.Len(), q.buffer.Front(); i > 0; i, e = i-1, e.Next() {
 		f := e.Value.(*frame)
 		if f != nil {
@@ -344,6 +587,8 @@ func (q *equeue) _close(force bool, close_code uint) {
 
 	q.buffer = nil
 	if force {
+		e.window.close()
+		e.stall.set(false)
 		atomic.StoreUint32(&e.closed, TCP_CLOSED)
 		SafeClose(e.conn)
 	} else {
@@ -356,9 +601,14 @@ func sendFrame(frm *frame) bool {
 	if log.V(log.LV_DAT_FRM) {
 		log.Infoln("SEND queue", frm)
 	}
+	var data = frm.data
+	if e := frm.conn; !e.sniffed && e.mux.sniffer != nil {
+		e.sniffed = true
+		data = e.mux.sniffer.inspect(e, data)
+	}
 	dst.SetWriteDeadline(time.Now().Add(GENERAL_SO_TIMEOUT))
-	nw, ew := dst.Write(frm.data)
-	if nw == int(frm.length) && ew == nil {
+	nw, ew := dst.Write(data)
+	if nw == len(data) && ew == nil {
 		return false
 	}
 	// an error occured
@@ -367,3 +617,180 @@ func sendFrame(frm *frame) bool {
 	}
 	return true
 }
+
+// frames in the queue
+func (q *equeue) length() int {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	if q.buffer == nil {
+		return 0
+	}
+	return q.buffer.Len()
+}
+
+func queuedBytes(buffer *list.List) int64 {
+	var n int64
+	for e := buffer.Front(); e != nil; e = e.Next() {
+		if f, y := e.Value.(*frame); y && f != nil {
+			n += int64(len(f.data))
+		}
+	}
+	return n
+}
+
+// -------------------------------
+// bufferMeter
+// -------------------------------
+// account the bytes held in the queues of all edges. the reading from tunnels
+// is never blocked by it, or the pings and the other streams would stall.
+// instead the streams queued over the low are paused or dropped when the
+// usage reaches the ceiling, see equeue.hold.
+// nil meter means unlimited.
+type bufferMeter struct {
+	used int64
+	max  int64
+	lock sync.Mutex
+}
+
+func newBufferMeter(max int64) *bufferMeter {
+	return &bufferMeter{max: max}
+}
+
+func (m *bufferMeter) add(n int64) {
+	if m == nil || n == 0 {
+		return
+	}
+	m.lock.Lock()
+	m.used += n
+	m.lock.Unlock()
+}
+
+// reached the ceiling
+func (m *bufferMeter) over() bool {
+	if m == nil {
+		return false
+	}
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return m.used >= m.max
+}
+
+func (m *bufferMeter) String() string {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return fmt.Sprintf("Buffer=%s/%s", i64HumanSize(m.used), i64HumanSize(m.max))
+}
+
+// -------------------------------
+// flowWindow
+// -------------------------------
+// the credit of sending to a stream, consumed by reading the edge and granted
+// by peer after the data was written to the destination. so a slow destination
+// stalls its own stream only rather than filling the buffers shared by all.
+// nil window means unlimited.
+type flowWindow struct {
+	credit int
+	closed bool
+	lock   sync.Mutex
+	cond   *sync.Cond
+}
+
+func newFlowWindow(credit int) *flowWindow {
+	w := &flowWindow{credit: credit}
+	w.cond = sync.NewCond(&w.lock)
+	return w
+}
+
+// wait for the credit, return the available up to max or 0 if closed
+func (w *flowWindow) acquire(max int) int {
+	if w == nil {
+		return max
+	}
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	for w.credit <= 0 && !w.closed {
+		w.cond.Wait()
+	}
+	if w.closed {
+		return 0
+	}
+	return minInt(w.credit, max)
+}
+
+func (w *flowWindow) consume(n int) {
+	if w == nil {
+		return
+	}
+	w.lock.Lock()
+	w.credit -= n
+	w.lock.Unlock()
+}
+
+func (w *flowWindow) grant(n int) {
+	if w == nil || n <= 0 {
+		return
+	}
+	w.lock.Lock()
+	w.credit += n
+	w.cond.Broadcast()
+	w.lock.Unlock()
+}
+
+// release the waiting
+func (w *flowWindow) close() {
+	if w == nil {
+		return
+	}
+	w.lock.Lock()
+	w.closed = true
+	w.cond.Broadcast()
+	w.lock.Unlock()
+}
+
+// -------------------------------
+// streamStall
+// -------------------------------
+// the sending of stream paused by peer whose consumer is slow, then the edge
+// is not read until resumed or the pausing expired.
+type streamStall struct {
+	lock    sync.Mutex
+	until   time.Time
+	resumed chan bool // closed by resuming, nil if not paused
+}
+
+func (s *streamStall) set(paused bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if paused {
+		if s.resumed == nil {
+			s.resumed = make(chan bool)
+		}
+		s.until = time.Now().Add(STREAM_PAUSE_MAX)
+	} else if s.resumed != nil {
+		close(s.resumed)
+		s.resumed = nil
+	}
+}
+
+// blocking while paused, return true if waited
+func (s *streamStall) wait() bool {
+	s.lock.Lock()
+	var ch, until = s.resumed, s.until
+	s.lock.Unlock()
+	if ch == nil {
+		return false
+	}
+	for d := until.Sub(time.Now()); d > 0; {
+		select {
+		case <-ch:
+			return true
+		case <-time.After(d):
+		}
+		// may be extended
+		s.lock.Lock()
+		d = s.until.Sub(time.Now())
+		s.lock.Unlock()
+	}
+	s.set(false)
+	return true
+}
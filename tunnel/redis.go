@@ -0,0 +1,288 @@
+package tunnel
+
+import (
+	"bufio"
+	"encoding/hex"
+	"io"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Lafeng/deblocus/exception"
+)
+
+const (
+	REDIS_DEFAULT_PORT = "6379"
+	REDIS_IDLE_CONNS   = 8
+	REDIS_TIMEOUT      = time.Second * 2
+	// keys of the shared tokens
+	REDIS_TOKEN_PREFIX = "deblocus:token:"
+	// keys of the spent stateless tokens
+	REDIS_SPENT_PREFIX = "deblocus:spent:"
+)
+
+var (
+	REDIS_ERROR = exception.New("Redis error")
+)
+
+// --------------------
+// redisTokenStore
+// --------------------
+// the TokenStore of redis (6.2+ for GETDEL) in the minimal RESP client, the
+// commands of a call are pipelined in a single round trip.
+// redis://[:password@]host[:port][/db]
+type redisTokenStore struct {
+	addr     string
+	password string
+	db       int
+	idle     chan *redisConn
+}
+
+type redisConn struct {
+	conn net.Conn
+	r    *bufio.Reader
+}
+
+func newRedisTokenStore(uri string) (*redisTokenStore, error) {
+	u, err := url.Parse(uri)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "redis" || u.Host == NULL {
+		return nil, REDIS_ERROR.Apply("incorrect url " + uri)
+	}
+	var st = &redisTokenStore{
+		addr: u.Host,
+		idle: make(chan *redisConn, REDIS_IDLE_CONNS),
+	}
+	if _, _, err = net.SplitHostPort(u.Host); err != nil {
+		st.addr = net.JoinHostPort(u.Host, REDIS_DEFAULT_PORT)
+	}
+	if u.User != nil {
+		st.password, _ = u.User.Password()
+	}
+	if db := strings.Trim(u.Path, "/"); db != NULL {
+		if st.db, err = strconv.Atoi(db); err != nil || st.db < 0 {
+			return nil, REDIS_ERROR.Apply("incorrect db " + db)
+		}
+	}
+	return st, nil
+}
+
+func tokenStoreKey(token []byte) []byte {
+	return []byte(REDIS_TOKEN_PREFIX + hex.EncodeToString(token))
+}
+
+func (st *redisTokenStore) Put(tokens [][]byte, state []byte, ttl time.Duration) error {
+	var (
+		px   = []byte(strconv.FormatInt(int64(ttl/time.Millisecond), 10))
+		cmds = make([][][]byte, len(tokens))
+	)
+	for i, token := range tokens {
+		cmds[i] = [][]byte{[]byte("SET"), tokenStoreKey(token), state, []byte("PX"), px}
+	}
+	_, err := st.call(cmds...)
+	return err
+}
+
+func (st *redisTokenStore) Take(token []byte) ([]byte, error) {
+	replies, err := st.call([][]byte{[]byte("GETDEL"), tokenStoreKey(token)})
+	if err != nil {
+		return nil, err
+	}
+	state, _ := replies[0].([]byte)
+	return state, nil
+}
+
+func (st *redisTokenStore) Get(token []byte) ([]byte, error) {
+	replies, err := st.call([][]byte{[]byte("GET"), tokenStoreKey(token)})
+	if err != nil {
+		return nil, err
+	}
+	state, _ := replies[0].([]byte)
+	return state, nil
+}
+
+// the marks are apart from the states by the prefix
+func (st *redisTokenStore) Spend(token []byte, ttl time.Duration) (bool, error) {
+	var (
+		key = []byte(REDIS_SPENT_PREFIX + hex.EncodeToString(token))
+		px  = []byte(strconv.FormatInt(int64(ttl/time.Millisecond), 10))
+	)
+	replies, err := st.call([][]byte{[]byte("SET"), key, []byte("1"), []byte("PX"), px, []byte("NX")})
+	if err != nil {
+		return false, err
+	}
+	return replies[0] != nil, nil
+}
+
+func (st *redisTokenStore) Drop(tokens [][]byte) error {
+	if len(tokens) == 0 {
+		return nil
+	}
+	var cmd = [][]byte{[]byte("DEL")}
+	for _, token := range tokens {
+		cmd = append(cmd, tokenStoreKey(token))
+	}
+	_, err := st.call(cmd)
+	return err
+}
+
+func (st *redisTokenStore) Close() error {
+	for {
+		select {
+		case c := <-st.idle:
+			c.conn.Close()
+		default:
+			return nil
+		}
+	}
+}
+
+// the replies of pipelined commands, the error reply fails the call
+func (st *redisTokenStore) call(cmds ...[][]byte) ([]interface{}, error) {
+	c, err := st.get()
+	if err != nil {
+		return nil, err
+	}
+	c.conn.SetDeadline(time.Now().Add(REDIS_TIMEOUT))
+	replies, err := c.pipeline(cmds...)
+	if err != nil {
+		// the stream may be out of sync
+		c.conn.Close()
+		return nil, err
+	}
+	for _, r := range replies {
+		if e, y := r.(error); y {
+			st.put(c)
+			return nil, e
+		}
+	}
+	st.put(c)
+	return replies, nil
+}
+
+func (st *redisTokenStore) get() (*redisConn, error) {
+	select {
+	case c := <-st.idle:
+		return c, nil
+	default:
+	}
+	conn, err := net.DialTimeout("tcp", st.addr, REDIS_TIMEOUT)
+	if err != nil {
+		return nil, err
+	}
+	var c = &redisConn{conn: conn, r: bufio.NewReader(conn)}
+	var init [][][]byte
+	if st.password != NULL {
+		init = append(init, [][]byte{[]byte("AUTH"), []byte(st.password)})
+	}
+	if st.db > 0 {
+		init = append(init, [][]byte{[]byte("SELECT"), []byte(strconv.Itoa(st.db))})
+	}
+	if len(init) > 0 {
+		conn.SetDeadline(time.Now().Add(REDIS_TIMEOUT))
+		replies, err := c.pipeline(init...)
+		if err == nil {
+			for _, r := range replies {
+				if e, y := r.(error); y {
+					err = e
+				}
+			}
+		}
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+func (st *redisTokenStore) put(c *redisConn) {
+	select {
+	case st.idle <- c:
+	default:
+		c.conn.Close()
+	}
+}
+
+func (c *redisConn) pipeline(cmds ...[][]byte) ([]interface{}, error) {
+	var buf []byte
+	for _, args := range cmds {
+		buf = append(buf, '*')
+		buf = strconv.AppendInt(buf, int64(len(args)), 10)
+		buf = append(buf, "\r\n"...)
+		for _, arg := range args {
+			buf = append(buf, '$')
+			buf = strconv.AppendInt(buf, int64(len(arg)), 10)
+			buf = append(buf, "\r\n"...)
+			buf = append(buf, arg...)
+			buf = append(buf, "\r\n"...)
+		}
+	}
+	if _, err := c.conn.Write(buf); err != nil {
+		return nil, err
+	}
+	var replies = make([]interface{}, len(cmds))
+	for i := range replies {
+		r, err := c.readReply()
+		if err != nil {
+			return nil, err
+		}
+		replies[i] = r
+	}
+	return replies, nil
+}
+
+// string of status, int64, []byte of bulk or nil, []interface{}, or error
+func (c *redisConn) readReply() (interface{}, error) {
+	line, err := c.r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	if len(line) < 3 || line[len(line)-2] != '\r' {
+		return nil, REDIS_ERROR.Apply("malformed reply")
+	}
+	var body = line[1 : len(line)-2]
+	switch line[0] {
+	case '+':
+		return body, nil
+	case '-':
+		return REDIS_ERROR.Apply(body), nil
+	case ':':
+		n, err := strconv.ParseInt(body, 10, 64)
+		if err != nil {
+			return nil, REDIS_ERROR.Apply("malformed integer")
+		}
+		return n, nil
+	case '$':
+		n, err := strconv.Atoi(body)
+		if err != nil || n < -1 {
+			return nil, REDIS_ERROR.Apply("malformed bulk")
+		} else if n == -1 {
+			return nil, nil
+		}
+		var data = make([]byte, n+2)
+		if _, err = io.ReadFull(c.r, data); err != nil {
+			return nil, err
+		}
+		return data[:n], nil
+	case '*':
+		n, err := strconv.Atoi(body)
+		if err != nil || n < -1 {
+			return nil, REDIS_ERROR.Apply("malformed array")
+		}
+		var list []interface{}
+		for i := 0; i < n; i++ {
+			r, err := c.readReply()
+			if err != nil {
+				return nil, err
+			}
+			list = append(list, r)
+		}
+		return list, nil
+	}
+	return nil, REDIS_ERROR.Apply("unknown reply " + line[:1])
+}
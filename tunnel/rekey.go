@@ -0,0 +1,148 @@
+package tunnel
+
+import (
+	"strings"
+	"sync/atomic"
+	"time"
+
+	log "github.com/Lafeng/deblocus/glog"
+)
+
+const (
+	REKEY_SEED_LEN     = 32
+	REKEY_BYTES_MIN    = 1 << 20
+	REKEY_INTERVAL_MIN = time.Minute
+)
+
+// --------------------
+// rekey
+// --------------------
+// each side rotates the key of its writing direction of tunnel after the
+// traffic or the period of policy: sends REKEY with a random seed in the old
+// key, then switches to the cipher derived from the key of session and the
+// seed. the peer switches its reading at the frame, so the streams are not
+// interrupted.
+// the kits of which the directions could be rotated independently only,
+// eg. the stream ciphers and AEAD.
+
+type rekeyCipherKit interface {
+	rekey(fresh cipherKit, write bool)
+}
+
+// the bytes and period of a key, eg. 1G,30m
+type rekeyPolicy struct {
+	bytes    int64
+	interval time.Duration
+}
+
+func parseRekeyPolicy(s string) (*rekeyPolicy, error) {
+	var p = new(rekeyPolicy)
+	for _, item := range strings.Split(s, ",") {
+		item = strings.TrimSpace(item)
+		if d, e := time.ParseDuration(item); e == nil {
+			if d < REKEY_INTERVAL_MIN || p.interval > 0 {
+				return nil, CONF_ERROR.Apply("Rekey")
+			}
+			p.interval = d
+		} else if n, e := parseHumanSize(item); e == nil {
+			if n < REKEY_BYTES_MIN || p.bytes > 0 {
+				return nil, CONF_ERROR.Apply("Rekey")
+			}
+			p.bytes = n
+		} else {
+			return nil, CONF_ERROR.Apply("Rekey")
+		}
+	}
+	return p, nil
+}
+
+// the writing of tunnel with the current key
+type rekeyState struct {
+	policy *rekeyPolicy
+	bytes  int64
+	since  time.Time
+	rotate bool // the tun is replaced rather than rekeyed
+}
+
+func newRekeyState(p *rekeyPolicy) *rekeyState {
+	return &rekeyState{policy: p, since: time.Now()}
+}
+
+func (r *rekeyState) due(wrote int) bool {
+	r.bytes += int64(wrote)
+	p := r.policy
+	return p.bytes > 0 && r.bytes >= p.bytes ||
+		p.interval > 0 && time.Since(r.since) >= p.interval
+}
+
+// the cipher of the seed, the seed is mixed into the key as well as the iv
+// which may be shorter.
+func (c *CipherFactory) rekeyCipher(seed []byte) cipherKit {
+	f := &CipherFactory{normalizeKey(len(c.key), c.key, seed), c.decr, c.name}
+	defer f.Cleanup()
+	return f.InitCipher(seed)
+}
+
+// send REKEY then switch the writing, in the lock of writer after a frame.
+// the tun is marked to be rotated by client if the peer couldn't rekey.
+func (c *Conn) rekeyWrite() error {
+	if c.rekey.rotate {
+		atomic.CompareAndSwapInt32(&c.rotate, 0, 1)
+		c.rekey = nil
+		return nil
+	}
+	kit, y := c.cipher.(rekeyCipherKit)
+	if !y || c.cf == nil {
+		c.rekey = nil // eg. NULL
+		return nil
+	}
+	var (
+		seed = randArray(REKEY_SEED_LEN)
+		buf  = make([]byte, FRAME_HEADER_LEN+REKEY_SEED_LEN)
+	)
+	pack(buf, FRAME_ACTION_REKEY, 0, seed)
+	if _, err := c.write(c.transformFrame(buf)); err != nil {
+		return err
+	}
+	kit.rekey(c.cf.rekeyCipher(seed), true)
+	if log.V(log.LV_ACT_FRM) {
+		log.Infof("Rekeyed tun (%s) after bytes=%d", c.identifier, c.rekey.bytes)
+	}
+	c.rekey = newRekeyState(c.rekey.policy)
+	return nil
+}
+
+// switch the reading at the REKEY of peer
+func (c *Conn) rekeyRead(seed []byte) error {
+	kit, y := c.cipher.(rekeyCipherKit)
+	if !y || c.cf == nil || len(seed) != REKEY_SEED_LEN {
+		return ILLEGAL_STATE.Apply("rekey")
+	}
+	kit.rekey(c.cf.rekeyCipher(seed), false)
+	return nil
+}
+
+// swap the stream of direction, then release the old one and the unused one
+func (c *XORCipherKit) rekey(fresh cipherKit, write bool) {
+	f := fresh.(*XORCipherKit)
+	if write {
+		c.enc, f.enc = f.enc, c.enc
+	} else {
+		c.dec, f.dec = f.dec, c.dec
+	}
+	f.Cleanup()
+}
+
+// the next record of direction begins with the new salt
+func (c *aeadCipherKit) rekey(fresh cipherKit, write bool) {
+	f := fresh.(*aeadCipherKit)
+	if write {
+		c.wkey, f.wkey = f.wkey, c.wkey
+		c.sealer = nil
+	} else {
+		c.rkey, f.rkey = f.rkey, c.rkey
+		c.opener, c.rnonce = nil, nil
+		c.rbuf, c.filled, c.plen = make([]byte, AEAD_SALT_LEN), 0, -1
+	}
+	f.Cleanup()
+}
@@ -0,0 +1,138 @@
+package tunnel
+
+import (
+	"bytes"
+	"io"
+	"testing"
+	"time"
+)
+
+func TestParseRekeyPolicy(t *testing.T) {
+	for s, expected := range map[string]rekeyPolicy{
+		"1G,30m": {1 << 30, 30 * time.Minute},
+		"2h":     {0, 2 * time.Hour},
+		" 512M ": {512 << 20, 0},
+	} {
+		if p, e := parseRekeyPolicy(s); e != nil || *p != expected {
+			t.Errorf("%s: %+v %v", s, p, e)
+		}
+	}
+	for _, s := range []string{"", "1K", "10s", "1G,2G", "1h,2h", "1G;1h", "x"} {
+		if _, e := parseRekeyPolicy(s); e == nil {
+			t.Errorf("accepted %q", s)
+		}
+	}
+}
+
+// read the frames of DATA and switch the reading at REKEY as multiplexer
+func readRekeyedFrames(t *testing.T, tun *Conn, n int) (data []byte, rekeys int) {
+	header := make([]byte, FRAME_HEADER_LEN)
+	for n > 0 {
+		if _, err := io.ReadFull(tun, header); err != nil {
+			t.Fatal(err)
+		}
+		frm, err := parse_frame(header)
+		if err == nil && len(frm.data) > 0 {
+			_, err = io.ReadFull(tun, frm.data)
+			frm.data = frm.data[:frm.length]
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		switch frm.action {
+		case FRAME_ACTION_REKEY:
+			if err = tun.rekeyRead(frm.data); err != nil {
+				t.Fatal(err)
+			}
+			rekeys++
+		case FRAME_ACTION_DATA:
+			data = append(data, frm.data...)
+			n--
+		}
+	}
+	return
+}
+
+func TestRekeyConn(t *testing.T) {
+	for _, name := range []string{"AES128CTR", "CHACHA20-POLY1305", "AES256GCM", CIPHER_NULL} {
+		var (
+			cf   = NewCipherFactory(name, []byte("secret"))
+			iv   = []byte("0123456789abcdef")
+			sent = randArray(8 * 200)
+			done = make(chan bool)
+		)
+		c, s := tcpPair(t)
+		client, server := NewConn(c, nil), NewConn(s, nil)
+		client.SetupCipher(cf, iv)
+		server.SetupCipher(cf, iv)
+		client.rekey = newRekeyState(&rekeyPolicy{bytes: 600})
+		go func() {
+			defer close(done)
+			for i := 0; i < 8; i++ {
+				if i == 6 && client.rekey != nil {
+					// by the period
+					client.rekey.since = time.Now().Add(-time.Hour)
+					client.rekey.policy = &rekeyPolicy{interval: time.Minute}
+				}
+				frameWriteBuffer(client, packFrame(FRAME_ACTION_DATA, 1, sent[i*200:(i+1)*200]))
+			}
+		}()
+		data, rekeys := readRekeyedFrames(t, server, 8)
+		<-done
+		if !bytes.Equal(data, sent) {
+			t.Errorf("%s: received mismatched data", name)
+		}
+		if name == CIPHER_NULL {
+			if rekeys != 0 || client.rekey != nil {
+				t.Errorf("%s: rekeys=%d", name, rekeys)
+			}
+		} else if rekeys != 3 {
+			t.Errorf("%s: rekeys=%d", name, rekeys)
+		}
+		// the other direction kept its key
+		if name != CIPHER_NULL {
+			go frameWriteBuffer(server, packFrame(FRAME_ACTION_DATA, 1, []byte("reply")))
+			if data, _ = readRekeyedFrames(t, client, 1); string(data) != "reply" {
+				t.Errorf("%s: received %q", name, data)
+			}
+		}
+		c.Close()
+		s.Close()
+	}
+}
+
+// the tun is rotated by client if the peer couldn't rekey
+func TestRotateConn(t *testing.T) {
+	var (
+		mux     = newClientMultiplexer()
+		rotated = make(chan *Conn, 1)
+		handler = func(e event, msg ...interface{}) {
+			if e == evt_rotate && msg[0] == mux {
+				rotated <- msg[1].(*Conn)
+			}
+		}
+	)
+	c, s := tcpPair(t)
+	defer s.Close()
+	defer mux.destroy()
+	mux.rotate = &rekeyPolicy{bytes: 100}
+	tun := NewConn(c, nullCipherKit)
+	go mux.Listen(tun, handler, 0)
+	for tun.rekey == nil {
+		time.Sleep(10 * time.Millisecond)
+	}
+	frameWriteBuffer(tun, packFrame(FRAME_ACTION_DATA, 1, make([]byte, 200)))
+	if tun.rekey != nil || tun.rotate != 1 {
+		t.Fatalf("not marked to be rotated rotate=%d", tun.rotate)
+	}
+	// the reading round notices the client
+	frameWriteBuffer(NewConn(s, nullCipherKit), packFrame(FRAME_ACTION_PING, 0, nil))
+	select {
+	case r := <-rotated:
+		if r != tun {
+			t.Errorf("rotated the other tun")
+		}
+	case <-time.After(time.Second * 2):
+		t.Errorf("not rotated")
+	}
+}
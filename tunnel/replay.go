@@ -0,0 +1,63 @@
+package tunnel
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	log "github.com/Lafeng/deblocus/glog"
+	"github.com/cloudflare/golibs/lrucache"
+)
+
+const (
+	REPLAY_CACHE_MAX = 1 << 16
+)
+
+// --------------------
+// replayFilter
+// --------------------
+// the hello of client is stamped by the time counter and the random of
+// part-1 as nonce under the siphash, so each one is unique and valid in the
+// window of tolerance. the sums seen in window are kept, then a captured
+// handshake replayed by the on-path prober is treated as unrecognized
+// request without the error feedback.
+type replayFilter struct {
+	replayed int64
+	cache    *lrucache.LRUCache
+	ttl      time.Duration
+	lock     sync.Mutex
+}
+
+// the hello stamped with the last counter of window expires after the
+// tolerance steps and the current one.
+func newReplayFilter(toleranceSteps int) *replayFilter {
+	return &replayFilter{
+		cache: lrucache.NewLRUCache(REPLAY_CACHE_MAX),
+		ttl:   time.Duration(2*toleranceSteps+2) * TIME_STEP * time.Second,
+	}
+}
+
+// return true if the sum of hello was seen in window
+func (f *replayFilter) seen(sum []byte, client net.Addr) bool {
+	if f == nil {
+		return false
+	}
+	var key, now = string(sum), time.Now()
+	f.lock.Lock()
+	_, y := f.cache.GetNotStale(key)
+	if !y {
+		f.cache.Set(key, true, now.Add(f.ttl))
+	}
+	f.lock.Unlock()
+	if y {
+		atomic.AddInt64(&f.replayed, 1)
+		log.Warningf("Replayed hello from=%s", client)
+	}
+	return y
+}
+
+func (f *replayFilter) String() string {
+	return fmt.Sprintf("Replayed-hellos=%d", atomic.LoadInt64(&f.replayed))
+}
@@ -0,0 +1,68 @@
+package tunnel
+
+import (
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/Lafeng/deblocus/crypto"
+)
+
+func TestReplayFilter(t *testing.T) {
+	var (
+		f      = newReplayFilter(TIME_ERROR)
+		client = &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 1}
+	)
+	if f.seen([]byte("sum-1"), client) || f.seen([]byte("sum-2"), client) {
+		t.Fatalf("fresh sums were seen")
+	}
+	if !f.seen([]byte("sum-1"), client) {
+		t.Errorf("replayed sum was not seen")
+	}
+	if s := f.String(); !strings.Contains(s, "Replayed-hellos=1") {
+		t.Errorf("unexpected stats %s", s)
+	}
+	var nilFilter *replayFilter
+	if nilFilter.seen([]byte("sum-1"), client) {
+		t.Errorf("seen by nil filter")
+	}
+}
+
+// the captured initial bytes of client are refused at the second time
+// without the error feedback
+func TestReplayedHandshake(t *testing.T) {
+	serv := newHandshakeServer(t)
+	serv.errFeedback = true
+	serv.replays = newReplayFilter(TIME_ERROR)
+	dhKey, _ := crypto.NewDHKey(DH_METHOD)
+	w := newMsgWriter().WriteMsg(makeDbcHello(TYPE_NEWX, serv.sharedKey))
+	w.WriteL2Msg(dhKey.ExportPubKey()).WriteL1Msg(offerCipherSuites(allSuites, false))
+	captured := append([]byte(nil), w.buf.Bytes()...)
+
+	for i := 0; i < 2; i++ {
+		var (
+			c, s = tcpPair(t)
+			sman = &d5sman{Server: serv, clientAddr: c.LocalAddr()}
+			done = make(chan error, 1)
+		)
+		go func() {
+			_, err := sman.Connect(NewConn(s, nullCipherKit), calculateTimeCounter(true))
+			s.Close()
+			done <- err
+		}()
+		c.Write(captured)
+		// the dh reply or closed
+		nr, _ := c.Read(make([]byte, 1))
+		c.Close()
+		err := <-done
+		if i == 0 && nr == 0 {
+			t.Errorf("the original was refused %v", err)
+		}
+		if i == 1 && (nr > 0 || err != UNRECOGNIZED_REQ) {
+			t.Errorf("the replayed got reply=%d err=%v", nr, err)
+		}
+	}
+	if n := serv.replays.replayed; n != 1 {
+		t.Errorf("replayed=%d", n)
+	}
+}
@@ -0,0 +1,383 @@
+package tunnel
+
+import (
+	"encoding/binary"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	log "github.com/Lafeng/deblocus/glog"
+)
+
+const (
+	// the last sent bytes of stream kept for replaying after rebinding,
+	// the stream is aborted if more were lost with the broken tunnel.
+	ROAM_REPLAY_WINDOW = 256 << 10
+	// body of REBIND: received(8) + closeW(1)
+	ROAM_REBIND_LEN = 9
+)
+
+// --------------------
+// roaming
+// --------------------
+// the streams of a broken tunnel are orphaned instead of being closed, the
+// client re-attaches to the session by a resumption token when its address
+// changed, then rebinds the orphans to the fresh tunnel with REBIND:
+//   client: REBIND sid received closeW -> server
+//   server: REBIND sid received closeW -> client, or REBIND_N if unknown
+// both sides replay the sent bytes which the peer did not receive, and
+// resend CLOSE_W if it was lost. the writing of stream is suspended from
+// the tunnel was broken until the stream was rebound or expired in grace.
+
+type replayBuffer struct {
+	lock    sync.Mutex
+	buf     []byte // ring of the last sent bytes
+	head    int    // the oldest byte in full ring
+	total   int64  // sent bytes of stream
+	fin     bool   // CLOSE_W was sent
+	reason  byte
+	since   int64         // unixnano of orphaned
+	rebound chan struct{} // closed on rebinding
+	aborted bool
+}
+
+// record the bytes to send with lock held
+func (r *replayBuffer) write(b []byte) {
+	r.total += int64(len(b))
+	for len(b) > 0 {
+		var n int
+		if len(r.buf) < ROAM_REPLAY_WINDOW {
+			n = minInt(len(b), ROAM_REPLAY_WINDOW-len(r.buf))
+			r.buf = append(r.buf, b[:n]...)
+		} else {
+			n = copy(r.buf[r.head:], b)
+			r.head = (r.head + n) % ROAM_REPLAY_WINDOW
+		}
+		b = b[n:]
+	}
+}
+
+// the last n bytes with lock held, nil if they were overwritten
+func (r *replayBuffer) tail(n int64) []byte {
+	if n > int64(len(r.buf)) || n < 0 {
+		return nil
+	}
+	var b = make([]byte, 0, n)
+	if n == 0 {
+		return b
+	}
+	if len(r.buf) < ROAM_REPLAY_WINDOW {
+		return append(b, r.buf[len(r.buf)-int(n):]...)
+	}
+	start := (r.head - int(n) + ROAM_REPLAY_WINDOW) % ROAM_REPLAY_WINDOW
+	if start < r.head {
+		return append(b, r.buf[start:r.head]...)
+	}
+	b = append(b, r.buf[start:]...)
+	return append(b, r.buf[:r.head]...)
+}
+
+// stop writing until rebound
+func (r *replayBuffer) suspend() {
+	r.lock.Lock()
+	if r.rebound == nil && !r.aborted {
+		r.rebound = make(chan struct{})
+	}
+	r.lock.Unlock()
+}
+
+func (r *replayBuffer) resume() {
+	r.lock.Lock()
+	if r.rebound != nil {
+		close(r.rebound)
+		r.rebound = nil
+	}
+	r.lock.Unlock()
+}
+
+func (r *replayBuffer) abort() {
+	r.lock.Lock()
+	r.aborted = true
+	r.lock.Unlock()
+	r.resume()
+}
+
+// wait for rebinding if suspended, return false if aborted or expired
+func (r *replayBuffer) await(timeout time.Duration) bool {
+	r.lock.Lock()
+	ch, aborted := r.rebound, r.aborted
+	r.lock.Unlock()
+	if ch != nil && !aborted {
+		select {
+		case <-ch:
+		case <-time.After(timeout):
+			return false
+		}
+		r.lock.Lock()
+		aborted = r.aborted
+		r.lock.Unlock()
+	}
+	return !aborted
+}
+
+// the sid of key: identifier.sid
+func keySid(key string) (uint16, bool) {
+	i := strings.LastIndexAny(key, "._")
+	if i < 0 {
+		return 0, false
+	}
+	sid, err := strconv.ParseUint(key[i+1:], 10, 16)
+	return uint16(sid), err == nil
+}
+
+// --------------------
+// orphans of router
+// --------------------
+
+// keep the edge of broken tunnel with lock held
+func (r *egressRouter) orphan(key string, e *edgeConn) bool {
+	sid, y := keySid(key)
+	if !y || e.replay == nil || e.closed_gte(TCP_CLOSED) {
+		return false
+	}
+	atomic.StoreInt64(&e.replay.since, time.Now().UnixNano())
+	e.replay.suspend()
+	r.orphans[sid] = e
+	return true
+}
+
+// client: the orphans are rebound to the tunnel
+func (r *egressRouter) takeOrphans(tun *Conn) map[uint16]*edgeConn {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	var taken = r.orphans
+	r.orphans = make(map[uint16]*edgeConn)
+	for sid, e := range taken {
+		e.key = sessionKey(tun, sid)
+		r.registry[e.key] = e
+	}
+	return taken
+}
+
+// server: take the orphan or the edge of another tunnel which may be
+// broken without being aware of it, then rebind it to the tunnel.
+func (r *egressRouter) adopt(sid uint16, tun *Conn) *edgeConn {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	var (
+		key = sessionKey(tun, sid)
+		e   = r.orphans[sid]
+	)
+	if e != nil {
+		delete(r.orphans, sid)
+	} else {
+		for k, edge := range r.registry {
+			if s, y := keySid(k); y && s == sid && k != key && edge.replay != nil {
+				delete(r.registry, k)
+				e = edge
+				break
+			}
+		}
+	}
+	if e != nil {
+		e.key = key
+		r.registry[key] = e
+	}
+	return e
+}
+
+// close the edge which could not be rebound
+func (r *egressRouter) abandon(e *edgeConn) {
+	r.lock.Lock()
+	if r.registry[e.key] == e {
+		delete(r.registry, e.key)
+	}
+	for sid, o := range r.orphans {
+		if o == e {
+			delete(r.orphans, sid)
+		}
+	}
+	r.lock.Unlock()
+	e.replay.abort()
+	if e.queue != nil {
+		e.queue._push(&frame{action: FRAME_ACTION_CLOSE})
+	} else {
+		SafeClose(e.conn)
+	}
+}
+
+// unixnano of the oldest orphan, or 0 if none
+func (r *egressRouter) orphanedSince() int64 {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+	var since int64
+	for _, e := range r.orphans {
+		if t := atomic.LoadInt64(&e.replay.since); since == 0 || t < since {
+			since = t
+		}
+	}
+	return since
+}
+
+// abandon the orphans exceeded the grace
+func (r *egressRouter) expireOrphans(grace time.Duration) {
+	var expired []*edgeConn
+	var deadline = time.Now().Add(-grace).UnixNano()
+	r.lock.RLock()
+	for _, e := range r.orphans {
+		if atomic.LoadInt64(&e.replay.since) < deadline {
+			expired = append(expired, e)
+		}
+	}
+	r.lock.RUnlock()
+	for _, e := range expired {
+		if log.V(log.LV_REQ) {
+			log.Infoln("Orphaned stream was expired", e.dest)
+		}
+		r.abandon(e)
+	}
+}
+
+// --------------------
+// rebinding
+// --------------------
+
+// write the data frame of edge, wait for rebinding if the tunnel was broken
+func (p *multiplexer) roamWrite(edge *edgeConn, buf []byte, prio int) bool {
+	var r = edge.replay
+	if !r.await(p.roam) {
+		return false
+	}
+	r.lock.Lock()
+	r.write(buf[FRAME_HEADER_LEN:])
+	var tun = edge.tun
+	var err = frameWritePriority(tun, buf, prio)
+	r.lock.Unlock()
+	if err != nil {
+		SafeClose(tun)
+		// the lost will be replayed after rebinding
+		r.suspend()
+		return r.await(p.roam)
+	}
+	return true
+}
+
+// send CLOSE_W, or resend it after rebinding if suspended
+func (p *multiplexer) roamClose(edge *edgeConn, sid uint16, reason byte) {
+	var r = edge.replay
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.fin, r.reason = true, reason
+	if r.rebound == nil {
+		frameWriteBuffer(edge.tun, packFrame(FRAME_ACTION_CLOSE_W, sid, []byte{reason}))
+	}
+}
+
+// client: rebind the orphans to the fresh tunnel
+func (p *multiplexer) rebindOrphans(tun *Conn) {
+	for sid, edge := range p.router.takeOrphans(tun) {
+		var r = edge.replay
+		r.lock.Lock()
+		edge.tun = tun
+		r.lock.Unlock()
+		if log.V(log.LV_REQ) {
+			log.Infof("Rebinding %s to %s\n", edge.dest, tun.identifier)
+		}
+		if frameWriteBuffer(tun, packFrame(FRAME_ACTION_REBIND, sid, rebindBody(edge))) != nil {
+			// orphaned again with the tunnel
+			return
+		}
+	}
+}
+
+// REBIND or REBIND_N from peer
+func (p *multiplexer) onRebind(frm *frame, tun *Conn) {
+	defer frm.free()
+	var (
+		edge   *edgeConn
+		router = p.router
+		sid    = frm.sid
+	)
+	switch {
+	case frm.action == FRAME_ACTION_REBIND_N:
+		if edge, _ = router.getRegistered(sessionKey(tun, sid)); edge != nil && edge.replay != nil {
+			router.abandon(edge)
+		}
+		return
+	case p.isClient:
+		edge, _ = router.getRegistered(sessionKey(tun, sid))
+	case p.roam > 0:
+		edge = router.adopt(sid, tun)
+	}
+	if edge == nil || edge.replay == nil || len(frm.data) < ROAM_REBIND_LEN {
+		if edge != nil && edge.replay != nil {
+			router.abandon(edge)
+		}
+		frameWriteBuffer(tun, packFrame(FRAME_ACTION_REBIND_N, sid, nil))
+		return
+	}
+	var (
+		r        = edge.replay
+		received = int64(binary.BigEndian.Uint64(frm.data))
+		closeW   = frm.data[8] != 0
+		replayed bool
+	)
+	r.lock.Lock()
+	edge.tun = tun
+	if p.isClient || frameWriteBuffer(tun, packFrame(FRAME_ACTION_REBIND, sid, rebindBody(edge))) == nil {
+		replayed = p.replay(edge, tun, sid, received, closeW)
+	}
+	r.lock.Unlock()
+	if replayed {
+		r.resume()
+		if log.V(log.LV_REQ) {
+			log.Infof("Stream %s was rebound to %s\n", edge.dest, tun.identifier)
+		}
+	} else {
+		log.Warningf("Stream %s was lost in roaming\n", edge.dest)
+		router.abandon(edge)
+		frameWriteBuffer(tun, packFrame(FRAME_ACTION_REBIND_N, sid, nil))
+	}
+}
+
+// resend the bytes lost by peer and CLOSE_W with lock held
+func (p *multiplexer) replay(edge *edgeConn, tun *Conn, sid uint16, received int64, closeW bool) bool {
+	var r = edge.replay
+	var lost = r.tail(r.total - received)
+	if lost == nil {
+		return false
+	}
+	var chunk = FRAME_MAX_LEN - FRAME_HEADER_LEN
+	if p.frames != nil {
+		chunk = minInt(chunk, p.frames.max)
+	}
+	for len(lost) > 0 {
+		n := minInt(len(lost), chunk)
+		if frameWriteBuffer(tun, packFrame(FRAME_ACTION_DATA, sid, lost[:n])) != nil {
+			return false
+		}
+		lost = lost[n:]
+	}
+	if r.fin && !closeW {
+		return frameWriteBuffer(tun, packFrame(FRAME_ACTION_CLOSE_W, sid, []byte{r.reason})) == nil
+	}
+	return true
+}
+
+// received bytes and whether CLOSE_W was received
+func rebindBody(edge *edgeConn) []byte {
+	var body = make([]byte, ROAM_REBIND_LEN)
+	binary.BigEndian.PutUint64(body, uint64(atomic.LoadInt64(&edge.recv)))
+	if atomic.LoadUint32(&edge.closed)&TCP_CLOSE_W != 0 {
+		body[8] = 1
+	}
+	return body
+}
+
+func packFrame(action byte, sid uint16, body []byte) []byte {
+	var buf = make([]byte, FRAME_HEADER_LEN+len(body))
+	pack(buf, action, sid, body)
+	return buf
+}
@@ -0,0 +1,115 @@
+package tunnel
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestReplayBuffer(t *testing.T) {
+	var (
+		r    = new(replayBuffer)
+		data = randArray(ROAM_REPLAY_WINDOW + 1000)
+	)
+	r.write(data[:100])
+	if !bytes.Equal(r.tail(60), data[40:100]) || r.tail(101) != nil {
+		t.Fatalf("tail before full")
+	}
+	for i := 100; i < len(data); i += 7000 {
+		r.write(data[i:minInt(i+7000, len(data))])
+	}
+	if r.total != int64(len(data)) || len(r.buf) != ROAM_REPLAY_WINDOW {
+		t.Fatalf("total=%d buf=%d", r.total, len(r.buf))
+	}
+	for _, n := range []int{0, 500, 1000, 5000, ROAM_REPLAY_WINDOW} {
+		if !bytes.Equal(r.tail(int64(n)), data[len(data)-n:]) {
+			t.Errorf("tail %d mismatched", n)
+		}
+	}
+	if r.tail(ROAM_REPLAY_WINDOW+1) != nil {
+		t.Errorf("overwritten bytes were replayed")
+	}
+}
+
+// the tunnel was broken then the stream was rebound to a fresh tunnel
+func TestRoamingRebind(t *testing.T) {
+	var (
+		client = newClientMultiplexer()
+		server = newServerMultiplexer()
+	)
+	client.roam, server.roam = time.Second*5, time.Second*5
+	defer client.destroy()
+	defer server.destroy()
+	var attach = func() (net.Conn, net.Conn) {
+		c, s := tcpPair(t)
+		ctun, stun := NewConn(c, nullCipherKit), NewConn(s, nullCipherKit)
+		ctun.SetId(NULL, false)
+		stun.SetId("user", true)
+		go server.Listen(stun, nil, 0)
+		go client.Listen(ctun, nil, 0)
+		return c, s
+	}
+	c, s := attach()
+
+	dest, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dest.Close()
+	go func() {
+		conn, err := dest.Accept()
+		if err == nil {
+			io.Copy(conn, conn)
+			conn.Close()
+		}
+	}()
+	for client.pool.Len() == 0 {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	app, req := tcpPair(t)
+	defer app.Close()
+	go client.HandleRequest("T", req, dest.Addr().String())
+	var echo = func(size int) {
+		data := randArray(size)
+		go app.Write(data)
+		buf := make([]byte, size)
+		app.SetReadDeadline(time.Now().Add(GENERAL_SO_TIMEOUT))
+		if _, err := io.ReadFull(app, buf); err != nil {
+			t.Fatal(size, err)
+		}
+		if !bytes.Equal(data, buf) {
+			t.Fatalf("size=%d echo mismatched", size)
+		}
+	}
+	echo(FRAME_MAX_LEN * 4)
+
+	// the address was changed
+	c.Close()
+	s.Close()
+	for client.pool.Len() > 0 || server.pool.Len() > 0 {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if client.router.orphanedSince() == 0 || server.router.orphanedSince() == 0 {
+		t.Fatalf("streams were not orphaned")
+	}
+	attach()
+	echo(FRAME_MAX_LEN * 4)
+	if client.router.orphanedSince() != 0 || server.router.orphanedSince() != 0 {
+		t.Errorf("orphans were not rebound")
+	}
+
+	// expired in grace
+	attach()
+	for client.pool.Len() < 2 {
+		time.Sleep(10 * time.Millisecond)
+	}
+	client.router.cleanOfTun(client.pool.Select())
+	client.router.expireOrphans(0)
+	app.SetReadDeadline(time.Now().Add(GENERAL_SO_TIMEOUT))
+	if _, err = app.Read(make([]byte, 1)); err == nil {
+		t.Errorf("expired stream was alive")
+	}
+}
@@ -0,0 +1,124 @@
+package tunnel
+
+import (
+	"net"
+	"strings"
+
+	"github.com/Lafeng/deblocus/exception"
+)
+
+const (
+	// user attribute, value: <CIDR|default> <interface|source-ip>
+	UA_ROUTE      = "route"
+	ROUTE_DEFAULT = "default"
+)
+
+var (
+	INVALID_ROUTE = exception.New("Invalid route")
+)
+
+// --------------------
+// egressRoute
+// --------------------
+type egressRoute struct {
+	network *net.IPNet // nil for default route
+	source  net.IP     // fixed source address
+	iface   string     // or use an address of the interface
+}
+
+// select the source address of egress for the destination
+func (r *egressRoute) localAddr(dst net.IP) (*net.TCPAddr, error) {
+	if r.source != nil {
+		return &net.TCPAddr{IP: r.source}, nil
+	}
+	ifi, err := net.InterfaceByName(r.iface)
+	if err != nil {
+		return nil, err
+	}
+	addrs, err := ifi.Addrs()
+	if err != nil {
+		return nil, err
+	}
+	var wantV4 = dst.To4() != nil
+	for _, a := range addrs {
+		if n, y := a.(*net.IPNet); y && (n.IP.To4() != nil) == wantV4 {
+			return &net.TCPAddr{IP: n.IP}, nil
+		}
+	}
+	return nil, INVALID_ROUTE.Apply("no usable address on " + r.iface)
+}
+
+// --------------------
+// egressTable
+// --------------------
+// per-user static routing table evaluated at stream-open on server.
+// the longest prefix wins, and the earlier one wins among same prefixes.
+// unmatched destinations use the default route or the system routing.
+type egressTable struct {
+	routes []*egressRoute
+	deflt  *egressRoute
+}
+
+func newEgressTable(entries []string) (*egressTable, error) {
+	var t = new(egressTable)
+	for _, entry := range entries {
+		fields := strings.Fields(entry)
+		if len(fields) != 2 {
+			return nil, INVALID_ROUTE.Apply(entry)
+		}
+		var r = new(egressRoute)
+		if r.source = net.ParseIP(fields[1]); r.source == nil {
+			r.iface = fields[1]
+		}
+		if fields[0] == ROUTE_DEFAULT {
+			if t.deflt == nil {
+				t.deflt = r
+			}
+			continue
+		}
+		_, network, err := net.ParseCIDR(fields[0])
+		if err != nil {
+			return nil, INVALID_ROUTE.Apply(entry)
+		}
+		r.network = network
+		t.insert(r)
+	}
+	return t, nil
+}
+
+// keep routes ordered by prefix length desc
+func (t *egressTable) insert(r *egressRoute) {
+	ones, _ := r.network.Mask.Size()
+	var i int
+	for ; i < len(t.routes); i++ {
+		if o, _ := t.routes[i].network.Mask.Size(); o < ones {
+			break
+		}
+	}
+	t.routes = append(t.routes, nil)
+	copy(t.routes[i+1:], t.routes[i:])
+	t.routes[i] = r
+}
+
+func (t *egressTable) lookup(dst net.IP) *egressRoute {
+	for _, r := range t.routes {
+		if r.network.Contains(dst) {
+			return r
+		}
+	}
+	return t.deflt
+}
+
+func (t *egressTable) Dial(target string) (net.Conn, error) {
+	addr, err := net.ResolveTCPAddr("tcp", target)
+	if err != nil {
+		return nil, err
+	}
+	var d = dialer
+	if r := t.lookup(addr.IP); r != nil {
+		if d.LocalAddr, err = r.localAddr(addr.IP); err != nil {
+			return nil, err
+		}
+	}
+	return d.Dial("tcp", addr.String())
+}
@@ -0,0 +1,56 @@
+package tunnel
+
+import (
+	"net"
+	"testing"
+)
+
+func TestEgressTablePrecedence(t *testing.T) {
+	table, err := newEgressTable([]string{
+		"10.0.0.0/8 10.255.0.1",
+		"10.1.0.0/16 10.255.0.2",
+		"10.1.0.0/16 10.255.0.3", // shadowed by the previous one
+		"10.1.1.0/24 eth9",
+		"default 192.168.0.1",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var cases = []struct {
+		dst, src, iface string
+	}{
+		{"10.2.3.4", "10.255.0.1", NULL},
+		{"10.1.2.3", "10.255.0.2", NULL},
+		{"10.1.1.1", NULL, "eth9"},
+		{"8.8.8.8", "192.168.0.1", NULL},
+	}
+	for _, c := range cases {
+		r := table.lookup(net.ParseIP(c.dst))
+		if r == nil {
+			t.Fatalf("dst=%s no route", c.dst)
+		}
+		if r.iface != c.iface || (c.src != NULL && !r.source.Equal(net.ParseIP(c.src))) {
+			t.Errorf("dst=%s selected src=%s iface=%s", c.dst, r.source, r.iface)
+		}
+	}
+}
+
+func TestEgressTableDefault(t *testing.T) {
+	table, err := newEgressTable([]string{"172.16.0.0/12 172.16.0.1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// unmatched and no default, then use system routing
+	if r := table.lookup(net.ParseIP("1.1.1.1")); r != nil {
+		t.Errorf("unexpected route src=%s", r.source)
+	}
+	if r := table.lookup(net.ParseIP("172.20.0.1")); r == nil {
+		t.Errorf("expected route for 172.20.0.1")
+	}
+
+	for _, bad := range []string{"10.0.0.0/33 1.1.1.1", "10.0.0.0/8", "foo 1.1.1.1"} {
+		if _, err = newEgressTable([]string{bad}); err == nil {
+			t.Errorf("expected error for %q", bad)
+		}
+	}
+}
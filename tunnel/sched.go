@@ -0,0 +1,143 @@
+package tunnel
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// user attribute, value: name of priority class
+	UA_CLASS      = "class"
+	CLASS_DEFAULT = "default"
+	// the class without sending in such time is inactive and has no share
+	CLASS_IDLE  = time.Second
+	CLASS_BURST = time.Millisecond * 100
+)
+
+// --------------------
+// egressClass
+// --------------------
+type egressClass struct {
+	sent   int64 // achieved bytes
+	name   string
+	weight int
+	tokens float64
+	last   time.Time // last refilled
+	active time.Time // last sending
+	meter  streamMeter
+}
+
+// --------------------
+// egressScheduler
+// --------------------
+// share the total egress rate (server to clients) among the active classes
+// by weight, the idle classes don't occupy the shares (work-conserving).
+// each class is a token bucket with the rate of its share, and the sender
+// will sleep for the debt of tokens.
+type egressScheduler struct {
+	lock    sync.Mutex
+	rate    float64 // bytes per second
+	classes map[string]*egressClass
+}
+
+// classes: name:weight,...
+func newEgressScheduler(rate int64, classes string) (*egressScheduler, error) {
+	var s = &egressScheduler{
+		rate:    float64(rate),
+		classes: make(map[string]*egressClass),
+	}
+	var now = time.Now()
+	for _, item := range strings.Split(classes, ",") {
+		if item = strings.TrimSpace(item); item == NULL {
+			continue
+		}
+		name, w := SubstringBefore(item, ":")
+		weight, err := strconv.Atoi(w)
+		if name == NULL || err != nil || weight <= 0 {
+			return nil, CONF_ERROR.Apply("PriorityClasses " + item)
+		}
+		s.classes[name] = &egressClass{
+			name:   name,
+			weight: weight,
+			meter:  streamMeter{start: now},
+		}
+	}
+	if s.classes[CLASS_DEFAULT] == nil {
+		s.classes[CLASS_DEFAULT] = &egressClass{
+			name:   CLASS_DEFAULT,
+			weight: 1,
+			meter:  streamMeter{start: now},
+		}
+	}
+	return s, nil
+}
+
+// the class of name or default, known=false if name is undefined
+func (s *egressScheduler) class(name string) (c *egressClass, known bool) {
+	if c = s.classes[name]; c != nil {
+		return c, true
+	}
+	return s.classes[CLASS_DEFAULT], name == NULL
+}
+
+func (s *egressScheduler) share(c *egressClass, now time.Time) float64 {
+	var sum int
+	for _, o := range s.classes {
+		if o == c || now.Sub(o.active) < CLASS_IDLE {
+			sum += o.weight
+		}
+	}
+	return s.rate * float64(c.weight) / float64(sum)
+}
+
+// take n bytes of the class, and sleep if in debt
+func (s *egressScheduler) acquire(c *egressClass, n int) {
+	s.lock.Lock()
+	var (
+		now   = time.Now()
+		share = s.share(c, now)
+		wait  time.Duration
+	)
+	// no burst at first
+	if !c.last.IsZero() {
+		c.tokens += share * now.Sub(c.last).Seconds()
+		if max := share * CLASS_BURST.Seconds(); c.tokens > max {
+			c.tokens = max
+		}
+	}
+	c.last, c.active = now, now
+	c.tokens -= float64(n)
+	if c.tokens < 0 {
+		wait = time.Duration(-c.tokens / share * float64(time.Second))
+	}
+	s.lock.Unlock()
+
+	if wait > 0 {
+		time.Sleep(wait)
+	}
+	atomic.AddInt64(&c.sent, int64(n))
+}
+
+func (s *egressScheduler) String() string {
+	var (
+		buf   = new(bytes.Buffer)
+		now   = time.Now()
+		names []string
+	)
+	for name := range s.classes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		c := s.classes[name]
+		rate := c.meter.sample(now, atomic.LoadInt64(&c.sent))
+		fmt.Fprintf(buf, "Class=%s Weight=%d Rate=%.1fKB/s\n", c.name, c.weight, rate/1024)
+	}
+	return buf.String()
+}
@@ -0,0 +1,58 @@
+package tunnel
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestEgressClasses(t *testing.T) {
+	s, err := newEgressScheduler(1<<20, "premium:8, free:2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c, known := s.class("premium"); !known || c.weight != 8 {
+		t.Errorf("premium %+v", c)
+	}
+	// fallback to default
+	if c, known := s.class(NULL); !known || c.name != CLASS_DEFAULT {
+		t.Errorf("no class %+v", c)
+	}
+	if c, known := s.class("gold"); known || c.name != CLASS_DEFAULT {
+		t.Errorf("undefined class %+v", c)
+	}
+	for _, bad := range []string{"premium", "premium:0", ":1", "free:x"} {
+		if _, err = newEgressScheduler(1<<20, bad); err == nil {
+			t.Errorf("expected error for %q", bad)
+		}
+	}
+}
+
+func TestEgressSchedulerShares(t *testing.T) {
+	var (
+		s, _     = newEgressScheduler(4<<20, "premium:4,free:1")
+		premium  = s.classes["premium"]
+		free     = s.classes["free"]
+		deadline = time.Now().Add(time.Millisecond * 500)
+		wg       sync.WaitGroup
+	)
+	// saturate both classes
+	for _, c := range []*egressClass{premium, free} {
+		wg.Add(1)
+		go func(c *egressClass) {
+			defer wg.Done()
+			for time.Now().Before(deadline) {
+				s.acquire(c, 16<<10)
+			}
+		}(c)
+	}
+	wg.Wait()
+	ratio := float64(premium.sent) / float64(free.sent)
+	if ratio < 2.5 || ratio > 6 {
+		t.Errorf("premium=%d free=%d ratio=%.2f", premium.sent, free.sent, ratio)
+	}
+	// total is limited
+	if total := premium.sent + free.sent; total > 4<<20 {
+		t.Errorf("exceeded total=%d", total)
+	}
+}
@@ -2,26 +2,60 @@ package tunnel
 
 import (
 	"bytes"
+	"crypto/rand"
 	"crypto/sha1"
-	"encoding/binary"
+	"crypto/tls"
+	"encoding/hex"
 	"fmt"
-	"math/rand"
+	"io"
 	"net"
+	"strings"
 	"sync"
 	"sync/atomic"
 	"time"
 	"unsafe"
 
+	"github.com/Lafeng/deblocus/auth"
 	ex "github.com/Lafeng/deblocus/exception"
 	"github.com/Lafeng/deblocus/geo"
 	log "github.com/Lafeng/deblocus/glog"
 )
 
 const (
+	// defaults of TokenBatch, TokenFloor and Parallels
 	GENERATE_TOKEN_NUM = 4
 	TOKENS_FLOOR       = 2
 	PARALLEL_TUN_QTY   = 2
-	TKSZ               = sha1.Size
+	TKSZ               = sha1.Size // the default size of token
+	TKSZ_LONG          = 32        // negotiated with the clients support it
+	// bounds of the configured
+	TOKEN_BATCH_MAX = 32
+	TOKEN_FLOOR_MAX = 16
+	PARALLEL_MAX    = 16
+	// user attribute, value: duration eg. 1h
+	UA_MAX_SESSION = "max_session"
+	// the spent tokens are remembered for detecting double-spend
+	SPENT_TOKENS_MAX = 4096
+	SPENT_TOKEN_TTL  = time.Hour
+	// unconsumed tokens held by a session
+	TOKENS_MAX = 64
+	// shards of the token container, a power of 2
+	TOKEN_SHARDS = 64
+	// interval of reaping the expired tokens at least
+	TOKEN_REAP_MIN = time.Second
+	// the tokens are taken only from the address or the subnet (/24 of ipv4,
+	// /64 of ipv6) of the client which the session was created by
+	BIND_TOKENS_IP     = "ip"
+	BIND_TOKENS_SUBNET = "subnet"
+)
+
+var (
+	TOKEN_REPLAYED = ex.New("Token replayed")
+	TOKENS_HOARDED = ex.New("Too many unconsumed tokens")
+	TOKEN_MISBOUND = ex.New("Token taken by other client")
+	ERR_MIGRATE_TO = ex.New("Invalid endpoint of migration")
+	// the negotiation exceeded the deadline
+	ERR_HANDSHAKE_TIMEOUT = ex.New("Handshake timeout")
 )
 
 //
@@ -41,23 +75,75 @@ type Filterable interface {
 type Session struct {
 	mux           *multiplexer
 	mgr           *SessionMgr
+	server        *Server
 	uid           string // user
 	cid           string // client
+	addr          string // bare ip of client, the tokens are bound to it
+	label         string // supplied by client
+	correlation   string // id generated by client
+	persist       bool   // opted in to survive restarts
 	cipherFactory *CipherFactory
-	tokens        map[string]bool
+	tokens        map[tokenKey]time.Time // token -> issued time
+	tokenLock     sync.Mutex             // guards tokens
+	minting       sync.Mutex             // serializes the requests of tokens
+	tokenSize     int
+	protocol      int    // version negotiated
+	caps          uint32 // shared with client of V2
+	sid           uint32 // id in the stateless tokens
 	activeCnt     int32
+	closed        int32
+	start         time.Time
+	planTimer     *time.Timer
 }
 
 func (serv *Server) NewSession(cf *CipherFactory) *Session {
 	s := &Session{
 		mux:           newServerMultiplexer(),
 		mgr:           serv.sessionMgr,
+		server:        serv,
 		cipherFactory: cf,
-		tokens:        make(map[string]bool),
+		tokens:        make(map[tokenKey]time.Time),
+		tokenSize:     TKSZ,
+		protocol:      PROTOCOL_V1,
+		start:         time.Now(),
 	}
 	if serv.filter != nil {
 		s.mux.filter = serv.filter
 	}
+	if serv.resolver != nil {
+		s.mux.resolver = serv.resolver
+	}
+	s.mux.probe = serv.probe
+	s.mux.buffers = serv.buffers
+	if serv.streamWindow > 0 {
+		s.mux.window = serv.streamWindow
+	}
+	s.mux.linger = serv.linger
+	s.mux.pingMax = serv.PingIntervalMax
+	s.mux.frames = serv.frames
+	s.mux.coalesce = serv.coalesce
+	s.mux.roam = serv.roaming
+	s.mux.rekey = serv.rekey
+	// of v1 clients by the configuration, narrowed by the capabilities of v2
+	s.mux.datagrams = serv.udpRelay
+	s.mux.multipath = serv.multipath
+	if serv.fingerprint > 0 && cf != nil {
+		s.mux.profile = newWireProfile(serv.fingerprint, cf.key)
+	}
+	s.mux.outbound = serv.outbound
+	s.mux.sniffer = serv.sniffer
+	s.mux.prioPorts = serv.prioPorts
+	if serv.DialFailBudget > 0 {
+		s.mux.dials = newDialBudget(serv.DialFailBudget, serv.dialFailWindow)
+	}
+	if serv.StreamOpenRate > 0 {
+		s.mux.opens = newTokenBucket(serv.StreamOpenRate, serv.StreamOpenBurst)
+	}
+	s.mux.streamCap = serv.MaxStreams
+	if serv.sched != nil {
+		s.mux.sched = serv.sched
+		s.mux.class, _ = serv.sched.class(NULL)
+	}
 	return s
 }
 
@@ -65,6 +151,69 @@ func (s *Session) indentifySession(user string, c *Conn) {
 	s.uid = user
 	c.SetId(user, true)
 	s.cid = SubstringLastBefore(c.identifier, ":")
+	s.addr = ipAddr(c.RemoteAddr())
+}
+
+// apply the policies defined in user attributes
+func (s *Session) applyUserPolicy(u *auth.User) {
+	s.persist = persistable(u.Attrs)
+	if routes := u.Attrs.Values(UA_ROUTE); len(routes) > 0 {
+		table, err := newEgressTable(routes)
+		if err == nil {
+			s.mux.egress = table
+		} else {
+			log.Warningf("Ignored routes of user %s: %v\n", s.uid, err)
+		}
+	}
+	if sched := s.server.sched; sched != nil {
+		var known bool
+		name := u.Attrs.Get(UA_CLASS)
+		if s.mux.class, known = sched.class(name); !known {
+			log.Warningf("Undefined class %s of user %s\n", name, s.uid)
+		}
+	}
+	if values := u.Attrs.Values(UA_BANDWIDTH); len(values) > 0 {
+		schedule, err := parseBandwidthSchedule(values, u.Attrs.Get(UA_TIMEZONE))
+		if err == nil {
+			s.mux.bandwidth = newBwLimiter(schedule)
+		} else {
+			log.Warningf("Ignored bandwidth of user %s: %v\n", s.uid, err)
+		}
+	}
+	if v := u.Attrs.Get(UA_MAX_SESSION); v != NULL {
+		d, err := time.ParseDuration(v)
+		if err == nil && d > 0 {
+			s.planTimer = time.AfterFunc(d, s.planExpired)
+		} else {
+			log.Warningf("Ignored %s of user %s: %s\n", UA_MAX_SESSION, s.uid, v)
+		}
+	}
+}
+
+// the subsystems not shared with client are disabled
+func (s *Session) applyCapabilities(caps uint32) {
+	s.caps = caps
+	if caps&CAP_ROAMING == 0 {
+		s.mux.roam = 0
+	}
+	if caps&CAP_REKEY == 0 {
+		s.mux.rekey = nil
+	}
+	s.mux.flowCtl = caps&CAP_FLOW_CONTROL != 0
+	s.mux.multipath = s.mux.multipath && caps&CAP_MULTIPATH != 0
+	s.mux.datagrams = s.mux.datagrams && caps&CAP_UDP_RELAY != 0
+	s.mux.frameMAC = caps&CAP_FRAME_MAC != 0
+	s.mux.goaway = caps&CAP_GOAWAY != 0
+}
+
+// the session reached the max duration of user plan
+func (s *Session) planExpired() {
+	if atomic.LoadInt32(&s.closed) != 0 {
+		return
+	}
+	atomic.AddInt64(&s.server.planDrops, 1)
+	log.Infof("Session %s@%s was dropped by plan limit", s.uid, s.cid)
+	s.destroy(SESSION_CLOSE_PLAN)
 }
 
 func (t *Session) eventHandler(e event, msg ...interface{}) {
@@ -78,7 +227,11 @@ func (t *Session) tokensHandle(args []byte) {
 	var cmd = args[0]
 	switch cmd {
 	case FRAME_ACTION_TOKEN_REQUEST:
-		tokens := t.mgr.createTokens(t, GENERATE_TOKEN_NUM)
+		tokens, err := t.mgr.requestTokens(t, t.server.TokenBatch)
+		if err != nil {
+			log.Warningf("Refused to issue tokens to %s@%s %v", t.uid, t.cid, err)
+			return
+		}
 		if tokens != nil {
 			tokens[0] = FRAME_ACTION_TOKEN_REPLY
 			t.mux.bestSend(tokens, "replyTokens")
@@ -91,35 +244,152 @@ func (t *Session) tokensHandle(args []byte) {
 func (t *Session) DataTunServe(tun *Conn, isNewSession bool) {
 	defer func() {
 		if atomic.AddInt32(&t.activeCnt, -1) <= 0 {
-			t.destroy()
-			log.Infof("Client %s was offline", t.cid)
+			if roam := t.mux.roam; roam > 0 && atomic.LoadInt32(&t.closed) == 0 {
+				// the client may re-attach from another address
+				log.Infof("Client %s was detached%s", t.cid, correlationTag(t.correlation))
+				time.AfterFunc(roam, t.roamExpired)
+				return
+			}
+			t.destroy(SESSION_CLOSE_OFFLINE)
+			log.Infof("Client %s was offline%s", t.cid, correlationTag(t.correlation))
 		}
 	}()
 
 	if isNewSession {
-		log.Infof("Client %s is online", t.cid)
+		log.Infof("Client %s is online%s", t.cid, correlationTag(t.correlation))
 	}
 	if log.V(log.LV_SVR_CONNECT) {
 		log.Infof("Tun %s is established", tun.identifier)
 	}
 	cnt := atomic.AddInt32(&t.activeCnt, 1)
+	// the cipher should be set up by negotiation or resumption,
+	// otherwise the plaintext conn must not be handed over to mux.
+	if !tun.cipherReady() {
+		log.Warningf("Tun %s was closed: %v", tun.identifier, CIPHER_NOT_READY)
+		SafeClose(tun)
+		return
+	}
 	// mux will output error log
-	err := t.mux.Listen(tun, t.eventHandler, DT_PING_INTERVAL+int(cnt))
+	err := t.mux.Listen(tun, t.eventHandler, t.server.PingInterval+int(cnt))
 	if log.V(log.LV_SVR_CONNECT) {
 		log.Infof("Tun %s was disconnected%s", tun.identifier, ex.Detail(err))
 	}
 }
 
-func (t *Session) destroy() {
+// the client did not re-attach in grace of roaming
+func (t *Session) roamExpired() {
+	if atomic.LoadInt32(&t.activeCnt) <= 0 && atomic.LoadInt32(&t.closed) == 0 {
+		t.destroy(SESSION_CLOSE_OFFLINE)
+		log.Infof("Client %s was offline%s", t.cid, correlationTag(t.correlation))
+	}
+}
+
+func (t *Session) destroy(reason string) {
+	// don't destroy repeatedly
+	if !atomic.CompareAndSwapInt32(&t.closed, 0, 1) {
+		return
+	}
+	if t.planTimer != nil {
+		t.planTimer.Stop()
+	}
+	if hook := t.server.disconnectHook; hook != nil && t.uid != NULL {
+		invokeDisconnectHook(hook, t.disconnectInfo(reason))
+	}
 	t.cipherFactory.Cleanup()
+	t.server.traffic.retire(t)
 	t.mgr.clearTokens(t)
+	t.mgr.unregister(t)
 	t.mux.destroy()
 }
 
+// the issued time of unconsumed token, or zero
+func (t *Session) issuedOf(key tokenKey) time.Time {
+	t.tokenLock.Lock()
+	defer t.tokenLock.Unlock()
+	return t.tokens[key]
+}
+
+// false if the tokens were cleared
+func (t *Session) holdToken(key tokenKey, issued time.Time) bool {
+	t.tokenLock.Lock()
+	defer t.tokenLock.Unlock()
+	if t.tokens == nil {
+		return false
+	}
+	t.tokens[key] = issued
+	return true
+}
+
+// freeze the data flows of session but keep tunnels and tokens alive
+func (t *Session) setPaused(paused bool) {
+	t.mux.setPaused(paused)
+}
+
 //
 //
 //
-type SessionContainer map[string]*Session
+type SessionContainer map[tokenKey]*Session
+
+// the token padded to the long size, so the maps are looked up without
+// formatting the tokens on the accepting of every tunnel.
+type tokenKey [TKSZ_LONG]byte
+
+func keyOf(token []byte) (key tokenKey) {
+	copy(key[:], token)
+	return
+}
+
+// --------------------
+// tokenShard
+// --------------------
+// the container is sharded by the hash of token, so the data tunnels accepted
+// concurrently don't serialize on a single lock. the lock of shard is taken
+// before the tokenLock of session.
+// the spent tokens of shard are remembered until expired, and the oldest is
+// evicted in full.
+type tokenShard struct {
+	container SessionContainer
+	spent     map[tokenKey]spentToken
+	spentRing [SPENT_TOKENS_MAX / TOKEN_SHARDS]tokenKey
+	spentNext int
+	lock      sync.Mutex
+}
+
+// FNV-1a of the whole key, the stateless tokens are led by the expiry
+func shardOf(key *tokenKey) int {
+	var h uint32 = 2166136261
+	for _, b := range key {
+		h ^= uint32(b)
+		h *= 16777619
+	}
+	return int(h & (TOKEN_SHARDS - 1))
+}
+
+// must hold the lock
+func (sh *tokenShard) spentOf(key tokenKey, now time.Time) (spentToken, bool) {
+	st, y := sh.spent[key]
+	if y && now.After(st.expiry) {
+		delete(sh.spent, key)
+		y = false
+	}
+	return st, y
+}
+
+// must hold the lock
+func (sh *tokenShard) spend(key tokenKey, st spentToken) {
+	delete(sh.spent, sh.spentRing[sh.spentNext])
+	sh.spentRing[sh.spentNext] = key
+	sh.spentNext = (sh.spentNext + 1) % len(sh.spentRing)
+	sh.spent[key] = st
+}
+
+// must hold the lock
+func (sh *tokenShard) drop(ses *Session, key tokenKey) {
+	delete(sh.container, key)
+	ses.tokenLock.Lock()
+	delete(ses.tokens, key)
+	ses.tokenLock.Unlock()
+}
 
 //
 //
@@ -129,85 +399,380 @@ type SessionContainer map[string]*Session
 //
 //
 type SessionMgr struct {
-	container SessionContainer
-	lock      *sync.RWMutex
+	replays   int64 // attempts of double-spend
+	regrants  int64 // tokens reused in grace window
+	hoarded   int64 // refused requests of tokens
+	misbound  int64 // tokens presented by other clients
+	expired   int64 // unused tokens reaped
+	shards    [TOKEN_SHARDS]tokenShard
+	sessions  map[*Session]bool   // authenticated sessions
+	byId      map[uint32]*Session // sid -> registered session
+	grace     time.Duration
+	maxTokens int // per session, unlimited if 0
+	binding   string
+	ttl       time.Duration // of the unused tokens, never expire if 0
+	reaper    *time.Ticker
+	reaped    chan struct{} // closed to stop the reaper
+	// tokens of sha1(uid|random) as the old servers
+	legacyTokens bool
+	stateless    *statelessTokens
+	shared       *sharedTokens // with other servers, nil if local only
+	lock         *sync.RWMutex // of sessions and byId
+}
+
+type spentToken struct {
+	ses    *Session
+	client string // host of taker
+	at     time.Time
+	expiry time.Time
 }
 
 func NewSessionMgr() *SessionMgr {
-	return &SessionMgr{
-		container: make(SessionContainer),
-		lock:      new(sync.RWMutex),
+	var s = &SessionMgr{
+		sessions: make(map[*Session]bool),
+		byId:     make(map[uint32]*Session),
+		lock:     new(sync.RWMutex),
+	}
+	for i := range s.shards {
+		s.shards[i].container = make(SessionContainer)
+		s.shards[i].spent = make(map[tokenKey]spentToken)
+	}
+	return s
+}
+
+func (s *SessionMgr) register(session *Session) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.sessions[session] = true
+	// the restored session keeps its id
+	for session.sid == 0 || s.byId[session.sid] != nil && s.byId[session.sid] != session {
+		session.sid = uint32(myRand.Int63n(1 << 32))
 	}
+	s.byId[session.sid] = session
 }
 
-func (s *SessionMgr) take(token []byte) *Session {
+func (s *SessionMgr) unregister(session *Session) {
 	s.lock.Lock()
 	defer s.lock.Unlock()
-	key := fmt.Sprintf("%x", token)
-	ses := s.container[key]
-	delete(s.container, key)
+	delete(s.sessions, session)
+	if s.byId[session.sid] == session {
+		delete(s.byId, session.sid)
+	}
+}
+
+// snapshot of sessions matched with uid or cid, or all if target is empty
+func (s *SessionMgr) lookup(target string) []*Session {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	var list []*Session
+	for ses := range s.sessions {
+		if target == NULL || ses.uid == target || ses.cid == target {
+			list = append(list, ses)
+		}
+	}
+	return list
+}
+
+// the token is single-use, the first taker wins and the later uses of it
+// are rejected as replay (double-spend) with the owner.
+// but the same client could retry with the token in grace window if the
+// reply of resumption was lost.
+func (s *SessionMgr) take(token []byte, client string) (*Session, error) {
+	ses, fresh, err := s.takeLocal(token, client)
+	if s.shared == nil {
+		return ses, err
+	}
+	if ses == nil && err == VALIDATION_FAILED && s.stateless != nil {
+		// the session of other servers is revived by the id, then the token
+		// is verified locally
+		if sid, valid := s.stateless.idOf(token); valid {
+			if _, err = s.shared.reviveById(sid, client, s.binding); err != nil {
+				return nil, err
+			}
+			ses, fresh, err = s.takeLocal(token, client)
+		}
+	}
+	if fresh && !s.claim(token) {
+		// taken by other servers
+		atomic.AddInt64(&s.replays, 1)
+		return nil, TOKEN_REPLAYED.Apply(ses.uid + "@" + ses.cid)
+	}
+	if ses == nil && err == VALIDATION_FAILED && s.stateless == nil {
+		return s.shared.revive(token, client, s.binding)
+	}
+	return ses, err
+}
+
+// the token consumed locally was not taken by other servers
+func (s *SessionMgr) claim(token []byte) bool {
+	if s.stateless != nil {
+		return s.shared.spend(token, s.stateless.ttl)
+	}
+	return s.shared.claim(token)
+}
+
+// fresh if consumed from the container now
+func (s *SessionMgr) takeLocal(token []byte, client string) (ses *Session, fresh bool, err error) {
+	var (
+		key    = keyOf(token)
+		shard  = &s.shards[shardOf(&key)]
+		now    = time.Now()
+		expiry = now.Add(SPENT_TOKEN_TTL)
+	)
+	// the checks and the consuming of a key are atomic in its shard
+	shard.lock.Lock()
+	defer shard.lock.Unlock()
+	ses = shard.container[key]
+	if s.stateless != nil {
+		var valid time.Time
+		s.lock.RLock()
+		ses, valid = s.stateless.verify(token, s.byId)
+		s.lock.RUnlock()
+		// the spent one is checked below
+		if ses != nil {
+			if _, y := shard.spentOf(key, now); y {
+				ses = nil
+			} else if valid.After(expiry) {
+				expiry = valid
+			}
+		}
+	}
+	if ses != nil && s.stateless == nil && s.ttl > 0 && now.Sub(ses.issuedOf(key)) >= s.ttl {
+		// before reaped
+		shard.drop(ses, key)
+		atomic.AddInt64(&s.expired, 1)
+		return nil, false, VALIDATION_FAILED
+	}
+	if ses != nil && s.binding != NULL && !sameOrigin(ses.addr, client, s.binding) {
+		// not consumed, the owner could still use it
+		atomic.AddInt64(&s.misbound, 1)
+		return nil, false, TOKEN_MISBOUND.Apply(ses.uid + "@" + ses.cid)
+	}
 	if ses != nil {
-		delete(ses.tokens, key)
+		shard.drop(ses, key)
+		shard.spend(key, spentToken{ses, client, now, expiry})
+		return ses, true, nil
+	}
+	if st, y := shard.spentOf(key, now); y {
+		if st.client == client && now.Sub(st.at) < s.grace && atomic.LoadInt32(&st.ses.closed) == 0 {
+			atomic.AddInt64(&s.regrants, 1)
+			return st.ses, false, nil
+		}
+		atomic.AddInt64(&s.replays, 1)
+		return nil, false, TOKEN_REPLAYED.Apply(st.ses.uid + "@" + st.ses.cid)
+	}
+	return nil, false, VALIDATION_FAILED
+}
+
+// compare the ip of session with the taker in binding of ip or subnet
+func sameOrigin(addr, client string, binding string) bool {
+	a, b := net.ParseIP(addr), net.ParseIP(client)
+	if a == nil || b == nil {
+		return addr == client
+	}
+	if binding != BIND_TOKENS_SUBNET {
+		return a.Equal(b)
+	}
+	var mask = net.CIDRMask(64, 128)
+	if a4, b4 := a.To4(), b.To4(); a4 != nil || b4 != nil {
+		a, b, mask = a4, b4, net.CIDRMask(24, 32)
+	}
+	return a != nil && b != nil && a.Mask(mask).Equal(b.Mask(mask))
+}
+
+// the bare ip of cid in user@host
+func originOf(cid string) string {
+	if i := strings.LastIndexByte(cid, '@'); i >= 0 {
+		cid = cid[i+1:]
 	}
-	return ses
+	return strings.Trim(cid, "[]")
 }
 
 func (s *SessionMgr) length() int {
-	return len(s.container)
+	var n int
+	for i := range s.shards {
+		shard := &s.shards[i]
+		shard.lock.Lock()
+		n += len(shard.container)
+		shard.lock.Unlock()
+	}
+	return n
 }
 
-func (s *SessionMgr) clearTokens(session *Session) int {
-	s.lock.Lock()
-	defer s.lock.Unlock()
-	var i = len(session.tokens)
-	for k, _ := range session.tokens {
-		delete(s.container, k)
+// copy of unconsumed tokens in hex
+func (s *SessionMgr) tokensOf(session *Session) map[string]time.Time {
+	session.tokenLock.Lock()
+	defer session.tokenLock.Unlock()
+	var tokens = make(map[string]time.Time, len(session.tokens))
+	for k, v := range session.tokens {
+		tokens[hex.EncodeToString(k[:session.tokenSize])] = v
+	}
+	return tokens
+}
+
+// the tokens in hex of restored session
+func (s *SessionMgr) restoreTokens(session *Session, tokens map[string]time.Time) {
+	for h, v := range tokens {
+		token, err := hex.DecodeString(h)
+		if err != nil || len(token) != session.tokenSize {
+			continue
+		}
+		k := keyOf(token)
+		// the stateless are held for the cap only
+		if s.stateless != nil {
+			session.holdToken(k, v)
+			continue
+		}
+		shard := &s.shards[shardOf(&k)]
+		shard.lock.Lock()
+		if _, y := shard.container[k]; !y && session.holdToken(k, v) {
+			shard.container[k] = session
+		}
+		shard.lock.Unlock()
+	}
+}
+
+// unconsumed tokens of session
+func (s *SessionMgr) tokenCount(session *Session) int {
+	session.tokenLock.Lock()
+	defer session.tokenLock.Unlock()
+	// the stateless are not reaped but expire by the period
+	if s.stateless != nil {
+		for k, issued := range session.tokens {
+			if time.Since(issued) >= s.stateless.ttl {
+				delete(session.tokens, k)
+			}
+		}
 	}
+	return len(session.tokens)
+}
+
+func (s *SessionMgr) clearTokens(session *Session) int {
+	session.tokenLock.Lock()
+	var tokens = session.tokens
 	session.tokens = nil
-	return i
+	session.tokenLock.Unlock()
+	for k := range tokens {
+		shard := &s.shards[shardOf(&k)]
+		shard.lock.Lock()
+		if shard.container[k] == session {
+			delete(shard.container, k)
+		}
+		shard.lock.Unlock()
+	}
+	if s.shared != nil && s.stateless != nil {
+		// the others could not revive it any more
+		s.shared.drop([][]byte{statelessStoreKey(session.sid)})
+	} else if s.shared != nil && len(tokens) > 0 {
+		var list = make([][]byte, 0, len(tokens))
+		for k := range tokens {
+			k := k
+			list = append(list, k[:session.tokenSize])
+		}
+		s.shared.drop(list)
+	}
+	return len(tokens)
+}
+
+// refuse the request of client if the unconsumed tokens would exceed the cap
+func (s *SessionMgr) requestTokens(session *Session, many int) ([]byte, error) {
+	session.minting.Lock()
+	defer session.minting.Unlock()
+	if held := s.tokenCount(session); s.maxTokens > 0 && held+many > s.maxTokens {
+		atomic.AddInt64(&s.hoarded, 1)
+		return nil, TOKENS_HOARDED.Apply(held)
+	}
+	return s.mintTokens(session, many), nil
 }
 
-// return header=1 + TKSZ*many
+// return header=1 + tokenSize*many
 func (s *SessionMgr) createTokens(session *Session, many int) []byte {
-	s.lock.Lock()
-	defer s.lock.Unlock()
+	if session == nil {
+		return nil
+	}
+	session.minting.Lock()
+	defer session.minting.Unlock()
+	return s.mintTokens(session, many)
+}
 
+// must hold the minting of session
+func (s *SessionMgr) mintTokens(session *Session, many int) []byte {
 	// issue #35
 	// clearTokens() invoked prior to createTokens()
-	if session == nil || session.tokens == nil {
+	session.tokenLock.Lock()
+	var cleared = session.tokens == nil
+	session.tokenLock.Unlock()
+	if cleared {
 		return nil
 	}
 
 	var (
-		tokens  = make([]byte, 1+many*TKSZ)
-		i64buf  = make([]byte, 8)
+		size    = session.tokenSize
+		tokens  = make([]byte, 1+many*size)
 		_tokens = tokens[1:]
-		sha     = sha1.New()
 	)
-	rand.Seed(time.Now().UnixNano())
-	sha.Write([]byte(session.uid))
 	for i := 0; i < many; i++ {
-		binary.BigEndian.PutUint64(i64buf, uint64(rand.Int63()))
-		sha.Write(i64buf)
-		binary.BigEndian.PutUint64(i64buf, uint64(time.Now().UnixNano()))
-		sha.Write(i64buf)
-		pos := i * TKSZ
-		sha.Sum(_tokens[pos:pos])
-		token := _tokens[pos : pos+TKSZ]
-		key := fmt.Sprintf("%x", token)
-		if _, y := s.container[key]; y {
+		pos := i * size
+		token := _tokens[pos : pos+size]
+		if s.stateless != nil {
+			if err := s.stateless.mint(session, token); err != nil {
+				log.Errorln("Failed to create tokens", err)
+				return nil
+			}
+			// held for the cap of MaxTokens
+			if !session.holdToken(keyOf(token), time.Now()) {
+				return nil
+			}
+			continue
+		}
+		if err := s.newToken(session.uid, token); err != nil {
+			log.Errorln("Failed to create tokens", err)
+			return nil
+		}
+		key := keyOf(token)
+		shard := &s.shards[shardOf(&key)]
+		shard.lock.Lock()
+		if _, y := shard.container[key]; y {
+			shard.lock.Unlock()
 			i--
 			continue
 		}
-		s.container[key] = session
-		session.tokens[key] = true
+		// cleared meanwhile
+		if !session.holdToken(key, time.Now()) {
+			shard.lock.Unlock()
+			return nil
+		}
+		shard.container[key] = session
+		shard.lock.Unlock()
+	}
+	if s.shared != nil && s.stateless != nil {
+		// the state of session for the other servers, by the id in tokens
+		s.shared.put(session, [][]byte{statelessStoreKey(session.sid)})
+	} else if s.shared != nil {
+		var list = make([][]byte, many)
+		for i := range list {
+			list[i] = _tokens[i*size : (i+1)*size]
+		}
+		if err := s.shared.put(session, list); err != nil {
+			s.shared.keepUnshared(list)
+		}
 	}
 	if log.V(log.LV_SESSION) {
-		log.Errorf("SessionMap created=%d len=%d\n", many, len(s.container))
+		log.Errorf("SessionMap created=%d len=%d\n", many, s.length())
 	}
 	return tokens
 }
 
+// the random token, or sha1 of the uid and random in legacy
+func (s *SessionMgr) newToken(uid string, token []byte) error {
+	if _, err := io.ReadFull(rand.Reader, token); err != nil || !s.legacyTokens {
+		return err
+	}
+	sum := sha1.Sum(append([]byte(uid), token...))
+	copy(token, sum[:])
+	return nil
+}
+
 //
 //
 //
@@ -216,6 +781,7 @@ func (s *SessionMgr) createTokens(session *Session, many int) []byte {
 //
 //
 type Server struct {
+	planDrops int64 // sessions dropped by plan limit
 	*serverConf
 	sharedKey  []byte
 	sessionMgr *SessionMgr
@@ -223,21 +789,90 @@ type Server struct {
 	tcPool     unsafe.Pointer // *[]uint64
 	tcTicker   *time.Ticker
 	filter     Filterable
+	storm      *stormGuard
+	halfOpen   *halfOpenGuard
+	replays    *replayFilter
+	subnets    *subnetGuard
+	admits     *admitQueue
+	resolver   *dohResolver
+	probe      *probePolicy
+	buffers    *bufferMeter
+	sched      *egressScheduler
+	zombies    *sessionScanner
+	idle       *sessionScanner
+	acl        *aclSource
+	webhook    *authWebhook
+	store      *sessionStore
+	tickets    *ticketKeeper
+	checkpoint *time.Ticker
+	outbound   *outboundLimit
+	tarpit     *tarpit
+	decoy      *decoy
+	knocks     *knockGate
+	bans       *banGuard
+	perSource  *sourceLimit
+	skew       *skewMeter
+	sniffer    *protocolSniffer
+	camouflage *tlsCamouflage
+	handshakes *handshakeMeter
+	traffic    *trafficLedger // of the destroyed sessions for metrics
+	users      *reloadableAuth
+	configFile string // reloaded by admin
+	// closed to stop the checkpoint
+	checkpointDone chan struct{}
+	// hooks
+	disconnectHook DisconnectHook
 }
 
-func NewServer(cman *ConfigMan) *Server {
+func NewServer(cman *ConfigMan) (*Server, error) {
 	conf := cman.sConf
 	s := &Server{
 		serverConf: conf,
 		sharedKey:  preSharedKey(conf.publicKey),
 		sessionMgr: NewSessionMgr(),
 		tunParams: &tunParams{
-			pingInterval: DT_PING_INTERVAL,
+			pingInterval: conf.PingInterval,
 			parallels:    conf.Parallels,
+			maxStreams:   conf.MaxStreams,
 		},
+		handshakes: newHandshakeMeter(),
+		users:      newReloadableAuth(conf.AuthSys),
+		configFile: cman.filepath,
+	}
+	conf.AuthSys = s.users
+	s.sessionMgr.grace = conf.tokenGrace
+	s.sessionMgr.maxTokens = conf.MaxTokens
+	s.sessionMgr.legacyTokens = conf.legacyTokens
+	s.sessionMgr.binding = conf.BindTokens
+	if conf.tokenTTL > 0 {
+		s.sessionMgr.ttl = conf.tokenTTL
+		s.sessionMgr.startReaper()
+	}
+	if conf.TokenStore != NULL {
+		store, _ := newRedisTokenStore(conf.TokenStore)
+		var ttl = conf.tokenTTL
+		if conf.statelessTokens > 0 {
+			ttl = conf.statelessTokens
+		}
+		s.sessionMgr.shared = newSharedTokens(s, store, MarshalPrivateKey(conf.privateKey), ttl)
+	}
+	if conf.statelessTokens > 0 {
+		s.sessionMgr.stateless = newStatelessTokens(MarshalPrivateKey(conf.privateKey), conf.statelessTokens)
+		s.tunParams.tokenTTL = conf.statelessTokens
+	} else {
+		s.tunParams.tokenTTL = conf.tokenTTL
+	}
+	// fail before serving
+	if err := s.initFilters(); err != nil {
+		return nil, err
+	}
+	if strings.ToUpper(conf.Cipher) == CIPHER_NULL {
+		log.Warningln("*** Encryption is OFF, the tunnels are in PLAINTEXT ***")
 	}
 
 	// inital update time counter
+	s.skew = newSkewMeter(conf.skewSteps)
+	s.replays = newReplayFilter(conf.skewSteps)
 	s.updateNow()
 
 	var step = time.Second * TIME_STEP
@@ -255,13 +890,201 @@ func NewServer(cman *ConfigMan) *Server {
 		go s.updateTimeCounterWorker(step)
 	})
 
-	if len(conf.DenyDest) == 2 {
-		s.filter, _ = geo.NewGeoIPFilter(conf.DenyDest)
+	if conf.StormThreshold > 0 {
+		s.storm = newStormGuard(conf.StormThreshold, conf.StormAdmitRate)
 	}
-	return s
+	if conf.SubnetConcurrency > 0 || conf.SubnetRate > 0 {
+		s.subnets = newSubnetGuard(conf.SubnetConcurrency, conf.SubnetRate)
+	}
+	if conf.MaxTunnelsPerIP > 0 {
+		s.perSource = newSourceLimit(conf.MaxTunnelsPerIP)
+	}
+	if conf.BanThreshold > 0 {
+		s.bans = newBanGuard(conf.BanThreshold, conf.banCooldown)
+	}
+	if conf.MaxHalfOpen > 0 {
+		s.halfOpen = newHalfOpenGuard(conf.MaxHalfOpen, conf.handshakeTimeout)
+	}
+	if conf.MaxNegotiations > 0 {
+		s.admits = newAdmitQueue(conf.MaxNegotiations)
+	}
+	if conf.tarpitStyle != NULL {
+		s.tarpit = newTarpit(conf.tarpitStyle, conf.tarpitDelay, conf.TarpitMax)
+	}
+	if conf.Decoy != NULL {
+		s.decoy = newDecoy(conf.Decoy, conf.DecoyMax)
+	}
+	if conf.Knock != NULL {
+		s.knocks = newKnockGate(s.sharedKey, conf.knockWindow)
+	}
+	if conf.MaxOutbound > 0 {
+		s.outbound = newOutboundLimit(conf.MaxOutbound)
+	}
+	if conf.probeThreshold > 0 {
+		s.probe = newProbePolicy(conf.probeThreshold, conf.probePenalty)
+	}
+	if conf.maxBufferMemory > 0 {
+		s.buffers = newBufferMeter(conf.maxBufferMemory)
+	}
+	if conf.Metrics != NULL {
+		s.traffic = newTrafficLedger()
+	}
+	if conf.zombieTimeout > 0 {
+		s.zombies = newZombieWatchdog(conf.zombieTimeout)
+		s.zombies.start(s.sessionMgr)
+	}
+	if conf.idleTimeout > 0 {
+		s.idle = newIdleEvictor(conf.idleTimeout)
+		s.idle.start(s.sessionMgr)
+	}
+	if conf.AuthWebhook != NULL {
+		s.webhook = newAuthWebhook(conf.AuthWebhook, conf.webhookTimeout, conf.webhookCache, conf.webhookFailOpen)
+	}
+	if conf.Sniff != NULL {
+		var err error
+		if s.sniffer, err = newProtocolSniffer(conf.Sniff); err != nil {
+			return nil, err
+		}
+	}
+	if conf.TLS != NULL {
+		var err error
+		if s.camouflage, err = newTLSCamouflage(conf.TLS, conf.TLSCert, conf.TLSKey); err != nil {
+			return nil, err
+		}
+	}
+	if conf.egressRate > 0 {
+		var err error
+		if s.sched, err = newEgressScheduler(conf.egressRate, conf.PriorityClasses); err != nil {
+			return nil, err
+		}
+	}
+	if conf.sessionTickets > 0 {
+		s.tickets = newTicketKeeper(MarshalPrivateKey(conf.privateKey), conf.sessionTickets)
+	}
+	if conf.SessionStore != NULL {
+		s.store = newSessionStore(conf.SessionStore, MarshalPrivateKey(conf.privateKey))
+		if err := s.restoreSessions(); err != nil {
+			if err = s.degrade("SessionStore", err); err != nil {
+				return nil, err
+			}
+		}
+		if conf.sessionCheckpoint > 0 {
+			s.startCheckpoint(conf.sessionCheckpoint)
+		}
+	}
+	return s, nil
 }
 
-func (t *Server) TunnelServe(raw *net.TCPConn) {
+func (t *Server) initFilters() error {
+	var guard = newDestGuard(t.ListenAddr, t.denyNetworks)
+	if t.DoH != NULL {
+		t.resolver = newDoHResolver(t.DoH, t.dohFallback)
+		guard.resolver = t.resolver
+	}
+	if t.DenyNetworksSource != NULL {
+		t.acl = newACLSource(t.DenyNetworksSource, t.aclRefresh, guard)
+		// keep the configured rules if failed
+		if err := t.acl.refresh(); err != nil {
+			if err = t.degrade("DenyNetworksSource", err); err != nil {
+				return err
+			}
+		}
+		t.acl.start()
+	}
+	var filters = filterChain{guard}
+	if t.DenyDest != NULL {
+		f, err := geo.NewGeoIPFilter(t.DenyDest)
+		if err == nil {
+			filters = append(filters, f)
+		} else if err = t.degrade("DenyDest", err); err != nil {
+			return err
+		}
+	}
+	if t.AllowDest != NULL {
+		f, err := geo.NewGeoIPAllowFilter(t.AllowDest)
+		if err == nil {
+			filters = append(filters, f)
+		} else if err = t.degrade("AllowDest", err); err != nil {
+			return err
+		}
+	}
+	t.filter = filters
+	return nil
+}
+
+// in strict mode the failure of resource is fatal,
+// and in lenient mode the server starts without it.
+func (t *Server) degrade(resource string, err error) error {
+	if t.lenient {
+		log.Warningf("Started without %s: %v\n", resource, err)
+		return nil
+	}
+	return RESOURCE_ERROR.Apply(resource + ": " + err.Error())
+}
+
+func (t *Server) TunnelServe(raw net.Conn) {
+	// only the raw listener, others are served by http
+	_, isTCP := raw.(*net.TCPConn)
+	if isTCP && t.knocks != nil && !t.knocks.admit(raw.RemoteAddr()) {
+		// look like a closed port
+		setLinger(raw, 0)
+		SafeClose(raw)
+		return
+	}
+	// the others may come from the shared proxies
+	var source string
+	_, isKCP := raw.(*kcpConn)
+	if (isTCP || isKCP) && (t.bans != nil || t.perSource != nil) {
+		source = ipAddr(raw.RemoteAddr())
+	}
+	if source != NULL && t.bans != nil && !t.bans.admit(source, time.Now()) {
+		SafeClose(raw)
+		return
+	}
+	var handover bool // the slot of source is released by the tunnel
+	if source != NULL && t.perSource != nil {
+		if !t.perSource.acquire(source) {
+			if log.V(log.LV_WARN) {
+				log.Warningf("Refused connection over the limit of source %s", source)
+			}
+			SafeClose(raw)
+			return
+		}
+		defer func() {
+			if !handover {
+				t.perSource.release(source)
+			}
+		}()
+	}
+	var expired func() bool
+	if t.halfOpen != nil {
+		if !t.halfOpen.acquire() {
+			if log.V(log.LV_WARN) {
+				log.Warningf("Refused half-open connection at capacity from=%s", raw.RemoteAddr())
+			}
+			SafeClose(raw)
+			return
+		}
+		defer t.halfOpen.release()
+		// close the underlying one of the wrapped
+		expired = t.halfOpen.watch(raw)
+	}
+	if t.subnets != nil {
+		subnet := subnetOf(raw.RemoteAddr())
+		if !t.subnets.acquire(subnet, time.Now()) {
+			if log.V(log.LV_WARN) {
+				log.Warningf("Throttled negotiation from=%s subnet=%s", raw.RemoteAddr(), subnet)
+			}
+			SafeClose(raw)
+			return
+		}
+		defer t.subnets.release(subnet)
+	}
+	setLinger(raw, t.linger)
+	// only the raw listener, others are wrapped by themselves
+	if _, y := raw.(*net.TCPConn); y && t.camouflage != nil && t.camouflage.tunnel {
+		raw = tls.Server(raw, t.camouflage.config)
+	}
 	var conn = NewConn(raw, nullCipherKit)
 	defer func() {
 		ex.Catch(recover(), nil)
@@ -270,17 +1093,37 @@ func (t *Server) TunnelServe(raw *net.TCPConn) {
 	man := &d5sman{
 		Server:     t,
 		clientAddr: raw.RemoteAddr(),
+		unwatch:    expired,
 	}
 	// read atomically
 	tcPool := *(*[]uint64)(atomic.LoadPointer(&t.tcPool))
 	session, err := man.Connect(conn, tcPool)
+	var timeout = expired != nil && expired()
+	if timeout {
+		log.Warningf("Handshake timeout stage=%s from=%s", stageNames[man.stage], raw.RemoteAddr())
+		err = nvl(err, ERR_HANDSHAKE_TIMEOUT).(error)
+	}
+	if source != NULL && t.bans != nil && !timeout && banworthy(man.stage, err) {
+		if t.bans.fail(source, time.Now()) {
+			log.Warningf("Banned %s for %s after failed negotiations", source, t.bans.cooldown)
+		}
+	}
 
 	if err == nil {
-		go session.DataTunServe(conn, man.isNewSession)
+		if source != NULL && t.perSource != nil {
+			handover = true
+			go func() {
+				defer t.perSource.release(source)
+				session.DataTunServe(conn, man.isNewSession)
+			}()
+		} else {
+			go session.DataTunServe(conn, man.isNewSession)
+		}
 	} else {
 		SafeClose(raw)
-		if session != nil {
-			t.sessionMgr.clearTokens(session)
+		// the resumed is alive with other tunnels
+		if session != nil && man.isNewSession {
+			session.destroy(SESSION_CLOSE_ABORTED)
 		}
 	}
 }
@@ -297,35 +1140,239 @@ func (s *Server) updateTimeCounterWorker(step time.Duration) {
 }
 
 func (s *Server) updateNow() {
-	tc := calculateTimeCounter(true)
+	tc := s.skew.counters(time.Now())
 	// write atomically
 	atomic.StorePointer(&s.tcPool, unsafe.Pointer(&tc))
 }
 
+// admin: pause sessions matched with uid or cid
+// return the number of affected sessions
+func (t *Server) PauseSession(target string) int {
+	list := t.sessionMgr.lookup(target)
+	for _, s := range list {
+		s.setPaused(true)
+		log.Infof("Session %s@%s was paused", s.uid, s.cid)
+	}
+	return len(list)
+}
+
+// admin: resume sessions matched with uid or cid
+func (t *Server) ResumeSession(target string) int {
+	list := t.sessionMgr.lookup(target)
+	for _, s := range list {
+		s.setPaused(false)
+		log.Infof("Session %s@%s was resumed", s.uid, s.cid)
+	}
+	return len(list)
+}
+
+// admin: notice sessions matched with uid or cid to migrate to the endpoint,
+// or to MigrateTo if empty. the clients will negotiate new sessions on the
+// endpoint then drain the sessions here before the node is decommissioned.
+func (t *Server) MigrateSession(target, endpoint string) (int, error) {
+	if endpoint == NULL {
+		endpoint = t.MigrateTo
+	}
+	if _, _, err := net.SplitHostPort(endpoint); err != nil {
+		return 0, ERR_MIGRATE_TO.Apply(endpoint)
+	}
+	var notice = append([]byte{FRAME_ACTION_MIGRATE}, endpoint...)
+	list := t.sessionMgr.lookup(target)
+	for _, s := range list {
+		go s.mux.bestSend(notice, "migrate")
+		log.Infof("Session %s@%s was noticed to migrate to %s", s.uid, s.cid, endpoint)
+	}
+	return len(list), nil
+}
+
+// admin: terminate sessions matched with uid or cid, the tokens are cleared
+// and the tunnels are dropped. the tickets of them are revoked also, so the
+// clients have to authenticate again.
+// return the number of terminated sessions
+func (t *Server) KickSession(target string) int {
+	// never all by mistake
+	if target == NULL {
+		return 0
+	}
+	list := t.sessionMgr.lookup(target)
+	for _, s := range list {
+		if t.tickets != nil {
+			t.tickets.revoke(s.cipherFactory.key)
+		}
+		s.destroy(SESSION_CLOSE_KICKED)
+		log.Infof("Session %s@%s was kicked", s.uid, s.cid)
+	}
+	return len(list)
+}
+
 // implement Stats()
 func (t *Server) Stats() string {
-	uniqClient := make(map[string]byte)
-	t.sessionMgr.lock.RLock()
-	for _, s := range t.sessionMgr.container {
-		if _, y := uniqClient[s.cid]; !y {
-			uniqClient[s.cid] = byte(s.activeCnt)
+	buf := new(bytes.Buffer)
+	buf.WriteString(t.collectStats().String())
+	for _, s := range t.sessionMgr.lookup(NULL) {
+		rx, tx, _ := s.mux.traffic()
+		buf.WriteString(fmt.Sprintf("Clt=%s User=%s Conn=%d TK=%d Rx=%d Tx=%d Active-streams=%d", s.cid, s.uid,
+			atomic.LoadInt32(&s.activeCnt), t.sessionMgr.tokenCount(s), rx, tx, atomic.LoadInt64(&s.mux.active)))
+		if s.label != NULL {
+			buf.WriteString(" Label=" + s.label)
+		}
+		if s.correlation != NULL {
+			buf.WriteString(" Cor=" + s.correlation)
+		}
+		if bw := s.mux.bandwidth; bw != nil {
+			if n := bw.limit(); n > 0 {
+				buf.WriteString(fmt.Sprintf(" Bandwidth=%.1fKB/s", float64(n)/1024))
+			}
+		}
+		if n := atomic.LoadInt64(&s.mux.throttled); n > 0 {
+			buf.WriteString(fmt.Sprintf(" Throttled-opens=%d", n))
 		}
+		if n := atomic.LoadInt64(&s.mux.overflows); n > 0 {
+			buf.WriteString(fmt.Sprintf(" Refused-streams=%d", n))
+		}
+		if s.mux.dials != nil {
+			buf.WriteString(s.mux.dials.String())
+		}
+		buf.WriteString(s.mux.pingStats())
+		buf.WriteString(s.mux.rttStats())
+		buf.WriteString(s.mux.stallStats())
+		if s.mux.isPaused() {
+			buf.WriteString(" Paused")
+		}
+		buf.WriteByte('\n')
 	}
-	t.sessionMgr.lock.RUnlock()
-	buf := new(bytes.Buffer)
-	for k, n := range uniqClient {
-		buf.WriteString(fmt.Sprintf("Clt=%s Conn=%d\n", k, n))
+	if t.storm != nil {
+		buf.WriteString(t.storm.String() + "\n")
+	}
+	buf.WriteString(bytePool.String() + "\n")
+	if t.halfOpen != nil {
+		buf.WriteString(t.halfOpen.String() + "\n")
+	}
+	if t.subnets != nil {
+		buf.WriteString(t.subnets.String() + "\n")
+	}
+	if t.admits != nil {
+		buf.WriteString(t.admits.String() + "\n")
+	}
+	if t.handshakes != nil {
+		buf.WriteString(t.handshakes.String() + "\n")
+	}
+	if t.tarpit != nil {
+		buf.WriteString(t.tarpit.String() + "\n")
+	}
+	if t.decoy != nil {
+		buf.WriteString(t.decoy.String() + "\n")
+	}
+	if t.knocks != nil {
+		buf.WriteString(t.knocks.String() + "\n")
+	}
+	if t.bans != nil {
+		buf.WriteString(t.bans.String() + "\n")
+	}
+	if t.perSource != nil {
+		buf.WriteString(t.perSource.String() + "\n")
+	}
+	if t.skew != nil {
+		buf.WriteString(t.skew.String() + "\n")
+	}
+	if t.replays != nil {
+		buf.WriteString(t.replays.String() + "\n")
+	}
+	if t.outbound != nil {
+		buf.WriteString(t.outbound.String() + "\n")
+	}
+	if t.resolver != nil {
+		buf.WriteString(t.resolver.String() + "\n")
+	}
+	if t.probe != nil {
+		buf.WriteString(t.probe.String() + "\n")
+	}
+	if t.buffers != nil {
+		buf.WriteString(t.buffers.String() + "\n")
+	}
+	if t.sniffer != nil {
+		buf.WriteString(t.sniffer.String() + "\n")
+	}
+	if t.frames != nil {
+		buf.WriteString(t.frames.String() + "\n")
+	}
+	if t.sched != nil {
+		buf.WriteString(t.sched.String())
+	}
+	if t.zombies != nil {
+		buf.WriteString(t.zombies.String() + "\n")
+	}
+	if t.idle != nil {
+		buf.WriteString(t.idle.String() + "\n")
+	}
+	if t.acl != nil {
+		buf.WriteString(t.acl.String() + "\n")
+	}
+	if t.webhook != nil {
+		buf.WriteString(t.webhook.String() + "\n")
+	}
+	if t.tickets != nil {
+		buf.WriteString(t.tickets.String() + "\n")
+	}
+	if t.sessionMgr.shared != nil {
+		buf.WriteString(t.sessionMgr.shared.String() + "\n")
+	}
+	if n := atomic.LoadInt64(&t.sessionMgr.replays); n > 0 {
+		buf.WriteString(fmt.Sprintf("Token-replays=%d\n", n))
+	}
+	if n := atomic.LoadInt64(&t.sessionMgr.regrants); n > 0 {
+		buf.WriteString(fmt.Sprintf("Token-regrants=%d\n", n))
+	}
+	if n := atomic.LoadInt64(&t.sessionMgr.misbound); n > 0 {
+		buf.WriteString(fmt.Sprintf("Token-misbound=%d\n", n))
+	}
+	if n := atomic.LoadInt64(&t.sessionMgr.expired); n > 0 {
+		buf.WriteString(fmt.Sprintf("Token-expired=%d\n", n))
+	}
+	if n := atomic.LoadInt64(&t.sessionMgr.hoarded); n > 0 {
+		buf.WriteString(fmt.Sprintf("Token-hoarding-refused=%d\n", n))
+	}
+	if n := atomic.LoadInt64(&t.planDrops); n > 0 {
+		buf.WriteString(fmt.Sprintf("Dropped-by-plan=%d\n", n))
 	}
 	return string(buf.Bytes())
 }
 
 // implement Close()
 func (t *Server) Close() {
-	uniqSession := make(map[string]byte)
-	for _, s := range t.sessionMgr.container {
-		if _, y := uniqSession[s.cid]; !y {
-			uniqSession[s.cid] = 1
-			s.destroy()
+	t.sessionMgr.stopReaper()
+	if t.zombies != nil {
+		t.zombies.stop()
+	}
+	if t.idle != nil {
+		t.idle.stop()
+	}
+	if t.acl != nil {
+		t.acl.stop()
+	}
+	t.stopCheckpoint()
+	// the streams of sessions are finished in parallel
+	var wg sync.WaitGroup
+	for _, s := range t.sessionMgr.lookup(NULL) {
+		wg.Add(1)
+		go func(s *Session) {
+			defer wg.Done()
+			s.mux.drain(TUN_DRAIN_TIMEOUT)
+		}(s)
+	}
+	wg.Wait()
+	var persisted map[*Session]bool
+	if t.store != nil {
+		persisted = t.persistSessions()
+	}
+	for _, s := range t.sessionMgr.lookup(NULL) {
+		if persisted[s] {
+			s.destroy(SESSION_CLOSE_PERSISTED)
+		} else {
+			s.destroy(SESSION_CLOSE_SHUTDOWN)
 		}
 	}
+	if t.sessionMgr.shared != nil {
+		t.sessionMgr.shared.store.Close()
+	}
 }
@@ -0,0 +1,729 @@
+package tunnel
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/Lafeng/deblocus/auth"
+	ex "github.com/Lafeng/deblocus/exception"
+)
+
+func newTestServer() *Server {
+	return &Server{
+		serverConf: &serverConf{linger: -1, TokenBatch: GENERATE_TOKEN_NUM},
+		sessionMgr: NewSessionMgr(),
+	}
+}
+
+func newTestSession(serv *Server, user string) *Session {
+	cf := NewCipherFactory("AES128CTR", randArray(32))
+	s := serv.NewSession(cf)
+	s.uid, s.cid = user, "127.0.0.1"
+	return s
+}
+
+func TestDisconnectHook(t *testing.T) {
+	var (
+		serv  = newTestServer()
+		infos = make(chan *DisconnectInfo, 4)
+	)
+	serv.OnDisconnect(func(info *DisconnectInfo) {
+		infos <- info
+		panic("hook must be panic-safe")
+	})
+	s := newTestSession(serv, "alice")
+	s.mux.rxBytes, s.mux.txBytes, s.mux.streams = 100, 2000, 3
+	s.destroy(SESSION_CLOSE_OFFLINE)
+	s.destroy(SESSION_CLOSE_SHUTDOWN) // repeatedly
+
+	select {
+	case info := <-infos:
+		if info.User != "alice" || info.Reason != SESSION_CLOSE_OFFLINE || info.Cipher != "AES128CTR" {
+			t.Errorf("unexpected info %+v", info)
+		}
+		if info.BytesUp != 100 || info.BytesDown != 2000 || info.Streams != 3 {
+			t.Errorf("unexpected traffic %+v", info)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("hook was not invoked")
+	}
+	select {
+	case info := <-infos:
+		t.Errorf("hook was invoked repeatedly %+v", info)
+	case <-time.After(time.Millisecond * 100):
+	}
+}
+
+func TestDumpTokens(t *testing.T) {
+	var (
+		serv  = newTestServer()
+		mgr   = serv.sessionMgr
+		alice = newTestSession(serv, "alice")
+		bob   = newTestSession(serv, "bob")
+	)
+	mgr.register(alice)
+	mgr.register(bob)
+	tokens := mgr.createTokens(alice, GENERATE_TOKEN_NUM)
+	mgr.createTokens(bob, 2)
+	// bob was gone but tokens were left
+	mgr.unregister(bob)
+	mgr.take(tokens[1:1+TKSZ], "127.0.0.1")
+
+	dump := mgr.dumpTokens(time.Now().Add(time.Minute))
+	if dump.Total != GENERATE_TOKEN_NUM+1 || dump.Orphans != 2 {
+		t.Fatalf("unexpected dump %+v", dump)
+	}
+	if dump.Users["alice"] != GENERATE_TOKEN_NUM-1 || dump.Users["bob"] != 2 {
+		t.Errorf("unexpected users %v", dump.Users)
+	}
+	first := dump.Sessions[0]
+	if first.User != "alice" || !first.Registered || first.OldestAge != 60 {
+		t.Errorf("unexpected session %+v", first)
+	}
+	for _, h := range first.Hashes {
+		if len(h) != TOKEN_HASH_PREFIX {
+			t.Errorf("hash %s was not redacted", h)
+		}
+	}
+	data, err := serv.DumpTokens()
+	if err != nil || bytes.Contains(data, []byte(fmt.Sprintf("%x", tokens[1+TKSZ:1+TKSZ*2]))) {
+		t.Errorf("raw token was exposed err=%v", err)
+	}
+}
+
+func TestTokenDoubleSpend(t *testing.T) {
+	var (
+		serv   = newTestServer()
+		mgr    = serv.sessionMgr
+		alice  = newTestSession(serv, "alice")
+		tokens = mgr.createTokens(alice, 1)
+		token  = tokens[1 : 1+TKSZ]
+		wg     sync.WaitGroup
+		won    int32
+		replay int32
+	)
+	for i := 0; i < 64; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			s, err := mgr.take(token, "127.0.0.1")
+			if s == alice && err == nil {
+				atomic.AddInt32(&won, 1)
+			} else if e, y := err.(*ex.Exception); s == nil && y && e.Origin == TOKEN_REPLAYED {
+				atomic.AddInt32(&replay, 1)
+			}
+		}()
+	}
+	wg.Wait()
+	if won != 1 || replay != 63 || mgr.replays != 63 {
+		t.Errorf("won=%d replay=%d replays=%d", won, replay, mgr.replays)
+	}
+	if len(alice.tokens) != 0 || mgr.length() != 0 {
+		t.Errorf("token was not consumed")
+	}
+	// never issued
+	if _, err := mgr.take(randArray(TKSZ), "127.0.0.1"); err != VALIDATION_FAILED {
+		t.Errorf("unexpected error %v", err)
+	}
+	if !strings.Contains(serv.Stats(), "Token-replays=63") {
+		t.Errorf("unexpected stats %s", serv.Stats())
+	}
+}
+
+func TestTokenShards(t *testing.T) {
+	var (
+		serv     = newTestServer()
+		mgr      = serv.sessionMgr
+		sessions = make([]*Session, 8)
+		wg       sync.WaitGroup
+		taken    int32
+	)
+	mgr.maxTokens = 32
+	for i := range sessions {
+		sessions[i] = newTestSession(serv, fmt.Sprintf("user%d", i))
+		mgr.register(sessions[i])
+	}
+	for _, ses := range sessions {
+		for j := 0; j < 16; j++ {
+			wg.Add(1)
+			go func(ses *Session) {
+				defer wg.Done()
+				tokens, _ := mgr.requestTokens(ses, GENERATE_TOKEN_NUM)
+				for ; len(tokens) > 1; tokens = tokens[TKSZ:] {
+					if s, _ := mgr.take(tokens[1:1+TKSZ], "127.0.0.1"); s == ses {
+						atomic.AddInt32(&taken, 1)
+					}
+				}
+			}(ses)
+		}
+	}
+	wg.Wait()
+	// every request was granted or refused by the cap
+	if mgr.length() != 0 || int64(taken)/GENERATE_TOKEN_NUM+mgr.hoarded != 16*int64(len(sessions)) {
+		t.Errorf("container=%d taken=%d hoarded=%d", mgr.length(), taken, mgr.hoarded)
+	}
+
+	// the cap held under the concurrent requests
+	mgr.hoarded = 0
+	for _, ses := range sessions {
+		for j := 0; j < 16; j++ {
+			wg.Add(1)
+			go func(ses *Session) {
+				defer wg.Done()
+				mgr.requestTokens(ses, GENERATE_TOKEN_NUM)
+			}(ses)
+		}
+	}
+	wg.Wait()
+	if mgr.length() != 32*len(sessions) || mgr.hoarded != 8*int64(len(sessions)) {
+		t.Errorf("container=%d hoarded=%d", mgr.length(), mgr.hoarded)
+	}
+	for _, ses := range sessions {
+		mgr.clearTokens(ses)
+	}
+
+	// spread over the shards and cleared from all of them
+	var bulk = newTestSession(serv, "bulk")
+	mgr.createTokens(bulk, TOKEN_SHARDS*4)
+	var used int
+	for i := range mgr.shards {
+		if len(mgr.shards[i].container) > 0 {
+			used++
+		}
+	}
+	if used < TOKEN_SHARDS/2 {
+		t.Errorf("tokens were in %d shards", used)
+	}
+	if n := mgr.clearTokens(bulk); n != TOKEN_SHARDS*4 || mgr.length() != 0 {
+		t.Errorf("cleared=%d container=%d", n, mgr.length())
+	}
+}
+
+func TestTokenGrace(t *testing.T) {
+	var (
+		serv   = newTestServer()
+		mgr    = serv.sessionMgr
+		alice  = newTestSession(serv, "alice")
+		tokens = mgr.createTokens(alice, 1)
+		token  = tokens[1 : 1+TKSZ]
+	)
+	mgr.grace = time.Millisecond * 100
+	if s, err := mgr.take(token, "10.0.0.1"); s != alice || err != nil {
+		t.Fatalf("take failed %v", err)
+	}
+	// the reply was lost then retry
+	if s, err := mgr.take(token, "10.0.0.1"); s != alice || err != nil {
+		t.Errorf("retry in grace window failed %v", err)
+	}
+	// another client
+	if s, err := mgr.take(token, "10.0.0.2"); s != nil || err == nil {
+		t.Errorf("double-spend was accepted")
+	}
+	time.Sleep(mgr.grace)
+	if s, err := mgr.take(token, "10.0.0.1"); s != nil || err == nil {
+		t.Errorf("token was reused after grace window")
+	}
+	if mgr.regrants != 1 || mgr.replays != 2 {
+		t.Errorf("regrants=%d replays=%d", mgr.regrants, mgr.replays)
+	}
+	// the session was gone
+	tokens = mgr.createTokens(alice, 1)
+	mgr.take(tokens[1:1+TKSZ], "10.0.0.1")
+	alice.destroy(SESSION_CLOSE_OFFLINE)
+	if s, _ := mgr.take(tokens[1:1+TKSZ], "10.0.0.1"); s != nil {
+		t.Errorf("token of destroyed session was reused")
+	}
+}
+
+func TestTokenBinding(t *testing.T) {
+	var (
+		serv  = newTestServer()
+		mgr   = serv.sessionMgr
+		alice = newTestSession(serv, "alice")
+	)
+	c, s := tcpPair(t)
+	defer c.Close()
+	defer s.Close()
+	alice.indentifySession("alice", NewConn(s.(*net.TCPConn), nil))
+	if alice.cid != "alice@127.0.0.1" || alice.addr != "127.0.0.1" {
+		t.Fatalf("identified as %s %s", alice.cid, alice.addr)
+	}
+	mgr.binding = BIND_TOKENS_IP
+	tokens := mgr.createTokens(alice, 2)
+	token := tokens[1 : 1+TKSZ]
+	taken, err := mgr.take(token, "127.0.0.2")
+	if e, y := err.(*ex.Exception); taken != nil || !y || e.Origin != TOKEN_MISBOUND {
+		t.Errorf("token was taken by other client err=%v", err)
+	}
+	// the owner could still use it
+	if taken, err = mgr.take(token, "127.0.0.1"); taken != alice || err != nil {
+		t.Errorf("take failed %v", err)
+	}
+	mgr.binding = BIND_TOKENS_SUBNET
+	token = tokens[1+TKSZ : 1+TKSZ*2]
+	if taken, _ = mgr.take(token, "127.0.1.1"); taken != nil {
+		t.Errorf("token was taken out of subnet")
+	}
+	if taken, err = mgr.take(token, "127.0.0.2"); taken != alice || err != nil {
+		t.Errorf("take in subnet failed %v", err)
+	}
+	if !strings.Contains(serv.Stats(), "Token-misbound=2") {
+		t.Errorf("unexpected stats %s", serv.Stats())
+	}
+
+	// the states persisted before carry the cid only
+	var p = persistedOf(alice)
+	if p.origin() != "127.0.0.1" {
+		t.Errorf("origin of persisted %s", p.origin())
+	}
+	p.Addr, p.Client = NULL, "alice@[2001:db8::1]"
+	if p.origin() != "2001:db8::1" {
+		t.Errorf("origin of legacy %s", p.origin())
+	}
+
+	for _, c := range []struct {
+		addr, client string
+		binding      string
+		same         bool
+	}{
+		{"2001:db8::1", "2001:db8::1", BIND_TOKENS_IP, true},
+		{"2001:db8::1", "2001:db8::ff", BIND_TOKENS_IP, false},
+		{"2001:db8::1", "2001:db8::ff", BIND_TOKENS_SUBNET, true},
+		{"2001:db8::1", "2001:db8:0:1::1", BIND_TOKENS_SUBNET, false},
+		{"10.0.0.1", "10.0.0.1", BIND_TOKENS_IP, true},
+		{"10.0.0.1", "10.0.0.9", BIND_TOKENS_SUBNET, true},
+		{"10.0.0.1", "2001:db8::1", BIND_TOKENS_SUBNET, false},
+	} {
+		if sameOrigin(c.addr, c.client, c.binding) != c.same {
+			t.Errorf("sameOrigin(%s, %s, %s) != %v", c.addr, c.client, c.binding, c.same)
+		}
+	}
+}
+
+func TestTokenHoarding(t *testing.T) {
+	var (
+		serv  = newTestServer()
+		mgr   = serv.sessionMgr
+		alice = newTestSession(serv, "alice")
+	)
+	mgr.maxTokens = 12
+	mgr.register(alice)
+	mgr.createTokens(alice, 6)
+	if _, err := mgr.requestTokens(alice, GENERATE_TOKEN_NUM); err != nil {
+		t.Fatalf("refused under the cap %v", err)
+	}
+	tokens, err := mgr.requestTokens(alice, GENERATE_TOKEN_NUM)
+	if e, y := err.(*ex.Exception); tokens != nil || !y || e.Origin != TOKENS_HOARDED {
+		t.Errorf("issued past the cap err=%v", err)
+	}
+	// requested by client
+	alice.tokensHandle([]byte{FRAME_ACTION_TOKEN_REQUEST})
+	if n := mgr.tokenCount(alice); n != 10 || mgr.hoarded != 2 {
+		t.Errorf("tokens=%d hoarded=%d", n, mgr.hoarded)
+	}
+	stats := serv.Stats()
+	if !strings.Contains(stats, "User=alice Conn=0 TK=10") || !strings.Contains(stats, "Token-hoarding-refused=2") {
+		t.Errorf("unexpected stats %s", stats)
+	}
+	// consumed then room for more
+	for k := range alice.tokens {
+		mgr.take(k[:TKSZ], "127.0.0.1")
+		break
+	}
+	if _, err = mgr.requestTokens(alice, 3); err != nil {
+		t.Errorf("refused after consumed %v", err)
+	}
+}
+
+func TestTokenPoolOptions(t *testing.T) {
+	var (
+		serv  = newTestServer()
+		alice = newTestSession(serv, "alice")
+	)
+	serv.TokenBatch = 8
+	alice.tokensHandle([]byte{FRAME_ACTION_TOKEN_REQUEST})
+	if n := serv.sessionMgr.tokenCount(alice); n != 8 {
+		t.Errorf("issued tokens=%d", n)
+	}
+
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	conf := &clientConf{
+		Listen:   ":9009",
+		connInfo: &connectionInfo{cipher: "AES128CTR", pkType: NameOfKey(&key.PublicKey), sPubKey: &key.PublicKey},
+	}
+	for floor, expected := range map[int]int{0: TOKENS_FLOOR, 5: 5, TOKEN_FLOOR_MAX + 1: -1} {
+		conf.TokenFloor = floor
+		if err := conf.validate(); (err == nil) != (expected > 0) || expected > 0 && conf.connInfo.tokenFloor != expected {
+			t.Errorf("floor=%d: %d %v", floor, conf.connInfo.tokenFloor, err)
+		}
+	}
+}
+
+func TestTokenMinting(t *testing.T) {
+	for _, legacy := range []bool{false, true} {
+		var (
+			serv  = newTestServer()
+			mgr   = serv.sessionMgr
+			alice = newTestSession(serv, "alice")
+		)
+		mgr.legacyTokens = legacy
+		mgr.register(alice)
+		tokens := mgr.createTokens(alice, 16)
+		if len(tokens) != 1+16*TKSZ || mgr.tokenCount(alice) != 16 {
+			t.Fatalf("legacy=%v len=%d count=%d", legacy, len(tokens), mgr.tokenCount(alice))
+		}
+		for tokens = tokens[1:]; len(tokens) > 0; tokens = tokens[TKSZ:] {
+			if ses, err := mgr.take(tokens[:TKSZ], "127.0.0.1"); ses != alice || err != nil {
+				t.Errorf("legacy=%v take %x: %v", legacy, tokens[:TKSZ], err)
+			}
+		}
+	}
+}
+
+func TestMaxSessionOfPlan(t *testing.T) {
+	var (
+		serv    = newTestServer()
+		reasons = make(chan string, 4)
+		trial   = &auth.User{Name: "trial", Attrs: make(auth.Attributes)}
+		paid    = &auth.User{Name: "paid", Attrs: make(auth.Attributes)}
+	)
+	serv.OnDisconnect(func(info *DisconnectInfo) {
+		reasons <- info.User + ":" + info.Reason
+	})
+	trial.Attrs.Add(UA_MAX_SESSION, "50ms")
+	capped := newTestSession(serv, trial.Name)
+	capped.applyUserPolicy(trial)
+	uncapped := newTestSession(serv, paid.Name)
+	uncapped.applyUserPolicy(paid)
+
+	select {
+	case r := <-reasons:
+		if r != "trial:"+SESSION_CLOSE_PLAN {
+			t.Errorf("unexpected disconnection %s", r)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("capped session was not dropped")
+	}
+	if uncapped.planTimer != nil || atomic.LoadInt32(&uncapped.closed) != 0 {
+		t.Errorf("uncapped session was limited")
+	}
+	if serv.planDrops != 1 || !strings.Contains(serv.Stats(), "Dropped-by-plan=1") {
+		t.Errorf("planDrops=%d", serv.planDrops)
+	}
+}
+
+func TestStartupMode(t *testing.T) {
+	var listen = &net.TCPAddr{IP: net.IPv4zero, Port: 9008}
+	// unloadable filter
+	strict := newTestServer()
+	strict.ListenAddr, strict.DenyDest = listen, "USA"
+	if err := strict.initFilters(); err == nil {
+		t.Errorf("strict mode started in degraded state")
+	}
+
+	strict = newTestServer()
+	strict.ListenAddr, strict.AllowDest = listen, "US,USA"
+	if err := strict.initFilters(); err == nil {
+		t.Errorf("strict mode started without allow-list")
+	}
+
+	lenient := newTestServer()
+	lenient.ListenAddr, lenient.DenyDest, lenient.lenient = listen, "USA", true
+	if err := lenient.initFilters(); err != nil || lenient.filter == nil {
+		t.Errorf("lenient mode failed err=%v", err)
+	}
+}
+
+func TestAllowDest(t *testing.T) {
+	serv := newTestServer()
+	serv.ListenAddr, serv.AllowDest = &net.TCPAddr{IP: net.IPv4zero, Port: 9008}, "us,JP"
+	if err := serv.initFilters(); err != nil {
+		t.Fatal(err)
+	}
+	for host, denied := range map[string]bool{
+		"8.8.8.8:53":             false,
+		"1.2.4.8:53":             true,
+		"[2001:4860::8888]:53":   true,
+		// failed closed by the guard before
+		"not-resolved.invalid:1": true,
+	} {
+		if serv.filter.Filter(host) != denied {
+			t.Errorf("host=%s denied=%v", host, !denied)
+		}
+	}
+}
+
+func TestStreamMeter(t *testing.T) {
+	var (
+		now = time.Unix(1e9, 0)
+		m   = &streamMeter{start: now}
+	)
+	// steady 1000B/s converges to 1000
+	for i := 1; i <= 30; i++ {
+		m.sample(now.Add(time.Duration(i)*time.Second), int64(i*1000))
+	}
+	if r := m.sample(now.Add(time.Second*30), 30000); math.Abs(r-1000) > 10 {
+		t.Errorf("rate=%f", r)
+	}
+	// stalled then decays
+	if r := m.sample(now.Add(time.Second*35), 30000); r > 400 || r <= 0 {
+		t.Errorf("rate=%f after stalled", r)
+	}
+}
+
+func TestDumpStreams(t *testing.T) {
+	var (
+		serv = newTestServer()
+		s    = newTestSession(serv, "alice")
+	)
+	serv.sessionMgr.register(s)
+	defer s.destroy(SESSION_CLOSE_SHUTDOWN)
+	for i, dest := range []string{"a.example:80", "b.example:443"} {
+		c1, c2 := net.Pipe()
+		defer c1.Close()
+		defer c2.Close()
+		edge := s.mux.router.register(fmt.Sprint("key", i), dest, nil, c1, false)
+		edge.rxBytes, edge.txBytes = int64(i*100), int64(i*1000)
+	}
+	data, err := serv.DumpStreams("alice", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var list []*StreamStat
+	if err = json.Unmarshal(data, &list); err != nil || len(list) != 2 {
+		t.Fatalf("list=%s err=%v", data, err)
+	}
+	if st := list[0]; st.Dest != "b.example:443" || st.BytesUp != 100 || st.BytesDown != 1000 {
+		t.Errorf("unexpected stat %+v", st)
+	}
+	text, _ := serv.DumpStreams(NULL, false)
+	if bytes.Count(text, []byte("User=alice")) != 2 {
+		t.Errorf("unexpected text %s", text)
+	}
+	if data, _ = serv.DumpStreams("bob", false); len(data) != 0 {
+		t.Errorf("unexpected streams of bob %s", data)
+	}
+}
+
+func TestDumpStats(t *testing.T) {
+	var (
+		serv  = newTestServer()
+		alice = newTestSession(serv, "alice")
+		bob   = newTestSession(serv, "bob")
+	)
+	for _, s := range []*Session{alice, bob} {
+		serv.sessionMgr.register(s)
+		defer s.destroy(SESSION_CLOSE_SHUTDOWN)
+	}
+	serv.sessionMgr.createTokens(alice, 3)
+	alice.activeCnt = 2
+	alice.mux.rxBytes, alice.mux.txBytes = 100, 1000
+	bob.mux.rxBytes = 10
+	// the stream is counted by registering
+	if !alice.mux.acquireStream() {
+		t.Fatal("stream was refused")
+	}
+	defer alice.mux.releaseStream()
+	dst, rd := net.Pipe()
+	defer rd.Close()
+	alice.mux.router.register("key", "dest:80", nil, dst, false)
+	serv.handshakes = newHandshakeMeter()
+	serv.handshakes.fail(STAGE_AUTH)
+
+	data, err := serv.DumpStats()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var st ServerStats
+	if err = json.Unmarshal(data, &st); err != nil {
+		t.Fatalf("stats=%s err=%v", data, err)
+	}
+	if st.Sessions != 2 || st.Tunnels != 2 || st.Tokens != 3 || st.RxBytes != 110 || st.TxBytes != 1000 ||
+		st.Streams != 1 || st.ActiveStreams != 1 || st.Failures["auth"] != 1 {
+		t.Errorf("unexpected stats %s", data)
+	}
+	if u := st.Users["alice"]; u == nil || u.Sessions != 1 || u.Tunnels != 2 || u.Tokens != 3 || u.ActiveStreams != 1 {
+		t.Errorf("unexpected stats of alice %+v", u)
+	}
+	var text = serv.Stats()
+	for _, line := range []string{
+		"Sessions=2 Tunnels=2 Tokens=3 Rx=110 Tx=1000 Streams=1 Active-streams=1\n",
+		"User=alice Sessions=1 Conn=2 TK=3 Active-streams=1\nUser=bob Sessions=1 Conn=0 TK=0 Active-streams=0\n",
+		"User=alice Conn=2 TK=3 Rx=100 Tx=1000 Active-streams=1",
+	} {
+		if !strings.Contains(text, line) {
+			t.Errorf("%q not in stats %s", line, text)
+		}
+	}
+}
+
+func TestLingerFlush(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	var (
+		payload = make([]byte, 4<<20)
+		result  = make(chan int, 1)
+	)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			result <- -1
+			return
+		}
+		defer conn.Close()
+		// read slowly then the data is buffered in sender
+		time.Sleep(time.Millisecond * 100)
+		n, _ := io.Copy(ioutil.Discard, conn)
+		result <- int(n)
+	}()
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	setLinger(conn, 5)
+	if _, err = conn.Write(payload); err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+	if n := <-result; n != len(payload) {
+		t.Errorf("received=%d expected=%d", n, len(payload))
+	}
+}
+
+func TestMigrateSession(t *testing.T) {
+	// the target records the negotiation from client
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	dialed := make(chan bool, 1)
+	go func() {
+		if conn, err := ln.Accept(); err == nil {
+			dialed <- true
+			conn.Close()
+		}
+	}()
+
+	var (
+		serv   = newTestServer()
+		alice  = newTestSession(serv, "alice")
+		c, s   = tcpPair(t)
+		target = ln.Addr().String()
+	)
+	defer c.Close()
+	serv.sessionMgr.register(alice)
+	if _, err = serv.MigrateSession("alice", NULL); err == nil {
+		t.Errorf("migrated to empty endpoint")
+	}
+	tun := NewConn(s, nullCipherKit)
+	tun.priority = &TSPriority{0, 1e9}
+	alice.mux.pool.Push(tun)
+	if n, err := serv.MigrateSession("alice", target); n != 1 || err != nil {
+		t.Fatalf("noticed=%d err=%v", n, err)
+	}
+	// received by client
+	header := make([]byte, FRAME_HEADER_LEN)
+	if _, err = io.ReadFull(c, header); err != nil {
+		t.Fatal(err)
+	}
+	frm, err := parse_frame(header)
+	if err != nil {
+		t.Fatal(err)
+	}
+	io.ReadFull(c, frm.data)
+	notice := frm.data[:frm.length]
+	if frm.action != FRAME_ACTION_TOKENS || notice[0] != FRAME_ACTION_MIGRATE || string(notice[1:]) != target {
+		t.Fatalf("unexpected notice %s % x", frm, notice)
+	}
+
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	clt := &Client{
+		lock:      new(sync.Mutex),
+		connInfo:  &connectionInfo{sAddr: "127.0.0.1:1", sPubKey: &key.PublicKey, cipher: "AES128CTR"},
+		mux:       newClientMultiplexer(),
+		state:     CLT_WORKING,
+		pendingTK: NewTimedWait(false),
+	}
+	mux := clt.mux
+	clt.eventHandler(evt_tokens, notice)
+	select {
+	case <-dialed:
+	case <-time.After(time.Second * 5):
+		t.Fatalf("client did not connect to %s", target)
+	}
+	// failed to negotiate then stay
+	for i := 0; atomic.LoadInt32(&clt.migrating) != 0; i++ {
+		if i > 100 {
+			t.Fatalf("migration was not finished")
+		}
+		time.Sleep(time.Millisecond * 50)
+	}
+	if clt.connInfo.sAddr != "127.0.0.1:1" || clt.mux != mux {
+		t.Errorf("switched to %s after the failed migration", clt.connInfo.sAddr)
+	}
+}
+
+func TestKickSession(t *testing.T) {
+	var (
+		serv   = newTestServer()
+		mgr    = serv.sessionMgr
+		alice  = newTestSession(serv, "alice")
+		bob    = newTestSession(serv, "bob")
+		c, s   = tcpPair(t)
+		reason = make(chan string, 2)
+	)
+	defer c.Close()
+	serv.tickets = newTicketKeeper([]byte("key"), time.Hour)
+	serv.OnDisconnect(func(info *DisconnectInfo) {
+		reason <- info.Reason
+	})
+	mgr.register(alice)
+	mgr.register(bob)
+	tokens := mgr.createTokens(alice, 2)
+	mgr.createTokens(bob, 2)
+	ticket, _ := serv.tickets.issue(alice)
+	tun := NewConn(s, nullCipherKit)
+	tun.priority = &TSPriority{0, 1e9}
+	alice.mux.pool.Push(tun)
+
+	if n := serv.KickSession(NULL); n != 0 {
+		t.Errorf("kicked all sessions=%d", n)
+	}
+	if n := serv.KickSession("alice"); n != 1 {
+		t.Fatalf("kicked=%d", n)
+	}
+	if r := <-reason; r != SESSION_CLOSE_KICKED {
+		t.Errorf("unexpected reason %s", r)
+	}
+	// tunnels dropped, tokens cleared and ticket revoked
+	c.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := c.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("tunnel was not dropped err=%v", err)
+	}
+	if s, _ := mgr.take(tokens[1:1+TKSZ], "127.0.0.1"); s != nil || mgr.tokenCount(alice) != 0 {
+		t.Errorf("token of kicked session was taken")
+	}
+	if _, err := serv.tickets.open(ticket); err == nil {
+		t.Errorf("ticket of kicked session was opened")
+	}
+	if len(mgr.lookup("alice")) != 0 || len(mgr.lookup("bob")) != 1 || mgr.tokenCount(bob) != 2 {
+		t.Errorf("unexpected sessions after kicked")
+	}
+}
@@ -0,0 +1,96 @@
+package tunnel
+
+import (
+	"fmt"
+	"net"
+	"sync/atomic"
+	"time"
+
+	log "github.com/Lafeng/deblocus/glog"
+)
+
+const (
+	// the skew beyond tolerance is still detected in such more steps
+	SKEW_DETECT_STEPS = 5
+	SKEW_MAX          = time.Hour
+)
+
+// the time counters of now within steps
+// cur, prev1, next1, prev2, next2...
+func timeCounters(now time.Time, steps int) []uint64 {
+	var (
+		tc  = make([]uint64, steps<<1+1)
+		cur = uint64(now.Unix() / TIME_STEP)
+	)
+	tc[0] = cur
+	for i := 1; i <= steps; i++ {
+		tc[i<<1-1] = cur - uint64(i)
+		tc[i<<1] = cur + uint64(i)
+	}
+	return tc
+}
+
+// the skew in steps of the matched time counter, the client is ahead if > 0
+func skewOfCounter(index int) int {
+	if index&1 == 1 {
+		return -((index + 1) >> 1)
+	}
+	return index >> 1
+}
+
+// --------------------
+// skewMeter
+// --------------------
+// the clock skew of client is detected by the matched time counter of hello,
+// and the tolerance is applied to every verification based on client clock.
+type skewMeter struct {
+	skewed    int64 // accepted with skew
+	rejected  int64 // beyond tolerance
+	max       int32 // the largest absolute skew in steps
+	tolerance int   // steps
+}
+
+func newSkewMeter(tolerance int) *skewMeter {
+	return &skewMeter{tolerance: tolerance}
+}
+
+// the counters should be verified with, including the detection margin
+func (m *skewMeter) counters(now time.Time) []uint64 {
+	return timeCounters(now, m.tolerance+SKEW_DETECT_STEPS)
+}
+
+// return true if the skew of matched counter is tolerable
+func (m *skewMeter) check(index int, client net.Addr) bool {
+	skew := skewOfCounter(index)
+	abs := skew
+	if abs < 0 {
+		abs = -abs
+	}
+	if m == nil {
+		return abs <= TIME_ERROR
+	}
+	for {
+		max := atomic.LoadInt32(&m.max)
+		if int32(abs) <= max || atomic.CompareAndSwapInt32(&m.max, max, int32(abs)) {
+			break
+		}
+	}
+	if abs > m.tolerance {
+		atomic.AddInt64(&m.rejected, 1)
+		log.Warningf("Rejected client=%s with clock skew %+ds beyond tolerance", client, skew*TIME_STEP)
+		return false
+	}
+	if abs > 0 {
+		atomic.AddInt64(&m.skewed, 1)
+		if log.V(log.LV_WARN) {
+			log.Warningf("Clock skew of client=%s is %+ds", client, skew*TIME_STEP)
+		}
+	}
+	return true
+}
+
+func (m *skewMeter) String() string {
+	return fmt.Sprintf("Clock-skewed=%d Skew-rejected=%d Max-skew=%ds Skew-tolerance=%ds",
+		atomic.LoadInt64(&m.skewed), atomic.LoadInt64(&m.rejected),
+		atomic.LoadInt32(&m.max)*TIME_STEP, m.tolerance*TIME_STEP)
+}
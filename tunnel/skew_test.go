@@ -0,0 +1,63 @@
+package tunnel
+
+import (
+	"encoding/binary"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dchest/siphash"
+)
+
+// the hello of client whose clock is ahead by steps
+func skewedHello(sp []byte, steps int) []byte {
+	_, _, hk := extractKeys(sp)
+	head := makeDbcHello(1, sp)
+	tc := uint64(time.Now().Unix()/TIME_STEP + int64(steps))
+	binary.BigEndian.PutUint64(head[DPH_LEN1:], siphash.Hash(hk, tc, head[:DPH_LEN1]))
+	return head
+}
+
+func TestTimeCounters(t *testing.T) {
+	var now = time.Unix(1e9, 0)
+	tc := timeCounters(now, 2)
+	for i, skew := range []int{0, -1, 1, -2, 2} {
+		if skewOfCounter(i) != skew || tc[i] != uint64(now.Unix()/TIME_STEP+int64(skew)) {
+			t.Errorf("counter[%d]=%d skew=%d", i, tc[i], skewOfCounter(i))
+		}
+	}
+}
+
+func TestSkewTolerance(t *testing.T) {
+	var (
+		sp     = randArray(16)
+		client = &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)}
+		m      = newSkewMeter(2)
+		tc     = m.counters(time.Now())
+	)
+	for steps, accepted := range map[int]bool{
+		0:                          true,
+		-2:                         true,
+		2:                          true,
+		3:                          false,
+		-2 - SKEW_DETECT_STEPS:     false,
+		2 + SKEW_DETECT_STEPS + 1:  false, // undetectable
+		-2 - SKEW_DETECT_STEPS - 1: false,
+	} {
+		index, _, _ := matchDbcHello(skewedHello(sp, steps), sp, tc)
+		if ok := index >= 0 && m.check(index, client); ok != accepted {
+			t.Errorf("skew=%d index=%d accepted=%v", steps, index, ok)
+		}
+	}
+	stats := m.String()
+	if !strings.Contains(stats, "Clock-skewed=2 Skew-rejected=2 Max-skew=420s") {
+		t.Errorf("unexpected stats %s", stats)
+	}
+	// the default tolerance is consistent with the client
+	var defaults *skewMeter
+	index, _, _ := matchDbcHello(skewedHello(sp, TIME_ERROR), sp, tc)
+	if !defaults.check(index, client) {
+		t.Errorf("default tolerance was not applied")
+	}
+}
@@ -0,0 +1,171 @@
+package tunnel
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"strings"
+	"sync/atomic"
+
+	log "github.com/Lafeng/deblocus/glog"
+)
+
+const (
+	STREAM_HTTP = iota
+	STREAM_TLS
+	STREAM_SSH
+	STREAM_RAW
+	// behaviors of protocols
+	SNIFF_HTTP_XFF = "http-xff" // add X-Forwarded-For to the first request
+	SNIFF_TLS_SNI  = "tls-sni"  // log server name of ClientHello
+	SNIFF_SSH_LOG  = "ssh-log"  // log the banner of ssh client
+	// only the prefix of first frame is inspected
+	SNIFF_PREFIX_MAX = 4096
+)
+
+var (
+	protocolNames = []string{"http", "tls", "ssh", "raw"}
+	httpMethods   = []string{"GET ", "POST ", "HEAD ", "PUT ", "DELETE ", "OPTIONS ", "PATCH ", "CONNECT "}
+)
+
+// --------------------
+// protocolSniffer
+// --------------------
+// detect the protocol of stream from the first frame sent to destination,
+// the bytes will be forwarded as is except the configured rewriting.
+type protocolSniffer struct {
+	counts [4]int64
+	xff    bool
+	sni    bool
+	ssh    bool
+}
+
+// behaviors: comma-separated
+func newProtocolSniffer(behaviors string) (*protocolSniffer, error) {
+	var s = new(protocolSniffer)
+	for _, b := range strings.Split(behaviors, ",") {
+		switch strings.TrimSpace(b) {
+		case SNIFF_HTTP_XFF:
+			s.xff = true
+		case SNIFF_TLS_SNI:
+			s.sni = true
+		case SNIFF_SSH_LOG:
+			s.ssh = true
+		case NULL:
+		default:
+			return nil, CONF_ERROR.Apply("Sniff " + b)
+		}
+	}
+	return s, nil
+}
+
+func sniffProtocol(prefix []byte) int {
+	switch {
+	// handshake record of TLS 1.x
+	case len(prefix) > 5 && prefix[0] == 0x16 && prefix[1] == 3:
+		return STREAM_TLS
+	case bytes.HasPrefix(prefix, []byte("SSH-")):
+		return STREAM_SSH
+	}
+	for _, m := range httpMethods {
+		if bytes.HasPrefix(prefix, []byte(m)) {
+			return STREAM_HTTP
+		}
+	}
+	return STREAM_RAW
+}
+
+// inspect the first data to destination, and return the data to send
+func (s *protocolSniffer) inspect(e *edgeConn, data []byte) []byte {
+	var prefix = data
+	if len(prefix) > SNIFF_PREFIX_MAX {
+		prefix = prefix[:SNIFF_PREFIX_MAX]
+	}
+	proto := sniffProtocol(prefix)
+	atomic.AddInt64(&s.counts[proto], 1)
+
+	switch proto {
+	case STREAM_HTTP:
+		if s.xff && e.tun != nil {
+			host, _, _ := net.SplitHostPort(e.tun.RemoteAddr().String())
+			return insertHeader(data, "X-Forwarded-For: "+host)
+		}
+	case STREAM_TLS:
+		if s.sni {
+			log.Infof("TLS %s SNI=%s for %s", e.dest[2:], parseSNI(prefix), e.key)
+		}
+	case STREAM_SSH:
+		if s.ssh {
+			banner, _ := SubstringBefore(string(prefix), "\r\n")
+			log.Infof("SSH %s banner=%q for %s", e.dest[2:], banner, e.key)
+		}
+	}
+	return data
+}
+
+// insert the header after the request line
+func insertHeader(data []byte, header string) []byte {
+	var i = bytes.Index(data, []byte("\r\n"))
+	if i < 0 || i > SNIFF_PREFIX_MAX {
+		return data
+	}
+	i += 2
+	var buf = make([]byte, 0, len(data)+len(header)+2)
+	buf = append(buf, data[:i]...)
+	buf = append(buf, header...)
+	buf = append(buf, "\r\n"...)
+	return append(buf, data[i:]...)
+}
+
+// the server_name extension of ClientHello, or empty if absent or truncated
+func parseSNI(record []byte) string {
+	// record header(5), handshake header(4), version(2), random(32)
+	var p = 5 + 4 + 2 + 32
+	var next = func(lenBytes int) []byte {
+		if p+lenBytes > len(record) {
+			return nil
+		}
+		var n int
+		for _, b := range record[p : p+lenBytes] {
+			n = n<<8 | int(b)
+		}
+		if p += lenBytes; p+n > len(record) {
+			return nil
+		}
+		p += n
+		return record[p-n : p]
+	}
+	if len(record) < p || record[5] != 1 { // client_hello
+		return NULL
+	}
+	// session id, cipher suites, compression methods
+	if next(1) == nil || next(2) == nil || next(1) == nil {
+		return NULL
+	}
+	exts := next(2)
+	for len(exts) >= 4 {
+		typ := binary.BigEndian.Uint16(exts)
+		n := int(binary.BigEndian.Uint16(exts[2:]))
+		if 4+n > len(exts) {
+			break
+		}
+		// server_name: list len(2), type(1)=host_name, len(2), name
+		if body := exts[4 : 4+n]; typ == 0 && len(body) > 5 && body[2] == 0 {
+			if l := int(binary.BigEndian.Uint16(body[3:])); 5+l <= len(body) {
+				return string(body[5 : 5+l])
+			}
+		}
+		exts = exts[4+n:]
+	}
+	return NULL
+}
+
+func (s *protocolSniffer) String() string {
+	var buf = new(bytes.Buffer)
+	buf.WriteString("Sniffed")
+	for i, name := range protocolNames {
+		fmt.Fprintf(buf, " %s=%d", name, atomic.LoadInt64(&s.counts[i]))
+	}
+	return buf.String()
+}
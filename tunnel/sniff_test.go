@@ -0,0 +1,114 @@
+package tunnel
+
+import (
+	"crypto/tls"
+	"io"
+	"io/ioutil"
+	"net"
+	"testing"
+)
+
+// the first record of a real ClientHello
+func clientHello(t *testing.T, serverName string) []byte {
+	c1, c2 := net.Pipe()
+	defer c2.Close()
+	go func() {
+		defer c1.Close()
+		tls.Client(c1, &tls.Config{ServerName: serverName}).Handshake()
+	}()
+	header := make([]byte, 5)
+	if _, err := io.ReadFull(c2, header); err != nil {
+		t.Fatal(err)
+	}
+	body := make([]byte, int(header[3])<<8|int(header[4]))
+	if _, err := io.ReadFull(c2, body); err != nil {
+		t.Fatal(err)
+	}
+	return append(header, body...)
+}
+
+func TestSniffProtocol(t *testing.T) {
+	hello := clientHello(t, "example.com")
+	for proto, data := range map[int][]byte{
+		STREAM_HTTP: []byte("GET / HTTP/1.1\r\nHost: example.com\r\n\r\n"),
+		STREAM_TLS:  hello,
+		STREAM_SSH:  []byte("SSH-2.0-OpenSSH_7.4\r\n"),
+		STREAM_RAW:  []byte("\x05\x01\x00"),
+	} {
+		if p := sniffProtocol(data); p != proto {
+			t.Errorf("detected %s expected %s", protocolNames[p], protocolNames[proto])
+		}
+	}
+	if sni := parseSNI(hello); sni != "example.com" {
+		t.Errorf("sni=%q", sni)
+	}
+	// truncated
+	if sni := parseSNI(hello[:60]); sni != NULL {
+		t.Errorf("sni=%q of truncated hello", sni)
+	}
+}
+
+func TestSniffHandling(t *testing.T) {
+	if _, err := newProtocolSniffer("http-xff,ftp-log"); err == nil {
+		t.Errorf("expected error of unknown behavior")
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		if c, err := ln.Accept(); err == nil {
+			defer c.Close()
+			io.Copy(ioutil.Discard, c)
+		}
+	}()
+	raw, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer raw.Close()
+
+	var (
+		mux    = newServerMultiplexer()
+		tun    = NewConn(raw, nullCipherKit)
+		hello  = clientHello(t, "example.com")
+		ssh    = []byte("SSH-2.0-OpenSSH_7.4\r\n")
+		get    = "GET / HTTP/1.1\r\nHost: example.com\r\n\r\n"
+		second = "GET /next HTTP/1.1\r\n\r\n"
+	)
+	defer mux.destroy()
+	mux.sniffer, _ = newProtocolSniffer("http-xff, tls-sni, ssh-log")
+	for _, data := range [][]byte{[]byte(get), hello, ssh, {0, 1, 2}} {
+		dst, rd := net.Pipe()
+		edge := newEdgeConn(mux, "key", "example.com:80", tun, dst)
+		received := make(chan []byte, 1)
+		go func() {
+			buf, _ := ioutil.ReadAll(rd)
+			received <- buf
+		}()
+		frames := []string{string(data)}
+		if data[0] == 'G' {
+			frames = append(frames, second)
+		}
+		for _, f := range frames {
+			if sendFrame(&frame{data: []byte(f), length: uint16(len(f)), conn: edge}) {
+				t.Fatal("sendFrame failed")
+			}
+		}
+		dst.Close()
+		out := string(<-received)
+		if data[0] == 'G' {
+			// only the first request
+			expected := "GET / HTTP/1.1\r\nX-Forwarded-For: 127.0.0.1\r\nHost: example.com\r\n\r\n" + second
+			if out != expected {
+				t.Errorf("unexpected http %q", out)
+			}
+		} else if out != string(data) {
+			t.Errorf("data was changed %q", out)
+		}
+	}
+	if s := mux.sniffer.String(); s != "Sniffed http=1 tls=1 ssh=1 raw=1" {
+		t.Errorf("unexpected stats %s", s)
+	}
+}
@@ -0,0 +1,86 @@
+package tunnel
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// response style to the probes
+	TARPIT_OFF  = "off"
+	TARPIT_SLOW = "slow" // hold silently then close
+	TARPIT_TLS  = "tls"  // alert of handshake failure like a TLS server
+	TARPIT_HTTP = "http" // bad request like a web server
+	// bounds of holding the probes
+	TARPIT_DELAY     = time.Second * 10
+	TARPIT_DELAY_MAX = time.Minute * 2
+	TARPIT_MAX       = 64
+	TARPIT_DRAIN_MAX = 64 << 10
+)
+
+var (
+	// fatal alert: handshake_failure
+	tarpitTLSAlert  = []byte{0x15, 0x03, 0x01, 0x00, 0x02, 0x02, 0x28}
+	tarpitHTTPReply = []byte("HTTP/1.1 400 Bad Request\r\nContent-Type: text/html\r\n" +
+		"Content-Length: 0\r\nConnection: close\r\n\r\n")
+)
+
+// --------------------
+// tarpit
+// --------------------
+// hold the connections failed at the first stage of negotiation for a while,
+// and then give a benign response, to make the scanning costly and no
+// distinctive instant close. the trapped connections are limited by capacity,
+// beyond that they will be closed as before.
+type tarpit struct {
+	trapped  int64
+	bypassed int64 // at capacity
+	style    string
+	delay    time.Duration
+	slots    chan bool
+}
+
+func newTarpit(style string, delay time.Duration, capacity int) *tarpit {
+	return &tarpit{
+		style: style,
+		delay: delay,
+		slots: make(chan bool, capacity),
+	}
+}
+
+// return false if at capacity
+func (p *tarpit) trap(conn net.Conn) bool {
+	select {
+	case p.slots <- true:
+		defer func() { <-p.slots }()
+	default:
+		atomic.AddInt64(&p.bypassed, 1)
+		return false
+	}
+	atomic.AddInt64(&p.trapped, 1)
+	// discard the input until deadline, or peer gave up
+	conn.SetReadDeadline(time.Now().Add(p.delay))
+	io.Copy(ioutil.Discard, io.LimitReader(conn, TARPIT_DRAIN_MAX))
+
+	var reply []byte
+	switch p.style {
+	case TARPIT_TLS:
+		reply = tarpitTLSAlert
+	case TARPIT_HTTP:
+		reply = tarpitHTTPReply
+	}
+	if reply != nil {
+		conn.SetWriteDeadline(time.Now().Add(GENERAL_SO_TIMEOUT))
+		conn.Write(reply)
+	}
+	return true
+}
+
+func (p *tarpit) String() string {
+	return fmt.Sprintf("Tarpitted=%d Tarpit-bypassed=%d",
+		atomic.LoadInt64(&p.trapped), atomic.LoadInt64(&p.bypassed))
+}
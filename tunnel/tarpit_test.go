@@ -0,0 +1,72 @@
+package tunnel
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// return the reply of tarpit and the elapsed time
+func probeTarpit(p *tarpit) ([]byte, time.Duration) {
+	client, server := net.Pipe()
+	defer client.Close()
+	go func() {
+		defer server.Close()
+		p.trap(server)
+	}()
+	start := time.Now()
+	client.Write([]byte("GET / HTTP/1.1\r\n\r\n"))
+	reply, _ := ioutil.ReadAll(client)
+	return reply, time.Since(start)
+}
+
+func TestTarpitStyles(t *testing.T) {
+	var delay = time.Millisecond * 100
+	for style, expected := range map[string][]byte{
+		TARPIT_SLOW: nil,
+		TARPIT_TLS:  tarpitTLSAlert,
+		TARPIT_HTTP: tarpitHTTPReply,
+	} {
+		p := newTarpit(style, delay, 1)
+		reply, elapsed := probeTarpit(p)
+		if !bytes.Equal(reply, expected) {
+			t.Errorf("%s: unexpected reply %q", style, reply)
+		}
+		if elapsed < delay {
+			t.Errorf("%s: released in %s", style, elapsed)
+		}
+		if !strings.Contains(p.String(), "Tarpitted=1") {
+			t.Errorf("%s: unexpected stats %s", style, p)
+		}
+	}
+}
+
+func TestTarpitCapacity(t *testing.T) {
+	var (
+		p      = newTarpit(TARPIT_SLOW, time.Second, 1)
+		c1, s1 = net.Pipe()
+		c2, s2 = net.Pipe()
+		done   = make(chan bool, 1)
+	)
+	defer c1.Close()
+	defer c2.Close()
+	go func() {
+		done <- p.trap(s1)
+	}()
+	time.Sleep(time.Millisecond * 50)
+	start := time.Now()
+	if p.trap(s2) || time.Since(start) > time.Millisecond*50 {
+		t.Errorf("trapped beyond capacity")
+	}
+	// the peer gave up
+	c1.Close()
+	if !<-done {
+		t.Errorf("first probe was not trapped")
+	}
+	if !strings.Contains(p.String(), "Tarpitted=1 Tarpit-bypassed=1") {
+		t.Errorf("unexpected stats %s", p)
+	}
+}
@@ -0,0 +1,177 @@
+package tunnel
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/Lafeng/deblocus/exception"
+)
+
+const (
+	// the spent and revoked are swept after growing over it
+	SPENT_TICKETS_MAX = 4096
+	// random of client to set up the cipher of resumed tun
+	TICKET_RAND_LEN = 16
+	// the state is padded to the multiple of it, against telling the
+	// tickets apart by the length
+	TICKET_PAD_SIZE = 512
+)
+
+var (
+	TICKET_INVALID = exception.New("Invalid ticket")
+)
+
+type sessionTicket struct {
+	persistedSession
+	Expiry time.Time
+}
+
+// --------------------
+// ticketKeeper
+// --------------------
+// the state of session is sealed into a ticket issued at the end of
+// negotiation, so the client could re-establish the session destroyed by a
+// network blip in a single round trip instead of the DH and identity exchange.
+// the ticket is sealed by AES-GCM with the key derived from the private key
+// of server, valid in the ttl and spent once. the key of session is reused as
+// the resumption by tokens, so the forward secrecy is bounded by the ttl.
+// the spent tickets are remembered until expired rather than evicted, the
+// issued in ttl bound them.
+type ticketKeeper struct {
+	issued  int64
+	resumed int64
+	refused int64
+	ttl     time.Duration
+	aead    cipher.AEAD
+	spent   *expirySet // nonce of the ticket
+	revoked *expirySet // sha256 of the key of session
+}
+
+func newTicketKeeper(secret []byte, ttl time.Duration) *ticketKeeper {
+	var key = sha256.Sum256(append([]byte("session-ticket:"), secret...))
+	block, _ := aes.NewCipher(key[:])
+	aead, _ := cipher.NewGCM(block)
+	return &ticketKeeper{
+		ttl:     ttl,
+		aead:    aead,
+		spent:   newExpirySet(),
+		revoked: newExpirySet(),
+	}
+}
+
+func (k *ticketKeeper) issue(s *Session) ([]byte, error) {
+	var ticket = &sessionTicket{*persistedOf(s), time.Now().Add(k.ttl)}
+	plain, err := json.Marshal(ticket)
+	if err != nil {
+		return nil, err
+	}
+	// the trailing spaces are ignored by json
+	if pad := len(plain) % TICKET_PAD_SIZE; pad > 0 {
+		plain = append(plain, bytes.Repeat([]byte{' '}, TICKET_PAD_SIZE-pad)...)
+	}
+	var nonce = make([]byte, k.aead.NonceSize())
+	if _, err = io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+	atomic.AddInt64(&k.issued, 1)
+	return k.aead.Seal(nonce, nonce, plain, nil), nil
+}
+
+// the state of unexpired ticket, then the ticket is spent
+func (k *ticketKeeper) open(sealed []byte) (*sessionTicket, error) {
+	var n = k.aead.NonceSize()
+	if len(sealed) < n {
+		atomic.AddInt64(&k.refused, 1)
+		return nil, TICKET_INVALID.Apply("truncated")
+	}
+	plain, err := k.aead.Open(nil, sealed[:n], sealed[n:], nil)
+	if err != nil {
+		atomic.AddInt64(&k.refused, 1)
+		return nil, TICKET_INVALID.Apply(err)
+	}
+	var ticket = new(sessionTicket)
+	if err = json.Unmarshal(plain, ticket); err != nil {
+		atomic.AddInt64(&k.refused, 1)
+		return nil, TICKET_INVALID.Apply(err)
+	}
+	if time.Now().After(ticket.Expiry) {
+		atomic.AddInt64(&k.refused, 1)
+		return nil, TICKET_INVALID.Apply("expired")
+	}
+	if k.isRevoked(ticket.Key) {
+		atomic.AddInt64(&k.refused, 1)
+		return nil, TICKET_INVALID.Apply("revoked")
+	}
+	if !k.spent.add(string(sealed[:n]), ticket.Expiry) {
+		atomic.AddInt64(&k.refused, 1)
+		return nil, TICKET_INVALID.Apply("replayed")
+	}
+	atomic.AddInt64(&k.resumed, 1)
+	return ticket, nil
+}
+
+// the tickets issued to the session are refused until expired
+func (k *ticketKeeper) revoke(key []byte) {
+	sum := sha256.Sum256(key)
+	k.revoked.add(string(sum[:]), time.Now().Add(k.ttl))
+}
+
+func (k *ticketKeeper) isRevoked(key []byte) bool {
+	sum := sha256.Sum256(key)
+	return k.revoked.has(string(sum[:]))
+}
+
+func (k *ticketKeeper) String() string {
+	return fmt.Sprintf("Tickets-issued=%d Tickets-resumed=%d Tickets-refused=%d",
+		atomic.LoadInt64(&k.issued), atomic.LoadInt64(&k.resumed), atomic.LoadInt64(&k.refused))
+}
+
+// --------------------
+// expirySet
+// --------------------
+// the keys are kept until expired, and swept after the set doubled.
+type expirySet struct {
+	keys    map[string]time.Time
+	sweepAt int
+	lock    sync.Mutex
+}
+
+func newExpirySet() *expirySet {
+	return &expirySet{keys: make(map[string]time.Time), sweepAt: SPENT_TICKETS_MAX}
+}
+
+// false if the key was there
+func (e *expirySet) add(key string, expiry time.Time) bool {
+	var now = time.Now()
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	if t, y := e.keys[key]; y && now.Before(t) {
+		return false
+	}
+	if len(e.keys) >= e.sweepAt {
+		for k, t := range e.keys {
+			if !now.Before(t) {
+				delete(e.keys, k)
+			}
+		}
+		e.sweepAt = maxInt(SPENT_TICKETS_MAX, len(e.keys)*2)
+	}
+	e.keys[key] = expiry
+	return true
+}
+
+func (e *expirySet) has(key string) bool {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	t, y := e.keys[key]
+	return y && time.Now().Before(t)
+}
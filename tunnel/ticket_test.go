@@ -0,0 +1,156 @@
+package tunnel
+
+import (
+	stdcrypto "crypto"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTicketKeeper(t *testing.T) {
+	var (
+		serv  = newTestServer()
+		k     = newTicketKeeper([]byte("key"), time.Hour)
+		alice = newTestSession(serv, "alice")
+	)
+	alice.tokenSize, alice.protocol, alice.caps = TKSZ_LONG, PROTOCOL_V2, CAP_TICKET
+	sealed, err := k.issue(alice)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(sealed), "alice") {
+		t.Errorf("ticket was not sealed")
+	}
+	// the length is independent of the state
+	alice.uid, alice.label = strings.Repeat("a", 64), "mobile"
+	if other, _ := k.issue(alice); len(other) != len(sealed) || (len(sealed)-k.aead.NonceSize()-k.aead.Overhead())%TICKET_PAD_SIZE != 0 {
+		t.Errorf("ticket of %d bytes and %d bytes", len(sealed), len(other))
+	}
+	alice.uid, alice.label = "alice", NULL
+	ticket, err := k.open(sealed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ticket.User != "alice" || ticket.TokenSize != TKSZ_LONG || ticket.Caps != CAP_TICKET ||
+		string(ticket.Key) != string(alice.cipherFactory.key) {
+		t.Errorf("unexpected ticket %+v", ticket.persistedSession)
+	}
+	// replayed, tampered, sealed by other key, or expired
+	if _, err = k.open(sealed); err == nil {
+		t.Errorf("replayed ticket was opened")
+	}
+	sealed, _ = k.issue(alice)
+	sealed[len(sealed)-1] ^= 1
+	if _, err = k.open(sealed); err == nil {
+		t.Errorf("tampered ticket was opened")
+	}
+	sealed, _ = newTicketKeeper([]byte("other"), time.Hour).issue(alice)
+	if _, err = k.open(sealed); err == nil {
+		t.Errorf("ticket of other key was opened")
+	}
+	sealed, _ = newTicketKeeper([]byte("key"), -time.Second).issue(alice)
+	if _, err = k.open(sealed); err == nil {
+		t.Errorf("expired ticket was opened")
+	}
+	if s := k.String(); !strings.Contains(s, "Tickets-issued=3 Tickets-resumed=1 Tickets-refused=4") {
+		t.Errorf("unexpected stats %s", s)
+	}
+}
+
+// the spent are not forgotten until expired
+func TestExpirySet(t *testing.T) {
+	var (
+		e   = newExpirySet()
+		now = time.Now()
+	)
+	if !e.add("spent", now.Add(time.Hour)) || e.add("spent", now.Add(time.Hour)) {
+		t.Fatalf("added twice")
+	}
+	e.add("expired", now.Add(-time.Second))
+	for i := 0; i < SPENT_TICKETS_MAX; i++ {
+		e.add(strconv.Itoa(i), now.Add(time.Hour))
+	}
+	if !e.has("spent") || e.has("expired") || len(e.keys) != SPENT_TICKETS_MAX+1 {
+		t.Errorf("keys=%d", len(e.keys))
+	}
+}
+
+// the session destroyed by server was revived in a single round trip
+func TestTicketResumption(t *testing.T) {
+	priv, _ := GenerateDSAKey("ED25519")
+	pub := priv.(stdcrypto.Signer).Public()
+	serv := newHandshakeServer(t)
+	serv.privateKey = priv
+	serv.sharedKey = preSharedKey(pub)
+	serv.tickets = newTicketKeeper([]byte("key"), time.Hour)
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	var (
+		info = &connectionInfo{sPubKey: pub, user: "alice", pass: "secret", sAddr: ln.Addr().String()}
+		p    = new(tunParams)
+	)
+	if _, err = exchangeKeys(t, serv, info, p); err != nil {
+		t.Fatal(err)
+	}
+	if p.caps&CAP_TICKET == 0 || len(p.ticket) == 0 {
+		t.Fatalf("ticket was not issued caps=%b", p.caps)
+	}
+	for _, s := range serv.sessionMgr.lookup("alice") {
+		s.destroy(SESSION_CLOSE_OFFLINE)
+	}
+
+	type served struct {
+		ses  *Session
+		conn *Conn
+		err  error
+	}
+	var resume = func(ticket []byte) (*tunParams, *Conn, served, error) {
+		var done = make(chan served, 1)
+		go func() {
+			s, err := ln.Accept()
+			if err != nil {
+				done <- served{err: err}
+				return
+			}
+			conn := NewConn(s, nullCipherKit)
+			sman := &d5sman{Server: serv, clientAddr: s.RemoteAddr()}
+			ses, err := sman.Connect(conn, calculateTimeCounter(true))
+			if err != nil {
+				s.Close()
+			}
+			done <- served{ses, conn, err}
+		}()
+		np := &tunParams{cipherFactory: p.cipherFactory, protocol: p.protocol}
+		conn, err := (&d5cman{connectionInfo: info}).ResumeTicket(np, ticket)
+		return np, conn, <-done, err
+	}
+
+	np, conn, sv, err := resume(p.ticket)
+	if err != nil || sv.err != nil || sv.ses.uid != "alice" {
+		t.Fatalf("resume failed %v %v", err, sv.err)
+	}
+	defer conn.Close()
+	defer sv.conn.Close()
+	// the ciphers of both
+	conn.Write([]byte("ping"))
+	var buf = make([]byte, 4)
+	if _, err = io.ReadFull(sv.conn, buf); err != nil || string(buf) != "ping" {
+		t.Errorf("unexpected %q %v", buf, err)
+	}
+	if len(np.ticket) == 0 || string(np.ticket) == string(p.ticket) || len(np.token) == 0 {
+		t.Errorf("ticket=%d tokens=%d", len(np.ticket), len(np.token))
+	}
+	if ses, err := serv.sessionMgr.take(np.token[:np.tokenSize], "127.0.0.1"); ses != sv.ses {
+		t.Errorf("token of revived session was refused %v", err)
+	}
+	// single-use
+	if _, _, sv, err = resume(p.ticket); err == nil || sv.err != VALIDATION_FAILED {
+		t.Errorf("replayed ticket was accepted %v %v", err, sv.err)
+	}
+}
@@ -0,0 +1,138 @@
+package tunnel
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"io"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	STOKEN_EXPIRY_LEN = 4
+	STOKEN_NONCE_LEN  = 8 // sid~4 | random~4
+	STOKEN_MAC_OFFSET = STOKEN_EXPIRY_LEN + STOKEN_NONCE_LEN
+)
+
+// --------------------
+// statelessTokens
+// --------------------
+// the tokens signed by the secret instead of the entries of the container,
+// so any process of the same key could validate them without the shared
+// state of tokens. the session is looked up by the id in nonce, or revived
+// from the TokenStore if set, where the state of session is kept by the id
+// until destroyed, so the processes or hosts of the same key share them.
+// expiry~4 | nonce~8 | hmac(secret, uid|expiry|nonce)~rest
+// the spent tokens are remembered by each process until expired, and marked
+// in the TokenStore if set, otherwise a token could be spent once on every
+// process. the issued are held by the session for MaxTokens until expired.
+type statelessTokens struct {
+	secret []byte
+	ttl    time.Duration
+}
+
+func newStatelessTokens(secret []byte, ttl time.Duration) *statelessTokens {
+	var key = sha256.Sum256(append([]byte("stateless-token:"), secret...))
+	return &statelessTokens{secret: key[:], ttl: ttl}
+}
+
+func (t *statelessTokens) sign(uid string, token []byte) []byte {
+	mac := hmac.New(sha256.New, t.secret)
+	mac.Write([]byte(uid))
+	mac.Write(token[:STOKEN_MAC_OFFSET])
+	return mac.Sum(nil)[:len(token)-STOKEN_MAC_OFFSET]
+}
+
+// fill the token of session
+func (t *statelessTokens) mint(session *Session, token []byte) error {
+	var expiry = time.Now().Add(t.ttl).Unix()
+	binary.BigEndian.PutUint32(token, uint32(expiry))
+	binary.BigEndian.PutUint32(token[STOKEN_EXPIRY_LEN:], session.sid)
+	if _, err := io.ReadFull(rand.Reader, token[STOKEN_EXPIRY_LEN+4:STOKEN_MAC_OFFSET]); err != nil {
+		return err
+	}
+	copy(token[STOKEN_MAC_OFFSET:], t.sign(session.uid, token))
+	return nil
+}
+
+// the id of session in the unexpired token, or false
+func (t *statelessTokens) idOf(token []byte) (uint32, bool) {
+	if len(token) < TKSZ {
+		return 0, false
+	}
+	var expiry = time.Unix(int64(binary.BigEndian.Uint32(token)), 0)
+	return binary.BigEndian.Uint32(token[STOKEN_EXPIRY_LEN:]), !time.Now().After(expiry)
+}
+
+// the unexpired session of token signed by the secret, or nil
+func (t *statelessTokens) verify(token []byte, sessions map[uint32]*Session) (*Session, time.Time) {
+	sid, valid := t.idOf(token)
+	if !valid {
+		return nil, time.Time{}
+	}
+	var expiry = time.Unix(int64(binary.BigEndian.Uint32(token)), 0)
+	ses := sessions[sid]
+	if ses == nil || !hmac.Equal(token[STOKEN_MAC_OFFSET:], t.sign(ses.uid, token)) {
+		return nil, expiry
+	}
+	return ses, expiry
+}
+
+// the key of session state in the TokenStore, apart from the tokens by size
+func statelessStoreKey(sid uint32) []byte {
+	var key = []byte("sid:....")
+	binary.BigEndian.PutUint32(key[4:], sid)
+	return key
+}
+
+// --------------------
+// token reaper
+// --------------------
+// the unused tokens of container are removed after the ttl since issued, so
+// the tokens leaked or forgotten by clients are not valid forever. the clients
+// knowing the ttl from params renew the tokens before.
+func (s *SessionMgr) expireTokens(now time.Time) int {
+	var n int
+	for i := range s.shards {
+		shard := &s.shards[i]
+		shard.lock.Lock()
+		for key, ses := range shard.container {
+			if issued := ses.issuedOf(key); now.Sub(issued) >= s.ttl {
+				shard.drop(ses, key)
+				n++
+			}
+		}
+		shard.lock.Unlock()
+	}
+	atomic.AddInt64(&s.expired, int64(n))
+	return n
+}
+
+func (s *SessionMgr) startReaper() {
+	var step = s.ttl / 8
+	if step < TOKEN_REAP_MIN {
+		step = TOKEN_REAP_MIN
+	}
+	s.reaper = time.NewTicker(step)
+	s.reaped = make(chan struct{})
+	go func(ticker *time.Ticker, done chan struct{}) {
+		for {
+			select {
+			case <-done:
+				return
+			case now := <-ticker.C:
+				s.expireTokens(now)
+			}
+		}
+	}(s.reaper, s.reaped)
+}
+
+func (s *SessionMgr) stopReaper() {
+	if s.reaper != nil {
+		s.reaper.Stop()
+		close(s.reaped)
+		s.reaper = nil
+	}
+}
@@ -0,0 +1,306 @@
+package tunnel
+
+import (
+	"bytes"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	ex "github.com/Lafeng/deblocus/exception"
+)
+
+func newStatelessServer(secret string) *Server {
+	serv := newTestServer()
+	serv.sessionMgr.stateless = newStatelessTokens([]byte(secret), time.Hour)
+	return serv
+}
+
+func TestStatelessTokens(t *testing.T) {
+	var (
+		serv  = newStatelessServer("key")
+		mgr   = serv.sessionMgr
+		alice = newTestSession(serv, "alice")
+	)
+	mgr.register(alice)
+	for _, size := range []int{TKSZ, TKSZ_LONG} {
+		alice.tokenSize = size
+		tokens := mgr.createTokens(alice, 4)
+		if len(tokens) != 1+4*size || mgr.length() != 0 {
+			t.Fatalf("size=%d len=%d container=%d", size, len(tokens), mgr.length())
+		}
+		for tokens = tokens[1:]; len(tokens) > 0; tokens = tokens[size:] {
+			if ses, err := mgr.take(tokens[:size], "127.0.0.1"); ses != alice || err != nil {
+				t.Errorf("size=%d take %v", size, err)
+			}
+		}
+	}
+
+	// the same token is spent once
+	token := mgr.createTokens(alice, 1)[1:]
+	mgr.take(token, "127.0.0.1")
+	if _, err := mgr.take(token, "10.0.0.1"); !isReplayed(err) {
+		t.Errorf("double-spend err=%v", err)
+	}
+
+	// tampered, signed by other key, or expired
+	token = mgr.createTokens(alice, 1)[1:]
+	token[len(token)-1] ^= 1
+	if _, err := mgr.take(token, "127.0.0.1"); err != VALIDATION_FAILED {
+		t.Errorf("tampered err=%v", err)
+	}
+	other := newStatelessServer("other")
+	bob := newTestSession(other, "alice")
+	bob.sid = alice.sid
+	other.sessionMgr.register(bob)
+	if _, err := mgr.take(other.sessionMgr.createTokens(bob, 1)[1:], "127.0.0.1"); err != VALIDATION_FAILED {
+		t.Errorf("signed by other key err=%v", err)
+	}
+	mgr.stateless.ttl = -time.Second
+	token = mgr.createTokens(alice, 1)[1:]
+	mgr.stateless.ttl = time.Hour
+	if _, err := mgr.take(token, "127.0.0.1"); err != VALIDATION_FAILED {
+		t.Errorf("expired err=%v", err)
+	}
+
+	// the session was closed
+	token = mgr.createTokens(alice, 1)[1:]
+	mgr.unregister(alice)
+	if _, err := mgr.take(token, "127.0.0.1"); err != VALIDATION_FAILED {
+		t.Errorf("closed session err=%v", err)
+	}
+}
+
+// the other process of the same key validates the tokens of the session
+// with the same id, eg. restored from the store
+func TestStatelessTokensOfOtherProcess(t *testing.T) {
+	var (
+		serv1 = newStatelessServer("key")
+		serv2 = newStatelessServer("key")
+		alice = newTestSession(serv1, "alice")
+	)
+	serv1.sessionMgr.register(alice)
+	token := serv1.sessionMgr.createTokens(alice, 1)[1:]
+
+	restored := newTestSession(serv2, "alice")
+	restored.sid = alice.sid
+	serv2.sessionMgr.register(restored)
+	if ses, err := serv2.sessionMgr.take(token, "127.0.0.1"); ses != restored || err != nil {
+		t.Errorf("take ses=%v err=%v", ses, err)
+	}
+}
+
+// the session of other host is revived from the store by the id in token,
+// and the token is spent once among them
+func TestStatelessTokensOfOtherHost(t *testing.T) {
+	var (
+		store = newMemTokenStore()
+		serv1 = newHandshakeServer(t)
+		serv2 = newHandshakeServer(t)
+		mgr1  = serv1.sessionMgr
+		mgr2  = serv2.sessionMgr
+		alice = newTestSession(serv1, "alice")
+	)
+	for _, mgr := range []*SessionMgr{mgr1, mgr2} {
+		mgr.stateless = newStatelessTokens([]byte("key"), time.Hour)
+	}
+	mgr1.shared = newSharedTokens(serv1, store, []byte("key"), time.Hour)
+	mgr2.shared = newSharedTokens(serv2, store, []byte("key"), time.Hour)
+	mgr1.register(alice)
+	tokens := mgr1.createTokens(alice, 3)[1:]
+
+	revived, err := mgr2.take(tokens[:TKSZ], "127.0.0.1")
+	if err != nil || revived == nil || revived.sid != alice.sid || !bytes.Equal(revived.cipherFactory.key, alice.cipherFactory.key) {
+		t.Fatalf("not revived err=%v", err)
+	}
+	if s, err := mgr2.take(tokens[TKSZ:TKSZ*2], "127.0.0.1"); s != revived || err != nil {
+		t.Errorf("revived again err=%v", err)
+	}
+	// spent on serv2
+	if _, err := mgr1.take(tokens[:TKSZ], "127.0.0.1"); !isReplayed(err) {
+		t.Errorf("double-spend across hosts err=%v", err)
+	}
+	// destroyed on the origin
+	alice.destroy(SESSION_CLOSE_OFFLINE)
+	revived.destroy(SESSION_CLOSE_OFFLINE)
+	if s, _ := mgr2.take(tokens[TKSZ*2:], "127.0.0.1"); s != nil {
+		t.Errorf("token of destroyed session was taken")
+	}
+}
+
+func TestStatelessTokensHoarded(t *testing.T) {
+	var (
+		serv  = newStatelessServer("key")
+		mgr   = serv.sessionMgr
+		alice = newTestSession(serv, "alice")
+	)
+	mgr.maxTokens = 4
+	mgr.register(alice)
+	tokens, err := mgr.requestTokens(alice, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = mgr.requestTokens(alice, 1); err == nil {
+		t.Errorf("issued over the cap")
+	}
+	// spent or expired
+	mgr.take(tokens[1:1+TKSZ], "127.0.0.1")
+	for k := range alice.tokens {
+		alice.tokens[k] = time.Now().Add(-time.Hour)
+		break
+	}
+	if _, err = mgr.requestTokens(alice, 2); err != nil {
+		t.Errorf("refused under the cap %v", err)
+	}
+}
+
+// the tokens led by the same expiry are spread over the shards
+func TestStatelessTokenShards(t *testing.T) {
+	var (
+		serv  = newStatelessServer("key")
+		alice = newTestSession(serv, "alice")
+		used  = make(map[int]bool)
+	)
+	serv.sessionMgr.register(alice)
+	tokens := serv.sessionMgr.createTokens(alice, TOKEN_SHARDS*4)[1:]
+	for ; len(tokens) > 0; tokens = tokens[TKSZ:] {
+		key := keyOf(tokens[:TKSZ])
+		used[shardOf(&key)] = true
+	}
+	if len(used) < TOKEN_SHARDS/2 {
+		t.Errorf("tokens were in %d shards", len(used))
+	}
+}
+
+func TestSpentTokens(t *testing.T) {
+	var (
+		shard = &tokenShard{spent: make(map[tokenKey]spentToken)}
+		now   = time.Now()
+		first = keyOf(randArray(TKSZ))
+	)
+	shard.spend(first, spentToken{expiry: now.Add(time.Hour)})
+	if _, y := shard.spentOf(first, now); !y {
+		t.Fatalf("spent token was forgotten")
+	}
+	if _, y := shard.spentOf(first, now.Add(time.Hour*2)); y || len(shard.spent) != 0 {
+		t.Errorf("expired token was kept")
+	}
+	// the oldest is evicted in full
+	for i := 0; i <= len(shard.spentRing); i++ {
+		shard.spend(keyOf(randArray(TKSZ)), spentToken{expiry: now.Add(time.Hour)})
+	}
+	if len(shard.spent) != len(shard.spentRing) {
+		t.Errorf("spent=%d", len(shard.spent))
+	}
+}
+
+func isReplayed(err error) bool {
+	e, y := err.(*ex.Exception)
+	return y && e.Origin == TOKEN_REPLAYED
+}
+
+func TestTokenKeys(t *testing.T) {
+	var (
+		serv  = newTestServer()
+		mgr   = serv.sessionMgr
+		alice = newTestSession(serv, "alice")
+	)
+	alice.tokenSize = TKSZ_LONG
+	tokens := mgr.createTokens(alice, 2)
+	// the padded key is not matched by the prefix
+	if s, _ := mgr.take(tokens[1:1+TKSZ], "127.0.0.1"); s != nil {
+		t.Errorf("taken by the prefix of token")
+	}
+	saved := mgr.tokensOf(alice)
+	for h := range saved {
+		if len(h) != TKSZ_LONG*2 {
+			t.Errorf("unexpected saved token %s", h)
+		}
+	}
+	// restored as persisted
+	mgr.clearTokens(alice)
+	alice.tokens = make(map[tokenKey]time.Time)
+	mgr.restoreTokens(alice, saved)
+	for i := 0; i < 2; i++ {
+		if s, err := mgr.take(tokens[1+i*TKSZ_LONG:1+(i+1)*TKSZ_LONG], "127.0.0.1"); s != alice || err != nil {
+			t.Errorf("take restored token %d: %v", i, err)
+		}
+	}
+	if mgr.length() != 0 {
+		t.Errorf("container=%d", mgr.length())
+	}
+}
+
+func TestTokenExpiry(t *testing.T) {
+	var (
+		serv   = newTestServer()
+		mgr    = serv.sessionMgr
+		alice  = newTestSession(serv, "alice")
+		tokens = mgr.createTokens(alice, 3)
+	)
+	mgr.ttl = time.Hour
+	// issued long ago
+	for k := range alice.tokens {
+		alice.tokens[k] = time.Now().Add(-time.Hour * 2)
+		break
+	}
+	if n := mgr.expireTokens(time.Now()); n != 1 || mgr.length() != 2 || len(alice.tokens) != 2 {
+		t.Errorf("expired=%d container=%d held=%d", n, mgr.length(), len(alice.tokens))
+	}
+	// expired before reaped
+	for k := range alice.tokens {
+		alice.tokens[k] = time.Now().Add(-time.Hour)
+	}
+	for i := 0; i < 3; i++ {
+		if s, _ := mgr.take(tokens[1+i*TKSZ:1+(i+1)*TKSZ], "127.0.0.1"); s != nil {
+			t.Errorf("expired token was taken")
+		}
+	}
+	if mgr.length() != 0 || !strings.Contains(serv.Stats(), "Token-expired=3") {
+		t.Errorf("unexpected stats %s", serv.Stats())
+	}
+
+	// told to the client
+	p := new(tunParams)
+	p.deserialize((&tunParams{tokenSize: TKSZ, tokenTTL: time.Hour}).serialize())
+	if p.tokenTTL != time.Hour {
+		t.Errorf("ttl=%s", p.tokenTTL)
+	}
+
+	// the reaper exits by stopping
+	mgr.startReaper()
+	done := mgr.reaped
+	mgr.stopReaper()
+	mgr.stopReaper()
+	select {
+	case <-done:
+	default:
+		t.Errorf("reaper was not stopped")
+	}
+}
+
+func TestClientTokenExpiry(t *testing.T) {
+	var (
+		p = &tunParams{tokenSize: TKSZ, tokenTTL: time.Hour * 8}
+		c = &Client{lock: new(sync.Mutex), params: p, state: CLT_CLOSED, pendingTK: NewTimedWait(false),
+			connInfo: &connectionInfo{tokenFloor: TOKENS_FLOOR}}
+	)
+	var pool = randArray(TKSZ * 4)
+	c.setTokens(pool)
+	// the first one was received long ago, the second is in margin
+	c.tokenAt[0] = time.Now().Add(-time.Hour * 9)
+	c.tokenAt[1] = time.Now().Add(-time.Hour * 7)
+	if token := c.shiftToken(); !bytes.Equal(token, pool[TKSZ*2:TKSZ*3]) {
+		t.Errorf("unexpected token")
+	}
+	if len(c.token) != TKSZ || len(c.tokenAt) != 1 {
+		t.Errorf("expired tokens were kept pool=%d", len(c.tokenAt))
+	}
+	if !c.renewTokens(p) {
+		t.Errorf("not renewed with few tokens")
+	}
+	c.saveTokens(append([]byte{FRAME_ACTION_TOKEN_REPLY}, randArray(TKSZ*GENERATE_TOKEN_NUM)...))
+	if c.renewTokens(p) || c.renewTokens(new(tunParams)) {
+		t.Errorf("renewed with fresh tokens")
+	}
+}
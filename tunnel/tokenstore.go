@@ -0,0 +1,228 @@
+package tunnel
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	log "github.com/Lafeng/deblocus/glog"
+)
+
+const (
+	// the shared tokens expire in the store if TokenTTL was not set
+	SHARED_TOKEN_TTL = time.Hour * 24
+	// the tokens failed to be saved into the store, validated locally
+	UNSHARED_TOKENS_MAX = 4096
+)
+
+// TokenStore shares the tokens among the servers behind a load balancer.
+// the state of session is opaque to the store.
+type TokenStore interface {
+	// save the state of session for the tokens, expire in ttl
+	Put(tokens [][]byte, state []byte, ttl time.Duration) error
+	// remove the token atomically, and return the state or nil if absent
+	Take(token []byte) ([]byte, error)
+	// the state without removing it, or nil if absent
+	Get(token []byte) ([]byte, error)
+	// mark the token spent in ttl atomically, false if it was marked before
+	Spend(token []byte, ttl time.Duration) (bool, error)
+	// remove the tokens
+	Drop(tokens [][]byte) error
+	Close() error
+}
+
+// --------------------
+// sharedTokens
+// --------------------
+// the issued tokens are saved into the store with the state of session sealed
+// by the key derived from the private key of servers, so the servers of the
+// same key could revive the session by the token issued by any of them. the
+// token taken by a server is removed from the store, then the other servers
+// refuse it as replayed.
+// the tokens issued while the store was unavailable are remembered, and
+// validated locally as the store has no entries of them.
+type sharedTokens struct {
+	revived  int64
+	failures int64
+	store    TokenStore
+	server   *Server
+	aead     cipher.AEAD
+	ttl      time.Duration
+	lock     sync.Mutex // of reviving
+	unshared map[tokenKey]time.Time
+	ulock    sync.Mutex // of unshared
+}
+
+func newSharedTokens(server *Server, store TokenStore, secret []byte, ttl time.Duration) *sharedTokens {
+	var key = sha256.Sum256(append([]byte("token-store:"), secret...))
+	block, _ := aes.NewCipher(key[:])
+	aead, _ := cipher.NewGCM(block)
+	if ttl <= 0 {
+		ttl = SHARED_TOKEN_TTL
+	}
+	return &sharedTokens{store: store, server: server, aead: aead, ttl: ttl,
+		unshared: make(map[tokenKey]time.Time)}
+}
+
+func (sh *sharedTokens) put(s *Session, tokens [][]byte) error {
+	plain, err := json.Marshal(persistedOf(s))
+	if err == nil {
+		var nonce = make([]byte, sh.aead.NonceSize())
+		if _, err = io.ReadFull(rand.Reader, nonce); err == nil {
+			err = sh.store.Put(tokens, sh.aead.Seal(nonce, nonce, plain, nil), sh.ttl)
+		}
+	}
+	if err != nil {
+		sh.fail("share tokens of "+s.uid+"@"+s.cid, err)
+	}
+	return err
+}
+
+// the tokens failed to put, the ones over the cap are refused and cost the
+// clients authenticating again
+func (sh *sharedTokens) keepUnshared(tokens [][]byte) {
+	var now = time.Now()
+	sh.ulock.Lock()
+	defer sh.ulock.Unlock()
+	if len(sh.unshared)+len(tokens) > UNSHARED_TOKENS_MAX {
+		for k, expiry := range sh.unshared {
+			if now.After(expiry) {
+				delete(sh.unshared, k)
+			}
+		}
+	}
+	for _, token := range tokens {
+		if len(sh.unshared) >= UNSHARED_TOKENS_MAX {
+			break
+		}
+		sh.unshared[keyOf(token)] = now.Add(sh.ttl)
+	}
+}
+
+// the token was not saved into the store, then forgotten
+func (sh *sharedTokens) takeUnshared(token []byte) bool {
+	var key = keyOf(token)
+	sh.ulock.Lock()
+	defer sh.ulock.Unlock()
+	expiry, y := sh.unshared[key]
+	delete(sh.unshared, key)
+	return y && time.Now().Before(expiry)
+}
+
+func (sh *sharedTokens) drop(tokens [][]byte) {
+	sh.ulock.Lock()
+	for _, token := range tokens {
+		delete(sh.unshared, keyOf(token))
+	}
+	sh.ulock.Unlock()
+	if err := sh.store.Drop(tokens); err != nil {
+		sh.fail("drop tokens", err)
+	}
+}
+
+// the token taken locally is still in the store, false if taken by others.
+// trust the local if the store is unavailable, or the token was not saved.
+func (sh *sharedTokens) claim(token []byte) bool {
+	state, err := sh.store.Take(token)
+	if err != nil {
+		sh.fail("claim token", err)
+		return true
+	}
+	return state != nil || sh.takeUnshared(token)
+}
+
+// the stateless token is spent once among the servers, trust the local if
+// the store is unavailable.
+func (sh *sharedTokens) spend(token []byte, ttl time.Duration) bool {
+	fresh, err := sh.store.Spend(token, ttl)
+	if err != nil {
+		sh.fail("spend token", err)
+		return true
+	}
+	return fresh
+}
+
+// the session of the token issued by other servers, revived once and
+// registered for its later tokens
+func (sh *sharedTokens) revive(token []byte, client string, binding string) (*Session, error) {
+	sealed, err := sh.store.Take(token)
+	if err != nil {
+		sh.fail("take token", err)
+		return nil, VALIDATION_FAILED
+	}
+	return sh.open(sealed, client, binding)
+}
+
+// the session of the stateless tokens issued by other servers, which is
+// kept in the store by its id until destroyed.
+func (sh *sharedTokens) reviveById(sid uint32, client string, binding string) (*Session, error) {
+	sealed, err := sh.store.Get(statelessStoreKey(sid))
+	if err != nil {
+		sh.fail("get session", err)
+		return nil, VALIDATION_FAILED
+	}
+	return sh.open(sealed, client, binding)
+}
+
+// revive the sealed state, which keeps the id of session
+func (sh *sharedTokens) open(sealed []byte, client string, binding string) (*Session, error) {
+	var n = sh.aead.NonceSize()
+	if len(sealed) < n {
+		return nil, VALIDATION_FAILED
+	}
+	plain, err := sh.aead.Open(nil, sealed[:n], sealed[n:], nil)
+	if err != nil {
+		return nil, VALIDATION_FAILED
+	}
+	var p = new(persistedSession)
+	if err = json.Unmarshal(plain, p); err != nil {
+		return nil, VALIDATION_FAILED
+	}
+	if binding != NULL && !sameOrigin(p.origin(), client, binding) {
+		return nil, TOKEN_MISBOUND.Apply(p.User + "@" + p.Client)
+	}
+
+	sh.lock.Lock()
+	defer sh.lock.Unlock()
+	var mgr = sh.server.sessionMgr
+	for _, s := range mgr.lookup(p.User) {
+		if s.cid == p.Client && bytes.Equal(s.cipherFactory.key, p.Key) && atomic.LoadInt32(&s.closed) == 0 {
+			return s, nil
+		}
+	}
+	u, _ := sh.server.AuthSys.UserInfo(p.User)
+	if u == nil {
+		return nil, VALIDATION_FAILED
+	}
+	s, err := sh.server.reviveSession(p, u)
+	if err != nil {
+		return nil, err
+	}
+	mgr.register(s)
+	time.AfterFunc(SESSION_RESTORE_TTL, s.restoreExpired)
+	atomic.AddInt64(&sh.revived, 1)
+	if log.V(log.LV_LOGIN) {
+		log.Infof("Revived the session of %s@%s by shared token%s", p.User, p.Client, correlationTag(p.Correlation))
+	}
+	return s, nil
+}
+
+func (sh *sharedTokens) fail(action string, err error) {
+	atomic.AddInt64(&sh.failures, 1)
+	if log.V(log.LV_WARN) {
+		log.Warningf("Token store failed to %s: %v", action, err)
+	}
+}
+
+func (sh *sharedTokens) String() string {
+	return fmt.Sprintf("Tokens-revived=%d Token-store-failures=%d",
+		atomic.LoadInt64(&sh.revived), atomic.LoadInt64(&sh.failures))
+}
@@ -0,0 +1,296 @@
+package tunnel
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	ex "github.com/Lafeng/deblocus/exception"
+)
+
+type memTokenStore struct {
+	states map[string][]byte
+	down   bool // fail to put
+	lock   sync.Mutex
+}
+
+func newMemTokenStore() *memTokenStore {
+	return &memTokenStore{states: make(map[string][]byte)}
+}
+
+func (m *memTokenStore) Put(tokens [][]byte, state []byte, ttl time.Duration) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if m.down {
+		return io.ErrClosedPipe
+	}
+	for _, token := range tokens {
+		m.states[string(token)] = state
+	}
+	return nil
+}
+
+func (m *memTokenStore) Take(token []byte) ([]byte, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	state := m.states[string(token)]
+	delete(m.states, string(token))
+	return state, nil
+}
+
+func (m *memTokenStore) Get(token []byte) ([]byte, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return m.states[string(token)], nil
+}
+
+func (m *memTokenStore) Spend(token []byte, ttl time.Duration) (bool, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	var key = "spent:" + string(token)
+	if _, y := m.states[key]; y {
+		return false, nil
+	}
+	m.states[key] = []byte{1}
+	return true, nil
+}
+
+func (m *memTokenStore) Drop(tokens [][]byte) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	for _, token := range tokens {
+		delete(m.states, string(token))
+	}
+	return nil
+}
+
+func (m *memTokenStore) Close() error {
+	return nil
+}
+
+func TestSharedTokens(t *testing.T) {
+	var (
+		store = newMemTokenStore()
+		serv1 = newHandshakeServer(t)
+		serv2 = newHandshakeServer(t)
+		mgr1  = serv1.sessionMgr
+		mgr2  = serv2.sessionMgr
+		alice = newTestSession(serv1, "alice")
+	)
+	mgr1.shared = newSharedTokens(serv1, store, []byte("cluster"), 0)
+	mgr2.shared = newSharedTokens(serv2, store, []byte("cluster"), 0)
+	mgr1.register(alice)
+	tokens := mgr1.createTokens(alice, 3)
+	token := func(i int) []byte {
+		return tokens[1+i*TKSZ : 1+(i+1)*TKSZ]
+	}
+
+	// revived by the token issued by serv1
+	revived, err := mgr2.take(token(0), "127.0.0.1")
+	if err != nil || revived == nil || revived.uid != "alice" || !bytes.Equal(revived.cipherFactory.key, alice.cipherFactory.key) {
+		t.Fatalf("not revived err=%v", err)
+	}
+	if s, err := mgr2.take(token(1), "127.0.0.1"); s != revived || err != nil {
+		t.Errorf("revived again err=%v", err)
+	}
+	if len(mgr2.lookup("alice")) != 1 || mgr2.shared.revived != 1 {
+		t.Errorf("sessions=%d revived=%d", len(mgr2.lookup("alice")), mgr2.shared.revived)
+	}
+	// taken by serv2 already
+	s, err := mgr1.take(token(0), "127.0.0.1")
+	if e, y := err.(*ex.Exception); s != nil || !y || e.Origin != TOKEN_REPLAYED {
+		t.Errorf("double-spend across servers err=%v", err)
+	}
+	if s, err := mgr1.take(token(2), "127.0.0.1"); s != alice || err != nil {
+		t.Errorf("local token was refused err=%v", err)
+	}
+	if s, _ := mgr2.take(token(2), "127.0.0.1"); s != nil {
+		t.Errorf("token was taken twice")
+	}
+
+	// the tokens issued by serv2 to the revived are taken by the origin
+	tokens = mgr2.createTokens(revived, 1)
+	if s, err := mgr1.take(token(0), "127.0.0.1"); s != alice || err != nil {
+		t.Errorf("token of revived was refused err=%v", err)
+	}
+	// the tokens of destroyed session are dropped from the store
+	tokens = mgr1.createTokens(alice, 1)
+	alice.destroy(SESSION_CLOSE_OFFLINE)
+	if s, _ := mgr2.take(token(0), "127.0.0.1"); s != nil {
+		t.Errorf("token of destroyed session was taken")
+	}
+	if !strings.Contains(serv2.Stats(), "Tokens-revived=1 Token-store-failures=0") {
+		t.Errorf("unexpected stats %s", serv2.Stats())
+	}
+}
+
+// the tokens failed to put are validated locally instead of replayed
+func TestUnsharedTokens(t *testing.T) {
+	var (
+		store = newMemTokenStore()
+		serv  = newHandshakeServer(t)
+		mgr   = serv.sessionMgr
+		alice = newTestSession(serv, "alice")
+	)
+	mgr.shared = newSharedTokens(serv, store, []byte("cluster"), 0)
+	mgr.register(alice)
+	store.down = true
+	tokens := mgr.createTokens(alice, 2)
+	store.down = false
+	if s, err := mgr.take(tokens[1:1+TKSZ], "127.0.0.1"); s != alice || err != nil {
+		t.Errorf("unshared token was refused err=%v", err)
+	}
+	if _, err := mgr.take(tokens[1:1+TKSZ], "10.0.0.1"); !isReplayed(err) {
+		t.Errorf("double-spend err=%v", err)
+	}
+	// dropped with the session
+	alice.destroy(SESSION_CLOSE_OFFLINE)
+	if len(mgr.shared.unshared) != 0 || mgr.replays != 1 {
+		t.Errorf("unshared=%d replays=%d", len(mgr.shared.unshared), mgr.replays)
+	}
+}
+
+// the commands of tokens on a map, AUTH is required if password set
+func fakeRedis(t *testing.T, password string) (string, func()) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var (
+		data = make(map[string]string)
+		lock sync.Mutex
+	)
+	serve := func(c net.Conn) {
+		defer c.Close()
+		var r, authed = bufio.NewReader(c), password == NULL
+		for {
+			var args []string
+			line, err := r.ReadString('\n')
+			if err != nil {
+				return
+			}
+			n, _ := strconv.Atoi(strings.TrimSpace(line[1:]))
+			for i := 0; i < n; i++ {
+				line, _ = r.ReadString('\n')
+				size, _ := strconv.Atoi(strings.TrimSpace(line[1:]))
+				buf := make([]byte, size+2)
+				io.ReadFull(r, buf)
+				args = append(args, string(buf[:size]))
+			}
+			lock.Lock()
+			switch cmd := strings.ToUpper(args[0]); {
+			case cmd == "AUTH":
+				if authed = args[1] == password; authed {
+					io.WriteString(c, "+OK\r\n")
+				} else {
+					io.WriteString(c, "-WRONGPASS invalid password\r\n")
+				}
+			case !authed:
+				io.WriteString(c, "-NOAUTH Authentication required\r\n")
+			case cmd == "SELECT":
+				io.WriteString(c, "+OK\r\n")
+			case cmd == "SET" && len(args) == 5 && args[3] == "PX":
+				data[args[1]] = args[2]
+				io.WriteString(c, "+OK\r\n")
+			case cmd == "SET" && len(args) == 6 && args[5] == "NX":
+				if _, y := data[args[1]]; y {
+					io.WriteString(c, "$-1\r\n")
+				} else {
+					data[args[1]] = args[2]
+					io.WriteString(c, "+OK\r\n")
+				}
+			case cmd == "GET":
+				if v, y := data[args[1]]; y {
+					io.WriteString(c, "$"+strconv.Itoa(len(v))+"\r\n"+v+"\r\n")
+				} else {
+					io.WriteString(c, "$-1\r\n")
+				}
+			case cmd == "GETDEL":
+				if v, y := data[args[1]]; y {
+					delete(data, args[1])
+					io.WriteString(c, "$"+strconv.Itoa(len(v))+"\r\n"+v+"\r\n")
+				} else {
+					io.WriteString(c, "$-1\r\n")
+				}
+			case cmd == "DEL":
+				var n int
+				for _, k := range args[1:] {
+					if _, y := data[k]; y {
+						delete(data, k)
+						n++
+					}
+				}
+				io.WriteString(c, ":"+strconv.Itoa(n)+"\r\n")
+			default:
+				io.WriteString(c, "-ERR unknown command\r\n")
+			}
+			lock.Unlock()
+		}
+	}
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go serve(c)
+		}
+	}()
+	return ln.Addr().String(), func() { ln.Close() }
+}
+
+func TestRedisTokenStore(t *testing.T) {
+	addr, stop := fakeRedis(t, "secret")
+	defer stop()
+	st, err := newRedisTokenStore("redis://:secret@" + addr + "/1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer st.Close()
+	var tokens = [][]byte{randArray(TKSZ), randArray(TKSZ), randArray(TKSZ)}
+	// binary state
+	var state = []byte("state\r\n\x00")
+	if err = st.Put(tokens, state, time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	if v, err := st.Take(tokens[0]); err != nil || !bytes.Equal(v, state) {
+		t.Errorf("take %q err=%v", v, err)
+	}
+	if v, err := st.Take(tokens[0]); err != nil || v != nil {
+		t.Errorf("taken twice %q err=%v", v, err)
+	}
+	if v, err := st.Get(tokens[1]); err != nil || !bytes.Equal(v, state) {
+		t.Errorf("get %q err=%v", v, err)
+	}
+	if fresh, err := st.Spend(tokens[0], time.Minute); !fresh || err != nil {
+		t.Errorf("spend err=%v", err)
+	}
+	if fresh, _ := st.Spend(tokens[0], time.Minute); fresh {
+		t.Errorf("spent twice")
+	}
+	if err = st.Drop(tokens[1:]); err != nil {
+		t.Errorf("drop err=%v", err)
+	}
+	if v, _ := st.Take(tokens[2]); v != nil {
+		t.Errorf("dropped token was taken")
+	}
+
+	wrong, _ := newRedisTokenStore("redis://:wrong@" + addr)
+	if _, err = wrong.Take(tokens[0]); err == nil {
+		t.Errorf("authenticated by wrong password")
+	}
+	for _, uri := range []string{"http://" + addr, "redis://", "redis://" + addr + "/x"} {
+		if _, err = newRedisTokenStore(uri); err == nil {
+			t.Errorf("accepted url %s", uri)
+		}
+	}
+	if st, _ = newRedisTokenStore("redis://example.com"); st.addr != "example.com:6379" {
+		t.Errorf("unexpected addr %s", st.addr)
+	}
+}
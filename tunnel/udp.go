@@ -0,0 +1,413 @@
+package tunnel
+
+import (
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"net"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/Lafeng/deblocus/exception"
+	log "github.com/Lafeng/deblocus/glog"
+)
+
+const (
+	SOCKS5_CMD_CONNECT   byte = 1
+	SOCKS5_CMD_ASSOCIATE byte = 3
+)
+
+const (
+	// the server closes the association without datagrams in timeout
+	UDP_IDLE_TIMEOUT = time.Minute * 2
+	// datagrams queued for sending to destinations, overflows are dropped
+	UDP_QUEUE_LEN = 64
+	// atyp(1) + ipv6(16) + port(2)
+	UDP_ADDR_MAX = 19
+	// cached resolutions of association
+	UDP_RESOLVED_MAX = 64
+)
+
+var (
+	INVALID_SOCKS5_ADDR    = exception.New("Invalid socks5 address")
+	UNSUPPORTED_SOCKS5_CMD = exception.New("Unsupported socks5 command")
+)
+
+// --------------------
+// udpAssoc
+// --------------------
+// the association of UDP ASSOCIATE is identified by the sid of tunnel.
+// each datagram is carried by one UDP frame as is in socks5:
+// atyp + addr + port + data, where the address is the destination in the
+// frames sent by client, and the source in the frames replied by server.
+// the client relays the datagrams of app until the control connection was
+// closed, and the server sends them to destinations by one socket.
+type udpAssoc struct {
+	last      int64 // unixnano of last datagram
+	key       string
+	sid       uint16
+	tun       *Conn
+	conn      *net.UDPConn
+	ctrl      net.Conn     // client: the control connection of socks5
+	peer      atomic.Value // client: *net.UDPAddr of app
+	out       chan []byte  // server: datagrams to destinations
+	resolved  map[string]*net.UDPAddr
+	done      chan struct{}
+	closeOnce sync.Once
+	release   func() // server: the slots of stream and outbound
+}
+
+func newUdpAssoc(key string, sid uint16, tun *Conn, conn *net.UDPConn) *udpAssoc {
+	return &udpAssoc{
+		last: time.Now().UnixNano(),
+		key:  key,
+		sid:  sid,
+		tun:  tun,
+		conn: conn,
+		done: make(chan struct{}),
+	}
+}
+
+func (a *udpAssoc) touch() {
+	atomic.StoreInt64(&a.last, time.Now().UnixNano())
+}
+
+func (a *udpAssoc) idle(now time.Time) time.Duration {
+	return time.Duration(now.UnixNano() - atomic.LoadInt64(&a.last))
+}
+
+func (a *udpAssoc) close() {
+	a.closeOnce.Do(func() {
+		close(a.done)
+		SafeClose(a.conn)
+		if a.ctrl != nil {
+			SafeClose(a.ctrl)
+		}
+		if a.release != nil {
+			a.release()
+		}
+	})
+}
+
+// --------------------
+// udpRelay
+// --------------------
+type udpRelay struct {
+	lock   sync.Mutex
+	assocs map[string]*udpAssoc
+}
+
+func newUdpRelay() *udpRelay {
+	return &udpRelay{assocs: make(map[string]*udpAssoc)}
+}
+
+func (r *udpRelay) get(key string) *udpAssoc {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return r.assocs[key]
+}
+
+func (r *udpRelay) put(a *udpAssoc) {
+	r.lock.Lock()
+	r.assocs[a.key] = a
+	r.lock.Unlock()
+}
+
+// return false if it was removed
+func (r *udpRelay) remove(a *udpAssoc) bool {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if r.assocs[a.key] == a {
+		delete(r.assocs, a.key)
+		return true
+	}
+	return false
+}
+
+func (r *udpRelay) size() int {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return len(r.assocs)
+}
+
+func (r *udpRelay) cleanOfTun(tun *Conn) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	for k, a := range r.assocs {
+		if a.tun == tun {
+			delete(r.assocs, k)
+			a.close()
+		}
+	}
+}
+
+func (r *udpRelay) destroy() {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	for k, a := range r.assocs {
+		delete(r.assocs, k)
+		a.close()
+	}
+}
+
+// parse atyp + addr + port, return host:port and the consumed length
+func parseSocksAddr(b []byte) (string, int, error) {
+	var host string
+	var ofs int
+	if len(b) < 1 {
+		return NULL, 0, INVALID_SOCKS5_ADDR
+	}
+	switch b[0] {
+	case IPV4:
+		ofs = 1 + net.IPv4len
+		if len(b) >= ofs {
+			host = net.IP(b[1:ofs]).String()
+		}
+	case IPV6:
+		ofs = 1 + net.IPv6len
+		if len(b) >= ofs {
+			host = net.IP(b[1:ofs]).String()
+		}
+	case DOMAIN:
+		if len(b) > 1 {
+			ofs = 2 + int(b[1])
+			if len(b) >= ofs {
+				host = string(b[2:ofs])
+			}
+		}
+	}
+	if host == NULL || len(b) < ofs+2 {
+		return NULL, 0, INVALID_SOCKS5_ADDR
+	}
+	port := binary.BigEndian.Uint16(b[ofs:])
+	return net.JoinHostPort(host, strconv.Itoa(int(port))), ofs + 2, nil
+}
+
+func packSocksAddr(addr *net.UDPAddr) []byte {
+	var b []byte
+	if ip := addr.IP.To4(); ip != nil {
+		b = append([]byte{IPV4}, ip...)
+	} else {
+		b = append([]byte{IPV6}, addr.IP.To16()...)
+	}
+	return append(b, byte(addr.Port>>8), byte(addr.Port))
+}
+
+// client: relay the datagrams of app between the local socket and tunnel
+// until the control connection was closed
+func (p *multiplexer) HandleAssociate(ctrl net.Conn, local *net.UDPConn) {
+	var tun = p.pool.Select()
+	if tun == nil {
+		log.Warningln(ERR_TUN_NA)
+		SafeClose(ctrl)
+		SafeClose(local)
+		return
+	}
+	var (
+		sid = next_sid()
+		a   = newUdpAssoc(sessionKey(tun, sid), sid, tun, local)
+		buf = make([]byte, FRAME_MAX_LEN)
+		// RSV(2) and FRAG(1) of socks5 overlap the tail of frame header
+		ofs    = FRAME_HEADER_LEN - 3
+		window = buf[ofs : ofs+3+FRAME_PAYLOAD_MAX]
+		appIP  = ipAddr(ctrl.RemoteAddr())
+	)
+	a.ctrl = ctrl
+	p.udp.put(a)
+	if log.V(log.LV_REQ) {
+		log.Infof("SOCKS5/UDP from=%s sid=%d\n", appIP, sid)
+	}
+	go func() {
+		io.Copy(ioutil.Discard, ctrl)
+		p.closeAssoc(a, true)
+	}()
+	defer p.closeAssoc(a, true)
+
+	for {
+		nr, from, er := local.ReadFromUDP(window)
+		if er != nil {
+			return
+		}
+		// only the app of control connection, no fragments, and not truncated
+		if from.IP.String() != appIP || nr <= 3 || nr == len(window) || window[2] != 0 {
+			continue
+		}
+		if _, _, er = parseSocksAddr(buf[FRAME_HEADER_LEN : ofs+nr]); er != nil {
+			continue
+		}
+		a.peer.Store(from)
+		a.touch()
+		nr -= 3
+		pack(buf, FRAME_ACTION_UDP, sid, uint16(nr))
+		if frameWriteBuffer(tun, buf[:FRAME_HEADER_LEN+nr]) != nil {
+			return
+		}
+		atomic.AddInt64(&p.txBytes, int64(nr))
+	}
+}
+
+// the datagram of association from tunnel
+func (p *multiplexer) onDatagram(frm *frame, key string, tun *Conn) {
+	defer frm.free()
+	var a = p.udp.get(key)
+	if p.isClient {
+		if a == nil {
+			return
+		}
+		if peer, y := a.peer.Load().(*net.UDPAddr); y {
+			var dgram = make([]byte, 3+len(frm.data))
+			copy(dgram[3:], frm.data)
+			a.conn.WriteToUDP(dgram, peer)
+			a.touch()
+		}
+	} else {
+		if a == nil {
+			var err error
+			if a, err = p.openAssoc(key, frm.sid, tun); err != nil {
+				log.Warningf("Cannot associate UDP for %s error: %s\n", key, err)
+				p.notifyAssocClosed(tun, frm.sid)
+				return
+			}
+		}
+		select {
+		case a.out <- append([]byte(nil), frm.data...):
+		default: // overflowed
+		}
+	}
+	atomic.AddInt64(&p.rxBytes, int64(len(frm.data)))
+}
+
+// server: the association with one socket to destinations, only if the UDP
+// relay was negotiated. it holds a stream and an outbound slot until closed
+func (p *multiplexer) openAssoc(key string, sid uint16, tun *Conn) (*udpAssoc, error) {
+	if !p.datagrams {
+		return nil, UNSUPPORTED_SOCKS5_CMD
+	}
+	if !p.acquireStream() {
+		return nil, ERR_STREAMS_FULL
+	}
+	if p.outbound != nil && !p.outbound.acquire() {
+		p.releaseStream()
+		return nil, ERR_OUTBOUND_FULL
+	}
+	var release = func() {
+		p.releaseStream()
+		if p.outbound != nil {
+			p.outbound.release()
+		}
+	}
+	conn, err := net.ListenUDP("udp", nil)
+	if err != nil {
+		release()
+		return nil, err
+	}
+	var a = newUdpAssoc(key, sid, tun, conn)
+	a.release = release
+	a.out = make(chan []byte, UDP_QUEUE_LEN)
+	a.resolved = make(map[string]*net.UDPAddr)
+	p.udp.put(a)
+	if log.V(log.LV_SVR_OPEN) {
+		log.Infoln("ASSOCIATE UDP for", key)
+	}
+	go p.assocSend(a)
+	go p.assocReceive(a)
+	return a, nil
+}
+
+// server: send the queued datagrams to destinations
+func (p *multiplexer) assocSend(a *udpAssoc) {
+	for {
+		select {
+		case <-a.done:
+			return
+		case dgram := <-a.out:
+			target, n, err := parseSocksAddr(dgram)
+			if err != nil {
+				continue
+			}
+			// the resolved address is filtered and sent to, fail closed
+			addr, err := p.resolveUDP(a, target)
+			if err != nil {
+				continue
+			}
+			if p.filter != nil && p.deniedDest(addr.String(), target) {
+				if log.V(log.LV_WARN) {
+					log.Warningf("Denied datagram [%s] for %s\n", target, a.key)
+				}
+				continue
+			}
+			a.conn.WriteToUDP(dgram[n:], addr)
+			a.touch()
+		}
+	}
+}
+
+func (p *multiplexer) resolveUDP(a *udpAssoc, target string) (*net.UDPAddr, error) {
+	if addr := a.resolved[target]; addr != nil {
+		return addr, nil
+	}
+	var literal = target
+	if p.resolver != nil {
+		var err error
+		if literal, err = resolveTarget(p.resolver, target); err != nil {
+			return nil, err
+		}
+	}
+	addr, err := net.ResolveUDPAddr("udp", literal)
+	if err != nil {
+		return nil, err
+	}
+	if len(a.resolved) >= UDP_RESOLVED_MAX {
+		a.resolved = make(map[string]*net.UDPAddr)
+	}
+	a.resolved[target] = addr
+	return addr, nil
+}
+
+// server: reply the datagrams from destinations to tunnel
+func (p *multiplexer) assocReceive(a *udpAssoc) {
+	var (
+		buf  = make([]byte, FRAME_MAX_LEN)
+		rbuf = make([]byte, FRAME_PAYLOAD_MAX-UDP_ADDR_MAX)
+	)
+	defer p.closeAssoc(a, true)
+	for {
+		a.conn.SetReadDeadline(time.Now().Add(UDP_IDLE_TIMEOUT))
+		nr, from, er := a.conn.ReadFromUDP(rbuf)
+		if er != nil {
+			if IsTimeout(er) && a.idle(time.Now()) < UDP_IDLE_TIMEOUT {
+				continue
+			}
+			return
+		}
+		a.touch()
+		if nr == len(rbuf) { // truncated
+			continue
+		}
+		n := copy(buf[FRAME_HEADER_LEN:], packSocksAddr(from))
+		n += copy(buf[FRAME_HEADER_LEN+n:], rbuf[:nr])
+		pack(buf, FRAME_ACTION_UDP, a.sid, uint16(n))
+		if frameWriteBuffer(a.tun, buf[:FRAME_HEADER_LEN+n]) != nil {
+			return
+		}
+		atomic.AddInt64(&p.txBytes, int64(n))
+	}
+}
+
+// close and notify peer if it was not closed by peer
+func (p *multiplexer) closeAssoc(a *udpAssoc, notify bool) {
+	if p.udp.remove(a) {
+		a.close()
+		if notify {
+			p.notifyAssocClosed(a.tun, a.sid)
+		}
+	}
+}
+
+func (p *multiplexer) notifyAssocClosed(tun *Conn, sid uint16) {
+	var buf = make([]byte, FRAME_HEADER_LEN)
+	pack(buf, FRAME_ACTION_UDP_CLOSE, sid, nil)
+	go frameWriteBuffer(tun, buf)
+}
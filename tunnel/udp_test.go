@@ -0,0 +1,174 @@
+package tunnel
+
+import (
+	"bytes"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestSocksAddr(t *testing.T) {
+	for _, addr := range []*net.UDPAddr{
+		{IP: net.IPv4(10, 0, 0, 1), Port: 53},
+		{IP: net.ParseIP("2001:db8::1"), Port: 443},
+	} {
+		b := packSocksAddr(addr)
+		host, n, err := parseSocksAddr(append(b, "data"...))
+		if err != nil || n != len(b) || host != addr.String() {
+			t.Errorf("%s => %s n=%d %v", addr, host, n, err)
+		}
+	}
+	host, n, err := parseSocksAddr([]byte{DOMAIN, 3, 'd', 'n', 's', 0, 53})
+	if err != nil || n != 7 || host != "dns:53" {
+		t.Errorf("domain %s n=%d %v", host, n, err)
+	}
+	for _, b := range [][]byte{nil, {IPV4, 1, 2}, {DOMAIN, 9, 'a'}, {9, 0, 0}} {
+		if _, _, err = parseSocksAddr(b); err == nil {
+			t.Errorf("parsed invalid % x", b)
+		}
+	}
+}
+
+func TestUDPAssociate(t *testing.T) {
+	c, s := tcpPair(t)
+	var (
+		client = newClientMultiplexer()
+		server = newServerMultiplexer()
+	)
+	defer client.destroy()
+	defer server.destroy()
+	server.datagrams = true
+	go server.Listen(NewConn(s, nullCipherKit), nil, 0)
+	go client.Listen(NewConn(c, nullCipherKit), nil, 0)
+	for client.pool.Len() == 0 {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// destination echoes datagrams
+	dest, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dest.Close()
+	go func() {
+		buf := make([]byte, FRAME_MAX_LEN)
+		for {
+			n, from, err := dest.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			dest.WriteToUDP(buf[:n], from)
+		}
+	}()
+
+	// the app with the control connection
+	ctrlApp, ctrl := tcpPair(t)
+	relay, _ := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	go client.HandleAssociate(ctrl, relay)
+	app, err := net.DialUDP("udp", nil, relay.LocalAddr().(*net.UDPAddr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer app.Close()
+
+	header := append([]byte{0, 0, 0}, packSocksAddr(dest.LocalAddr().(*net.UDPAddr))...)
+	for _, size := range []int{1, 1400, 32 << 10} {
+		data := randArray(size)
+		app.Write(append(header, data...))
+		app.SetReadDeadline(time.Now().Add(GENERAL_SO_TIMEOUT))
+		buf := make([]byte, FRAME_MAX_LEN)
+		n, err := app.Read(buf)
+		if err != nil {
+			t.Fatal(size, err)
+		}
+		// replied from the destination
+		if !bytes.Equal(buf[:len(header)], header) || !bytes.Equal(buf[len(header):n], data) {
+			t.Fatalf("size=%d reply mismatched", size)
+		}
+	}
+	// fragments are dropped
+	app.Write(append([]byte{0, 0, 1}, header[3:]...))
+	app.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+	if _, err = app.Read(make([]byte, 64)); !IsTimeout(err) {
+		t.Errorf("relayed fragment %v", err)
+	}
+
+	if client.udp.size() != 1 || server.udp.size() != 1 {
+		t.Fatalf("associations client=%d server=%d", client.udp.size(), server.udp.size())
+	}
+	// terminated with the control connection
+	ctrlApp.Close()
+	for i := 0; i < 50 && server.udp.size() > 0; i++ {
+		time.Sleep(20 * time.Millisecond)
+	}
+	if client.udp.size() != 0 || server.udp.size() != 0 {
+		t.Errorf("not closed client=%d server=%d", client.udp.size(), server.udp.size())
+	}
+	if server.active != 0 {
+		t.Errorf("the stream of association was not released active=%d", server.active)
+	}
+}
+
+func TestUDPAssociateRefused(t *testing.T) {
+	var server = newServerMultiplexer()
+	defer server.destroy()
+	c, s := tcpPair(t)
+	defer c.Close()
+	var tun = NewConn(s.(*net.TCPConn), nullCipherKit)
+	// not negotiated
+	if _, err := server.openAssoc("key", 1, tun); err == nil {
+		t.Errorf("associated without negotiation")
+	}
+	// over the caps of streams and outbound
+	server.datagrams, server.streamCap = true, 1
+	a, err := server.openAssoc("key", 1, tun)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = server.openAssoc("key2", 2, tun); err != ERR_STREAMS_FULL {
+		t.Errorf("associated over the cap of streams err=%v", err)
+	}
+	server.closeAssoc(a, false)
+	server.streamCap, server.outbound = 0, newOutboundLimit(1)
+	if a, err = server.openAssoc("key", 1, tun); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = server.openAssoc("key2", 2, tun); err != ERR_OUTBOUND_FULL {
+		t.Errorf("associated over the cap of outbound err=%v", err)
+	}
+	server.closeAssoc(a, false)
+	if server.active != 0 || server.outbound.active != 0 {
+		t.Errorf("the slots were not released active=%d outbound=%d", server.active, server.outbound.active)
+	}
+}
+
+func TestSocksUnsupportedAssociate(t *testing.T) {
+	app, conn := tcpPair(t)
+	defer app.Close()
+	defer conn.Close()
+	go app.Write([]byte{5, SOCKS5_CMD_ASSOCIATE, 0, 1, 0, 0, 0, 0, 0, 0})
+	if _, _, ok := (socks5Handler{conn: conn}).readRequest(); ok {
+		t.Fatalf("accepted UDP ASSOCIATE")
+	}
+	reply := make([]byte, 10)
+	app.Read(reply)
+	if reply[1] != 0x7 {
+		t.Errorf("reply % x", reply)
+	}
+}
+
+func TestSocksStreamsFull(t *testing.T) {
+	app, conn := tcpPair(t)
+	defer app.Close()
+	defer conn.Close()
+	go app.Write([]byte{5, SOCKS5_CMD_CONNECT, 0, 1, 127, 0, 0, 1, 0, 80})
+	full := func() bool { return true }
+	if _, _, ok := (socks5Handler{conn: conn, full: full}).readRequest(); ok {
+		t.Fatalf("accepted over the cap of streams")
+	}
+	reply := make([]byte, 10)
+	app.Read(reply)
+	if reply[1] != 0x1 {
+		t.Errorf("reply % x", reply)
+	}
+}
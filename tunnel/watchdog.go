@@ -0,0 +1,156 @@
+package tunnel
+
+import (
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	log "github.com/Lafeng/deblocus/glog"
+)
+
+const (
+	ZOMBIE_SCAN_MIN = time.Second
+)
+
+// --------------------
+// sessionScanner
+// --------------------
+// the sessions are scanned periodically, and the session without progress
+// in timeout is reaped. the progress, the exempt at the moment and the way
+// of reaping are of the policy, eg. zombieWatchdog or idleEvictor.
+type sessionScanner struct {
+	reaped   int64
+	name     string // of stats
+	timeout  time.Duration
+	progress func(s *Session) int64
+	exempt   func(s *Session) bool
+	action   func(s *Session, idle time.Duration)
+	marks    map[*Session]*progressMark // owned by the scanning goroutine
+	ticker   *time.Ticker
+	done     chan struct{}
+}
+
+type progressMark struct {
+	progress int64
+	since    time.Time // last progress
+}
+
+// return the sessions to reap at now
+func (w *sessionScanner) scan(sessions []*Session, now time.Time) []*Session {
+	var (
+		reaping []*Session
+		alive   = make(map[*Session]*progressMark, len(sessions))
+	)
+	for _, s := range sessions {
+		var (
+			progress = w.progress(s)
+			mark     = w.marks[s]
+		)
+		if mark == nil || mark.progress != progress || w.exempt(s) {
+			mark = &progressMark{progress, now}
+		} else if now.Sub(mark.since) >= w.timeout {
+			reaping = append(reaping, s)
+			continue
+		}
+		alive[s] = mark
+	}
+	w.marks = alive
+	return reaping
+}
+
+func (w *sessionScanner) reap(s *Session, idle time.Duration) {
+	atomic.AddInt64(&w.reaped, 1)
+	w.action(s, idle)
+}
+
+func (w *sessionScanner) start(mgr *SessionMgr) {
+	var step = w.timeout / 4
+	if step < ZOMBIE_SCAN_MIN {
+		step = ZOMBIE_SCAN_MIN
+	}
+	w.ticker = time.NewTicker(step)
+	w.done = make(chan struct{})
+	go func(ticker *time.Ticker, done chan struct{}) {
+		for {
+			var now time.Time
+			select {
+			case <-done:
+				return
+			case now = <-ticker.C:
+			}
+			var marks = w.marks
+			for _, s := range w.scan(mgr.lookup(NULL), now) {
+				w.reap(s, now.Sub(marks[s].since))
+			}
+		}
+	}(w.ticker, w.done)
+}
+
+func (w *sessionScanner) stop() {
+	if w.ticker != nil {
+		w.ticker.Stop()
+		close(w.done)
+		w.ticker = nil
+	}
+}
+
+func (w *sessionScanner) String() string {
+	return fmt.Sprintf("%s=%d", w.name, atomic.LoadInt64(&w.reaped))
+}
+
+// --------------------
+// zombieWatchdog
+// --------------------
+// the session holding tunnels without any progress (frames received or bytes
+// relayed) in threshold is a zombie, eg. the tunnel goroutine was blocked in
+// writing without deadline. the idle but healthy session still has pings.
+func newZombieWatchdog(threshold time.Duration) *sessionScanner {
+	return &sessionScanner{
+		name:     "Zombie-sessions",
+		timeout:  threshold,
+		progress: sessionProgress,
+		// the paused session has no progress intentionally
+		exempt: func(s *Session) bool {
+			return s.mux.isPaused() || atomic.LoadInt32(&s.activeCnt) <= 0
+		},
+		action: func(s *Session, idle time.Duration) {
+			rx, tx, streams := s.mux.traffic()
+			log.Warningf("Zombie session %s@%s Conn=%d Streams=%d Rx=%d Tx=%d Idle=%s was destroyed\n",
+				s.uid, s.cid, atomic.LoadInt32(&s.activeCnt), streams, rx, tx, idle)
+			s.destroy(SESSION_CLOSE_ZOMBIE)
+		},
+		marks: make(map[*Session]*progressMark),
+	}
+}
+
+func sessionProgress(s *Session) int64 {
+	rx, tx, _ := s.mux.traffic()
+	return rx + tx + atomic.LoadInt64(&s.mux.received)
+}
+
+// --------------------
+// idleEvictor
+// --------------------
+// the session without data relayed in timeout is evicted, with or without
+// tunnels, to free the multiplexer and tokens held by the clients left. the
+// pings are not counted as the zombieWatchdog does.
+func newIdleEvictor(timeout time.Duration) *sessionScanner {
+	return &sessionScanner{
+		name:    "Idle-evicted",
+		timeout: timeout,
+		progress: func(s *Session) int64 {
+			rx, tx, _ := s.mux.traffic()
+			return rx + tx
+		},
+		// the paused session is idle intentionally
+		exempt: func(s *Session) bool {
+			return s.mux.isPaused()
+		},
+		action: func(s *Session, idle time.Duration) {
+			log.Infof("Idle session %s@%s Conn=%d TK=%d Idle=%s was evicted\n",
+				s.uid, s.cid, atomic.LoadInt32(&s.activeCnt), s.mgr.tokenCount(s), idle)
+			s.destroy(SESSION_CLOSE_IDLE)
+		},
+		marks: make(map[*Session]*progressMark),
+	}
+}
@@ -0,0 +1,133 @@
+package tunnel
+
+import (
+	"net"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestZombieWatchdog(t *testing.T) {
+	var (
+		serv    = newTestServer()
+		reasons = make(chan string, 4)
+		w       = newZombieWatchdog(time.Minute)
+		now     = time.Now()
+	)
+	serv.zombies = w
+	serv.OnDisconnect(func(info *DisconnectInfo) {
+		reasons <- info.User + ":" + info.Reason
+	})
+	// the peer never reads, then the first ping is blocked in writing
+	c1, c2 := net.Pipe()
+	defer c2.Close()
+	stalled := newTestSession(serv, "stalled")
+	serv.sessionMgr.register(stalled)
+	tun := NewConn(c1, nullCipherKit)
+	tun.SetupCipher(NewCipherFactory(CIPHER_NULL), randArray(16))
+	go stalled.DataTunServe(tun, true)
+
+	healthy := newTestSession(serv, "healthy")
+	serv.sessionMgr.register(healthy)
+	atomic.StoreInt32(&healthy.activeCnt, 1)
+
+	for i := 0; i < 100 && atomic.LoadInt32(&stalled.activeCnt) == 0; i++ {
+		time.Sleep(time.Millisecond * 10)
+	}
+	if z := w.scan(serv.sessionMgr.lookup(NULL), now); len(z) != 0 {
+		t.Fatalf("zombies at first scan %v", z)
+	}
+	atomic.AddInt64(&healthy.mux.received, 1)
+	now = now.Add(time.Minute)
+	zombies := w.scan(serv.sessionMgr.lookup(NULL), now)
+	if len(zombies) != 1 || zombies[0] != stalled {
+		t.Fatalf("zombies=%v", zombies)
+	}
+	w.reap(zombies[0], time.Minute)
+
+	select {
+	case r := <-reasons:
+		if r != "stalled:"+SESSION_CLOSE_ZOMBIE {
+			t.Errorf("unexpected disconnection %s", r)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("zombie was not destroyed")
+	}
+	// the blocked tunnel was released
+	for i := 0; i < 100 && atomic.LoadInt32(&stalled.activeCnt) > 0; i++ {
+		time.Sleep(time.Millisecond * 10)
+	}
+	if n := atomic.LoadInt32(&stalled.activeCnt); n != 0 {
+		t.Errorf("stalled tunnel was not released activeCnt=%d", n)
+	}
+	if atomic.LoadInt32(&healthy.closed) != 0 || len(serv.sessionMgr.lookup(NULL)) != 1 {
+		t.Errorf("healthy session was destroyed")
+	}
+	if !strings.Contains(serv.Stats(), "Zombie-sessions=1") {
+		t.Errorf("unexpected stats %s", serv.Stats())
+	}
+	// the scanning exits by stopping
+	w.start(serv.sessionMgr)
+	done := w.done
+	w.stop()
+	w.stop()
+	select {
+	case <-done:
+	default:
+		t.Errorf("watchdog was not stopped")
+	}
+}
+
+func TestIdleEvictor(t *testing.T) {
+	var (
+		serv    = newTestServer()
+		reasons = make(chan string, 4)
+		e       = newIdleEvictor(time.Hour)
+		now     = time.Now()
+	)
+	serv.idle = e
+	serv.OnDisconnect(func(info *DisconnectInfo) {
+		reasons <- info.User + ":" + info.Reason
+	})
+	idle := newTestSession(serv, "idle")
+	serv.sessionMgr.register(idle)
+	serv.sessionMgr.createTokens(idle, 2)
+	busy := newTestSession(serv, "busy")
+	serv.sessionMgr.register(busy)
+	paused := newTestSession(serv, "paused")
+	serv.sessionMgr.register(paused)
+	paused.setPaused(true)
+
+	if s := e.scan(serv.sessionMgr.lookup(NULL), now); len(s) != 0 {
+		t.Fatalf("idle at first scan %v", s)
+	}
+	// the pings are not data
+	atomic.AddInt64(&idle.mux.received, 1)
+	atomic.AddInt64(&busy.mux.rxBytes, 1)
+	now = now.Add(time.Hour)
+	evicted := e.scan(serv.sessionMgr.lookup(NULL), now)
+	if len(evicted) != 1 || evicted[0] != idle {
+		t.Fatalf("evicted=%v", evicted)
+	}
+	e.reap(evicted[0], time.Hour)
+	if r := <-reasons; r != "idle:"+SESSION_CLOSE_IDLE {
+		t.Errorf("unexpected disconnection %s", r)
+	}
+	if serv.sessionMgr.length() != 0 || len(serv.sessionMgr.lookup(NULL)) != 2 {
+		t.Errorf("tokens or sessions were kept")
+	}
+	if !strings.Contains(serv.Stats(), "Idle-evicted=1") {
+		t.Errorf("unexpected stats %s", serv.Stats())
+	}
+	// the scanning exits by stopping
+	e.start(serv.sessionMgr)
+	done := e.done
+	e.stop()
+	e.stop()
+	select {
+	case <-done:
+	default:
+		t.Errorf("evictor was not stopped")
+	}
+}
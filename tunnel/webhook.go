@@ -0,0 +1,138 @@
+package tunnel
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/Lafeng/deblocus/exception"
+	log "github.com/Lafeng/deblocus/glog"
+	"github.com/cloudflare/golibs/lrucache"
+)
+
+const (
+	WEBHOOK_TIMEOUT     = time.Second * 2
+	WEBHOOK_TIMEOUT_MAX = time.Second * 10
+	WEBHOOK_CACHE_TTL   = time.Second * 30
+	WEBHOOK_CACHE_MAX   = 4096
+	// policy on webhook errors
+	WEBHOOK_FAIL_OPEN   = "open"
+	WEBHOOK_FAIL_CLOSED = "closed"
+)
+
+var (
+	WEBHOOK_ERROR = exception.New("Webhook error")
+)
+
+// the body posted to webhook
+type webhookRequest struct {
+	User   string `json:"uid"`
+	Client string `json:"cid"`
+	Source string `json:"source"`
+	Dest   string `json:"dest"`
+}
+
+// --------------------
+// authWebhook
+// --------------------
+// the external authorization of opening streams. the webhook replies
+// 2xx to allow and 403 to deny, the others are errors applied with
+// fail-open or fail-closed policy. the decisions are cached briefly.
+type authWebhook struct {
+	calls    int64
+	denies   int64
+	errors   int64
+	url      string
+	failOpen bool
+	ttl      time.Duration // of decisions, no cache if 0
+	client   *http.Client
+	cache    *lrucache.LRUCache // uid, cid, dest -> allowed
+}
+
+func newAuthWebhook(url string, timeout, ttl time.Duration, failOpen bool) *authWebhook {
+	return &authWebhook{
+		url:      url,
+		failOpen: failOpen,
+		ttl:      ttl,
+		client:   &http.Client{Timeout: timeout},
+		cache:    lrucache.NewLRUCache(WEBHOOK_CACHE_MAX),
+	}
+}
+
+// return true if allowed
+func (w *authWebhook) authorize(r *webhookRequest) bool {
+	var key = r.User + "\x00" + r.Client + "\x00" + r.Dest
+	if w.ttl > 0 {
+		if v, y := w.cache.GetNotStale(key); y {
+			return v.(bool)
+		}
+	}
+	atomic.AddInt64(&w.calls, 1)
+	allowed, err := w.call(r)
+	if err != nil {
+		atomic.AddInt64(&w.errors, 1)
+		log.Warningf("Webhook failed for %s@%s [%s] fail-open=%t: %v", r.User, r.Client, r.Dest, w.failOpen, err)
+		return w.failOpen
+	}
+	if !allowed {
+		atomic.AddInt64(&w.denies, 1)
+	}
+	if w.ttl > 0 {
+		w.cache.Set(key, allowed, time.Now().Add(w.ttl))
+	}
+	return allowed
+}
+
+func (w *authWebhook) call(r *webhookRequest) (bool, error) {
+	body, _ := json.Marshal(r)
+	resp, err := w.client.Post(w.url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+	// reuse connection
+	io.Copy(ioutil.Discard, io.LimitReader(resp.Body, 4096))
+	switch {
+	case resp.StatusCode >= 200 && resp.StatusCode < 300:
+		return true, nil
+	case resp.StatusCode == http.StatusForbidden:
+		return false, nil
+	}
+	return false, WEBHOOK_ERROR.Apply(resp.Status)
+}
+
+func (w *authWebhook) String() string {
+	return fmt.Sprintf("Webhook-calls=%d Webhook-denied=%d Webhook-errors=%d",
+		atomic.LoadInt64(&w.calls), atomic.LoadInt64(&w.denies), atomic.LoadInt64(&w.errors))
+}
+
+// the filter of session consulting webhook
+type webhookFilter struct {
+	hook *authWebhook
+	ses  *Session
+}
+
+// implement Filterable
+func (f *webhookFilter) Filter(host string) bool {
+	return !f.hook.authorize(&webhookRequest{
+		User:   f.ses.uid,
+		Client: f.ses.cid,
+		Source: f.ses.cid,
+		Dest:   host,
+	})
+}
+
+// consulted after the static filters
+func (s *Session) applyWebhook(hook *authWebhook) {
+	var f = &webhookFilter{hook: hook, ses: s}
+	if s.mux.filter != nil {
+		s.mux.filter = filterChain{s.mux.filter, f}
+	} else {
+		s.mux.filter = f
+	}
+}
@@ -0,0 +1,95 @@
+package tunnel
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func mockWebhook(hits *int32) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(hits, 1)
+		var req webhookRequest
+		if json.NewDecoder(r.Body).Decode(&req) != nil || req.User != "alice" || req.Source != "127.0.0.1" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		switch {
+		case strings.HasPrefix(req.Dest, "deny"):
+			w.WriteHeader(http.StatusForbidden)
+		case strings.HasPrefix(req.Dest, "slow"):
+			time.Sleep(time.Millisecond * 300)
+		case strings.HasPrefix(req.Dest, "error"):
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	}))
+}
+
+func TestAuthWebhook(t *testing.T) {
+	var hits int32
+	ts := mockWebhook(&hits)
+	defer ts.Close()
+	var (
+		serv  = newTestServer()
+		alice = newTestSession(serv, "alice")
+		hook  = newAuthWebhook(ts.URL, time.Millisecond*100, time.Minute, false)
+	)
+	alice.applyWebhook(hook)
+	for dest, denied := range map[string]bool{
+		"allow.example.com:443": false,
+		"deny.example.com:443":  true,
+		"slow.example.com:443":  true,
+		"error.example.com:443": true,
+	} {
+		if alice.mux.filter.Filter(dest) != denied {
+			t.Errorf("%s: denied=%t", dest, !denied)
+		}
+	}
+	if s := hook.String(); s != "Webhook-calls=4 Webhook-denied=1 Webhook-errors=2" {
+		t.Errorf("unexpected stats %s", s)
+	}
+	// decisions were cached but errors were not
+	atomic.StoreInt32(&hits, 0)
+	alice.mux.filter.Filter("allow.example.com:443")
+	alice.mux.filter.Filter("deny.example.com:443")
+	if alice.mux.filter.Filter("error.example.com:443"); atomic.LoadInt32(&hits) != 1 {
+		t.Errorf("webhook hits=%d", hits)
+	}
+	// another user
+	bob := newTestSession(serv, "bob")
+	bob.applyWebhook(hook)
+	if !bob.mux.filter.Filter("allow.example.com:443") {
+		t.Errorf("cached decision of other user was used")
+	}
+}
+
+func TestAuthWebhookFailOpen(t *testing.T) {
+	var hits int32
+	ts := mockWebhook(&hits)
+	var (
+		serv  = newTestServer()
+		alice = newTestSession(serv, "alice")
+		hook  = newAuthWebhook(ts.URL, time.Millisecond*100, 0, true)
+	)
+	alice.applyWebhook(hook)
+	for _, dest := range []string{"slow.example.com:443", "error.example.com:443"} {
+		if alice.mux.filter.Filter(dest) {
+			t.Errorf("%s was denied in fail-open", dest)
+		}
+	}
+	// still denied explicitly
+	if !alice.mux.filter.Filter("deny.example.com:443") {
+		t.Errorf("denial was ignored in fail-open")
+	}
+	ts.Close()
+	if alice.mux.filter.Filter("allow.example.com:443") {
+		t.Errorf("unreachable webhook denied in fail-open")
+	}
+	if s := hook.String(); s != "Webhook-calls=4 Webhook-denied=1 Webhook-errors=3" {
+		t.Errorf("unexpected stats %s", s)
+	}
+}
@@ -0,0 +1,405 @@
+package tunnel
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Lafeng/deblocus/exception"
+	log "github.com/Lafeng/deblocus/glog"
+)
+
+const (
+	WS_GUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+	// opcodes
+	WS_OP_CONTINUATION = 0x0
+	WS_OP_TEXT         = 0x1
+	WS_OP_BINARY       = 0x2
+	WS_OP_CLOSE        = 0x8
+	WS_OP_PING         = 0x9
+	WS_OP_PONG         = 0xa
+	// payload of control frames
+	WS_CONTROL_MAX = 125
+	// the keep-alive connections without requests
+	HTTP_IDLE_TIMEOUT = time.Minute
+)
+
+var (
+	WS_HANDSHAKE_FAILED = exception.New("WebSocket handshake failed")
+	WS_PROTOCOL_ERROR   = exception.New("WebSocket protocol error")
+)
+
+// --------------------
+// wsConn
+// --------------------
+// the tunnel carried by WebSocket binary messages, so it could be fronted by
+// CDNs or reverse proxies. the negotiation and frames of tunnel are
+// transparent to the wrapping. the control frames are handled in reading.
+type wsConn struct {
+	net.Conn
+	remote    net.Addr // of client behind the trusted proxies
+	reader    *bufio.Reader
+	masking   bool // client must mask the frames
+	wlock     sync.Mutex
+	remaining int64 // of current frame
+	mask      []byte
+	maskPos   int
+}
+
+func newWsConn(conn net.Conn, reader *bufio.Reader, isClient bool) *wsConn {
+	return &wsConn{Conn: conn, reader: reader, masking: isClient}
+}
+
+func (c *wsConn) RemoteAddr() net.Addr {
+	if c.remote != nil {
+		return c.remote
+	}
+	return c.Conn.RemoteAddr()
+}
+
+func wsAccept(key string) string {
+	sum := sha1.Sum([]byte(key + WS_GUID))
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
+
+// dial ws:// or wss:// url, the server name of config is the host of url
+// if not specified.
+func dialWebSocket(rawURL string, config *tls.Config, timeout time.Duration) (net.Conn, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	var host = u.Host
+	if _, _, err = net.SplitHostPort(host); err != nil {
+		if u.Scheme == "wss" {
+			host += ":443"
+		} else {
+			host += ":80"
+		}
+	}
+	var dialer = &net.Dialer{Timeout: timeout}
+	var conn net.Conn
+	if u.Scheme == "wss" {
+		if config == nil {
+			config = new(tls.Config)
+		}
+		if config.ServerName == NULL {
+			config = config.Clone()
+			config.ServerName = u.Hostname()
+		}
+		conn, err = tls.DialWithDialer(dialer, "tcp", host, config)
+	} else {
+		conn, err = dialer.Dial("tcp", host)
+	}
+	if err != nil {
+		return nil, err
+	}
+	conn.SetDeadline(time.Now().Add(timeout))
+	ws, err := wsHandshake(conn, u)
+	if err != nil {
+		SafeClose(conn)
+		return nil, err
+	}
+	conn.SetDeadline(ZERO_TIME)
+	return ws, nil
+}
+
+// client side handshake
+func wsHandshake(conn net.Conn, u *url.URL) (*wsConn, error) {
+	var key = base64.StdEncoding.EncodeToString(randArray(16)[:16])
+	req := &http.Request{
+		Method:     "GET",
+		URL:        &url.URL{Path: u.Path, RawQuery: u.RawQuery},
+		Proto:      "HTTP/1.1",
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		Header:     make(http.Header),
+		Host:       u.Host,
+	}
+	if req.URL.Path == NULL {
+		req.URL.Path = "/"
+	}
+	req.Header.Set("Upgrade", "websocket")
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Sec-WebSocket-Key", key)
+	req.Header.Set("Sec-WebSocket-Version", "13")
+	if err := req.Write(conn); err != nil {
+		return nil, err
+	}
+	reader := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(reader, req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols ||
+		resp.Header.Get("Sec-WebSocket-Accept") != wsAccept(key) {
+		return nil, WS_HANDSHAKE_FAILED.Apply(resp.Status)
+	}
+	return newWsConn(conn, reader, true), nil
+}
+
+// server side handshake
+func upgradeWebSocket(w http.ResponseWriter, r *http.Request) (*wsConn, error) {
+	var key = r.Header.Get("Sec-WebSocket-Key")
+	if r.Method != "GET" || !strings.EqualFold(r.Header.Get("Upgrade"), "websocket") ||
+		r.Header.Get("Sec-WebSocket-Version") != "13" || key == NULL {
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return nil, WS_HANDSHAKE_FAILED.Apply("bad request")
+	}
+	hj, y := w.(http.Hijacker)
+	if !y {
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return nil, WS_HANDSHAKE_FAILED.Apply("not hijackable")
+	}
+	conn, rw, err := hj.Hijack()
+	if err != nil {
+		return nil, err
+	}
+	rw.WriteString("HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n")
+	rw.WriteString("Sec-WebSocket-Accept: " + wsAccept(key) + "\r\n\r\n")
+	if err = rw.Flush(); err != nil {
+		SafeClose(conn)
+		return nil, err
+	}
+	return newWsConn(conn, rw.Reader, false), nil
+}
+
+func (c *wsConn) writeFrame(opcode byte, payload []byte) error {
+	var (
+		header = make([]byte, 14)
+		n      = 2
+		size   = len(payload)
+	)
+	header[0] = 0x80 | opcode // FIN
+	switch {
+	case size < 126:
+		header[1] = byte(size)
+	case size <= 0xffff:
+		header[1] = 126
+		binary.BigEndian.PutUint16(header[2:], uint16(size))
+		n = 4
+	default:
+		header[1] = 127
+		binary.BigEndian.PutUint64(header[2:], uint64(size))
+		n = 10
+	}
+	var frame []byte
+	if c.masking {
+		header[1] |= 0x80
+		mask := randArray(4)[:4]
+		copy(header[n:], mask)
+		n += 4
+		frame = bytePool.Get(n + size)
+		copy(frame, header[:n])
+		for i, b := range payload {
+			frame[n+i] = b ^ mask[i&3]
+		}
+	} else {
+		frame = bytePool.Get(n + size)
+		copy(frame, header[:n])
+		copy(frame[n:], payload)
+	}
+	c.wlock.Lock()
+	defer c.wlock.Unlock()
+	_, err := c.Conn.Write(frame)
+	bytePool.Put(frame)
+	return err
+}
+
+func (c *wsConn) Write(b []byte) (int, error) {
+	if err := c.writeFrame(WS_OP_BINARY, b); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+// read the header of next data frame, and handle the control frames
+func (c *wsConn) nextFrame() error {
+	for {
+		var header = make([]byte, 2)
+		if _, err := io.ReadFull(c.reader, header); err != nil {
+			return err
+		}
+		var (
+			opcode = header[0] & 0xf
+			masked = header[1]&0x80 != 0
+			size   = int64(header[1] & 0x7f)
+		)
+		switch size {
+		case 126:
+			ext := make([]byte, 2)
+			if _, err := io.ReadFull(c.reader, ext); err != nil {
+				return err
+			}
+			size = int64(binary.BigEndian.Uint16(ext))
+		case 127:
+			ext := make([]byte, 8)
+			if _, err := io.ReadFull(c.reader, ext); err != nil {
+				return err
+			}
+			size = int64(binary.BigEndian.Uint64(ext))
+		}
+		// the server must receive masked frames, the client must not
+		if size < 0 || masked == c.masking {
+			return WS_PROTOCOL_ERROR.Apply("masking")
+		}
+		c.mask, c.maskPos = nil, 0
+		if masked {
+			c.mask = make([]byte, 4)
+			if _, err := io.ReadFull(c.reader, c.mask); err != nil {
+				return err
+			}
+		}
+		switch opcode {
+		case WS_OP_BINARY, WS_OP_CONTINUATION, WS_OP_TEXT:
+			c.remaining = size
+			return nil
+		}
+		if size > WS_CONTROL_MAX {
+			return WS_PROTOCOL_ERROR.Apply("control frame")
+		}
+		payload := make([]byte, size)
+		if _, err := io.ReadFull(c.reader, payload); err != nil {
+			return err
+		}
+		c.unmask(payload)
+		switch opcode {
+		case WS_OP_PING:
+			if err := c.writeFrame(WS_OP_PONG, payload); err != nil {
+				return err
+			}
+		case WS_OP_PONG:
+		case WS_OP_CLOSE:
+			c.writeFrame(WS_OP_CLOSE, payload)
+			return io.EOF
+		default:
+			return WS_PROTOCOL_ERROR.Apply(opcode)
+		}
+	}
+}
+
+func (c *wsConn) unmask(b []byte) {
+	if c.mask != nil {
+		for i := range b {
+			b[i] ^= c.mask[c.maskPos&3]
+			c.maskPos++
+		}
+	}
+}
+
+func (c *wsConn) Read(b []byte) (int, error) {
+	for c.remaining == 0 {
+		if err := c.nextFrame(); err != nil {
+			return 0, err
+		}
+	}
+	if int64(len(b)) > c.remaining {
+		b = b[:c.remaining]
+	}
+	n, err := c.reader.Read(b)
+	c.unmask(b[:n])
+	c.remaining -= int64(n)
+	return n, err
+}
+
+// --------------------
+// WebSocket listener
+// --------------------
+// parse the listen address with path, eg. :8080/tunnel
+func parseListenPath(str string) (addr, path string, err error) {
+	addr, path = str, "/"
+	if i := strings.IndexByte(str, '/'); i >= 0 {
+		addr, path = str[:i], str[i:]
+	}
+	if _, err = net.ResolveTCPAddr("tcp", addr); err != nil {
+		return NULL, NULL, err
+	}
+	return addr, path, nil
+}
+
+// the address of client forwarded by the trusted proxies, which is the
+// rightmost one of X-Forwarded-For not of the proxies, or the peer itself.
+func forwardedAddr(r *http.Request, peer net.Addr, proxies []*net.IPNet) net.Addr {
+	if tcp, y := peer.(*net.TCPAddr); !y || !inNetworks(tcp.IP, proxies) {
+		return peer
+	}
+	var hops = strings.Split(strings.Join(r.Header["X-Forwarded-For"], ","), ",")
+	for i := len(hops) - 1; i >= 0; i-- {
+		ip := net.ParseIP(strings.TrimSpace(hops[i]))
+		if ip == nil {
+			break
+		}
+		if !inNetworks(ip, proxies) {
+			return &net.TCPAddr{IP: ip}
+		}
+	}
+	return peer
+}
+
+func inNetworks(ip net.IP, networks []*net.IPNet) bool {
+	for _, n := range networks {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// the upgraded connections of path are served as tunnels
+func (t *Server) webSocketHandler(path string) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc(path, func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgradeWebSocket(w, r)
+		if err != nil {
+			if log.V(log.LV_WARN) {
+				log.Warningf("Rejected WebSocket from=%s %v", r.RemoteAddr, err)
+			}
+			return
+		}
+		// the guards of source apply to the client instead of the proxy
+		if t.wsProxies != nil {
+			conn.remote = forwardedAddr(r, conn.Conn.RemoteAddr(), t.wsProxies)
+		}
+		t.TunnelServe(conn)
+	})
+	return mux
+}
+
+// the slow headers and idle connections are closed rather than held out of
+// the guards of tunnels.
+func newHTTPServer(handler http.Handler) *http.Server {
+	return &http.Server{
+		Handler:           handler,
+		ReadHeaderTimeout: GENERAL_SO_TIMEOUT,
+		IdleTimeout:       HTTP_IDLE_TIMEOUT,
+	}
+}
+
+// return nil if the WebSocket transport is not enabled
+func (t *Server) ListenWebSocket() (net.Listener, error) {
+	if t.WebSocket == NULL {
+		return nil, nil
+	}
+	addr, path, err := parseListenPath(t.WebSocket)
+	if err != nil {
+		return nil, CONF_ERROR.Apply("WebSocket")
+	}
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	if t.camouflage != nil && t.camouflage.websocket {
+		ln = tls.NewListener(ln, t.camouflage.config)
+	}
+	go newHTTPServer(t.webSocketHandler(path)).Serve(ln)
+	return ln, nil
+}
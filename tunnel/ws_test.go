@@ -0,0 +1,116 @@
+package tunnel
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestWebSocketRelay(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgradeWebSocket(w, r)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		io.Copy(conn, conn)
+	}))
+	defer srv.Close()
+
+	conn, err := dialWebSocket(strings.Replace(srv.URL, "http", "ws", 1)+"/tunnel", nil, GENERAL_SO_TIMEOUT)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	// cover the lengths of 7, 16 and 64 bits
+	for _, size := range []int{1, 125, 126, 0xffff, 0x10000, FRAME_MAX_LEN * 3} {
+		data := randArray(size)
+		go conn.Write(data)
+		echo := make([]byte, size)
+		if _, err = io.ReadFull(conn, echo); err != nil {
+			t.Fatal(size, err)
+		}
+		if !bytes.Equal(data, echo) {
+			t.Fatalf("size=%d echo mismatched", size)
+		}
+	}
+	// answered pong is skipped by the reader
+	ws := conn.(*wsConn)
+	ws.writeFrame(WS_OP_PING, []byte("ping"))
+	ws.Write([]byte("data"))
+	echo := make([]byte, 4)
+	if _, err = io.ReadFull(conn, echo); err != nil || string(echo) != "data" {
+		t.Errorf("read %q %v", echo, err)
+	}
+	ws.writeFrame(WS_OP_CLOSE, nil)
+	if _, err = conn.Read(echo); err != io.EOF {
+		t.Errorf("not closed %v", err)
+	}
+}
+
+func TestWebSocketRejected(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		upgradeWebSocket(w, r)
+	}))
+	defer srv.Close()
+
+	resp, err := http.Get(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("plain request status=%d", resp.StatusCode)
+	}
+	if _, err = dialWebSocket("ws://"+srv.Listener.Addr().String()+"/", nil, GENERAL_SO_TIMEOUT); err != nil {
+		t.Fatal(err)
+	}
+	// not a WebSocket server
+	plain := httptest.NewServer(http.NotFoundHandler())
+	defer plain.Close()
+	if _, err = dialWebSocket("ws://"+plain.Listener.Addr().String()+"/", nil, GENERAL_SO_TIMEOUT); err == nil {
+		t.Errorf("handshake with plain http server")
+	}
+}
+
+func TestForwardedAddr(t *testing.T) {
+	proxies, _ := parseNetworks([]string{"10.0.0.0/8"})
+	var (
+		proxy = &net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 80}
+		other = &net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 80}
+	)
+	for _, c := range []struct {
+		peer     net.Addr
+		xff      []string
+		expected string
+	}{
+		{proxy, []string{"203.0.113.9"}, "203.0.113.9"},
+		// the rightmost one not of the proxies, the left was told by client
+		{proxy, []string{"198.51.100.1, 203.0.113.9", "10.0.0.2"}, "203.0.113.9"},
+		{proxy, nil, "10.0.0.1"},
+		{proxy, []string{"garbage"}, "10.0.0.1"},
+		// not trusted
+		{other, []string{"203.0.113.9"}, "192.0.2.1"},
+	} {
+		r := &http.Request{Header: http.Header{"X-Forwarded-For": c.xff}}
+		if addr := forwardedAddr(r, c.peer, proxies); addr.(*net.TCPAddr).IP.String() != c.expected {
+			t.Errorf("%v %v: %s", c.peer, c.xff, addr)
+		}
+	}
+}
+
+func TestParseWebSocketListen(t *testing.T) {
+	if addr, path, err := parseListenPath(":8080/tunnel"); err != nil || addr != ":8080" || path != "/tunnel" {
+		t.Errorf("addr=%s path=%s %v", addr, path, err)
+	}
+	if _, path, err := parseListenPath("127.0.0.1:8080"); err != nil || path != "/" {
+		t.Errorf("path=%s %v", path, err)
+	}
+	if _, _, err := parseListenPath("nowhere/"); err == nil {
+		t.Errorf("accepted invalid address")
+	}
+}